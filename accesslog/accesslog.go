@@ -0,0 +1,131 @@
+// Package accesslog writes a line per request served, in Common or Combined
+// Log Format or as JSON, separately from the application log.
+package accesslog
+
+import (
+	"encoding/json"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mongo-data-api-go-alternative/auth"
+	"mongo-data-api-go-alternative/config"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// entry is a request as recorded in the JSON format
+type entry struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remoteAddr"`
+	// User is the name of the API key the request was authenticated with
+	User       string  `json:"user,omitempty"`
+	Method     string  `json:"method"`
+	URI        string  `json:"uri"`
+	Protocol   string  `json:"protocol"`
+	Status     int     `json:"status"`
+	Bytes      int     `json:"bytes"`
+	DurationMs float64 `json:"durationMs"`
+	Referer    string  `json:"referer,omitempty"`
+	UserAgent  string  `json:"userAgent,omitempty"`
+}
+
+// Middleware logs every request to w in format (config.AccessLogCommon,
+// AccessLogCombined or AccessLogJSON) once it has been handled
+func Middleware(w io.Writer, format string) fiber.Handler {
+	var mu sync.Mutex
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		if err := c.Next(); err != nil {
+			// Let the error handler set the status and body to log them
+			if err := c.App().ErrorHandler(c, err); err != nil {
+				c.SendStatus(fiber.StatusInternalServerError)
+			}
+		}
+
+		e := entry{
+			Time:       start,
+			RemoteAddr: c.IP(),
+			Method:     c.Method(),
+			URI:        redact(c.OriginalURL()),
+			Protocol:   string(c.Request().Header.Protocol()),
+			Status:     c.Response().StatusCode(),
+			Bytes:      len(c.Response().Body()),
+			DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+			Referer:    c.Get(fiber.HeaderReferer),
+			UserAgent:  c.Get(fiber.HeaderUserAgent),
+		}
+		if n := c.Response().Header.ContentLength(); n > 0 {
+			e.Bytes = n
+		}
+		if p := auth.PrincipalFromCtx(c); p != nil {
+			e.User = p.Key.Name
+		}
+
+		line := e.format(format)
+		mu.Lock()
+		w.Write(line)
+		mu.Unlock()
+		return nil
+	}
+}
+
+func (e *entry) format(format string) []byte {
+	if format == config.AccessLogJSON {
+		line, _ := json.Marshal(e)
+		return append(line, '\n')
+	}
+
+	// host ident authuser [date] "request" status bytes
+	var b strings.Builder
+	b.WriteString(e.RemoteAddr)
+	b.WriteString(" - ")
+	b.WriteString(orDash(e.User))
+	b.WriteString(" [")
+	b.WriteString(e.Time.Format("02/Jan/2006:15:04:05 -0700"))
+	b.WriteString("] ")
+	b.WriteString(strconv.Quote(e.Method + " " + e.URI + " " + e.Protocol))
+	b.WriteByte(' ')
+	b.WriteString(strconv.Itoa(e.Status))
+	b.WriteByte(' ')
+	if e.Bytes > 0 {
+		b.WriteString(strconv.Itoa(e.Bytes))
+	} else {
+		b.WriteByte('-')
+	}
+	if format == config.AccessLogCombined {
+		b.WriteByte(' ')
+		b.WriteString(strconv.Quote(orDash(e.Referer)))
+		b.WriteByte(' ')
+		b.WriteString(strconv.Quote(orDash(e.UserAgent)))
+	}
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+// redact hides the value of the token query parameter, which authenticates
+// requests like an API key
+func redact(uri string) string {
+	path, query, ok := strings.Cut(uri, "?")
+	if !ok {
+		return uri
+	}
+	params := strings.Split(query, "&")
+	for i, param := range params {
+		name, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil && unescaped == "token" {
+			params[i] = name + "=REDACTED"
+		}
+	}
+	return path + "?" + strings.Join(params, "&")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
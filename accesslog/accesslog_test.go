@@ -0,0 +1,114 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"mongo-data-api-go-alternative/config"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestFormats(t *testing.T) {
+	for _, tc := range []struct {
+		format string
+		want   []string
+	}{
+		{config.AccessLogCommon, []string{
+			`^0\.0\.0\.0 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /api/find\?token=REDACTED HTTP/1\.1" 200 5$`,
+			`^0\.0\.0\.0 - - \[[^]]+\] "POST /api/missing HTTP/1\.1" 404 \d+$`,
+		}},
+		{config.AccessLogCombined, []string{
+			`^0\.0\.0\.0 - - \[[^]]+\] "GET /api/find\?token=REDACTED HTTP/1\.1" 200 5 "https://example\.com/" "curl/8\.0"$`,
+			`^0\.0\.0\.0 - - \[[^]]+\] "POST /api/missing HTTP/1\.1" 404 \d+ "-" "-"$`,
+		}},
+	} {
+		lines := serve(t, tc.format)
+		if len(lines) != len(tc.want) {
+			t.Fatalf("%s: lines %q", tc.format, lines)
+		}
+		for i, want := range tc.want {
+			if !regexp.MustCompile(want).MatchString(lines[i]) {
+				t.Errorf("%s: line %q, want %s", tc.format, lines[i], want)
+			}
+		}
+	}
+
+	lines := serve(t, config.AccessLogJSON)
+	var found, missing entry
+	if len(lines) != 2 || json.Unmarshal([]byte(lines[0]), &found) != nil || json.Unmarshal([]byte(lines[1]), &missing) != nil {
+		t.Fatalf("json: lines %q", lines)
+	}
+	if found.Method != "GET" || found.URI != "/api/find?token=REDACTED" || found.Status != 200 || found.Bytes != 5 ||
+		found.Protocol != "HTTP/1.1" || found.Referer != "https://example.com/" || found.UserAgent != "curl/8.0" || found.Time.IsZero() {
+		t.Errorf("json: %+v", found)
+	}
+	// Errors are logged with the status the error handler answers with
+	if missing.Status != fiber.StatusNotFound || missing.Referer != "" || strings.Contains(lines[1], "referer") {
+		t.Errorf("json: %s", lines[1])
+	}
+}
+
+// serve sends a read and a request for a missing route through the
+// middleware and returns the lines logged
+func serve(t *testing.T, format string) []string {
+	t.Helper()
+	var log bytes.Buffer
+	app := fiber.New()
+	app.Use(Middleware(&log, format))
+	app.Get("/api/find", func(c *fiber.Ctx) error { return c.SendString("hello") })
+
+	req := httptest.NewRequest("GET", "/api/find?token=secret", nil)
+	req.Header.Set("Referer", "https://example.com/")
+	req.Header.Set("User-Agent", "curl/8.0")
+	for _, req := range []*http.Request{req, httptest.NewRequest("POST", "/api/missing", nil)} {
+		if _, err := app.Test(req, -1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return strings.Split(strings.TrimSuffix(log.String(), "\n"), "\n")
+}
+
+func TestRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	w, err := openFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Each line starts a new file, keeping the two newest backups
+	for file, want := range map[string]string{path: "fourth\n", path + ".1": "third\n", path + ".2": "second\n"} {
+		if got, err := os.ReadFile(file); err != nil || string(got) != want {
+			t.Errorf("%s: %q, %v; want %q", file, got, err, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("third backup kept: %v", err)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	for uri, want := range map[string]string{
+		"/api/find":                       "/api/find",
+		"/api/export?token=abc.def":       "/api/export?token=REDACTED",
+		"/api/tail?db=app&token=x&coll=y": "/api/tail?db=app&token=REDACTED&coll=y",
+		"/api/find?%74oken=x":             "/api/find?%74oken=REDACTED",
+		"/api/find?tokens=1&token":        "/api/find?tokens=1&token=REDACTED",
+	} {
+		if got := redact(uri); got != want {
+			t.Errorf("redact(%q) = %q, want %q", uri, got, want)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !windows && !plan9
+
+package accesslog
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// dialSyslog connects to a syslog daemon, the local one when network is
+// empty. Lines are logged with the local7 facility, like web server access
+// logs usually are.
+func dialSyslog(network, addr string) (io.WriteCloser, error) {
+	return syslog.Dial(network, addr, syslog.LOG_LOCAL7|syslog.LOG_INFO, "mongo-data-api")
+}
@@ -0,0 +1,104 @@
+package accesslog
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Open returns the destination of the access log: "stdout", "stderr",
+// "syslog" for the local syslog daemon, "syslog://host:port" (UDP) or
+// "syslog+tcp://host:port" for a remote one, or the path of a file. Files
+// are rotated once they reach maxSizeMB, keeping maxBackups rotated files
+// named <path>.1 (the newest) to <path>.<maxBackups>.
+func Open(output string, maxSizeMB, maxBackups int) (io.WriteCloser, error) {
+	switch {
+	case output == "" || output == "stdout":
+		return nopCloser{os.Stdout}, nil
+	case output == "stderr":
+		return nopCloser{os.Stderr}, nil
+	case output == "syslog":
+		return dialSyslog("", "")
+	case strings.HasPrefix(output, "syslog://"):
+		return dialSyslog("udp", strings.TrimPrefix(output, "syslog://"))
+	case strings.HasPrefix(output, "syslog+tcp://"):
+		return dialSyslog("tcp", strings.TrimPrefix(output, "syslog+tcp://"))
+	}
+	return openFile(output, int64(maxSizeMB)<<20, maxBackups)
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// rotatingFile is a file that is moved aside once it grows past maxSize
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+func openFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups by one, dropping the oldest, and starts a new
+// file
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	if r.maxBackups > 0 {
+		for i := r.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Truncate(r.path, 0); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
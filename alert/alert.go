@@ -0,0 +1,256 @@
+// Package alert posts a message to a webhook when the error rate or latency
+// of the API stays above a threshold, for deployments without a monitoring
+// stack of their own.
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"mongo-data-api-go-alternative/config"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// checkInterval is how often the window is compared to the thresholds
+const checkInterval = 10 * time.Second
+
+// latencyBounds are the upper bounds of the latency histogram of a slot,
+// growing by 25% from 1ms to about two minutes
+var latencyBounds = func() []time.Duration {
+	var bounds []time.Duration
+	for d := float64(time.Millisecond); d < float64(2*time.Minute); d *= 1.25 {
+		bounds = append(bounds, time.Duration(d))
+	}
+	return bounds
+}()
+
+// slot counts the requests answered within one second
+type slot struct {
+	second   int64
+	requests int
+	errors   int
+	// latency[i] counts the requests faster than latencyBounds[i] and not
+	// faster than latencyBounds[i-1]; the last count holds slower ones
+	latency []int
+}
+
+// Alerter watches the responses over a sliding window
+type Alerter struct {
+	cfg    config.AlertConfig
+	client *http.Client
+	now    func() time.Time
+	source string
+
+	skipPaths map[string]bool
+
+	mu    sync.Mutex
+	slots []slot
+	// firing holds the alerts sent and not resolved yet, by the time
+	// they were last sent
+	firing map[string]time.Time
+}
+
+// New creates an alerter for cfg, which must have a webhook URL
+func New(cfg config.AlertConfig) *Alerter {
+	source := "mongo-data-api"
+	if host, err := os.Hostname(); err == nil {
+		source += "@" + host
+	}
+	a := &Alerter{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		now:    time.Now,
+		source: source,
+		slots:  make([]slot, cfg.WindowSeconds),
+		firing: make(map[string]time.Time),
+
+		skipPaths: make(map[string]bool),
+	}
+	for i := range a.slots {
+		a.slots[i].latency = make([]int, len(latencyBounds)+1)
+	}
+	return a
+}
+
+// SetSkipPaths excludes the requests to routes from the window
+func (a *Alerter) SetSkipPaths(paths []string) {
+	for _, path := range paths {
+		a.skipPaths[path] = true
+	}
+}
+
+// Middleware records the status and duration of each request. Responses
+// with a 5xx status count as errors.
+func (a *Alerter) Middleware(c *fiber.Ctx) error {
+	start := a.now()
+	err := c.Next()
+	if a.skipPaths[c.Route().Path] {
+		return err
+	}
+
+	status := c.Response().StatusCode()
+	if err != nil {
+		status = fiber.StatusInternalServerError
+		if e, ok := err.(*fiber.Error); ok {
+			status = e.Code
+		}
+	}
+	a.record(start, a.now().Sub(start), status >= 500)
+	return err
+}
+
+func (a *Alerter) record(at time.Time, d time.Duration, failed bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	sec := at.Unix()
+	s := &a.slots[sec%int64(len(a.slots))]
+	if s.second != sec {
+		s.second, s.requests, s.errors = sec, 0, 0
+		clear(s.latency)
+	}
+	s.requests++
+	if failed {
+		s.errors++
+	}
+	i := 0
+	for i < len(latencyBounds) && d >= latencyBounds[i] {
+		i++
+	}
+	s.latency[i]++
+}
+
+// window sums the slots of the last WindowSeconds
+type window struct {
+	requests int
+	errors   int
+	latency  []int
+}
+
+func (a *Alerter) window() window {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	w := window{latency: make([]int, len(latencyBounds)+1)}
+	oldest := a.now().Unix() - int64(len(a.slots))
+	for _, s := range a.slots {
+		if s.second <= oldest || s.requests == 0 {
+			continue
+		}
+		w.requests += s.requests
+		w.errors += s.errors
+		for i, n := range s.latency {
+			w.latency[i] += n
+		}
+	}
+	return w
+}
+
+// percentile estimates the latency below which the fraction p of the
+// requests were answered, interpolating within the histogram bucket
+func (w window) percentile(p float64) time.Duration {
+	rank := p * float64(w.requests)
+	seen := 0
+	for i, n := range w.latency {
+		if n == 0 || float64(seen+n) < rank {
+			seen += n
+			continue
+		}
+		var lower, upper time.Duration
+		if i > 0 {
+			lower = latencyBounds[i-1]
+		}
+		if i == len(latencyBounds) {
+			return lower
+		}
+		upper = latencyBounds[i]
+		return lower + time.Duration((rank-float64(seen))/float64(n)*float64(upper-lower))
+	}
+	return 0
+}
+
+// Start compares the window to the thresholds periodically
+func (a *Alerter) Start() {
+	go func() {
+		for range time.Tick(checkInterval) {
+			a.check()
+		}
+	}()
+}
+
+func (a *Alerter) check() {
+	w := a.window()
+	period := time.Duration(len(a.slots)) * time.Second
+	enough := w.requests > 0 && w.requests >= a.cfg.MinRequests
+
+	if a.cfg.ErrorRate > 0 {
+		rate := 0.0
+		if w.requests > 0 {
+			rate = float64(w.errors) / float64(w.requests)
+		}
+		a.evaluate("errorRate", enough && rate > a.cfg.ErrorRate,
+			fmt.Sprintf("Error rate %s (%d of %d requests) over the last %s exceeds %s",
+				percent(rate), w.errors, w.requests, period, percent(a.cfg.ErrorRate)),
+			fmt.Sprintf("Resolved: error rate %s over the last %s is back under %s",
+				percent(rate), period, percent(a.cfg.ErrorRate)))
+	}
+	if a.cfg.LatencyMs > 0 {
+		threshold := time.Duration(a.cfg.LatencyMs) * time.Millisecond
+		p95 := w.percentile(0.95)
+		a.evaluate("latency", enough && p95 > threshold,
+			fmt.Sprintf("p95 latency %s over the last %s (%d requests) exceeds %s",
+				p95.Round(time.Millisecond), period, w.requests, threshold),
+			fmt.Sprintf("Resolved: p95 latency %s over the last %s is back under %s",
+				p95.Round(time.Millisecond), period, threshold))
+	}
+}
+
+// evaluate sends the alert while breached, at most once per cooldown, and
+// the resolution once it no longer is
+func (a *Alerter) evaluate(name string, breached bool, alert, resolved string) {
+	a.mu.Lock()
+	sent, firing := a.firing[name]
+	now := a.now()
+	send := ""
+	switch {
+	case breached && (!firing || now.Sub(sent) >= time.Duration(a.cfg.CooldownSeconds)*time.Second):
+		a.firing[name] = now
+		send = alert
+	case !breached && firing:
+		delete(a.firing, name)
+		send = resolved
+	}
+	a.mu.Unlock()
+
+	if send != "" {
+		if err := a.post(fmt.Sprintf("[%s] %s", a.source, send)); err != nil {
+			log.Printf("Failed to send alert to webhook: %v", err)
+		}
+	}
+}
+
+// post sends text as a Slack-compatible webhook message
+func (a *Alerter) post(text string) error {
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	resp, err := a.client.Post(a.cfg.WebhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+func percent(f float64) string {
+	return fmt.Sprintf("%.1f%%", f*100)
+}
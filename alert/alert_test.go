@@ -0,0 +1,142 @@
+package alert
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mongo-data-api-go-alternative/config"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// newAlerter returns an alerter posting to a test webhook, whose clock is at
+// *now, and the messages it posted
+func newAlerter(t *testing.T, cfg config.AlertConfig, now *time.Time) (*Alerter, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var messages []string
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ Text string }
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		messages = append(messages, body.Text)
+		mu.Unlock()
+	}))
+	t.Cleanup(webhook.Close)
+	cfg.WebhookURL = webhook.URL
+	a := New(cfg)
+	a.source = "test"
+	a.now = func() time.Time { return *now }
+	return a, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		sent := messages
+		messages = nil
+		return sent
+	}
+}
+
+func TestErrorRate(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	a, sent := newAlerter(t, config.AlertConfig{ErrorRate: 0.1, WindowSeconds: 60, MinRequests: 10, CooldownSeconds: 20}, &now)
+
+	// Too little traffic to alert, however many errors
+	for i := 0; i < 9; i++ {
+		a.record(now, time.Millisecond, i < 5)
+	}
+	a.check()
+	if messages := sent(); len(messages) != 0 {
+		t.Fatalf("sent %q below MinRequests", messages)
+	}
+
+	a.record(now, time.Millisecond, false)
+	a.check()
+	want := "[test] Error rate 50.0% (5 of 10 requests) over the last 1m0s exceeds 10.0%"
+	if messages := sent(); len(messages) != 1 || messages[0] != want {
+		t.Fatalf("sent %q, want %q", messages, want)
+	}
+	// Still breached: sent again once the cooldown is over
+	now = now.Add(10 * time.Second)
+	a.check()
+	if messages := sent(); len(messages) != 0 {
+		t.Errorf("sent %q during the cooldown", messages)
+	}
+	now = now.Add(10 * time.Second)
+	a.check()
+	if messages := sent(); len(messages) != 1 || !strings.Contains(messages[0], "exceeds 10.0%") {
+		t.Errorf("sent %q after the cooldown", messages)
+	}
+
+	// Successful requests bring the rate back under the threshold
+	for i := 0; i < 40; i++ {
+		a.record(now, time.Millisecond, false)
+	}
+	a.check()
+	want = "[test] Resolved: error rate 10.0% over the last 1m0s is back under 10.0%"
+	if messages := sent(); len(messages) != 1 || messages[0] != want {
+		t.Errorf("sent %q, want %q", messages, want)
+	}
+	a.check()
+	if messages := sent(); len(messages) != 0 {
+		t.Errorf("sent %q once resolved", messages)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	a, sent := newAlerter(t, config.AlertConfig{LatencyMs: 100, WindowSeconds: 60, MinRequests: 1, CooldownSeconds: 900}, &now)
+
+	for i := 0; i < 94; i++ {
+		a.record(now, 10*time.Millisecond, false)
+	}
+	for i := 0; i < 6; i++ {
+		a.record(now, time.Second, false)
+	}
+	if p95 := a.window().percentile(0.95); p95 < 800*time.Millisecond || p95 > time.Second+300*time.Millisecond {
+		t.Errorf("p95 %v, want about 1s", p95)
+	}
+	a.check()
+	if messages := sent(); len(messages) != 1 || !strings.HasPrefix(messages[0], "[test] p95 latency ") || !strings.HasSuffix(messages[0], "over the last 1m0s (100 requests) exceeds 100ms") {
+		t.Fatalf("sent %q", messages)
+	}
+
+	// Requests leave the window after WindowSeconds, so there's no longer
+	// enough traffic to alert
+	now = now.Add(time.Minute)
+	if w := a.window(); w.requests != 0 {
+		t.Errorf("window holds %d requests after a minute", w.requests)
+	}
+	a.check()
+	if messages := sent(); len(messages) != 1 || !strings.HasPrefix(messages[0], "[test] Resolved: p95 latency 0s") {
+		t.Errorf("sent %q", messages)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	a, _ := newAlerter(t, config.AlertConfig{ErrorRate: 0.1, WindowSeconds: 60}, &now)
+	a.SetSkipPaths([]string{"/api/health"})
+	app := fiber.New()
+	app.Use(a.Middleware)
+	app.Get("/api/health", func(c *fiber.Ctx) error { return fiber.ErrServiceUnavailable })
+	app.Get("/api/find", func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusOK) })
+	app.Get("/api/fail", func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusBadGateway) })
+	app.Get("/api/error", func(c *fiber.Ctx) error { return fiber.ErrBadRequest })
+
+	for _, path := range []string{"/api/health", "/api/find", "/api/fail", "/api/error"} {
+		if _, err := app.Test(httptest.NewRequest("GET", path, nil), -1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Skipped paths aren't counted, and only 5xx responses are errors
+	if w := a.window(); w.requests != 3 || w.errors != 1 {
+		t.Errorf("window has %d requests, %d errors; want 3 and 1", w.requests, w.errors)
+	}
+}
@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"mongo-data-api-go-alternative/config"
+	"mongo-data-api-go-alternative/priority"
+	"mongo-data-api-go-alternative/ratelimit"
+	"mongo-data-api-go-alternative/tenant"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const localsKey = "principal"
+
+// MiddlewareConfig configures API key authentication
+type MiddlewareConfig struct {
+	Store   *Store
+	Tenancy config.TenancyConfig
+	Limiter *ratelimit.Limiter
+	// Queue bounds the requests served at once by the priority class of
+	// their key; nil serves every request right away
+	Queue *priority.Queue
+	// Tokens verifies signed tokens presented instead of an API key; nil
+	// disables them
+	Tokens *Tokens
+	// OAuth validates OAuth2 access tokens presented in the Authorization
+	// header instead of an API key; nil disables them
+	OAuth *OAuth
+	// ScopePrefix marks the OAuth2 scopes granting roles
+	ScopePrefix string
+	// Public collections are readable by requests without credentials,
+	// which are rate limited per client IP by PublicRateLimit
+	Public          []config.PublicCollection
+	PublicRateLimit int
+	// Maintenance freezes operations while enabled; nil disables it
+	Maintenance *Maintenance
+	// ReadOnly forbids every operation but reads
+	ReadOnly bool
+	// SkipPaths are served without authentication; a trailing "*" matches
+	// every path with that prefix. Paths are relative to the prefix the
+	// middleware is mounted at.
+	SkipPaths []string
+}
+
+// Middleware authenticates requests by the apiKey header, by a signed token
+// acting for the key that issued it or by an OAuth2 access token, enforces
+// the key's rate limit, queues the request by the key's priority class and
+// attaches the principal and its tenant scope to
+// the request context
+func Middleware(cfg MiddlewareConfig) fiber.Handler {
+	var public map[string]config.PublicCollection
+	if len(cfg.Public) > 0 {
+		public = make(map[string]config.PublicCollection, len(cfg.Public))
+		for _, pc := range cfg.Public {
+			public[pc.Namespace] = pc
+		}
+	}
+	return func(c *fiber.Ctx) error {
+		path := strings.TrimPrefix(c.Path(), strings.TrimSuffix(c.Route().Path, "/"))
+		// OPTIONS requests only learn the methods of a path
+		if c.Method() == fiber.MethodOptions || skipped(path, cfg.SkipPaths) {
+			return c.Next()
+		}
+
+		var (
+			claims    *TokenClaims
+			client    *OAuthClient
+			anonymous bool
+		)
+		key, ok := cfg.Store.Lookup(c.Get("apiKey"))
+		token, header := presentedToken(c)
+		if !ok && token == "" && c.Get("apiKey") == "" && public != nil {
+			// Requests without credentials may read the public collections,
+			// queued behind those of keys
+			key = config.APIKey{Name: "anonymous:" + c.IP(), RateLimit: cfg.PublicRateLimit, Priority: config.PriorityBatch}
+			ok, anonymous = true, true
+		}
+		if !ok && token != "" {
+			var err error
+			key, claims, client, err = cfg.bearer(c, token, header)
+			switch {
+			case errors.Is(err, ErrTokenExpired):
+				return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": "Forbidden: Token expired"})
+			case errors.Is(err, ErrInvalidToken):
+				return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": "Forbidden: Invalid token"})
+			case err != nil:
+				return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"message": "Service Unavailable: " + err.Error()})
+			}
+			ok = true
+		}
+		if !ok {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"message": "Forbidden: Invalid API Key ",
+			})
+		}
+
+		if cfg.Tenancy.Mode != config.TenancyNone && key.Tenant == "" {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"message": "Forbidden: API Key is not assigned to a tenant",
+			})
+		}
+
+		if cfg.Limiter != nil {
+			if ok, wait := cfg.Limiter.Allow(key.Name, key.RateLimit); !ok {
+				c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+					"message": "Too Many Requests: rate limit exceeded",
+				})
+			}
+		}
+
+		p := &Principal{
+			Key:        key,
+			operations: cfg.Store.operations(key.Roles),
+			systemDB:   cfg.Store.SystemDatabase(),
+		}
+		switch {
+		case claims != nil:
+			p = p.restrict(claims)
+		case client != nil:
+			p.client, p.scoped, p.grants = client, true, cfg.Store.grants(client.Scopes, cfg.ScopePrefix)
+		case anonymous:
+			p = newAnonymous(key, p.systemDB, public)
+		}
+		p.readOnly = cfg.ReadOnly
+		c.Locals(localsKey, p)
+		if cfg.Maintenance != nil {
+			c.Locals(maintenanceKey, cfg.Maintenance)
+		}
+		tenant.Set(c, tenant.NewScope(cfg.Tenancy, key.Tenant))
+		if cfg.Queue != nil {
+			release, err := cfg.Queue.Acquire(c.UserContext(), key.Priority)
+			if err != nil {
+				c.Set(fiber.HeaderRetryAfter, "1")
+				return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+					"message": "Service Unavailable: " + err.Error(),
+				})
+			}
+			defer release()
+		}
+		return c.Next()
+	}
+}
+
+// AdminMiddleware authenticates admin requests by the adminKey header
+func AdminMiddleware(adminKey string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if c.Method() == fiber.MethodOptions {
+			return c.Next()
+		}
+		presented := c.Get("adminKey")
+		if adminKey == "" || subtle.ConstantTimeCompare([]byte(presented), []byte(adminKey)) != 1 {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"message": "Forbidden: Invalid Admin Key",
+			})
+		}
+		return c.Next()
+	}
+}
+
+// presentedToken returns the token of a request, from its Authorization
+// header or the token query parameter of a signed URL, and whether it came
+// from the header
+func presentedToken(c *fiber.Ctx) (string, bool) {
+	if token, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer "); ok {
+		return token, true
+	}
+	return c.Query("token"), false
+}
+
+// bearer authenticates a token presented instead of an API key: a signed
+// token, acting for the key that issued it, or an OAuth2 access token,
+// which is only accepted in the Authorization header
+func (cfg MiddlewareConfig) bearer(c *fiber.Ctx, token string, header bool) (config.APIKey, *TokenClaims, *OAuthClient, error) {
+	if cfg.Tokens != nil {
+		claims, err := cfg.Tokens.Verify(token, time.Now())
+		if err == nil {
+			key, _, err := cfg.Store.Key(claims.Key)
+			if err != nil {
+				return key, nil, nil, ErrInvalidToken
+			}
+			return key, &claims, nil, nil
+		}
+		if !errors.Is(err, ErrInvalidToken) || cfg.OAuth == nil {
+			return config.APIKey{}, nil, nil, err
+		}
+	}
+	if cfg.OAuth == nil || !header {
+		return config.APIKey{}, nil, nil, ErrInvalidToken
+	}
+	client, err := cfg.OAuth.Validate(c.Context(), token)
+	if err != nil {
+		return config.APIKey{}, nil, nil, err
+	}
+	return cfg.OAuth.key(client), nil, client, nil
+}
+
+func skipped(path string, skipPaths []string) bool {
+	for _, p := range skipPaths {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(path, prefix) {
+				return true
+			}
+		} else if path == p {
+			return true
+		}
+	}
+	return false
+}
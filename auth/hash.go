@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"strings"
+
+	"mongo-data-api-go-alternative/config"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// keyPrefixLen is the number of leading characters of a key kept in the
+// clear in its hash, to find the hash to check a presented key against
+const keyPrefixLen = 8
+
+// HashKey returns the keyHash of an API key: its first characters and its
+// bcrypt hash, separated by a colon
+func HashKey(key string) (string, error) {
+	if len(key) < 2*keyPrefixLen {
+		return "", fmt.Errorf("keys must be at least %d characters to be hashed", 2*keyPrefixLen)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(key), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return key[:keyPrefixLen] + ":" + string(hash), nil
+}
+
+// MaskKey returns a key's secret for display: the last characters of a
+// plaintext key, or the prefix of a hashed one
+func MaskKey(k config.APIKey) string {
+	if prefix, _, ok := splitHash(k.KeyHash); ok && k.Key == "" {
+		return prefix + "****"
+	}
+	if len(k.Key) > 4 {
+		return "****" + k.Key[len(k.Key)-4:]
+	}
+	return "****"
+}
+
+// splitHash returns the prefix and bcrypt hash of a keyHash
+func splitHash(keyHash string) (prefix string, hash []byte, ok bool) {
+	prefix, h, ok := strings.Cut(keyHash, ":")
+	return prefix, []byte(h), ok && len(prefix) == keyPrefixLen
+}
+
+// digest indexes keys, so that looking one up does not compare the
+// presented secret byte by byte
+func digest(key string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(key))
+}
+
+// matches reports whether a presented key is the key of k, comparing
+// plaintext keys in constant time
+func matches(k config.APIKey, presented string) bool {
+	if k.Key != "" {
+		return subtle.ConstantTimeCompare([]byte(k.Key), []byte(presented)) == 1
+	}
+	_, hash, ok := splitHash(k.KeyHash)
+	return ok && bcrypt.CompareHashAndPassword(hash, []byte(presented)) == nil
+}
@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrMaintenance is matched by the errors Authorize returns for operations
+// frozen by maintenance mode
+var ErrMaintenance = errors.New("maintenance")
+
+// defaultRetryAfter is the Retry-After of maintenance mode without
+// retryAfterSeconds
+const defaultRetryAfter = 60
+
+const maintenanceKey = "maintenance"
+
+// readOperations are still served in maintenance mode unless reads are
+// frozen too, and the only operations of read-only instances
+var readOperations = map[string]bool{
+	"findOne": true, "find": true, "aggregate": true, "export": true, "tail": true, "stats": true,
+}
+
+// MaintenanceState is the maintenance mode set through the admin API
+type MaintenanceState struct {
+	Enabled bool `json:"enabled" bson:"enabled"`
+	// Reads freezes reads as well as writes
+	Reads bool `json:"reads" bson:"reads"`
+	// RetryAfterSeconds is sent as Retry-After (default 60)
+	RetryAfterSeconds int `json:"retryAfterSeconds,omitempty" bson:"retryAfterSeconds,omitempty"`
+	// Message is returned to clients instead of the default explanation
+	Message string     `json:"message,omitempty" bson:"message,omitempty"`
+	Since   *time.Time `json:"since,omitempty" bson:"since,omitempty"`
+}
+
+// MaintenanceError rejects an operation frozen by maintenance mode
+type MaintenanceError struct {
+	Operation  string
+	RetryAfter int
+	Message    string
+}
+
+func (e *MaintenanceError) Error() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	return fmt.Sprintf("operation %s is unavailable during maintenance", e.Operation)
+}
+
+// Is matches ErrMaintenance
+func (e *MaintenanceError) Is(target error) bool { return target == ErrMaintenance }
+
+// Maintenance holds the maintenance mode, persisted in the system database
+// when attached so that every instance follows it
+type Maintenance struct {
+	mu    sync.RWMutex
+	state MaintenanceState
+	coll  *mongo.Collection
+}
+
+// State returns the current maintenance mode
+func (m *Maintenance) State() MaintenanceState {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.state
+}
+
+// Set changes the maintenance mode. Since records when it was enabled.
+func (m *Maintenance) Set(ctx context.Context, state MaintenanceState) (MaintenanceState, error) {
+	if state.RetryAfterSeconds < 0 {
+		return state, fmt.Errorf("retryAfterSeconds must not be negative")
+	}
+	if !state.Enabled {
+		state = MaintenanceState{}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case !state.Enabled:
+	case m.state.Enabled:
+		state.Since = m.state.Since
+	default:
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		state.Since = &now
+	}
+	if m.coll != nil {
+		opts := options.Replace().SetUpsert(true)
+		if _, err := m.coll.ReplaceOne(ctx, bson.D{{Key: "_id", Value: maintenanceKey}}, state, opts); err != nil {
+			return state, err
+		}
+	}
+	m.state = state
+	return state, nil
+}
+
+// Attach persists the maintenance mode in coll and loads it
+func (m *Maintenance) Attach(ctx context.Context, coll *mongo.Collection) error {
+	m.coll = coll
+	return m.Reload(ctx)
+}
+
+// StartRefresh periodically reloads the maintenance mode so changes made
+// through another instance are picked up
+func (m *Maintenance) StartRefresh(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			if err := m.Reload(ctx); err != nil {
+				log.Printf("Failed to reload maintenance mode: %v", err)
+			}
+			cancel()
+		}
+	}()
+}
+
+// Reload replaces the maintenance mode with the persisted one
+func (m *Maintenance) Reload(ctx context.Context) error {
+	if m.coll == nil {
+		return nil
+	}
+	var state MaintenanceState
+	err := m.coll.FindOne(ctx, bson.D{{Key: "_id", Value: maintenanceKey}}).Decode(&state)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return err
+	}
+	m.mu.Lock()
+	m.state = state
+	m.mu.Unlock()
+	return nil
+}
+
+// check returns a MaintenanceError when op is frozen
+func (m *Maintenance) check(op string) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if !m.state.Enabled || readOperations[op] && !m.state.Reads {
+		return nil
+	}
+	retryAfter := m.state.RetryAfterSeconds
+	if retryAfter == 0 {
+		retryAfter = defaultRetryAfter
+	}
+	return &MaintenanceError{Operation: op, RetryAfter: retryAfter, Message: m.state.Message}
+}
+
+// maintenanceFromCtx returns the maintenance mode the request is subject to
+func maintenanceFromCtx(c *fiber.Ctx) *Maintenance {
+	m, _ := c.Locals(maintenanceKey).(*Maintenance)
+	return m
+}
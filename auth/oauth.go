@@ -0,0 +1,312 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"mongo-data-api-go-alternative/config"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// jwksTTL is how long the signing keys of the identity provider are
+	// used before they are fetched again, and jwksRetry the least time
+	// between fetches prompted by tokens signed with unknown keys
+	jwksTTL   = time.Hour
+	jwksRetry = time.Minute
+	// introspectionTTL bounds how long the introspection of a token is
+	// reused, so that revoked tokens stop working soon
+	introspectionTTL = time.Minute
+)
+
+// OAuthClient is a machine client authenticated by an OAuth2 access token
+type OAuthClient struct {
+	ID     string
+	Scopes []string
+	Tenant string
+}
+
+// OAuth validates OAuth2 access tokens issued by an identity provider
+type OAuth struct {
+	cfg    config.OAuthConfig
+	client *http.Client
+
+	mu            sync.Mutex
+	keys          map[string]interface{} // public keys by kid
+	fetched       time.Time
+	introspection map[[sha256.Size]byte]introspected
+}
+
+type introspected struct {
+	client  *OAuthClient
+	expires time.Time
+}
+
+// NewOAuth returns a validator of the tokens of the identity provider
+// configured in cfg
+func NewOAuth(cfg config.OAuthConfig) *OAuth {
+	return &OAuth{
+		cfg:           cfg,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		introspection: make(map[[sha256.Size]byte]introspected),
+	}
+}
+
+// Validate returns the client an access token was issued to. JWTs are
+// verified with the published keys when a JWKS URL is configured; other
+// tokens are introspected.
+func (o *OAuth) Validate(ctx context.Context, token string) (*OAuthClient, error) {
+	if o.cfg.JWKSURL != "" && strings.Count(token, ".") == 2 {
+		return o.validateJWT(ctx, token)
+	}
+	if o.cfg.IntrospectionURL != "" {
+		return o.introspect(ctx, token)
+	}
+	return nil, ErrInvalidToken
+}
+
+// key returns the API key a client acts as
+func (o *OAuth) key(client *OAuthClient) config.APIKey {
+	return config.APIKey{Name: "oauth:" + client.ID, Tenant: client.Tenant, RateLimit: o.cfg.RateLimit}
+}
+
+func (o *OAuth) validateJWT(ctx context.Context, token string) (*OAuthClient, error) {
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30 * time.Second),
+	}
+	if o.cfg.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(o.cfg.Issuer))
+	}
+	if o.cfg.Audience != "" {
+		opts = append(opts, jwt.WithAudience(o.cfg.Audience))
+	}
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return o.signingKey(ctx, kid)
+	}, opts...)
+	if err != nil {
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			return nil, ErrTokenExpired
+		}
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	return o.clientOf(claims)
+}
+
+// signingKey returns the published key of a kid, fetching the keys again
+// when they are stale or the kid is unknown
+func (o *OAuth) signingKey(ctx context.Context, kid string) (interface{}, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	key, ok := o.keys[kid]
+	age := time.Since(o.fetched)
+	if ok && age < jwksTTL {
+		return key, nil
+	}
+	if ok || age >= jwksRetry {
+		keys, err := o.fetchKeys(ctx)
+		if err != nil {
+			if ok {
+				// Keep using the known key while the provider is unreachable
+				return key, nil
+			}
+			return nil, err
+		}
+		o.keys, o.fetched = keys, time.Now()
+	}
+	if key, ok := o.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// jwk is a public key of a JWK set (RFC 7517)
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (o *OAuth) fetchKeys(ctx context.Context) (map[string]interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.cfg.JWKSURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching JWKS: %s", resp.Status)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("decoding JWKS: %w", err)
+	}
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		// Keys of unsupported types are left out
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// introspect asks the identity provider about a token (RFC 7662). Active
+// tokens are remembered until they expire, for at most introspectionTTL.
+func (o *OAuth) introspect(ctx context.Context, token string) (*OAuthClient, error) {
+	sum := sha256.Sum256([]byte(token))
+	now := time.Now()
+	o.mu.Lock()
+	cached, ok := o.introspection[sum]
+	o.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.client, nil
+	}
+
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.cfg.IntrospectionURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(o.cfg.ClientID), url.QueryEscape(o.cfg.ClientSecret))
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("introspecting token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspecting token: %s", resp.Status)
+	}
+	claims := jwt.MapClaims{}
+	if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return nil, fmt.Errorf("decoding introspection: %w", err)
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return nil, ErrInvalidToken
+	}
+	expires := now.Add(introspectionTTL)
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		if !now.Before(exp.Time) {
+			return nil, ErrTokenExpired
+		}
+		if exp.Before(expires) {
+			expires = exp.Time
+		}
+	}
+	client, err := o.clientOf(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for k, e := range o.introspection {
+		if !now.Before(e.expires) {
+			delete(o.introspection, k)
+		}
+	}
+	o.introspection[sum] = introspected{client: client, expires: expires}
+	return client, nil
+}
+
+// clientOf returns the client of a token's claims. The client is named by
+// client_id (RFC 9068), azp or sub, and its scopes are listed in scope or
+// scp.
+func (o *OAuth) clientOf(claims jwt.MapClaims) (*OAuthClient, error) {
+	client := &OAuthClient{}
+	for _, name := range []string{"client_id", "azp", "sub"} {
+		if id, _ := claims[name].(string); id != "" {
+			client.ID = id
+			break
+		}
+	}
+	if client.ID == "" {
+		return nil, fmt.Errorf("%w: no client_id, azp or sub claim", ErrInvalidToken)
+	}
+	if scopes, ok := claims["scope"].(string); ok {
+		client.Scopes = strings.Fields(scopes)
+	}
+	switch scopes := claims["scp"].(type) {
+	case string:
+		client.Scopes = append(client.Scopes, strings.Fields(scopes)...)
+	case []interface{}:
+		for _, s := range scopes {
+			if s, ok := s.(string); ok {
+				client.Scopes = append(client.Scopes, s)
+			}
+		}
+	}
+	if o.cfg.TenantClaim != "" {
+		client.Tenant, _ = claims[o.cfg.TenantClaim].(string)
+	}
+	return client, nil
+}
@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"fmt"
+
+	"mongo-data-api-go-alternative/config"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Namespace is a collection of a database read or written by a pipeline
+type Namespace struct {
+	Database   string `json:"database"`
+	Collection string `json:"collection"`
+}
+
+// joinStages are the stages reading another collection
+var joinStages = map[string]bool{"$lookup": true, "$graphLookup": true, "$unionWith": true}
+
+// AuthorizeJoins checks the collections that the pipeline of an aggregation
+// on database.collection joins. The requesting key must be allowed to
+// aggregate each joined collection itself, and joins of another database
+// also need one of rules allowing them.
+func AuthorizeJoins(c *fiber.Ctx, rules []config.JoinRule, database, collection string, pipeline interface{}) error {
+	stages, _ := pipeline.(bson.A)
+	source := database + "." + collection
+	for _, joined := range JoinedNamespaces(stages, database) {
+		target := joined.Database + "." + joined.Collection
+		if joined.Database != database && !joinAllowed(rules, source, target) {
+			return fmt.Errorf("%w: joining %s from %s is not allowed", ErrForbidden, target, source)
+		}
+		if err := Authorize(c, "aggregate", joined.Database, joined.Collection); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// joinAllowed reports whether one of rules allows an aggregation on source
+// to join target
+func joinAllowed(rules []config.JoinRule, source, target string) bool {
+	for _, r := range rules {
+		if r.Allows(source, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// JoinedNamespaces returns the collections the join stages of a pipeline
+// running on database read, including those of the pipelines nested in
+// joins and $facet. A joined collection in another database is named
+// {db: ..., coll: ...}; nested pipelines run on the database they join.
+func JoinedNamespaces(stages bson.A, database string) []Namespace {
+	var joined []Namespace
+	for _, st := range stages {
+		stage, ok := st.(bson.D)
+		if !ok || len(stage) == 0 {
+			continue
+		}
+		name, spec := stage[0].Key, stage[0].Value
+		if name == "$facet" {
+			if d, ok := spec.(bson.D); ok {
+				for _, e := range d {
+					if sub, ok := e.Value.(bson.A); ok {
+						joined = append(joined, JoinedNamespaces(sub, database)...)
+					}
+				}
+			}
+			continue
+		}
+		if !joinStages[name] {
+			continue
+		}
+		ns := Namespace{Database: database}
+		switch s := spec.(type) {
+		case string:
+			// {$unionWith: "collection"}
+			ns.Collection = s
+			joined = append(joined, ns)
+			continue
+		case bson.D:
+			target := field(s, "from")
+			if name == "$unionWith" {
+				target = s
+			}
+			switch t := target.(type) {
+			case string:
+				ns.Collection = t
+			case bson.D:
+				if db, ok := field(t, "db").(string); ok {
+					ns.Database = db
+				}
+				ns.Collection, _ = field(t, "coll").(string)
+			}
+			// A $lookup with only a pipeline, e.g. of $documents, joins
+			// no collection
+			if ns.Collection != "" {
+				joined = append(joined, ns)
+			}
+			if sub, ok := field(s, "pipeline").(bson.A); ok {
+				joined = append(joined, JoinedNamespaces(sub, ns.Database)...)
+			}
+		}
+	}
+	return joined
+}
+
+// OutputNamespace returns the collection written by the $out or $merge
+// stage of pipeline, or nil when it has none. database is the database the
+// pipeline runs on. Writing to it needs the aggregateWrite operation.
+func OutputNamespace(pipeline interface{}, database string) (*Namespace, error) {
+	stages, _ := pipeline.(bson.A)
+	for i, st := range stages {
+		stage, ok := st.(bson.D)
+		if !ok || len(stage) == 0 || (stage[0].Key != "$out" && stage[0].Key != "$merge") {
+			continue
+		}
+		if i != len(stages)-1 {
+			return nil, fmt.Errorf("%s must be the last stage", stage[0].Key)
+		}
+		target := stage[0].Value
+		if spec, ok := target.(bson.D); ok && stage[0].Key == "$merge" {
+			target = field(spec, "into")
+		}
+		switch t := target.(type) {
+		case string:
+			return &Namespace{Database: database, Collection: t}, nil
+		case bson.D:
+			ns := &Namespace{Database: database}
+			if db, ok := field(t, "db").(string); ok {
+				ns.Database = db
+			}
+			if coll, ok := field(t, "coll").(string); ok {
+				ns.Collection = coll
+				return ns, nil
+			}
+		}
+		return nil, fmt.Errorf("invalid %s stage", stage[0].Key)
+	}
+	return nil, nil
+}
+
+// field returns the value of key in d, or nil
+func field(d bson.D, key string) interface{} {
+	for _, e := range d {
+		if e.Key == key {
+			return e.Value
+		}
+	}
+	return nil
+}
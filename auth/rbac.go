@@ -0,0 +1,245 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"mongo-data-api-go-alternative/config"
+	"mongo-data-api-go-alternative/tenant"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ErrForbidden is returned when a key may not perform an operation
+var ErrForbidden = errors.New("forbidden")
+
+const savedQueryKey = "savedQuery"
+
+// Operations lists every data operation that roles can grant. Roles can also
+// grant "run" (every saved query) or "run:<name>" (a single saved query).
+var Operations = []string{
+	"insertOne", "insertMany",
+	"findOne", "find",
+	"updateOne", "updateMany",
+	"deleteOne", "deleteMany",
+	"aggregate",
+	"import", "export", "tail", "clone", "stats", "aggregateWrite", "upsert",
+}
+
+var builtinRoles = map[string][]string{
+	"read":      {"findOne", "find", "aggregate", "export", "tail"},
+	"readWrite": {"*"},
+}
+
+// ValidateRole checks that a role only grants known operations
+func ValidateRole(r config.Role) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	for _, op := range r.Operations {
+		if op != "*" && op != "run" && !strings.HasPrefix(op, "run:") && !isOperation(op) {
+			return fmt.Errorf("role %q: unknown operation %q", r.Name, op)
+		}
+	}
+	return nil
+}
+
+func isOperation(op string) bool {
+	for _, o := range Operations {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	Key config.APIKey
+
+	operations map[string]bool // nil means unrestricted
+	systemDB   string
+	token      *TokenClaims
+	// client is the OAuth2 client of the request
+	client *OAuthClient
+	// public holds the public collections an anonymous request may read
+	public map[string]config.PublicCollection
+	// scoped principals are allowed their grants instead of operations on
+	// the namespaces of Key
+	scoped bool
+	grants []grant
+	// readOnly principals are served by a read-only instance
+	readOnly bool
+}
+
+// grant is the operations a scope allows on a namespace pattern
+type grant struct {
+	operations map[string]bool // nil means every operation
+	namespace  string          // empty means every namespace
+}
+
+func (g grant) allows(ops []string, ns string) bool {
+	if g.namespace != "" {
+		if ok, _ := path.Match(g.namespace, ns); !ok {
+			return false
+		}
+	}
+	for _, op := range ops {
+		if g.operations == nil || g.operations[op] {
+			return true
+		}
+	}
+	return false
+}
+
+// Client returns the OAuth2 client the request was authenticated as, or nil
+// for API keys
+func (p *Principal) Client() *OAuthClient {
+	return p.client
+}
+
+// Anonymous reports whether the request came without credentials, to read
+// public collections
+func (p *Principal) Anonymous() bool {
+	return p.public != nil
+}
+
+// Public returns the public collection an anonymous request reads, if
+// database.collection is one
+func (p *Principal) Public(database, collection string) (config.PublicCollection, bool) {
+	if p == nil {
+		return config.PublicCollection{}, false
+	}
+	pc, ok := p.public[database+"."+collection]
+	return pc, ok
+}
+
+// newAnonymous returns the principal of requests without credentials, which
+// may run find and findOne on the public collections
+func newAnonymous(key config.APIKey, systemDB string, public map[string]config.PublicCollection) *Principal {
+	p := &Principal{Key: key, systemDB: systemDB, public: public, scoped: true}
+	for ns := range public {
+		p.grants = append(p.grants, grant{operations: map[string]bool{"find": true, "findOne": true}, namespace: ns})
+	}
+	return p
+}
+
+// Token returns the claims of the signed token the request was
+// authenticated with, or nil for API keys
+func (p *Principal) Token() *TokenClaims {
+	return p.token
+}
+
+// restrict returns the principal of a token issued by p: the operations of
+// the token that p can still run, on the token's namespace if p can still
+// access it
+func (p *Principal) restrict(claims *TokenClaims) *Principal {
+	r := &Principal{Key: p.Key, operations: map[string]bool{}, systemDB: p.systemDB, token: claims}
+	r.Key.Namespaces = []string{claims.Namespace}
+	database, collection, _ := strings.Cut(claims.Namespace, ".")
+	if !p.CanAccess(database, collection) {
+		return r
+	}
+	for _, op := range claims.Operations {
+		if p.Can(op) {
+			r.operations[op] = true
+		}
+	}
+	return r
+}
+
+// Can reports whether the principal may run op
+func (p *Principal) Can(op string) bool {
+	if p.scoped {
+		for _, g := range p.grants {
+			if g.operations == nil || g.operations[op] {
+				return true
+			}
+		}
+		return false
+	}
+	return p.operations == nil || p.operations[op]
+}
+
+// CanAccess reports whether the namespace allowlist covers database.collection
+func (p *Principal) CanAccess(database, collection string) bool {
+	ns := database + "." + collection
+	if p.scoped {
+		for _, g := range p.grants {
+			if g.namespace == "" {
+				return true
+			}
+			if ok, _ := path.Match(g.namespace, ns); ok {
+				return true
+			}
+		}
+		return false
+	}
+	if len(p.Key.Namespaces) == 0 {
+		return true
+	}
+	for _, pattern := range p.Key.Namespaces {
+		if ok, _ := path.Match(pattern, ns); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// granted reports whether a single grant of the client allows one of ops on
+// ns
+func (p *Principal) granted(ops []string, ns string) bool {
+	for _, g := range p.grants {
+		if g.allows(ops, ns) {
+			return true
+		}
+	}
+	return false
+}
+
+// PrincipalFromCtx returns the principal stored on the request context
+func PrincipalFromCtx(c *fiber.Ctx) *Principal {
+	p, _ := c.Locals(localsKey).(*Principal)
+	return p
+}
+
+// RunningSavedQuery marks the request as executing the named saved query, so
+// the underlying operation is authorized by the "run" permissions instead
+func RunningSavedQuery(c *fiber.Ctx, name string) {
+	c.Locals(savedQueryKey, name)
+}
+
+// Authorize checks that the request's principal may run op against the
+// (logical) database and collection, and that maintenance mode does not
+// freeze op, in which case the error matches ErrMaintenance
+func Authorize(c *fiber.Ctx, op, database, collection string) error {
+	p := PrincipalFromCtx(c)
+	if p == nil {
+		return fmt.Errorf("%w: not authenticated", ErrForbidden)
+	}
+	ops := []string{op}
+	if name, ok := c.Locals(savedQueryKey).(string); ok {
+		if !p.Can("run") && !p.Can("run:"+name) {
+			return fmt.Errorf("%w: saved query %s is not permitted for this API key", ErrForbidden, name)
+		}
+		ops = []string{"run", "run:" + name}
+	} else if !p.Can(op) {
+		return fmt.Errorf("%w: operation %s is not permitted for this API key", ErrForbidden, op)
+	}
+	if !p.CanAccess(database, collection) {
+		return fmt.Errorf("%w: namespace %s.%s is not permitted for this API key", ErrForbidden, database, collection)
+	}
+	if p.scoped && !p.granted(ops, database+"."+collection) {
+		// Each grant allows its operations on its own namespace only
+		return fmt.Errorf("%w: operation %s on %s.%s is not permitted for this client", ErrForbidden, op, database, collection)
+	}
+	if tenant.FromCtx(c).Database(database) == p.systemDB {
+		return fmt.Errorf("%w: database %s is reserved", ErrForbidden, database)
+	}
+	if p.readOnly && !readOperations[op] {
+		return fmt.Errorf("%w: operation %s is not available on this read-only instance", ErrForbidden, op)
+	}
+	return maintenanceFromCtx(c).check(op)
+}
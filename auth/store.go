@@ -0,0 +1,563 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"mongo-data-api-go-alternative/config"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxRejected bounds the digests of unknown keys remembered by a Store
+const maxRejected = 10000
+
+// Store errors
+var (
+	ErrNotFound = errors.New("not found")
+	ErrReadOnly = errors.New("defined in configuration and cannot be modified")
+	ErrConflict = errors.New("already exists")
+)
+
+// Store holds API keys and roles. Entries from the configuration are
+// read-only; entries created through the admin API are persisted in the
+// system database and shared by all instances.
+type Store struct {
+	mu       sync.RWMutex
+	keys     map[string]keyEntry          // by name
+	byDigest map[[sha256.Size]byte]string // plaintext key digest -> name
+	byPrefix map[string][]string          // hashed key prefix -> names
+	// verified remembers the digests of keys that matched a hash, so that
+	// bcrypt runs once per key; it is emptied whenever keys change
+	verified map[[sha256.Size]byte]string
+	// rejected remembers the digests of keys that matched no hash, so that
+	// repeating an invalid key does not run bcrypt again; it is emptied
+	// whenever keys change or it holds maxRejected digests
+	rejected   map[[sha256.Size]byte]struct{}
+	generation int
+	roles      map[string]roleEntry
+	systemDB   string
+
+	keysColl  *mongo.Collection
+	rolesColl *mongo.Collection
+}
+
+type keyEntry struct {
+	config.APIKey
+	static bool
+}
+
+type roleEntry struct {
+	config.Role
+	static bool
+}
+
+// NewStore builds a key store from the configured keys and roles
+func NewStore(cfg *config.Config) (*Store, error) {
+	s := &Store{
+		keys:     make(map[string]keyEntry),
+		byDigest: make(map[[sha256.Size]byte]string),
+		byPrefix: make(map[string][]string),
+		verified: make(map[[sha256.Size]byte]string),
+		rejected: make(map[[sha256.Size]byte]struct{}),
+		roles:    make(map[string]roleEntry),
+		systemDB: cfg.SystemDatabase,
+	}
+	if err := s.SetStatic(cfg.APIKeys, cfg.Roles); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SetStatic replaces the keys and roles from the configuration, e.g. when
+// it is reloaded. They take precedence over persisted entries of the same
+// name; persisted entries they shadowed come back with the next Reload.
+func (s *Store) SetStatic(keys []config.APIKey, roles []config.Role) error {
+	for _, r := range roles {
+		if err := ValidateRole(r); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, e := range s.keys {
+		if e.static {
+			s.unindex(e.APIKey)
+			delete(s.keys, name)
+		}
+	}
+	for name, e := range s.roles {
+		if e.static {
+			delete(s.roles, name)
+		}
+	}
+	for name, ops := range builtinRoles {
+		s.roles[name] = roleEntry{Role: config.Role{Name: name, Operations: ops}, static: true}
+	}
+	for _, r := range roles {
+		s.roles[r.Name] = roleEntry{Role: r, static: true}
+	}
+	for _, k := range keys {
+		if e, ok := s.keys[k.Name]; ok {
+			s.unindex(e.APIKey)
+		}
+		if name, ok := s.byDigest[digest(k.Key)]; ok && k.Key != "" {
+			s.unindex(s.keys[name].APIKey)
+			delete(s.keys, name)
+		}
+		s.keys[k.Name] = keyEntry{APIKey: k, static: true}
+		s.index(k)
+	}
+	return nil
+}
+
+// Attach enables persistence in the given collections and loads the keys and
+// roles stored there
+func (s *Store) Attach(ctx context.Context, keys, roles *mongo.Collection) error {
+	s.keysColl, s.rolesColl = keys, roles
+	if err := s.Reload(ctx); err != nil {
+		return err
+	}
+	return s.migrateKeys(ctx)
+}
+
+// migrateKeys hashes the persisted keys stored in plaintext before keys
+// were hashed at rest. Keys too short to be hashed are left as they are.
+func (s *Store) migrateKeys(ctx context.Context) error {
+	var plain []config.APIKey
+	s.mu.RLock()
+	for _, e := range s.keys {
+		if !e.static && e.Key != "" {
+			plain = append(plain, e.APIKey)
+		}
+	}
+	s.mu.RUnlock()
+
+	hashed := 0
+	for _, k := range plain {
+		if len(k.Key) < 2*keyPrefixLen {
+			log.Printf("API key %q is too short to be hashed, replace it", k.Name)
+			continue
+		}
+		if _, err := s.PutKey(ctx, k); err != nil {
+			return fmt.Errorf("hashing key %q: %w", k.Name, err)
+		}
+		hashed++
+	}
+	if hashed > 0 {
+		log.Printf("Hashed %d plaintext API keys", hashed)
+	}
+	return nil
+}
+
+// StartRefresh periodically reloads persisted entries so changes made
+// through another instance are picked up
+func (s *Store) StartRefresh(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			if err := s.Reload(ctx); err != nil {
+				log.Printf("Failed to reload API keys: %v", err)
+			}
+			cancel()
+		}
+	}()
+}
+
+// Reload replaces the persisted entries with the current database contents
+func (s *Store) Reload(ctx context.Context) error {
+	if s.keysColl == nil {
+		return nil
+	}
+
+	var keys []config.APIKey
+	cursor, err := s.keysColl.Find(ctx, bson.D{})
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(ctx, &keys); err != nil {
+		return err
+	}
+
+	var roles []config.Role
+	cursor, err = s.rolesColl.Find(ctx, bson.D{})
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(ctx, &roles); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, e := range s.keys {
+		if !e.static {
+			s.unindex(e.APIKey)
+			delete(s.keys, name)
+		}
+	}
+	for _, k := range keys {
+		if e, ok := s.keys[k.Name]; ok && e.static {
+			continue
+		}
+		if _, taken := s.byDigest[digest(k.Key)]; taken && k.Key != "" {
+			continue
+		}
+		s.keys[k.Name] = keyEntry{APIKey: k}
+		s.index(k)
+	}
+	for name, e := range s.roles {
+		if !e.static {
+			delete(s.roles, name)
+		}
+	}
+	for _, r := range roles {
+		if e, ok := s.roles[r.Name]; ok && e.static {
+			continue
+		}
+		s.roles[r.Name] = roleEntry{Role: r}
+	}
+	return nil
+}
+
+// SystemDatabase returns the database that data endpoints may not access
+func (s *Store) SystemDatabase() string {
+	return s.systemDB
+}
+
+// Lookup returns the key definition for a presented key. Plaintext keys are
+// compared in constant time. Hashed keys are checked with bcrypt the first
+// time they are presented, and so are keys matching none of them.
+func (s *Store) Lookup(key string) (config.APIKey, bool) {
+	if key == "" {
+		return config.APIKey{}, false
+	}
+	d := digest(key)
+	s.mu.RLock()
+	if name, ok := s.byDigest[d]; ok {
+		k := s.keys[name].APIKey
+		s.mu.RUnlock()
+		return k, matches(k, key)
+	}
+	if name, ok := s.verified[d]; ok {
+		k := s.keys[name].APIKey
+		s.mu.RUnlock()
+		return k, true
+	}
+	if _, ok := s.rejected[d]; ok {
+		s.mu.RUnlock()
+		return config.APIKey{}, false
+	}
+	var candidates []config.APIKey
+	if len(key) >= keyPrefixLen {
+		for _, name := range s.byPrefix[key[:keyPrefixLen]] {
+			candidates = append(candidates, s.keys[name].APIKey)
+		}
+	}
+	generation := s.generation
+	s.mu.RUnlock()
+
+	// bcrypt is slow, so hashes are checked without holding the lock
+	for _, k := range candidates {
+		if matches(k, key) {
+			s.mu.Lock()
+			if s.generation == generation {
+				s.verified[d] = k.Name
+			}
+			s.mu.Unlock()
+			return k, true
+		}
+	}
+	if len(candidates) > 0 {
+		s.mu.Lock()
+		if s.generation == generation {
+			if len(s.rejected) >= maxRejected {
+				s.rejected = make(map[[sha256.Size]byte]struct{})
+			}
+			s.rejected[d] = struct{}{}
+		}
+		s.mu.Unlock()
+	}
+	return config.APIKey{}, false
+}
+
+// index makes a key found by Lookup
+func (s *Store) index(k config.APIKey) {
+	if k.Key != "" {
+		s.byDigest[digest(k.Key)] = k.Name
+	} else if prefix, _, ok := splitHash(k.KeyHash); ok {
+		s.byPrefix[prefix] = append(s.byPrefix[prefix], k.Name)
+	}
+	s.changed()
+}
+
+// unindex removes a key from the indexes of Lookup
+func (s *Store) unindex(k config.APIKey) {
+	if k.Key != "" {
+		delete(s.byDigest, digest(k.Key))
+	} else if prefix, _, ok := splitHash(k.KeyHash); ok {
+		names := s.byPrefix[prefix][:0]
+		for _, name := range s.byPrefix[prefix] {
+			if name != k.Name {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			delete(s.byPrefix, prefix)
+		} else {
+			s.byPrefix[prefix] = names
+		}
+	}
+	s.changed()
+}
+
+// changed forgets the verified keys after keys are added or removed
+func (s *Store) changed() {
+	s.generation++
+	if len(s.verified) > 0 {
+		s.verified = make(map[[sha256.Size]byte]string)
+	}
+	if len(s.rejected) > 0 {
+		s.rejected = make(map[[sha256.Size]byte]struct{})
+	}
+}
+
+// Keys lists all keys sorted by name
+func (s *Store) Keys() []config.APIKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]config.APIKey, 0, len(s.keys))
+	for _, e := range s.keys {
+		keys = append(keys, e.APIKey)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+	return keys
+}
+
+// Key returns a key by name and whether it comes from the configuration
+func (s *Store) Key(name string) (config.APIKey, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.keys[name]
+	if !ok {
+		return config.APIKey{}, false, fmt.Errorf("key %q %w", name, ErrNotFound)
+	}
+	return e.APIKey, e.static, nil
+}
+
+// PutKey creates or replaces a persisted key. An empty key value is replaced
+// by a newly generated secret, unless the key is already hashed. Key values
+// are stored hashed; the returned key holds the value so that it can be
+// shown once.
+func (s *Store) PutKey(ctx context.Context, k config.APIKey) (config.APIKey, error) {
+	if k.Key == "" && k.KeyHash == "" {
+		k.Key = GenerateKey()
+	}
+	if err := k.Validate(); err != nil {
+		return k, err
+	}
+	if k.Key != "" {
+		if owner, ok := s.Lookup(k.Key); ok && owner.Name != k.Name {
+			return k, fmt.Errorf("key value %w", ErrConflict)
+		}
+		hash, err := HashKey(k.Key)
+		if err != nil {
+			return k, err
+		}
+		k.KeyHash = hash
+	}
+	stored := k
+	stored.Key = ""
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.keys[k.Name]; ok && e.static {
+		return k, fmt.Errorf("key %q is %w", k.Name, ErrReadOnly)
+	}
+	for _, r := range k.Roles {
+		if _, ok := s.roles[r]; !ok {
+			return k, fmt.Errorf("role %q %w", r, ErrNotFound)
+		}
+	}
+
+	if s.keysColl != nil {
+		opts := options.Replace().SetUpsert(true)
+		if _, err := s.keysColl.ReplaceOne(ctx, bson.D{{Key: "_id", Value: k.Name}}, stored, opts); err != nil {
+			return k, err
+		}
+	}
+	if old, ok := s.keys[k.Name]; ok {
+		s.unindex(old.APIKey)
+	}
+	s.keys[k.Name] = keyEntry{APIKey: stored}
+	s.index(stored)
+	return k, nil
+}
+
+// DeleteKey revokes a persisted key
+func (s *Store) DeleteKey(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.keys[name]
+	if !ok {
+		return fmt.Errorf("key %q %w", name, ErrNotFound)
+	}
+	if e.static {
+		return fmt.Errorf("key %q is %w", name, ErrReadOnly)
+	}
+	if s.keysColl != nil {
+		if _, err := s.keysColl.DeleteOne(ctx, bson.D{{Key: "_id", Value: name}}); err != nil {
+			return err
+		}
+	}
+	s.unindex(e.APIKey)
+	delete(s.keys, name)
+	return nil
+}
+
+// Roles lists all roles sorted by name
+func (s *Store) Roles() []config.Role {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	roles := make([]config.Role, 0, len(s.roles))
+	for _, e := range s.roles {
+		roles = append(roles, e.Role)
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	return roles
+}
+
+// Role returns a role by name
+func (s *Store) Role(name string) (config.Role, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.roles[name]
+	if !ok {
+		return config.Role{}, false, fmt.Errorf("role %q %w", name, ErrNotFound)
+	}
+	return e.Role, e.static, nil
+}
+
+// PutRole creates or replaces a persisted role
+func (s *Store) PutRole(ctx context.Context, r config.Role) error {
+	if err := ValidateRole(r); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.roles[r.Name]; ok && e.static {
+		return fmt.Errorf("role %q is %w", r.Name, ErrReadOnly)
+	}
+	if s.rolesColl != nil {
+		opts := options.Replace().SetUpsert(true)
+		if _, err := s.rolesColl.ReplaceOne(ctx, bson.D{{Key: "_id", Value: r.Name}}, r, opts); err != nil {
+			return err
+		}
+	}
+	s.roles[r.Name] = roleEntry{Role: r}
+	return nil
+}
+
+// DeleteRole removes a persisted role that is not assigned to any key
+func (s *Store) DeleteRole(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.roles[name]
+	if !ok {
+		return fmt.Errorf("role %q %w", name, ErrNotFound)
+	}
+	if e.static {
+		return fmt.Errorf("role %q is %w", name, ErrReadOnly)
+	}
+	for _, k := range s.keys {
+		for _, r := range k.Roles {
+			if r == name {
+				return fmt.Errorf("role %q is assigned to key %q: %w", name, k.Name, ErrConflict)
+			}
+		}
+	}
+	if s.rolesColl != nil {
+		if _, err := s.rolesColl.DeleteOne(ctx, bson.D{{Key: "_id", Value: name}}); err != nil {
+			return err
+		}
+	}
+	delete(s.roles, name)
+	return nil
+}
+
+// operations resolves the set of operations granted by roles; nil means
+// every operation is allowed
+func (s *Store) operations(roles []string) map[string]bool {
+	if len(roles) == 0 {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ops := make(map[string]bool)
+	for _, name := range roles {
+		for _, op := range s.roles[name].Operations {
+			if op == "*" {
+				return nil
+			}
+			ops[op] = true
+		}
+	}
+	return ops
+}
+
+// grants resolves the scopes of an OAuth2 client. A scope
+// "<prefix><role>:<namespace>" grants the operations of the role on the
+// namespace, a database or "database.collection" pattern, and a scope
+// without a namespace grants them on every namespace. Other scopes and
+// unknown roles grant nothing.
+func (s *Store) grants(scopes []string, prefix string) []grant {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var grants []grant
+	for _, scope := range scopes {
+		rest, ok := strings.CutPrefix(scope, prefix)
+		if !ok {
+			continue
+		}
+		name, ns, _ := strings.Cut(rest, ":")
+		role, ok := s.roles[name]
+		if !ok {
+			continue
+		}
+		g := grant{operations: make(map[string]bool), namespace: ns}
+		if ns != "" && !strings.Contains(ns, ".") {
+			g.namespace = ns + ".*"
+		}
+		for _, op := range role.Operations {
+			if op == "*" {
+				g.operations = nil
+				break
+			}
+			g.operations[op] = true
+		}
+		grants = append(grants, g)
+	}
+	return grants
+}
+
+// GenerateKey returns a new random API key
+func GenerateKey() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
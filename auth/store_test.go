@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"testing"
+
+	"mongo-data-api-go-alternative/config"
+)
+
+func TestLookupRejectedKeys(t *testing.T) {
+	const key = "mdk_abcd0123456789"
+	hash, err := HashKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewStore(&config.Config{APIKeys: []config.APIKey{{Name: "hashed", KeyHash: hash}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A wrong key with the prefix of the hashed one is checked once
+	wrong := key[:keyPrefixLen] + "wrong-secret"
+	for i := 0; i < 2; i++ {
+		if _, ok := store.Lookup(wrong); ok {
+			t.Fatal("wrong key accepted")
+		}
+	}
+	if _, ok := store.rejected[digest(wrong)]; !ok || len(store.rejected) != 1 {
+		t.Errorf("rejected %v, want the wrong key's digest", store.rejected)
+	}
+	// Keys without a candidate hash never reach bcrypt and aren't kept
+	if _, ok := store.Lookup("unknown-key-without-prefix"); ok || len(store.rejected) != 1 {
+		t.Errorf("rejected %d digests, want 1", len(store.rejected))
+	}
+	if k, ok := store.Lookup(key); !ok || k.Name != "hashed" {
+		t.Errorf("Lookup(key) = %v, %v", k.Name, ok)
+	}
+
+	// Changing keys forgets rejected digests, which may have become valid
+	if err := store.SetStatic([]config.APIKey{{Name: "plain", Key: wrong}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if k, ok := store.Lookup(wrong); !ok || k.Name != "plain" {
+		t.Errorf("after reload Lookup(wrong) = %v, %v", k.Name, ok)
+	}
+
+	// The cache is bounded
+	if err := store.SetStatic([]config.APIKey{{Name: "hashed", KeyHash: hash}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxRejected+1; i++ {
+		store.rejected[digest(string(rune(i)))] = struct{}{}
+	}
+	store.Lookup(wrong)
+	if len(store.rejected) != 1 {
+		t.Errorf("rejected %d digests after overflowing, want 1", len(store.rejected))
+	}
+}
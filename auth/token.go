@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Token errors
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// TokenClaims are the permissions carried by a signed token: a subset of
+// the operations of the issuing key, on a single namespace, until Expires
+type TokenClaims struct {
+	// Key is the name of the issuing API key
+	Key string `json:"key"`
+	// Namespace is the "database.collection" the token may access
+	Namespace  string   `json:"ns"`
+	Operations []string `json:"ops"`
+	// Expires is a Unix time in seconds
+	Expires int64 `json:"exp"`
+}
+
+// Tokens signs and verifies short-lived tokens with HMAC-SHA256. A token is
+// its base64url-encoded JSON claims and their signature, separated by a dot.
+type Tokens struct {
+	secret []byte
+	// MaxTTL is the longest lifetime a token may be issued for
+	MaxTTL time.Duration
+}
+
+// NewTokens returns a signer using secret, which must not be empty
+func NewTokens(secret string, maxTTL time.Duration) *Tokens {
+	return &Tokens{secret: []byte(secret), MaxTTL: maxTTL}
+}
+
+// Sign returns the token of claims
+func (t *Tokens) Sign(claims TokenClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(t.mac(encoded)), nil
+}
+
+// Verify checks the signature and expiry of a token and returns its claims
+func (t *Tokens) Verify(token string, now time.Time) (TokenClaims, error) {
+	var claims TokenClaims
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return claims, ErrInvalidToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, t.mac(encoded)) {
+		return claims, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return claims, ErrInvalidToken
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if now.Unix() >= claims.Expires {
+		return claims, ErrTokenExpired
+	}
+	return claims, nil
+}
+
+func (t *Tokens) mac(encoded string) []byte {
+	h := hmac.New(sha256.New, t.secret)
+	h.Write([]byte(encoded))
+	return h.Sum(nil)
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"mongo-data-api-go-alternative/auth"
+	"mongo-data-api-go-alternative/config"
+	"mongo-data-api-go-alternative/db"
+	"mongo-data-api-go-alternative/importer"
+	"mongo-data-api-go-alternative/query"
+	"mongo-data-api-go-alternative/script"
+	"mongo-data-api-go-alternative/seed"
+	"mongo-data-api-go-alternative/server"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// checkConfig loads the configuration and compiles everything derived from
+// it without connecting to MongoDB
+func checkConfig(args []string) error {
+	fs := flag.NewFlagSet("check-config", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("loading configuration: %w", err)
+	}
+	if err := compileConfig(cfg); err != nil {
+		return err
+	}
+
+	tenancy := cfg.Tenancy.Mode
+	if tenancy == config.TenancyNone {
+		tenancy = "off"
+	}
+	fmt.Printf("Configuration OK: %d API keys, %d roles, %d saved queries, %d custom endpoints, tenancy %s\n",
+		len(cfg.APIKeys), len(cfg.Roles), len(cfg.SavedQueries), len(cfg.Endpoints), tenancy)
+	if len(cfg.APIKeys) == 0 && cfg.AdminKey == "" {
+		fmt.Println("Warning: no API keys and no admin key are configured, so only keys stored in MongoDB can authenticate")
+	}
+	return nil
+}
+
+// compileConfig compiles the API keys, saved queries and endpoint scripts
+// of cfg
+func compileConfig(cfg *config.Config) error {
+	if _, err := auth.NewStore(cfg); err != nil {
+		return fmt.Errorf("loading API keys: %w", err)
+	}
+	if _, err := query.NewRegistry(cfg.SavedQueries); err != nil {
+		return fmt.Errorf("loading saved queries: %w", err)
+	}
+	if _, err := script.Load(cfg.Endpoints, nil, script.Policy{}); err != nil {
+		return fmt.Errorf("loading custom endpoints: %w", err)
+	}
+	return nil
+}
+
+// ping connects to MongoDB and reports the server version and round trip
+func ping(args []string) error {
+	fs := flag.NewFlagSet("ping", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("loading configuration: %w", err)
+	}
+	start := time.Now()
+	if err := connectMongo(cfg); err != nil {
+		return err
+	}
+	defer db.Close()
+	elapsed := time.Since(start)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var info struct {
+		Version string `bson:"version"`
+	}
+	if err := db.Client().Database("admin").RunCommand(ctx, bson.D{{Key: "buildInfo", Value: 1}}).Decode(&info); err != nil {
+		return fmt.Errorf("reading server version: %w", err)
+	}
+	fmt.Printf("MongoDB %s reachable in %s\n", info.Version, elapsed.Round(time.Millisecond))
+	return nil
+}
+
+// keys manages the API keys persisted in the system database
+func keys(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing subcommand, expected keys create|revoke|list|hash")
+	}
+	sub, args := args[0], args[1:]
+
+	fs := flag.NewFlagSet("keys "+sub, flag.ContinueOnError)
+	var name, tenant, roles, namespaces, value, priority string
+	var rateLimit int
+	switch sub {
+	case "create":
+		fs.StringVar(&name, "name", "", "key name (required)")
+		fs.StringVar(&tenant, "tenant", "", "tenant the key belongs to")
+		fs.StringVar(&roles, "roles", "", "comma-separated roles (default: full access)")
+		fs.StringVar(&namespaces, "namespaces", "", `comma-separated "database.collection" patterns the key may access`)
+		fs.IntVar(&rateLimit, "rate-limit", 0, "requests per minute (0 = unlimited)")
+		fs.StringVar(&priority, "priority", "", `priority class under load, "interactive" (default) or "batch"`)
+		fs.StringVar(&value, "key", "", "secret to use instead of a generated one")
+	case "revoke":
+		fs.StringVar(&name, "name", "", "key name (required)")
+	case "list":
+	case "hash":
+		fs.StringVar(&value, "key", "", "secret to hash (required)")
+	default:
+		return fmt.Errorf("unknown subcommand %q, expected keys create|revoke|list|hash", sub)
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if sub == "hash" {
+		// Hashing needs neither the configuration nor MongoDB
+		if value == "" {
+			return fmt.Errorf("--key is required")
+		}
+		hash, err := auth.HashKey(value)
+		if err != nil {
+			return err
+		}
+		fmt.Println(hash)
+		return nil
+	}
+	if sub != "list" && name == "" {
+		return fmt.Errorf("--name is required")
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("loading configuration: %w", err)
+	}
+	store, err := auth.NewStore(cfg)
+	if err != nil {
+		return fmt.Errorf("loading API keys: %w", err)
+	}
+	if err := connectMongo(cfg); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = store.Attach(ctx,
+		db.GetCollection(cfg.SystemDatabase, "apiKeys"),
+		db.GetCollection(cfg.SystemDatabase, "roles"))
+	if err != nil {
+		return fmt.Errorf("loading API keys from MongoDB: %w", err)
+	}
+
+	switch sub {
+	case "create":
+		if _, _, err := store.Key(name); err == nil {
+			return fmt.Errorf("key %q %w", name, auth.ErrConflict)
+		}
+		k, err := store.PutKey(ctx, config.APIKey{
+			Name:       name,
+			Key:        value,
+			Tenant:     tenant,
+			Roles:      splitList(roles),
+			Namespaces: splitList(namespaces),
+			RateLimit:  rateLimit,
+			Priority:   priority,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created key %q: %s\n", k.Name, k.Key)
+	case "revoke":
+		if err := store.DeleteKey(ctx, name); err != nil {
+			return err
+		}
+		fmt.Printf("Revoked key %q\n", name)
+	case "list":
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tKEY\tTENANT\tROLES\tNAMESPACES\tRATE LIMIT\tSOURCE")
+		for _, k := range store.Keys() {
+			_, static, _ := store.Key(k.Name)
+			source := "mongodb"
+			if static {
+				source = "config"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n", k.Name, auth.MaskKey(k), k.Tenant,
+				strings.Join(k.Roles, ","), strings.Join(k.Namespaces, ","), k.RateLimit, source)
+		}
+		return w.Flush()
+	}
+	return nil
+}
+
+// routes lists the routes of the API as configured, including custom
+// endpoints. The app is built on the in-memory store so no database is
+// needed.
+func routes(args []string) error {
+	fs := flag.NewFlagSet("routes", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("loading configuration: %w", err)
+	}
+	cfg.Mock = true
+	cfg.MockData, cfg.Seed = "", nil
+	cfg.RecordDir, cfg.ReplayDir = "", ""
+	cfg.AccessLog.Format, cfg.Alerts.WebhookURL = "", ""
+	cfg.WatchConfig = false
+
+	// Silence the startup messages of the server
+	log.SetOutput(io.Discard)
+	app, err := server.New(cfg)
+	log.SetOutput(os.Stderr)
+	if err != nil {
+		return err
+	}
+
+	list := app.GetRoutes(true)
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, r := range list {
+		if r.Method == "HEAD" {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\n", r.Method, r.Path)
+	}
+	return w.Flush()
+}
+
+// seedData loads the configured seed files, or a single file given by
+// flags, into empty collections
+func seedData(args []string) error {
+	fs := flag.NewFlagSet("seed", flag.ContinueOnError)
+	var src config.SeedSource
+	fs.StringVar(&src.Database, "database", "", "target database (with --collection and --file)")
+	fs.StringVar(&src.Collection, "collection", "", "target collection")
+	fs.StringVar(&src.File, "file", "", "JSON array or NDJSON file of documents")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("loading configuration: %w", err)
+	}
+	sources := cfg.Seed
+	if src != (config.SeedSource{}) {
+		if src.Database == "" || src.Collection == "" || src.File == "" {
+			return fmt.Errorf("--database, --collection and --file must be used together")
+		}
+		sources = []config.SeedSource{src}
+	}
+	if len(sources) == 0 {
+		return fmt.Errorf("nothing to seed: configure seed or pass --database, --collection and --file")
+	}
+	if err := connectMongo(cfg); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	results, err := seed.Apply(context.Background(), db.NewMongo(db.Client()), sources)
+	for _, res := range results {
+		if res.Skipped {
+			fmt.Printf("%s.%s: not empty, skipped\n", res.Database, res.Collection)
+		} else {
+			fmt.Printf("%s.%s: inserted %d documents from %s\n", res.Database, res.Collection, res.Inserted, res.File)
+		}
+	}
+	return err
+}
+
+// importData sends a NDJSON or CSV file to /api/import of a running server
+// in batches and reports the progress. CSV is converted to documents
+// locally, so line numbers in errors refer to the input file.
+func importData(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "3000"
+	}
+	url := fs.String("url", "http://localhost:"+port, "base URL of the Data API")
+	apiKey := fs.String("api-key", os.Getenv("API_KEY"), "API key (default $API_KEY)")
+	database := fs.String("database", "", "target database (required)")
+	collection := fs.String("collection", "", "target collection (required)")
+	file := fs.String("file", "", "input file (default stdin)")
+	format := fs.String("format", "", "ndjson or csv (default from the file extension, else ndjson)")
+	batchSize := fs.Int("batch-size", importer.DefaultBatchSize, "documents per request")
+	upsertKeys := fs.String("upsert-keys", "", "comma-separated fields identifying documents to replace instead of inserting")
+	ignoreBlanks := fs.Bool("ignore-blanks", false, "omit empty CSV fields")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *database == "" || *collection == "" {
+		return fmt.Errorf("--database and --collection are required")
+	}
+	if *batchSize <= 0 {
+		return fmt.Errorf("--batch-size must be positive")
+	}
+
+	in := io.Reader(os.Stdin)
+	if *file != "" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+		if *format == "" && strings.EqualFold(filepath.Ext(*file), ".csv") {
+			*format = importer.FormatCSV
+		}
+	}
+	if *format == "" {
+		*format = importer.FormatNDJSON
+	}
+	dec, err := importer.NewDecoder(bufio.NewReader(in), *format, importer.DecodeOptions{IgnoreBlanks: *ignoreBlanks})
+	if err != nil {
+		return err
+	}
+
+	query := neturl.Values{}
+	query.Set("database", *database)
+	query.Set("collection", *collection)
+	query.Set("format", importer.FormatNDJSON)
+	query.Set("batchSize", strconv.Itoa(*batchSize))
+	if *upsertKeys != "" {
+		query.Set("upsertKeys", *upsertKeys)
+	}
+	endpoint := strings.TrimSuffix(*url, "/") + "/api/import?" + query.Encode()
+	client := &http.Client{Timeout: 5 * time.Minute}
+
+	var total importer.Progress
+	send := func(body *bytes.Buffer, lines []int) error {
+		req, err := http.NewRequest(http.MethodPost, endpoint, body)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		req.Header.Set("apiKey", *apiKey)
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			var failure struct {
+				Error   string `json:"error"`
+				Message string `json:"message"`
+			}
+			json.NewDecoder(resp.Body).Decode(&failure)
+			return fmt.Errorf("import failed with status %d: %s%s", resp.StatusCode, failure.Error, failure.Message)
+		}
+		var p importer.Progress
+		if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+			return fmt.Errorf("reading import result: %w", err)
+		}
+		total.Processed += p.Processed
+		total.Inserted += p.Inserted
+		total.Upserted += p.Upserted
+		total.Modified += p.Modified
+		total.Failed += p.Failed
+		for _, e := range p.Errors {
+			// The server numbers the documents of the request
+			if e.Line >= 1 && e.Line <= len(lines) {
+				e.Line = lines[e.Line-1]
+			}
+			total.Errors = append(total.Errors, e)
+		}
+		fmt.Fprintf(os.Stderr, "\r%d processed, %d inserted, %d upserted, %d modified, %d failed",
+			total.Processed, total.Inserted, total.Upserted, total.Modified, total.Failed)
+		return nil
+	}
+
+	var body bytes.Buffer
+	var lines []int
+	for {
+		doc, err := dec.Next()
+		if err == io.EOF {
+			break
+		}
+		var recErr *importer.RecordError
+		if errors.As(err, &recErr) {
+			total.Processed++
+			total.Failed++
+			total.Errors = append(total.Errors, importer.LineError{Line: recErr.Line, Error: recErr.Err.Error()})
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		raw, err := bson.MarshalExtJSON(doc, true, false)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", dec.Line(), err)
+		}
+		body.Write(raw)
+		body.WriteByte('\n')
+		lines = append(lines, dec.Line())
+		if len(lines) == *batchSize {
+			if err := send(&body, lines); err != nil {
+				return err
+			}
+			body.Reset()
+			lines = lines[:0]
+		}
+	}
+	if len(lines) > 0 {
+		if err := send(&body, lines); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintln(os.Stderr)
+
+	sort.SliceStable(total.Errors, func(i, j int) bool { return total.Errors[i].Line < total.Errors[j].Line })
+	for _, e := range total.Errors {
+		fmt.Printf("line %d: %s\n", e.Line, e.Error)
+	}
+	fmt.Printf("Imported %d documents: %d inserted, %d upserted, %d modified, %d failed\n",
+		total.Processed, total.Inserted, total.Upserted, total.Modified, total.Failed)
+	if total.Failed > 0 {
+		return fmt.Errorf("%d documents failed", total.Failed)
+	}
+	return nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// connectMongo connects to MONGO_URI with the configured client options
+func connectMongo(cfg *config.Config) error {
+	opts, err := db.ClusterOptions(cfg.MongoOptions)
+	if err == nil {
+		err = db.Connect(cfg.MongoURI, cfg.AppName, opts)
+	}
+	if err != nil {
+		return fmt.Errorf("connecting to MongoDB: %w", err)
+	}
+	return nil
+}
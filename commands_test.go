@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"mongo-data-api-go-alternative/importer"
+)
+
+func TestImportData(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "users.csv")
+	if err := os.WriteFile(file, []byte("name,age\nann,1\nbob,2\n\ncy,3\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var batches [][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != "/api/import" || q.Get("database") != "app" || q.Get("collection") != "users" || q.Get("format") != "ndjson" ||
+			q.Get("upsertKeys") != "name" || r.Header.Get("apiKey") != "secret" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+			t.Errorf("request %s %v", r.URL, r.Header)
+		}
+		body, _ := io.ReadAll(r.Body)
+		lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+		mu.Lock()
+		batches = append(batches, lines)
+		mu.Unlock()
+		// The server rejects the first document of each batch
+		json.NewEncoder(w).Encode(importer.Progress{
+			Processed: int64(len(lines)), Upserted: int64(len(lines) - 1), Failed: 1,
+			Errors: []importer.LineError{{Line: 1, Error: "duplicate key"}},
+		})
+	}))
+	defer server.Close()
+
+	var err error
+	out := captureStdout(t, func() {
+		err = importData([]string{"--url", server.URL + "/", "--api-key", "secret", "--database", "app", "--collection", "users",
+			"--file", file, "--batch-size", "2", "--upsert-keys", "name"})
+	})
+	if err == nil || err.Error() != "2 documents failed" {
+		t.Errorf("error %v", err)
+	}
+	// Errors refer to the lines of the file, not the documents of a batch
+	if want := "line 2: duplicate key\nline 5: duplicate key\nImported 3 documents: 0 inserted, 1 upserted, 0 modified, 2 failed\n"; out != want {
+		t.Errorf("output %q, want %q", out, want)
+	}
+	// CSV rows are sent as Extended JSON documents, in batches
+	want := [][]string{
+		{`{"name":"ann","age":{"$numberInt":"1"}}`, `{"name":"bob","age":{"$numberInt":"2"}}`},
+		{`{"name":"cy","age":{"$numberInt":"3"}}`},
+	}
+	if !reflect.DeepEqual(batches, want) {
+		t.Errorf("batches %q, want %q", batches, want)
+	}
+
+	for _, args := range [][]string{
+		{"--database", "app"},
+		{"--database", "app", "--collection", "users", "--batch-size", "0"},
+		{"--database", "app", "--collection", "users", "--file", filepath.Join(t.TempDir(), "missing.csv")},
+	} {
+		if err := importData(args); err == nil {
+			t.Errorf("%v accepted", args)
+		}
+	}
+}
+
+// captureStdout returns what f prints to stdout
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	out := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- string(b)
+	}()
+	f()
+	w.Close()
+	return <-out
+}
+
+func TestKeysArguments(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		err  string
+	}{
+		{nil, "missing subcommand"},
+		{[]string{"rotate"}, `unknown subcommand "rotate"`},
+		{[]string{"hash"}, "--key is required"},
+		{[]string{"create", "--roles", "reader"}, "--name is required"},
+		{[]string{"revoke"}, "--name is required"},
+	} {
+		if err := keys(tc.args); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%v: error %v, want %q", tc.args, err, tc.err)
+		}
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	for s, want := range map[string][]string{
+		"":               nil,
+		"reader":         {"reader"},
+		" a, b ,,c ,":    {"a", "b", "c"},
+		"app.*, logs.* ": {"app.*", "logs.*"},
+	} {
+		if got := splitList(s); !reflect.DeepEqual(got, want) {
+			t.Errorf("splitList(%q) = %q, want %q", s, got, want)
+		}
+	}
+}
@@ -0,0 +1,1814 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTP engines
+const (
+	EngineFiber   = "fiber"
+	EngineNetHTTP = "net/http"
+)
+
+// Tenancy modes
+const (
+	TenancyNone   = ""
+	TenancyPrefix = "prefix"
+	TenancyField  = "field"
+)
+
+// DefaultCluster names the deployment at MongoURI
+const DefaultCluster = "default"
+
+// Config holds the server configuration. Values are read from an optional
+// JSON file (CONFIG_FILE) and then overridden by environment variables.
+type Config struct {
+	Port     string `json:"port"`
+	MongoURI string `json:"mongoUri"`
+	// MongoOptions override the client settings of MongoURI
+	MongoOptions ClusterOptions `json:"mongoOptions"`
+	APIKeys      []APIKey       `json:"apiKeys"`
+	// APIKeysFile is a JSON array of further API keys, e.g. mounted from a
+	// Kubernetes Secret to keep them out of the config file
+	APIKeysFile string `json:"apiKeysFile"`
+	Roles       []Role `json:"roles"`
+	// WatchConfig reloads the API keys, roles and saved queries when
+	// CONFIG_FILE or APIKeysFile change
+	WatchConfig bool `json:"watchConfig"`
+	// SavedQueries are named queries clients run by name with parameters
+	SavedQueries []SavedQuery `json:"savedQueries"`
+	// Endpoints are custom endpoints implemented by Starlark scripts
+	Endpoints []Endpoint    `json:"endpoints"`
+	Tenancy   TenancyConfig `json:"tenancy"`
+	// RESTAPI serves the data operations as resources under /api/data
+	RESTAPI bool          `json:"restApi"`
+	Metrics MetricsConfig `json:"metrics"`
+	// AccessLog writes a line per request, separately from the application
+	// log
+	AccessLog AccessLogConfig `json:"accessLog"`
+	// PlainObjectIDs converts 24-hex-character strings in _id filters to
+	// ObjectIds and returns ObjectId _ids as plain strings, unless a
+	// request sets plainObjectIds itself
+	PlainObjectIDs bool `json:"plainObjectIds"`
+	// StrictBodies rejects request bodies with top-level fields the
+	// endpoint does not know, instead of ignoring them
+	StrictBodies bool `json:"strictBodies"`
+	// LegacyDeleteResults keeps the {"result": {"n": N}} responses of
+	// deleteOne and deleteMany for clients written against them
+	LegacyDeleteResults bool `json:"legacyDeleteResults"`
+	// RestrictUpserts requires the upsert operation, in addition to
+	// updateOne or updateMany, for updates that upsert
+	RestrictUpserts bool `json:"restrictUpserts"`
+	// ReadOnly serves reads only, for instances deployed as read-only
+	// edges: write endpoints are not routed and every other write, such
+	// as a saved update or an aggregation with $out, is forbidden
+	ReadOnly bool `json:"readOnly"`
+	// ShardKeys maps "database.collection" to the shard key fields of
+	// sharded collections, so that updates and deletes that MongoDB could
+	// not route are rejected with a clear error
+	ShardKeys map[string][]string `json:"shardKeys"`
+	// NaturalKeys maps "database.collection" to the fields identifying a
+	// document, so that insertOne inserts it at most once and resolves
+	// conflicts as the request's onConflict asks
+	NaturalKeys map[string][]string `json:"naturalKeys"`
+	// VersionedCollections are the "database.collection" names whose
+	// documents keep their prior versions in a history collection
+	VersionedCollections []string `json:"versionedCollections"`
+	// Trash moves the documents deleted from some collections to a trash
+	// collection instead of destroying them
+	Trash TrashConfig `json:"trash"`
+	// UUIDFields maps "database.collection" to the fields holding UUIDs,
+	// which clients send and receive as canonical strings while they are
+	// stored as Binary subtype 4
+	UUIDFields map[string][]string `json:"uuidFields"`
+	// ComputedFields maps "database.collection" to fields derived from
+	// each document by an aggregation expression, which reads add to the
+	// documents they return
+	ComputedFields map[string]map[string]interface{} `json:"computedFields"`
+	// ReadDefaults maps "database.collection" to the limits and projection
+	// of its reads, so that a find without a limit cannot return a whole
+	// large collection
+	ReadDefaults map[string]ReadDefaults `json:"readDefaults"`
+	// ProtoSchemas maps "database.collection" to the protobuf message its
+	// documents are encoded as for clients accepting application/x-protobuf
+	ProtoSchemas map[string]ProtoSchema `json:"protoSchemas"`
+	// MaxTimeMS limits the operations of requests that don't set maxTimeMS
+	MaxTimeMS MaxTimeConfig `json:"maxTimeMs"`
+	// AggregateLimits caps the results aggregations return
+	AggregateLimits AggregateLimits `json:"aggregateLimits"`
+	// CrossDatabaseJoins are the pairs of namespaces between which the
+	// $lookup, $graphLookup and $unionWith stages of aggregations may join
+	// collections of different databases
+	CrossDatabaseJoins []JoinRule `json:"crossDatabaseJoins"`
+	// Alerts posts to a webhook when the error rate or latency stays too
+	// high
+	Alerts AlertConfig `json:"alerts"`
+	// MigrationsDir holds versioned migration files; MigrateOnStart applies
+	// the pending ones when the server starts
+	MigrationsDir  string `json:"migrationsDir"`
+	MigrateOnStart bool   `json:"migrateOnStart"`
+	// Retention declares how long documents are kept in collections; the
+	// matching TTL indexes are ensured at startup
+	Retention []RetentionPolicy `json:"retention"`
+	// Seed loads fixture documents into empty collections at startup
+	Seed []SeedSource `json:"seed"`
+	// WarmQueries are run with limit 1 at startup and through the admin API
+	// to warm the plan cache and connection pool after deploys and
+	// failovers
+	WarmQueries []WarmQuery `json:"warmQueries"`
+	// AdminKey authenticates the /api/admin endpoints; the admin API is
+	// disabled when it is empty
+	AdminKey string `json:"adminKey"`
+	// TokenSecret signs the short-lived tokens issued by /api/tokens, which
+	// is disabled when it is empty. TokenMaxTTLSeconds is the longest
+	// lifetime of a token (default 3600).
+	TokenSecret        string `json:"tokenSecret"`
+	TokenMaxTTLSeconds int    `json:"tokenMaxTtlSeconds"`
+	// PublicCollections are readable without credentials, by find and
+	// findOne only. Anonymous requests are rate limited per client IP by
+	// PublicRateLimit requests per minute (default 60).
+	PublicCollections []PublicCollection `json:"publicCollections"`
+	PublicRateLimit   int                `json:"publicRateLimit"`
+	// RateLimitRedis shares the rate limits between replicas through Redis
+	RateLimitRedis RateLimitRedisConfig `json:"rateLimitRedis"`
+	// OAuth accepts OAuth2 access tokens issued by an identity provider in
+	// place of API keys
+	OAuth OAuthConfig `json:"oauth"`
+	// SystemDatabase holds keys and roles managed through the admin API.
+	// It is never reachable through the data endpoints.
+	SystemDatabase string `json:"systemDatabase"`
+	// Engine is the HTTP server the API is served with: "fiber" (default)
+	// or "net/http"
+	Engine string `json:"engine"`
+	// AppName identifies the server's MongoDB connections in server logs,
+	// currentOp and the profiler, unless MongoURI sets appName (default
+	// "mongo-data-api")
+	AppName string `json:"appName"`
+	// AdminPort moves metrics, the readiness probe, profiling and the admin
+	// API and UI to a separate listener, so that Port only serves data
+	// endpoints
+	AdminPort string `json:"adminPort"`
+	// Mock serves the API from an in-memory data store instead of MongoDB,
+	// optionally seeded from MockData (a JSON file mapping
+	// "database.collection" to an array of EJSON documents)
+	Mock     bool   `json:"mock"`
+	MockData string `json:"mockData"`
+	// RecordDir records the requests and responses of the data endpoints to
+	// fixture files; ReplayDir serves previously recorded fixtures without
+	// a database
+	RecordDir string `json:"recordDir"`
+	ReplayDir string `json:"replayDir"`
+	// Clusters names additional MongoDB deployments that collections can
+	// be cloned from and to
+	Clusters map[string]Cluster `json:"clusters"`
+	// DualWrite mirrors the writes of the default cluster to one of the
+	// clusters while collections are migrated to it
+	DualWrite DualWriteConfig `json:"dualWrite"`
+	// ShadowReads repeats a sample of the reads on one of the clusters and
+	// logs results that differ
+	ShadowReads ShadowReadConfig `json:"shadowReads"`
+	// ReadFailover serves the reads the default cluster fails, or answers
+	// too slowly, from a standby cluster holding the same data
+	ReadFailover ReadFailoverConfig `json:"readFailover"`
+	// FanOutReads lets finds read a namespace from several clusters at once
+	// and merge the results, e.g. across the regions of a migration
+	FanOutReads FanOutReadConfig `json:"fanOutReads"`
+	// TrafficMirror replays a sample of the requests to another deployment
+	// for load testing
+	TrafficMirror TrafficMirrorConfig `json:"trafficMirror"`
+	// JobsDir holds the files written by background jobs, such as async
+	// exports
+	JobsDir string `json:"jobsDir"`
+	// JobRetentionHours is how long finished jobs and their result files
+	// are kept (default 24, negative to keep them)
+	JobRetentionHours int `json:"jobRetentionHours"`
+	// StatsCacheSeconds is how long /api/stats results are cached
+	// (default 30, negative to disable caching)
+	StatsCacheSeconds int `json:"statsCacheSeconds"`
+	// CursorMaxAgeSeconds is how long a cursor may stay open before it is
+	// closed (default 3600, negative to never close cursors)
+	CursorMaxAgeSeconds int `json:"cursorMaxAgeSeconds"`
+	// SessionIdleTimeoutSeconds is how long a client session may go unused
+	// before it is ended (default 300)
+	SessionIdleTimeoutSeconds int `json:"sessionIdleTimeoutSeconds"`
+	// TailIdleTimeoutSeconds is how long a tail of a capped collection waits
+	// for a new document before it ends (default 60)
+	TailIdleTimeoutSeconds int `json:"tailIdleTimeoutSeconds"`
+	// BodyLimitMB is the maximum request body size in megabytes (default 4)
+	BodyLimitMB int `json:"bodyLimitMb"`
+	// ReadTimeoutSeconds and WriteTimeoutSeconds bound reading a request and
+	// writing its response (default 10). IdleTimeoutSeconds is how long an
+	// idle keep-alive connection is kept open (default: the read timeout).
+	ReadTimeoutSeconds  int `json:"readTimeoutSeconds"`
+	WriteTimeoutSeconds int `json:"writeTimeoutSeconds"`
+	IdleTimeoutSeconds  int `json:"idleTimeoutSeconds"`
+	// MaxConnections is the maximum number of concurrent connections,
+	// including idle keep-alive ones (0 = the engine's default)
+	MaxConnections int `json:"maxConnections"`
+	// RequestQueue bounds the authenticated requests served at once and
+	// queues the others by the priority class of their key
+	RequestQueue RequestQueueConfig `json:"requestQueue"`
+	// MaxStreamBodyMB bounds the declared length of every request body,
+	// including streamed ones that BodyLimitMB does not apply to (default
+	// 1024)
+	MaxStreamBodyMB int `json:"maxStreamBodyMb"`
+	// MaxURLLength is the longest request URI (default 4096) and MaxHeaders
+	// the largest number of request headers (default 100)
+	MaxURLLength int `json:"maxUrlLength"`
+	MaxHeaders   int `json:"maxHeaders"`
+	// RequireJSON rejects POST bodies without a JSON Content-Type, except
+	// CSV and NDJSON imports
+	RequireJSON bool `json:"requireJson"`
+	// Prefork spawns a Fiber server process per CPU sharing the port
+	Prefork bool `json:"prefork"`
+	// TLSCertFile and TLSKeyFile enable HTTPS. The files are reloaded when
+	// they change. The net/http engine also negotiates HTTP/2 over TLS.
+	TLSCertFile string `json:"tlsCertFile"`
+	TLSKeyFile  string `json:"tlsKeyFile"`
+	// ACMEDomains enables HTTPS with certificates obtained from an ACME CA
+	// (Let's Encrypt) for these domains instead of certificate files
+	ACMEDomains []string `json:"acmeDomains"`
+	// ACMEEmail is the contact address of the ACME account
+	ACMEEmail string `json:"acmeEmail"`
+	// ACMECacheDir stores ACME accounts and certificates across restarts
+	ACMECacheDir string `json:"acmeCacheDir"`
+	// ACMEDirectoryURL is the ACME directory (default Let's Encrypt)
+	ACMEDirectoryURL string `json:"acmeDirectoryUrl"`
+}
+
+// APIKey describes a client credential, the tenant it belongs to and what
+// it is allowed to do
+type APIKey struct {
+	Name string `json:"name" bson:"_id"`
+	Key  string `json:"key,omitempty" bson:"key,omitempty"`
+	// KeyHash stores the key hashed instead of Key: its first 8 characters,
+	// a colon and its bcrypt hash (see "keys hash")
+	KeyHash string `json:"keyHash,omitempty" bson:"keyHash,omitempty"`
+	Tenant  string `json:"tenant,omitempty" bson:"tenant,omitempty"`
+	// Roles grant operations; a key without roles may run every operation
+	Roles []string `json:"roles,omitempty" bson:"roles,omitempty"`
+	// Namespaces is an allowlist of "database.collection" patterns
+	// (e.g. "app.*"); a key without namespaces may access every namespace
+	Namespaces []string `json:"namespaces,omitempty" bson:"namespaces,omitempty"`
+	// RateLimit is the number of requests allowed per minute (0 = unlimited)
+	RateLimit int `json:"rateLimit,omitempty" bson:"rateLimit,omitempty"`
+	// NumbersAsStrings returns the 64-bit integers and decimals of the
+	// documents read as strings, unless a request sets numbersAsStrings
+	NumbersAsStrings bool `json:"numbersAsStrings,omitempty" bson:"numbersAsStrings,omitempty"`
+	// Envelope reshapes the responses of the key's requests
+	Envelope *Envelope `json:"envelope,omitempty" bson:"envelope,omitempty"`
+	// Priority is the class the key's requests are queued in under load:
+	// PriorityInteractive (default) or PriorityBatch
+	Priority string `json:"priority,omitempty" bson:"priority,omitempty"`
+}
+
+// Priority classes of API keys
+const (
+	PriorityInteractive = "interactive"
+	PriorityBatch       = "batch"
+)
+
+// Envelope cases
+const (
+	CaseCamel = "camelCase"
+	CaseSnake = "snake_case"
+)
+
+// Envelope reshapes the top level of the data endpoints' responses, so that
+// clients written against another API keep working. Documents are returned
+// as they are.
+type Envelope struct {
+	// Rename maps response fields, such as "documents", to the names they
+	// are returned as
+	Rename map[string]string `json:"rename,omitempty" bson:"rename,omitempty"`
+	// Omit lists the response fields left out, such as "totalCount" or
+	// "matchedCount"
+	Omit []string `json:"omit,omitempty" bson:"omit,omitempty"`
+	// CountField, if set, adds the number of documents returned under that
+	// name
+	CountField string `json:"countField,omitempty" bson:"countField,omitempty"`
+	// Case is the case of the field names not renamed: CaseCamel (default)
+	// or CaseSnake
+	Case string `json:"case,omitempty" bson:"case,omitempty"`
+}
+
+// Validate checks an envelope definition
+func (e Envelope) Validate() error {
+	switch e.Case {
+	case "", CaseCamel, CaseSnake:
+	default:
+		return fmt.Errorf("invalid envelope case %q: expected %s or %s", e.Case, CaseCamel, CaseSnake)
+	}
+	for from, to := range e.Rename {
+		if to == "" {
+			return fmt.Errorf("envelope renames %q to an empty name", from)
+		}
+	}
+	return nil
+}
+
+// Role is a named set of permitted operations ("find", "insertOne", ... or "*")
+type Role struct {
+	Name       string   `json:"name" bson:"_id"`
+	Operations []string `json:"operations" bson:"operations"`
+}
+
+// TenancyConfig controls how requests are namespaced per tenant
+type TenancyConfig struct {
+	// Mode is "prefix" (database `app` becomes `<tenant>_app`), "field"
+	// (tenant id injected into every document, filter and pipeline) or empty
+	// to disable tenancy.
+	Mode string `json:"mode"`
+	// Field is the document field holding the tenant id in "field" mode
+	Field string `json:"field"`
+}
+
+// MetricsConfig tunes the Prometheus histograms
+type MetricsConfig struct {
+	// HTTPBuckets and MongoBuckets are the upper bounds in seconds of the
+	// request and MongoDB command duration buckets
+	HTTPBuckets  []float64 `json:"httpBuckets"`
+	MongoBuckets []float64 `json:"mongoBuckets"`
+	// NativeHistograms also records native histograms, with exponential
+	// buckets of any resolution
+	NativeHistograms bool `json:"nativeHistograms"`
+}
+
+// Access log formats
+const (
+	AccessLogCommon   = "common"
+	AccessLogCombined = "combined"
+	AccessLogJSON     = "json"
+)
+
+// AccessLogConfig selects the format and destination of the access log
+type AccessLogConfig struct {
+	// Format is "common", "combined" or "json"; the access log is disabled
+	// when it is empty
+	Format string `json:"format"`
+	// Output is "stdout" (default), "stderr", "syslog", "syslog://host:port",
+	// "syslog+tcp://host:port" or the path of a file
+	Output string `json:"output"`
+	// MaxSizeMB is the size at which a file is rotated (default 100) and
+	// MaxBackups the number of rotated files kept (default 5)
+	MaxSizeMB  int `json:"maxSizeMb"`
+	MaxBackups int `json:"maxBackups"`
+}
+
+// File reports whether the access log is written to a file
+func (c AccessLogConfig) File() bool {
+	return c.Output != "" && c.Output != "stdout" && c.Output != "stderr" &&
+		c.Output != "syslog" && !strings.HasPrefix(c.Output, "syslog://") && !strings.HasPrefix(c.Output, "syslog+tcp://")
+}
+
+// MaxTimeConfig holds the default time limits in milliseconds of each
+// operation category (0 = unlimited)
+type MaxTimeConfig struct {
+	// Read limits findOne, find and its total count
+	Read int64 `json:"read"`
+	// Write limits inserts, updates and deletes
+	Write int64 `json:"write"`
+	// Aggregate limits aggregations, including $out and $merge
+	Aggregate int64 `json:"aggregate"`
+}
+
+// AggregateLimits caps the documents and bytes an aggregation returns, so
+// that a pipeline without a $limit cannot return a whole collection.
+// Aggregations writing with $out or $merge are not capped; 0 disables a
+// cap.
+type AggregateLimits struct {
+	MaxDocuments int64 `json:"maxDocuments"`
+	// MaxResponseMB is the total BSON size of the documents returned
+	MaxResponseMB int64 `json:"maxResponseMb"`
+}
+
+// JoinRule allows aggregations on the collections matching Source to join
+// those of another database matching Target. Both are "database.collection"
+// names or path.Match patterns.
+type JoinRule struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+}
+
+// Allows reports whether the rule allows an aggregation on the namespace
+// source to join the namespace target
+func (r JoinRule) Allows(source, target string) bool {
+	s, _ := path.Match(r.Source, source)
+	t, _ := path.Match(r.Target, target)
+	return s && t
+}
+
+// Cluster is an additional MongoDB deployment. In the config file it is
+// either its connection string or an object with the uri and options.
+type Cluster struct {
+	URI string `json:"uri"`
+	ClusterOptions
+}
+
+// UnmarshalJSON accepts a connection string or an object
+func (c *Cluster) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &c.URI); err == nil {
+		return nil
+	}
+	// An alias without the method, so the fields decode normally
+	type cluster Cluster
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	return dec.Decode((*cluster)(c))
+}
+
+// DualWriteConfig configures the mirroring of writes to another cluster
+type DualWriteConfig struct {
+	// Cluster names the cluster writes are mirrored to; dual writes are
+	// disabled when it is empty
+	Cluster string `json:"cluster"`
+	// QueueSize is how many writes may wait to be mirrored (default 10000);
+	// writes made while the queue is full are recorded as failed
+	QueueSize int `json:"queueSize"`
+	// MaxRetries is how often a write failing with a network error or a
+	// timeout is retried (default 3)
+	MaxRetries int `json:"maxRetries"`
+}
+
+// ShadowReadConfig configures the comparison of reads with another cluster
+type ShadowReadConfig struct {
+	// Cluster names the cluster reads are repeated on; shadow reads are
+	// disabled when it is empty
+	Cluster string `json:"cluster"`
+	// Percent is the share of reads repeated, above 0 and at most 100
+	Percent float64 `json:"percent"`
+	// TimeoutMs bounds each repeated read (default 10000)
+	TimeoutMs int `json:"timeoutMs"`
+	// MaxConcurrent is how many repeated reads may be in flight (default
+	// 16); reads beyond it are not repeated
+	MaxConcurrent int `json:"maxConcurrent"`
+}
+
+// RateLimitRedisConfig configures the Redis server holding the rate limit
+// buckets of every replica
+type RateLimitRedisConfig struct {
+	// URL is the server, e.g. "redis://:password@redis:6379/0" or
+	// "rediss://" for TLS; each replica limits requests on its own when it
+	// is empty
+	URL string `json:"url"`
+	// KeyPrefix prefixes the keys of the buckets (default
+	// "mongodataapi:ratelimit:")
+	KeyPrefix string `json:"keyPrefix"`
+	// TimeoutMs bounds each call to Redis (default 100). While calls fail
+	// each replica limits requests on its own.
+	TimeoutMs int `json:"timeoutMs"`
+}
+
+// RequestQueueConfig configures the request queue. Requests over
+// MaxConcurrent wait for a slot; interactive ones are served first, and
+// batch ones once they have waited StarvationMs.
+type RequestQueueConfig struct {
+	// MaxConcurrent is how many requests may be served at once (0 =
+	// unlimited)
+	MaxConcurrent int `json:"maxConcurrent"`
+	// MaxQueued is how many requests may wait (default 1000); requests
+	// arriving while the queue is full are rejected
+	MaxQueued int `json:"maxQueued"`
+	// TimeoutMs is how long a request may wait before it is rejected
+	// (default 10000)
+	TimeoutMs int `json:"timeoutMs"`
+	// StarvationMs is how long a batch request waits before it is served
+	// ahead of interactive ones (default 5000)
+	StarvationMs int `json:"starvationMs"`
+}
+
+// ReadFailoverConfig configures the failover of reads to a standby cluster
+type ReadFailoverConfig struct {
+	// Cluster names the standby cluster; reads don't fail over when it is
+	// empty
+	Cluster string `json:"cluster"`
+	// LatencyBudgetMs is how long a read may run on the default cluster
+	// before it is retried on the standby (default 0: only failed reads
+	// are retried)
+	LatencyBudgetMs int `json:"latencyBudgetMs"`
+}
+
+// FanOutReadConfig configures the finds reading several clusters
+type FanOutReadConfig struct {
+	// Clusters names the clusters read, including DefaultCluster for
+	// MongoURI; fan-out reads are disabled when it is empty
+	Clusters []string `json:"clusters"`
+	// TimeoutMs bounds the read of each cluster (default 10000)
+	TimeoutMs int `json:"timeoutMs"`
+}
+
+// TrafficMirrorConfig configures the replaying of requests to another
+// deployment
+type TrafficMirrorConfig struct {
+	// URL is the base URL requests are replayed to; mirroring is disabled
+	// when it is empty
+	URL string `json:"url"`
+	// Percent is the share of requests replayed, above 0 and at most 100
+	Percent float64 `json:"percent"`
+	// Writes replays writes as well as reads
+	Writes bool `json:"writes"`
+	// APIKey is sent as the apiKey of replayed requests. The credentials of
+	// the client are never forwarded, so without it the target receives
+	// unauthenticated requests.
+	APIKey string `json:"apiKey"`
+	// TimeoutMs bounds each replayed request (default 10000)
+	TimeoutMs int `json:"timeoutMs"`
+	// MaxConcurrent is how many replayed requests may be in flight
+	// (default 32); requests beyond it are not replayed
+	MaxConcurrent int `json:"maxConcurrent"`
+}
+
+// TrashConfig configures the recycle bin of deleted documents
+type TrashConfig struct {
+	// Collections are the "database.collection" names, or path.Match
+	// patterns such as "app.*", whose deletes are moved to the trash
+	Collections []string `json:"collections"`
+	// Collection names the trash collection of each database (default
+	// "_trash")
+	Collection string `json:"collection"`
+	// RetentionDays is how long deleted documents can be restored before
+	// they are purged (default 30)
+	RetentionDays int `json:"retentionDays"`
+}
+
+// ClusterOptions override client settings of a connection string
+type ClusterOptions struct {
+	// RetryWrites and RetryReads turn retryable writes and reads on or
+	// off; the driver retries both by default
+	RetryWrites *bool `json:"retryWrites,omitempty"`
+	RetryReads  *bool `json:"retryReads,omitempty"`
+	// WriteConcern is the default write concern of the deployment
+	WriteConcern *WriteConcern `json:"writeConcern,omitempty"`
+	// Compressors lists the wire compressors to offer the deployment, in
+	// order of preference: zstd, snappy or zlib
+	Compressors []string `json:"compressors,omitempty"`
+	// Auth authenticates with AWS IAM or an X.509 certificate instead of
+	// the credentials of the connection string
+	Auth *MongoAuth `json:"auth,omitempty"`
+}
+
+// MongoDB authentication mechanisms besides those of connection strings
+const (
+	AuthAWS  = "MONGODB-AWS"
+	AuthX509 = "MONGODB-X509"
+)
+
+// MongoAuth configures AWS IAM or X.509 authentication to a deployment
+type MongoAuth struct {
+	// Mechanism is AuthAWS or AuthX509
+	Mechanism string `json:"mechanism"`
+	// AccessKeyID, SecretAccessKey and SessionToken are AWS credentials.
+	// Without them the driver looks them up in the AWS_* environment
+	// variables, the web identity token of RoleARN, ECS and EC2.
+	AccessKeyID     string `json:"accessKeyId,omitempty"`
+	SecretAccessKey string `json:"secretAccessKey,omitempty"`
+	SessionToken    string `json:"sessionToken,omitempty"`
+	// RoleARN is assumed with the token in WebIdentityTokenFile, e.g. that
+	// of an EKS service account. The driver reads them from the process
+	// environment, so they apply to every deployment using AWS without
+	// keys.
+	RoleARN              string `json:"roleArn,omitempty"`
+	WebIdentityTokenFile string `json:"webIdentityTokenFile,omitempty"`
+	// CertificateKeyFile is a PEM file holding the X.509 client
+	// certificate and its key, which CertificateKeyFilePassword decrypts
+	// if it is encrypted
+	CertificateKeyFile         string `json:"certificateKeyFile,omitempty"`
+	CertificateKeyFilePassword string `json:"certificateKeyFilePassword,omitempty"`
+	// CAFile verifies the server's certificate instead of the system roots
+	CAFile string `json:"caFile,omitempty"`
+}
+
+// validate checks the settings of the mechanism of the cluster called name
+func (a *MongoAuth) validate(name string) error {
+	switch a.Mechanism {
+	case AuthAWS:
+		if (a.AccessKeyID == "") != (a.SecretAccessKey == "") {
+			return fmt.Errorf("cluster %q: auth needs both accessKeyId and secretAccessKey", name)
+		}
+		if a.SessionToken != "" && a.AccessKeyID == "" {
+			return fmt.Errorf("cluster %q: a sessionToken needs accessKeyId and secretAccessKey", name)
+		}
+		if (a.RoleARN == "") != (a.WebIdentityTokenFile == "") {
+			return fmt.Errorf("cluster %q: auth needs both roleArn and webIdentityTokenFile", name)
+		}
+		if a.CertificateKeyFile != "" {
+			return fmt.Errorf("cluster %q: certificateKeyFile needs the %s mechanism", name, AuthX509)
+		}
+	case AuthX509:
+		if a.CertificateKeyFile == "" {
+			return fmt.Errorf("cluster %q: the %s mechanism needs a certificateKeyFile", name, AuthX509)
+		}
+		if a.AccessKeyID != "" || a.RoleARN != "" {
+			return fmt.Errorf("cluster %q: AWS credentials need the %s mechanism", name, AuthAWS)
+		}
+	default:
+		return fmt.Errorf("cluster %q: invalid auth mechanism %q (expected %q or %q)", name, a.Mechanism, AuthAWS, AuthX509)
+	}
+	return nil
+}
+
+// WriteConcern is a MongoDB write concern
+type WriteConcern struct {
+	// W is a number of nodes, "majority" or the name of a tag set
+	W interface{} `json:"w,omitempty"`
+	// Journal waits for the write to be journaled
+	Journal *bool `json:"j,omitempty"`
+	// WTimeoutMS bounds the wait for W nodes to acknowledge the write
+	WTimeoutMS int64 `json:"wtimeout,omitempty"`
+}
+
+// validate checks the compressors, authentication and write concern of the
+// cluster called name
+func (o ClusterOptions) validate(name string) error {
+	for _, c := range o.Compressors {
+		if c != "zstd" && c != "snappy" && c != "zlib" {
+			return fmt.Errorf("cluster %q: unknown compressor %q", name, c)
+		}
+	}
+	if o.Auth != nil {
+		if err := o.Auth.validate(name); err != nil {
+			return err
+		}
+	}
+	wc := o.WriteConcern
+	if wc == nil {
+		return nil
+	}
+	switch w := wc.W.(type) {
+	case nil:
+	case float64:
+		if w < 0 || w != float64(int(w)) {
+			return fmt.Errorf("cluster %q: invalid writeConcern.w %v", name, w)
+		}
+	case string:
+		if w == "" {
+			return fmt.Errorf("cluster %q: writeConcern.w must not be empty", name)
+		}
+	default:
+		return fmt.Errorf("cluster %q: writeConcern.w must be a number or a string", name)
+	}
+	if wc.WTimeoutMS < 0 {
+		return fmt.Errorf("cluster %q: writeConcern.wtimeout must not be negative", name)
+	}
+	return nil
+}
+
+// AlertConfig sets the thresholds of the webhook alerts. Alerting is
+// disabled without a WebhookURL.
+type AlertConfig struct {
+	// WebhookURL receives Slack-compatible {"text": "..."} messages
+	WebhookURL string `json:"webhookUrl"`
+	// ErrorRate is the fraction of 5xx responses above which an alert is
+	// sent, e.g. 0.05 (0 = no error rate alerts)
+	ErrorRate float64 `json:"errorRate"`
+	// LatencyMs is the 95th percentile response time above which an alert
+	// is sent (0 = no latency alerts)
+	LatencyMs int `json:"latencyMs"`
+	// WindowSeconds is the sliding window the thresholds are compared to
+	// (default 300), and MinRequests the traffic in it below which no alert
+	// is sent (default 20)
+	WindowSeconds int `json:"windowSeconds"`
+	MinRequests   int `json:"minRequests"`
+	// CooldownSeconds is the time before an alert still breached is sent
+	// again (default 900)
+	CooldownSeconds int `json:"cooldownSeconds"`
+}
+
+// PublicCollection exposes a collection read-only to anonymous requests
+type PublicCollection struct {
+	// Namespace is the "database.collection" exposed
+	Namespace string `json:"namespace"`
+	// Filter is combined with the filter of every anonymous request, so
+	// that only the documents it matches are public
+	Filter map[string]interface{} `json:"filter,omitempty"`
+	// MaxLimit caps the documents returned by an anonymous find (default
+	// 100)
+	MaxLimit int64 `json:"maxLimit,omitempty"`
+}
+
+// OAuthConfig validates OAuth2 access tokens, as JWTs signed by the keys
+// published at JWKSURL or by asking the IntrospectionURL of the identity
+// provider (RFC 7662), and maps their scopes to roles. A scope
+// "<ScopePrefix><role>:<namespace>" grants the operations of the role on
+// the namespace, a database or "database.collection" pattern, and
+// "<ScopePrefix><role>" grants them on every namespace.
+type OAuthConfig struct {
+	JWKSURL string `json:"jwksUrl"`
+	// Issuer and Audience are required claims of JWTs when set
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+	// IntrospectionURL is called with the ClientID and ClientSecret of the
+	// proxy for tokens that are not JWTs
+	IntrospectionURL string `json:"introspectionUrl"`
+	ClientID         string `json:"clientId"`
+	ClientSecret     string `json:"clientSecret"`
+	// ScopePrefix marks the scopes meant for the proxy (default "mongo.")
+	ScopePrefix string `json:"scopePrefix"`
+	// TenantClaim names the claim holding the tenant of a client, required
+	// when multi-tenancy is enabled
+	TenantClaim string `json:"tenantClaim"`
+	// RateLimit is the number of requests allowed per minute and client
+	// (0 = unlimited)
+	RateLimit int `json:"rateLimit"`
+}
+
+// Enabled reports whether OAuth2 access tokens are accepted
+func (o OAuthConfig) Enabled() bool {
+	return o.JWKSURL != "" || o.IntrospectionURL != ""
+}
+
+// SavedQuery is a pre-approved operation. Values of the form
+// {"$param": "name"} anywhere in its templates are replaced by the
+// corresponding typed parameter when the query is run.
+type SavedQuery struct {
+	Name        string                   `json:"name"`
+	Description string                   `json:"description,omitempty"`
+	Operation   string                   `json:"operation"`
+	Database    string                   `json:"database"`
+	Collection  string                   `json:"collection"`
+	Parameters  []Parameter              `json:"parameters,omitempty"`
+	Document    map[string]interface{}   `json:"document,omitempty"`
+	Filter      map[string]interface{}   `json:"filter,omitempty"`
+	Update      map[string]interface{}   `json:"update,omitempty"`
+	Upsert      bool                     `json:"upsert,omitempty"`
+	Projection  map[string]interface{}   `json:"projection,omitempty"`
+	Sort        map[string]interface{}   `json:"sort,omitempty"`
+	Limit       int64                    `json:"limit,omitempty"`
+	Skip        int64                    `json:"skip,omitempty"`
+	Pipeline    []map[string]interface{} `json:"pipeline,omitempty"`
+	// Async runs an aggregate ending in $out or $merge as a background
+	// job, as async does for /api/aggregate
+	Async bool `json:"async,omitempty"`
+}
+
+// Parameter declares a saved query parameter. Type is one of string, int,
+// number, bool, date (RFC 3339) or objectId.
+type Parameter struct {
+	Name     string      `json:"name"`
+	Type     string      `json:"type"`
+	Required bool        `json:"required,omitempty"`
+	Default  interface{} `json:"default,omitempty"`
+}
+
+// Endpoint is a custom endpoint served at /api/custom/<path> by a Starlark
+// script defining handle(req)
+type Endpoint struct {
+	Name   string `json:"name"`
+	Method string `json:"method"`
+	// Path may contain route parameters such as ":id"
+	Path   string `json:"path"`
+	Script string `json:"script"`
+	// TimeoutMs bounds the script's execution time (default 10000)
+	TimeoutMs int `json:"timeoutMs"`
+}
+
+// RetentionPolicy expires the documents of a collection once the date in
+// Field is older than ExpireAfter
+type RetentionPolicy struct {
+	Database   string `json:"database"`
+	Collection string `json:"collection"`
+	Field      string `json:"field"`
+	// ExpireAfter is a duration such as "720h" or a number of days such as
+	// "30d"
+	ExpireAfter string `json:"expireAfter"`
+}
+
+// Expiry returns ExpireAfter in seconds
+func (p RetentionPolicy) Expiry() (int64, error) {
+	if days, ok := strings.CutSuffix(p.ExpireAfter, "d"); ok {
+		n, err := strconv.ParseInt(days, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid expireAfter %q", p.ExpireAfter)
+		}
+		return n * 24 * 60 * 60, nil
+	}
+	d, err := time.ParseDuration(p.ExpireAfter)
+	if err != nil || d < time.Second {
+		return 0, fmt.Errorf("invalid expireAfter %q", p.ExpireAfter)
+	}
+	return int64(d / time.Second), nil
+}
+
+// Validate checks a single retention policy
+func (p RetentionPolicy) Validate() error {
+	if p.Database == "" || p.Collection == "" || p.Field == "" {
+		return fmt.Errorf("database, collection and field are required")
+	}
+	if strings.HasPrefix(p.Field, "$") || p.Field == "_id" {
+		return fmt.Errorf("invalid field %q", p.Field)
+	}
+	_, err := p.Expiry()
+	return err
+}
+
+// ReadDefaults bound the reads of a collection. A find without a limit
+// gets DefaultLimit, or MaxLimit when it is 0, and larger limits are
+// lowered to MaxLimit. Projection is the Extended JSON projection of finds
+// and findOnes that don't set one.
+type ReadDefaults struct {
+	DefaultLimit int64                  `json:"defaultLimit,omitempty"`
+	MaxLimit     int64                  `json:"maxLimit,omitempty"`
+	Projection   map[string]interface{} `json:"projection,omitempty"`
+}
+
+// WarmQuery is a representative query of a collection: a find with
+// Filter and Sort, or an aggregation when Pipeline is set. Values are
+// Extended JSON. Sort is a list of fields such as "status,-createdAt", as
+// the sort parameter of /api/data, to keep the order of its fields.
+type WarmQuery struct {
+	Database   string                   `json:"database"`
+	Collection string                   `json:"collection"`
+	Filter     map[string]interface{}   `json:"filter,omitempty"`
+	Sort       string                   `json:"sort,omitempty"`
+	Pipeline   []map[string]interface{} `json:"pipeline,omitempty"`
+}
+
+// Validate checks a single warm query
+func (q WarmQuery) Validate() error {
+	if q.Database == "" || q.Collection == "" {
+		return fmt.Errorf("database and collection are required")
+	}
+	if len(q.Pipeline) > 0 && (q.Filter != nil || q.Sort != "") {
+		return fmt.Errorf("a pipeline cannot be combined with filter or sort")
+	}
+	return nil
+}
+
+// SeedSource is a file of documents to load into a collection while it is
+// empty. The file holds a JSON array or one document per line, in Extended
+// JSON.
+type SeedSource struct {
+	Database   string `json:"database"`
+	Collection string `json:"collection"`
+	File       string `json:"file"`
+}
+
+// ProtoSchema names the message of a .proto file documents are encoded as
+type ProtoSchema struct {
+	File string `json:"file"`
+	// Message is the fully qualified message name, e.g. "shop.Order"
+	Message string `json:"message"`
+	// ImportPaths are searched for the files File imports, besides its
+	// own directory
+	ImportPaths []string `json:"importPaths,omitempty"`
+}
+
+// Load reads the configuration from CONFIG_FILE (if set) and the environment
+func Load() (*Config, error) {
+	cfg := &Config{}
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading config file: %w", err)
+		}
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		err = dec.Decode(cfg)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+		}
+	}
+
+	if v := os.Getenv("PORT"); v != "" {
+		cfg.Port = v
+	}
+	if v := os.Getenv("ADMIN_PORT"); v != "" {
+		cfg.AdminPort = v
+	}
+	if v := os.Getenv("MONGO_URI"); v != "" {
+		cfg.MongoURI = v
+	}
+	for env, field := range map[string]**bool{
+		"MONGO_RETRY_WRITES": &cfg.MongoOptions.RetryWrites,
+		"MONGO_RETRY_READS":  &cfg.MongoOptions.RetryReads,
+	} {
+		if v := os.Getenv(env); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q", env, v)
+			}
+			*field = &b
+		}
+	}
+	auth := cfg.MongoOptions.Auth
+	if auth == nil {
+		auth = &MongoAuth{}
+	}
+	for env, field := range map[string]*string{
+		"MONGO_AUTH_MECHANISM":                    &auth.Mechanism,
+		"MONGO_TLS_CERTIFICATE_KEY_FILE":          &auth.CertificateKeyFile,
+		"MONGO_TLS_CERTIFICATE_KEY_FILE_PASSWORD": &auth.CertificateKeyFilePassword,
+		"MONGO_TLS_CA_FILE":                       &auth.CAFile,
+	} {
+		if v := os.Getenv(env); v != "" {
+			*field = v
+		}
+	}
+	if *auth != (MongoAuth{}) {
+		cfg.MongoOptions.Auth = auth
+	}
+	if v := os.Getenv("MONGO_COMPRESSORS"); v != "" {
+		cfg.MongoOptions.Compressors = strings.Split(v, ",")
+	}
+	if v := os.Getenv("MONGO_WRITE_CONCERN"); v != "" {
+		if cfg.MongoOptions.WriteConcern == nil {
+			cfg.MongoOptions.WriteConcern = &WriteConcern{}
+		}
+		// A number of nodes, or "majority" or a tag set name
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.MongoOptions.WriteConcern.W = float64(n)
+		} else {
+			cfg.MongoOptions.WriteConcern.W = v
+		}
+	}
+	if v := os.Getenv("MONGO_APP_NAME"); v != "" {
+		cfg.AppName = v
+	}
+	if v := os.Getenv("API_KEYS_FILE"); v != "" {
+		cfg.APIKeysFile = v
+	}
+	if cfg.APIKeysFile != "" {
+		f, err := os.Open(cfg.APIKeysFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading API keys file: %w", err)
+		}
+		var keys []APIKey
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&keys)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parsing API keys file %s: %w", cfg.APIKeysFile, err)
+		}
+		cfg.APIKeys = append(cfg.APIKeys, keys...)
+	}
+	if v := os.Getenv("API_KEY"); v != "" {
+		cfg.APIKeys = append(cfg.APIKeys, APIKey{Name: "default", Key: v, Tenant: os.Getenv("API_KEY_TENANT")})
+	} else if v := os.Getenv("API_KEY_HASH"); v != "" {
+		cfg.APIKeys = append(cfg.APIKeys, APIKey{Name: "default", KeyHash: v, Tenant: os.Getenv("API_KEY_TENANT")})
+	}
+	if v := os.Getenv("WATCH_CONFIG"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid WATCH_CONFIG %q", v)
+		}
+		cfg.WatchConfig = b
+	}
+	if v := os.Getenv("TENANCY_MODE"); v != "" {
+		cfg.Tenancy.Mode = v
+	}
+	if v := os.Getenv("TENANCY_FIELD"); v != "" {
+		cfg.Tenancy.Field = v
+	}
+	if v := os.Getenv("ADMIN_KEY"); v != "" {
+		cfg.AdminKey = v
+	}
+	if v := os.Getenv("TOKEN_SECRET"); v != "" {
+		cfg.TokenSecret = v
+	}
+	if v := os.Getenv("SYSTEM_DATABASE"); v != "" {
+		cfg.SystemDatabase = v
+	}
+	if v := os.Getenv("HTTP_ENGINE"); v != "" {
+		cfg.Engine = v
+	}
+	if v := os.Getenv("JOBS_DIR"); v != "" {
+		cfg.JobsDir = v
+	}
+	if v := os.Getenv("BODY_LIMIT_MB"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid BODY_LIMIT_MB %q", v)
+		}
+		cfg.BodyLimitMB = n
+	}
+	for env, field := range map[string]*int{
+		"READ_TIMEOUT_SECONDS":          &cfg.ReadTimeoutSeconds,
+		"WRITE_TIMEOUT_SECONDS":         &cfg.WriteTimeoutSeconds,
+		"IDLE_TIMEOUT_SECONDS":          &cfg.IdleTimeoutSeconds,
+		"MAX_CONNECTIONS":               &cfg.MaxConnections,
+		"MAX_CONCURRENT_REQUESTS":       &cfg.RequestQueue.MaxConcurrent,
+		"REQUEST_QUEUE_SIZE":            &cfg.RequestQueue.MaxQueued,
+		"REQUEST_QUEUE_TIMEOUT_MS":      &cfg.RequestQueue.TimeoutMs,
+		"REQUEST_STARVATION_MS":         &cfg.RequestQueue.StarvationMs,
+		"MAX_STREAM_BODY_MB":            &cfg.MaxStreamBodyMB,
+		"MAX_URL_LENGTH":                &cfg.MaxURLLength,
+		"MAX_HEADERS":                   &cfg.MaxHeaders,
+		"SESSION_IDLE_TIMEOUT_SECONDS":  &cfg.SessionIdleTimeoutSeconds,
+		"TAIL_IDLE_TIMEOUT_SECONDS":     &cfg.TailIdleTimeoutSeconds,
+		"TOKEN_MAX_TTL_SECONDS":         &cfg.TokenMaxTTLSeconds,
+		"DUAL_WRITE_QUEUE_SIZE":         &cfg.DualWrite.QueueSize,
+		"DUAL_WRITE_MAX_RETRIES":        &cfg.DualWrite.MaxRetries,
+		"SHADOW_READ_TIMEOUT_MS":        &cfg.ShadowReads.TimeoutMs,
+		"SHADOW_READ_MAX_CONCURRENT":    &cfg.ShadowReads.MaxConcurrent,
+		"FAN_OUT_READ_TIMEOUT_MS":       &cfg.FanOutReads.TimeoutMs,
+		"READ_FAILOVER_BUDGET_MS":       &cfg.ReadFailover.LatencyBudgetMs,
+		"TRAFFIC_MIRROR_TIMEOUT_MS":     &cfg.TrafficMirror.TimeoutMs,
+		"TRAFFIC_MIRROR_MAX_CONCURRENT": &cfg.TrafficMirror.MaxConcurrent,
+		"RATE_LIMIT_REDIS_TIMEOUT_MS":   &cfg.RateLimitRedis.TimeoutMs,
+		"TRASH_RETENTION_DAYS":          &cfg.Trash.RetentionDays,
+		"CURSOR_MAX_AGE_SECONDS":        &cfg.CursorMaxAgeSeconds,
+		"JOB_RETENTION_HOURS":           &cfg.JobRetentionHours,
+	} {
+		if v := os.Getenv(env); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q", env, v)
+			}
+			*field = n
+		}
+	}
+	if v := os.Getenv("DUAL_WRITE_CLUSTER"); v != "" {
+		cfg.DualWrite.Cluster = v
+	}
+	if v := os.Getenv("SHADOW_READ_CLUSTER"); v != "" {
+		cfg.ShadowReads.Cluster = v
+	}
+	if v := os.Getenv("SHADOW_READ_PERCENT"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SHADOW_READ_PERCENT %q", v)
+		}
+		cfg.ShadowReads.Percent = f
+	}
+	if v := os.Getenv("READ_FAILOVER_CLUSTER"); v != "" {
+		cfg.ReadFailover.Cluster = v
+	}
+	if v := os.Getenv("FAN_OUT_READ_CLUSTERS"); v != "" {
+		cfg.FanOutReads.Clusters = strings.Split(v, ",")
+	}
+	if v := os.Getenv("TRAFFIC_MIRROR_URL"); v != "" {
+		cfg.TrafficMirror.URL = v
+	}
+	if v := os.Getenv("TRAFFIC_MIRROR_API_KEY"); v != "" {
+		cfg.TrafficMirror.APIKey = v
+	}
+	if v := os.Getenv("RATE_LIMIT_REDIS_URL"); v != "" {
+		cfg.RateLimitRedis.URL = v
+	}
+	if v := os.Getenv("TRAFFIC_MIRROR_PERCENT"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TRAFFIC_MIRROR_PERCENT %q", v)
+		}
+		cfg.TrafficMirror.Percent = f
+	}
+	if v := os.Getenv("TRAFFIC_MIRROR_WRITES"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TRAFFIC_MIRROR_WRITES %q", v)
+		}
+		cfg.TrafficMirror.Writes = b
+	}
+	if v := os.Getenv("VERSIONED_COLLECTIONS"); v != "" {
+		cfg.VersionedCollections = strings.Split(v, ",")
+	}
+	if v := os.Getenv("TRASH_COLLECTIONS"); v != "" {
+		cfg.Trash.Collections = strings.Split(v, ",")
+	}
+	if v := os.Getenv("TRASH_COLLECTION"); v != "" {
+		cfg.Trash.Collection = v
+	}
+	if v := os.Getenv("MIGRATIONS_DIR"); v != "" {
+		cfg.MigrationsDir = v
+	}
+	if v := os.Getenv("MIGRATE_ON_START"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MIGRATE_ON_START %q", v)
+		}
+		cfg.MigrateOnStart = b
+	}
+	if v := os.Getenv("PLAIN_OBJECT_IDS"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PLAIN_OBJECT_IDS %q", v)
+		}
+		cfg.PlainObjectIDs = b
+	}
+	if v := os.Getenv("STRICT_BODIES"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid STRICT_BODIES %q", v)
+		}
+		cfg.StrictBodies = b
+	}
+	if v := os.Getenv("LEGACY_DELETE_RESULTS"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LEGACY_DELETE_RESULTS %q", v)
+		}
+		cfg.LegacyDeleteResults = b
+	}
+	if v := os.Getenv("REQUIRE_JSON"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REQUIRE_JSON %q", v)
+		}
+		cfg.RequireJSON = b
+	}
+	if v := os.Getenv("RESTRICT_UPSERTS"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RESTRICT_UPSERTS %q", v)
+		}
+		cfg.RestrictUpserts = b
+	}
+	if v := os.Getenv("READ_ONLY"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid READ_ONLY %q", v)
+		}
+		cfg.ReadOnly = b
+	}
+	if v := os.Getenv("REST_API"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REST_API %q", v)
+		}
+		cfg.RESTAPI = b
+	}
+	for env, field := range map[string]*[]float64{
+		"METRICS_HTTP_BUCKETS":  &cfg.Metrics.HTTPBuckets,
+		"METRICS_MONGO_BUCKETS": &cfg.Metrics.MongoBuckets,
+	} {
+		if v := os.Getenv(env); v != "" {
+			var buckets []float64
+			for _, b := range strings.Split(v, ",") {
+				f, err := strconv.ParseFloat(strings.TrimSpace(b), 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid %s %q", env, v)
+				}
+				buckets = append(buckets, f)
+			}
+			*field = buckets
+		}
+	}
+	if v := os.Getenv("METRICS_NATIVE_HISTOGRAMS"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid METRICS_NATIVE_HISTOGRAMS %q", v)
+		}
+		cfg.Metrics.NativeHistograms = b
+	}
+	if v := os.Getenv("ACCESS_LOG"); v != "" {
+		// "off" disables an access log enabled in the config file
+		cfg.AccessLog.Format = v
+		if v == "off" {
+			cfg.AccessLog.Format = ""
+		}
+	}
+	if v := os.Getenv("ACCESS_LOG_OUTPUT"); v != "" {
+		cfg.AccessLog.Output = v
+	}
+	for env, field := range map[string]*int{
+		"ACCESS_LOG_MAX_SIZE_MB": &cfg.AccessLog.MaxSizeMB,
+		"ACCESS_LOG_MAX_BACKUPS": &cfg.AccessLog.MaxBackups,
+	} {
+		if v := os.Getenv(env); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q", env, v)
+			}
+			*field = n
+		}
+	}
+	for env, field := range map[string]*int64{
+		"MAX_TIME_MS_READ":          &cfg.MaxTimeMS.Read,
+		"MAX_TIME_MS_WRITE":         &cfg.MaxTimeMS.Write,
+		"MAX_TIME_MS_AGGREGATE":     &cfg.MaxTimeMS.Aggregate,
+		"AGGREGATE_MAX_DOCUMENTS":   &cfg.AggregateLimits.MaxDocuments,
+		"AGGREGATE_MAX_RESPONSE_MB": &cfg.AggregateLimits.MaxResponseMB,
+	} {
+		if v := os.Getenv(env); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q", env, v)
+			}
+			*field = n
+		}
+	}
+	for env, field := range map[string]*string{
+		"OAUTH_JWKS_URL":          &cfg.OAuth.JWKSURL,
+		"OAUTH_ISSUER":            &cfg.OAuth.Issuer,
+		"OAUTH_AUDIENCE":          &cfg.OAuth.Audience,
+		"OAUTH_INTROSPECTION_URL": &cfg.OAuth.IntrospectionURL,
+		"OAUTH_CLIENT_ID":         &cfg.OAuth.ClientID,
+		"OAUTH_CLIENT_SECRET":     &cfg.OAuth.ClientSecret,
+		"OAUTH_SCOPE_PREFIX":      &cfg.OAuth.ScopePrefix,
+		"OAUTH_TENANT_CLAIM":      &cfg.OAuth.TenantClaim,
+	} {
+		if v := os.Getenv(env); v != "" {
+			*field = v
+		}
+	}
+	if v := os.Getenv("ALERT_WEBHOOK_URL"); v != "" {
+		cfg.Alerts.WebhookURL = v
+	}
+	if v := os.Getenv("ALERT_ERROR_RATE"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ALERT_ERROR_RATE %q", v)
+		}
+		cfg.Alerts.ErrorRate = f
+	}
+	for env, field := range map[string]*int{
+		"ALERT_LATENCY_MS":       &cfg.Alerts.LatencyMs,
+		"ALERT_WINDOW_SECONDS":   &cfg.Alerts.WindowSeconds,
+		"ALERT_MIN_REQUESTS":     &cfg.Alerts.MinRequests,
+		"ALERT_COOLDOWN_SECONDS": &cfg.Alerts.CooldownSeconds,
+		"OAUTH_RATE_LIMIT":       &cfg.OAuth.RateLimit,
+		"PUBLIC_RATE_LIMIT":      &cfg.PublicRateLimit,
+	} {
+		if v := os.Getenv(env); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q", env, v)
+			}
+			*field = n
+		}
+	}
+	if v := os.Getenv("PREFORK"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PREFORK %q", v)
+		}
+		cfg.Prefork = b
+	}
+	if v := os.Getenv("TLS_CERT_FILE"); v != "" {
+		cfg.TLSCertFile = v
+	}
+	if v := os.Getenv("TLS_KEY_FILE"); v != "" {
+		cfg.TLSKeyFile = v
+	}
+	if v := os.Getenv("ACME_DOMAINS"); v != "" {
+		cfg.ACMEDomains = strings.Split(v, ",")
+	}
+	if v := os.Getenv("ACME_EMAIL"); v != "" {
+		cfg.ACMEEmail = v
+	}
+	if v := os.Getenv("ACME_CACHE_DIR"); v != "" {
+		cfg.ACMECacheDir = v
+	}
+	if v := os.Getenv("ACME_DIRECTORY_URL"); v != "" {
+		cfg.ACMEDirectoryURL = v
+	}
+	if v := os.Getenv("STATS_CACHE_SECONDS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid STATS_CACHE_SECONDS %q", v)
+		}
+		cfg.StatsCacheSeconds = n
+	}
+
+	// Defaults
+	if cfg.Port == "" {
+		cfg.Port = "3000"
+	}
+	if cfg.MongoURI == "" {
+		cfg.MongoURI = "mongodb://localhost:27017"
+	}
+	if cfg.AppName == "" {
+		cfg.AppName = "mongo-data-api"
+	}
+	if cfg.SystemDatabase == "" {
+		cfg.SystemDatabase = "dataapi_system"
+	}
+	if cfg.Engine == "" {
+		cfg.Engine = EngineFiber
+	}
+	if cfg.JobsDir == "" {
+		cfg.JobsDir = filepath.Join(os.TempDir(), "dataapi-jobs")
+	}
+	if cfg.JobRetentionHours == 0 {
+		cfg.JobRetentionHours = 24
+	}
+	if len(cfg.ACMEDomains) > 0 && cfg.ACMECacheDir == "" {
+		cfg.ACMECacheDir = filepath.Join(os.TempDir(), "dataapi-acme")
+	}
+	if cfg.StatsCacheSeconds == 0 {
+		cfg.StatsCacheSeconds = 30
+	}
+	if cfg.CursorMaxAgeSeconds == 0 {
+		cfg.CursorMaxAgeSeconds = 3600
+	}
+	if cfg.SessionIdleTimeoutSeconds == 0 {
+		cfg.SessionIdleTimeoutSeconds = 300
+	}
+	if cfg.TailIdleTimeoutSeconds == 0 {
+		cfg.TailIdleTimeoutSeconds = 60
+	}
+	if cfg.TokenMaxTTLSeconds == 0 {
+		cfg.TokenMaxTTLSeconds = 3600
+	}
+	if len(cfg.PublicCollections) > 0 && cfg.PublicRateLimit == 0 {
+		cfg.PublicRateLimit = 60
+	}
+	if cfg.OAuth.Enabled() && cfg.OAuth.ScopePrefix == "" {
+		cfg.OAuth.ScopePrefix = "mongo."
+	}
+	if cfg.BodyLimitMB == 0 {
+		cfg.BodyLimitMB = 4
+	}
+	if cfg.MaxStreamBodyMB == 0 {
+		cfg.MaxStreamBodyMB = 1024
+	}
+	if cfg.MaxURLLength == 0 {
+		cfg.MaxURLLength = 4096
+	}
+	if cfg.MaxHeaders == 0 {
+		cfg.MaxHeaders = 100
+	}
+	if cfg.RateLimitRedis.KeyPrefix == "" {
+		cfg.RateLimitRedis.KeyPrefix = "mongodataapi:ratelimit:"
+	}
+	if cfg.RateLimitRedis.TimeoutMs == 0 {
+		cfg.RateLimitRedis.TimeoutMs = 100
+	}
+	if cfg.RequestQueue.MaxQueued == 0 {
+		cfg.RequestQueue.MaxQueued = 1000
+	}
+	if cfg.RequestQueue.TimeoutMs == 0 {
+		cfg.RequestQueue.TimeoutMs = 10000
+	}
+	if cfg.RequestQueue.StarvationMs == 0 {
+		cfg.RequestQueue.StarvationMs = 5000
+	}
+	if cfg.DualWrite.QueueSize == 0 {
+		cfg.DualWrite.QueueSize = 10000
+	}
+	if cfg.DualWrite.MaxRetries == 0 {
+		cfg.DualWrite.MaxRetries = 3
+	}
+	if cfg.ShadowReads.TimeoutMs == 0 {
+		cfg.ShadowReads.TimeoutMs = 10000
+	}
+	if cfg.ShadowReads.MaxConcurrent == 0 {
+		cfg.ShadowReads.MaxConcurrent = 16
+	}
+	if cfg.FanOutReads.TimeoutMs == 0 {
+		cfg.FanOutReads.TimeoutMs = 10000
+	}
+	if cfg.TrafficMirror.TimeoutMs == 0 {
+		cfg.TrafficMirror.TimeoutMs = 10000
+	}
+	if cfg.TrafficMirror.MaxConcurrent == 0 {
+		cfg.TrafficMirror.MaxConcurrent = 32
+	}
+	if cfg.Trash.Collection == "" {
+		cfg.Trash.Collection = "_trash"
+	}
+	if cfg.Trash.RetentionDays == 0 {
+		cfg.Trash.RetentionDays = 30
+	}
+	if cfg.ReadTimeoutSeconds == 0 {
+		cfg.ReadTimeoutSeconds = 10
+	}
+	if cfg.WriteTimeoutSeconds == 0 {
+		cfg.WriteTimeoutSeconds = 10
+	}
+	if cfg.AccessLog.MaxSizeMB == 0 {
+		cfg.AccessLog.MaxSizeMB = 100
+	}
+	if cfg.AccessLog.MaxBackups == 0 {
+		cfg.AccessLog.MaxBackups = 5
+	}
+	if cfg.Alerts.WindowSeconds == 0 {
+		cfg.Alerts.WindowSeconds = 300
+	}
+	if cfg.Alerts.MinRequests == 0 {
+		cfg.Alerts.MinRequests = 20
+	}
+	if cfg.Alerts.CooldownSeconds == 0 {
+		cfg.Alerts.CooldownSeconds = 900
+	}
+	if cfg.Tenancy.Mode == TenancyField && cfg.Tenancy.Field == "" {
+		cfg.Tenancy.Field = "tenantId"
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Files returns the configuration files Load reads
+func (cfg *Config) Files() []string {
+	var files []string
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		files = append(files, path)
+	}
+	if cfg.APIKeysFile != "" {
+		files = append(files, cfg.APIKeysFile)
+	}
+	return files
+}
+
+// Validate checks the configuration for inconsistencies
+func (cfg *Config) Validate() error {
+	switch cfg.Tenancy.Mode {
+	case TenancyNone, TenancyPrefix, TenancyField:
+	default:
+		return fmt.Errorf("invalid tenancy mode %q (expected %q or %q)", cfg.Tenancy.Mode, TenancyPrefix, TenancyField)
+	}
+	if cfg.Tenancy.Mode == TenancyField && strings.ContainsAny(cfg.Tenancy.Field, ".$") {
+		return fmt.Errorf("invalid tenancy field %q", cfg.Tenancy.Field)
+	}
+	switch cfg.Engine {
+	case "", EngineFiber, EngineNetHTTP:
+	default:
+		return fmt.Errorf("invalid engine %q (expected %q or %q)", cfg.Engine, EngineFiber, EngineNetHTTP)
+	}
+	if cfg.BodyLimitMB < 0 {
+		return fmt.Errorf("bodyLimitMb must not be negative")
+	}
+	if cfg.MaxStreamBodyMB < 0 || cfg.MaxURLLength < 0 || cfg.MaxHeaders < 0 {
+		return fmt.Errorf("maxStreamBodyMb, maxUrlLength and maxHeaders must not be negative")
+	}
+	if cfg.ReadTimeoutSeconds < 0 || cfg.WriteTimeoutSeconds < 0 || cfg.IdleTimeoutSeconds < 0 || cfg.SessionIdleTimeoutSeconds < 0 || cfg.TailIdleTimeoutSeconds < 0 {
+		return fmt.Errorf("timeouts must not be negative")
+	}
+	if cfg.MaxConnections < 0 {
+		return fmt.Errorf("maxConnections must not be negative")
+	}
+	if q := cfg.RequestQueue; q.MaxConcurrent < 0 || q.MaxQueued < 0 || q.TimeoutMs < 0 || q.StarvationMs < 0 {
+		return fmt.Errorf("requestQueue.maxConcurrent, maxQueued, timeoutMs and starvationMs must not be negative")
+	}
+	if cfg.TokenSecret != "" && len(cfg.TokenSecret) < 32 {
+		return fmt.Errorf("tokenSecret must be at least 32 characters")
+	}
+	if cfg.TokenMaxTTLSeconds < 0 {
+		return fmt.Errorf("tokenMaxTtlSeconds must not be negative")
+	}
+	if cfg.OAuth.IntrospectionURL != "" && cfg.OAuth.ClientID == "" {
+		return fmt.Errorf("oauth.introspectionUrl requires oauth.clientId")
+	}
+	if cfg.OAuth.Enabled() && cfg.Tenancy.Mode != TenancyNone && cfg.OAuth.TenantClaim == "" {
+		return fmt.Errorf("oauth.tenantClaim is required with multi-tenancy")
+	}
+	if cfg.OAuth.RateLimit < 0 {
+		return fmt.Errorf("oauth.rateLimit must not be negative")
+	}
+	for _, p := range cfg.PublicCollections {
+		if db, coll, ok := strings.Cut(p.Namespace, "."); !ok || db == "" || coll == "" || strings.ContainsAny(p.Namespace, `*?[\`) {
+			return fmt.Errorf("invalid publicCollections namespace %q: expected \"database.collection\"", p.Namespace)
+		}
+		if p.MaxLimit < 0 {
+			return fmt.Errorf("publicCollections %q: maxLimit must not be negative", p.Namespace)
+		}
+	}
+	if len(cfg.PublicCollections) > 0 && cfg.Tenancy.Mode != TenancyNone {
+		return fmt.Errorf("publicCollections cannot be used with multi-tenancy")
+	}
+	if cfg.PublicRateLimit < 0 {
+		return fmt.Errorf("publicRateLimit must not be negative")
+	}
+	if rr := cfg.RateLimitRedis; rr.URL != "" && !strings.HasPrefix(rr.URL, "redis://") && !strings.HasPrefix(rr.URL, "rediss://") {
+		return fmt.Errorf("invalid rateLimitRedis.url: expected a redis:// or rediss:// URL")
+	}
+	if cfg.RateLimitRedis.TimeoutMs < 0 {
+		return fmt.Errorf("rateLimitRedis.timeoutMs must not be negative")
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return fmt.Errorf("tlsCertFile and tlsKeyFile must be set together")
+	}
+	if len(cfg.ACMEDomains) > 0 && cfg.TLSCertFile != "" {
+		return fmt.Errorf("acmeDomains and tlsCertFile cannot be used together")
+	}
+	for _, d := range cfg.ACMEDomains {
+		if d == "" || strings.ContainsAny(d, "/: ") {
+			return fmt.Errorf("invalid ACME domain %q", d)
+		}
+	}
+	if cfg.Prefork && (cfg.TLSCertFile != "" || len(cfg.ACMEDomains) > 0) {
+		// Fiber only preforks with static certificate files
+		return fmt.Errorf("prefork cannot be used with TLS")
+	}
+	if cfg.Prefork && cfg.Engine == EngineNetHTTP {
+		return fmt.Errorf("prefork is only supported by the %q engine", EngineFiber)
+	}
+	if cfg.AdminPort != "" && cfg.AdminPort == cfg.Port {
+		return fmt.Errorf("adminPort must differ from port")
+	}
+	if cfg.Prefork && cfg.AdminPort != "" {
+		// The processes can't share the admin listener
+		return fmt.Errorf("prefork cannot be used with adminPort")
+	}
+	if cfg.Prefork && cfg.Mock {
+		// Every process would hold its own in-memory data
+		return fmt.Errorf("prefork cannot be used with the mock data store")
+	}
+	switch cfg.AccessLog.Format {
+	case "", AccessLogCommon, AccessLogCombined, AccessLogJSON:
+	default:
+		return fmt.Errorf("invalid access log format %q (expected %q, %q or %q)", cfg.AccessLog.Format, AccessLogCommon, AccessLogCombined, AccessLogJSON)
+	}
+	if cfg.AccessLog.MaxSizeMB < 0 || cfg.AccessLog.MaxBackups < 0 {
+		return fmt.Errorf("accessLog.maxSizeMb and accessLog.maxBackups must not be negative")
+	}
+	if cfg.Prefork && cfg.AccessLog.Format != "" && cfg.AccessLog.File() {
+		// The processes would rotate the file from under each other
+		return fmt.Errorf("prefork cannot be used with an access log file")
+	}
+	for ns, fields := range cfg.ShardKeys {
+		if db, coll, ok := strings.Cut(ns, "."); !ok || db == "" || coll == "" || len(fields) == 0 {
+			return fmt.Errorf("invalid shardKeys entry %q: expected \"database.collection\" with at least one field", ns)
+		}
+	}
+	for ns, fields := range cfg.NaturalKeys {
+		if db, coll, ok := strings.Cut(ns, "."); !ok || db == "" || coll == "" || len(fields) == 0 {
+			return fmt.Errorf("invalid naturalKeys entry %q: expected \"database.collection\" with at least one field", ns)
+		}
+	}
+	for _, ns := range cfg.VersionedCollections {
+		if db, coll, ok := strings.Cut(ns, "."); !ok || db == "" || coll == "" {
+			return fmt.Errorf("invalid versionedCollections entry %q: expected \"database.collection\"", ns)
+		}
+	}
+	for ns, schema := range cfg.ProtoSchemas {
+		if db, coll, ok := strings.Cut(ns, "."); !ok || db == "" || coll == "" {
+			return fmt.Errorf("invalid protoSchemas entry %q: expected \"database.collection\"", ns)
+		}
+		if schema.File == "" || schema.Message == "" {
+			return fmt.Errorf("protoSchemas %q: file and message are required", ns)
+		}
+	}
+	for ns, fields := range cfg.UUIDFields {
+		if db, coll, ok := strings.Cut(ns, "."); !ok || db == "" || coll == "" || len(fields) == 0 {
+			return fmt.Errorf("invalid uuidFields entry %q: expected \"database.collection\" with at least one field", ns)
+		}
+	}
+	for ns, fields := range cfg.ComputedFields {
+		if db, coll, ok := strings.Cut(ns, "."); !ok || db == "" || coll == "" || len(fields) == 0 {
+			return fmt.Errorf("invalid computedFields entry %q: expected \"database.collection\" with at least one field", ns)
+		}
+		for field := range fields {
+			if field == "" || field == "_id" || strings.HasPrefix(field, "$") || strings.Contains(field, ".") {
+				return fmt.Errorf("computedFields %q: invalid field name %q", ns, field)
+			}
+		}
+	}
+	for ns, d := range cfg.ReadDefaults {
+		if db, coll, ok := strings.Cut(ns, "."); !ok || db == "" || coll == "" {
+			return fmt.Errorf("invalid readDefaults entry %q: expected \"database.collection\"", ns)
+		}
+		if d.DefaultLimit < 0 || d.MaxLimit < 0 {
+			return fmt.Errorf("readDefaults %q: limits must not be negative", ns)
+		}
+		if d.MaxLimit > 0 && d.DefaultLimit > d.MaxLimit {
+			return fmt.Errorf("readDefaults %q: defaultLimit must not exceed maxLimit", ns)
+		}
+	}
+	if cfg.AggregateLimits.MaxDocuments < 0 || cfg.AggregateLimits.MaxResponseMB < 0 {
+		return fmt.Errorf("aggregateLimits must not be negative")
+	}
+	for _, r := range cfg.CrossDatabaseJoins {
+		for _, pattern := range []string{r.Source, r.Target} {
+			db, coll, ok := strings.Cut(pattern, ".")
+			if _, err := path.Match(pattern, ""); err != nil || !ok || db == "" || coll == "" {
+				return fmt.Errorf("invalid crossDatabaseJoins entry %q: expected \"database.collection\" or a pattern", pattern)
+			}
+		}
+	}
+	if cfg.MaxTimeMS.Read < 0 || cfg.MaxTimeMS.Write < 0 || cfg.MaxTimeMS.Aggregate < 0 {
+		return fmt.Errorf("maxTimeMs must not be negative")
+	}
+	if a := cfg.Alerts; a.WebhookURL != "" {
+		if !strings.HasPrefix(a.WebhookURL, "http://") && !strings.HasPrefix(a.WebhookURL, "https://") {
+			return fmt.Errorf("invalid alerts.webhookUrl %q", a.WebhookURL)
+		}
+		if a.ErrorRate == 0 && a.LatencyMs == 0 {
+			return fmt.Errorf("alerts need an errorRate or a latencyMs threshold")
+		}
+		if a.ErrorRate < 0 || a.ErrorRate >= 1 {
+			return fmt.Errorf("alerts.errorRate must be between 0 and 1")
+		}
+		if a.WindowSeconds <= 0 {
+			return fmt.Errorf("alerts.windowSeconds must be positive")
+		}
+		if a.LatencyMs < 0 || a.MinRequests < 0 || a.CooldownSeconds < 0 {
+			return fmt.Errorf("alerts.latencyMs, minRequests and cooldownSeconds must not be negative")
+		}
+	}
+	if cfg.MigrateOnStart && cfg.MigrationsDir == "" {
+		return fmt.Errorf("migrateOnStart needs migrationsDir")
+	}
+	if cfg.ReadOnly && (cfg.MigrateOnStart || len(cfg.Seed) > 0 && !cfg.Mock) {
+		return fmt.Errorf("readOnly cannot be combined with migrateOnStart or seed")
+	}
+	if dw := cfg.DualWrite; dw.Cluster != "" {
+		if _, ok := cfg.Clusters[dw.Cluster]; !ok {
+			return fmt.Errorf("dualWrite.cluster %q is not a configured cluster", dw.Cluster)
+		}
+		if cfg.ReadOnly {
+			return fmt.Errorf("dualWrite cannot be combined with readOnly")
+		}
+	}
+	if cfg.DualWrite.QueueSize < 0 || cfg.DualWrite.MaxRetries < 0 {
+		return fmt.Errorf("dualWrite.queueSize and maxRetries must not be negative")
+	}
+	if sr := cfg.ShadowReads; sr.Cluster != "" {
+		if _, ok := cfg.Clusters[sr.Cluster]; !ok {
+			return fmt.Errorf("shadowReads.cluster %q is not a configured cluster", sr.Cluster)
+		}
+		if sr.Percent <= 0 || sr.Percent > 100 {
+			return fmt.Errorf("shadowReads.percent must be above 0 and at most 100")
+		}
+	}
+	if cfg.ShadowReads.TimeoutMs < 0 || cfg.ShadowReads.MaxConcurrent < 0 {
+		return fmt.Errorf("shadowReads.timeoutMs and maxConcurrent must not be negative")
+	}
+	if rf := cfg.ReadFailover; rf.Cluster != "" {
+		if _, ok := cfg.Clusters[rf.Cluster]; !ok {
+			return fmt.Errorf("readFailover.cluster %q is not a configured cluster", rf.Cluster)
+		}
+	}
+	if cfg.ReadFailover.LatencyBudgetMs < 0 {
+		return fmt.Errorf("readFailover.latencyBudgetMs must not be negative")
+	}
+	fanOut := make(map[string]bool, len(cfg.FanOutReads.Clusters))
+	for _, name := range cfg.FanOutReads.Clusters {
+		if _, ok := cfg.Clusters[name]; !ok && name != DefaultCluster {
+			return fmt.Errorf("fanOutReads.clusters: %q is not a configured cluster", name)
+		}
+		if fanOut[name] {
+			return fmt.Errorf("fanOutReads.clusters: %q is listed twice", name)
+		}
+		fanOut[name] = true
+	}
+	if cfg.FanOutReads.TimeoutMs < 0 {
+		return fmt.Errorf("fanOutReads.timeoutMs must not be negative")
+	}
+	if tm := cfg.TrafficMirror; tm.URL != "" {
+		if !strings.HasPrefix(tm.URL, "http://") && !strings.HasPrefix(tm.URL, "https://") {
+			return fmt.Errorf("invalid trafficMirror.url %q", tm.URL)
+		}
+		if tm.Percent <= 0 || tm.Percent > 100 {
+			return fmt.Errorf("trafficMirror.percent must be above 0 and at most 100")
+		}
+	}
+	if cfg.TrafficMirror.TimeoutMs < 0 || cfg.TrafficMirror.MaxConcurrent < 0 {
+		return fmt.Errorf("trafficMirror.timeoutMs and maxConcurrent must not be negative")
+	}
+	for _, pattern := range cfg.Trash.Collections {
+		db, coll, ok := strings.Cut(pattern, ".")
+		if _, err := path.Match(pattern, ""); err != nil || !ok || db == "" || coll == "" {
+			return fmt.Errorf("invalid trash.collections entry %q: expected \"database.collection\" or a pattern", pattern)
+		}
+	}
+	if cfg.Trash.RetentionDays < 0 {
+		return fmt.Errorf("trash.retentionDays must not be negative")
+	}
+	for name, buckets := range map[string][]float64{"httpBuckets": cfg.Metrics.HTTPBuckets, "mongoBuckets": cfg.Metrics.MongoBuckets} {
+		for i, b := range buckets {
+			if b <= 0 || i > 0 && b <= buckets[i-1] {
+				return fmt.Errorf("metrics.%s must be positive and increasing", name)
+			}
+		}
+	}
+	if cfg.RecordDir != "" && cfg.ReplayDir != "" {
+		return fmt.Errorf("recordDir and replayDir cannot be used together")
+	}
+	if err := cfg.MongoOptions.validate(DefaultCluster); err != nil {
+		return err
+	}
+	var role *MongoAuth
+	if a := cfg.MongoOptions.Auth; a != nil && a.RoleARN != "" {
+		role = a
+	}
+	for name, cluster := range cfg.Clusters {
+		if name == "" || name == DefaultCluster || cluster.URI == "" {
+			return fmt.Errorf("invalid cluster %q: names must not be empty or %q and need a connection string", name, DefaultCluster)
+		}
+		if err := cluster.validate(name); err != nil {
+			return err
+		}
+		if a := cluster.Auth; a != nil && a.RoleARN != "" {
+			// The role is set in the process environment
+			if role != nil && (a.RoleARN != role.RoleARN || a.WebIdentityTokenFile != role.WebIdentityTokenFile) {
+				return fmt.Errorf("cluster %q: all clusters must assume the same roleArn with the same webIdentityTokenFile", name)
+			}
+			role = a
+		}
+	}
+
+	seen := make(map[string]bool)
+	names := make(map[string]bool)
+	for i := range cfg.APIKeys {
+		k := &cfg.APIKeys[i]
+		if k.Name == "" {
+			k.Name = fmt.Sprintf("key%d", i)
+		}
+		if err := k.Validate(); err != nil {
+			return fmt.Errorf("apiKeys[%d]: %w", i, err)
+		}
+		if k.Key != "" && seen[k.Key] || names[k.Name] {
+			return fmt.Errorf("apiKeys[%d]: duplicate key", i)
+		}
+		seen[k.Key] = true
+		names[k.Name] = true
+	}
+	for i, r := range cfg.Roles {
+		if err := r.Validate(); err != nil {
+			return fmt.Errorf("roles[%d]: %w", i, err)
+		}
+	}
+	policies := make(map[string]bool)
+	for i, p := range cfg.Retention {
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("retention[%d]: %w", i, err)
+		}
+		key := p.Database + "." + p.Collection + "." + p.Field
+		if policies[key] {
+			return fmt.Errorf("retention[%d]: duplicate policy for field %s of %s.%s", i, p.Field, p.Database, p.Collection)
+		}
+		policies[key] = true
+	}
+	for i, q := range cfg.WarmQueries {
+		if err := q.Validate(); err != nil {
+			return fmt.Errorf("warmQueries[%d]: %w", i, err)
+		}
+	}
+	seeded := make(map[string]bool)
+	for i, src := range cfg.Seed {
+		if src.Database == "" || src.Collection == "" || src.File == "" {
+			return fmt.Errorf("seed[%d]: database, collection and file are required", i)
+		}
+		ns := src.Database + "." + src.Collection
+		if seeded[ns] {
+			// The second file would never be loaded into the non-empty collection
+			return fmt.Errorf("seed[%d]: duplicate seed for %s", i, ns)
+		}
+		seeded[ns] = true
+	}
+	return nil
+}
+
+// Validate checks a single API key definition
+func (k APIKey) Validate() error {
+	if k.Name == "" {
+		return fmt.Errorf("name must not be empty")
+	}
+	if k.Key == "" && k.KeyHash == "" {
+		return fmt.Errorf("key or keyHash must not be empty")
+	}
+	if k.KeyHash != "" {
+		prefix, hash, ok := strings.Cut(k.KeyHash, ":")
+		if !ok || len(prefix) != 8 || !strings.HasPrefix(hash, "$2") {
+			return fmt.Errorf("invalid keyHash: expected the first 8 characters of the key, a colon and a bcrypt hash")
+		}
+	}
+	if k.RateLimit < 0 {
+		return fmt.Errorf("rateLimit must not be negative")
+	}
+	switch k.Priority {
+	case "", PriorityInteractive, PriorityBatch:
+	default:
+		return fmt.Errorf("invalid priority %q: expected %s or %s", k.Priority, PriorityInteractive, PriorityBatch)
+	}
+	if k.Envelope != nil {
+		if err := k.Envelope.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, ns := range k.Namespaces {
+		if _, err := path.Match(ns, ""); err != nil || ns == "" {
+			return fmt.Errorf("invalid namespace pattern %q", ns)
+		}
+	}
+	return ValidateTenantID(k.Tenant)
+}
+
+// Validate checks a single role definition
+func (r Role) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("name must not be empty")
+	}
+	if len(r.Operations) == 0 {
+		return fmt.Errorf("role %q grants no operations", r.Name)
+	}
+	return nil
+}
+
+// ValidateTenantID ensures a tenant id is safe to use in database names
+func ValidateTenantID(id string) error {
+	if len(id) > 32 {
+		return fmt.Errorf("tenant id %q is longer than 32 characters", id)
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+			return fmt.Errorf("tenant id %q may only contain letters, digits and '-'", id)
+		}
+	}
+	return nil
+}
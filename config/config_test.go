@@ -0,0 +1,43 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMongoAuth(t *testing.T) {
+	role := func(arn string) *MongoAuth {
+		return &MongoAuth{Mechanism: AuthAWS, RoleARN: arn, WebIdentityTokenFile: "/var/run/token"}
+	}
+	for _, tc := range []struct {
+		name     string
+		auth     *MongoAuth
+		clusters map[string]Cluster
+		err      string
+	}{
+		{"AWS keys", &MongoAuth{Mechanism: AuthAWS, AccessKeyID: "AKID", SecretAccessKey: "secret", SessionToken: "token"}, nil, ""},
+		{"AWS environment", &MongoAuth{Mechanism: AuthAWS}, nil, ""},
+		{"X.509", &MongoAuth{Mechanism: AuthX509, CertificateKeyFile: "client.pem"}, nil, ""},
+		{"half a key", &MongoAuth{Mechanism: AuthAWS, AccessKeyID: "AKID"}, nil, "needs both accessKeyId and secretAccessKey"},
+		{"session token alone", &MongoAuth{Mechanism: AuthAWS, SessionToken: "token"}, nil, "a sessionToken needs accessKeyId and secretAccessKey"},
+		{"role without token", &MongoAuth{Mechanism: AuthAWS, RoleARN: "arn"}, nil, "needs both roleArn and webIdentityTokenFile"},
+		{"X.509 without certificate", &MongoAuth{Mechanism: AuthX509}, nil, "needs a certificateKeyFile"},
+		{"X.509 with AWS keys", &MongoAuth{Mechanism: AuthX509, CertificateKeyFile: "client.pem", AccessKeyID: "AKID"}, nil, "AWS credentials need"},
+		{"unknown mechanism", &MongoAuth{Mechanism: "PLAIN"}, nil, "invalid auth mechanism"},
+		// The role is set in the process environment, so every cluster
+		// must assume the same one
+		{"same role", role("arn:a"), map[string]Cluster{"b": {URI: "mongodb://b", ClusterOptions: ClusterOptions{Auth: role("arn:a")}}}, ""},
+		{"different roles", role("arn:a"), map[string]Cluster{"b": {URI: "mongodb://b", ClusterOptions: ClusterOptions{Auth: role("arn:b")}}},
+			`cluster "b": all clusters must assume the same roleArn`},
+		{"different roles of other clusters", nil, map[string]Cluster{
+			"b": {URI: "mongodb://b", ClusterOptions: ClusterOptions{Auth: role("arn:b")}},
+			"c": {URI: "mongodb://c", ClusterOptions: ClusterOptions{Auth: role("arn:c")}},
+		}, "all clusters must assume the same roleArn"},
+	} {
+		cfg := &Config{MongoOptions: ClusterOptions{Auth: tc.auth}, Clusters: tc.clusters}
+		err := cfg.Validate()
+		if tc.err == "" && err != nil || tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%s: error %v, want %q", tc.name, err, tc.err)
+		}
+	}
+}
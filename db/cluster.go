@@ -0,0 +1,89 @@
+package db
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"mongo-data-api-go-alternative/config"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// ClusterOptions returns the client options setting o, to pass to Connect
+// or Dial. Settings o leaves unset keep the values of the connection
+// string; a write concern, compressors or authentication replace those of
+// the connection string.
+func ClusterOptions(o config.ClusterOptions) (*options.ClientOptions, error) {
+	opts := options.Client()
+	if o.RetryWrites != nil {
+		opts.SetRetryWrites(*o.RetryWrites)
+	}
+	if o.RetryReads != nil {
+		opts.SetRetryReads(*o.RetryReads)
+	}
+	if len(o.Compressors) > 0 {
+		opts.SetCompressors(o.Compressors)
+	}
+	if wc := o.WriteConcern; wc != nil {
+		w := wc.W
+		if n, ok := w.(float64); ok {
+			// JSON numbers decode as float64; the driver wants an int
+			w = int(n)
+		}
+		opts.SetWriteConcern(&writeconcern.WriteConcern{
+			W:        w,
+			Journal:  wc.Journal,
+			WTimeout: time.Duration(wc.WTimeoutMS) * time.Millisecond,
+		})
+	}
+	if a := o.Auth; a != nil {
+		if err := setAuth(opts, a); err != nil {
+			return nil, err
+		}
+	}
+	return opts, nil
+}
+
+// setAuth sets the credential of a and, for X.509, the client certificate
+// and CA. The driver only assumes AWS roles named in the process
+// environment, so RoleARN is set there; config validation makes every
+// cluster assume the same role.
+func setAuth(opts *options.ClientOptions, a *config.MongoAuth) error {
+	cred := options.Credential{AuthMechanism: a.Mechanism, AuthSource: "$external"}
+	if a.Mechanism == config.AuthAWS {
+		cred.Username, cred.Password = a.AccessKeyID, a.SecretAccessKey
+		if a.SessionToken != "" {
+			cred.AuthMechanismProperties = map[string]string{"AWS_SESSION_TOKEN": a.SessionToken}
+		}
+		if a.RoleARN != "" {
+			os.Setenv("AWS_ROLE_ARN", a.RoleARN)
+			os.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", a.WebIdentityTokenFile)
+		}
+	}
+	opts.SetAuth(cred)
+
+	if a.CertificateKeyFile == "" && a.CAFile == "" {
+		return nil
+	}
+	// Let the driver load the files as it would from a connection string,
+	// which handles encrypted keys
+	q := url.Values{"tls": {"true"}}
+	if a.CertificateKeyFile != "" {
+		q.Set("tlsCertificateKeyFile", a.CertificateKeyFile)
+	}
+	if a.CertificateKeyFilePassword != "" {
+		q.Set("tlsCertificateKeyFilePassword", a.CertificateKeyFilePassword)
+	}
+	if a.CAFile != "" {
+		q.Set("tlsCAFile", a.CAFile)
+	}
+	tlsOpts := options.Client().ApplyURI("mongodb://localhost/?" + q.Encode())
+	if err := tlsOpts.Validate(); err != nil {
+		return fmt.Errorf("loading TLS files: %w", err)
+	}
+	opts.SetTLSConfig(tlsOpts.TLSConfig)
+	return nil
+}
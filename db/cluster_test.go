@@ -0,0 +1,139 @@
+package db
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"mongo-data-api-go-alternative/config"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// writeCertificate writes a self-signed certificate and its key to one PEM
+// file, as used for X.509 authentication, and the certificate alone to
+// another, usable as a CA file
+func writeCertificate(t *testing.T) (certKeyFile, caFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	dir := t.TempDir()
+	certKeyFile, caFile = filepath.Join(dir, "client.pem"), filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(certKeyFile, append(cert, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(caFile, cert, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certKeyFile, caFile
+}
+
+func TestClusterOptions(t *testing.T) {
+	// The role is set in the environment; restore it afterwards
+	t.Setenv("AWS_ROLE_ARN", "")
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "")
+	certKeyFile, caFile := writeCertificate(t)
+	yes := true
+
+	for _, tc := range []struct {
+		name  string
+		opts  config.ClusterOptions
+		check func(t *testing.T, opts *options.ClientOptions)
+	}{
+		{"defaults", config.ClusterOptions{}, func(t *testing.T, opts *options.ClientOptions) {
+			if opts.Auth != nil || opts.TLSConfig != nil || opts.RetryWrites != nil || opts.WriteConcern != nil {
+				t.Errorf("options %+v", opts)
+			}
+		}},
+		{"write concern", config.ClusterOptions{RetryWrites: &yes, Compressors: []string{"zstd"}, WriteConcern: &config.WriteConcern{W: float64(2), WTimeoutMS: 500}},
+			func(t *testing.T, opts *options.ClientOptions) {
+				if !*opts.RetryWrites || !reflect.DeepEqual(opts.Compressors, []string{"zstd"}) ||
+					opts.WriteConcern.W != 2 || opts.WriteConcern.WTimeout != 500*time.Millisecond {
+					t.Errorf("options %+v, write concern %+v", opts, opts.WriteConcern)
+				}
+			}},
+		{"AWS keys", config.ClusterOptions{Auth: &config.MongoAuth{Mechanism: config.AuthAWS, AccessKeyID: "AKID", SecretAccessKey: "secret", SessionToken: "token"}},
+			func(t *testing.T, opts *options.ClientOptions) {
+				want := options.Credential{AuthMechanism: "MONGODB-AWS", AuthSource: "$external", Username: "AKID", Password: "secret",
+					AuthMechanismProperties: map[string]string{"AWS_SESSION_TOKEN": "token"}}
+				if !reflect.DeepEqual(*opts.Auth, want) || opts.TLSConfig != nil {
+					t.Errorf("credential %+v", *opts.Auth)
+				}
+				if os.Getenv("AWS_ROLE_ARN") != "" {
+					t.Error("role set without roleArn")
+				}
+			}},
+		{"AWS role", config.ClusterOptions{Auth: &config.MongoAuth{Mechanism: config.AuthAWS, RoleARN: "arn:aws:iam::1:role/api", WebIdentityTokenFile: "/var/run/token"}},
+			func(t *testing.T, opts *options.ClientOptions) {
+				if opts.Auth.Username != "" || opts.Auth.AuthMechanism != "MONGODB-AWS" {
+					t.Errorf("credential %+v", *opts.Auth)
+				}
+				if os.Getenv("AWS_ROLE_ARN") != "arn:aws:iam::1:role/api" || os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != "/var/run/token" {
+					t.Error("role not set in the environment")
+				}
+			}},
+		{"X.509", config.ClusterOptions{Auth: &config.MongoAuth{Mechanism: config.AuthX509, CertificateKeyFile: certKeyFile, CAFile: caFile}},
+			func(t *testing.T, opts *options.ClientOptions) {
+				if opts.Auth.AuthMechanism != "MONGODB-X509" || opts.Auth.AuthSource != "$external" {
+					t.Errorf("credential %+v", *opts.Auth)
+				}
+				if opts.TLSConfig == nil || len(opts.TLSConfig.Certificates) != 1 || opts.TLSConfig.RootCAs == nil {
+					t.Errorf("TLS config %+v", opts.TLSConfig)
+				}
+			}},
+		{"X.509 without CA", config.ClusterOptions{Auth: &config.MongoAuth{Mechanism: config.AuthX509, CertificateKeyFile: certKeyFile}},
+			func(t *testing.T, opts *options.ClientOptions) {
+				if opts.TLSConfig == nil || len(opts.TLSConfig.Certificates) != 1 || opts.TLSConfig.RootCAs != nil {
+					t.Errorf("TLS config %+v", opts.TLSConfig)
+				}
+			}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts, err := ClusterOptions(tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.check(t, opts)
+		})
+	}
+
+	// Certificate files are loaded up front
+	for name, a := range map[string]*config.MongoAuth{
+		"missing file": {Mechanism: config.AuthX509, CertificateKeyFile: filepath.Join(t.TempDir(), "missing.pem")},
+		"no key":       {Mechanism: config.AuthX509, CertificateKeyFile: caFile},
+		"missing CA":   {Mechanism: config.AuthX509, CertificateKeyFile: certKeyFile, CAFile: filepath.Join(t.TempDir(), "ca.pem")},
+	} {
+		if _, err := ClusterOptions(config.ClusterOptions{Auth: a}); err == nil || !strings.Contains(err.Error(), "loading TLS files") {
+			t.Errorf("%s: error %v", name, err)
+		}
+	}
+}
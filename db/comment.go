@@ -0,0 +1,86 @@
+package db
+
+import (
+	"context"
+	"strings"
+)
+
+type clientKey struct{}
+
+// WithClient returns a context whose operations are attributed to client,
+// e.g. the name of the API key a request was made with. The Mongo store
+// appends "client=<name>" to the comment of every operation run with it, so
+// currentOp and profiler output show which consumer caused the load.
+func WithClient(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// ClientFromContext returns the client set with WithClient
+func ClientFromContext(ctx context.Context) (string, bool) {
+	client, ok := ctx.Value(clientKey{}).(string)
+	return client, ok
+}
+
+// stringComment appends the client and request ID of ctx to an operation
+// comment, as "client=<name> requestId=<id>"
+func stringComment(ctx context.Context, existing *string) *string {
+	var tags []string
+	if client, ok := ClientFromContext(ctx); ok {
+		tags = append(tags, "client="+client)
+	}
+	if id, ok := RequestIDFromContext(ctx); ok && id != "" {
+		tags = append(tags, "requestId="+id)
+	}
+	if len(tags) == 0 {
+		return existing
+	}
+	if existing != nil && *existing != "" {
+		tags = append([]string{*existing}, tags...)
+	}
+	comment := strings.Join(tags, " ")
+	return &comment
+}
+
+// ParseComment returns the client and request ID an operation comment was
+// tagged with, empty when it has none
+func ParseComment(comment string) (client, requestID string) {
+	for _, field := range strings.Fields(comment) {
+		if v, ok := strings.CutPrefix(field, "client="); ok {
+			client = v
+		} else if v, ok := strings.CutPrefix(field, "requestId="); ok {
+			requestID = v
+		}
+	}
+	return client, requestID
+}
+
+// comment is stringComment for options that accept any BSON value as the
+// comment. Comments that are not strings are left as they are.
+func comment(ctx context.Context, existing interface{}) interface{} {
+	switch v := existing.(type) {
+	case nil:
+		if c := stringComment(ctx, nil); c != nil {
+			return *c
+		}
+		return nil
+	case string:
+		return *stringComment(ctx, &v)
+	default:
+		return existing
+	}
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context carrying the ID of the request its
+// operations are made for. The Mongo store appends "requestId=<id>" to
+// their comments, so that slow operations can be traced back to requests.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID set with WithRequestID
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok
+}
@@ -0,0 +1,151 @@
+package db
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Cursors tracks the cursors the Mongo stores open
+var Cursors = NewCursorRegistry()
+
+// operationTail is the operation of tailable cursors, which wait for new
+// documents for as long as their request lasts
+const operationTail = "tail"
+
+// CursorInfo describes an open cursor: the API key and request it was
+// opened for, the operation and namespace it reads and since when
+type CursorInfo struct {
+	ID         uint64    `json:"id"`
+	Client     string    `json:"client,omitempty"`
+	RequestID  string    `json:"requestId,omitempty"`
+	Operation  string    `json:"operation"`
+	Namespace  string    `json:"ns"`
+	OpenedAt   time.Time `json:"openedAt"`
+	AgeSeconds float64   `json:"ageSeconds"`
+}
+
+type openCursor struct {
+	CursorInfo
+	cancel context.CancelFunc
+}
+
+// CursorRegistry holds the open cursors, so that they can be listed and
+// those left open too long closed
+type CursorRegistry struct {
+	mu     sync.Mutex
+	next   uint64
+	open   map[uint64]*openCursor
+	closed atomic.Int64
+}
+
+// NewCursorRegistry returns an empty registry
+func NewCursorRegistry() *CursorRegistry {
+	return &CursorRegistry{open: make(map[uint64]*openCursor)}
+}
+
+// Track registers a cursor opened with ctx for operation on
+// database.collection. The cursor must be read with the returned context,
+// which is canceled when the cursor is closed through the registry, and
+// done called once it is closed.
+func (r *CursorRegistry) Track(ctx context.Context, operation, database, collection string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	client, _ := ClientFromContext(ctx)
+	requestID, _ := RequestIDFromContext(ctx)
+	r.mu.Lock()
+	r.next++
+	id := r.next
+	r.open[id] = &openCursor{
+		CursorInfo: CursorInfo{
+			ID:        id,
+			Client:    client,
+			RequestID: requestID,
+			Operation: operation,
+			Namespace: database + "." + collection,
+			OpenedAt:  time.Now(),
+		},
+		cancel: cancel,
+	}
+	r.mu.Unlock()
+	return ctx, func() {
+		r.mu.Lock()
+		delete(r.open, id)
+		r.mu.Unlock()
+		cancel()
+	}
+}
+
+// List returns the open cursors, oldest first
+func (r *CursorRegistry) List() []CursorInfo {
+	now := time.Now()
+	r.mu.Lock()
+	list := make([]CursorInfo, 0, len(r.open))
+	for _, c := range r.open {
+		info := c.CursorInfo
+		info.AgeSeconds = now.Sub(info.OpenedAt).Seconds()
+		list = append(list, info)
+	}
+	r.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Open returns the number of open cursors
+func (r *CursorRegistry) Open() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.open)
+}
+
+// Closed returns the number of cursors closed through the registry
+func (r *CursorRegistry) Closed() int64 {
+	return r.closed.Load()
+}
+
+// Close closes an open cursor by canceling the context it is read with,
+// which fails the request reading it. It reports whether the cursor was
+// open.
+func (r *CursorRegistry) Close(id uint64) bool {
+	r.mu.Lock()
+	c, ok := r.open[id]
+	r.mu.Unlock()
+	if ok {
+		c.cancel()
+		r.closed.Add(1)
+	}
+	return ok
+}
+
+// CloseExpired closes the cursors open for longer than maxAge and returns
+// how many it closed. Tailable cursors are left to their request's idle
+// timeout.
+func (r *CursorRegistry) CloseExpired(maxAge time.Duration) int {
+	var expired []CursorInfo
+	for _, c := range r.List() {
+		if c.Operation != operationTail && time.Duration(c.AgeSeconds*float64(time.Second)) > maxAge {
+			expired = append(expired, c)
+		}
+	}
+	closed := 0
+	for _, c := range expired {
+		if r.Close(c.ID) {
+			closed++
+			log.Printf("Closed cursor %d of client %s, request %s, on %s after %.0fs", c.ID, c.Client, c.RequestID, c.Namespace, c.AgeSeconds)
+		}
+	}
+	return closed
+}
+
+// StartExpiry closes the cursors open for longer than maxAge in the
+// background, checking a few times per maxAge
+func (r *CursorRegistry) StartExpiry(maxAge time.Duration) {
+	interval := min(maxAge/4, time.Minute)
+	go func() {
+		for range time.Tick(interval) {
+			r.CloseExpired(maxAge)
+		}
+	}()
+}
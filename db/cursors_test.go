@@ -0,0 +1,28 @@
+package db
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCloseExpired(t *testing.T) {
+	r := NewCursorRegistry()
+	findCtx, findDone := r.Track(context.Background(), "find", "app", "users")
+	defer findDone()
+	tailCtx, tailDone := r.Track(context.Background(), operationTail, "app", "events")
+	defer tailDone()
+
+	if n := r.CloseExpired(0); n != 1 {
+		t.Errorf("closed %d cursors, want 1", n)
+	}
+	if findCtx.Err() == nil {
+		t.Error("expired find cursor left open")
+	}
+	if tailCtx.Err() != nil {
+		t.Error("tailable cursor closed")
+	}
+	// Tailable cursors can still be closed one by one
+	if list := r.List(); len(list) != 2 || !r.Close(list[1].ID) || tailCtx.Err() == nil {
+		t.Errorf("closing the tailable cursor of %v failed", list)
+	}
+}
@@ -3,7 +3,6 @@ package db
 import (
 	"context"
 	"log"
-	"os"
 	"time"
 
 	"go.mongodb.org/mongo-driver/mongo"
@@ -13,32 +12,53 @@ import (
 var client *mongo.Client
 
 // Connect establishes a connection to MongoDB
-func Connect() error {
-	uri := os.Getenv("MONGO_URI")
-	if uri == "" {
-		uri = "mongodb://localhost:27017"
+func Connect(uri, appName string, opts ...*options.ClientOptions) error {
+	c, err := Dial(uri, appName, opts...)
+	if err != nil {
+		return err
 	}
+	client = c
+
+	log.Println("Connected to MongoDB!")
+	return nil
+}
 
+// Dial connects a new client to uri and verifies the connection, without
+// making it the client used by GetCollection. appName identifies the client
+// in server logs, currentOp and the profiler unless uri sets one. opts are
+// applied after uri, e.g. to set monitors.
+func Dial(uri, appName string, opts ...*options.ClientOptions) (*mongo.Client, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
 	// Create a new client and connect to the server
 	clientOptions := options.Client().ApplyURI(uri)
+	if clientOptions.AppName == nil && appName != "" {
+		clientOptions.SetAppName(appName)
+	}
 
-	var err error
-	client, err = mongo.Connect(ctx, clientOptions)
+	c, err := mongo.Connect(ctx, append([]*options.ClientOptions{clientOptions}, opts...)...)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Ping the database to verify connection
-	err = client.Ping(ctx, nil)
-	if err != nil {
-		return err
+	if err := c.Ping(ctx, nil); err != nil {
+		c.Disconnect(ctx)
+		return nil, err
 	}
+	return c, nil
+}
 
-	log.Println("Connected to MongoDB!")
-	return nil
+// SetClient uses an existing client instead of connecting with Connect,
+// e.g. when the API is embedded in a program that already has one
+func SetClient(c *mongo.Client) {
+	client = c
+}
+
+// Connected reports whether a client has been set up
+func Connected() bool {
+	return client != nil
 }
 
 // GetCollection returns a handle to a specific collection
@@ -0,0 +1,63 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ServerInfo describes the deployment a store is connected to
+type ServerInfo struct {
+	// Version is the MongoDB version of the server answering
+	Version string `json:"version"`
+	// Topology is standalone, replicaSet or sharded, and SetName the name
+	// of the replica set
+	Topology string `json:"topology"`
+	SetName  string `json:"setName,omitempty"`
+	// PingMS is the round trip of a ping to the primary
+	PingMS float64 `json:"pingMs"`
+}
+
+// ServerInspector is implemented by stores that can describe their
+// deployment
+type ServerInspector interface {
+	ServerInfo(ctx context.Context) (*ServerInfo, error)
+}
+
+var _ ServerInspector = (*Mongo)(nil)
+
+// ServerInfo implements ServerInspector
+func (m *Mongo) ServerInfo(ctx context.Context) (*ServerInfo, error) {
+	start := time.Now()
+	if err := m.client.Ping(ctx, nil); err != nil {
+		return nil, err
+	}
+	info := &ServerInfo{PingMS: float64(time.Since(start).Microseconds()) / 1000}
+
+	admin := m.client.Database("admin")
+	var build struct {
+		Version string `bson:"version"`
+	}
+	if err := admin.RunCommand(ctx, bson.D{{Key: "buildInfo", Value: 1}}).Decode(&build); err != nil {
+		return nil, err
+	}
+	info.Version = build.Version
+
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	if err := admin.RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		return nil, err
+	}
+	switch {
+	case hello.Msg == "isdbgrid":
+		info.Topology = "sharded"
+	case hello.SetName != "":
+		info.Topology, info.SetName = "replicaSet", hello.SetName
+	default:
+		info.Topology = "standalone"
+	}
+	return info, nil
+}
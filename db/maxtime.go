@@ -0,0 +1,45 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+type maxTimeKey struct{}
+
+// WithMaxTime returns a context whose operations are limited to d. The
+// Mongo store sends it as maxTimeMS with reads and aggregations that don't
+// set one, so the server aborts them. The driver can't send maxTimeMS with
+// writes; they get a deadline instead, which bounds how long the caller
+// waits but may leave the write to complete on the server.
+func WithMaxTime(ctx context.Context, d time.Duration) context.Context {
+	if d <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, maxTimeKey{}, d)
+}
+
+// MaxTimeFromContext returns the limit set with WithMaxTime
+func MaxTimeFromContext(ctx context.Context) (time.Duration, bool) {
+	d, ok := ctx.Value(maxTimeKey{}).(time.Duration)
+	return d, ok
+}
+
+// maxTime returns the limit of ctx, or existing when it is already set
+func maxTime(ctx context.Context, existing *time.Duration) *time.Duration {
+	if existing != nil {
+		return existing
+	}
+	if d, ok := MaxTimeFromContext(ctx); ok {
+		return &d
+	}
+	return nil
+}
+
+// writeContext applies the limit of ctx to a write as a deadline
+func writeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d, ok := MaxTimeFromContext(ctx); ok {
+		return context.WithTimeout(ctx, d)
+	}
+	return ctx, func() {}
+}
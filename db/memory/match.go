@@ -0,0 +1,486 @@
+package memory
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// errUnsupported reports a feature the in-memory store does not implement
+func errUnsupported(what string) error {
+	return fmt.Errorf("%s is not supported in mock mode", what)
+}
+
+// toD converts a filter, update or document argument to bson.D
+func toD(v interface{}) (bson.D, error) {
+	switch d := v.(type) {
+	case nil:
+		return bson.D{}, nil
+	case bson.D:
+		return d, nil
+	case bson.M:
+		return mapToD(d), nil
+	case map[string]interface{}:
+		return mapToD(d), nil
+	}
+	return nil, fmt.Errorf("expected a document, got %T", v)
+}
+
+func mapToD(m map[string]interface{}) bson.D {
+	d := make(bson.D, 0, len(m))
+	for k, v := range m {
+		switch sub := v.(type) {
+		case bson.M:
+			v = mapToD(sub)
+		case map[string]interface{}:
+			v = mapToD(sub)
+		}
+		d = append(d, bson.E{Key: k, Value: v})
+	}
+	return d
+}
+
+// lookup returns the value at a dotted path
+func lookup(doc bson.D, path string) (interface{}, bool) {
+	key, rest, nested := strings.Cut(path, ".")
+	for _, e := range doc {
+		if e.Key != key {
+			continue
+		}
+		if !nested {
+			return e.Value, true
+		}
+		switch v := e.Value.(type) {
+		case bson.D:
+			return lookup(v, rest)
+		case bson.A:
+			// a.0.b addresses an array element; a.b collects b from every
+			// element
+			if i, err := strconv.Atoi(strings.SplitN(rest, ".", 2)[0]); err == nil {
+				if i < 0 || i >= len(v) {
+					return nil, false
+				}
+				_, after, more := strings.Cut(rest, ".")
+				if !more {
+					return v[i], true
+				}
+				if sub, ok := v[i].(bson.D); ok {
+					return lookup(sub, after)
+				}
+				return nil, false
+			}
+			var values bson.A
+			for _, item := range v {
+				if sub, ok := item.(bson.D); ok {
+					if found, ok := lookup(sub, rest); ok {
+						values = append(values, found)
+					}
+				}
+			}
+			return values, len(values) > 0
+		}
+		return nil, false
+	}
+	return nil, false
+}
+
+// matches reports whether doc satisfies filter
+func matches(doc bson.D, filter bson.D) (bool, error) {
+	for _, e := range filter {
+		ok, err := matchElement(doc, e)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchElement(doc bson.D, e bson.E) (bool, error) {
+	switch e.Key {
+	case "$and", "$or", "$nor":
+		clauses, ok := e.Value.(bson.A)
+		if !ok {
+			return false, fmt.Errorf("%s requires an array", e.Key)
+		}
+		for _, clause := range clauses {
+			sub, err := toD(clause)
+			if err != nil {
+				return false, err
+			}
+			ok, err := matches(doc, sub)
+			if err != nil {
+				return false, err
+			}
+			switch {
+			case e.Key == "$and" && !ok:
+				return false, nil
+			case e.Key == "$or" && ok:
+				return true, nil
+			case e.Key == "$nor" && ok:
+				return false, nil
+			}
+		}
+		return e.Key != "$or", nil
+	case "$comment":
+		return true, nil
+	}
+	if strings.HasPrefix(e.Key, "$") {
+		return false, errUnsupported("query operator " + e.Key)
+	}
+
+	value, exists := lookup(doc, e.Key)
+	if cond, ok := e.Value.(bson.D); ok && isOperatorDoc(cond) {
+		return matchOperators(value, exists, cond)
+	}
+	if re, ok := e.Value.(primitive.Regex); ok {
+		return matchRegex(value, re.Pattern, re.Options)
+	}
+	return equalsAny(value, exists, e.Value), nil
+}
+
+func isOperatorDoc(d bson.D) bool {
+	return len(d) > 0 && strings.HasPrefix(d[0].Key, "$")
+}
+
+func matchOperators(value interface{}, exists bool, cond bson.D) (bool, error) {
+	for _, op := range cond {
+		var ok bool
+		switch op.Key {
+		case "$eq":
+			ok = equalsAny(value, exists, op.Value)
+		case "$ne":
+			ok = !equalsAny(value, exists, op.Value)
+		case "$gt", "$gte", "$lt", "$lte":
+			ok = anyElement(value, func(v interface{}) bool {
+				c, comparable := compare(v, op.Value)
+				if !comparable {
+					return false
+				}
+				switch op.Key {
+				case "$gt":
+					return c > 0
+				case "$gte":
+					return c >= 0
+				case "$lt":
+					return c < 0
+				}
+				return c <= 0
+			})
+		case "$in", "$nin":
+			list, isArray := op.Value.(bson.A)
+			if !isArray {
+				return false, fmt.Errorf("%s requires an array", op.Key)
+			}
+			for _, item := range list {
+				if equalsAny(value, exists, item) {
+					ok = true
+					break
+				}
+			}
+			if op.Key == "$nin" {
+				ok = !ok
+			}
+		case "$all":
+			list, isArray := op.Value.(bson.A)
+			if !isArray {
+				return false, fmt.Errorf("$all requires an array")
+			}
+			ok = exists
+			for _, item := range list {
+				ok = ok && equalsAny(value, exists, item)
+			}
+		case "$exists":
+			ok = exists == truthy(op.Value)
+		case "$size":
+			arr, isArray := value.(bson.A)
+			n, isNumber := toFloat(op.Value)
+			ok = isArray && isNumber && float64(len(arr)) == n
+		case "$regex":
+			pattern, _ := op.Value.(string)
+			options, _ := lookup(cond, "$options")
+			opts, _ := options.(string)
+			if re, isRegex := op.Value.(primitive.Regex); isRegex {
+				pattern, opts = re.Pattern, re.Options+opts
+			}
+			var err error
+			if ok, err = matchRegex(value, pattern, opts); err != nil {
+				return false, err
+			}
+		case "$options":
+			ok = true
+		case "$not":
+			sub, isDoc := op.Value.(bson.D)
+			if !isDoc {
+				return false, fmt.Errorf("$not requires a document")
+			}
+			matched, err := matchOperators(value, exists, sub)
+			if err != nil {
+				return false, err
+			}
+			ok = !matched
+		case "$type":
+			alias, isAlias := op.Value.(string)
+			if !isAlias {
+				return false, errUnsupported("$type by number")
+			}
+			ok = exists && anyElement(value, func(v interface{}) bool { return typeAlias(v) == alias })
+		case "$elemMatch":
+			sub, isDoc := op.Value.(bson.D)
+			arr, isArray := value.(bson.A)
+			if !isDoc || !isArray {
+				break
+			}
+			for _, item := range arr {
+				var matched bool
+				var err error
+				if itemDoc, isItemDoc := item.(bson.D); isItemDoc && !isOperatorDoc(sub) {
+					matched, err = matches(itemDoc, sub)
+				} else {
+					matched, err = matchOperators(item, true, sub)
+				}
+				if err != nil {
+					return false, err
+				}
+				if matched {
+					ok = true
+					break
+				}
+			}
+		default:
+			return false, errUnsupported("query operator " + op.Key)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func matchRegex(value interface{}, pattern, options string) (bool, error) {
+	flags := ""
+	for _, o := range options {
+		if strings.ContainsRune("ims", o) {
+			flags += string(o)
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return false, fmt.Errorf("invalid regular expression: %w", err)
+	}
+	return anyElement(value, func(v interface{}) bool {
+		s, ok := v.(string)
+		return ok && re.MatchString(s)
+	}), nil
+}
+
+// anyElement applies fn to value or, for arrays, to each element
+func anyElement(value interface{}, fn func(interface{}) bool) bool {
+	if arr, ok := value.(bson.A); ok {
+		for _, item := range arr {
+			if fn(item) {
+				return true
+			}
+		}
+	}
+	return fn(value)
+}
+
+// equalsAny implements MongoDB equality: null matches missing fields and an
+// array matches when it or one of its elements equals want
+func equalsAny(value interface{}, exists bool, want interface{}) bool {
+	if want == nil {
+		return !exists || value == nil
+	}
+	if !exists {
+		return false
+	}
+	return anyElement(value, func(v interface{}) bool { return equal(v, want) })
+}
+
+func equal(a, b interface{}) bool {
+	if c, ok := compare(a, b); ok {
+		return c == 0
+	}
+	return reflect.DeepEqual(normalize(a), normalize(b))
+}
+
+// normalize converts numbers to float64 so documents containing numbers of
+// different types compare equal
+func normalize(v interface{}) interface{} {
+	switch val := v.(type) {
+	case bson.D:
+		out := make(bson.D, len(val))
+		for i, e := range val {
+			out[i] = bson.E{Key: e.Key, Value: normalize(e.Value)}
+		}
+		return out
+	case bson.A:
+		out := make(bson.A, len(val))
+		for i, item := range val {
+			out[i] = normalize(item)
+		}
+		return out
+	}
+	if f, ok := toFloat(v); ok {
+		return f
+	}
+	return v
+}
+
+func truthy(v interface{}) bool {
+	if b, ok := v.(bool); ok {
+		return b
+	}
+	if f, ok := toFloat(v); ok {
+		return f != 0
+	}
+	return v != nil
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case primitive.Decimal128:
+		f, err := strconv.ParseFloat(n.String(), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// compare orders two values of the same kind; ok is false when they cannot
+// be compared
+func compare(a, b interface{}) (c int, ok bool) {
+	if fa, ok := toFloat(a); ok {
+		fb, ok := toFloat(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case fa < fb:
+			return -1, true
+		case fa > fb:
+			return 1, true
+		}
+		return 0, true
+	}
+	switch va := a.(type) {
+	case string:
+		vb, ok := b.(string)
+		return strings.Compare(va, vb), ok
+	case bool:
+		vb, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case va == vb:
+			return 0, true
+		case vb:
+			return -1, true
+		}
+		return 1, true
+	case primitive.ObjectID:
+		vb, ok := b.(primitive.ObjectID)
+		return bytes.Compare(va[:], vb[:]), ok
+	case primitive.DateTime:
+		vb, ok := b.(primitive.DateTime)
+		switch {
+		case !ok:
+			return 0, false
+		case va < vb:
+			return -1, true
+		case va > vb:
+			return 1, true
+		}
+		return 0, true
+	case nil:
+		return 0, b == nil
+	}
+	return 0, false
+}
+
+// typeOrder is the BSON comparison order of the kinds of values used when
+// sorting mixed types
+func typeOrder(v interface{}) int {
+	if _, ok := toFloat(v); ok {
+		return 2
+	}
+	switch v.(type) {
+	case nil:
+		return 1
+	case string:
+		return 3
+	case bson.D:
+		return 4
+	case bson.A:
+		return 5
+	case primitive.Binary:
+		return 6
+	case primitive.ObjectID:
+		return 7
+	case bool:
+		return 8
+	case primitive.DateTime:
+		return 9
+	}
+	return 10
+}
+
+// typeAlias returns the $type alias of the type of v
+func typeAlias(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case float64:
+		return "double"
+	case int32:
+		return "int"
+	case int64:
+		return "long"
+	case primitive.Decimal128:
+		return "decimal"
+	case string:
+		return "string"
+	case bson.D:
+		return "object"
+	case bson.A:
+		return "array"
+	case primitive.Binary:
+		return "binData"
+	case primitive.ObjectID:
+		return "objectId"
+	case bool:
+		return "bool"
+	case primitive.DateTime:
+		return "date"
+	case primitive.Regex:
+		return "regex"
+	case primitive.Timestamp:
+		return "timestamp"
+	}
+	return ""
+}
+
+// sortCompare orders any two values, falling back to the BSON type order
+func sortCompare(a, b interface{}) int {
+	if c, ok := compare(a, b); ok {
+		return c
+	}
+	return typeOrder(a) - typeOrder(b)
+}
@@ -0,0 +1,139 @@
+package memory
+
+import (
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ejson parses a relaxed extended JSON document
+func ejson(t *testing.T, s string) bson.D {
+	t.Helper()
+	var d bson.D
+	if err := bson.UnmarshalExtJSON([]byte(s), false, &d); err != nil {
+		t.Fatalf("%s: %v", s, err)
+	}
+	return d
+}
+
+func TestMatches(t *testing.T) {
+	doc := ejson(t, `{
+		"_id": 1, "name": "Ada", "age": 36, "score": 9.5, "active": true, "nothing": null,
+		"tags": ["math", "code"], "address": {"city": "London", "zip": "N1"},
+		"orders": [{"sku": "a", "qty": 2}, {"sku": "b", "qty": 5}],
+		"joined": {"$date": "2020-01-02T00:00:00Z"}
+	}`)
+
+	for _, tc := range []struct {
+		filter string
+		want   bool
+	}{
+		{`{}`, true},
+		{`{"name": "Ada"}`, true},
+		{`{"name": "Bob"}`, false},
+		{`{"age": 36.0}`, true},
+		{`{"address.city": "London"}`, true},
+		{`{"address": {"city": "London", "zip": "N1"}}`, true},
+		{`{"address": {"zip": "N1", "city": "London"}}`, false},
+		{`{"tags": "code"}`, true},
+		{`{"tags": ["math", "code"]}`, true},
+		{`{"tags.1": "code"}`, true},
+		{`{"tags.5": "code"}`, false},
+		{`{"orders.sku": "b"}`, true},
+		{`{"orders.0.qty": 2}`, true},
+		{`{"missing": null}`, true},
+		{`{"nothing": null}`, true},
+		{`{"name": null}`, false},
+		{`{"age": {"$eq": 36}}`, true},
+		{`{"age": {"$ne": 36}}`, false},
+		{`{"missing": {"$ne": 1}}`, true},
+		{`{"age": {"$gt": 30, "$lt": 40}}`, true},
+		{`{"age": {"$gte": 36, "$lte": 36}}`, true},
+		{`{"age": {"$gt": 36}}`, false},
+		{`{"age": {"$gt": "30"}}`, false},
+		{`{"orders.qty": {"$gt": 4}}`, true},
+		{`{"name": {"$gt": "A"}}`, true},
+		{`{"joined": {"$lt": {"$date": "2021-01-01T00:00:00Z"}}}`, true},
+		{`{"age": {"$in": [1, 36]}}`, true},
+		{`{"tags": {"$in": ["art", "code"]}}`, true},
+		{`{"age": {"$nin": [1, 36]}}`, false},
+		{`{"missing": {"$in": [null]}}`, true},
+		{`{"tags": {"$all": ["code", "math"]}}`, true},
+		{`{"tags": {"$all": ["code", "art"]}}`, false},
+		{`{"missing": {"$all": []}}`, false},
+		{`{"address": {"$exists": true}}`, true},
+		{`{"missing": {"$exists": 0}}`, true},
+		{`{"nothing": {"$exists": false}}`, false},
+		{`{"tags": {"$size": 2}}`, true},
+		{`{"name": {"$size": 3}}`, false},
+		{`{"name": {"$regex": "^a", "$options": "i"}}`, true},
+		{`{"name": {"$regex": "^a"}}`, false},
+		{`{"name": {"$regularExpression": {"pattern": "d", "options": ""}}}`, true},
+		{`{"tags": {"$regex": "^co"}}`, true},
+		{`{"age": {"$regex": "3"}}`, false},
+		{`{"age": {"$not": {"$gt": 40}}}`, true},
+		{`{"address": {"$type": "object"}, "name": {"$type": "string"}}`, true},
+		{`{"tags": {"$type": "string"}}`, true},
+		{`{"name": {"$not": {"$type": "object"}}}`, true},
+		{`{"missing": {"$type": "null"}}`, false},
+		{`{"orders": {"$elemMatch": {"sku": "a", "qty": {"$gt": 1}}}}`, true},
+		{`{"orders": {"$elemMatch": {"sku": "a", "qty": 5}}}`, false},
+		{`{"tags": {"$elemMatch": {"$eq": "code"}}}`, true},
+		{`{"name": {"$elemMatch": {"$eq": "Ada"}}}`, false},
+		{`{"$and": [{"name": "Ada"}, {"age": 36}]}`, true},
+		{`{"$and": [{"name": "Ada"}, {"age": 1}]}`, false},
+		{`{"$or": [{"name": "Bob"}, {"age": 36}]}`, true},
+		{`{"$or": [{"name": "Bob"}, {"age": 1}]}`, false},
+		{`{"$nor": [{"name": "Bob"}, {"age": 1}]}`, true},
+		{`{"$nor": [{"name": "Ada"}]}`, false},
+		{`{"$comment": "ignored", "active": true}`, true},
+		{`{"score": {"$gte": {"$numberDecimal": "9.5"}}}`, true},
+	} {
+		got, err := matches(doc, ejson(t, tc.filter))
+		if err != nil {
+			t.Errorf("%s: %v", tc.filter, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: matches = %v, want %v", tc.filter, got, tc.want)
+		}
+	}
+}
+
+func TestMatchErrors(t *testing.T) {
+	doc := ejson(t, `{"name": "Ada"}`)
+	for _, tc := range []struct {
+		filter string
+		err    string
+	}{
+		{`{"$where": "true"}`, "query operator $where is not supported in mock mode"},
+		{`{"name": {"$type": 2}}`, "$type by number is not supported in mock mode"},
+		{`{"$or": {"name": "Ada"}}`, "$or requires an array"},
+		{`{"name": {"$in": "Ada"}}`, "$in requires an array"},
+		{`{"name": {"$all": "Ada"}}`, "$all requires an array"},
+		{`{"name": {"$not": "Ada"}}`, "$not requires a document"},
+		{`{"name": {"$regex": "("}}`, "invalid regular expression"},
+	} {
+		if _, err := matches(doc, ejson(t, tc.filter)); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: error %v, want %q", tc.filter, err, tc.err)
+		}
+	}
+}
+
+func TestSortCompare(t *testing.T) {
+	// Mixed types follow the BSON comparison order
+	values := ejson(t, `{"v": [null, -1, 2.5, {"$numberLong": "3"}, "a", "b", {}, [], {"$oid": "65a1b2c3d4e5f60718293a4b"},
+		false, true, {"$date": "2020-01-01T00:00:00Z"}]}`)[0].Value.(bson.A)
+	for i := 1; i < len(values); i++ {
+		if c := sortCompare(values[i-1], values[i]); c >= 0 {
+			t.Errorf("sortCompare(%v, %v) = %d, want < 0", values[i-1], values[i], c)
+		}
+		if c := sortCompare(values[i], values[i-1]); c <= 0 {
+			t.Errorf("sortCompare(%v, %v) = %d, want > 0", values[i], values[i-1], c)
+		}
+	}
+	if c := sortCompare(int32(2), 2.0); c != 0 {
+		t.Errorf("sortCompare(int32(2), 2.0) = %d, want 0", c)
+	}
+}
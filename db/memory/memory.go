@@ -0,0 +1,701 @@
+// Package memory implements db.DataStore in memory for running the API
+// without MongoDB (mock mode). It supports the common query, update and
+// projection operators, sorting and a subset of aggregation stages; anything
+// else fails with an explicit "not supported in mock mode" error.
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"mongo-data-api-go-alternative/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var _ db.DataStore = (*Store)(nil)
+
+// Store keeps documents in memory, in insertion order
+type Store struct {
+	mu        sync.RWMutex
+	databases map[string]map[string][]bson.D
+	// indexes holds the indexes created besides _id by namespace; they are
+	// only recorded, not used or enforced
+	indexes map[string][]db.Index
+}
+
+// New returns an empty store
+func New() *Store {
+	return &Store{databases: make(map[string]map[string][]bson.D), indexes: make(map[string][]db.Index)}
+}
+
+// Load adds seed documents from r, a JSON object mapping
+// "database.collection" to an array of EJSON documents
+func (s *Store) Load(r io.Reader) error {
+	var seed map[string][]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&seed); err != nil {
+		return err
+	}
+	for ns, docs := range seed {
+		database, collection, ok := strings.Cut(ns, ".")
+		if !ok {
+			return fmt.Errorf("invalid namespace %q (expected database.collection)", ns)
+		}
+		for i, raw := range docs {
+			var doc bson.D
+			if err := bson.UnmarshalExtJSON(raw, false, &doc); err != nil {
+				return fmt.Errorf("%s[%d]: %w", ns, i, err)
+			}
+			if _, err := s.InsertOne(context.Background(), database, collection, doc); err != nil {
+				return fmt.Errorf("%s[%d]: %w", ns, i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// documents returns the collection's documents; callers must hold the lock
+func (s *Store) documents(database, collection string) []bson.D {
+	return s.databases[database][collection]
+}
+
+func (s *Store) setDocuments(database, collection string, docs []bson.D) {
+	if s.databases[database] == nil {
+		s.databases[database] = make(map[string][]bson.D)
+	}
+	s.databases[database][collection] = docs
+}
+
+// insert adds doc, generating an _id when it has none
+func (s *Store) insert(database, collection string, document interface{}) (interface{}, error) {
+	doc, err := toD(document)
+	if err != nil {
+		return nil, err
+	}
+	doc = copyD(doc)
+	id, ok := lookup(doc, "_id")
+	if !ok {
+		id = primitive.NewObjectID()
+		doc = append(bson.D{{Key: "_id", Value: id}}, doc...)
+	}
+	for _, existing := range s.documents(database, collection) {
+		if existingID, _ := lookup(existing, "_id"); equal(existingID, id) {
+			return nil, fmt.Errorf("E11000 duplicate key error collection: %s.%s index: _id_ dup key: { _id: %v }", database, collection, id)
+		}
+	}
+	s.setDocuments(database, collection, append(s.documents(database, collection), doc))
+	return id, nil
+}
+
+// InsertOne inserts a single document
+func (s *Store) InsertOne(_ context.Context, database, collection string, document interface{}) (*mongo.InsertOneResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, err := s.insert(database, collection, document)
+	if err != nil {
+		return nil, err
+	}
+	return &mongo.InsertOneResult{InsertedID: id}, nil
+}
+
+// InsertMany inserts documents in order, stopping at the first error
+func (s *Store) InsertMany(_ context.Context, database, collection string, documents []interface{}) (*mongo.InsertManyResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := &mongo.InsertManyResult{InsertedIDs: make([]interface{}, 0, len(documents))}
+	for _, document := range documents {
+		id, err := s.insert(database, collection, document)
+		if err != nil {
+			return result, err
+		}
+		result.InsertedIDs = append(result.InsertedIDs, id)
+	}
+	return result, nil
+}
+
+// filter returns the indexes of the documents matching filter
+func (s *Store) filter(database, collection string, filter interface{}) ([]int, error) {
+	f, err := toD(filter)
+	if err != nil {
+		return nil, err
+	}
+	var matched []int
+	for i, doc := range s.documents(database, collection) {
+		ok, err := matches(doc, f)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matched = append(matched, i)
+		}
+	}
+	return matched, nil
+}
+
+// FindOne returns the first document matching filter
+func (s *Store) FindOne(ctx context.Context, database, collection string, filter interface{}, opts *options.FindOneOptions) (bson.M, error) {
+	find := options.Find().SetLimit(1)
+	if opts != nil {
+		find.Projection, find.Sort = opts.Projection, opts.Sort
+		if opts.Skip != nil {
+			find.SetSkip(*opts.Skip)
+		}
+	}
+	results, err := s.Find(ctx, database, collection, filter, find)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, mongo.ErrNoDocuments
+	}
+	return results[0], nil
+}
+
+// Find returns the documents matching filter with sort, skip, limit and
+// projection applied
+func (s *Store) Find(_ context.Context, database, collection string, filter interface{}, opts *options.FindOptions) ([]bson.M, error) {
+	s.mu.RLock()
+	indexes, err := s.filter(database, collection, filter)
+	docs := make([]bson.D, len(indexes))
+	for i, idx := range indexes {
+		docs[i] = copyD(s.documents(database, collection)[idx])
+	}
+	s.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if opts != nil {
+		if opts.Sort != nil {
+			if docs, err = sortDocs(docs, opts.Sort); err != nil {
+				return nil, err
+			}
+		}
+		if opts.Skip != nil {
+			docs = skip(docs, *opts.Skip)
+		}
+		if opts.Limit != nil {
+			docs = limit(docs, *opts.Limit)
+		}
+		if opts.Projection != nil {
+			if docs, err = projectDocs(docs, opts.Projection); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return toM(docs), nil
+}
+
+// FindEach calls fn with each document Find returns
+func (s *Store) FindEach(ctx context.Context, database, collection string, filter interface{}, opts *options.FindOptions, fn func(bson.Raw) error) error {
+	docs, err := s.Find(ctx, database, collection, filter, opts)
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		raw, err := bson.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		if err := fn(raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CountDocuments counts the documents matching filter
+func (s *Store) CountDocuments(_ context.Context, database, collection string, filter interface{}) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	indexes, err := s.filter(database, collection, filter)
+	return int64(len(indexes)), err
+}
+
+func (s *Store) update(database, collection string, filter, update interface{}, opts *options.UpdateOptions, many bool) (*mongo.UpdateResult, error) {
+	u, err := toD(update)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	indexes, err := s.filter(database, collection, filter)
+	if err != nil {
+		return nil, err
+	}
+	if !many && len(indexes) > 1 {
+		indexes = indexes[:1]
+	}
+
+	result := &mongo.UpdateResult{MatchedCount: int64(len(indexes))}
+	docs := s.documents(database, collection)
+	for _, i := range indexes {
+		updated, err := applyUpdate(docs[i], u, false)
+		if err != nil {
+			return nil, err
+		}
+		if !equal(updated, docs[i]) {
+			docs[i] = updated
+			result.ModifiedCount++
+		}
+	}
+
+	if len(indexes) == 0 && opts != nil && opts.Upsert != nil && *opts.Upsert {
+		f, _ := toD(filter)
+		doc, err := applyUpdate(upsertBase(f), u, true)
+		if err != nil {
+			return nil, err
+		}
+		if result.UpsertedID, err = s.insert(database, collection, doc); err != nil {
+			return nil, err
+		}
+		result.UpsertedCount = 1
+	}
+	return result, nil
+}
+
+// UpdateOne updates the first document matching filter
+func (s *Store) UpdateOne(_ context.Context, database, collection string, filter, update interface{}, opts *options.UpdateOptions) (*mongo.UpdateResult, error) {
+	return s.update(database, collection, filter, update, opts, false)
+}
+
+// UpdateMany updates all documents matching filter
+func (s *Store) UpdateMany(_ context.Context, database, collection string, filter, update interface{}, opts *options.UpdateOptions) (*mongo.UpdateResult, error) {
+	return s.update(database, collection, filter, update, opts, true)
+}
+
+func (s *Store) delete(database, collection string, filter interface{}, many bool) (*mongo.DeleteResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	indexes, err := s.filter(database, collection, filter)
+	if err != nil {
+		return nil, err
+	}
+	if !many && len(indexes) > 1 {
+		indexes = indexes[:1]
+	}
+	remove := make(map[int]bool, len(indexes))
+	for _, i := range indexes {
+		remove[i] = true
+	}
+	docs := s.documents(database, collection)
+	kept := make([]bson.D, 0, len(docs)-len(indexes))
+	for i, doc := range docs {
+		if !remove[i] {
+			kept = append(kept, doc)
+		}
+	}
+	if len(indexes) > 0 {
+		s.setDocuments(database, collection, kept)
+	}
+	return &mongo.DeleteResult{DeletedCount: int64(len(indexes))}, nil
+}
+
+// DeleteOne deletes the first document matching filter
+func (s *Store) DeleteOne(_ context.Context, database, collection string, filter interface{}) (*mongo.DeleteResult, error) {
+	return s.delete(database, collection, filter, false)
+}
+
+// DeleteMany deletes all documents matching filter
+func (s *Store) DeleteMany(_ context.Context, database, collection string, filter interface{}) (*mongo.DeleteResult, error) {
+	return s.delete(database, collection, filter, true)
+}
+
+// Aggregate runs a pipeline made of $match, $sort, $skip, $limit, $project
+// and $count stages
+func (s *Store) Aggregate(_ context.Context, database, collection string, pipeline interface{}, _ *options.AggregateOptions) ([]bson.M, error) {
+	stages, ok := pipeline.(bson.A)
+	if !ok && pipeline != nil {
+		return nil, errors.New("pipeline must be an array of stages")
+	}
+
+	s.mu.RLock()
+	source := s.documents(database, collection)
+	docs := make([]bson.D, len(source))
+	for i, doc := range source {
+		docs[i] = copyD(doc)
+	}
+	s.mu.RUnlock()
+
+	for i, item := range stages {
+		stage, ok := item.(bson.D)
+		if !ok || len(stage) != 1 {
+			return nil, fmt.Errorf("stage %d must be a document with exactly one field", i)
+		}
+		var err error
+		switch arg := stage[0].Value; stage[0].Key {
+		case "$match":
+			f, err := toD(arg)
+			if err != nil {
+				return nil, err
+			}
+			matched := docs[:0]
+			for _, doc := range docs {
+				ok, err := matches(doc, f)
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					matched = append(matched, doc)
+				}
+			}
+			docs = matched
+		case "$sort":
+			docs, err = sortDocs(docs, arg)
+		case "$skip":
+			n, _ := toFloat(arg)
+			docs = skip(docs, int64(n))
+		case "$limit":
+			n, _ := toFloat(arg)
+			docs = limit(docs, int64(n))
+		case "$project":
+			docs, err = projectDocs(docs, arg)
+		case "$count":
+			field, _ := arg.(string)
+			docs = []bson.D{{{Key: field, Value: int32(len(docs))}}}
+		default:
+			return nil, errUnsupported("stage " + stage[0].Key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return toM(docs), nil
+}
+
+// AggregateWrite runs a pipeline ending in $out or $merge. $merge only
+// supports its default behavior: documents are matched on _id, fields of
+// matching documents are merged and other documents are inserted.
+func (s *Store) AggregateWrite(ctx context.Context, database, collection string, pipeline interface{}) error {
+	stages, ok := pipeline.(bson.A)
+	if !ok || len(stages) == 0 {
+		return errors.New("pipeline must be an array of stages")
+	}
+	last, ok := stages[len(stages)-1].(bson.D)
+	if !ok || len(last) != 1 || (last[0].Key != "$out" && last[0].Key != "$merge") {
+		return errors.New("pipeline must end with a $out or $merge stage")
+	}
+	name, spec := last[0].Key, last[0].Value
+	if d, ok := spec.(bson.D); ok && name == "$merge" {
+		if len(d) != 1 || d[0].Key != "into" {
+			return errUnsupported("$merge options other than into")
+		}
+		spec = d[0].Value
+	}
+	targetDB, target := database, ""
+	switch t := spec.(type) {
+	case string:
+		target = t
+	case bson.D:
+		for _, e := range t {
+			switch e.Key {
+			case "db":
+				targetDB, _ = e.Value.(string)
+			case "coll":
+				target, _ = e.Value.(string)
+			}
+		}
+	}
+	if targetDB == "" || target == "" {
+		return fmt.Errorf("invalid %s stage", name)
+	}
+
+	results, err := s.Aggregate(ctx, database, collection, stages[:len(stages)-1], nil)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if name == "$out" {
+		s.setDocuments(targetDB, target, nil)
+	}
+	for _, result := range results {
+		doc, err := toD(result)
+		if err != nil {
+			return err
+		}
+		id, _ := lookup(doc, "_id")
+		existing := s.documents(targetDB, target)
+		merged := false
+		for i, e := range existing {
+			if existingID, _ := lookup(e, "_id"); id != nil && equal(existingID, id) {
+				for _, field := range doc {
+					e = setPath(e, field.Key, field.Value)
+				}
+				existing[i], merged = e, true
+				break
+			}
+		}
+		if !merged {
+			if _, err := s.insert(targetDB, target, doc); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ListDatabases returns the names of the databases holding documents
+func (s *Store) ListDatabases(context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.databases))
+	for name := range s.databases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ListCollections returns the names of the collections in a database
+func (s *Store) ListCollections(_ context.Context, database string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.databases[database]))
+	for name := range s.databases[database] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ListIndexes returns the _id index and the indexes created with
+// CreateIndex
+func (s *Store) ListIndexes(_ context.Context, database, collection string) ([]db.Index, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.databases[database][collection]; !ok {
+		return []db.Index{}, nil
+	}
+	indexes := []db.Index{{Name: "_id_", Keys: bson.D{{Key: "_id", Value: int32(1)}}}}
+	return append(indexes, s.indexes[database+"."+collection]...), nil
+}
+
+// CreateIndex records an index, creating the collection if needed
+func (s *Store) CreateIndex(_ context.Context, database, collection string, index db.Index) (string, error) {
+	if len(index.Keys) == 0 {
+		return "", errors.New("index keys must not be empty")
+	}
+	if index.Name == "" {
+		parts := make([]string, len(index.Keys))
+		for i, k := range index.Keys {
+			parts[i] = fmt.Sprintf("%s_%v", k.Key, k.Value)
+		}
+		index.Name = strings.Join(parts, "_")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ns := database + "." + collection
+	for _, existing := range s.indexes[ns] {
+		if existing.Name != index.Name && !equal(existing.Keys, index.Keys) {
+			continue
+		}
+		if existing.Name == index.Name && equal(existing.Keys, index.Keys) && existing.Unique == index.Unique &&
+			equalExpiry(existing.ExpireAfterSeconds, index.ExpireAfterSeconds) {
+			return index.Name, nil
+		}
+		return "", fmt.Errorf("an index %q with different options already exists", existing.Name)
+	}
+	if _, ok := s.databases[database][collection]; !ok {
+		s.setDocuments(database, collection, []bson.D{})
+	}
+	s.indexes[ns] = append(s.indexes[ns], index)
+	return index.Name, nil
+}
+
+// DropIndex removes an index created with CreateIndex
+func (s *Store) DropIndex(_ context.Context, database, collection, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ns := database + "." + collection
+	for i, index := range s.indexes[ns] {
+		if index.Name == name {
+			s.indexes[ns] = append(s.indexes[ns][:i:i], s.indexes[ns][i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("index not found with name [%s]", name)
+}
+
+// SetIndexExpiry changes the expiry of a TTL index
+func (s *Store) SetIndexExpiry(_ context.Context, database, collection, name string, seconds int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, index := range s.indexes[database+"."+collection] {
+		if index.Name != name {
+			continue
+		}
+		if index.ExpireAfterSeconds == nil {
+			return fmt.Errorf("index %q is not a TTL index", name)
+		}
+		s.indexes[database+"."+collection][i].ExpireAfterSeconds = &seconds
+		return nil
+	}
+	return fmt.Errorf("index not found with name [%s]", name)
+}
+
+func equalExpiry(a, b *int64) bool {
+	return a == nil && b == nil || a != nil && b != nil && *a == *b
+}
+
+// Stats computes the statistics of a collection or database from the BSON
+// size of its documents. Every collection has a single nominal _id index
+// without size.
+func (s *Store) Stats(_ context.Context, database, collection string) (*db.Stats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	collections := s.databases[database]
+	if collection != "" {
+		docs, ok := collections[collection]
+		if !ok {
+			return nil, db.ErrNamespaceNotFound
+		}
+		collections = map[string][]bson.D{collection: docs}
+	}
+
+	stats := &db.Stats{Indexes: int64(len(collections))}
+	for _, docs := range collections {
+		for _, doc := range docs {
+			raw, err := bson.Marshal(doc)
+			if err != nil {
+				return nil, err
+			}
+			stats.Documents++
+			stats.DataSize += int64(len(raw))
+		}
+	}
+	stats.StorageSize = stats.DataSize
+	if stats.Documents > 0 {
+		stats.AvgDocumentSize = float64(stats.DataSize) / float64(stats.Documents)
+	}
+	if collection == "" {
+		stats.Collections = int64(len(collections))
+	} else {
+		stats.IndexSizes = map[string]int64{"_id_": 0}
+	}
+	return stats, nil
+}
+
+// sortDocs sorts by a sort specification. Maps are only accepted with a
+// single key because their order is undefined.
+func sortDocs(docs []bson.D, spec interface{}) ([]bson.D, error) {
+	if m, ok := spec.(bson.M); ok {
+		spec = map[string]interface{}(m)
+	}
+	if m, ok := spec.(map[string]interface{}); ok && len(m) > 1 {
+		return nil, errors.New("multi-key map passed in for ordered parameter sort")
+	}
+	keys, err := toD(spec)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, k := range keys {
+			a, _ := lookup(docs[i], k.Key)
+			b, _ := lookup(docs[j], k.Key)
+			c := sortCompare(a, b)
+			if dir, _ := toFloat(k.Value); dir < 0 {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	return docs, nil
+}
+
+func skip(docs []bson.D, n int64) []bson.D {
+	if n <= 0 {
+		return docs
+	}
+	if n >= int64(len(docs)) {
+		return []bson.D{}
+	}
+	return docs[n:]
+}
+
+func limit(docs []bson.D, n int64) []bson.D {
+	if n <= 0 || n >= int64(len(docs)) {
+		return docs
+	}
+	return docs[:n]
+}
+
+// projectDocs applies an inclusion or exclusion projection of (dotted)
+// fields. _id is included unless excluded explicitly. A field path such as
+// "$address.city" as the value sets the field to the referenced value.
+func projectDocs(docs []bson.D, spec interface{}) ([]bson.D, error) {
+	fields, err := toD(spec)
+	if err != nil {
+		return nil, err
+	}
+	include, includeID := false, true
+	for _, f := range fields {
+		if _, ok := f.Value.(bson.D); ok {
+			return nil, errUnsupported("projection operator in " + f.Key)
+		}
+		if f.Key == "_id" {
+			includeID = truthy(f.Value)
+		} else if truthy(f.Value) {
+			include = true
+		}
+	}
+	// {_id: 1} alone includes only _id
+	include = include || (len(fields) == 1 && fields[0].Key == "_id" && includeID)
+
+	out := make([]bson.D, len(docs))
+	for i, doc := range docs {
+		if include {
+			projected := bson.D{}
+			if id, ok := lookup(doc, "_id"); ok && includeID {
+				projected = append(projected, bson.E{Key: "_id", Value: id})
+			}
+			for _, f := range fields {
+				if ref, ok := f.Value.(string); ok && strings.HasPrefix(ref, "$") {
+					if v, ok := lookup(doc, ref[1:]); ok {
+						projected = setPath(projected, f.Key, v)
+					}
+					continue
+				}
+				if f.Key == "_id" || !truthy(f.Value) {
+					continue
+				}
+				if v, ok := lookup(doc, f.Key); ok {
+					projected = setPath(projected, f.Key, v)
+				}
+			}
+			out[i] = projected
+			continue
+		}
+		for _, f := range fields {
+			if !truthy(f.Value) {
+				doc = unsetPath(doc, f.Key)
+			}
+		}
+		out[i] = doc
+	}
+	return out, nil
+}
+
+func toM(docs []bson.D) []bson.M {
+	results := make([]bson.M, len(docs))
+	for i, doc := range docs {
+		m := make(bson.M, len(doc))
+		for _, e := range doc {
+			m[e.Key] = e.Value
+		}
+		results[i] = m
+	}
+	return results
+}
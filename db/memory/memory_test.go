@@ -0,0 +1,253 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// newStore returns a store with shop.orders loaded from seed
+func newStore(t *testing.T, seed string) *Store {
+	t.Helper()
+	s := New()
+	if err := s.Load(strings.NewReader(`{"shop.orders": ` + seed + `}`)); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+const orders = `[
+	{"_id": 1, "sku": "a", "qty": 5, "status": "open"},
+	{"_id": 2, "sku": "b", "qty": 1, "status": "closed"},
+	{"_id": 3, "sku": "c", "qty": 3, "status": "open"}
+]`
+
+func ids(docs []bson.M) []interface{} {
+	out := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		out[i] = doc["_id"]
+	}
+	return out
+}
+
+func TestFind(t *testing.T) {
+	s := newStore(t, orders)
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name   string
+		filter bson.D
+		opts   *options.FindOptions
+		want   []interface{}
+	}{
+		{"all", nil, nil, []interface{}{int32(1), int32(2), int32(3)}},
+		{"filter", bson.D{{Key: "status", Value: "open"}}, nil, []interface{}{int32(1), int32(3)}},
+		{"sort", nil, options.Find().SetSort(bson.D{{Key: "qty", Value: 1}}), []interface{}{int32(2), int32(3), int32(1)}},
+		{"sort on two keys", nil, options.Find().SetSort(bson.D{{Key: "status", Value: -1}, {Key: "qty", Value: 1}}), []interface{}{int32(3), int32(1), int32(2)}},
+		{"skip and limit", nil, options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetSkip(1).SetLimit(1), []interface{}{int32(2)}},
+		{"skip everything", nil, options.Find().SetSkip(5), []interface{}{}},
+	} {
+		docs, err := s.Find(ctx, "shop", "orders", tc.filter, tc.opts)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got := ids(docs); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: ids %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	if _, err := s.Find(ctx, "shop", "orders", nil, options.Find().SetSort(bson.M{"a": 1, "b": 1})); err == nil {
+		t.Error("sort on a map with two keys accepted")
+	}
+	if _, err := s.FindOne(ctx, "shop", "orders", bson.D{{Key: "sku", Value: "z"}}, nil); !errors.Is(err, mongo.ErrNoDocuments) {
+		t.Errorf("FindOne without a match: %v, want ErrNoDocuments", err)
+	}
+	if n, err := s.CountDocuments(ctx, "shop", "orders", bson.M{"qty": bson.M{"$gte": 3}}); err != nil || n != 2 {
+		t.Errorf("CountDocuments = %d, %v, want 2", n, err)
+	}
+}
+
+func TestProjection(t *testing.T) {
+	s := newStore(t, `[{"_id": 1, "name": "Ada", "address": {"city": "London", "zip": "N1"}}]`)
+
+	for _, tc := range []struct {
+		projection bson.D
+		want       bson.M
+	}{
+		{bson.D{{Key: "name", Value: 1}}, bson.M{"_id": int32(1), "name": "Ada"}},
+		{bson.D{{Key: "name", Value: true}, {Key: "_id", Value: 0}}, bson.M{"name": "Ada"}},
+		{bson.D{{Key: "address.city", Value: 1}}, bson.M{"_id": int32(1), "address": bson.D{{Key: "city", Value: "London"}}}},
+		{bson.D{{Key: "city", Value: "$address.city"}}, bson.M{"_id": int32(1), "city": "London"}},
+		{bson.D{{Key: "address", Value: 0}}, bson.M{"_id": int32(1), "name": "Ada"}},
+		{bson.D{{Key: "address.zip", Value: 0}, {Key: "_id", Value: 0}}, bson.M{"name": "Ada", "address": bson.D{{Key: "city", Value: "London"}}}},
+	} {
+		doc, err := s.FindOne(context.Background(), "shop", "orders", nil, options.FindOne().SetProjection(tc.projection))
+		if err != nil {
+			t.Fatalf("%v: %v", tc.projection, err)
+		}
+		if !reflect.DeepEqual(doc, tc.want) {
+			t.Errorf("%v: %v, want %v", tc.projection, doc, tc.want)
+		}
+	}
+	if _, err := s.FindOne(context.Background(), "shop", "orders", nil, options.FindOne().SetProjection(bson.D{{Key: "name", Value: bson.D{{Key: "$slice", Value: 1}}}})); err == nil {
+		t.Error("projection operator accepted")
+	}
+}
+
+func TestWrites(t *testing.T) {
+	s := newStore(t, orders)
+	ctx := context.Background()
+
+	res, err := s.InsertOne(ctx, "shop", "orders", bson.M{"sku": "d"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := res.InsertedID.(primitive.ObjectID); !ok {
+		t.Errorf("generated _id %v, want an ObjectID", res.InsertedID)
+	}
+	if _, err := s.InsertOne(ctx, "shop", "orders", bson.D{{Key: "_id", Value: 1.0}}); err == nil || !strings.Contains(err.Error(), "E11000") {
+		t.Errorf("duplicate _id: %v, want E11000", err)
+	}
+	many, err := s.InsertMany(ctx, "shop", "orders", []interface{}{bson.D{{Key: "_id", Value: 10}}, bson.D{{Key: "_id", Value: 1}}, bson.D{{Key: "_id", Value: 11}}})
+	if err == nil || len(many.InsertedIDs) != 1 {
+		t.Errorf("InsertMany stopping at a duplicate: %v, %v", many.InsertedIDs, err)
+	}
+
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "status", Value: "open"}}}}
+	for _, tc := range []struct {
+		name                           string
+		many                           bool
+		filter                         bson.D
+		opts                           *options.UpdateOptions
+		matched, modified, upsertedOne int64
+	}{
+		{"one", false, bson.D{{Key: "status", Value: "closed"}}, nil, 1, 1, 0},
+		{"unchanged", true, bson.D{{Key: "status", Value: "open"}}, nil, 3, 0, 0},
+		{"no match", false, bson.D{{Key: "sku", Value: "z"}}, nil, 0, 0, 0},
+		{"upsert", false, bson.D{{Key: "sku", Value: "z"}}, options.Update().SetUpsert(true), 0, 0, 1},
+	} {
+		var res *mongo.UpdateResult
+		if tc.many {
+			res, err = s.UpdateMany(ctx, "shop", "orders", tc.filter, update, tc.opts)
+		} else {
+			res, err = s.UpdateOne(ctx, "shop", "orders", tc.filter, update, tc.opts)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if res.MatchedCount != tc.matched || res.ModifiedCount != tc.modified || res.UpsertedCount != tc.upsertedOne {
+			t.Errorf("%s: matched %d, modified %d, upserted %d", tc.name, res.MatchedCount, res.ModifiedCount, res.UpsertedCount)
+		}
+	}
+	upserted, err := s.FindOne(ctx, "shop", "orders", bson.D{{Key: "sku", Value: "z"}}, nil)
+	if err != nil || upserted["status"] != "open" {
+		t.Errorf("upserted %v, %v", upserted, err)
+	}
+
+	if res, err := s.DeleteOne(ctx, "shop", "orders", bson.D{{Key: "status", Value: "open"}}); err != nil || res.DeletedCount != 1 {
+		t.Errorf("DeleteOne: %v, %v", res, err)
+	}
+	if res, err := s.DeleteMany(ctx, "shop", "orders", bson.D{{Key: "status", Value: "open"}}); err != nil || res.DeletedCount != 3 {
+		t.Errorf("DeleteMany: %v, %v", res, err)
+	}
+	if n, _ := s.CountDocuments(ctx, "shop", "orders", nil); n != 2 {
+		t.Errorf("%d documents left, want 2", n)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	s := newStore(t, orders)
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name     string
+		pipeline bson.A
+		want     []bson.M
+	}{
+		{"match sort project", bson.A{
+			bson.D{{Key: "$match", Value: bson.D{{Key: "status", Value: "open"}}}},
+			bson.D{{Key: "$sort", Value: bson.D{{Key: "qty", Value: 1}}}},
+			bson.D{{Key: "$project", Value: bson.D{{Key: "sku", Value: 1}, {Key: "_id", Value: 0}}}},
+		}, []bson.M{{"sku": "c"}, {"sku": "a"}}},
+		{"skip limit", bson.A{
+			bson.D{{Key: "$skip", Value: 1}},
+			bson.D{{Key: "$limit", Value: int64(1)}},
+			bson.D{{Key: "$project", Value: bson.D{{Key: "_id", Value: 1}}}},
+		}, []bson.M{{"_id": int32(2)}}},
+		{"count", bson.A{
+			bson.D{{Key: "$match", Value: bson.D{{Key: "qty", Value: bson.D{{Key: "$gt", Value: 1}}}}}},
+			bson.D{{Key: "$count", Value: "n"}},
+		}, []bson.M{{"n": int32(2)}}},
+	} {
+		got, err := s.Aggregate(ctx, "shop", "orders", tc.pipeline, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	for _, pipeline := range []interface{}{
+		bson.D{},
+		bson.A{bson.D{{Key: "$group", Value: bson.D{}}}},
+		bson.A{bson.D{{Key: "$match", Value: bson.D{}}, {Key: "$limit", Value: 1}}},
+	} {
+		if _, err := s.Aggregate(ctx, "shop", "orders", pipeline, nil); err == nil {
+			t.Errorf("pipeline %v accepted", pipeline)
+		}
+	}
+}
+
+func TestAggregateWrite(t *testing.T) {
+	s := newStore(t, orders)
+	ctx := context.Background()
+	open := bson.D{{Key: "$match", Value: bson.D{{Key: "status", Value: "open"}}}}
+
+	if err := s.AggregateWrite(ctx, "shop", "orders", bson.A{open, bson.D{{Key: "$out", Value: "open"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := s.CountDocuments(ctx, "shop", "open", nil); n != 2 {
+		t.Errorf("$out wrote %d documents, want 2", n)
+	}
+
+	// $merge updates the documents with the same _id and inserts the others
+	closed := bson.A{
+		bson.D{{Key: "$project", Value: bson.D{{Key: "status", Value: 1}}}},
+		bson.D{{Key: "$merge", Value: bson.D{{Key: "into", Value: bson.D{{Key: "db", Value: "reports"}, {Key: "coll", Value: "status"}}}}}},
+	}
+	if _, err := s.InsertOne(ctx, "reports", "status", bson.D{{Key: "_id", Value: 1}, {Key: "note", Value: "kept"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AggregateWrite(ctx, "shop", "orders", closed); err != nil {
+		t.Fatal(err)
+	}
+	merged, err := s.Find(ctx, "reports", "status", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []bson.M{
+		{"_id": int32(1), "note": "kept", "status": "open"},
+		{"_id": int32(2), "status": "closed"},
+		{"_id": int32(3), "status": "open"},
+	}; !reflect.DeepEqual(merged, want) {
+		t.Errorf("merged %v, want %v", merged, want)
+	}
+
+	for _, pipeline := range []bson.A{
+		{open},
+		{bson.D{{Key: "$merge", Value: bson.D{{Key: "into", Value: "x"}, {Key: "on", Value: "sku"}}}}},
+		{bson.D{{Key: "$out", Value: ""}}},
+	} {
+		if err := s.AggregateWrite(ctx, "shop", "orders", pipeline); err == nil {
+			t.Errorf("pipeline %v accepted", pipeline)
+		}
+	}
+}
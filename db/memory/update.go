@@ -0,0 +1,225 @@
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// applyUpdate applies update operators to a copy of doc. $setOnInsert is
+// only applied when inserting is true.
+func applyUpdate(doc bson.D, update bson.D, inserting bool) (bson.D, error) {
+	if !isOperatorDoc(update) {
+		return nil, errors.New("update document must contain key beginning with '$'")
+	}
+	doc = copyD(doc)
+	for _, op := range update {
+		fields, ok := op.Value.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("%s requires a document", op.Key)
+		}
+		for _, f := range fields {
+			if f.Key == "_id" && op.Key != "$setOnInsert" && !inserting {
+				return nil, errors.New("performing an update on the path '_id' would modify the immutable field '_id'")
+			}
+			var err error
+			switch op.Key {
+			case "$set":
+				doc = setPath(doc, f.Key, copyValue(f.Value))
+			case "$setOnInsert":
+				if inserting {
+					doc = setPath(doc, f.Key, copyValue(f.Value))
+				}
+			case "$unset":
+				doc = unsetPath(doc, f.Key)
+			case "$inc":
+				current, _ := lookup(doc, f.Key)
+				var sum interface{}
+				if sum, err = add(current, f.Value); err == nil {
+					doc = setPath(doc, f.Key, sum)
+				}
+			case "$push", "$addToSet":
+				current, exists := lookup(doc, f.Key)
+				arr, isArray := current.(bson.A)
+				if exists && !isArray {
+					return nil, fmt.Errorf("%s requires %s to be an array", op.Key, f.Key)
+				}
+				values := bson.A{f.Value}
+				if each, ok := f.Value.(bson.D); ok && len(each) == 1 && each[0].Key == "$each" {
+					values, _ = each[0].Value.(bson.A)
+				}
+				arr = append(bson.A{}, arr...)
+				for _, v := range values {
+					if op.Key == "$addToSet" && equalsAny(arr, true, v) {
+						continue
+					}
+					arr = append(arr, copyValue(v))
+				}
+				doc = setPath(doc, f.Key, arr)
+			case "$pull":
+				current, _ := lookup(doc, f.Key)
+				if arr, ok := current.(bson.A); ok {
+					kept := bson.A{}
+					for _, item := range arr {
+						if !equal(item, f.Value) {
+							kept = append(kept, item)
+						}
+					}
+					doc = setPath(doc, f.Key, kept)
+				}
+			default:
+				return nil, errUnsupported("update operator " + op.Key)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return doc, nil
+}
+
+// add implements $inc: integers stay integers, anything else becomes a double
+func add(current, inc interface{}) (interface{}, error) {
+	if current == nil {
+		current = int32(0)
+	}
+	a, okA := toFloat(current)
+	b, okB := toFloat(inc)
+	if !okA || !okB {
+		return nil, errors.New("cannot apply $inc to a value of non-numeric type")
+	}
+	switch x := current.(type) {
+	case int32:
+		if y, ok := inc.(int32); ok {
+			return x + y, nil
+		}
+		if y, ok := inc.(int64); ok {
+			return int64(x) + y, nil
+		}
+	case int64:
+		if y, ok := inc.(int32); ok {
+			return x + int64(y), nil
+		}
+		if y, ok := inc.(int64); ok {
+			return x + y, nil
+		}
+	}
+	return a + b, nil
+}
+
+// setPath sets the value at a dotted path, creating embedded documents as
+// needed
+func setPath(doc bson.D, path string, value interface{}) bson.D {
+	key, rest, nested := strings.Cut(path, ".")
+	for i, e := range doc {
+		if e.Key != key {
+			continue
+		}
+		if !nested {
+			doc[i].Value = value
+			return doc
+		}
+		switch v := e.Value.(type) {
+		case bson.D:
+			doc[i].Value = setPath(v, rest, value)
+			return doc
+		case bson.A:
+			idx, after, more := strings.Cut(rest, ".")
+			if n, err := strconv.Atoi(idx); err == nil && n >= 0 {
+				for len(v) <= n {
+					v = append(v, nil)
+				}
+				if more {
+					sub, _ := v[n].(bson.D)
+					v[n] = setPath(sub, after, value)
+				} else {
+					v[n] = value
+				}
+				doc[i].Value = v
+				return doc
+			}
+		}
+		doc[i].Value = setPath(bson.D{}, rest, value)
+		return doc
+	}
+	if nested {
+		return append(doc, bson.E{Key: key, Value: setPath(bson.D{}, rest, value)})
+	}
+	return append(doc, bson.E{Key: key, Value: value})
+}
+
+func unsetPath(doc bson.D, path string) bson.D {
+	key, rest, nested := strings.Cut(path, ".")
+	for i, e := range doc {
+		if e.Key != key {
+			continue
+		}
+		if !nested {
+			return append(doc[:i:i], doc[i+1:]...)
+		}
+		if sub, ok := e.Value.(bson.D); ok {
+			doc[i].Value = unsetPath(sub, rest)
+		}
+		return doc
+	}
+	return doc
+}
+
+// upsertBase builds the document inserted by an upsert from the equality
+// conditions of filter
+func upsertBase(filter bson.D) bson.D {
+	doc := bson.D{}
+	for _, e := range filter {
+		switch {
+		case e.Key == "$and":
+			clauses, _ := e.Value.(bson.A)
+			for _, clause := range clauses {
+				if sub, ok := clause.(bson.D); ok {
+					for _, f := range upsertBase(sub) {
+						doc = setPath(doc, f.Key, f.Value)
+					}
+				}
+			}
+		case strings.HasPrefix(e.Key, "$"):
+		default:
+			value := e.Value
+			if cond, ok := value.(bson.D); ok && isOperatorDoc(cond) {
+				if len(cond) != 1 || cond[0].Key != "$eq" {
+					continue
+				}
+				value = cond[0].Value
+			}
+			doc = setPath(doc, e.Key, copyValue(value))
+		}
+	}
+	return doc
+}
+
+func copyD(d bson.D) bson.D {
+	out := make(bson.D, len(d))
+	for i, e := range d {
+		out[i] = bson.E{Key: e.Key, Value: copyValue(e.Value)}
+	}
+	return out
+}
+
+func copyValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case bson.D:
+		return copyD(val)
+	case bson.A:
+		out := make(bson.A, len(val))
+		for i, item := range val {
+			out[i] = copyValue(item)
+		}
+		return out
+	case bson.M:
+		return copyD(mapToD(val))
+	case map[string]interface{}:
+		return copyD(mapToD(val))
+	}
+	return v
+}
@@ -0,0 +1,82 @@
+package memory
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyUpdate(t *testing.T) {
+	const doc = `{"_id": 1, "n": 1, "big": {"$numberLong": "5"}, "tags": ["a"], "address": {"city": "Paris", "zip": "75001"}, "items": [{"q": 1}]}`
+
+	for _, tc := range []struct {
+		update    string
+		inserting bool
+		want      string
+	}{
+		{`{"$set": {"n": 2, "new": true}}`, false,
+			`{"_id": 1, "n": 2, "big": {"$numberLong": "5"}, "tags": ["a"], "address": {"city": "Paris", "zip": "75001"}, "items": [{"q": 1}], "new": true}`},
+		{`{"$set": {"address.city": "Lyon", "a.b.c": 1, "items.0.q": 2, "tags.2": "c"}}`, false,
+			`{"_id": 1, "n": 1, "big": {"$numberLong": "5"}, "tags": ["a", null, "c"], "address": {"city": "Lyon", "zip": "75001"}, "items": [{"q": 2}], "a": {"b": {"c": 1}}}`},
+		{`{"$unset": {"n": "", "address.zip": "", "missing": ""}}`, false,
+			`{"_id": 1, "big": {"$numberLong": "5"}, "tags": ["a"], "address": {"city": "Paris"}, "items": [{"q": 1}]}`},
+		{`{"$inc": {"n": 2, "big": 1, "new": 3, "address.count": 1.5}}`, false,
+			`{"_id": 1, "n": 3, "big": {"$numberLong": "6"}, "tags": ["a"], "address": {"city": "Paris", "zip": "75001", "count": 1.5}, "items": [{"q": 1}], "new": 3}`},
+		{`{"$push": {"tags": "a", "list": {"$each": [1, 2]}}}`, false,
+			`{"_id": 1, "n": 1, "big": {"$numberLong": "5"}, "tags": ["a", "a"], "address": {"city": "Paris", "zip": "75001"}, "items": [{"q": 1}], "list": [1, 2]}`},
+		{`{"$addToSet": {"tags": {"$each": ["a", "b", "b"]}}}`, false,
+			`{"_id": 1, "n": 1, "big": {"$numberLong": "5"}, "tags": ["a", "b"], "address": {"city": "Paris", "zip": "75001"}, "items": [{"q": 1}]}`},
+		{`{"$pull": {"tags": "a", "items": {"q": 1.0}}}`, false,
+			`{"_id": 1, "n": 1, "big": {"$numberLong": "5"}, "tags": [], "address": {"city": "Paris", "zip": "75001"}, "items": []}`},
+		{`{"$setOnInsert": {"created": true}}`, false,
+			doc},
+		{`{"$setOnInsert": {"created": true}, "$set": {"n": 2}}`, true,
+			`{"_id": 1, "n": 2, "big": {"$numberLong": "5"}, "tags": ["a"], "address": {"city": "Paris", "zip": "75001"}, "items": [{"q": 1}], "created": true}`},
+	} {
+		original := ejson(t, doc)
+		got, err := applyUpdate(original, ejson(t, tc.update), tc.inserting)
+		if err != nil {
+			t.Errorf("%s: %v", tc.update, err)
+			continue
+		}
+		if want := ejson(t, tc.want); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s:\ngot  %v\nwant %v", tc.update, got, want)
+		}
+		if !reflect.DeepEqual(original, ejson(t, doc)) {
+			t.Errorf("%s modified the original document: %v", tc.update, original)
+		}
+	}
+}
+
+func TestApplyUpdateErrors(t *testing.T) {
+	doc := ejson(t, `{"_id": 1, "name": "Ada"}`)
+	for _, tc := range []struct {
+		update string
+		err    string
+	}{
+		{`{"name": "Bob"}`, "must contain key beginning with '$'"},
+		{`{"$set": {"_id": 2}}`, "immutable field '_id'"},
+		{`{"$set": 1}`, "$set requires a document"},
+		{`{"$inc": {"name": 1}}`, "non-numeric type"},
+		{`{"$push": {"name": 1}}`, "$push requires name to be an array"},
+		{`{"$rename": {"name": "n"}}`, "update operator $rename is not supported in mock mode"},
+	} {
+		if _, err := applyUpdate(doc, ejson(t, tc.update), false); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: error %v, want %q", tc.update, err, tc.err)
+		}
+	}
+}
+
+func TestUpsertBase(t *testing.T) {
+	for _, tc := range []struct {
+		filter, want string
+	}{
+		{`{"name": "Ada", "age": {"$gt": 30}}`, `{"name": "Ada"}`},
+		{`{"age": {"$eq": 36}, "address.city": "Paris"}`, `{"age": 36, "address": {"city": "Paris"}}`},
+		{`{"$and": [{"a": 1}, {"b": {"$in": [1]}}], "$or": [{"c": 1}]}`, `{"a": 1}`},
+	} {
+		if got, want := upsertBase(ejson(t, tc.filter)), ejson(t, tc.want); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: %v, want %v", tc.filter, got, want)
+		}
+	}
+}
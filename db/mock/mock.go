@@ -0,0 +1,416 @@
+// Package mock provides a DataStore for unit tests. Every call is recorded;
+// results come from the optional function fields and default to empty
+// results.
+package mock
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"mongo-data-api-go-alternative/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Call is a recorded DataStore call
+type Call struct {
+	Method     string
+	Database   string
+	Collection string
+	// Filter, Update, Documents and Pipeline hold the arguments as passed,
+	// i.e. after tenant scoping and hooks
+	Filter    interface{}
+	Update    interface{}
+	Documents []interface{}
+	Pipeline  interface{}
+	// Options is the *options.FindOptions, *options.FindOneOptions,
+	// *options.UpdateOptions or *options.AggregateOptions passed, if any
+	Options interface{}
+	// Index is the index passed to CreateIndex, or the name and expiry
+	// passed to DropIndex and SetIndexExpiry
+	Index *db.Index
+	// View is the view passed to CreateView
+	View *db.View
+	// Client is the client the operation is attributed to, see
+	// db.WithClient
+	Client string
+	// MaxTime is the limit the operation was run with, see db.WithMaxTime
+	MaxTime time.Duration
+	// Session is the number of the session the operation ran in, 0 for
+	// none. For StartSession, StartSnapshot and the transaction methods it
+	// is the session's own number.
+	Session int
+}
+
+var _ db.DataStore = (*Store)(nil)
+
+// Store implements db.DataStore
+type Store struct {
+	InsertOneFunc       func(call Call) (*mongo.InsertOneResult, error)
+	InsertManyFunc      func(call Call) (*mongo.InsertManyResult, error)
+	FindOneFunc         func(call Call) (bson.M, error)
+	FindFunc            func(call Call) ([]bson.M, error)
+	CountDocumentsFunc  func(call Call) (int64, error)
+	UpdateOneFunc       func(call Call) (*mongo.UpdateResult, error)
+	UpdateManyFunc      func(call Call) (*mongo.UpdateResult, error)
+	DeleteOneFunc       func(call Call) (*mongo.DeleteResult, error)
+	DeleteManyFunc      func(call Call) (*mongo.DeleteResult, error)
+	AggregateFunc       func(call Call) ([]bson.M, error)
+	AggregateWriteFunc  func(call Call) error
+	ListDatabasesFunc   func() ([]string, error)
+	ListCollectionsFunc func(database string) ([]string, error)
+	StatsFunc           func(call Call) (*db.Stats, error)
+	ListIndexesFunc     func(call Call) ([]db.Index, error)
+	CreateIndexFunc     func(call Call) (string, error)
+	DropIndexFunc       func(call Call) error
+	SetIndexExpiryFunc  func(call Call) error
+	// CurrentOpsFunc gets the filter as Filter, and KillOpFunc the opid as
+	// the "op" of Filter
+	CurrentOpsFunc func(call Call) ([]bson.M, error)
+	KillOpFunc     func(call Call) error
+	// ListViewsFunc gets the database of the views, CreateViewFunc the view
+	// as View and DropViewFunc its name as Collection
+	ListViewsFunc  func(call Call) ([]db.View, error)
+	CreateViewFunc func(call Call) error
+	DropViewFunc   func(call Call) error
+
+	mu       sync.Mutex
+	calls    []Call
+	sessions int
+}
+
+func client(ctx context.Context) string {
+	name, _ := db.ClientFromContext(ctx)
+	return name
+}
+
+func maxTime(ctx context.Context) time.Duration {
+	d, _ := db.MaxTimeFromContext(ctx)
+	return d
+}
+
+type sessionKey struct{}
+
+func session(ctx context.Context) int {
+	n, _ := ctx.Value(sessionKey{}).(int)
+	return n
+}
+
+func (s *Store) record(call Call) Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, call)
+	return call
+}
+
+// Calls returns the calls made so far
+func (s *Store) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+// LastCall returns the most recent call; ok is false when there was none
+func (s *Store) LastCall() (call Call, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.calls) == 0 {
+		return Call{}, false
+	}
+	return s.calls[len(s.calls)-1], true
+}
+
+// InsertOne implements db.DataStore
+func (s *Store) InsertOne(ctx context.Context, database, collection string, document interface{}) (*mongo.InsertOneResult, error) {
+	call := s.record(Call{Method: "InsertOne", Client: client(ctx), MaxTime: maxTime(ctx), Session: session(ctx), Database: database, Collection: collection, Documents: []interface{}{document}})
+	if s.InsertOneFunc != nil {
+		return s.InsertOneFunc(call)
+	}
+	return &mongo.InsertOneResult{}, nil
+}
+
+// InsertMany implements db.DataStore
+func (s *Store) InsertMany(ctx context.Context, database, collection string, documents []interface{}) (*mongo.InsertManyResult, error) {
+	call := s.record(Call{Method: "InsertMany", Client: client(ctx), MaxTime: maxTime(ctx), Session: session(ctx), Database: database, Collection: collection, Documents: documents})
+	if s.InsertManyFunc != nil {
+		return s.InsertManyFunc(call)
+	}
+	return &mongo.InsertManyResult{InsertedIDs: make([]interface{}, len(documents))}, nil
+}
+
+// FindOne implements db.DataStore. Without FindOneFunc it finds nothing.
+func (s *Store) FindOne(ctx context.Context, database, collection string, filter interface{}, opts *options.FindOneOptions) (bson.M, error) {
+	call := s.record(Call{Method: "FindOne", Client: client(ctx), MaxTime: maxTime(ctx), Session: session(ctx), Database: database, Collection: collection, Filter: filter, Options: opts})
+	if s.FindOneFunc != nil {
+		return s.FindOneFunc(call)
+	}
+	return nil, mongo.ErrNoDocuments
+}
+
+// Find implements db.DataStore
+func (s *Store) Find(ctx context.Context, database, collection string, filter interface{}, opts *options.FindOptions) ([]bson.M, error) {
+	call := s.record(Call{Method: "Find", Client: client(ctx), MaxTime: maxTime(ctx), Session: session(ctx), Database: database, Collection: collection, Filter: filter, Options: opts})
+	if s.FindFunc != nil {
+		return s.FindFunc(call)
+	}
+	return []bson.M{}, nil
+}
+
+// FindEach implements db.DataStore. It is recorded as a Find call and
+// iterates over the documents FindFunc returns.
+func (s *Store) FindEach(ctx context.Context, database, collection string, filter interface{}, opts *options.FindOptions, fn func(bson.Raw) error) error {
+	docs, err := s.Find(ctx, database, collection, filter, opts)
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		raw, err := bson.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		if err := fn(raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CountDocuments implements db.DataStore
+func (s *Store) CountDocuments(ctx context.Context, database, collection string, filter interface{}) (int64, error) {
+	call := s.record(Call{Method: "CountDocuments", Client: client(ctx), MaxTime: maxTime(ctx), Session: session(ctx), Database: database, Collection: collection, Filter: filter})
+	if s.CountDocumentsFunc != nil {
+		return s.CountDocumentsFunc(call)
+	}
+	return 0, nil
+}
+
+// UpdateOne implements db.DataStore
+func (s *Store) UpdateOne(ctx context.Context, database, collection string, filter, update interface{}, opts *options.UpdateOptions) (*mongo.UpdateResult, error) {
+	call := s.record(Call{Method: "UpdateOne", Client: client(ctx), MaxTime: maxTime(ctx), Session: session(ctx), Database: database, Collection: collection, Filter: filter, Update: update, Options: opts})
+	if s.UpdateOneFunc != nil {
+		return s.UpdateOneFunc(call)
+	}
+	return &mongo.UpdateResult{}, nil
+}
+
+// UpdateMany implements db.DataStore
+func (s *Store) UpdateMany(ctx context.Context, database, collection string, filter, update interface{}, opts *options.UpdateOptions) (*mongo.UpdateResult, error) {
+	call := s.record(Call{Method: "UpdateMany", Client: client(ctx), MaxTime: maxTime(ctx), Session: session(ctx), Database: database, Collection: collection, Filter: filter, Update: update, Options: opts})
+	if s.UpdateManyFunc != nil {
+		return s.UpdateManyFunc(call)
+	}
+	return &mongo.UpdateResult{}, nil
+}
+
+// DeleteOne implements db.DataStore
+func (s *Store) DeleteOne(ctx context.Context, database, collection string, filter interface{}) (*mongo.DeleteResult, error) {
+	call := s.record(Call{Method: "DeleteOne", Client: client(ctx), MaxTime: maxTime(ctx), Session: session(ctx), Database: database, Collection: collection, Filter: filter})
+	if s.DeleteOneFunc != nil {
+		return s.DeleteOneFunc(call)
+	}
+	return &mongo.DeleteResult{}, nil
+}
+
+// DeleteMany implements db.DataStore
+func (s *Store) DeleteMany(ctx context.Context, database, collection string, filter interface{}) (*mongo.DeleteResult, error) {
+	call := s.record(Call{Method: "DeleteMany", Client: client(ctx), MaxTime: maxTime(ctx), Session: session(ctx), Database: database, Collection: collection, Filter: filter})
+	if s.DeleteManyFunc != nil {
+		return s.DeleteManyFunc(call)
+	}
+	return &mongo.DeleteResult{}, nil
+}
+
+// Aggregate implements db.DataStore
+func (s *Store) Aggregate(ctx context.Context, database, collection string, pipeline interface{}, opts *options.AggregateOptions) ([]bson.M, error) {
+	call := s.record(Call{Method: "Aggregate", Client: client(ctx), MaxTime: maxTime(ctx), Session: session(ctx), Database: database, Collection: collection, Pipeline: pipeline, Options: opts})
+	if s.AggregateFunc != nil {
+		return s.AggregateFunc(call)
+	}
+	return []bson.M{}, nil
+}
+
+// AggregateWrite implements db.DataStore
+func (s *Store) AggregateWrite(ctx context.Context, database, collection string, pipeline interface{}) error {
+	call := s.record(Call{Method: "AggregateWrite", Client: client(ctx), MaxTime: maxTime(ctx), Session: session(ctx), Database: database, Collection: collection, Pipeline: pipeline})
+	if s.AggregateWriteFunc != nil {
+		return s.AggregateWriteFunc(call)
+	}
+	return nil
+}
+
+// ListDatabases implements db.DataStore
+func (s *Store) ListDatabases(context.Context) ([]string, error) {
+	s.record(Call{Method: "ListDatabases"})
+	if s.ListDatabasesFunc != nil {
+		return s.ListDatabasesFunc()
+	}
+	return []string{}, nil
+}
+
+// ListCollections implements db.DataStore
+func (s *Store) ListCollections(_ context.Context, database string) ([]string, error) {
+	s.record(Call{Method: "ListCollections", Database: database})
+	if s.ListCollectionsFunc != nil {
+		return s.ListCollectionsFunc(database)
+	}
+	return []string{}, nil
+}
+
+// Stats implements db.DataStore
+func (s *Store) Stats(ctx context.Context, database, collection string) (*db.Stats, error) {
+	call := s.record(Call{Method: "Stats", Client: client(ctx), MaxTime: maxTime(ctx), Database: database, Collection: collection})
+	if s.StatsFunc != nil {
+		return s.StatsFunc(call)
+	}
+	return &db.Stats{}, nil
+}
+
+// ListIndexes implements db.DataStore
+func (s *Store) ListIndexes(_ context.Context, database, collection string) ([]db.Index, error) {
+	call := s.record(Call{Method: "ListIndexes", Database: database, Collection: collection})
+	if s.ListIndexesFunc != nil {
+		return s.ListIndexesFunc(call)
+	}
+	return []db.Index{}, nil
+}
+
+// CreateIndex implements db.DataStore
+func (s *Store) CreateIndex(_ context.Context, database, collection string, index db.Index) (string, error) {
+	call := s.record(Call{Method: "CreateIndex", Database: database, Collection: collection, Index: &index})
+	if s.CreateIndexFunc != nil {
+		return s.CreateIndexFunc(call)
+	}
+	return index.Name, nil
+}
+
+// DropIndex implements db.DataStore
+func (s *Store) DropIndex(_ context.Context, database, collection, name string) error {
+	call := s.record(Call{Method: "DropIndex", Database: database, Collection: collection, Index: &db.Index{Name: name}})
+	if s.DropIndexFunc != nil {
+		return s.DropIndexFunc(call)
+	}
+	return nil
+}
+
+// SetIndexExpiry implements db.DataStore
+func (s *Store) SetIndexExpiry(_ context.Context, database, collection, name string, seconds int64) error {
+	call := s.record(Call{Method: "SetIndexExpiry", Database: database, Collection: collection, Index: &db.Index{Name: name, ExpireAfterSeconds: &seconds}})
+	if s.SetIndexExpiryFunc != nil {
+		return s.SetIndexExpiryFunc(call)
+	}
+	return nil
+}
+
+var _ db.OperationManager = (*Store)(nil)
+
+// CurrentOps implements db.OperationManager
+func (s *Store) CurrentOps(ctx context.Context, filter bson.D) ([]bson.M, error) {
+	call := s.record(Call{Method: "CurrentOps", Filter: filter})
+	if s.CurrentOpsFunc != nil {
+		return s.CurrentOpsFunc(call)
+	}
+	return []bson.M{}, nil
+}
+
+// KillOp implements db.OperationManager
+func (s *Store) KillOp(ctx context.Context, opID interface{}) error {
+	call := s.record(Call{Method: "KillOp", Filter: bson.D{{Key: "op", Value: opID}}})
+	if s.KillOpFunc != nil {
+		return s.KillOpFunc(call)
+	}
+	return nil
+}
+
+var _ db.ViewManager = (*Store)(nil)
+
+// ListViews implements db.ViewManager
+func (s *Store) ListViews(ctx context.Context, database string) ([]db.View, error) {
+	call := s.record(Call{Method: "ListViews", Database: database})
+	if s.ListViewsFunc != nil {
+		return s.ListViewsFunc(call)
+	}
+	return []db.View{}, nil
+}
+
+// CreateView implements db.ViewManager
+func (s *Store) CreateView(ctx context.Context, database string, view db.View) error {
+	call := s.record(Call{Method: "CreateView", Database: database, Collection: view.Name, View: &view})
+	if s.CreateViewFunc != nil {
+		return s.CreateViewFunc(call)
+	}
+	return nil
+}
+
+// DropView implements db.ViewManager
+func (s *Store) DropView(ctx context.Context, database, name string) error {
+	call := s.record(Call{Method: "DropView", Database: database, Collection: name})
+	if s.DropViewFunc != nil {
+		return s.DropViewFunc(call)
+	}
+	return nil
+}
+
+var (
+	_ db.SessionStarter  = (*Store)(nil)
+	_ db.SnapshotStarter = (*Store)(nil)
+)
+
+// StartSession implements db.SessionStarter. Sessions are numbered from 1
+// in the order they are started.
+func (s *Store) StartSession(causal bool) (db.Session, error) {
+	s.mu.Lock()
+	s.sessions++
+	n := s.sessions
+	s.mu.Unlock()
+	s.record(Call{Method: "StartSession", Session: n})
+	return &Session{store: s, n: n}, nil
+}
+
+// StartSnapshot implements db.SnapshotStarter. Snapshot sessions are
+// numbered with the other sessions.
+func (s *Store) StartSnapshot() (db.Session, error) {
+	s.mu.Lock()
+	s.sessions++
+	n := s.sessions
+	s.mu.Unlock()
+	s.record(Call{Method: "StartSnapshot", Session: n})
+	return &Session{store: s, n: n}, nil
+}
+
+// Session is a session of a mock Store, which records its transaction
+// calls
+type Session struct {
+	store *Store
+	n     int
+}
+
+// Bind implements db.Session
+func (s *Session) Bind(ctx context.Context) context.Context {
+	return context.WithValue(ctx, sessionKey{}, s.n)
+}
+
+// StartTransaction implements db.Session
+func (s *Session) StartTransaction() error {
+	s.store.record(Call{Method: "StartTransaction", Session: s.n})
+	return nil
+}
+
+// CommitTransaction implements db.Session
+func (s *Session) CommitTransaction(ctx context.Context) error {
+	s.store.record(Call{Method: "CommitTransaction", Session: s.n})
+	return nil
+}
+
+// AbortTransaction implements db.Session
+func (s *Session) AbortTransaction(ctx context.Context) error {
+	s.store.record(Call{Method: "AbortTransaction", Session: s.n})
+	return nil
+}
+
+// End implements db.Session
+func (s *Session) End(ctx context.Context) {
+	s.store.record(Call{Method: "EndSession", Session: s.n})
+}
@@ -0,0 +1,47 @@
+package db
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// OperationManager is implemented by stores that can list and kill the
+// operations in progress on their deployment
+type OperationManager interface {
+	// CurrentOps returns the $currentOp documents of the active operations
+	// of all users matching filter
+	CurrentOps(ctx context.Context, filter bson.D) ([]bson.M, error)
+	// KillOp kills an operation by its opid, which is a number on replica
+	// sets and a "shard:number" string through mongos
+	KillOp(ctx context.Context, opID interface{}) error
+}
+
+var _ OperationManager = (*Mongo)(nil)
+
+// CurrentOps implements OperationManager
+func (m *Mongo) CurrentOps(ctx context.Context, filter bson.D) ([]bson.M, error) {
+	if filter == nil {
+		filter = bson.D{}
+	}
+	pipeline := bson.A{
+		bson.D{{Key: "$currentOp", Value: bson.D{{Key: "allUsers", Value: true}}}},
+		bson.D{{Key: "$match", Value: filter}},
+	}
+	cursor, err := m.client.Database("admin").Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	ops := make([]bson.M, 0)
+	if err := cursor.All(ctx, &ops); err != nil {
+		return nil, err
+	}
+	return ops, nil
+}
+
+// KillOp implements OperationManager
+func (m *Mongo) KillOp(ctx context.Context, opID interface{}) error {
+	return m.client.Database("admin").RunCommand(ctx, bson.D{{Key: "killOp", Value: 1}, {Key: "op", Value: opID}}).Err()
+}
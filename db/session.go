@@ -0,0 +1,76 @@
+package db
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrSessionsUnsupported is returned by stores without server sessions
+var ErrSessionsUnsupported = errors.New("sessions are not supported by this data store")
+
+// Session is a server session. Operations run with a context returned by
+// Bind are part of it, and of its transaction when one is in progress. A
+// session must not be used concurrently.
+type Session interface {
+	Bind(ctx context.Context) context.Context
+	StartTransaction() error
+	CommitTransaction(ctx context.Context) error
+	AbortTransaction(ctx context.Context) error
+	End(ctx context.Context)
+}
+
+// SessionStarter is implemented by stores that support server sessions
+type SessionStarter interface {
+	// StartSession starts a session; causal makes its reads observe its
+	// preceding writes
+	StartSession(causal bool) (Session, error)
+}
+
+// SnapshotStarter is implemented by stores that support snapshot reads
+type SnapshotStarter interface {
+	// StartSnapshot starts a session whose reads all see the data as it was
+	// at the time of its first read
+	StartSnapshot() (Session, error)
+}
+
+var (
+	_ SessionStarter  = (*Mongo)(nil)
+	_ SnapshotStarter = (*Mongo)(nil)
+)
+
+// StartSession implements SessionStarter
+func (m *Mongo) StartSession(causal bool) (Session, error) {
+	s, err := m.client.StartSession(options.Session().SetCausalConsistency(causal))
+	if err != nil {
+		return nil, err
+	}
+	return mongoSession{s}, nil
+}
+
+// StartSnapshot implements SnapshotStarter
+func (m *Mongo) StartSnapshot() (Session, error) {
+	s, err := m.client.StartSession(options.Session().SetSnapshot(true))
+	if err != nil {
+		return nil, err
+	}
+	return mongoSession{s}, nil
+}
+
+type mongoSession struct {
+	mongo.Session
+}
+
+func (s mongoSession) Bind(ctx context.Context) context.Context {
+	return mongo.NewSessionContext(ctx, s.Session)
+}
+
+func (s mongoSession) StartTransaction() error {
+	return s.Session.StartTransaction()
+}
+
+func (s mongoSession) End(ctx context.Context) {
+	s.EndSession(ctx)
+}
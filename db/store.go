@@ -0,0 +1,423 @@
+package db
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DataStore is the database layer behind the data endpoints. Database names
+// are physical names, i.e. tenant prefixes have already been applied.
+// FindOne returns mongo.ErrNoDocuments when nothing matches.
+type DataStore interface {
+	InsertOne(ctx context.Context, database, collection string, document interface{}) (*mongo.InsertOneResult, error)
+	InsertMany(ctx context.Context, database, collection string, documents []interface{}) (*mongo.InsertManyResult, error)
+	FindOne(ctx context.Context, database, collection string, filter interface{}, opts *options.FindOneOptions) (bson.M, error)
+	Find(ctx context.Context, database, collection string, filter interface{}, opts *options.FindOptions) ([]bson.M, error)
+	// FindEach calls fn with each document matching filter as it is read
+	// from the cursor, stopping at the first error fn returns. The document
+	// is only valid during the call.
+	FindEach(ctx context.Context, database, collection string, filter interface{}, opts *options.FindOptions, fn func(bson.Raw) error) error
+	CountDocuments(ctx context.Context, database, collection string, filter interface{}) (int64, error)
+	UpdateOne(ctx context.Context, database, collection string, filter, update interface{}, opts *options.UpdateOptions) (*mongo.UpdateResult, error)
+	UpdateMany(ctx context.Context, database, collection string, filter, update interface{}, opts *options.UpdateOptions) (*mongo.UpdateResult, error)
+	DeleteOne(ctx context.Context, database, collection string, filter interface{}) (*mongo.DeleteResult, error)
+	DeleteMany(ctx context.Context, database, collection string, filter interface{}) (*mongo.DeleteResult, error)
+	Aggregate(ctx context.Context, database, collection string, pipeline interface{}, opts *options.AggregateOptions) ([]bson.M, error)
+	// AggregateWrite runs a pipeline ending in $out or $merge, which
+	// returns no documents
+	AggregateWrite(ctx context.Context, database, collection string, pipeline interface{}) error
+	ListDatabases(ctx context.Context) ([]string, error)
+	ListCollections(ctx context.Context, database string) ([]string, error)
+	// Stats returns the storage statistics of a collection, or of the
+	// database when collection is empty. It returns ErrNamespaceNotFound
+	// for collections that do not exist.
+	Stats(ctx context.Context, database, collection string) (*Stats, error)
+	// ListIndexes returns the indexes of a collection, or none when the
+	// collection does not exist
+	ListIndexes(ctx context.Context, database, collection string) ([]Index, error)
+	// CreateIndex creates an index and returns its name
+	CreateIndex(ctx context.Context, database, collection string, index Index) (string, error)
+	DropIndex(ctx context.Context, database, collection, name string) error
+	// SetIndexExpiry changes the expireAfterSeconds of a TTL index
+	SetIndexExpiry(ctx context.Context, database, collection, name string, seconds int64) error
+}
+
+// Index describes an index of a collection
+type Index struct {
+	// Name defaults to the name MongoDB derives from the keys
+	Name   string `json:"name,omitempty" bson:"name,omitempty"`
+	Keys   bson.D `json:"keys" bson:"keys"`
+	Unique bool   `json:"unique,omitempty" bson:"unique,omitempty"`
+	// ExpireAfterSeconds makes a TTL index that deletes documents once the
+	// date in its field is older than the given number of seconds
+	ExpireAfterSeconds *int64 `json:"expireAfterSeconds,omitempty" bson:"expireAfterSeconds,omitempty"`
+}
+
+// ErrNamespaceNotFound is returned for statistics of missing collections
+var ErrNamespaceNotFound = errors.New("namespace not found")
+
+// Stats are storage statistics of a database or collection. Sizes are in
+// bytes.
+type Stats struct {
+	// Collections is only set for databases
+	Collections     int64   `json:"collections,omitempty"`
+	Documents       int64   `json:"documents"`
+	AvgDocumentSize float64 `json:"avgDocumentSize"`
+	DataSize        int64   `json:"dataSize"`
+	StorageSize     int64   `json:"storageSize"`
+	Indexes         int64   `json:"indexes"`
+	IndexSize       int64   `json:"indexSize"`
+	// IndexSizes maps index names to their sizes; only set for collections
+	IndexSizes map[string]int64 `json:"indexSizes,omitempty"`
+	// Capped is set for capped collections
+	Capped bool `json:"capped,omitempty"`
+}
+
+var _ DataStore = (*Mongo)(nil)
+
+// Mongo implements DataStore on a MongoDB client
+type Mongo struct {
+	client *mongo.Client
+}
+
+// NewMongo returns a DataStore backed by client
+func NewMongo(client *mongo.Client) *Mongo {
+	return &Mongo{client: client}
+}
+
+// Client returns the client set up by Connect or SetClient
+func Client() *mongo.Client {
+	return client
+}
+
+func (m *Mongo) collection(database, collection string) *mongo.Collection {
+	return m.client.Database(database).Collection(collection)
+}
+
+// InsertOne inserts a single document
+func (m *Mongo) InsertOne(ctx context.Context, database, collection string, document interface{}) (*mongo.InsertOneResult, error) {
+	opts := options.InsertOne()
+	opts.Comment = comment(ctx, nil)
+	ctx, cancel := writeContext(ctx)
+	defer cancel()
+	return m.collection(database, collection).InsertOne(ctx, document, opts)
+}
+
+// InsertMany inserts several documents
+func (m *Mongo) InsertMany(ctx context.Context, database, collection string, documents []interface{}) (*mongo.InsertManyResult, error) {
+	opts := options.InsertMany()
+	opts.Comment = comment(ctx, nil)
+	ctx, cancel := writeContext(ctx)
+	defer cancel()
+	return m.collection(database, collection).InsertMany(ctx, documents, opts)
+}
+
+// FindOne returns the first document matching filter
+func (m *Mongo) FindOne(ctx context.Context, database, collection string, filter interface{}, opts *options.FindOneOptions) (bson.M, error) {
+	opts = copyOptions(opts, options.FindOne)
+	opts.Comment = stringComment(ctx, opts.Comment)
+	opts.MaxTime = maxTime(ctx, opts.MaxTime)
+	var result bson.M
+	if err := m.collection(database, collection).FindOne(ctx, filter, opts).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Find returns all documents matching filter
+func (m *Mongo) Find(ctx context.Context, database, collection string, filter interface{}, opts *options.FindOptions) ([]bson.M, error) {
+	ctx, done := Cursors.Track(ctx, "find", database, collection)
+	defer done()
+	cursor, err := m.find(ctx, database, collection, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	// A cursor closed through the registry has its context canceled, so it
+	// is killed on the server with a context of its own
+	defer cursor.Close(context.WithoutCancel(ctx))
+
+	results := make([]bson.M, 0)
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// find opens a cursor over the documents matching filter
+func (m *Mongo) find(ctx context.Context, database, collection string, filter interface{}, opts *options.FindOptions) (*mongo.Cursor, error) {
+	opts = copyOptions(opts, options.Find)
+	opts.Comment = stringComment(ctx, opts.Comment)
+	opts.MaxTime = maxTime(ctx, opts.MaxTime)
+	return m.collection(database, collection).Find(ctx, filter, opts)
+}
+
+// FindEach iterates over the documents matching filter without holding the
+// whole result in memory
+func (m *Mongo) FindEach(ctx context.Context, database, collection string, filter interface{}, opts *options.FindOptions, fn func(bson.Raw) error) error {
+	operation := "find"
+	if opts != nil && opts.CursorType != nil && *opts.CursorType != options.NonTailable {
+		operation = operationTail
+	}
+	ctx, done := Cursors.Track(ctx, operation, database, collection)
+	defer done()
+	cursor, err := m.find(ctx, database, collection, filter, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.WithoutCancel(ctx))
+
+	for cursor.Next(ctx) {
+		if err := fn(cursor.Current); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// CountDocuments counts the documents matching filter
+func (m *Mongo) CountDocuments(ctx context.Context, database, collection string, filter interface{}) (int64, error) {
+	opts := options.Count()
+	opts.Comment = stringComment(ctx, nil)
+	opts.MaxTime = maxTime(ctx, nil)
+	return m.collection(database, collection).CountDocuments(ctx, filter, opts)
+}
+
+// UpdateOne updates the first document matching filter
+func (m *Mongo) UpdateOne(ctx context.Context, database, collection string, filter, update interface{}, opts *options.UpdateOptions) (*mongo.UpdateResult, error) {
+	opts = updateOptions(ctx, opts)
+	ctx, cancel := writeContext(ctx)
+	defer cancel()
+	return m.collection(database, collection).UpdateOne(ctx, filter, update, opts)
+}
+
+// UpdateMany updates all documents matching filter
+func (m *Mongo) UpdateMany(ctx context.Context, database, collection string, filter, update interface{}, opts *options.UpdateOptions) (*mongo.UpdateResult, error) {
+	opts = updateOptions(ctx, opts)
+	ctx, cancel := writeContext(ctx)
+	defer cancel()
+	return m.collection(database, collection).UpdateMany(ctx, filter, update, opts)
+}
+
+// DeleteOne deletes the first document matching filter
+func (m *Mongo) DeleteOne(ctx context.Context, database, collection string, filter interface{}) (*mongo.DeleteResult, error) {
+	opts := deleteOptions(ctx)
+	ctx, cancel := writeContext(ctx)
+	defer cancel()
+	return m.collection(database, collection).DeleteOne(ctx, filter, opts)
+}
+
+// DeleteMany deletes all documents matching filter
+func (m *Mongo) DeleteMany(ctx context.Context, database, collection string, filter interface{}) (*mongo.DeleteResult, error) {
+	opts := deleteOptions(ctx)
+	ctx, cancel := writeContext(ctx)
+	defer cancel()
+	return m.collection(database, collection).DeleteMany(ctx, filter, opts)
+}
+
+// Aggregate runs pipeline and returns all results
+func (m *Mongo) Aggregate(ctx context.Context, database, collection string, pipeline interface{}, opts *options.AggregateOptions) ([]bson.M, error) {
+	ctx, done := Cursors.Track(ctx, "aggregate", database, collection)
+	defer done()
+	opts = copyOptions(opts, options.Aggregate)
+	opts.Comment = stringComment(ctx, opts.Comment)
+	opts.MaxTime = maxTime(ctx, opts.MaxTime)
+	cursor, err := m.collection(database, collection).Aggregate(ctx, pipeline, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.WithoutCancel(ctx))
+
+	results := make([]bson.M, 0)
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// AggregateWrite runs a pipeline ending in $out or $merge. The write happens
+// when the aggregate command runs, so the empty cursor is closed unread.
+func (m *Mongo) AggregateWrite(ctx context.Context, database, collection string, pipeline interface{}) error {
+	opts := options.Aggregate()
+	opts.Comment = stringComment(ctx, nil)
+	opts.MaxTime = maxTime(ctx, nil)
+	cursor, err := m.collection(database, collection).Aggregate(ctx, pipeline, opts)
+	if err != nil {
+		return err
+	}
+	return cursor.Close(ctx)
+}
+
+// copyOptions returns a copy of opts, or new options when opts is nil, so
+// that setting the comment doesn't change options the caller reuses
+func copyOptions[T any](opts *T, create func() *T) *T {
+	if opts == nil {
+		return create()
+	}
+	c := *opts
+	return &c
+}
+
+func updateOptions(ctx context.Context, opts *options.UpdateOptions) *options.UpdateOptions {
+	opts = copyOptions(opts, options.Update)
+	opts.Comment = comment(ctx, opts.Comment)
+	return opts
+}
+
+func deleteOptions(ctx context.Context) *options.DeleteOptions {
+	opts := options.Delete()
+	opts.Comment = comment(ctx, nil)
+	return opts
+}
+
+// ListDatabases returns the names of all databases on the server
+func (m *Mongo) ListDatabases(ctx context.Context) ([]string, error) {
+	return m.client.ListDatabaseNames(ctx, bson.D{})
+}
+
+// ListCollections returns the names of all collections in a database
+func (m *Mongo) ListCollections(ctx context.Context, database string) ([]string, error) {
+	return m.client.Database(database).ListCollectionNames(ctx, bson.D{})
+}
+
+// Stats returns dbStats for a database or the $collStats storage statistics
+// of a collection, summed over shards
+func (m *Mongo) Stats(ctx context.Context, database, collection string) (*Stats, error) {
+	if collection == "" {
+		var res bson.M
+		if err := m.client.Database(database).RunCommand(ctx, bson.D{{Key: "dbStats", Value: 1}}).Decode(&res); err != nil {
+			return nil, err
+		}
+		return &Stats{
+			Collections:     toInt64(res["collections"]),
+			Documents:       toInt64(res["objects"]),
+			AvgDocumentSize: toFloat64(res["avgObjSize"]),
+			DataSize:        toInt64(res["dataSize"]),
+			StorageSize:     toInt64(res["storageSize"]),
+			Indexes:         toInt64(res["indexes"]),
+			IndexSize:       toInt64(res["indexSize"]),
+		}, nil
+	}
+
+	pipeline := bson.A{bson.D{{Key: "$collStats", Value: bson.D{{Key: "storageStats", Value: bson.D{}}}}}}
+	cursor, err := m.collection(database, collection).Aggregate(ctx, pipeline)
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) && serverErr.HasErrorCode(26) {
+		return nil, ErrNamespaceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var shards []struct {
+		StorageStats bson.M `bson:"storageStats"`
+	}
+	if err := cursor.All(ctx, &shards); err != nil {
+		return nil, err
+	}
+	if len(shards) == 0 {
+		return nil, ErrNamespaceNotFound
+	}
+
+	stats := &Stats{IndexSizes: make(map[string]int64)}
+	for _, shard := range shards {
+		st := shard.StorageStats
+		stats.Documents += toInt64(st["count"])
+		stats.DataSize += toInt64(st["size"])
+		stats.StorageSize += toInt64(st["storageSize"])
+		stats.IndexSize += toInt64(st["totalIndexSize"])
+		if capped, ok := st["capped"].(bool); ok && capped {
+			stats.Capped = true
+		}
+		if sizes, ok := st["indexSizes"].(bson.M); ok {
+			for name, size := range sizes {
+				stats.IndexSizes[name] += toInt64(size)
+			}
+		}
+	}
+	stats.Indexes = int64(len(stats.IndexSizes))
+	if stats.Documents > 0 {
+		stats.AvgDocumentSize = float64(stats.DataSize) / float64(stats.Documents)
+	}
+	return stats, nil
+}
+
+// ListIndexes returns the indexes of a collection
+func (m *Mongo) ListIndexes(ctx context.Context, database, collection string) ([]Index, error) {
+	cursor, err := m.collection(database, collection).Indexes().List(ctx)
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) && serverErr.HasErrorCode(26) {
+		return []Index{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var specs []struct {
+		Name               string      `bson:"name"`
+		Key                bson.D      `bson:"key"`
+		Unique             bool        `bson:"unique"`
+		ExpireAfterSeconds interface{} `bson:"expireAfterSeconds"`
+	}
+	if err := cursor.All(ctx, &specs); err != nil {
+		return nil, err
+	}
+	indexes := make([]Index, len(specs))
+	for i, spec := range specs {
+		indexes[i] = Index{Name: spec.Name, Keys: spec.Key, Unique: spec.Unique}
+		if spec.ExpireAfterSeconds != nil {
+			seconds := toInt64(spec.ExpireAfterSeconds)
+			indexes[i].ExpireAfterSeconds = &seconds
+		}
+	}
+	return indexes, nil
+}
+
+// CreateIndex creates an index and returns its name
+func (m *Mongo) CreateIndex(ctx context.Context, database, collection string, index Index) (string, error) {
+	opts := options.Index()
+	if index.Name != "" {
+		opts.SetName(index.Name)
+	}
+	if index.Unique {
+		opts.SetUnique(true)
+	}
+	if index.ExpireAfterSeconds != nil {
+		opts.SetExpireAfterSeconds(int32(*index.ExpireAfterSeconds))
+	}
+	return m.collection(database, collection).Indexes().CreateOne(ctx, mongo.IndexModel{Keys: index.Keys, Options: opts})
+}
+
+// DropIndex drops the named index
+func (m *Mongo) DropIndex(ctx context.Context, database, collection, name string) error {
+	_, err := m.collection(database, collection).Indexes().DropOne(ctx, name)
+	return err
+}
+
+// SetIndexExpiry changes the expiry of a TTL index with collMod
+func (m *Mongo) SetIndexExpiry(ctx context.Context, database, collection, name string, seconds int64) error {
+	cmd := bson.D{
+		{Key: "collMod", Value: collection},
+		{Key: "index", Value: bson.D{{Key: "name", Value: name}, {Key: "expireAfterSeconds", Value: seconds}}},
+	}
+	return m.client.Database(database).RunCommand(ctx, cmd).Err()
+}
+
+// toInt64 converts a numeric command result field to int64
+func toInt64(v interface{}) int64 {
+	return int64(toFloat64(v))
+}
+
+// toFloat64 converts a numeric command result field to float64
+func toFloat64(v interface{}) float64 {
+	switch n := v.(type) {
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
@@ -0,0 +1,89 @@
+package db
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ErrNamespaceExists is returned when a view is created with the name of an
+// existing collection or view
+var ErrNamespaceExists = errors.New("namespace already exists")
+
+// View is a read-only collection whose documents are those of ViewOn, a
+// collection or view of the same database, passed through Pipeline
+type View struct {
+	Name     string `json:"name" bson:"name"`
+	ViewOn   string `json:"viewOn" bson:"viewOn"`
+	Pipeline bson.A `json:"pipeline" bson:"pipeline"`
+}
+
+// ViewManager is implemented by stores that can create and drop views
+type ViewManager interface {
+	ListViews(ctx context.Context, database string) ([]View, error)
+	// CreateView creates a view. It returns ErrNamespaceExists when a
+	// collection or view of that name exists.
+	CreateView(ctx context.Context, database string, view View) error
+	// DropView drops a view. It returns ErrNamespaceNotFound when there is
+	// no view of that name, so that a collection is never dropped.
+	DropView(ctx context.Context, database, name string) error
+}
+
+var _ ViewManager = (*Mongo)(nil)
+
+// ListViews implements ViewManager
+func (m *Mongo) ListViews(ctx context.Context, database string) ([]View, error) {
+	return m.listViews(ctx, database, bson.D{{Key: "type", Value: "view"}})
+}
+
+func (m *Mongo) listViews(ctx context.Context, database string, filter bson.D) ([]View, error) {
+	cursor, err := m.client.Database(database).ListCollections(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	views := make([]View, 0)
+	for cursor.Next(ctx) {
+		var spec struct {
+			Name    string `bson:"name"`
+			Options struct {
+				ViewOn   string `bson:"viewOn"`
+				Pipeline bson.A `bson:"pipeline"`
+			} `bson:"options"`
+		}
+		if err := cursor.Decode(&spec); err != nil {
+			return nil, err
+		}
+		views = append(views, View{Name: spec.Name, ViewOn: spec.Options.ViewOn, Pipeline: spec.Options.Pipeline})
+	}
+	return views, cursor.Err()
+}
+
+// CreateView implements ViewManager
+func (m *Mongo) CreateView(ctx context.Context, database string, view View) error {
+	pipeline := view.Pipeline
+	if pipeline == nil {
+		pipeline = bson.A{}
+	}
+	err := m.client.Database(database).CreateView(ctx, view.Name, view.ViewOn, pipeline)
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) && serverErr.HasErrorCode(48) {
+		return ErrNamespaceExists
+	}
+	return err
+}
+
+// DropView implements ViewManager
+func (m *Mongo) DropView(ctx context.Context, database, name string) error {
+	views, err := m.listViews(ctx, database, bson.D{{Key: "name", Value: name}, {Key: "type", Value: "view"}})
+	if err != nil {
+		return err
+	}
+	if len(views) == 0 {
+		return ErrNamespaceNotFound
+	}
+	return m.collection(database, name).Drop(ctx)
+}
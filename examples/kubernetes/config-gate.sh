@@ -0,0 +1,27 @@
+#!/bin/sh
+# Sets the mongo-data-api/config readiness gate of each pod of the
+# deployment in deployment.yaml: True once the pod reports that it applied
+# the current content of the ConfigMap and Secret, False otherwise. Run it
+# periodically, e.g. from a CronJob or after each config rollout, with a
+# service account allowed to read the ConfigMap and Secret, exec into the
+# pods and patch pods/status.
+set -eu
+
+NAMESPACE=${NAMESPACE:-default}
+CONFIG_FILE=/etc/dataapi/config/config.json
+KEYS_FILE=/etc/dataapi/keys/keys.json
+
+config_digest=$(kubectl -n "$NAMESPACE" get configmap mongo-data-api-config -o jsonpath='{.data.config\.json}' | sha256sum | cut -d' ' -f1)
+keys_digest=$(kubectl -n "$NAMESPACE" get secret mongo-data-api-keys -o jsonpath='{.data.keys\.json}' | base64 -d | sha256sum | cut -d' ' -f1)
+
+for pod in $(kubectl -n "$NAMESPACE" get pods -l app=mongo-data-api -o jsonpath='{.items[*].metadata.name}'); do
+	status=False
+	readyz=$(kubectl -n "$NAMESPACE" exec "$pod" -- wget -qO- http://127.0.0.1:3000/readyz 2>/dev/null || true)
+	if echo "$readyz" | grep -q "\"$CONFIG_FILE\":\"$config_digest\"" &&
+		echo "$readyz" | grep -q "\"$KEYS_FILE\":\"$keys_digest\"" &&
+		! echo "$readyz" | grep -q '"error"'; then
+		status=True
+	fi
+	kubectl -n "$NAMESPACE" patch pod "$pod" --subresource=status --type=strategic -p \
+		"{\"status\":{\"conditions\":[{\"type\":\"mongo-data-api/config\",\"status\":\"$status\"}]}}"
+done
@@ -0,0 +1,203 @@
+// Package failover serves the reads of a data store from a standby cluster
+// holding the same data when the primary fails them or is too slow
+package failover
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"mongo-data-api-go-alternative/config"
+	"mongo-data-api-go-alternative/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+// Reasons a read fails over
+const (
+	// ReasonError is a read the primary failed
+	ReasonError = "error"
+	// ReasonLatency is a read the primary did not answer within the latency
+	// budget
+	ReasonLatency = "latency"
+)
+
+// Reasons lists the reasons a read fails over
+var Reasons = []string{ReasonError, ReasonLatency}
+
+// Store is a data store that serves reads from the primary store and
+// retries those failing with network, timeout or server selection errors,
+// or taking longer than the latency budget, on the standby store. Writes and reads in sessions are only served by the
+// primary.
+type Store struct {
+	db.DataStore
+	standby db.DataStore
+	cluster string
+	budget  time.Duration
+
+	mu        sync.Mutex
+	failovers map[string]int64
+}
+
+var _ db.DataStore = (*Store)(nil)
+
+// New fails the reads of primary over to standby, the store of cfg.Cluster
+func New(primary, standby db.DataStore, cfg config.ReadFailoverConfig) *Store {
+	return &Store{
+		DataStore: primary,
+		standby:   standby,
+		cluster:   cfg.Cluster,
+		budget:    time.Duration(cfg.LatencyBudgetMs) * time.Millisecond,
+		failovers: make(map[string]int64),
+	}
+}
+
+// Failovers returns the number of reads failed over for reason
+func (s *Store) Failovers(reason string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failovers[reason]
+}
+
+// StartSession starts a session of the primary store; reads in sessions
+// don't fail over
+func (s *Store) StartSession(causal bool) (db.Session, error) {
+	starter, ok := s.DataStore.(db.SessionStarter)
+	if !ok {
+		return nil, db.ErrSessionsUnsupported
+	}
+	return starter.StartSession(causal)
+}
+
+// StartSnapshot starts a snapshot session of the primary store
+func (s *Store) StartSnapshot() (db.Session, error) {
+	starter, ok := s.DataStore.(db.SnapshotStarter)
+	if !ok {
+		return nil, db.ErrSessionsUnsupported
+	}
+	return starter.StartSnapshot()
+}
+
+// FindOne reads from the primary, or from the standby when that fails
+func (s *Store) FindOne(ctx context.Context, database, collection string, filter interface{}, opts *options.FindOneOptions) (bson.M, error) {
+	var doc bson.M
+	err := s.read(ctx, "findOne", database, collection, func(ctx context.Context, store db.DataStore) error {
+		var err error
+		doc, err = store.FindOne(ctx, database, collection, filter, opts)
+		return err
+	})
+	return doc, err
+}
+
+// Find reads from the primary, or from the standby when that fails
+func (s *Store) Find(ctx context.Context, database, collection string, filter interface{}, opts *options.FindOptions) ([]bson.M, error) {
+	var results []bson.M
+	err := s.read(ctx, "find", database, collection, func(ctx context.Context, store db.DataStore) error {
+		var err error
+		results, err = store.Find(ctx, database, collection, filter, opts)
+		return err
+	})
+	return results, err
+}
+
+// FindEach reads from the primary, or from the standby when the primary
+// fails or runs over the budget before the first document. Once documents
+// have been passed to fn the read stays on the primary, and tailable
+// cursors, which wait for documents, never fail over.
+func (s *Store) FindEach(ctx context.Context, database, collection string, filter interface{}, opts *options.FindOptions, fn func(bson.Raw) error) error {
+	tailable := opts != nil && opts.CursorType != nil && *opts.CursorType != options.NonTailable
+	if tailable || mongo.SessionFromContext(ctx) != nil {
+		return s.DataStore.FindEach(ctx, database, collection, filter, opts, fn)
+	}
+	primaryCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var timer *time.Timer
+	if s.budget > 0 {
+		timer = time.AfterFunc(s.budget, cancel)
+		defer timer.Stop()
+	}
+	started := false
+	err := s.DataStore.FindEach(primaryCtx, database, collection, filter, opts, func(raw bson.Raw) error {
+		if !started && timer != nil {
+			timer.Stop()
+		}
+		started = true
+		return fn(raw)
+	})
+	overBudget := primaryCtx.Err() != nil
+	if err == nil || started || ctx.Err() != nil || !(overBudget || unavailable(err)) {
+		return err
+	}
+	s.failover("find", database, collection, overBudget, err)
+	return s.standby.FindEach(ctx, database, collection, filter, opts, fn)
+}
+
+// CountDocuments counts on the primary, or on the standby when that fails
+func (s *Store) CountDocuments(ctx context.Context, database, collection string, filter interface{}) (int64, error) {
+	var n int64
+	err := s.read(ctx, "countDocuments", database, collection, func(ctx context.Context, store db.DataStore) error {
+		var err error
+		n, err = store.CountDocuments(ctx, database, collection, filter)
+		return err
+	})
+	return n, err
+}
+
+// Aggregate runs a pipeline on the primary, or on the standby when that
+// fails
+func (s *Store) Aggregate(ctx context.Context, database, collection string, pipeline interface{}, opts *options.AggregateOptions) ([]bson.M, error) {
+	var results []bson.M
+	err := s.read(ctx, "aggregate", database, collection, func(ctx context.Context, store db.DataStore) error {
+		var err error
+		results, err = store.Aggregate(ctx, database, collection, pipeline, opts)
+		return err
+	})
+	return results, err
+}
+
+// read runs fn on the primary within the latency budget and runs it again
+// on the standby when the primary is unavailable or over budget. Reads the
+// primary answered with an error, and those whose own context is done,
+// don't fail over.
+func (s *Store) read(ctx context.Context, operation, database, collection string, fn func(context.Context, db.DataStore) error) error {
+	if mongo.SessionFromContext(ctx) != nil {
+		return fn(ctx, s.DataStore)
+	}
+	primaryCtx, cancel := ctx, context.CancelFunc(func() {})
+	if s.budget > 0 {
+		primaryCtx, cancel = context.WithTimeout(ctx, s.budget)
+	}
+	err := fn(primaryCtx, s.DataStore)
+	overBudget := primaryCtx.Err() != nil
+	cancel()
+	if err == nil || ctx.Err() != nil || !(overBudget || unavailable(err)) {
+		return err
+	}
+	s.failover(operation, database, collection, overBudget, err)
+	return fn(ctx, s.standby)
+}
+
+// unavailable reports whether err means the primary could not be reached or
+// did not answer in time, rather than that it rejected the read, which the
+// standby would do too
+func unavailable(err error) bool {
+	return mongo.IsNetworkError(err) || mongo.IsTimeout(err) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.As(err, &topology.ServerSelectionError{})
+}
+
+// failover records a read failing over
+func (s *Store) failover(operation, database, collection string, overBudget bool, err error) {
+	reason := ReasonError
+	if overBudget {
+		reason = ReasonLatency
+	}
+	log.Printf("Failing %s on %s.%s over to cluster %s (%s): %v", operation, database, collection, s.cluster, reason, err)
+	s.mu.Lock()
+	s.failovers[reason]++
+	s.mu.Unlock()
+}
@@ -0,0 +1,64 @@
+package failover
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"mongo-data-api-go-alternative/config"
+	memstore "mongo-data-api-go-alternative/db/memory"
+	"mongo-data-api-go-alternative/db/mock"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestReadFailover(t *testing.T) {
+	ctx := context.Background()
+	primary := &mock.Store{FindFunc: func(call mock.Call) ([]bson.M, error) {
+		if call.Collection == "slow" {
+			// As the driver does once the budget is spent
+			time.Sleep(50 * time.Millisecond)
+			return nil, context.DeadlineExceeded
+		}
+		if call.Collection == "invalid" {
+			return nil, mongo.CommandError{Code: 2, Message: "unknown operator: $foo"}
+		}
+		return nil, mongo.CommandError{Message: "connection refused", Labels: []string{"NetworkError"}}
+	}}
+	standby := memstore.New()
+	for _, coll := range []string{"users", "slow"} {
+		if _, err := standby.InsertOne(ctx, "app", coll, bson.D{{Key: "_id", Value: 1}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store := New(primary, standby, config.ReadFailoverConfig{Cluster: "standby", LatencyBudgetMs: 20})
+
+	// Failed and slow reads are served by the standby
+	if docs, err := store.Find(ctx, "app", "users", bson.D{}, nil); err != nil || len(docs) != 1 {
+		t.Fatalf("find: %v %v", docs, err)
+	}
+	if docs, err := store.Find(ctx, "app", "slow", bson.D{}, nil); err != nil || len(docs) != 1 {
+		t.Fatalf("slow find: %v %v", docs, err)
+	}
+	n := 0
+	if err := store.FindEach(ctx, "app", "users", bson.D{}, nil, func(bson.Raw) error { n++; return nil }); err != nil || n != 1 {
+		t.Fatalf("findEach: %d %v", n, err)
+	}
+	// Finding nothing is an answer
+	if _, err := store.FindOne(ctx, "app", "users", bson.D{}, nil); !errors.Is(err, mongo.ErrNoDocuments) {
+		t.Fatalf("findOne: %v", err)
+	}
+	// So is an error of the primary that the standby would return too
+	if _, err := store.Find(ctx, "app", "invalid", bson.D{}, nil); err == nil || !strings.Contains(err.Error(), "unknown operator") {
+		t.Fatalf("invalid find: %v", err)
+	}
+	if err := store.FindEach(ctx, "app", "invalid", bson.D{}, nil, func(bson.Raw) error { return nil }); err == nil {
+		t.Fatal("invalid findEach failed over")
+	}
+	if store.Failovers(ReasonError) != 2 || store.Failovers(ReasonLatency) != 1 {
+		t.Errorf("failovers: %d errors, %d latency", store.Failovers(ReasonError), store.Failovers(ReasonLatency))
+	}
+}
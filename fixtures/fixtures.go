@@ -0,0 +1,189 @@
+// Package fixtures records request/response pairs of the data endpoints to
+// files and replays them, so consumers can run contract tests against the
+// API without live data.
+package fixtures
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Fixture is a recorded request and the responses it received, in order.
+// ObjectIds and dates are normalized (see normalizer).
+type Fixture struct {
+	Request   Request    `json:"request"`
+	Responses []Response `json:"responses"`
+}
+
+// Request identifies a recorded request
+type Request struct {
+	Method string      `json:"method"`
+	Path   string      `json:"path"`
+	Query  string      `json:"query,omitempty"`
+	Body   interface{} `json:"body,omitempty"`
+}
+
+// Response is a recorded response
+type Response struct {
+	Status int         `json:"status"`
+	Body   interface{} `json:"body"`
+}
+
+// Config configures recording and replaying
+type Config struct {
+	// Dir holds one JSON file per distinct request
+	Dir string
+	// SkipPaths are neither recorded nor replayed; a trailing "*" matches
+	// every path with that prefix. Paths are relative to the prefix the
+	// middleware is mounted at.
+	SkipPaths []string
+}
+
+func (cfg Config) skipped(c *fiber.Ctx) bool {
+	path := strings.TrimPrefix(c.Path(), strings.TrimSuffix(c.Route().Path, "/"))
+	for _, p := range cfg.SkipPaths {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(path, prefix) {
+				return true
+			}
+		} else if path == p {
+			return true
+		}
+	}
+	return false
+}
+
+// request returns the normalized request, or false when the body is not JSON
+func request(c *fiber.Ctx, n *normalizer) (Request, bool) {
+	req := Request{Method: c.Method(), Path: c.Path(), Query: string(c.Request().URI().QueryString())}
+	if len(c.Body()) > 0 {
+		var body interface{}
+		if err := json.Unmarshal(c.Body(), &body); err != nil {
+			return req, false
+		}
+		req.Body = n.normalize(body)
+	}
+	return req, true
+}
+
+// fileName derives a stable file name from the normalized request
+func fileName(req Request) string {
+	raw, _ := json.Marshal(req)
+	sum := sha256.Sum256(raw)
+	name := strings.ReplaceAll(strings.Trim(req.Path, "/"), "/", "_")
+	return fmt.Sprintf("%s_%s_%s.json", strings.ToLower(req.Method), name, hex.EncodeToString(sum[:6]))
+}
+
+// Recorder returns a middleware that appends every JSON response to the
+// fixture file of its request
+func Recorder(cfg Config) (fiber.Handler, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	var mu sync.Mutex
+	return func(c *fiber.Ctx) error {
+		if cfg.skipped(c) {
+			return c.Next()
+		}
+		if err := c.Next(); err != nil {
+			return err
+		}
+
+		var body interface{}
+		if err := json.Unmarshal(c.Response().Body(), &body); err != nil {
+			return nil
+		}
+		n := newNormalizer()
+		req, ok := request(c, n)
+		if !ok {
+			return nil
+		}
+		res := Response{Status: c.Response().StatusCode(), Body: n.normalize(body)}
+
+		mu.Lock()
+		defer mu.Unlock()
+		path := filepath.Join(cfg.Dir, fileName(req))
+		fixture := Fixture{Request: req}
+		if raw, err := os.ReadFile(path); err == nil {
+			if err := json.Unmarshal(raw, &fixture); err != nil {
+				return fmt.Errorf("reading fixture %s: %w", path, err)
+			}
+		}
+		fixture.Responses = append(fixture.Responses, res)
+		raw, err := json.MarshalIndent(fixture, "", "  ")
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(path, raw, 0o644)
+	}, nil
+}
+
+// replayEntry is a loaded fixture and the index of the next response
+type replayEntry struct {
+	fixture Fixture
+	next    int
+}
+
+// Replayer returns a handler that answers requests from the fixtures in
+// cfg.Dir without calling the remaining handlers. Identical requests receive
+// the recorded responses in order; the last one is repeated once they are
+// exhausted. ObjectIds and dates that appear in the request are substituted
+// back into the response.
+func Replayer(cfg Config) (fiber.Handler, error) {
+	files, err := filepath.Glob(filepath.Join(cfg.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]*replayEntry, len(files))
+	for _, file := range files {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var fixture Fixture
+		if err := json.Unmarshal(raw, &fixture); err != nil {
+			return nil, fmt.Errorf("reading fixture %s: %w", file, err)
+		}
+		if len(fixture.Responses) == 0 {
+			continue
+		}
+		entries[fileName(fixture.Request)] = &replayEntry{fixture: fixture}
+	}
+
+	var mu sync.Mutex
+	return func(c *fiber.Ctx) error {
+		if cfg.skipped(c) {
+			return c.Next()
+		}
+		n := newNormalizer()
+		req, ok := request(c, n)
+		if !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Request body is not valid JSON"})
+		}
+
+		mu.Lock()
+		entry, found := entries[fileName(req)]
+		var res Response
+		if found {
+			res = entry.fixture.Responses[entry.next]
+			if entry.next < len(entry.fixture.Responses)-1 {
+				entry.next++
+			}
+		}
+		mu.Unlock()
+		if !found {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": fmt.Sprintf("No fixture recorded for %s %s with this body", req.Method, req.Path),
+			})
+		}
+		return c.Status(res.Status).JSON(n.restore(res.Body))
+	}, nil
+}
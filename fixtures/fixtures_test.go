@@ -0,0 +1,144 @@
+package fixtures
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// newApp mounts middleware on /api in front of handler, like server.New
+func newApp(middleware, handler fiber.Handler) *fiber.App {
+	app := fiber.New()
+	api := app.Group("/api")
+	api.Use(middleware)
+	api.Post("/*", handler)
+	return app
+}
+
+func post(t *testing.T, app *fiber.App, path, body string) (int, map[string]interface{}) {
+	t.Helper()
+	res, err := app.Test(httptest.NewRequest("POST", path, strings.NewReader(body)), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := io.ReadAll(res.Body)
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		t.Fatalf("%s: %v: %s", path, err, raw)
+	}
+	return res.StatusCode, decoded
+}
+
+func TestRecordReplay(t *testing.T) {
+	cfg := Config{Dir: t.TempDir(), SkipPaths: []string{"/import", "/jobs*"}}
+	recorder, err := Recorder(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The handler echoes the filter's ObjectId and date next to a generated
+	// ObjectId, and counts the requests it answers
+	var calls int
+	live := newApp(recorder, func(c *fiber.Ctx) error {
+		calls++
+		var body struct {
+			Filter map[string]interface{} `json:"filter"`
+		}
+		if err := json.Unmarshal(c.Body(), &body); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(fiber.Map{"calls": calls, "document": fiber.Map{
+			"_id":     body.Filter["_id"],
+			"created": body.Filter["created"],
+			"orderId": fiber.Map{"$oid": "65f000000000000000000abc"},
+		}})
+	})
+
+	const recorded = `{"filter":{"_id":{"$oid":"65a1b2c3d4e5f60718293a4b"},"created":{"$date":"2024-01-02T03:04:05Z"}}}`
+	for i := 0; i < 2; i++ {
+		if status, body := post(t, live, "/api/findOne", recorded); status != fiber.StatusOK {
+			t.Fatalf("recording: status %d: %v", status, body)
+		}
+	}
+	post(t, live, "/api/import", recorded)
+	post(t, live, "/api/jobs/1", `{}`)
+
+	// Both responses went to one file, normalized
+	files, _ := filepath.Glob(filepath.Join(cfg.Dir, "*.json"))
+	if len(files) != 1 || !strings.HasPrefix(filepath.Base(files[0]), "post_api_findOne_") {
+		t.Fatalf("fixture files %v, want one for findOne", files)
+	}
+	raw, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fixture Fixture
+	if err := json.Unmarshal(raw, &fixture); err != nil {
+		t.Fatal(err)
+	}
+	wantRequest := map[string]interface{}{"filter": map[string]interface{}{
+		"_id":     map[string]interface{}{"$oid": "000000000000000000000001"},
+		"created": map[string]interface{}{"$date": "1970-01-01T00:00:01Z"},
+	}}
+	if !reflect.DeepEqual(fixture.Request.Body, wantRequest) {
+		t.Errorf("recorded request %v, want %v", fixture.Request.Body, wantRequest)
+	}
+	if len(fixture.Responses) != 2 {
+		t.Fatalf("%d responses recorded, want 2", len(fixture.Responses))
+	}
+	wantDocument := map[string]interface{}{
+		"_id":     map[string]interface{}{"$oid": "000000000000000000000001"},
+		"created": map[string]interface{}{"$date": "1970-01-01T00:00:01Z"},
+		"orderId": map[string]interface{}{"$oid": "000000000000000000000002"},
+	}
+	if doc := fixture.Responses[0].Body.(map[string]interface{})["document"]; !reflect.DeepEqual(doc, wantDocument) {
+		t.Errorf("recorded document %v, want %v", doc, wantDocument)
+	}
+
+	replayer, err := Replayer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	skipped := false
+	replay := newApp(replayer, func(c *fiber.Ctx) error {
+		skipped = true
+		return c.JSON(fiber.Map{})
+	})
+
+	// Other ObjectIds and dates in the same places match the fixture and are
+	// substituted back into the responses, which are replayed in order
+	const replayed = `{"filter":{"created":{"$date":"2025-06-07T08:09:10Z"},"_id":{"$oid":"66b2c3d4e5f60718293a4b5c"}}}`
+	for i, want := range []float64{1, 2, 2} {
+		status, body := post(t, replay, "/api/findOne", replayed)
+		if status != fiber.StatusOK || body["calls"] != want {
+			t.Fatalf("replay %d: status %d: %v", i, status, body)
+		}
+		wantDocument := map[string]interface{}{
+			"_id":     map[string]interface{}{"$oid": "66b2c3d4e5f60718293a4b5c"},
+			"created": map[string]interface{}{"$date": "2025-06-07T08:09:10Z"},
+			"orderId": map[string]interface{}{"$oid": "000000000000000000000002"},
+		}
+		if !reflect.DeepEqual(body["document"], wantDocument) {
+			t.Errorf("replay %d: document %v, want %v", i, body["document"], wantDocument)
+		}
+	}
+	if skipped {
+		t.Error("replayed request reached the handler")
+	}
+
+	if status, _ := post(t, replay, "/api/findOne", `{"filter":{"_id":1}}`); status != fiber.StatusNotFound {
+		t.Errorf("unrecorded request: status %d, want 404", status)
+	}
+	if status, _ := post(t, replay, "/api/findOne", `{"filter"`); status != fiber.StatusBadRequest {
+		t.Errorf("invalid body: status %d, want 400", status)
+	}
+	if post(t, replay, "/api/jobs/1", `{}`); !skipped {
+		t.Error("skipped path was replayed")
+	}
+}
@@ -0,0 +1,113 @@
+package fixtures
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// normalizer replaces ObjectIds and dates in EJSON values with
+// deterministic placeholders, numbered in order of first appearance: the
+// n-th ObjectId becomes n as a 24 digit hex string and the n-th date becomes
+// n seconds after the Unix epoch. The same original value always maps to the
+// same placeholder, so references between request and response survive.
+type normalizer struct {
+	ids   map[string]string
+	dates map[string]string
+	// originals maps placeholders back to the values they replaced
+	originals map[string]interface{}
+}
+
+func newNormalizer() *normalizer {
+	return &normalizer{
+		ids:       make(map[string]string),
+		dates:     make(map[string]string),
+		originals: make(map[string]interface{}),
+	}
+}
+
+func (n *normalizer) normalize(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		if len(val) == 1 {
+			if id, ok := val["$oid"].(string); ok {
+				return map[string]interface{}{"$oid": n.id(id)}
+			}
+			if date, ok := val["$date"]; ok {
+				return map[string]interface{}{"$date": n.date(date)}
+			}
+		}
+		// Walk keys in order so numbering does not depend on map iteration
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		out := make(map[string]interface{}, len(val))
+		for _, k := range keys {
+			out[k] = n.normalize(val[k])
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			out[i] = n.normalize(item)
+		}
+		return out
+	}
+	return v
+}
+
+func (n *normalizer) id(original string) string {
+	if p, ok := n.ids[original]; ok {
+		return p
+	}
+	p := fmt.Sprintf("%024x", len(n.ids)+1)
+	n.ids[original] = p
+	n.originals["oid:"+p] = original
+	return p
+}
+
+func (n *normalizer) date(original interface{}) string {
+	key := fmt.Sprint(original)
+	if p, ok := n.dates[key]; ok {
+		return p
+	}
+	p := time.Unix(int64(len(n.dates)+1), 0).UTC().Format(time.RFC3339)
+	n.dates[key] = p
+	n.originals["date:"+p] = original
+	return p
+}
+
+// restore replaces placeholders that n assigned with the original values
+func (n *normalizer) restore(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		if len(val) == 1 {
+			if id, ok := val["$oid"].(string); ok {
+				if original, ok := n.originals["oid:"+id]; ok {
+					return map[string]interface{}{"$oid": original}
+				}
+				return val
+			}
+			if date, ok := val["$date"].(string); ok {
+				if original, ok := n.originals["date:"+date]; ok {
+					return map[string]interface{}{"$date": original}
+				}
+				return val
+			}
+		}
+		out := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			out[k] = n.restore(item)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			out[i] = n.restore(item)
+		}
+		return out
+	}
+	return v
+}
@@ -0,0 +1,145 @@
+package formats
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"sort"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+)
+
+// ejsonRegistry encodes responses. Maps are written with sorted keys, as
+// encoding/json does, so that documents read as bson.M render the same
+// every time.
+var ejsonRegistry = newEJSONRegistry()
+
+func newEJSONRegistry() *bsoncodec.Registry {
+	reg := bson.NewRegistry()
+	enc := bsoncodec.ValueEncoderFunc(encodeSortedMap)
+	reg.RegisterTypeEncoder(reflect.TypeOf(bson.M{}), enc)
+	reg.RegisterTypeEncoder(reflect.TypeOf(map[string]interface{}{}), enc)
+	return reg
+}
+
+// ejsonWriter is a reusable EJSON encoder. Its value writer keeps its
+// buffer between documents, so pooling the encoder pools the buffer too.
+type ejsonWriter struct {
+	out io.Writer
+	enc *bson.Encoder
+}
+
+func (w *ejsonWriter) Write(p []byte) (int, error) {
+	return w.out.Write(p)
+}
+
+// ejsonWriters pools relaxed (index 0) and canonical (index 1) encoders
+var ejsonWriters = [2]sync.Pool{
+	{New: func() interface{} { return newEJSONWriter(false) }},
+	{New: func() interface{} { return newEJSONWriter(true) }},
+}
+
+func newEJSONWriter(canonical bool) interface{} {
+	w := &ejsonWriter{}
+	vw, err := bsonrw.NewExtJSONValueWriter(w, canonical, false)
+	if err != nil {
+		panic(err)
+	}
+	if w.enc, err = bson.NewEncoder(vw); err != nil {
+		panic(err)
+	}
+	if err := w.enc.SetRegistry(ejsonRegistry); err != nil {
+		panic(err)
+	}
+	return w
+}
+
+// WriteEJSON encodes the document v to out as an EJSON line. The encoding is
+// buffered and written to out in one call once it is complete.
+func WriteEJSON(out io.Writer, v interface{}, canonical bool) error {
+	pool := &ejsonWriters[0]
+	if canonical {
+		pool = &ejsonWriters[1]
+	}
+	w := pool.Get().(*ejsonWriter)
+	w.out = out
+	err := w.enc.Encode(v)
+	w.out = nil
+	// An encoder that failed mid-document is left in an unknown state
+	if err == nil {
+		pool.Put(w)
+	}
+	return err
+}
+
+func encodeSortedMap(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	if val.IsNil() {
+		return vw.WriteNull()
+	}
+	entries := make([]mapEntry, 0, val.Len())
+	iter := val.MapRange()
+	for iter.Next() {
+		entries = append(entries, mapEntry{key: iter.Key().String(), value: iter.Value()})
+	}
+	sort.Sort(byKey(entries))
+
+	dw, err := vw.WriteDocument()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		ew, err := dw.WriteDocumentElement(e.key)
+		if err != nil {
+			return err
+		}
+		value := e.value
+		if value.Kind() == reflect.Interface {
+			if value.IsNil() {
+				if err := ew.WriteNull(); err != nil {
+					return err
+				}
+				continue
+			}
+			value = value.Elem()
+		}
+		encoder, err := ec.LookupEncoder(value.Type())
+		if err != nil {
+			return err
+		}
+		if err := encoder.EncodeValue(ec, ew, value); err != nil {
+			return err
+		}
+	}
+	return dw.WriteDocumentEnd()
+}
+
+type mapEntry struct {
+	key   string
+	value reflect.Value
+}
+
+type byKey []mapEntry
+
+func (s byKey) Len() int           { return len(s) }
+func (s byKey) Less(i, j int) bool { return s[i].key < s[j].key }
+func (s byKey) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Indent rewrites the JSON document data to out indented by two spaces,
+// with the keys of every object sorted, so that responses can be read and
+// diffed. Numbers are copied as they are written.
+func Indent(out io.Writer, data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(out)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
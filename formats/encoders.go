@@ -0,0 +1,260 @@
+package formats
+
+import (
+	"encoding/csv"
+	"io"
+	"sort"
+	"strconv"
+
+	"mongo-data-api-go-alternative/tabular"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Names of the built-in formats
+const (
+	// JSON is relaxed EJSON, the default
+	JSON = "json"
+	// EJSON is canonical EJSON, which keeps every BSON type
+	EJSON = "ejson"
+	// NDJSON is a relaxed EJSON line per document
+	NDJSON = "ndjson"
+	// CSV is a header row of the top-level fields and a row per document
+	CSV = "csv"
+	// BSON is the concatenated BSON documents, as written by mongodump
+	BSON = "bson"
+	// MsgPack is MessagePack
+	MsgPack = "msgpack"
+	// Arrow is an Arrow IPC stream and Parquet a Parquet file, of the
+	// schema inferred from the documents
+	Arrow   = tabular.FormatArrow
+	Parquet = tabular.FormatParquet
+)
+
+func init() {
+	for _, f := range []Format{
+		{Name: JSON, MediaType: "application/json", Encoder: ejsonEncoder(false)},
+		{Name: EJSON, MediaType: "application/ejson", Encoder: ejsonEncoder(true)},
+		{Name: NDJSON, MediaType: "application/x-ndjson", Rows: true, Encoder: EncoderFunc(encodeNDJSON)},
+		{Name: CSV, MediaType: "text/csv", Rows: true, Encoder: EncoderFunc(encodeCSV)},
+		{Name: BSON, MediaType: "application/bson", Rows: true, Encoder: EncoderFunc(encodeBSON)},
+		{Name: MsgPack, MediaType: "application/msgpack", Encoder: EncoderFunc(encodeMsgPack)},
+		{Name: Arrow, MediaType: tabular.MIMEArrow, Rows: true, Encoder: tabularEncoder(Arrow)},
+		{Name: Parquet, MediaType: tabular.MIMEParquet, Rows: true, Encoder: tabularEncoder(Parquet)},
+	} {
+		if err := Register(f); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func ejsonEncoder(canonical bool) Encoder {
+	return EncoderFunc(func(w io.Writer, result map[string]interface{}) error {
+		return WriteEJSON(w, result, canonical)
+	})
+}
+
+func encodeNDJSON(w io.Writer, result map[string]interface{}) error {
+	for _, d := range rows(result) {
+		if err := WriteEJSON(w, d, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeCSV writes a column per top-level field, _id first and the others
+// sorted by name. Strings are written as they are and other values as
+// relaxed EJSON, except ObjectIds, dates and decimals, which are written in
+// their string form.
+func encodeCSV(w io.Writer, result map[string]interface{}) error {
+	docs := rows(result)
+	columns := fieldNames(docs)
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+	record := make([]string, len(columns))
+	for _, d := range docs {
+		for i, name := range columns {
+			cell, err := csvCell(d[name])
+			if err != nil {
+				return err
+			}
+			record[i] = cell
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func csvCell(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil, primitive.Null, primitive.Undefined:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case primitive.ObjectID:
+		return v.Hex(), nil
+	case primitive.DateTime:
+		return v.Time().UTC().Format("2006-01-02T15:04:05.000Z07:00"), nil
+	case primitive.Decimal128:
+		return v.String(), nil
+	}
+	b, err := bson.MarshalExtJSON(bson.D{{Key: "v", Value: v}}, false, false)
+	if err != nil {
+		return "", err
+	}
+	// Unwrap {"v":...}
+	return string(b[5 : len(b)-1]), nil
+}
+
+// fieldNames returns the top-level fields of docs, _id first and the
+// others sorted
+func fieldNames(docs []bson.M) []string {
+	seen := map[string]bool{}
+	var names []string
+	hasID := false
+	for _, d := range docs {
+		for k := range d {
+			if k == "_id" {
+				hasID = true
+			} else if !seen[k] {
+				seen[k] = true
+				names = append(names, k)
+			}
+		}
+	}
+	sort.Strings(names)
+	if hasID {
+		names = append([]string{"_id"}, names...)
+	}
+	return names
+}
+
+func encodeBSON(w io.Writer, result map[string]interface{}) error {
+	vw, err := bsonrw.NewBSONValueWriter(w)
+	if err != nil {
+		return err
+	}
+	enc, err := bson.NewEncoder(vw)
+	if err != nil {
+		return err
+	}
+	if err := enc.SetRegistry(ejsonRegistry); err != nil {
+		return err
+	}
+	for _, d := range rows(result) {
+		if err := enc.Encode(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeMsgPack writes the result as a MessagePack map. Maps are written
+// with sorted keys, ObjectIds and decimals as strings, dates as timestamps
+// and binaries as bytes.
+func encodeMsgPack(w io.Writer, result map[string]interface{}) error {
+	return msgPackValue(msgpack.NewEncoder(w), result)
+}
+
+func msgPackValue(enc *msgpack.Encoder, v interface{}) error {
+	switch v := v.(type) {
+	case nil, primitive.Null, primitive.Undefined:
+		return enc.EncodeNil()
+	case bson.M:
+		return msgPackMap(enc, v)
+	case map[string]interface{}:
+		return msgPackMap(enc, v)
+	case bson.D:
+		if err := enc.EncodeMapLen(len(v)); err != nil {
+			return err
+		}
+		for _, e := range v {
+			if err := enc.EncodeString(e.Key); err != nil {
+				return err
+			}
+			if err := msgPackValue(enc, e.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	case bson.A:
+		return msgPackArray(enc, v)
+	case []interface{}:
+		return msgPackArray(enc, v)
+	case []bson.M:
+		if err := enc.EncodeArrayLen(len(v)); err != nil {
+			return err
+		}
+		for _, item := range v {
+			if err := msgPackMap(enc, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	case primitive.ObjectID:
+		return enc.EncodeString(v.Hex())
+	case primitive.DateTime:
+		return enc.EncodeTime(v.Time())
+	case primitive.Decimal128:
+		return enc.EncodeString(v.String())
+	case primitive.Binary:
+		return enc.EncodeBytes(v.Data)
+	}
+	return enc.Encode(v)
+}
+
+func msgPackMap(enc *msgpack.Encoder, m map[string]interface{}) error {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if err := enc.EncodeMapLen(len(keys)); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := enc.EncodeString(k); err != nil {
+			return err
+		}
+		if err := msgPackValue(enc, m[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func msgPackArray(enc *msgpack.Encoder, items []interface{}) error {
+	if err := enc.EncodeArrayLen(len(items)); err != nil {
+		return err
+	}
+	for _, item := range items {
+		if err := msgPackValue(enc, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func tabularEncoder(format string) Encoder {
+	return EncoderFunc(func(w io.Writer, result map[string]interface{}) error {
+		tw, err := tabular.NewWriter(w, format)
+		if err != nil {
+			return err
+		}
+		if err := tw.Write(rows(result)); err != nil {
+			return err
+		}
+		return tw.Close()
+	})
+}
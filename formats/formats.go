@@ -0,0 +1,157 @@
+// Package formats encodes the responses of the data endpoints in the
+// formats clients negotiate. Formats are registered under a name, selected
+// by the format field of a request, and a media type, matched against its
+// Accept header.
+package formats
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Encoder writes response bodies in one format. result is a response such
+// as {"documents": [...], "totalCount": 3} or the counters of a write.
+type Encoder interface {
+	Encode(w io.Writer, result map[string]interface{}) error
+}
+
+// EncoderFunc adapts a plain function to the Encoder interface
+type EncoderFunc func(w io.Writer, result map[string]interface{}) error
+
+// Encode implements Encoder
+func (f EncoderFunc) Encode(w io.Writer, result map[string]interface{}) error {
+	return f(w, result)
+}
+
+// Format is a registered response format
+type Format struct {
+	// Name selects the format in the format field of a request
+	Name string
+	// MediaType is matched against Accept and sent as the Content-Type
+	MediaType string
+	// Rows is set for formats writing the documents of a result, or the
+	// result itself when it has none, as rows, lines or records. Other
+	// fields of the result such as totalCount are left out, and response
+	// envelopes do not apply.
+	Rows    bool
+	Encoder Encoder
+}
+
+var (
+	mu      sync.RWMutex
+	byName  = map[string]Format{}
+	ordered []Format
+)
+
+// Register adds a format, replacing any format of the same name. Formats
+// should be registered before the server starts.
+func Register(f Format) error {
+	if f.Name == "" || f.MediaType == "" {
+		return errors.New("formats: name and media type are required")
+	}
+	if f.Encoder == nil {
+		return errors.New("formats: nil encoder")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := byName[f.Name]; ok {
+		for i := range ordered {
+			if ordered[i].Name == f.Name {
+				ordered[i] = f
+			}
+		}
+	} else {
+		ordered = append(ordered, f)
+	}
+	byName[f.Name] = f
+	return nil
+}
+
+// Lookup returns the format registered under name
+func Lookup(name string) (Format, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	f, ok := byName[name]
+	if !ok {
+		return f, fmt.Errorf("unknown format %q", name)
+	}
+	return f, nil
+}
+
+// ByMediaType returns the format of a media type, or the default JSON
+// format when none is registered for it
+func ByMediaType(mediaType string) Format {
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, f := range ordered {
+		if f.MediaType == mediaType {
+			return f
+		}
+	}
+	return byName[JSON]
+}
+
+// MediaTypes returns the media types of the registered formats, the default
+// JSON first
+func MediaTypes() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	types := make([]string, len(ordered))
+	for i, f := range ordered {
+		types[i] = f.MediaType
+	}
+	return types
+}
+
+// Documents returns the documents of a find, findOne or aggregate result,
+// or false for results without documents. A findOne matching nothing has
+// none.
+func Documents(result map[string]interface{}) ([]bson.M, bool) {
+	if d, ok := result["document"]; ok {
+		if doc, ok := document(d); ok {
+			return []bson.M{doc}, true
+		}
+		return nil, true
+	}
+	switch docs := result["documents"].(type) {
+	case []bson.M:
+		return docs, true
+	case []interface{}:
+		out := make([]bson.M, 0, len(docs))
+		for _, d := range docs {
+			if doc, ok := document(d); ok {
+				out = append(out, doc)
+			}
+		}
+		return out, true
+	}
+	return nil, false
+}
+
+// rows returns the documents of a result, or the result itself
+func rows(result map[string]interface{}) []bson.M {
+	if docs, ok := Documents(result); ok {
+		return docs
+	}
+	return []bson.M{result}
+}
+
+func document(d interface{}) (bson.M, bool) {
+	switch d := d.(type) {
+	case bson.M:
+		return d, true
+	case map[string]interface{}:
+		return d, true
+	case bson.D:
+		m := make(bson.M, len(d))
+		for _, e := range d {
+			m[e.Key] = e.Value
+		}
+		return m, true
+	}
+	return nil, false
+}
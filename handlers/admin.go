@@ -0,0 +1,802 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"mongo-data-api-go-alternative/auth"
+	"mongo-data-api-go-alternative/config"
+	"mongo-data-api-go-alternative/db"
+	"mongo-data-api-go-alternative/migrations"
+	"mongo-data-api-go-alternative/mirror"
+	"mongo-data-api-go-alternative/query"
+	"mongo-data-api-go-alternative/ratelimit"
+	"mongo-data-api-go-alternative/retention"
+	"mongo-data-api-go-alternative/shadow"
+	"mongo-data-api-go-alternative/trafficmirror"
+	"mongo-data-api-go-alternative/warmup"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Admin serves the /api/admin endpoints for managing API keys, roles and
+// saved queries
+type Admin struct {
+	Keys      *auth.Store
+	Limiter   *ratelimit.Limiter
+	Queries   *query.Registry
+	Store     db.DataStore
+	Retention *retention.Manager
+	Warmer    *warmup.Warmer
+	// Migrations is nil when no migrations directory is configured
+	Migrations  *migrations.Runner
+	Maintenance *auth.Maintenance
+	// Mirror is nil when dual writes are not enabled
+	Mirror *mirror.Store
+	// Shadow is nil when shadow reads are not enabled
+	Shadow *shadow.Store
+	// Traffic is nil when traffic mirroring is not enabled
+	Traffic *trafficmirror.Mirror
+	// Operations is nil when the store cannot list the operations in
+	// progress, as in mock mode
+	Operations db.OperationManager
+	// Cursors holds the cursors open on MongoDB
+	Cursors *db.CursorRegistry
+	// Views is nil when the store cannot manage views, as in mock mode
+	Views db.ViewManager
+}
+
+// Register adds the admin routes to adm, the /api/admin group
+func (h *Admin) Register(adm fiber.Router) {
+	adm.Get("/keys", h.ListKeys)
+	adm.Post("/keys", h.CreateKey)
+	adm.Get("/keys/:name", h.GetKey)
+	adm.Patch("/keys/:name", h.UpdateKey)
+	adm.Delete("/keys/:name", h.DeleteKey)
+	adm.Get("/roles", h.ListRoles)
+	adm.Get("/roles/:name", h.GetRole)
+	adm.Put("/roles/:name", h.PutRole)
+	adm.Delete("/roles/:name", h.DeleteRole)
+	adm.Get("/queries", h.ListQueries)
+	adm.Get("/queries/:name", h.GetQuery)
+	adm.Put("/queries/:name", h.PutQuery)
+	adm.Delete("/queries/:name", h.DeleteQuery)
+	adm.Get("/databases", h.ListDatabases)
+	adm.Get("/databases/:db/collections", h.ListCollections)
+	adm.Get("/databases/:db/views", h.ListViews)
+	adm.Post("/databases/:db/views", h.CreateView)
+	adm.Delete("/databases/:db/views/:name", h.DropView)
+	adm.Get("/retention", h.CheckRetention)
+	adm.Post("/retention/apply", h.ApplyRetention)
+	adm.Post("/warm", h.Warm)
+	adm.Get("/migrations", h.ListMigrations)
+	adm.Post("/migrations/up", h.MigrateUp)
+	adm.Post("/migrations/down", h.MigrateDown)
+	adm.Get("/maintenance", h.GetMaintenance)
+	adm.Put("/maintenance", h.SetMaintenance)
+	adm.Get("/dualwrite", h.GetDualWrite)
+	adm.Post("/dualwrite/retry", h.RetryDualWrite)
+	adm.Post("/dualwrite/reconcile", h.ReconcileDualWrite)
+	adm.Get("/shadowreads", h.GetShadowReads)
+	adm.Get("/trafficmirror", h.GetTrafficMirror)
+	adm.Get("/slowOps", h.SlowOps)
+	adm.Get("/currentOps", h.CurrentOps)
+	adm.Post("/killOp", h.KillOp)
+	adm.Get("/cursors", h.ListCursors)
+	adm.Delete("/cursors/:id", h.CloseCursor)
+}
+
+// reconcileRequest is the body accepted by POST /api/admin/dualwrite/reconcile
+type reconcileRequest struct {
+	Database   string `json:"database"`
+	Collection string `json:"collection"`
+}
+
+// keyUpdate is the body accepted by PATCH /api/admin/keys/:name
+type keyUpdate struct {
+	Tenant           *string   `json:"tenant"`
+	Roles            *[]string `json:"roles"`
+	Namespaces       *[]string `json:"namespaces"`
+	RateLimit        *int      `json:"rateLimit"`
+	NumbersAsStrings *bool     `json:"numbersAsStrings"`
+	// Envelope replaces the key's envelope; an empty one restores the
+	// default responses
+	Envelope *config.Envelope `json:"envelope"`
+	Priority *string          `json:"priority"`
+}
+
+// keyView is the representation of a key returned by the admin API; the
+// secret is only returned in full when a key is created
+type keyView struct {
+	config.APIKey
+	Static bool `json:"static"`
+}
+
+// maskKey hides the secret of a key. Plaintext keys show their last
+// characters and hashed keys their prefix; hashes are never returned.
+func maskKey(k config.APIKey) config.APIKey {
+	k.Key = auth.MaskKey(k)
+	k.KeyHash = ""
+	return k
+}
+
+// adminError maps store errors to HTTP status codes
+func adminError(c *fiber.Ctx, err error) error {
+	status := fiber.StatusBadRequest
+	switch {
+	case errors.Is(err, auth.ErrNotFound), errors.Is(err, query.ErrNotFound):
+		status = fiber.StatusNotFound
+	case errors.Is(err, auth.ErrReadOnly), errors.Is(err, auth.ErrConflict), errors.Is(err, query.ErrReadOnly):
+		status = fiber.StatusConflict
+	}
+	return c.Status(status).JSON(fiber.Map{"error": err.Error()})
+}
+
+// ListKeys lists all API keys with masked secrets
+func (a *Admin) ListKeys(c *fiber.Ctx) error {
+	keys := a.Keys.Keys()
+	views := make([]keyView, 0, len(keys))
+	for _, k := range keys {
+		_, static, _ := a.Keys.Key(k.Name)
+		views = append(views, keyView{APIKey: maskKey(k), Static: static})
+	}
+	return c.JSON(fiber.Map{"keys": views})
+}
+
+// GetKey returns a single API key with a masked secret
+func (a *Admin) GetKey(c *fiber.Ctx) error {
+	k, static, err := a.Keys.Key(c.Params("name"))
+	if err != nil {
+		return adminError(c, err)
+	}
+	return c.JSON(fiber.Map{"key": keyView{APIKey: maskKey(k), Static: static}})
+}
+
+// CreateKey creates an API key, generating the secret unless one is given
+func (a *Admin) CreateKey(c *fiber.Ctx) error {
+	var k config.APIKey
+	if err := c.BodyParser(&k); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if _, _, err := a.Keys.Key(k.Name); err == nil {
+		return adminError(c, fmt.Errorf("key %q %w", k.Name, auth.ErrConflict))
+	}
+
+	created, err := a.Keys.PutKey(context.Background(), k)
+	if err != nil {
+		return adminError(c, err)
+	}
+	created.KeyHash = ""
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"key": keyView{APIKey: created}})
+}
+
+// UpdateKey changes the tenant, roles, namespace allowlist, rate limit,
+// number rendering, response envelope or priority class of an API key
+func (a *Admin) UpdateKey(c *fiber.Ctx) error {
+	k, _, err := a.Keys.Key(c.Params("name"))
+	if err != nil {
+		return adminError(c, err)
+	}
+
+	var update keyUpdate
+	if err := c.BodyParser(&update); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if update.Tenant != nil {
+		k.Tenant = *update.Tenant
+	}
+	if update.Roles != nil {
+		k.Roles = *update.Roles
+	}
+	if update.Namespaces != nil {
+		k.Namespaces = *update.Namespaces
+	}
+	if update.RateLimit != nil {
+		k.RateLimit = *update.RateLimit
+	}
+	if update.NumbersAsStrings != nil {
+		k.NumbersAsStrings = *update.NumbersAsStrings
+	}
+	if update.Envelope != nil {
+		k.Envelope = update.Envelope
+	}
+	if update.Priority != nil {
+		k.Priority = *update.Priority
+	}
+
+	updated, err := a.Keys.PutKey(context.Background(), k)
+	if err != nil {
+		return adminError(c, err)
+	}
+	a.Limiter.Reset(updated.Name)
+	return c.JSON(fiber.Map{"key": keyView{APIKey: maskKey(updated)}})
+}
+
+// DeleteKey revokes an API key
+func (a *Admin) DeleteKey(c *fiber.Ctx) error {
+	name := c.Params("name")
+	if err := a.Keys.DeleteKey(context.Background(), name); err != nil {
+		return adminError(c, err)
+	}
+	a.Limiter.Reset(name)
+	return c.JSON(fiber.Map{"deleted": name})
+}
+
+// ListRoles lists all roles including the built-in ones
+func (a *Admin) ListRoles(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{"roles": a.Keys.Roles(), "operations": auth.Operations})
+}
+
+// GetRole returns a single role
+func (a *Admin) GetRole(c *fiber.Ctx) error {
+	r, static, err := a.Keys.Role(c.Params("name"))
+	if err != nil {
+		return adminError(c, err)
+	}
+	return c.JSON(fiber.Map{"role": r, "static": static})
+}
+
+// PutRole creates or replaces a role
+func (a *Admin) PutRole(c *fiber.Ctx) error {
+	var r config.Role
+	if err := c.BodyParser(&r); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	r.Name = c.Params("name")
+	if err := a.Keys.PutRole(context.Background(), r); err != nil {
+		return adminError(c, err)
+	}
+	return c.JSON(fiber.Map{"role": r})
+}
+
+// DeleteRole removes a role that is no longer assigned to any key
+func (a *Admin) DeleteRole(c *fiber.Ctx) error {
+	name := c.Params("name")
+	if err := a.Keys.DeleteRole(context.Background(), name); err != nil {
+		return adminError(c, err)
+	}
+	return c.JSON(fiber.Map{"deleted": name})
+}
+
+// ListQueries lists all saved queries including their templates
+func (a *Admin) ListQueries(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{"queries": a.Queries.List()})
+}
+
+// GetQuery returns a single saved query
+func (a *Admin) GetQuery(c *fiber.Ctx) error {
+	q, static, err := a.Queries.Get(c.Params("name"))
+	if err != nil {
+		return adminError(c, err)
+	}
+	return c.JSON(fiber.Map{"query": q, "static": static})
+}
+
+// PutQuery creates or replaces a saved query
+func (a *Admin) PutQuery(c *fiber.Ctx) error {
+	var q config.SavedQuery
+	if err := c.BodyParser(&q); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	q.Name = c.Params("name")
+	if err := a.Queries.Put(context.Background(), q); err != nil {
+		return adminError(c, err)
+	}
+	return c.JSON(fiber.Map{"query": q})
+}
+
+// DeleteQuery removes a saved query
+func (a *Admin) DeleteQuery(c *fiber.Ctx) error {
+	name := c.Params("name")
+	if err := a.Queries.Delete(context.Background(), name); err != nil {
+		return adminError(c, err)
+	}
+	return c.JSON(fiber.Map{"deleted": name})
+}
+
+// ListDatabases lists the databases on the server
+func (a *Admin) ListDatabases(c *fiber.Ctx) error {
+	names, err := a.Store.ListDatabases(context.Background())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"databases": names})
+}
+
+// ListCollections lists the collections in a database
+func (a *Admin) ListCollections(c *fiber.Ctx) error {
+	names, err := a.Store.ListCollections(context.Background(), c.Params("db"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"collections": names})
+}
+
+// ListViews lists the views of a database with their definitions
+func (a *Admin) ListViews(c *fiber.Ctx) error {
+	if a.Views == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Views cannot be managed by this store"})
+	}
+	views, err := a.Views.ListViews(context.Background(), c.Params("db"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	return writeResponse(c, fiber.Map{"views": views}, fiber.MIMEApplicationJSON)
+}
+
+// CreateView creates a read-only view of a collection. Its pipeline is
+// EJSON and may not write with $out or $merge.
+func (a *Admin) CreateView(c *fiber.Ctx) error {
+	if a.Views == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Views cannot be managed by this store"})
+	}
+	var view db.View
+	if err := parseBody(c, &view, false); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if view.Name == "" || view.ViewOn == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "name and viewOn are required"})
+	}
+	if output, err := auth.OutputNamespace(view.Pipeline, c.Params("db")); err != nil || output != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "the pipeline of a view cannot write with $out or $merge"})
+	}
+	if err := a.Views.CreateView(context.Background(), c.Params("db"), view); err != nil {
+		status := fiber.StatusInternalServerError
+		if errors.Is(err, db.ErrNamespaceExists) {
+			status = fiber.StatusConflict
+		}
+		return c.Status(status).JSON(fiber.Map{"error": err.Error()})
+	}
+	c.Status(fiber.StatusCreated)
+	return writeResponse(c, view, fiber.MIMEApplicationJSON)
+}
+
+// DropView drops a view. Collections that are not views are left alone.
+func (a *Admin) DropView(c *fiber.Ctx) error {
+	if a.Views == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Views cannot be managed by this store"})
+	}
+	if err := a.Views.DropView(context.Background(), c.Params("db"), c.Params("name")); err != nil {
+		if errors.Is(err, db.ErrNamespaceNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": fmt.Sprintf("No view %s in %s", c.Params("name"), c.Params("db"))})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// CheckRetention reports how the TTL indexes compare to the retention
+// policies
+func (a *Admin) CheckRetention(c *fiber.Ctx) error {
+	if a.Retention == nil {
+		return c.JSON(fiber.Map{"policies": []retention.Status{}})
+	}
+	return c.JSON(fiber.Map{"policies": a.Retention.Check(context.Background())})
+}
+
+// ApplyRetention creates and updates TTL indexes to match the retention
+// policies
+func (a *Admin) ApplyRetention(c *fiber.Ctx) error {
+	if a.Retention == nil {
+		return c.JSON(fiber.Map{"policies": []retention.Status{}})
+	}
+	return c.JSON(fiber.Map{"policies": a.Retention.Apply(context.Background())})
+}
+
+// Warm runs the warm queries, e.g. after a failover, and reports how long
+// each took
+func (a *Admin) Warm(c *fiber.Ctx) error {
+	if a.Warmer == nil {
+		return c.JSON(fiber.Map{"queries": []warmup.Result{}})
+	}
+	return c.JSON(fiber.Map{"queries": a.Warmer.Run(context.Background())})
+}
+
+// migrationRequest is the body accepted by the migration endpoints. Target
+// is the version to migrate up to or down to; it defaults to the latest
+// version for up and to reverting only the latest migration for down.
+type migrationRequest struct {
+	Target *int64 `json:"target"`
+	DryRun bool   `json:"dryRun"`
+}
+
+// ListMigrations lists the migrations and whether they are applied
+func (a *Admin) ListMigrations(c *fiber.Ctx) error {
+	if a.Migrations == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Migrations are not enabled"})
+	}
+	states, err := a.Migrations.Status(context.Background())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"migrations": states})
+}
+
+// MigrateUp applies pending migrations
+func (a *Admin) MigrateUp(c *fiber.Ctx) error {
+	return a.migrate(c, a.Migrations.Up, 0)
+}
+
+// MigrateDown reverts applied migrations
+func (a *Admin) MigrateDown(c *fiber.Ctx) error {
+	return a.migrate(c, a.Migrations.Down, -1)
+}
+
+func (a *Admin) migrate(c *fiber.Ctx, run func(context.Context, int64, bool) ([]migrations.Result, error), target int64) error {
+	if a.Migrations == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Migrations are not enabled"})
+	}
+	var req migrationRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+	if req.Target != nil {
+		target = *req.Target
+	}
+	results, err := run(context.Background(), target, req.DryRun)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error(), "results": results})
+	}
+	return c.JSON(fiber.Map{"results": results})
+}
+
+// GetMaintenance returns the maintenance mode
+func (a *Admin) GetMaintenance(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{"maintenance": a.Maintenance.State()})
+}
+
+// SetMaintenance enables or disables maintenance mode, which answers the
+// frozen operations with 503 until it is disabled
+func (a *Admin) SetMaintenance(c *fiber.Ctx) error {
+	var state auth.MaintenanceState
+	if err := c.BodyParser(&state); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	state, err := a.Maintenance.Set(context.Background(), state)
+	if err != nil {
+		return adminError(c, err)
+	}
+	log.Printf("Maintenance mode enabled=%t reads=%t", state.Enabled, state.Reads)
+	return c.JSON(fiber.Map{"maintenance": state})
+}
+
+// GetDualWrite returns the progress of the writes mirrored to the migration
+// target: the queue, failed writes and reconciliations
+func (a *Admin) GetDualWrite(c *fiber.Ctx) error {
+	if a.Mirror == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Dual writes are not enabled"})
+	}
+	return c.JSON(fiber.Map{"dualWrite": a.Mirror.Status()})
+}
+
+// RetryDualWrite queues the writes that failed to be mirrored again
+func (a *Admin) RetryDualWrite(c *fiber.Ctx) error {
+	if a.Mirror == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Dual writes are not enabled"})
+	}
+	queued := a.Mirror.Retry()
+	log.Printf("Retrying %d mirrored writes", queued)
+	return c.JSON(fiber.Map{"queued": queued})
+}
+
+// ReconcileDualWrite starts comparing a collection on both clusters; the
+// result is reported by GetDualWrite
+func (a *Admin) ReconcileDualWrite(c *fiber.Ctx) error {
+	if a.Mirror == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Dual writes are not enabled"})
+	}
+	var req reconcileRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if req.Database == "" || req.Collection == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "database and collection are required"})
+	}
+	r, err := a.Mirror.Reconcile(req.Database, req.Collection)
+	if errors.Is(err, mirror.ErrReconciling) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"reconciliation": r})
+}
+
+// GetShadowReads returns the counts of reads compared with the shadow
+// cluster and the latest mismatches
+func (a *Admin) GetShadowReads(c *fiber.Ctx) error {
+	if a.Shadow == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Shadow reads are not enabled"})
+	}
+	return c.JSON(fiber.Map{"shadowReads": a.Shadow.Status()})
+}
+
+// GetTrafficMirror returns the counts of requests replayed to the traffic
+// mirror
+func (a *Admin) GetTrafficMirror(c *fiber.Ctx) error {
+	if a.Traffic == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Traffic mirroring is not enabled"})
+	}
+	return c.JSON(fiber.Map{"trafficMirror": a.Traffic.Status()})
+}
+
+const (
+	defaultSlowOpsMillis = 100
+	defaultSlowOpsLimit  = 100
+	maxSlowOpsLimit      = 1000
+)
+
+// slowOpsParams are the query parameters of GET /api/admin/slowOps
+type slowOpsParams struct {
+	Database  string `query:"database"`
+	Client    string `query:"client"`
+	RequestID string `query:"requestId"`
+	MinMillis int64  `query:"minMs"`
+	Limit     int64  `query:"limit"`
+}
+
+// slowOp is a profiled operation of the proxy, with the client and request
+// its comment was tagged with
+type slowOp struct {
+	Time         interface{} `json:"ts"`
+	Op           interface{} `json:"op"`
+	Namespace    interface{} `json:"ns"`
+	Millis       int64       `json:"millis"`
+	Client       string      `json:"client,omitempty"`
+	RequestID    string      `json:"requestId,omitempty"`
+	PlanSummary  interface{} `json:"planSummary,omitempty"`
+	KeysExamined interface{} `json:"keysExamined,omitempty"`
+	DocsExamined interface{} `json:"docsExamined,omitempty"`
+	Returned     interface{} `json:"nreturned,omitempty"`
+}
+
+// clientSlowOps sums up the slow operations of a client
+type clientSlowOps struct {
+	Count       int   `json:"count"`
+	TotalMillis int64 `json:"totalMillis"`
+	MaxMillis   int64 `json:"maxMillis"`
+}
+
+// SlowOps lists the slow operations the profiler recorded in a database for
+// requests through the proxy, newest first, with the API key and request
+// ID each was made for and a summary per API key. The profiler must be
+// enabled on the database, e.g. with db.setProfilingLevel(1).
+func (a *Admin) SlowOps(c *fiber.Ctx) error {
+	var params slowOpsParams
+	if err := c.QueryParser(&params); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if params.Database == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "database is required"})
+	}
+	if params.MinMillis < 0 || params.Limit < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "minMs and limit must not be negative"})
+	}
+	if params.MinMillis == 0 {
+		params.MinMillis = defaultSlowOpsMillis
+	}
+	if params.Limit == 0 {
+		params.Limit = defaultSlowOpsLimit
+	}
+	params.Limit = min(params.Limit, maxSlowOpsLimit)
+
+	filter := bson.D{
+		{Key: "millis", Value: bson.D{{Key: "$gte", Value: params.MinMillis}}},
+		taggedFilter([]string{"command.comment", "originatingCommand.comment"}, params.Client, params.RequestID),
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "ts", Value: -1}}).SetLimit(params.Limit)
+	profiled, err := a.Store.Find(context.Background(), params.Database, "system.profile", filter, opts)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	ops := make([]slowOp, 0, len(profiled))
+	clients := make(map[string]*clientSlowOps)
+	for _, p := range profiled {
+		op := slowOp{
+			Time:         p["ts"],
+			Op:           p["op"],
+			Namespace:    p["ns"],
+			Millis:       int64Value(p["millis"]),
+			PlanSummary:  p["planSummary"],
+			KeysExamined: p["keysExamined"],
+			DocsExamined: p["docsExamined"],
+			Returned:     p["nreturned"],
+		}
+		op.Client, op.RequestID = db.ParseComment(commentOf(p, "command", "originatingCommand"))
+		ops = append(ops, op)
+
+		summary := clients[op.Client]
+		if summary == nil {
+			summary = &clientSlowOps{}
+			clients[op.Client] = summary
+		}
+		summary.Count++
+		summary.TotalMillis += op.Millis
+		summary.MaxMillis = max(summary.MaxMillis, op.Millis)
+	}
+	return c.JSON(fiber.Map{"operations": ops, "clients": clients})
+}
+
+// currentOpsParams are the query parameters of GET /api/admin/currentOps
+type currentOpsParams struct {
+	Client    string `query:"client"`
+	RequestID string `query:"requestId"`
+}
+
+// currentOp is an operation of the proxy in progress
+type currentOp struct {
+	OpID        interface{} `json:"opid"`
+	Op          interface{} `json:"op"`
+	Namespace   interface{} `json:"ns"`
+	Host        interface{} `json:"host,omitempty"`
+	SecsRunning int64       `json:"secsRunning"`
+	Client      string      `json:"client,omitempty"`
+	RequestID   string      `json:"requestId,omitempty"`
+	PlanSummary interface{} `json:"planSummary,omitempty"`
+}
+
+// killOpRequest is the body accepted by POST /api/admin/killOp
+type killOpRequest struct {
+	OpID interface{} `json:"opid"`
+}
+
+// currentOpFields are the paths of the comment of an operation in progress
+var currentOpFields = []string{"command.comment", "cursor.originatingCommand.comment"}
+
+// CurrentOps lists the operations in progress that requests through the
+// proxy started, longest running first, with the API key and request ID
+// each was made for
+func (a *Admin) CurrentOps(c *fiber.Ctx) error {
+	if a.Operations == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Operations cannot be listed by this store"})
+	}
+	var params currentOpsParams
+	if err := c.QueryParser(&params); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	inProgress, err := a.Operations.CurrentOps(context.Background(), bson.D{taggedFilter(currentOpFields, params.Client, params.RequestID)})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	ops := make([]currentOp, 0, len(inProgress))
+	for _, p := range inProgress {
+		op := currentOp{
+			OpID:        p["opid"],
+			Op:          p["op"],
+			Namespace:   p["ns"],
+			Host:        p["host"],
+			SecsRunning: int64Value(p["secs_running"]),
+			PlanSummary: p["planSummary"],
+		}
+		op.Client, op.RequestID = db.ParseComment(commentOf(p, "command", "cursor.originatingCommand"))
+		ops = append(ops, op)
+	}
+	sort.SliceStable(ops, func(i, j int) bool { return ops[i].SecsRunning > ops[j].SecsRunning })
+	return c.JSON(fiber.Map{"operations": ops})
+}
+
+// KillOp kills an operation in progress by its opid. Only operations that
+// requests through the proxy started can be killed.
+func (a *Admin) KillOp(c *fiber.Ctx) error {
+	if a.Operations == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Operations cannot be killed by this store"})
+	}
+	var req killOpRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	// opids are numbers on replica sets and "shard:number" strings
+	// through mongos
+	switch id := req.OpID.(type) {
+	case float64:
+		if id != math.Trunc(id) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "opid must be an integer or a string"})
+		}
+		req.OpID = int64(id)
+	case string:
+		if id == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "opid is required"})
+		}
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "opid is required"})
+	}
+
+	ctx := context.Background()
+	ops, err := a.Operations.CurrentOps(ctx, bson.D{{Key: "opid", Value: req.OpID}, taggedFilter(currentOpFields, "", "")})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	if len(ops) == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": fmt.Sprintf("No operation %v of the proxy is in progress", req.OpID)})
+	}
+	if err := a.Operations.KillOp(ctx, req.OpID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	client, requestID := db.ParseComment(commentOf(ops[0], "command", "cursor.originatingCommand"))
+	log.Printf("Killed operation %v of client %s, request %s", req.OpID, client, requestID)
+	return c.JSON(fiber.Map{"killed": req.OpID})
+}
+
+// ListCursors lists the cursors open on MongoDB, oldest first, with the API
+// key and request each was opened for
+func (a *Admin) ListCursors(c *fiber.Ctx) error {
+	cursors := []db.CursorInfo{}
+	if a.Cursors != nil {
+		cursors = a.Cursors.List()
+	}
+	return c.JSON(fiber.Map{"cursors": cursors})
+}
+
+// CloseCursor closes an open cursor, failing the request reading it
+func (a *Admin) CloseCursor(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid cursor id"})
+	}
+	if a.Cursors == nil || !a.Cursors.Close(id) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": fmt.Sprintf("No cursor %d is open", id)})
+	}
+	return c.JSON(fiber.Map{"closed": id})
+}
+
+// taggedFilter matches the operations of the proxy by the tags of their
+// comment, which getMores carry in the command that opened the cursor, so
+// fields are the paths the comment may be found at. client and requestID,
+// if set, narrow the match down to theirs.
+func taggedFilter(fields []string, client, requestID string) bson.E {
+	patterns := []string{"(^| )(client|requestId)="}
+	if client != "" {
+		patterns = append(patterns, "(^| )client="+regexp.QuoteMeta(client)+"( |$)")
+	}
+	if requestID != "" {
+		patterns = append(patterns, "(^| )requestId="+regexp.QuoteMeta(requestID)+"( |$)")
+	}
+	tagged := make(bson.A, len(patterns))
+	for i, pattern := range patterns {
+		var clauses bson.A
+		for _, field := range fields {
+			clauses = append(clauses, bson.D{{Key: field, Value: primitive.Regex{Pattern: pattern}}})
+		}
+		tagged[i] = bson.D{{Key: "$or", Value: clauses}}
+	}
+	return bson.E{Key: "$and", Value: tagged}
+}
+
+// commentOf returns the string comment of the first of commands, given by
+// their dotted paths, that has one
+func commentOf(op bson.M, commands ...string) string {
+	for _, command := range commands {
+		cmd := op
+		for _, key := range strings.Split(command, ".") {
+			cmd, _ = cmd[key].(bson.M)
+		}
+		if comment, ok := cmd["comment"].(string); ok && comment != "" {
+			return comment
+		}
+	}
+	return ""
+}
+
+// int64Value converts the numbers of profiler documents, which may be
+// stored as any numeric type
+func int64Value(v interface{}) int64 {
+	switch n := v.(type) {
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	case float64:
+		return int64(n)
+	}
+	return 0
+}
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"mongo-data-api-go-alternative/formats"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// benchBody is an insertMany body of 100 documents with EJSON values
+func benchBody() []byte {
+	docs := make([]string, 100)
+	for i := range docs {
+		docs[i] = fmt.Sprintf(`{"_id":{"$oid":"65a1b2c3d4e5f60718293a%02x"},"name":"user %d","age":%d,"created":{"$date":"2024-01-02T03:04:05Z"},"tags":["a","b"],"address":{"city":"Paris","zip":"75001"}}`, i, i, i)
+	}
+	return []byte(`{"database":"app","collection":"users","documents":[` + strings.Join(docs, ",") + `]}`)
+}
+
+// benchResult is a find result of 100 documents
+func benchResult() map[string]interface{} {
+	docs := make([]bson.M, 100)
+	for i := range docs {
+		docs[i] = bson.M{
+			"_id":     primitive.NewObjectID(),
+			"name":    fmt.Sprintf("user %d", i),
+			"age":     int32(i),
+			"created": primitive.NewDateTimeFromTime(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)),
+			"tags":    bson.A{"a", "b"},
+			"address": bson.M{"city": "Paris", "zip": "75001"},
+		}
+	}
+	return map[string]interface{}{"documents": docs}
+}
+
+// legacyDocument is the request body as it was parsed before it was decoded
+// from EJSON directly: plain JSON maps that were remarshaled field by field
+type legacyDocument struct {
+	Database   string                   `json:"database"`
+	Collection string                   `json:"collection"`
+	Documents  []map[string]interface{} `json:"documents"`
+}
+
+func legacyDeserialize(input interface{}) (interface{}, error) {
+	data, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	err = bson.UnmarshalExtJSON(data, false, &v)
+	return v, err
+}
+
+func BenchmarkDecodeBody(b *testing.B) {
+	body := benchBody()
+	b.Run("remarshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var doc legacyDocument
+			if err := json.Unmarshal(body, &doc); err != nil {
+				b.Fatal(err)
+			}
+			for _, d := range doc.Documents {
+				if _, err := legacyDeserialize(d); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("single", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var doc Document
+			if err := bson.UnmarshalExtJSON(body, false, &doc); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkEncodeResult(b *testing.B) {
+	result := benchResult()
+	b.Run("remarshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			data, err := bson.MarshalExtJSON(result, false, false)
+			if err != nil {
+				b.Fatal(err)
+			}
+			var v interface{}
+			if err := json.Unmarshal(data, &v); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := json.Marshal(v); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("direct", func(b *testing.B) {
+		b.ReportAllocs()
+		var buf bytes.Buffer
+		for i := 0; i < b.N; i++ {
+			buf.Reset()
+			if err := formats.WriteEJSON(&buf, result, false); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkRespond tracks the allocations of writing a find result into the
+// response body
+func BenchmarkRespond(b *testing.B) {
+	app := fiber.New()
+	c := app.AcquireCtx(&fasthttp.RequestCtx{})
+	defer app.ReleaseCtx(c)
+	result := benchResult()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Response().Reset()
+		if err := respond(c, nil, result); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkExportWrite tracks the allocations of writing export lines
+func BenchmarkExportWrite(b *testing.B) {
+	docs := benchResult()["documents"].([]bson.M)
+	e := &exportChunks{}
+	for _, canonical := range []bool{false, true} {
+		b.Run(fmt.Sprintf("canonical=%t", canonical), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := e.write(ejsonLines(io.Discard, canonical), func(int64) error { return nil }, docs, int64(len(docs)+1)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkWriteDocuments compares encoding a large find result on the
+// request goroutine with encoding it on a worker pool
+func BenchmarkWriteDocuments(b *testing.B) {
+	docs := make([]bson.Raw, 0, 20*decodeChunk)
+	for _, d := range benchResult()["documents"].([]bson.M) {
+		raw, err := bson.Marshal(d)
+		if err != nil {
+			b.Fatal(err)
+		}
+		docs = append(docs, raw)
+	}
+	for len(docs) < cap(docs) {
+		docs = append(docs, docs[len(docs)%100])
+	}
+	each := func(_ context.Context, fn func(bson.Raw) error) error {
+		for _, d := range docs {
+			if err := fn(d); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := writeDocuments(context.Background(), io.Discard, workers, nil, each); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"mongo-data-api-go-alternative/auth"
+	"mongo-data-api-go-alternative/config"
+	"mongo-data-api-go-alternative/db"
+	"mongo-data-api-go-alternative/importer"
+	"mongo-data-api-go-alternative/jobs"
+	"mongo-data-api-go-alternative/tenant"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// cloneStages are the pipeline stages allowed in a clone. The pipeline is
+// run on each chunk separately, so only stages that transform documents one
+// at a time give the same result as on the whole collection.
+var cloneStages = map[string]bool{
+	"$match": true, "$project": true, "$addFields": true, "$set": true,
+	"$unset": true, "$replaceRoot": true, "$replaceWith": true,
+}
+
+// Clone serves /api/cloneCollection, which copies documents between
+// namespaces, possibly on different clusters, in a background job
+type Clone struct {
+	// Clusters maps cluster names to their stores; the default cluster is
+	// registered as config.DefaultCluster
+	Clusters map[string]db.DataStore
+	Jobs     *jobs.Manager
+	// StrictBodies rejects request bodies with unknown top-level fields
+	StrictBodies bool
+	// RestrictUpserts requires the upsert operation on the target of
+	// clones that upsert
+	RestrictUpserts bool
+	// UUIDFields maps "database.collection" to the fields stored as UUIDs
+	// in target collections
+	UUIDFields map[string][]string
+}
+
+// cloneNamespace is the source or target of a clone
+type cloneNamespace struct {
+	Cluster    string `bson:"cluster"`
+	Database   string `bson:"database"`
+	Collection string `bson:"collection"`
+}
+
+// cloneRequest is the body accepted by /api/cloneCollection
+type cloneRequest struct {
+	Source    cloneNamespace `bson:"source"`
+	Target    cloneNamespace `bson:"target"`
+	Filter    bson.D         `bson:"filter"`
+	Pipeline  bson.A         `bson:"pipeline"`
+	BatchSize int64          `bson:"batchSize"`
+	// Upsert replaces target documents with the same _id instead of failing
+	Upsert bool `bson:"upsert"`
+}
+
+// cloneProgress is the progress of a clone job
+type cloneProgress struct {
+	// Total is the number of source documents matching the filter when the
+	// clone started
+	Total int64 `json:"total"`
+	importer.Progress
+}
+
+// store resolves the cluster of a namespace and authorizes the clone on it
+func (cl *Clone) store(c *fiber.Ctx, ns cloneNamespace) (db.DataStore, string, error) {
+	if ns.Database == "" || ns.Collection == "" {
+		return nil, "", errors.New("source and target need a database and a collection")
+	}
+	store, ok := cl.Clusters[ns.Cluster]
+	if !ok {
+		return nil, "", fmt.Errorf("unknown cluster %q", ns.Cluster)
+	}
+	if err := auth.Authorize(c, "clone", ns.Database, ns.Collection); err != nil {
+		return nil, "", err
+	}
+	return store, tenant.FromCtx(c).Database(ns.Database), nil
+}
+
+// Start validates a clone request and starts the copy as a job
+func (cl *Clone) Start(c *fiber.Ctx) error {
+	var req cloneRequest
+	if err := parseBody(c, &req, cl.StrictBodies); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if req.BatchSize == 0 {
+		req.BatchSize = importer.DefaultBatchSize
+	}
+	if req.BatchSize < 0 || req.BatchSize > maxImportBatch {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "batchSize must be between 1 and 10000"})
+	}
+	for _, ns := range []*cloneNamespace{&req.Source, &req.Target} {
+		if ns.Cluster == "" {
+			ns.Cluster = config.DefaultCluster
+		}
+	}
+	if req.Source == req.Target {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "source and target must differ"})
+	}
+
+	source, sourceDB, err := cl.store(c, req.Source)
+	if err != nil {
+		return cloneError(c, err)
+	}
+	target, targetDB, err := cl.store(c, req.Target)
+	if err != nil {
+		return cloneError(c, err)
+	}
+	if cl.RestrictUpserts && req.Upsert {
+		if err := auth.Authorize(c, "upsert", req.Target.Database, req.Target.Collection); err != nil {
+			return cloneError(c, err)
+		}
+	}
+
+	for _, st := range req.Pipeline {
+		if stage, ok := st.(bson.D); !ok || len(stage) != 1 || !cloneStages[stage[0].Key] {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "pipeline may only contain $match, $project, $addFields, $set, $unset, $replaceRoot and $replaceWith stages"})
+		}
+	}
+
+	scope := tenant.FromCtx(c)
+	copier := &cloneCopier{
+		source:     source,
+		database:   sourceDB,
+		collection: req.Source.Collection,
+		filter:     scope.Filter(req.Filter),
+		pipeline:   req.Pipeline,
+		batchSize:  req.BatchSize,
+		writer: &importer.Writer{
+			Store:      target,
+			Database:   targetDB,
+			Collection: req.Target.Collection,
+			Scope:      scope,
+			Convert:    convertUUIDs(cl.UUIDFields[req.Target.Database+"."+req.Target.Collection]),
+		},
+	}
+	if req.Upsert {
+		copier.writer.UpsertKeys = []string{"_id"}
+	}
+
+	return startJob(c, cl.Jobs, "cloneCollection", copier.run)
+}
+
+// cloneError answers a clone request rejected before its job started
+func cloneError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, auth.ErrForbidden) || errors.Is(err, auth.ErrMaintenance) {
+		return denied(c, err)
+	}
+	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+}
+
+// cloneCopier copies documents in chunks by _id range
+type cloneCopier struct {
+	source     db.DataStore
+	database   string
+	collection string
+	filter     interface{}
+	pipeline   bson.A
+	batchSize  int64
+	writer     *importer.Writer
+}
+
+func (cp *cloneCopier) run(ctx context.Context, _ string, report func(interface{})) (interface{}, error) {
+	var progress cloneProgress
+	total, err := cp.source.CountDocuments(ctx, cp.database, cp.collection, cp.filter)
+	if err != nil {
+		return nil, err
+	}
+	progress.Total = total
+	report(progress)
+
+	var after interface{}
+	resumed := false
+	for {
+		filter := cp.filter
+		if resumed {
+			filter = bson.D{{Key: "$and", Value: bson.A{filter, bson.D{{Key: "_id", Value: bson.D{{Key: "$gt", Value: after}}}}}}}
+		}
+		opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(cp.batchSize)
+		if cp.pipeline != nil {
+			// Only the _id range of the chunk is read here; the pipeline then
+			// transforms exactly that range
+			opts.SetProjection(bson.D{{Key: "_id", Value: 1}})
+		}
+		chunk, err := cp.source.Find(ctx, cp.database, cp.collection, filter, opts)
+		if err != nil {
+			return progress, err
+		}
+		if len(chunk) == 0 {
+			return progress, nil
+		}
+		last := chunk[len(chunk)-1]["_id"]
+
+		docs := make([]interface{}, len(chunk))
+		for i, d := range chunk {
+			docs[i] = ordered(d)
+		}
+		if cp.pipeline != nil {
+			rangeFilter := bson.D{{Key: "$and", Value: bson.A{filter, bson.D{{Key: "_id", Value: bson.D{{Key: "$lte", Value: last}}}}}}}
+			stages := append(bson.A{
+				bson.D{{Key: "$match", Value: rangeFilter}},
+				bson.D{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+			}, cp.pipeline...)
+			transformed, err := cp.source.Aggregate(ctx, cp.database, cp.collection, stages, nil)
+			if err != nil {
+				return progress, err
+			}
+			docs = make([]interface{}, len(transformed))
+			for i, d := range transformed {
+				docs[i] = ordered(d)
+			}
+		}
+
+		// Errors refer to documents by their position in the copy
+		batch := importer.Batch{Documents: docs, Lines: make([]int, len(docs))}
+		for i := range docs {
+			batch.Lines[i] = int(progress.Processed) + i + 1
+		}
+		if err := cp.writer.Write(ctx, batch, &progress.Progress); err != nil {
+			return progress, err
+		}
+		report(progress)
+
+		if int64(len(chunk)) < cp.batchSize {
+			return progress, nil
+		}
+		after, resumed = last, true
+	}
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// computedFields returns the $addFields specification of the computed
+// fields of the collection of a request, nil if it has none. Expressions
+// are configured as relaxed EJSON, so that they can hold typed values such
+// as dates.
+func (h *Data) computedFields(doc *Document) (bson.D, error) {
+	fields := h.ComputedFields[doc.Database+"."+doc.Collection]
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	// Maps are marshaled with sorted keys, so the fields are added in the
+	// same order to every document
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	var spec bson.D
+	if err := bson.UnmarshalExtJSON(data, false, &spec); err != nil {
+		return nil, fmt.Errorf("computed fields of %s.%s: %w", doc.Database, doc.Collection, err)
+	}
+	return spec, nil
+}
+
+// findPipeline translates a find into an aggregation adding computed
+// fields to the documents it returns. They are computed after sorting and
+// paging, so filters and sorts apply to stored fields only, and before the
+// projection, which can include or exclude them like any other field.
+func findPipeline(filter interface{}, opts *options.FindOptions, fields bson.D) (bson.A, *options.AggregateOptions) {
+	if filter == nil {
+		filter = bson.D{}
+	}
+	pipeline := bson.A{bson.D{{Key: "$match", Value: filter}}}
+	if opts.Sort != nil {
+		pipeline = append(pipeline, bson.D{{Key: "$sort", Value: opts.Sort}})
+	}
+	if opts.Skip != nil && *opts.Skip > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$skip", Value: *opts.Skip}})
+	}
+	if opts.Limit != nil && *opts.Limit != 0 {
+		// A negative limit asks a find for a single batch of that size
+		limit := *opts.Limit
+		if limit < 0 {
+			limit = -limit
+		}
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: limit}})
+	}
+	pipeline = append(pipeline, bson.D{{Key: "$addFields", Value: fields}})
+	if opts.Projection != nil {
+		pipeline = append(pipeline, bson.D{{Key: "$project", Value: opts.Projection}})
+	}
+	aggregateOptions := options.Aggregate()
+	if opts.BatchSize != nil {
+		aggregateOptions.SetBatchSize(*opts.BatchSize)
+	}
+	return pipeline, aggregateOptions
+}
+
+// withComputedFields starts an aggregation pipeline by adding computed
+// fields, so that its stages can use them like stored fields
+func withComputedFields(pipeline interface{}, fields bson.D) interface{} {
+	stages, ok := pipeline.(bson.A)
+	if len(fields) == 0 || !ok {
+		return pipeline
+	}
+	return append(bson.A{bson.D{{Key: "$addFields", Value: fields}}}, stages...)
+}
@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"mongo-data-api-go-alternative/auth"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// What insertOne does when a document with the same natural key exists
+const (
+	conflictError   = "error"
+	conflictIgnore  = "ignore"
+	conflictReplace = "replace"
+	conflictMerge   = "merge"
+)
+
+// naturalKey returns the natural key fields of the collection of a request
+func (h *Data) naturalKey(doc *Document) []string {
+	return h.NaturalKeys[doc.Database+"."+doc.Collection]
+}
+
+// checkConflict validates the onConflict of an insertOne and authorizes
+// the operations it implies: returning the existing document reads it, and
+// replace and merge update it
+func (h *Data) checkConflict(c *fiber.Ctx, doc *Document) error {
+	switch doc.OnConflict {
+	case "", conflictError:
+		return nil
+	case conflictIgnore, conflictReplace, conflictMerge:
+	default:
+		return fmt.Errorf("onConflict must be error, ignore, replace or merge")
+	}
+	if len(h.naturalKey(doc)) == 0 {
+		return fmt.Errorf("onConflict %s needs a natural key configured for %s.%s", doc.OnConflict, doc.Database, doc.Collection)
+	}
+	ops := []string{"findOne"}
+	if doc.OnConflict != conflictIgnore {
+		ops = append(ops, "updateOne")
+	}
+	for _, op := range ops {
+		if err := auth.Authorize(c, op, doc.Database, doc.Collection); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// naturalKeyFilter matches the documents with the natural key values of
+// document; every key field must be set
+func naturalKeyFilter(key []string, document bson.D) (bson.D, error) {
+	filter := make(bson.D, 0, len(key))
+	for _, field := range key {
+		v, ok := lookupField(document, strings.Split(field, "."))
+		if !ok {
+			return nil, fmt.Errorf("document is missing natural key field %s", field)
+		}
+		filter = append(filter, bson.E{Key: field, Value: v})
+	}
+	return filter, nil
+}
+
+// lookupField returns the value at a dotted path of an embedded document
+func lookupField(d bson.D, path []string) (interface{}, bool) {
+	for _, e := range d {
+		if e.Key != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			return e.Value, true
+		}
+		sub, ok := e.Value.(bson.D)
+		if !ok {
+			return nil, false
+		}
+		return lookupField(sub, path[1:])
+	}
+	return nil, false
+}
+
+// insertByNaturalKey inserts document unless one with the same natural key
+// exists, in a single upsert. It returns the _id of the inserted document,
+// or the existing document after applying onConflict to it.
+func (h *Data) insertByNaturalKey(ctx context.Context, database string, doc *Document, filter interface{}, document bson.D) (interface{}, bson.M, error) {
+	res, err := h.Store.UpdateOne(ctx, database, doc.Collection, filter, bson.D{{Key: "$setOnInsert", Value: document}}, options.Update().SetUpsert(true))
+	if err != nil {
+		return nil, nil, err
+	}
+	if res.UpsertedID != nil {
+		return res.UpsertedID, nil, nil
+	}
+
+	existing, err := h.Store.FindOne(ctx, database, doc.Collection, filter, nil)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			// Deleted since the upsert matched it
+			return nil, nil, fmt.Errorf("conflicting document was deleted concurrently, retry the insert")
+		}
+		return nil, nil, err
+	}
+	var update bson.D
+	switch doc.OnConflict {
+	case conflictReplace:
+		if update = replacement(existing, document); len(update) == 0 {
+			update = nil
+		}
+	case conflictMerge:
+		if fields := fieldsWithoutID(document); len(fields) > 0 {
+			update = bson.D{{Key: "$set", Value: fields}}
+		}
+	}
+	if update == nil {
+		return nil, existing, nil
+	}
+	byID := bson.D{{Key: "_id", Value: existing["_id"]}}
+	if _, err := h.Store.UpdateOne(ctx, database, doc.Collection, byID, update, nil); err != nil {
+		return nil, nil, err
+	}
+	existing, err = h.Store.FindOne(ctx, database, doc.Collection, byID, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nil, existing, nil
+}
+
+// replacement is the update replacing the fields of existing with those of
+// document, keeping its _id
+func replacement(existing bson.M, document bson.D) bson.D {
+	fields := fieldsWithoutID(document)
+	set := make(map[string]bool, len(fields))
+	for _, e := range fields {
+		set[e.Key] = true
+	}
+	unset := bson.D{}
+	for key := range existing {
+		if key != "_id" && !set[key] {
+			unset = append(unset, bson.E{Key: key, Value: ""})
+		}
+	}
+	update := bson.D{}
+	if len(fields) > 0 {
+		update = append(update, bson.E{Key: "$set", Value: fields})
+	}
+	if len(unset) > 0 {
+		update = append(update, bson.E{Key: "$unset", Value: unset})
+	}
+	return update
+}
+
+// fieldsWithoutID returns the fields of document other than _id
+func fieldsWithoutID(document bson.D) bson.D {
+	fields := make(bson.D, 0, len(document))
+	for _, e := range document {
+		if e.Key != "_id" {
+			fields = append(fields, e)
+		}
+	}
+	return fields
+}
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"runtime"
+	"strconv"
+	"sync"
+
+	"mongo-data-api-go-alternative/formats"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// decodeChunk is the number of documents a worker decodes and encodes at a
+// time
+const decodeChunk = 256
+
+// chunkBuffers holds the buffers chunks are encoded into
+var chunkBuffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// encodedChunk is a run of consecutive cursor documents. done is closed
+// once a worker has encoded them into buf. render, if set, rewrites each
+// document before it is encoded.
+type encodedChunk struct {
+	docs   []bson.Raw
+	render func(bson.M)
+	buf    *bytes.Buffer
+	err    error
+	done   chan struct{}
+}
+
+// encode decodes the chunk's documents and writes them to its buffer as
+// comma-separated relaxed EJSON, rendered like the documents of Find
+func (ch *encodedChunk) encode() {
+	defer close(ch.done)
+	ch.buf = chunkBuffers.Get().(*bytes.Buffer)
+	for i, raw := range ch.docs {
+		var doc bson.M
+		if ch.err = bson.Unmarshal(raw, &doc); ch.err != nil {
+			return
+		}
+		if ch.render != nil {
+			ch.render(doc)
+		}
+		if i > 0 {
+			ch.buf.WriteByte(',')
+		}
+		if ch.err = formats.WriteEJSON(ch.buf, doc, false); ch.err != nil {
+			return
+		}
+		// Drop the newline ending each document
+		ch.buf.Truncate(ch.buf.Len() - 1)
+	}
+}
+
+// writeDocuments writes the documents produced by each to w as the elements
+// of a JSON array, without the brackets. Documents are decoded and encoded
+// by up to workers goroutines while each is still reading from the cursor;
+// a single writer keeps them in cursor order. render, if set, rewrites each
+// document before it is encoded.
+func writeDocuments(ctx context.Context, w io.Writer, workers int, render func(bson.M), each func(ctx context.Context, fn func(bson.Raw) error) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	work := make(chan *encodedChunk)
+	// ordered bounds the chunks in flight, so reading from the cursor pauses
+	// while the workers catch up
+	ordered := make(chan *encodedChunk, 2*workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ch := range work {
+				ch.encode()
+			}
+		}()
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		var err error
+		first := true
+		for ch := range ordered {
+			<-ch.done
+			if err == nil {
+				err = ch.err
+			}
+			if err == nil && ch.buf.Len() > 0 {
+				if !first {
+					_, err = w.Write([]byte{','})
+				}
+				if err == nil {
+					_, err = w.Write(ch.buf.Bytes())
+				}
+				first = false
+			}
+			if err != nil {
+				// Stop reading from the cursor
+				cancel()
+			}
+			ch.buf.Reset()
+			chunkBuffers.Put(ch.buf)
+		}
+		written <- err
+	}()
+
+	dispatch := func(docs []bson.Raw) {
+		ch := &encodedChunk{docs: docs, render: render, done: make(chan struct{})}
+		ordered <- ch
+		work <- ch
+	}
+	docs := make([]bson.Raw, 0, decodeChunk)
+	err := each(ctx, func(raw bson.Raw) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// The cursor reuses its buffer for the next document
+		docs = append(docs, append(bson.Raw(nil), raw...))
+		if len(docs) == decodeChunk {
+			dispatch(docs)
+			docs = make([]bson.Raw, 0, decodeChunk)
+		}
+		return nil
+	})
+	if err == nil && len(docs) > 0 {
+		dispatch(docs)
+	}
+	close(work)
+	close(ordered)
+	wg.Wait()
+	if werr := <-written; werr != nil {
+		return werr
+	}
+	return err
+}
+
+// findEach responds with the documents matching filter, encoding them while
+// the cursor is still being read. It is used when no result hook needs the
+// whole result. total, if set, returns the count set in the total count
+// header, and added as totalCount with totalInBody; render, if set,
+// rewrites each document.
+func (h *Data) findEach(c *fiber.Ctx, ctx context.Context, database, collection string, filter interface{}, opts *options.FindOptions, total func() (int64, error), totalInBody bool, render func(bson.M)) error {
+	c.Response().ResetBody()
+	body := c.Response().BodyWriter()
+	io.WriteString(body, `{"documents":[`)
+	err := writeDocuments(ctx, body, runtime.GOMAXPROCS(0), render, func(ctx context.Context, fn func(bson.Raw) error) error {
+		return h.Store.FindEach(ctx, database, collection, filter, opts, fn)
+	})
+	if err != nil {
+		c.Response().ResetBody()
+		log.Printf("Error executing Find: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	io.WriteString(body, "]")
+	if total != nil {
+		n, err := total()
+		if err != nil {
+			c.Response().ResetBody()
+			log.Printf("Error counting documents: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		if totalInBody {
+			fmt.Fprintf(body, `,"totalCount":%d`, n)
+		}
+		c.Set(HeaderTotalCount, strconv.FormatInt(n, 10))
+	}
+	io.WriteString(body, "}\n")
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return nil
+}
@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// dateValue converts an RFC3339 string sent for one of a request's
+// dateFields to a date, for clients that cannot send {"$date": ...}
+func dateValue(field string, v interface{}) (interface{}, error) {
+	s, ok := v.(string)
+	if !ok {
+		return v, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid RFC3339 date %q", field, s)
+	}
+	return primitive.NewDateTimeFromTime(t), nil
+}
+
+// plainDate renders a date as an RFC3339 string in UTC with millisecond
+// precision
+func plainDate(v interface{}) interface{} {
+	if d, ok := v.(primitive.DateTime); ok {
+		return d.Time().UTC().Format("2006-01-02T15:04:05.000Z07:00")
+	}
+	return v
+}
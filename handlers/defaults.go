@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// readDefaults applies the configured read defaults of the collection of a
+// request: the projection when it has none and, for finds, the default and
+// maximum limit
+func (h *Data) readDefaults(doc *Document, find bool) error {
+	d, ok := h.ReadDefaults[doc.Database+"."+doc.Collection]
+	if !ok {
+		return nil
+	}
+	if find {
+		if doc.Limit <= 0 {
+			doc.Limit = d.DefaultLimit
+			if doc.Limit == 0 {
+				doc.Limit = d.MaxLimit
+			}
+		}
+		if d.MaxLimit > 0 && doc.Limit > d.MaxLimit {
+			doc.Limit = d.MaxLimit
+		}
+	}
+	if doc.Projection == nil && len(d.Projection) > 0 {
+		data, err := json.Marshal(d.Projection)
+		if err != nil {
+			return err
+		}
+		if err := bson.UnmarshalExtJSON(data, false, &doc.Projection); err != nil {
+			return fmt.Errorf("projection of %s.%s: %w", doc.Database, doc.Collection, err)
+		}
+	}
+	return nil
+}
+
+// HeaderTruncated is set on aggregation responses whose documents were
+// truncated to the configured limits, for formats that leave out the
+// warning
+const HeaderTruncated = "X-Truncated"
+
+// limitAggregation ends pipeline with a $limit one past the maximum number
+// of documents, which tells truncateResults whether more would follow
+func (h *Data) limitAggregation(pipeline interface{}) interface{} {
+	stages, ok := pipeline.(bson.A)
+	if h.AggregateLimits.MaxDocuments <= 0 || !ok {
+		return pipeline
+	}
+	limit := bson.D{{Key: "$limit", Value: h.AggregateLimits.MaxDocuments + 1}}
+	return append(stages[:len(stages):len(stages)], limit)
+}
+
+// truncateResults drops the documents of an aggregation past the
+// configured maximum number of documents or total size. It returns the
+// documents kept and a warning saying why the others were dropped, empty
+// when none were.
+func (h *Data) truncateResults(results []bson.M) ([]bson.M, string, error) {
+	limits := h.AggregateLimits
+	warning := ""
+	if limits.MaxDocuments > 0 && int64(len(results)) > limits.MaxDocuments {
+		results = results[:limits.MaxDocuments]
+		warning = fmt.Sprintf("Results truncated to the first %d documents", limits.MaxDocuments)
+	}
+	if limits.MaxResponseMB > 0 {
+		size, maxSize := 0, int(limits.MaxResponseMB<<20)
+		for i, doc := range results {
+			raw, err := bson.Marshal(doc)
+			if err != nil {
+				return nil, "", err
+			}
+			if size += len(raw); size > maxSize {
+				results = results[:i]
+				warning = fmt.Sprintf("Results truncated to the first %d documents, within %d MB", i, limits.MaxResponseMB)
+				break
+			}
+		}
+	}
+	return results, warning, nil
+}
@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"strings"
+	"unicode"
+
+	"mongo-data-api-go-alternative/auth"
+	"mongo-data-api-go-alternative/config"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// envelope returns the envelope of the requesting API key, or nil when its
+// responses keep their default shape
+func envelope(c *fiber.Ctx) *config.Envelope {
+	p := auth.PrincipalFromCtx(c)
+	if p == nil || p.Key.Envelope == nil {
+		return nil
+	}
+	return p.Key.Envelope
+}
+
+// applyEnvelope reshapes the top level of a result as env says: fields are
+// omitted, counted, then renamed or converted to env's case
+func applyEnvelope(env *config.Envelope, result map[string]interface{}) map[string]interface{} {
+	shaped := make(map[string]interface{}, len(result)+1)
+	for key, v := range result {
+		shaped[key] = v
+	}
+	for _, key := range env.Omit {
+		delete(shaped, key)
+	}
+	if env.CountField != "" {
+		if n, ok := countDocuments(result); ok {
+			shaped[env.CountField] = n
+		}
+	}
+	if len(env.Rename) == 0 && env.Case != config.CaseSnake {
+		return shaped
+	}
+	renamed := make(map[string]interface{}, len(shaped))
+	for key, v := range shaped {
+		switch {
+		case env.Rename[key] != "":
+			key = env.Rename[key]
+		case key != env.CountField && env.Case == config.CaseSnake:
+			key = snakeCase(key)
+		}
+		renamed[key] = v
+	}
+	return renamed
+}
+
+// countDocuments returns the number of documents of a result
+func countDocuments(result map[string]interface{}) (int, bool) {
+	if d, ok := result["document"]; ok {
+		if d == nil {
+			return 0, true
+		}
+		return 1, true
+	}
+	switch docs := result["documents"].(type) {
+	case []bson.M:
+		return len(docs), true
+	case []interface{}:
+		return len(docs), true
+	}
+	return 0, false
+}
+
+// snakeCase converts a camelCase name such as "insertedIds" to
+// "inserted_ids"
+func snakeCase(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,334 @@
+package handlers
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+
+	"mongo-data-api-go-alternative/db"
+	"mongo-data-api-go-alternative/formats"
+	"mongo-data-api-go-alternative/hooks"
+	"mongo-data-api-go-alternative/tabular"
+	"mongo-data-api-go-alternative/tenant"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Export formats
+const (
+	exportNDJSON  = formats.NDJSON
+	exportGzip    = "ejson.gz"
+	exportArrow   = formats.Arrow
+	exportParquet = formats.Parquet
+)
+
+const (
+	defaultExportChunk = 1000
+	maxExportChunk     = 10000
+)
+
+// exportRequest is the body accepted by /api/export
+type exportRequest struct {
+	Database   string `bson:"database"`
+	Collection string `bson:"collection"`
+	Filter     bson.D `bson:"filter"`
+	Projection bson.D `bson:"projection"`
+	Format     string `bson:"format"`
+	ChunkSize  int64  `bson:"chunkSize"`
+	// After resumes an export after the document with this _id
+	After interface{} `bson:"after"`
+	// Async writes the export to a file in a background job
+	Async bool `bson:"async"`
+}
+
+// exportProgress is the progress of an export job
+type exportProgress struct {
+	Documents int64 `json:"documents"`
+}
+
+// exportResult is the result of an export job
+type exportResult struct {
+	Documents int64 `json:"documents"`
+	// Location is the path the export file is downloaded from
+	Location string `json:"location"`
+}
+
+// exportChunks reads a collection in _id order, one chunk at a time
+type exportChunks struct {
+	ctx        context.Context
+	store      db.DataStore
+	database   string
+	collection string
+	filter     interface{}
+	opts       *options.FindOptions
+	computed   bson.D
+	after      interface{}
+	resumed    bool
+}
+
+// next returns the documents following the last one returned
+func (e *exportChunks) next() ([]bson.M, error) {
+	filter := e.filter
+	if e.resumed {
+		filter = bson.D{{Key: "$and", Value: bson.A{filter, bson.D{{Key: "_id", Value: bson.D{{Key: "$gt", Value: e.after}}}}}}}
+	}
+	var docs []bson.M
+	var err error
+	if len(e.computed) > 0 {
+		pipeline, opts := findPipeline(filter, e.opts, e.computed)
+		docs, err = e.store.Aggregate(e.ctx, e.database, e.collection, pipeline, opts)
+	} else {
+		docs, err = e.store.Find(e.ctx, e.database, e.collection, filter, e.opts)
+	}
+	if err == nil && len(docs) > 0 {
+		e.after, e.resumed = docs[len(docs)-1]["_id"], true
+	}
+	return docs, err
+}
+
+// Export streams the documents of a collection matching an optional filter
+// in _id order, as relaxed EJSON lines ("ndjson", the default), gzipped
+// canonical EJSON lines ("ejson.gz"), an Arrow IPC stream ("arrow") or a
+// Parquet file ("parquet"). Arrow and Parquet exports get the schema
+// inferred from the first chunk and a record batch or row group per chunk.
+// Documents are read in chunks of
+// chunkSize by _id range; an interrupted export is resumed by passing the
+// last _id received as "after". With "async": true the export is written to
+// a file by a job instead. Result hooks are not applied.
+func (h *Data) Export(c *fiber.Ctx) error {
+	var doc exportRequest
+	if err := parseBody(c, &doc, h.StrictBodies); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if doc.Format == "" {
+		doc.Format = exportNDJSON
+	}
+	switch doc.Format {
+	case exportNDJSON, exportGzip, exportArrow, exportParquet:
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("format must be %q, %q, %q or %q", exportNDJSON, exportGzip, exportArrow, exportParquet)})
+	}
+	if doc.ChunkSize == 0 {
+		doc.ChunkSize = defaultExportChunk
+	}
+	if doc.ChunkSize < 0 || doc.ChunkSize > maxExportChunk {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "chunkSize must be between 1 and 10000"})
+	}
+	if id := field(doc.Projection, "_id"); id != nil && !truthy(id) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "projection must include _id to export in chunks"})
+	}
+
+	req := &hooks.Request{Operation: "export", Database: doc.Database, Collection: doc.Collection, Filter: doc.Filter}
+	if err := hooks.BeforeRequest(c, req); err != nil {
+		return hookError(c, err)
+	}
+
+	database, err := h.database(c, "export", &Document{Database: doc.Database, Collection: doc.Collection})
+	if err != nil {
+		return denied(c, err)
+	}
+	computed, err := h.computedFields(&Document{Database: doc.Database, Collection: doc.Collection})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer observe(c, "export", doc.Database, doc.Collection)()
+
+	// Each chunk is read in a single round trip
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(doc.ChunkSize).SetBatchSize(int32(doc.ChunkSize))
+	if doc.Projection != nil {
+		opts.SetProjection(doc.Projection)
+	}
+	chunks := &exportChunks{
+		ctx:        opContext(c),
+		store:      h.Store,
+		database:   database,
+		collection: doc.Collection,
+		filter:     tenant.FromCtx(c).Filter(req.Filter),
+		opts:       opts,
+		computed:   computed,
+	}
+	if doc.After != nil {
+		chunks.after, chunks.resumed = doc.After, true
+	}
+
+	// The first chunk is read before responding so that errors get a status
+	docs, err := chunks.next()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if doc.Async {
+		base := jobsPath(c, "")
+		return startJob(c, h.Jobs, "export", func(ctx context.Context, id string, report func(interface{})) (interface{}, error) {
+			// The chunks after the first are read by the job, which
+			// outlives the request and its session
+			chunks.ctx = ctx
+			f, err := h.Jobs.CreateFile(id, doc.Format)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			bw := bufio.NewWriter(f)
+			encode, flush, closeOutput := exportOutput(bw, doc.Format)
+			n, err := chunks.write(encode, func(n int64) error {
+				report(exportProgress{Documents: n})
+				return flush()
+			}, docs, doc.ChunkSize)
+			if err == nil {
+				err = closeOutput()
+			}
+			if err == nil {
+				err = f.Close()
+			}
+			if err != nil {
+				return nil, err
+			}
+			return exportResult{Documents: n, Location: base + id + "/result"}, nil
+		})
+	}
+
+	if f, err := formats.Lookup(doc.Format); err == nil {
+		c.Set(fiber.HeaderContentType, f.MediaType)
+	} else {
+		c.Set(fiber.HeaderContentType, "application/gzip")
+	}
+	if doc.Format != exportNDJSON {
+		c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s.%s.%s"`, doc.Database, doc.Collection, doc.Format))
+	}
+	c.Context().SetBodyStreamWriter(func(bw *bufio.Writer) {
+		encode, flush, closeOutput := exportOutput(bw, doc.Format)
+		defer closeOutput()
+		_, err := chunks.write(encode, func(int64) error { return flush() }, docs, doc.ChunkSize)
+		if err != nil {
+			// Usually the client went away; it can resume with the last _id
+			// it got
+			log.Printf("Export of %s.%s stopped after _id %v: %v", database, chunks.collection, chunks.after, err)
+		}
+	})
+	return nil
+}
+
+// write encodes docs and the chunks following them and returns the number
+// of documents written. flush is called after each chunk with the number
+// written so far.
+func (e *exportChunks) write(encode func([]bson.M) error, flush func(written int64) error, docs []bson.M, chunkSize int64) (int64, error) {
+	var written int64
+	for {
+		if err := encode(docs); err != nil {
+			return written, err
+		}
+		written += int64(len(docs))
+		if err := flush(written); err != nil {
+			return written, err
+		}
+		if int64(len(docs)) < chunkSize {
+			return written, nil
+		}
+		var err error
+		if docs, err = e.next(); err != nil {
+			return written, err
+		}
+	}
+}
+
+// exportOutput returns the encoder of the chunks of an export in format,
+// written to bw and, for "ejson.gz" exports, gzip compressed. flush pushes
+// everything written so far to bw's destination and closeOutput finishes
+// the output.
+func exportOutput(bw *bufio.Writer, format string) (encode func([]bson.M) error, flush, closeOutput func() error) {
+	switch format {
+	case exportArrow, exportParquet:
+		tw, _ := tabular.NewWriter(bw, format)
+		closeOutput = func() error {
+			if err := tw.Close(); err != nil {
+				return err
+			}
+			return bw.Flush()
+		}
+		return tw.Write, bw.Flush, closeOutput
+	case exportNDJSON:
+		return ejsonLines(bw, false), bw.Flush, bw.Flush
+	}
+	gz := gzip.NewWriter(bw)
+	flush = func() error {
+		if err := gz.Flush(); err != nil {
+			return err
+		}
+		return bw.Flush()
+	}
+	closeOutput = func() error {
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		return bw.Flush()
+	}
+	return ejsonLines(gz, true), flush, closeOutput
+}
+
+// ejsonLines returns an encoder writing documents to w as EJSON lines
+func ejsonLines(w io.Writer, canonical bool) func([]bson.M) error {
+	return func(docs []bson.M) error {
+		for _, d := range docs {
+			// Each document is followed by a newline
+			if err := formats.WriteEJSON(w, ordered(d), canonical); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// ordered converts a document to bson.D with _id first and the other fields
+// sorted, so exports are deterministic
+func ordered(m bson.M) bson.D {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		if k != "_id" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if _, ok := m["_id"]; ok {
+		keys = append([]string{"_id"}, keys...)
+	}
+	d := make(bson.D, len(keys))
+	for i, k := range keys {
+		d[i] = bson.E{Key: k, Value: orderedValue(m[k])}
+	}
+	return d
+}
+
+func orderedValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case bson.M:
+		return ordered(val)
+	case bson.A:
+		out := make(bson.A, len(val))
+		for i, item := range val {
+			out[i] = orderedValue(item)
+		}
+		return out
+	}
+	return v
+}
+
+// truthy reports whether a projection value includes a field
+func truthy(v interface{}) bool {
+	switch b := v.(type) {
+	case bool:
+		return b
+	case int32:
+		return b != 0
+	case int64:
+		return b != 0
+	case float64:
+		return b != 0
+	}
+	return true
+}
@@ -0,0 +1,286 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"mongo-data-api-go-alternative/hooks"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// fanOutRequest is the body of /api/fanOutFind
+type fanOutRequest struct {
+	Document `bson:",inline"`
+	// Clusters are the fan-out clusters to read, in order of preference;
+	// all of them by default
+	Clusters []string `bson:"clusters"`
+}
+
+// fanOutRead is the read of one cluster by a fan-out find
+type fanOutRead struct {
+	Cluster   string  `json:"cluster" bson:"cluster"`
+	Documents int     `json:"documents" bson:"documents"`
+	LatencyMS float64 `json:"latencyMs" bson:"latencyMs"`
+	Error     string  `json:"error,omitempty" bson:"error,omitempty"`
+
+	docs []bson.M
+}
+
+// FanOutFind runs a find on the same namespace of several clusters at once
+// and merges the results, e.g. to read a collection whose documents are
+// being migrated between regions. Documents are identified by _id: one
+// found on several clusters is returned once, as read from the first
+// cluster listed, and counted as a duplicate, or as a conflict when the
+// copies differ. The merged documents are sorted by the find's sort, then
+// skipped and limited. The documents read and the latency of each cluster
+// are reported; when some clusters fail, the documents of the others are
+// returned with partial set.
+func (h *Data) FanOutFind(c *fiber.Ctx) error {
+	if len(h.FanOutReads.Clusters) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "fan-out reads are not configured"})
+	}
+	var body fanOutRequest
+	if err := parseBody(c, &body, h.StrictBodies); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	doc := &body.Document
+	clusters := body.Clusters
+	if len(clusters) == 0 {
+		clusters = h.FanOutReads.Clusters
+	}
+	for i, name := range clusters {
+		if !slices.Contains(h.FanOutReads.Clusters, name) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("cluster %q is not configured for fan-out reads", name)})
+		}
+		if slices.Contains(clusters[:i], name) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("cluster %q is listed twice", name)})
+		}
+	}
+	if format, err := responseFormat(c, doc); err != nil || format.Rows {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "fanOutFind responds with JSON or EJSON only"})
+	}
+	if id := field(doc.Projection, "_id"); id != nil && !truthy(id) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "projection must include _id to merge results"})
+	}
+	// A session belongs to the default cluster
+	if c.Locals(sessionLocal) != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "fan-out reads cannot run in a session"})
+	}
+
+	f, err := h.prepareFind(c, doc)
+	if err != nil {
+		var fe *fiber.Error
+		if errors.As(err, &fe) {
+			return c.Status(fe.Code).JSON(fiber.Map{"error": fe.Message})
+		}
+		return denied(c, err)
+	}
+	// Every cluster reads the documents up to the end of the merged page
+	skip := doc.Skip
+	if skip > 0 {
+		f.options.Skip = nil
+		if doc.Limit > 0 {
+			f.options.SetLimit(doc.Limit + skip)
+		}
+	}
+
+	defer observe(c, "find", doc.Database, doc.Collection)()
+	reads := h.readClusters(limitedContext(c, doc, h.MaxTime.Read), f, clusters)
+	failed := 0
+	for _, r := range reads {
+		if r.Error != "" {
+			failed++
+		}
+	}
+	if failed == len(reads) {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "every cluster failed", "clusters": reads})
+	}
+
+	docs, duplicates, conflicts := mergeFanOut(reads)
+	if len(doc.Sort) > 0 {
+		sortDocuments(docs, doc.Sort)
+	}
+	if skip >= int64(len(docs)) {
+		docs = docs[:0]
+	} else {
+		docs = docs[skip:]
+	}
+	if doc.Limit > 0 && int64(len(docs)) > doc.Limit {
+		docs = docs[:doc.Limit]
+	}
+
+	result := map[string]interface{}{"documents": docs, "clusters": reads, "duplicates": duplicates, "conflicts": conflicts}
+	if failed > 0 {
+		result["partial"] = true
+	}
+	if err := hooks.AfterResult(c, f.req, result); err != nil {
+		return hookError(c, err)
+	}
+	if render := h.documentRenderer(c, doc); render != nil {
+		renderDocuments(result, render)
+	}
+	return respond(c, doc, result)
+}
+
+// readClusters runs the find on the clusters in parallel, each bounded by
+// the fan-out timeout
+func (h *Data) readClusters(ctx context.Context, f *preparedFind, clusters []string) []*fanOutRead {
+	timeout := time.Duration(h.FanOutReads.TimeoutMs) * time.Millisecond
+	reads := make([]*fanOutRead, len(clusters))
+	var wg sync.WaitGroup
+	for i, name := range clusters {
+		read := &fanOutRead{Cluster: name}
+		reads[i] = read
+		store, ok := h.Clusters[name]
+		if !ok {
+			read.Error = "cluster is not connected"
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := ctx
+			if timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+			started := time.Now()
+			docs, err := f.run(ctx, store)
+			read.LatencyMS = float64(time.Since(started).Microseconds()) / 1000
+			if err != nil {
+				read.Error = err.Error()
+				return
+			}
+			read.docs, read.Documents = docs, len(docs)
+		}()
+	}
+	wg.Wait()
+	return reads
+}
+
+// mergeFanOut merges the documents of the reads in their order, keeping
+// the first copy of each _id. duplicates counts the further copies and
+// conflicts the _ids with copies that differ.
+func mergeFanOut(reads []*fanOutRead) (docs []bson.M, duplicates, conflicts int) {
+	docs = []bson.M{}
+	index := make(map[string]int)
+	conflicted := make(map[string]bool)
+	for _, r := range reads {
+		for _, d := range r.docs {
+			// Ids of any type, including documents, key the map by their
+			// encoding
+			key, err := bson.Marshal(bson.D{{Key: "_id", Value: d["_id"]}})
+			if err != nil {
+				docs = append(docs, d)
+				continue
+			}
+			i, seen := index[string(key)]
+			if !seen {
+				index[string(key)] = len(docs)
+				docs = append(docs, d)
+				continue
+			}
+			duplicates++
+			if !conflicted[string(key)] && !reflect.DeepEqual(docs[i], d) {
+				conflicted[string(key)] = true
+				conflicts++
+			}
+		}
+	}
+	return docs, duplicates, conflicts
+}
+
+// sortDocuments sorts merged documents by a find's sort
+func sortDocuments(docs []bson.M, sortSpec bson.D) {
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, e := range sortSpec {
+			c := compareValues(lookup(docs[i], e.Key), lookup(docs[j], e.Key))
+			if dir, _ := direction(e.Value); dir < 0 {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+}
+
+// compareValues orders two values as MongoDB sorts them: by the order of
+// their types, then by value for the scalar types sort keys usually hold.
+// Documents and arrays of the same type compare equal.
+func compareValues(a, b interface{}) int {
+	if ta, tb := sortTypeOrder(a), sortTypeOrder(b); ta != tb {
+		return ta - tb
+	}
+	switch va := a.(type) {
+	case string:
+		return strings.Compare(va, b.(string))
+	case bool:
+		vb := b.(bool)
+		switch {
+		case va == vb:
+			return 0
+		case vb:
+			return -1
+		}
+		return 1
+	case primitive.ObjectID:
+		vb := b.(primitive.ObjectID)
+		return bytes.Compare(va[:], vb[:])
+	case primitive.DateTime:
+		return compareFloats(float64(va), float64(b.(primitive.DateTime)))
+	}
+	if fa, ok := patchNumber(a); ok {
+		fb, _ := patchNumber(b)
+		return compareFloats(fa, fb)
+	}
+	return 0
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// sortTypeOrder is the position of the type of v in MongoDB's sort order
+func sortTypeOrder(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 1
+	case int32, int64, float64:
+		return 2
+	case string:
+		return 3
+	case bson.M, bson.D:
+		return 4
+	case bson.A:
+		return 5
+	case primitive.Binary:
+		return 6
+	case primitive.ObjectID:
+		return 7
+	case bool:
+		return 8
+	case primitive.DateTime:
+		return 9
+	}
+	return 10
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// fieldConverter converts a value of field sent by a client to the type it
+// is stored as. Values it doesn't apply to are returned unchanged.
+type fieldConverter func(field string, v interface{}) (interface{}, error)
+
+// convertFields converts the RFC3339 strings of the request's dateFields
+// and the UUID strings of the fields configured as UUIDs
+func (h *Data) convertFields(doc *Document) error {
+	if err := convertRequestFields(doc, doc.DateFields, dateValue); err != nil {
+		return err
+	}
+	return convertRequestFields(doc, h.uuidFields(doc), uuidValue)
+}
+
+// convertRequestFields converts the values of fields in the request's
+// documents, update and filter. Fields are dotted paths; a path crossing
+// an array applies to each of its elements.
+func convertRequestFields(doc *Document, fields []string, convert fieldConverter) error {
+	for _, field := range fields {
+		if err := convertDocumentField(doc.Document, field, convert); err != nil {
+			return err
+		}
+		for _, d := range doc.Documents {
+			if err := convertDocumentField(d, field, convert); err != nil {
+				return err
+			}
+		}
+		if err := convertFilterField(doc.Filter, field, convert); err != nil {
+			return err
+		}
+		if err := convertUpdateField(doc.Update, field, convert); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// convertUpdateField converts the values set by the $set, $setOnInsert,
+// $min and $max operators of update, or by a replacement document
+func convertUpdateField(update bson.D, field string, convert fieldConverter) error {
+	if len(update) == 0 || !strings.HasPrefix(update[0].Key, "$") {
+		return convertDocumentField(update, field, convert)
+	}
+	for _, op := range update {
+		switch op.Key {
+		case "$set", "$setOnInsert", "$min", "$max":
+			if fields, ok := op.Value.(bson.D); ok {
+				if err := convertDocumentField(fields, field, convert); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// convertFilterField converts the values compared with field by filter, at
+// its top level or in $and, $or and $nor clauses
+func convertFilterField(filter bson.D, field string, convert fieldConverter) error {
+	for _, e := range filter {
+		switch e.Key {
+		case "$and", "$or", "$nor":
+			clauses, _ := e.Value.(bson.A)
+			for _, clause := range clauses {
+				if d, ok := clause.(bson.D); ok {
+					if err := convertFilterField(d, field, convert); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return convertDocumentField(filter, field, convert)
+}
+
+// convertDocumentField converts the values at field in d. Keys of d may be
+// dotted paths themselves, as in updates and filters.
+func convertDocumentField(d bson.D, field string, convert fieldConverter) error {
+	for i, e := range d {
+		if e.Key == field {
+			v, err := convertValue(field, e.Value, convert)
+			if err != nil {
+				return err
+			}
+			d[i].Value = v
+			continue
+		}
+		if rest, ok := strings.CutPrefix(field, e.Key+"."); ok {
+			if err := convertNestedField(e.Value, rest, convert); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func convertNestedField(v interface{}, field string, convert fieldConverter) error {
+	switch v := v.(type) {
+	case bson.D:
+		return convertDocumentField(v, field, convert)
+	case bson.A:
+		for _, item := range v {
+			if err := convertNestedField(item, field, convert); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// convertValue converts a field's value, an array of values or a document
+// of query operators on them
+func convertValue(field string, v interface{}, convert fieldConverter) (interface{}, error) {
+	switch v := v.(type) {
+	case bson.A:
+		for i := range v {
+			item, err := convertValue(field, v[i], convert)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = item
+		}
+		return v, nil
+	case bson.D:
+		if len(v) == 0 || !strings.HasPrefix(v[0].Key, "$") {
+			return v, nil
+		}
+		for i := range v {
+			operand, err := convertValue(field, v[i].Value, convert)
+			if err != nil {
+				return nil, err
+			}
+			v[i].Value = operand
+		}
+		return v, nil
+	}
+	return convert(field, v)
+}
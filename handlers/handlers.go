@@ -1,11 +1,29 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"strconv"
+	"strings"
+	"time"
 
+	"mongo-data-api-go-alternative/auth"
+	"mongo-data-api-go-alternative/config"
 	"mongo-data-api-go-alternative/db"
+	"mongo-data-api-go-alternative/formats"
+	"mongo-data-api-go-alternative/history"
+	"mongo-data-api-go-alternative/hooks"
+	"mongo-data-api-go-alternative/jobs"
+	"mongo-data-api-go-alternative/metrics"
+	"mongo-data-api-go-alternative/protoschema"
+	"mongo-data-api-go-alternative/query"
+	"mongo-data-api-go-alternative/sessions"
+	"mongo-data-api-go-alternative/tenant"
+	"mongo-data-api-go-alternative/trash"
 
 	"github.com/gofiber/fiber/v2"
 	"go.mongodb.org/mongo-driver/bson"
@@ -13,112 +31,373 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// Document is the request body of the data endpoints. It is decoded from
+// EJSON in a single pass, so filters, updates and pipelines keep their key
+// order and BSON types.
 type Document struct {
-	Database   string                   `json:"database" binding:"required"`
-	Collection string                   `json:"collection" binding:"required"`
-	Document   map[string]interface{}   `json:"document"`
-	Documents  []map[string]interface{} `json:"documents"`
-	Filter     map[string]interface{}   `json:"filter"`
-	Update     map[string]interface{}   `json:"update"`
-	Upsert     bool                     `json:"upsert"`
-	Projection map[string]interface{}   `json:"projection"`
-	Sort       map[string]interface{}   `json:"sort"`
-	Limit      int64                    `json:"limit"`
-	Skip       int64                    `json:"skip"`
-	Pipeline   []map[string]interface{} `json:"pipeline"`
-}
-
-// Helper function to deserialize incoming data
-func deserializeInput(input interface{}) (interface{}, error) {
-	// Convert input to JSON string
-	jsonData, err := json.Marshal(input)
-	if err != nil {
-		log.Printf("Failed to marshal input to JSON: %v", err)
-		return nil, err
+	Database   string   `bson:"database"`
+	Collection string   `bson:"collection"`
+	Document   bson.D   `bson:"document"`
+	Documents  []bson.D `bson:"documents"`
+	Filter     bson.D   `bson:"filter"`
+	Update     bson.D   `bson:"update"`
+	Upsert     bool     `bson:"upsert"`
+	Projection bson.D   `bson:"projection"`
+	Sort       bson.D   `bson:"sort"`
+	Limit      int64    `bson:"limit"`
+	Skip       int64    `bson:"skip"`
+	Pipeline   bson.A   `bson:"pipeline"`
+	// BatchSize is the number of documents per cursor batch of find and
+	// aggregate; larger batches mean fewer round trips on large scans
+	BatchSize int32 `bson:"batchSize"`
+	// Async runs an aggregation ending in $out or $merge as a job
+	Async bool `bson:"async"`
+	// IncludeTotalCount counts all documents matching the filter of a
+	// find, ignoring skip and limit, alongside the query
+	IncludeTotalCount bool `bson:"includeTotalCount"`
+	// Keyset pages a find by its sort keys: the response holds nextPage
+	// and prevPage tokens, which are sent back as PageAfter or PageBefore
+	Keyset     bool   `bson:"keyset"`
+	PageAfter  string `bson:"pageAfter"`
+	PageBefore string `bson:"pageBefore"`
+	// MaxTimeMS limits the operation; the default of its category applies
+	// when it is 0
+	MaxTimeMS int64 `bson:"maxTimeMS"`
+	// ShardKey names the shard key fields of the collection, overriding
+	// the configured ones, to check that writes can be routed
+	ShardKey []string `bson:"shardKey"`
+	// PlainObjectIDs overrides the configured handling of ObjectIds: _id
+	// strings in the filter are converted to ObjectIds, and ObjectId _ids
+	// are returned as strings
+	PlainObjectIDs *bool `bson:"plainObjectIds"`
+	// DateFields are the fields whose RFC3339 strings are converted to
+	// dates in the documents, update and filter; PlainDates returns the
+	// dates read as RFC3339 strings
+	DateFields []string `bson:"dateFields"`
+	PlainDates bool     `bson:"plainDates"`
+	// NumbersAsStrings overrides the API key's rendering of the 64-bit
+	// integers and decimals read: as strings, or as relaxed EJSON numbers
+	NumbersAsStrings *bool `bson:"numbersAsStrings"`
+	// Format names the format of the response, overriding the Accept
+	// header; the format query parameter does the same
+	Format string `bson:"format"`
+	// Pretty indents JSON responses and sorts the keys of their documents,
+	// for reading and diffing them; the pretty query parameter does the same
+	Pretty bool `bson:"pretty"`
+	// FailOnNoMatch responds to updates matching and upserting nothing
+	// and deletes deleting nothing with 404
+	FailOnNoMatch bool `bson:"failOnNoMatch"`
+	// OnConflict is what insertOne does when a document with the same
+	// natural key exists: error (the default), ignore and return it,
+	// replace it or merge the new fields into it
+	OnConflict string `bson:"onConflict"`
+	// Patch is the JSON Merge Patch mergeOne applies to the matched
+	// document
+	Patch bson.D `bson:"patch"`
+	// Operations is the JSON Patch patchOne applies to the matched
+	// document
+	Operations []PatchOperation `bson:"operations"`
+	// DocumentID names the document whose versions history lists, or
+	// which restore takes out of the trash, and VersionID the version
+	// revert restores
+	DocumentID interface{} `bson:"documentId"`
+	VersionID  interface{} `bson:"versionId"`
+
+	// pinned is set when the filter was pinned to a document read before
+	// the update, which then fails with 409 if it no longer matches
+	pinned bool
+}
+
+const (
+	// maxCursorBatch bounds the batchSize of find and aggregate
+	maxCursorBatch = 100000
+	// streamBatchSize is the cursor batch size of finds whose documents are
+	// encoded while the cursor is read, unless the request sets one. The
+	// driver's default first batch is 101 documents.
+	streamBatchSize = 1000
+)
+
+// maxBatchDocuments and maxBatchBytes are the server's limits for a single
+// insert command
+const (
+	maxBatchDocuments = 100000
+	maxBatchBytes     = 16 << 20
+)
+
+// Data serves the data endpoints on top of a DataStore
+type Data struct {
+	Store db.DataStore
+	// Jobs runs async imports, exports and aggregations; they are rejected
+	// when it is nil
+	Jobs *jobs.Manager
+	// MaxTime limits the operations of requests without maxTimeMS
+	MaxTime config.MaxTimeConfig
+	// ShardKeys maps "database.collection" to the shard key fields that
+	// updates and deletes are checked against
+	ShardKeys map[string][]string
+	// PlainObjectIDs is the handling of ObjectIds for requests that don't
+	// set plainObjectIds
+	PlainObjectIDs bool
+	// UUIDFields maps "database.collection" to the fields converted
+	// between UUID strings and Binary subtype 4
+	UUIDFields map[string][]string
+	// ComputedFields maps "database.collection" to the fields reads add to
+	// the documents they return, by the aggregation expression computing
+	// each
+	ComputedFields map[string]map[string]interface{}
+	// ReadDefaults maps "database.collection" to the limits and projection
+	// finds and findOnes get when they don't set their own
+	ReadDefaults map[string]config.ReadDefaults
+	// AggregateLimits caps the documents and bytes aggregations return
+	AggregateLimits config.AggregateLimits
+	// CrossDatabaseJoins allow aggregations to join collections of other
+	// databases; joins across databases are rejected without one
+	CrossDatabaseJoins []config.JoinRule
+	// Clusters are the stores of the configured clusters by name, including
+	// config.DefaultCluster; FanOutReads names those fan-out finds read
+	Clusters    map[string]db.DataStore
+	FanOutReads config.FanOutReadConfig
+	// TailIdleTimeout ends tails of capped collections that get no new
+	// document for that long; zero lets them run until the client goes away
+	TailIdleTimeout time.Duration
+	// Protos holds the protobuf schemas results can be encoded with
+	Protos *protoschema.Registry
+	// StrictBodies rejects request bodies with unknown top-level fields
+	StrictBodies bool
+	// LegacyDeleteResults returns deletes as {"result": {"n": N}} rather
+	// than {"deletedCount": N}
+	LegacyDeleteResults bool
+	// RestrictUpserts requires the upsert operation for updates that upsert
+	RestrictUpserts bool
+	// NaturalKeys maps "database.collection" to the fields identifying a
+	// document, which insertOne inserts at most once
+	NaturalKeys map[string][]string
+	// History keeps the prior versions of documents of versioned
+	// collections; nil when no collection is versioned
+	History *history.Store
+	// Trash holds the documents deleted from trashed collections; nil when
+	// no collection is
+	Trash *trash.Store
+}
+
+// database authorizes op for the requesting API key and returns the
+// tenant-scoped name of the database named in the request
+func (h *Data) database(c *fiber.Ctx, op string, doc *Document) (string, error) {
+	if err := auth.Authorize(c, op, doc.Database, doc.Collection); err != nil {
+		return "", err
 	}
+	return tenant.FromCtx(c).Database(doc.Database), nil
+}
 
-	// Deserialize JSON string to BSON
-	var bsonData interface{}
-	err = bson.UnmarshalExtJSON(jsonData, false, &bsonData)
-	if err != nil {
-		log.Printf("Failed to deserialize input: %v", err)
-		log.Printf("Input JSON: %s", string(jsonData))
-		return nil, err
+// denied answers a request whose operation Authorize rejected: 503 with
+// Retry-After while the operation is frozen by maintenance mode, 403
+// otherwise
+func denied(c *fiber.Ctx, err error) error {
+	var m *auth.MaintenanceError
+	if errors.As(err, &m) {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(m.RetryAfter))
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": err.Error()})
 	}
+	return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+}
 
-	return bsonData, nil
+// authorizeUpsert authorizes the upsert operation for updates requesting
+// one, when upserts are restricted
+func (h *Data) authorizeUpsert(c *fiber.Ctx, doc *Document) error {
+	if !h.RestrictUpserts || !doc.Upsert {
+		return nil
+	}
+	return auth.Authorize(c, "upsert", doc.Database, doc.Collection)
 }
 
-// Helper function to serialize outgoing data
-func serializeOutput(output interface{}) (interface{}, error) {
-	// Serialize BSON data to EJSON
-	ejsonBytes, err := bson.MarshalExtJSON(output, false, false)
-	if err != nil {
-		return nil, err
+// opContext returns the context of the database operations of a request,
+// which attributes them to the requesting API key and runs them in its
+// session, if any
+func opContext(c *fiber.Ctx) context.Context {
+	ctx := context.Background()
+	if p := auth.PrincipalFromCtx(c); p != nil {
+		ctx = db.WithClient(ctx, p.Key.Name)
+	}
+	if id := requestID(c); id != "" {
+		ctx = db.WithRequestID(ctx, id)
+	}
+	if s, ok := c.Locals(sessionLocal).(*sessions.Session); ok {
+		ctx = s.Bind(ctx)
+	}
+	return ctx
+}
+
+// limitedContext is opContext limited to the request's maxTimeMS, or to
+// def milliseconds when it sets none
+func limitedContext(c *fiber.Ctx, doc *Document, def int64) context.Context {
+	ms := doc.MaxTimeMS
+	if ms <= 0 {
+		ms = def
 	}
+	return db.WithMaxTime(opContext(c), time.Duration(ms)*time.Millisecond)
+}
 
-	// Unmarshal the EJSON bytes back into a Go map
-	var jsonData interface{}
-	if err := json.Unmarshal(ejsonBytes, &jsonData); err != nil {
-		return nil, err
+// observe records the duration and response status of op on a namespace
+// when the returned func is called, which handlers defer once the request
+// is authorized
+func observe(c *fiber.Ctx, op, database, collection string) func() {
+	start := time.Now()
+	return func() {
+		metrics.RecordMongoOperation(op, database, collection, c.Response().StatusCode(), time.Since(start))
 	}
+}
 
-	return jsonData, nil
+// hookRequest describes op to the registered transformation hooks
+func hookRequest(op string, doc *Document) *hooks.Request {
+	return &hooks.Request{Operation: op, Database: doc.Database, Collection: doc.Collection}
+}
+
+// hookError responds with the error returned by a hook
+func hookError(c *fiber.Ctx, err error) error {
+	return c.Status(hooks.Status(err)).JSON(fiber.Map{"error": err.Error()})
 }
 
 // InsertOne handles document insertion
-func InsertOne(c *fiber.Ctx) error {
+func (h *Data) InsertOne(c *fiber.Ctx) error {
 	var doc Document
-	if err := c.BodyParser(&doc); err != nil {
+	if err := parseBody(c, &doc, h.StrictBodies); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	// Deserialize the incoming document
-	deserializedDoc, err := deserializeInput(doc.Document)
-	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Failed to deserialize document"})
+	return h.insertOne(c, &doc)
+}
+
+func (h *Data) insertOne(c *fiber.Ctx, doc *Document) error {
+	if _, err := responseFormat(c, doc); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := h.convertFields(doc); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if doc.Document == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "document is required"})
+	}
+
+	req := hookRequest("insertOne", doc)
+	req.Documents = []interface{}{doc.Document}
+	if err := hooks.BeforeRequest(c, req); err != nil {
+		return hookError(c, err)
+	}
+	if len(req.Documents) != 1 {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Request hook must keep exactly one document"})
 	}
 
-	collection := db.GetCollection(doc.Database, doc.Collection)
-	result, err := collection.InsertOne(context.Background(), deserializedDoc)
+	scope := tenant.FromCtx(c)
+	deserializedDoc := scope.Document(req.Documents[0])
 
+	database, err := h.database(c, "insertOne", doc)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		return denied(c, err)
 	}
+	if err := h.checkConflict(c, doc); err != nil {
+		if errors.Is(err, auth.ErrForbidden) || errors.Is(err, auth.ErrMaintenance) {
+			return denied(c, err)
+		}
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	// Documents of collections with a natural key are inserted by upsert
+	var filter interface{}
+	document, _ := deserializedDoc.(bson.D)
+	if key := h.naturalKey(doc); len(key) > 0 {
+		f, err := naturalKeyFilter(key, document)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		filter = scope.Filter(f)
+	}
+	defer observe(c, "insertOne", doc.Database, doc.Collection)()
+	ctx := limitedContext(c, doc, h.MaxTime.Write)
 
 	// Wrap the result in a map to serialize
-	wrappedResult := map[string]interface{}{
-		"insertedId": result.InsertedID,
+	var wrappedResult map[string]interface{}
+	if filter == nil {
+		result, err := h.Store.InsertOne(ctx, database, doc.Collection, deserializedDoc)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		wrappedResult = map[string]interface{}{"insertedId": result.InsertedID}
+	} else {
+		insertedID, existing, err := h.insertByNaturalKey(ctx, database, doc, filter, document)
+		switch {
+		case err != nil:
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		case existing == nil:
+			wrappedResult = map[string]interface{}{"insertedId": insertedID}
+		case doc.OnConflict == "" || doc.OnConflict == conflictError:
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error":      fmt.Sprintf("A document with the same %s already exists", strings.Join(h.naturalKey(doc), ", ")),
+				"existingId": existing["_id"],
+			})
+		default:
+			wrappedResult = map[string]interface{}{"existingId": existing["_id"], "document": existing}
+			if render := h.documentRenderer(c, doc); render != nil {
+				renderDocuments(wrappedResult, render)
+			}
+		}
 	}
 
-	// Serialize the result before returning
-	serializedResult, err := serializeOutput(wrappedResult)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to serialize result"})
+	if err := hooks.AfterResult(c, req, wrappedResult); err != nil {
+		return hookError(c, err)
+	}
+	if h.plainObjectIDs(doc) {
+		plainResultIDs(wrappedResult)
 	}
 
-	return c.JSON(serializedResult)
+	return respond(c, doc, wrappedResult)
 }
 
-// InsertMany handles inserting multiple documents
-func InsertMany(c *fiber.Ctx) error {
+// InsertMany handles inserting multiple documents. With stream=true the
+// body is decoded and inserted batch by batch as it arrives.
+func (h *Data) InsertMany(c *fiber.Ctx) error {
+	if c.QueryBool("stream") {
+		return h.insertManyStream(c)
+	}
 	var doc Document
-	if err := c.BodyParser(&doc); err != nil {
+	if err := parseBody(c, &doc, h.StrictBodies); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	// Deserialize the incoming documents
-	var deserializedDocs []interface{}
-	for _, document := range doc.Documents {
-		deserializedDoc, err := deserializeInput(document)
-		if err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Failed to deserialize document"})
-		}
-		deserializedDocs = append(deserializedDocs, deserializedDoc)
+	return h.insertMany(c, &doc)
+}
+
+func (h *Data) insertMany(c *fiber.Ctx, doc *Document) error {
+	if _, err := responseFormat(c, doc); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := h.convertFields(doc); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	deserializedDocs := make([]interface{}, len(doc.Documents))
+	for i, document := range doc.Documents {
+		deserializedDocs[i] = document
 	}
 
-	collection := db.GetCollection(doc.Database, doc.Collection)
-	result, err := collection.InsertMany(context.Background(), deserializedDocs)
+	req := hookRequest("insertMany", doc)
+	req.Documents = deserializedDocs
+	if err := hooks.BeforeRequest(c, req); err != nil {
+		return hookError(c, err)
+	}
+
+	scope := tenant.FromCtx(c)
+	deserializedDocs = make([]interface{}, len(req.Documents))
+	for i, document := range req.Documents {
+		deserializedDocs[i] = scope.Document(document)
+	}
+
+	database, err := h.database(c, "insertMany", doc)
+	if err != nil {
+		return denied(c, err)
+	}
+	defer observe(c, "insertMany", doc.Database, doc.Collection)()
+	if batches := splitInsert(deserializedDocs); len(batches) > 1 || len(batches) == 1 && batches[0].Error != "" {
+		return h.insertBatches(c, limitedContext(c, doc, h.MaxTime.Write), req, database, deserializedDocs, batches, doc)
+	}
+	result, err := h.Store.InsertMany(limitedContext(c, doc, h.MaxTime.Write), database, doc.Collection, deserializedDocs)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 	}
@@ -128,41 +407,184 @@ func InsertMany(c *fiber.Ctx) error {
 		"insertedIds": result.InsertedIDs,
 	}
 
-	// Serialize the result before returning
-	serializedResult, err := serializeOutput(wrappedResult)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to serialize result"})
+	if err := hooks.AfterResult(c, req, wrappedResult); err != nil {
+		return hookError(c, err)
+	}
+	if h.plainObjectIDs(doc) {
+		plainResultIDs(wrappedResult)
 	}
 
-	return c.JSON(serializedResult)
+	return respond(c, doc, wrappedResult)
+}
+
+// insertBatch is the outcome of one batch of a split insertMany. It is
+// rendered with the rest of the result as EJSON, hence the bson tags.
+type insertBatch struct {
+	// Start is the index of the batch's first document in the request
+	Start    int    `bson:"start"`
+	Count    int    `bson:"count"`
+	Inserted int    `bson:"inserted"`
+	Error    string `bson:"error,omitempty"`
+}
+
+// splitInsert splits documents into consecutive batches within the
+// server's limits of 100,000 documents and 16MB per write. A document that
+// cannot be inserted on its own gets a batch with an error.
+func splitInsert(docs []interface{}) []insertBatch {
+	var batches []insertBatch
+	batch, size := insertBatch{}, 0
+	for i, d := range docs {
+		raw, err := bson.Marshal(d)
+		if err == nil && len(raw) > maxBatchBytes {
+			err = errors.New("document exceeds the 16MB size limit")
+		}
+		if err != nil {
+			if batch.Count > 0 {
+				batches = append(batches, batch)
+			}
+			batches = append(batches, insertBatch{Start: i, Count: 1, Error: err.Error()})
+			batch, size = insertBatch{Start: i + 1}, 0
+			continue
+		}
+		if batch.Count == maxBatchDocuments || size+len(raw) > maxBatchBytes {
+			batches = append(batches, batch)
+			batch, size = insertBatch{Start: i}, 0
+		}
+		batch.Count++
+		size += len(raw)
+	}
+	if batch.Count > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// insertBatches inserts documents batch by batch and responds with the
+// outcome of each batch and the combined ids. Batches are ordered
+// internally; a failed batch does not stop the following ones. ctx limits
+// each batch.
+func (h *Data) insertBatches(c *fiber.Ctx, ctx context.Context, req *hooks.Request, database string, docs []interface{}, batches []insertBatch, doc *Document) error {
+	insertedIDs := make([]interface{}, 0, len(docs))
+	failed := 0
+	for i := range batches {
+		b := &batches[i]
+		if b.Error == "" {
+			result, err := h.Store.InsertMany(ctx, database, req.Collection, docs[b.Start:b.Start+b.Count])
+			if err == nil {
+				b.Inserted = b.Count
+			} else {
+				b.Error = err.Error()
+				var bwe mongo.BulkWriteException
+				switch {
+				case errors.As(err, &bwe) && len(bwe.WriteErrors) > 0:
+					b.Inserted = bwe.WriteErrors[0].Index
+				case result != nil && len(result.InsertedIDs) < b.Count:
+					b.Inserted = len(result.InsertedIDs)
+				}
+			}
+			if result != nil {
+				insertedIDs = append(insertedIDs, result.InsertedIDs[:b.Inserted]...)
+			}
+		}
+		failed += b.Count - b.Inserted
+	}
+
+	wrappedResult := map[string]interface{}{
+		"insertedIds":   insertedIDs,
+		"insertedCount": len(insertedIDs),
+		"failedCount":   failed,
+		"batches":       batches,
+	}
+	if err := hooks.AfterResult(c, req, wrappedResult); err != nil {
+		return hookError(c, err)
+	}
+	if h.plainObjectIDs(doc) {
+		plainResultIDs(wrappedResult)
+	}
+	if failed > 0 {
+		c.Status(fiber.StatusMultiStatus)
+	}
+	return respond(c, doc, wrappedResult)
 }
 
 // FindOne handles single document retrieval
-func FindOne(c *fiber.Ctx) error {
+func (h *Data) FindOne(c *fiber.Ctx) error {
 	var doc Document
-	if err := c.BodyParser(&doc); err != nil {
+	if err := parseBody(c, &doc, h.StrictBodies); err != nil {
 		log.Printf("Error parsing request body: %v", err)
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	deserializedFilter, err := deserializeInput(doc.Filter)
-	if err != nil {
-		log.Printf("Failed to deserialize filter: %v", err)
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Failed to deserialize filter", "details": err.Error()})
+	return h.findOne(c, &doc)
+}
+
+func (h *Data) findOne(c *fiber.Ctx, doc *Document) error {
+	return h.findOneOr(c, doc, func(c *fiber.Ctx) error {
+		if wantsProtobuf(c) {
+			return h.respondProtobuf(c, doc, map[string]interface{}{"document": nil})
+		}
+		if wantsJSONAPI(c) {
+			return respondJSONAPI(c, doc, map[string]interface{}{"document": nil})
+		}
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{"document": nil})
+	})
+}
+
+// findOneOr runs a findOne, responding with notFound when no document
+// matches
+func (h *Data) findOneOr(c *fiber.Ctx, doc *Document, notFound fiber.Handler) error {
+	if _, err := responseFormat(c, doc); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := h.convertFields(doc); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := h.readDefaults(doc, false); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	req := hookRequest("findOne", doc)
+	req.Filter = h.filter(doc)
+	if err := hooks.BeforeRequest(c, req); err != nil {
+		return hookError(c, err)
 	}
 
-	collection := db.GetCollection(doc.Database, doc.Collection)
+	scope := tenant.FromCtx(c)
+	filter := andFilter(scope.Filter(req.Filter), publicFilter(c, doc))
 
-	findOptions := options.FindOne()
-	if doc.Projection != nil {
-		findOptions.SetProjection(doc.Projection)
+	database, err := h.database(c, "findOne", doc)
+	if err != nil {
+		return denied(c, err)
 	}
+	defer observe(c, "findOne", doc.Database, doc.Collection)()
 
+	computed, err := h.computedFields(doc)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
 	var result bson.M
-	err = collection.FindOne(context.Background(), deserializedFilter, findOptions).Decode(&result)
+	if len(computed) > 0 {
+		findOptions := options.Find().SetLimit(1)
+		if doc.Projection != nil {
+			findOptions.SetProjection(doc.Projection)
+		}
+		pipeline, aggregateOptions := findPipeline(filter, findOptions, computed)
+		var results []bson.M
+		results, err = h.Store.Aggregate(limitedContext(c, doc, h.MaxTime.Read), database, doc.Collection, pipeline, aggregateOptions)
+		if err == nil && len(results) == 0 {
+			err = mongo.ErrNoDocuments
+		} else if err == nil {
+			result = results[0]
+		}
+	} else {
+		findOptions := options.FindOne()
+		if doc.Projection != nil {
+			findOptions.SetProjection(doc.Projection)
+		}
+		result, err = h.Store.FindOne(limitedContext(c, doc, h.MaxTime.Read), database, doc.Collection, filter, findOptions)
+	}
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			return c.Status(fiber.StatusOK).JSON(fiber.Map{"document": nil})
+			return notFound(c)
 		}
 		log.Printf("Error executing FindOne: %v", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
@@ -172,31 +594,70 @@ func FindOne(c *fiber.Ctx) error {
 	wrappedResult := map[string]interface{}{
 		"document": result,
 	}
-
-	serializedResult, err := serializeOutput(wrappedResult)
-	if err != nil {
-		log.Printf("Failed to serialize result: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to serialize result"})
+	if err := hooks.AfterResult(c, req, wrappedResult); err != nil {
+		return hookError(c, err)
+	}
+	if render := h.documentRenderer(c, doc); render != nil {
+		renderDocuments(wrappedResult, render)
+	}
+	if wantsProtobuf(c) {
+		return h.respondProtobuf(c, doc, wrappedResult)
+	}
+	if wantsJSONAPI(c) {
+		return respondJSONAPI(c, doc, wrappedResult)
 	}
 
-	return c.JSON(serializedResult)
+	return respond(c, doc, wrappedResult)
 }
 
 // Find handles multiple document retrieval
-func Find(c *fiber.Ctx) error {
+func (h *Data) Find(c *fiber.Ctx) error {
 	var doc Document
-	if err := c.BodyParser(&doc); err != nil {
+	if err := parseBody(c, &doc, h.StrictBodies); err != nil {
 		log.Printf("Error parsing request body: %v", err)
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	deserializedFilter, err := deserializeInput(doc.Filter)
-	if err != nil {
-		log.Printf("Failed to deserialize filter: %v", err)
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Failed to deserialize filter", "details": err.Error()})
+	return h.find(c, &doc)
+}
+
+func (h *Data) find(c *fiber.Ctx, doc *Document) error {
+	if _, err := responseFormat(c, doc); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := h.convertFields(doc); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if doc.BatchSize < 0 || doc.BatchSize > maxCursorBatch {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "batchSize must be between 1 and 100000"})
+	}
+	if err := h.readDefaults(doc, true); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	req := hookRequest("find", doc)
+	req.Filter = h.filter(doc)
+	if err := hooks.BeforeRequest(c, req); err != nil {
+		return hookError(c, err)
 	}
+	public := publicFilter(c, doc)
 
-	collection := db.GetCollection(doc.Database, doc.Collection)
+	var pages *keyset
+	if doc.Keyset || doc.PageAfter != "" || doc.PageBefore != "" {
+		var err error
+		if pages, err = newKeyset(doc); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+
+	scope := tenant.FromCtx(c)
+	filter := andFilter(scope.Filter(req.Filter), public)
+
+	database, err := h.database(c, "find", doc)
+	if err != nil {
+		return denied(c, err)
+	}
+	defer observe(c, "find", doc.Database, doc.Collection)()
 
 	findOptions := options.Find()
 	if doc.Projection != nil {
@@ -211,56 +672,156 @@ func Find(c *fiber.Ctx) error {
 	if doc.Skip > 0 {
 		findOptions.SetSkip(doc.Skip)
 	}
+	if doc.BatchSize > 0 {
+		findOptions.SetBatchSize(doc.BatchSize)
+	}
+
+	ctx := limitedContext(c, doc, h.MaxTime.Read)
+	var total func() (int64, error)
+	// HEAD requests get the total count header either way, but their body,
+	// and so its ETag, stays that of the GET
+	if doc.IncludeTotalCount || c.Method() == fiber.MethodHead {
+		total = h.countTotal(ctx, database, doc.Collection, filter)
+	}
+	if pages != nil {
+		// One more document than the page tells whether another page follows
+		filter = pages.filter(filter)
+		findOptions.SetSort(pages.querySort()).SetLimit(pages.limit + 1)
+	}
 
-	cursor, err := collection.Find(context.Background(), deserializedFilter, findOptions)
+	computed, err := h.computedFields(doc)
 	if err != nil {
-		log.Printf("Error executing Find: %v", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 	}
-	defer cursor.Close(context.Background())
-
-	results := make([]bson.M, 0)
-	if err := cursor.All(context.Background(), &results); err != nil {
-		log.Printf("Error decoding results: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to decode results"})
+	if !hooks.Registered(req) && pages == nil && len(computed) == 0 && plainJSON(c, doc) {
+		if doc.BatchSize == 0 {
+			findOptions.SetBatchSize(streamBatchSize)
+		}
+		return h.findEach(c, ctx, database, doc.Collection, filter, findOptions, total, doc.IncludeTotalCount, h.documentRenderer(c, doc))
+	}
+	var results []bson.M
+	if len(computed) > 0 {
+		pipeline, aggregateOptions := findPipeline(filter, findOptions, computed)
+		results, err = h.Store.Aggregate(ctx, database, doc.Collection, pipeline, aggregateOptions)
+	} else {
+		results, err = h.Store.Find(ctx, database, doc.Collection, filter, findOptions)
+	}
+	if err != nil {
+		log.Printf("Error executing Find: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 	}
 
 	wrappedResult := map[string]interface{}{
 		"documents": results,
 	}
-
-	serializedResult, err := serializeOutput(wrappedResult)
-	if err != nil {
-		log.Printf("Failed to serialize result: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to serialize result"})
+	if pages != nil {
+		docs, next, prev, err := pages.page(results)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		wrappedResult["documents"] = docs
+		if next != "" {
+			wrappedResult["nextPage"] = next
+		}
+		if prev != "" {
+			wrappedResult["prevPage"] = prev
+		}
+	}
+	if total != nil {
+		n, err := total()
+		if err != nil {
+			log.Printf("Error counting documents: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		if doc.IncludeTotalCount {
+			wrappedResult["totalCount"] = n
+		}
+		c.Set(HeaderTotalCount, strconv.FormatInt(n, 10))
 	}
+	if err := hooks.AfterResult(c, req, wrappedResult); err != nil {
+		return hookError(c, err)
+	}
+	if render := h.documentRenderer(c, doc); render != nil {
+		renderDocuments(wrappedResult, render)
+	}
+	if wantsProtobuf(c) {
+		return h.respondProtobuf(c, doc, wrappedResult)
+	}
+	if wantsJSONAPI(c) {
+		return respondJSONAPI(c, doc, wrappedResult)
+	}
+
+	return respond(c, doc, wrappedResult)
+}
+
+// HeaderTotalCount is the response header holding the total count of a
+// find with includeTotalCount or of a HEAD request
+const HeaderTotalCount = "X-Total-Count"
 
-	return c.JSON(serializedResult)
+// countTotal starts counting the documents matching filter while the find
+// runs; the returned function waits for the count
+func (h *Data) countTotal(ctx context.Context, database, collection string, filter interface{}) func() (int64, error) {
+	type result struct {
+		n   int64
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		n, err := h.Store.CountDocuments(ctx, database, collection, filter)
+		done <- result{n, err}
+	}()
+	return func() (int64, error) {
+		r := <-done
+		return r.n, r.err
+	}
 }
 
 // UpdateOne handles updating a single document
-func UpdateOne(c *fiber.Ctx) error {
+func (h *Data) UpdateOne(c *fiber.Ctx) error {
 	var doc Document
-	if err := c.BodyParser(&doc); err != nil {
+	if err := parseBody(c, &doc, h.StrictBodies); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	deserializedFilter, err := deserializeInput(doc.Filter)
-	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Failed to deserialize filter"})
+	return h.updateOne(c, &doc)
+}
+
+func (h *Data) updateOne(c *fiber.Ctx, doc *Document) error {
+	if _, err := responseFormat(c, doc); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := h.convertFields(doc); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
+	req := hookRequest("updateOne", doc)
+	req.Filter, req.Update = h.filter(doc), doc.Update
+	if err := hooks.BeforeRequest(c, req); err != nil {
+		return hookError(c, err)
+	}
+	update := req.Update
 
-	deserializedUpdate, err := deserializeInput(doc.Update)
-	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Failed to deserialize update"})
+	scope := tenant.FromCtx(c)
+	if err := scope.Update(update); err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
 	}
+	filter := scope.Filter(req.Filter)
 
-	collection := db.GetCollection(doc.Database, doc.Collection)
+	database, err := h.database(c, "updateOne", doc)
+	if err != nil {
+		return denied(c, err)
+	}
+	if err := h.authorizeUpsert(c, doc); err != nil {
+		return denied(c, err)
+	}
+	if err := checkShardKey("updateOne", h.shardKey(doc), filter, update, true, doc.Upsert); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer observe(c, "updateOne", doc.Database, doc.Collection)()
 	opts := options.Update()
 	if doc.Upsert {
 		opts.SetUpsert(true)
 	}
-	result, err := collection.UpdateOne(context.Background(), deserializedFilter, deserializedUpdate, opts)
+	result, err := h.Store.UpdateOne(limitedContext(c, doc, h.MaxTime.Write), database, doc.Collection, filter, update, opts)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 	}
@@ -271,38 +832,68 @@ func UpdateOne(c *fiber.Ctx) error {
 		"modifiedCount": result.ModifiedCount,
 		"matchedCount":  result.MatchedCount,
 	}
-
-	serializedResult, err := serializeOutput(wrappedResult)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to serialize result"})
+	if err := hooks.AfterResult(c, req, wrappedResult); err != nil {
+		return hookError(c, err)
+	}
+	if h.plainObjectIDs(doc) {
+		plainResultIDs(wrappedResult)
+	}
+	if doc.pinned && result.MatchedCount == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "The document changed while the patch was applied; retry"})
+	}
+	if doc.FailOnNoMatch && result.MatchedCount == 0 && result.UpsertedCount == 0 {
+		return noMatch(c)
 	}
 
-	return c.JSON(serializedResult)
+	return respond(c, doc, wrappedResult)
 }
 
 // UpdateMany handles updating multiple documents
-func UpdateMany(c *fiber.Ctx) error {
+func (h *Data) UpdateMany(c *fiber.Ctx) error {
 	var doc Document
-	if err := c.BodyParser(&doc); err != nil {
+	if err := parseBody(c, &doc, h.StrictBodies); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	deserializedFilter, err := deserializeInput(doc.Filter)
-	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Failed to deserialize filter"})
+	return h.updateMany(c, &doc)
+}
+
+func (h *Data) updateMany(c *fiber.Ctx, doc *Document) error {
+	if _, err := responseFormat(c, doc); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := h.convertFields(doc); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
+	req := hookRequest("updateMany", doc)
+	req.Filter, req.Update = h.filter(doc), doc.Update
+	if err := hooks.BeforeRequest(c, req); err != nil {
+		return hookError(c, err)
+	}
+	update := req.Update
 
-	deserializedUpdate, err := deserializeInput(doc.Update)
-	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Failed to deserialize update"})
+	scope := tenant.FromCtx(c)
+	if err := scope.Update(update); err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
 	}
+	filter := scope.Filter(req.Filter)
 
-	collection := db.GetCollection(doc.Database, doc.Collection)
+	database, err := h.database(c, "updateMany", doc)
+	if err != nil {
+		return denied(c, err)
+	}
+	if err := h.authorizeUpsert(c, doc); err != nil {
+		return denied(c, err)
+	}
+	if err := checkShardKey("updateMany", h.shardKey(doc), filter, update, false, doc.Upsert); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer observe(c, "updateMany", doc.Database, doc.Collection)()
 	opts := options.Update()
 	if doc.Upsert {
 		opts.SetUpsert(true)
 	}
-	result, err := collection.UpdateMany(context.Background(), deserializedFilter, deserializedUpdate, opts)
+	result, err := h.Store.UpdateMany(limitedContext(c, doc, h.MaxTime.Write), database, doc.Collection, filter, update, opts)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 	}
@@ -311,122 +902,380 @@ func UpdateMany(c *fiber.Ctx) error {
 		"modifiedCount": result.ModifiedCount,
 		"matchedCount":  result.MatchedCount,
 	}
-
-	serializedResult, err := serializeOutput(wrappedResult)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to serialize result"})
+	if err := hooks.AfterResult(c, req, wrappedResult); err != nil {
+		return hookError(c, err)
+	}
+	if doc.pinned && result.MatchedCount == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "The document changed while the patch was applied; retry"})
+	}
+	if doc.FailOnNoMatch && result.MatchedCount == 0 && result.UpsertedCount == 0 {
+		return noMatch(c)
 	}
 
-	return c.JSON(serializedResult)
+	return respond(c, doc, wrappedResult)
 }
 
 // DeleteOne handles deleting a single document
-func DeleteOne(c *fiber.Ctx) error {
+func (h *Data) DeleteOne(c *fiber.Ctx) error {
 	var doc Document
-	if err := c.BodyParser(&doc); err != nil {
+	if err := parseBody(c, &doc, h.StrictBodies); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	// Deserialize the filter
-	deserializedFilter, err := deserializeInput(doc.Filter)
-	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Failed to deserialize filter"})
+	return h.deleteOne(c, &doc)
+}
+
+func (h *Data) deleteOne(c *fiber.Ctx, doc *Document) error {
+	if _, err := responseFormat(c, doc); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := h.convertFields(doc); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
+	req := hookRequest("deleteOne", doc)
+	req.Filter = h.filter(doc)
+	if err := hooks.BeforeRequest(c, req); err != nil {
+		return hookError(c, err)
+	}
+
+	scope := tenant.FromCtx(c)
+	filter := scope.Filter(req.Filter)
 
-	collection := db.GetCollection(doc.Database, doc.Collection)
-	result, err := collection.DeleteOne(context.Background(), deserializedFilter)
+	database, err := h.database(c, "deleteOne", doc)
+	if err != nil {
+		return denied(c, err)
+	}
+	if err := checkShardKey("deleteOne", h.shardKey(doc), filter, nil, true, false); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer observe(c, "deleteOne", doc.Database, doc.Collection)()
+	result, err := h.Store.DeleteOne(limitedContext(c, doc, h.MaxTime.Write), database, doc.Collection, filter)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	// Wrap the result in a map to serialize
-	wrappedResult := map[string]interface{}{
-		"result": result,
-	}
+	wrappedResult := h.deleteResult(result)
 
-	// Serialize the result before returning
-	serializedResult, err := serializeOutput(wrappedResult)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to serialize result"})
+	if err := hooks.AfterResult(c, req, wrappedResult); err != nil {
+		return hookError(c, err)
+	}
+	if doc.FailOnNoMatch && result.DeletedCount == 0 {
+		return noMatch(c)
 	}
 
-	return c.JSON(serializedResult)
+	return respond(c, doc, wrappedResult)
 }
 
 // DeleteMany handles deleting multiple documents
-func DeleteMany(c *fiber.Ctx) error {
+func (h *Data) DeleteMany(c *fiber.Ctx) error {
 	var doc Document
-	if err := c.BodyParser(&doc); err != nil {
+	if err := parseBody(c, &doc, h.StrictBodies); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	// Deserialize the filter
-	deserializedFilter, err := deserializeInput(doc.Filter)
-	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Failed to deserialize filter"})
+	return h.deleteMany(c, &doc)
+}
+
+func (h *Data) deleteMany(c *fiber.Ctx, doc *Document) error {
+	if _, err := responseFormat(c, doc); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := h.convertFields(doc); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	req := hookRequest("deleteMany", doc)
+	req.Filter = h.filter(doc)
+	if err := hooks.BeforeRequest(c, req); err != nil {
+		return hookError(c, err)
 	}
 
-	collection := db.GetCollection(doc.Database, doc.Collection)
-	result, err := collection.DeleteMany(context.Background(), deserializedFilter)
+	scope := tenant.FromCtx(c)
+	filter := scope.Filter(req.Filter)
+
+	database, err := h.database(c, "deleteMany", doc)
+	if err != nil {
+		return denied(c, err)
+	}
+	defer observe(c, "deleteMany", doc.Database, doc.Collection)()
+	result, err := h.Store.DeleteMany(limitedContext(c, doc, h.MaxTime.Write), database, doc.Collection, filter)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	// Wrap the result in a map to serialize
-	wrappedResult := map[string]interface{}{
-		"result": result,
+	wrappedResult := h.deleteResult(result)
+
+	if err := hooks.AfterResult(c, req, wrappedResult); err != nil {
+		return hookError(c, err)
+	}
+	if doc.FailOnNoMatch && result.DeletedCount == 0 {
+		return noMatch(c)
 	}
 
-	// Serialize the result before returning
-	serializedResult, err := serializeOutput(wrappedResult)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to serialize result"})
+	return respond(c, doc, wrappedResult)
+}
+
+// deleteResult renders the result of a delete as deletedCount, or as the
+// driver's result under "result" for deployments on the legacy shape
+func (h *Data) deleteResult(result *mongo.DeleteResult) map[string]interface{} {
+	if h.LegacyDeleteResults {
+		return map[string]interface{}{"result": result}
 	}
+	return map[string]interface{}{"deletedCount": result.DeletedCount}
+}
 
-	return c.JSON(serializedResult)
+// noMatch responds to a write with failOnNoMatch that matched no document
+func noMatch(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "No document matched the filter"})
 }
 
 // Aggregate handles aggregation pipeline operations
-func Aggregate(c *fiber.Ctx) error {
+func (h *Data) Aggregate(c *fiber.Ctx) error {
 	var doc Document
-	if err := c.BodyParser(&doc); err != nil {
+	if err := parseBody(c, &doc, h.StrictBodies); err != nil {
 		log.Printf("Error parsing request body: %v", err)
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	// Deserialize the pipeline
-	deserializedPipeline, err := deserializeInput(doc.Pipeline)
+	return h.aggregate(c, &doc)
+}
+
+func (h *Data) aggregate(c *fiber.Ctx, doc *Document) error {
+	if _, err := responseFormat(c, doc); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if doc.BatchSize < 0 || doc.BatchSize > maxCursorBatch {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "batchSize must be between 1 and 100000"})
+	}
+
+	req := hookRequest("aggregate", doc)
+	req.Pipeline = doc.Pipeline
+	if err := hooks.BeforeRequest(c, req); err != nil {
+		return hookError(c, err)
+	}
+
+	computed, err := h.computedFields(doc)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	scope := tenant.FromCtx(c)
+	pipeline, err := scope.Pipeline(withComputedFields(req.Pipeline, computed))
 	if err != nil {
-		log.Printf("Failed to deserialize pipeline: %v", err)
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Failed to deserialize pipeline", "details": err.Error()})
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	collection := db.GetCollection(doc.Database, doc.Collection)
+	database, err := h.database(c, "aggregate", doc)
+	if err != nil {
+		return denied(c, err)
+	}
+	if err := auth.AuthorizeJoins(c, h.CrossDatabaseJoins, doc.Database, doc.Collection, req.Pipeline); err != nil {
+		return denied(c, err)
+	}
+	defer observe(c, "aggregate", doc.Database, doc.Collection)()
+
+	output, err := auth.OutputNamespace(req.Pipeline, doc.Database)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if output != nil {
+		// Writing to a collection needs its own permission on the target
+		if err := auth.Authorize(c, "aggregateWrite", output.Database, output.Collection); err != nil {
+			return denied(c, err)
+		}
+		target := scope.Database(output.Database)
+		run := func(ctx context.Context, _ string, _ func(interface{})) (interface{}, error) {
+			if err := h.Store.AggregateWrite(ctx, database, doc.Collection, pipeline); err != nil {
+				return nil, err
+			}
+			count, err := h.Store.CountDocuments(ctx, target, output.Collection, scope.Filter(nil))
+			if err != nil {
+				return nil, err
+			}
+			return writeSummary{Namespace: *output, Documents: count}, nil
+		}
+		if doc.Async {
+			return startJob(c, h.Jobs, "aggregate", run)
+		}
+		summary, err := run(limitedContext(c, doc, h.MaxTime.Aggregate), "", nil)
+		if err != nil {
+			log.Printf("Aggregation error: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Aggregation failed", "details": err.Error()})
+		}
+		return c.JSON(summary)
+	}
+	if doc.Async {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "async aggregations must end with a $out or $merge stage"})
+	}
 
 	// Execute the aggregation
-	cursor, err := collection.Aggregate(context.Background(), deserializedPipeline)
+	aggregateOptions := options.Aggregate()
+	if doc.BatchSize > 0 {
+		aggregateOptions.SetBatchSize(doc.BatchSize)
+	}
+	results, err := h.Store.Aggregate(limitedContext(c, doc, h.MaxTime.Aggregate), database, doc.Collection, h.limitAggregation(pipeline), aggregateOptions)
 	if err != nil {
 		log.Printf("Aggregation error: %v", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Aggregation failed", "details": err.Error()})
 	}
-	defer cursor.Close(context.Background())
-
-	results := make([]bson.M, 0)
-	if err = cursor.All(context.Background(), &results); err != nil {
-		log.Printf("Error reading aggregation results: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to read aggregation results", "details": err.Error()})
+	results, truncated, err := h.truncateResults(results)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 	}
 
 	wrappedResults := map[string]interface{}{
 		"documents": results,
 	}
+	if truncated != "" {
+		wrappedResults["truncated"], wrappedResults["warning"] = true, truncated
+		c.Set(HeaderTruncated, "true")
+	}
+	if err := hooks.AfterResult(c, req, wrappedResults); err != nil {
+		return hookError(c, err)
+	}
+	if render := h.documentRenderer(c, doc); render != nil {
+		renderDocuments(wrappedResults, render)
+	}
+
+	return respond(c, doc, wrappedResults)
+}
+
+// writeSummary is the response to an aggregation ending in $out or $merge
+type writeSummary struct {
+	auth.Namespace
+	// Documents is the number of documents in the target collection after
+	// the write
+	Documents int64 `json:"documents"`
+}
+
+// field returns the value of key in d, or nil
+func field(d bson.D, key string) interface{} {
+	for _, e := range d {
+		if e.Key == key {
+			return e.Value
+		}
+	}
+	return nil
+}
 
-	// Serialize the results before returning
-	serializedResults, err := serializeOutput(wrappedResults)
+// normalize renders a deserialized value as canonical EJSON
+func normalize(value interface{}) (interface{}, error) {
+	ejsonBytes, err := bson.MarshalExtJSON(bson.D{{Key: "v", Value: value}}, true, false)
 	if err != nil {
-		log.Printf("Failed to serialize results: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to serialize results", "details": err.Error()})
+		return nil, err
+	}
+	var wrapped map[string]interface{}
+	if err := json.Unmarshal(ejsonBytes, &wrapped); err != nil {
+		return nil, err
+	}
+	return wrapped["v"], nil
+}
+
+// queryParts are the inputs of /api/validateQuery. They are kept raw so that
+// an invalid part is reported on its own instead of failing the request.
+type queryParts struct {
+	Filter   json.RawMessage `json:"filter"`
+	Update   json.RawMessage `json:"update"`
+	Pipeline json.RawMessage `json:"pipeline"`
+}
+
+// ValidateQuery parses and analyzes a filter, update and/or pipeline without
+// executing anything
+func (h *Data) ValidateQuery(c *fiber.Ctx) error {
+	var parts queryParts
+	if err := c.BodyParser(&parts); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if parts.Filter == nil && parts.Update == nil && parts.Pipeline == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "One of filter, update or pipeline is required"})
+	}
+
+	response := fiber.Map{}
+	valid := true
+	analyze := func(name string, input json.RawMessage, check func(interface{}) query.Report) {
+		var deserialized interface{}
+		if err := bson.UnmarshalExtJSON(input, false, &deserialized); err != nil {
+			response[name] = query.Report{Errors: []string{err.Error()}, Operators: []string{}, Warnings: []string{}}
+			valid = false
+			return
+		}
+		report := check(deserialized)
+		var err error
+		if report.Normalized, err = normalize(deserialized); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			report.Valid = false
+		}
+		valid = valid && report.Valid
+		response[name] = report
 	}
 
-	return c.JSON(serializedResults)
+	if parts.Filter != nil {
+		analyze("filter", parts.Filter, query.Filter)
+	}
+	if parts.Update != nil {
+		analyze("update", parts.Update, query.Update)
+	}
+	if parts.Pipeline != nil {
+		analyze("pipeline", parts.Pipeline, query.Pipeline)
+	}
+	response["valid"] = valid
+
+	return c.JSON(response)
+}
+
+// parseBody decodes the EJSON request body into v. When strict, top-level
+// fields that v has no field for are rejected rather than ignored, so that
+// a misspelled filter does not match every document.
+func parseBody(c *fiber.Ctx, v interface{}, strict bool) error {
+	if err := bson.UnmarshalExtJSON(c.Body(), false, v); err != nil || !strict {
+		return err
+	}
+	unknown, err := unknownFields(c.Body(), v)
+	if err != nil {
+		return err
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("unknown fields: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// respond writes result to the response body in the format the request
+// negotiated. Formats writing the whole result put it in the envelope of
+// the requesting API key. Pretty JSON is encoded first and then indented.
+func respond(c *fiber.Ctx, doc *Document, result map[string]interface{}) error {
+	format, err := responseFormat(c, doc)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if env := envelope(c); env != nil && !format.Rows {
+		result = applyEnvelope(env, result)
+	}
+	c.Response().ResetBody()
+	if pretty(c, doc) && (format.Name == formats.JSON || format.Name == formats.EJSON) {
+		var buf bytes.Buffer
+		if err = format.Encoder.Encode(&buf, result); err == nil {
+			err = formats.Indent(c.Response().BodyWriter(), buf.Bytes())
+		}
+	} else {
+		err = format.Encoder.Encode(c.Response().BodyWriter(), result)
+	}
+	if err != nil {
+		c.Response().ResetBody()
+		log.Printf("Failed to serialize result as %s: %v", format.Name, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to serialize result", "details": err.Error()})
+	}
+	c.Set(fiber.HeaderContentType, format.MediaType)
+	return nil
+}
+
+// writeResponse writes result to the response body as relaxed EJSON of
+// the given content type
+func writeResponse(c *fiber.Ctx, result interface{}, contentType string) error {
+	c.Response().ResetBody()
+	if err := formats.WriteEJSON(c.Response().BodyWriter(), result, false); err != nil {
+		c.Response().ResetBody()
+		log.Printf("Failed to serialize result: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to serialize result", "details": err.Error()})
+	}
+	c.Set(fiber.HeaderContentType, contentType)
+	return nil
 }
@@ -0,0 +1,4122 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"mongo-data-api-go-alternative/auth"
+	"mongo-data-api-go-alternative/config"
+	"mongo-data-api-go-alternative/db"
+	memstore "mongo-data-api-go-alternative/db/memory"
+	"mongo-data-api-go-alternative/db/mock"
+	"mongo-data-api-go-alternative/history"
+	"mongo-data-api-go-alternative/importer"
+	"mongo-data-api-go-alternative/jobs"
+	"mongo-data-api-go-alternative/metrics"
+	"mongo-data-api-go-alternative/migrations"
+	"mongo-data-api-go-alternative/mirror"
+	"mongo-data-api-go-alternative/protoschema"
+	"mongo-data-api-go-alternative/query"
+	"mongo-data-api-go-alternative/retention"
+	"mongo-data-api-go-alternative/script"
+	"mongo-data-api-go-alternative/sessions"
+	"mongo-data-api-go-alternative/shadow"
+	"mongo-data-api-go-alternative/tabular"
+	"mongo-data-api-go-alternative/trafficmirror"
+	"mongo-data-api-go-alternative/trash"
+	"mongo-data-api-go-alternative/warmup"
+
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/apache/arrow-go/v18/parquet/file"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/vmihailenco/msgpack/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const testKey = "test_key"
+
+var testOID, _ = primitive.ObjectIDFromHex("65a1b2c3d4e5f60718293a4b")
+
+// newTestApp registers the API and admin routes on store behind the API key
+// middleware, as server.New does
+func newTestApp(t *testing.T, store *mock.Store, cfg *config.Config) *fiber.App {
+	t.Helper()
+	if cfg == nil {
+		cfg = &config.Config{}
+	}
+	if cfg.APIKeys == nil {
+		cfg.APIKeys = []config.APIKey{{Name: "test", Key: testKey}}
+	}
+	if cfg.SystemDatabase == "" {
+		cfg.SystemDatabase = "dataapi_system"
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := auth.NewStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries, err := query.NewRegistry(cfg.SavedQueries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	protos, err := protoschema.Load(cfg.ProtoSchemas)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tokens *auth.Tokens
+	if cfg.TokenSecret != "" {
+		tokens = auth.NewTokens(cfg.TokenSecret, time.Hour)
+	}
+	var oauth *auth.OAuth
+	if cfg.OAuth.Enabled() {
+		oauth = auth.NewOAuth(cfg.OAuth)
+	}
+
+	endpoints, err := script.Load(cfg.Endpoints, store, script.Policy{CrossDatabaseJoins: cfg.CrossDatabaseJoins, RestrictUpserts: cfg.RestrictUpserts})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	maintenance := &auth.Maintenance{}
+
+	app := fiber.New(fiber.Config{StreamRequestBody: true})
+	app.Use(auth.Middleware(auth.MiddlewareConfig{Store: keys, Tenancy: cfg.Tenancy, Tokens: tokens, OAuth: oauth, ScopePrefix: cfg.OAuth.ScopePrefix, Public: cfg.PublicCollections, Maintenance: maintenance, ReadOnly: cfg.ReadOnly, SkipPaths: []string{"/api/admin*"}}))
+	manager := jobs.NewManager(t.TempDir())
+	var dataStore db.DataStore = store
+	var versions *history.Store
+	if len(cfg.VersionedCollections) > 0 {
+		versions = history.New(store, cfg.VersionedCollections, cfg.Tenancy.Mode == config.TenancyPrefix)
+		dataStore = versions
+	}
+	var trashed *trash.Store
+	if len(cfg.Trash.Collections) > 0 {
+		trashed = trash.New(dataStore, cfg.Trash, cfg.Tenancy.Mode == config.TenancyPrefix)
+		dataStore = trashed
+	}
+	clusters := map[string]db.DataStore{config.DefaultCluster: store, "backup": store}
+	data := &Data{Store: dataStore, Jobs: manager, MaxTime: cfg.MaxTimeMS, ShardKeys: cfg.ShardKeys, PlainObjectIDs: cfg.PlainObjectIDs, UUIDFields: cfg.UUIDFields, ComputedFields: cfg.ComputedFields, ReadDefaults: cfg.ReadDefaults, AggregateLimits: cfg.AggregateLimits, CrossDatabaseJoins: cfg.CrossDatabaseJoins, Clusters: clusters, FanOutReads: cfg.FanOutReads, TailIdleTimeout: time.Duration(cfg.TailIdleTimeoutSeconds) * time.Second, Protos: protos, StrictBodies: cfg.StrictBodies, LegacyDeleteResults: cfg.LegacyDeleteResults, RestrictUpserts: cfg.RestrictUpserts, NaturalKeys: cfg.NaturalKeys, History: versions, Trash: trashed}
+	routes := &Routes{
+		Data:      data,
+		Sessions:  &Sessions{Manager: sessions.NewManager(store, time.Minute)},
+		Clone:     &Clone{Clusters: clusters, Jobs: manager, StrictBodies: cfg.StrictBodies, RestrictUpserts: cfg.RestrictUpserts, UUIDFields: cfg.UUIDFields},
+		Stats:     &Stats{Store: store, TTL: time.Minute, MaxTime: cfg.MaxTimeMS},
+		Jobs:      &Jobs{Manager: manager},
+		Saved:     &SavedQueries{Registry: queries, Data: data},
+		Endpoints: endpoints,
+		ReadOnly:  cfg.ReadOnly,
+		RESTAPI:   cfg.RESTAPI,
+	}
+	if tokens != nil {
+		routes.Tokens = &Tokens{Signer: tokens}
+	}
+	api := app.Group("/api")
+	routes.Register(api)
+	admin := &Admin{Keys: keys, Queries: queries, Store: store, Retention: &retention.Manager{Store: store, Policies: cfg.Retention}, Warmer: &warmup.Warmer{Store: store, Queries: cfg.WarmQueries}, Maintenance: maintenance, Operations: store, Views: store, Cursors: db.NewCursorRegistry()}
+	if cfg.MigrationsDir != "" {
+		list, err := migrations.Load(cfg.MigrationsDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		admin.Migrations = &migrations.Runner{Store: store, Database: cfg.SystemDatabase, Migrations: list}
+	}
+	// The admin key middleware is left out, as the admin tests check the
+	// handlers
+	admin.Register(api.Group("/admin"))
+	return app
+}
+
+// call sends a request with the test API key and decodes the JSON response
+func call(t *testing.T, app *fiber.App, method, path, body string) (int, map[string]interface{}) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("apiKey", testKey)
+	res, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := io.ReadAll(res.Body)
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		t.Fatalf("invalid JSON response %q: %v", raw, err)
+	}
+	return res.StatusCode, decoded
+}
+
+func lastCall(t *testing.T, store *mock.Store, method string) mock.Call {
+	t.Helper()
+	c, ok := store.LastCall()
+	if !ok {
+		t.Fatalf("expected a %s call, got none", method)
+	}
+	if c.Method != method {
+		t.Fatalf("expected a %s call, got %s", method, c.Method)
+	}
+	return c
+}
+
+func assertJSON(t *testing.T, got interface{}, want string) {
+	t.Helper()
+	var w interface{}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatal(err)
+	}
+	g, _ := json.Marshal(got)
+	var gv interface{}
+	json.Unmarshal(g, &gv)
+	if !reflect.DeepEqual(gv, w) {
+		t.Errorf("got %s, want %s", g, want)
+	}
+}
+
+func TestInsertOne(t *testing.T) {
+	store := &mock.Store{InsertOneFunc: func(mock.Call) (*mongo.InsertOneResult, error) {
+		return &mongo.InsertOneResult{InsertedID: testOID}, nil
+	}}
+	app := newTestApp(t, store, nil)
+
+	status, body := call(t, app, "POST", "/api/insertOne",
+		`{"database":"app","collection":"users","document":{"name":"Ada","ref":{"$oid":"65a1b2c3d4e5f60718293a4b"}}}`)
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	assertJSON(t, body, `{"insertedId":{"$oid":"65a1b2c3d4e5f60718293a4b"}}`)
+
+	c := lastCall(t, store, "InsertOne")
+	if c.Database != "app" || c.Collection != "users" {
+		t.Errorf("namespace %s.%s", c.Database, c.Collection)
+	}
+	want := bson.D{{Key: "name", Value: "Ada"}, {Key: "ref", Value: testOID}}
+	if !reflect.DeepEqual(c.Documents[0], want) {
+		t.Errorf("document %v, want %v", c.Documents[0], want)
+	}
+}
+
+func TestInsertMany(t *testing.T) {
+	store := &mock.Store{InsertManyFunc: func(c mock.Call) (*mongo.InsertManyResult, error) {
+		return &mongo.InsertManyResult{InsertedIDs: []interface{}{int32(1), int32(2)}}, nil
+	}}
+	app := newTestApp(t, store, nil)
+
+	status, body := call(t, app, "POST", "/api/insertMany",
+		`{"database":"app","collection":"users","documents":[{"_id":1},{"_id":2}]}`)
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	assertJSON(t, body, `{"insertedIds":[1,2]}`)
+	if c := lastCall(t, store, "InsertMany"); len(c.Documents) != 2 {
+		t.Errorf("inserted %d documents, want 2", len(c.Documents))
+	}
+}
+
+func TestInsertManyBatches(t *testing.T) {
+	calls := 0
+	store := &mock.Store{InsertManyFunc: func(c mock.Call) (*mongo.InsertManyResult, error) {
+		calls++
+		ids := make([]interface{}, len(c.Documents))
+		for i := range ids {
+			ids[i] = int32(calls*1000000 + i)
+		}
+		if calls == 1 {
+			return &mongo.InsertManyResult{InsertedIDs: ids}, mongo.BulkWriteException{
+				WriteErrors: []mongo.BulkWriteError{{WriteError: mongo.WriteError{Index: 2, Message: "duplicate key"}}},
+			}
+		}
+		return &mongo.InsertManyResult{InsertedIDs: ids}, nil
+	}}
+	app := newTestApp(t, store, nil)
+
+	docs := strings.TrimSuffix(strings.Repeat(`{},`, maxBatchDocuments+1), ",")
+	status, body := call(t, app, "POST", "/api/insertMany", `{"database":"app","collection":"users","documents":[`+docs+`]}`)
+	if status != fiber.StatusMultiStatus {
+		t.Fatalf("status %d, want 207", status)
+	}
+	delete(body, "insertedIds")
+	assertJSON(t, body, `{"insertedCount":3,"failedCount":99998,"batches":[
+		{"start":0,"count":100000,"inserted":2,"error":"bulk write exception: write errors: [duplicate key]"},
+		{"start":100000,"count":1,"inserted":1}]}`)
+
+	big := bson.D{{Key: "s", Value: strings.Repeat("x", maxBatchBytes)}}
+	batches := splitInsert([]interface{}{bson.D{}, big, bson.D{}})
+	if len(batches) != 3 || batches[1].Error == "" || batches[0].Count != 1 || batches[2].Start != 2 {
+		t.Errorf("batches %+v, want the large document in a failed batch of its own", batches)
+	}
+}
+
+func TestInsertManyStream(t *testing.T) {
+	var batches [][]interface{}
+	store := &mock.Store{InsertManyFunc: func(c mock.Call) (*mongo.InsertManyResult, error) {
+		batches = append(batches, c.Documents)
+		return &mongo.InsertManyResult{}, nil
+	}}
+	app := newTestApp(t, store, nil)
+
+	docs := strings.Repeat(`{"n":1},`, 2*importer.DefaultBatchSize) + `{"n":{"$oid":"bad"}},{"n":2}`
+	status, body := call(t, app, "POST", "/api/insertMany?stream=true",
+		`{"database":"app","collection":"users","dataSource":"x","documents":[`+docs+`]}`)
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	delete(body, "errors")
+	assertJSON(t, body, `{"processed":2002,"inserted":2001,"upserted":0,"modified":0,"failed":1}`)
+	if len(batches) != 3 || len(batches[2]) != 1 {
+		t.Errorf("wrote %d batches, want 3", len(batches))
+	}
+
+	status, _ = call(t, app, "POST", "/api/insertMany?stream=true", `{"documents":[{}],"database":"app","collection":"users"}`)
+	if status != fiber.StatusBadRequest {
+		t.Errorf("documents before the namespace: status %d, want 400", status)
+	}
+
+	status, body = call(t, app, "POST", "/api/import?database=app&collection=users&stream=true&batchSize=2",
+		"{\"_id\":1}\n{\"_id\":2}\n{\"_id\":3}\n")
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	assertJSON(t, body, `{"processed":3,"inserted":3,"upserted":0,"modified":0,"failed":0}`)
+}
+
+func TestFindOne(t *testing.T) {
+	store := &mock.Store{FindOneFunc: func(mock.Call) (bson.M, error) {
+		return bson.M{"_id": testOID, "name": "Ada"}, nil
+	}}
+	app := newTestApp(t, store, nil)
+
+	status, body := call(t, app, "POST", "/api/findOne",
+		`{"database":"app","collection":"users","filter":{"name":"Ada"},"projection":{"name":1}}`)
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	assertJSON(t, body, `{"document":{"_id":{"$oid":"65a1b2c3d4e5f60718293a4b"},"name":"Ada"}}`)
+
+	c := lastCall(t, store, "FindOne")
+	if !reflect.DeepEqual(c.Filter, bson.D{{Key: "name", Value: "Ada"}}) {
+		t.Errorf("filter %v", c.Filter)
+	}
+	if opts := c.Options.(*options.FindOneOptions); opts.Projection == nil {
+		t.Error("projection was not passed")
+	}
+}
+
+func TestFindOneNotFound(t *testing.T) {
+	app := newTestApp(t, &mock.Store{}, nil)
+
+	status, body := call(t, app, "POST", "/api/findOne", `{"database":"app","collection":"users","filter":{"name":"Nobody"}}`)
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	assertJSON(t, body, `{"document":null}`)
+}
+
+func TestFindByID(t *testing.T) {
+	store := &mock.Store{FindOneFunc: func(mock.Call) (bson.M, error) {
+		return bson.M{"_id": testOID, "name": "Ada"}, nil
+	}}
+	app := newTestApp(t, store, nil)
+
+	status, body := call(t, app, "GET", "/api/collections/app/users/"+testOID.Hex()+"?fields=name,-address.zip", "")
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	assertJSON(t, body, `{"document":{"_id":{"$oid":"65a1b2c3d4e5f60718293a4b"},"name":"Ada"}}`)
+	c := lastCall(t, store, "FindOne")
+	want := bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: bson.A{testOID.Hex(), testOID}}}}}
+	if c.Database != "app" || c.Collection != "users" || !reflect.DeepEqual(c.Filter, want) {
+		t.Errorf("%s.%s filter %v", c.Database, c.Collection, c.Filter)
+	}
+	projection := c.Options.(*options.FindOneOptions).Projection
+	if !reflect.DeepEqual(projection, bson.D{{Key: "name", Value: int32(1)}, {Key: "address.zip", Value: int32(0)}}) {
+		t.Errorf("projection %v", projection)
+	}
+
+	call(t, app, "GET", "/api/collections/app/users/42", "")
+	if c := lastCall(t, store, "FindOne"); !reflect.DeepEqual(c.Filter, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: bson.A{"42", int64(42)}}}}}) {
+		t.Errorf("numeric id: filter %v", c.Filter)
+	}
+	call(t, app, "GET", "/api/collections/app/users/ada%40example.com", "")
+	if c := lastCall(t, store, "FindOne"); !reflect.DeepEqual(c.Filter, bson.D{{Key: "_id", Value: "ada@example.com"}}) {
+		t.Errorf("string id: filter %v", c.Filter)
+	}
+
+	app = newTestApp(t, &mock.Store{}, nil)
+	if status, body := call(t, app, "GET", "/api/collections/app/users/missing", ""); status != fiber.StatusNotFound {
+		t.Errorf("missing document: status %d: %v", status, body)
+	}
+}
+
+func TestOperationMetrics(t *testing.T) {
+	m := metrics.New(metrics.Options{})
+	app := newTestApp(t, &mock.Store{}, nil)
+	call(t, app, "POST", "/api/find", `{"database":"app","collection":"users"}`)
+	call(t, app, "POST", "/api/find", `{"database":"app","collection":"users"}`)
+	call(t, app, "GET", "/api/collections/app/orders/missing", "")
+	call(t, app, "GET", "/api/stats?database=app&collection=orders", "")
+
+	scrape := fiber.New()
+	m.RegisterAt(scrape, "/metrics")
+	res, err := scrape.Test(httptest.NewRequest("GET", "/metrics", nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := io.ReadAll(res.Body)
+	for _, want := range []string{
+		`mongodataapi_mongo_operation_duration_seconds_count{collection="users",database="app",operation="find",service="mongo-data-api",status="200"} 2`,
+		`mongodataapi_mongo_operation_duration_seconds_count{collection="orders",database="app",operation="findOne",service="mongo-data-api",status="404"} 1`,
+		`mongodataapi_mongo_operation_duration_seconds_count{collection="orders",database="app",operation="stats",service="mongo-data-api",status="200"} 1`,
+	} {
+		if !strings.Contains(string(raw), want) {
+			t.Errorf("missing %s in\n%s", want, raw)
+		}
+	}
+}
+
+func TestREST(t *testing.T) {
+	store := &mock.Store{
+		FindFunc: func(mock.Call) ([]bson.M, error) { return []bson.M{{"n": int32(1)}}, nil },
+		InsertOneFunc: func(mock.Call) (*mongo.InsertOneResult, error) {
+			return &mongo.InsertOneResult{InsertedID: int32(7)}, nil
+		},
+		InsertManyFunc: func(c mock.Call) (*mongo.InsertManyResult, error) {
+			return &mongo.InsertManyResult{InsertedIDs: []interface{}{int32(1), int32(2)}}, nil
+		},
+		UpdateOneFunc: func(mock.Call) (*mongo.UpdateResult, error) {
+			return &mongo.UpdateResult{MatchedCount: 1, ModifiedCount: 1}, nil
+		},
+		DeleteOneFunc: func(mock.Call) (*mongo.DeleteResult, error) {
+			return &mongo.DeleteResult{DeletedCount: 1}, nil
+		},
+	}
+	app := newTestApp(t, store, &config.Config{RESTAPI: true})
+
+	status, body := call(t, app, "GET", `/api/data/app/items?filter=`+url.QueryEscape(`{"n":{"$gt":0}}`)+`&sort=-n,name&limit=5&skip=10&fields=n`, "")
+	if status != fiber.StatusOK {
+		t.Fatalf("list: status %d: %v", status, body)
+	}
+	assertJSON(t, body, `{"documents":[{"n":1}]}`)
+	c := lastCall(t, store, "Find")
+	opts := c.Options.(*options.FindOptions)
+	if !reflect.DeepEqual(c.Filter, bson.D{{Key: "n", Value: bson.D{{Key: "$gt", Value: int32(0)}}}}) ||
+		!reflect.DeepEqual(opts.Sort, bson.D{{Key: "n", Value: int32(-1)}, {Key: "name", Value: int32(1)}}) ||
+		*opts.Limit != 5 || *opts.Skip != 10 || !reflect.DeepEqual(opts.Projection, bson.D{{Key: "n", Value: int32(1)}}) {
+		t.Errorf("list: filter %v, options %+v", c.Filter, opts)
+	}
+	call(t, app, "GET", `/api/data/app/items?sort=`+url.QueryEscape(`{"n":-1}`), "")
+	if opts := lastCall(t, store, "Find").Options.(*options.FindOptions); !reflect.DeepEqual(opts.Sort, bson.D{{Key: "n", Value: int32(-1)}}) {
+		t.Errorf("list: JSON sort %v", opts.Sort)
+	}
+	for _, query := range []string{"filter=%7Bbad", "limit=-1", "skip=x"} {
+		if status, _ := call(t, app, "GET", "/api/data/app/items?"+query, ""); status != fiber.StatusBadRequest {
+			t.Errorf("list with %s: status %d, want 400", query, status)
+		}
+	}
+
+	status, body = call(t, app, "POST", "/api/data/app/items", `{"name":"a","at":{"$date":"2024-01-02T00:00:00Z"}}`)
+	if status != fiber.StatusCreated {
+		t.Fatalf("create: status %d: %v", status, body)
+	}
+	if c := lastCall(t, store, "InsertOne"); c.Collection != "items" {
+		t.Errorf("create: inserted into %s", c.Collection)
+	}
+	if status, _ = call(t, app, "POST", "/api/data/app/items", `[{"name":"a"},{"name":"b"}]`); status != fiber.StatusCreated {
+		t.Errorf("create many: status %d", status)
+	}
+	if c := lastCall(t, store, "InsertMany"); len(c.Documents) != 2 {
+		t.Errorf("create many: inserted %v", c.Documents)
+	}
+
+	call(t, app, "PATCH", "/api/data/app/items/abc", `{"name":"b"}`)
+	c = lastCall(t, store, "UpdateOne")
+	if !reflect.DeepEqual(c.Filter, bson.D{{Key: "_id", Value: "abc"}}) ||
+		!reflect.DeepEqual(c.Update, bson.D{{Key: "$set", Value: bson.D{{Key: "name", Value: "b"}}}}) {
+		t.Errorf("patch: filter %v, update %v", c.Filter, c.Update)
+	}
+	call(t, app, "PATCH", "/api/data/app/items/abc", `{"$inc":{"n":1}}`)
+	if c := lastCall(t, store, "UpdateOne"); !reflect.DeepEqual(c.Update, bson.D{{Key: "$inc", Value: bson.D{{Key: "n", Value: int32(1)}}}}) {
+		t.Errorf("patch with operators: update %v", c.Update)
+	}
+	if status, _ := call(t, app, "PATCH", "/api/data/app/items/abc", `{"$inc":{"n":1},"name":"b"}`); status != fiber.StatusBadRequest {
+		t.Errorf("patch mixing fields and operators: status %d, want 400", status)
+	}
+
+	status, body = call(t, app, "DELETE", "/api/data/app/items/abc", "")
+	if status != fiber.StatusOK {
+		t.Errorf("delete: status %d: %v", status, body)
+	}
+	assertJSON(t, body, `{"deletedCount":1}`)
+	if c := lastCall(t, store, "DeleteOne"); !reflect.DeepEqual(c.Filter, bson.D{{Key: "_id", Value: "abc"}}) {
+		t.Errorf("delete: filter %v", c.Filter)
+	}
+}
+
+func TestRESTFilterExpression(t *testing.T) {
+	store := &mock.Store{}
+	app := newTestApp(t, store, &config.Config{RESTAPI: true})
+
+	date := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	for expr, want := range map[string]bson.D{
+		`status eq 'active' and age gt 30`: {{Key: "$and", Value: bson.A{
+			bson.D{{Key: "status", Value: bson.D{{Key: "$eq", Value: "active"}}}},
+			bson.D{{Key: "age", Value: bson.D{{Key: "$gt", Value: int64(30)}}}},
+		}}},
+		`not (a/b le -1.5 or c ne null) and d eq true`: {{Key: "$and", Value: bson.A{
+			bson.D{{Key: "$nor", Value: bson.A{bson.D{{Key: "$or", Value: bson.A{
+				bson.D{{Key: "a.b", Value: bson.D{{Key: "$lte", Value: -1.5}}}},
+				bson.D{{Key: "c", Value: bson.D{{Key: "$ne", Value: nil}}}},
+			}}}}}},
+			bson.D{{Key: "d", Value: bson.D{{Key: "$eq", Value: true}}}},
+		}}},
+		`name in ('O''Brien', 'Ada') or startswith(name, 'a.b')`: {{Key: "$or", Value: bson.A{
+			bson.D{{Key: "name", Value: bson.D{{Key: "$in", Value: bson.A{"O'Brien", "Ada"}}}}},
+			bson.D{{Key: "name", Value: bson.D{{Key: "$regex", Value: `^a\.b`}}}},
+		}}},
+		`created ge 2024-01-02`: {{Key: "created", Value: bson.D{{Key: "$gte", Value: date}}}},
+	} {
+		status, body := call(t, app, "GET", "/api/data/app/items?$filter="+url.QueryEscape(expr), "")
+		if status != fiber.StatusOK {
+			t.Errorf("%s: status %d: %v", expr, status, body)
+			continue
+		}
+		if c := lastCall(t, store, "Find"); !reflect.DeepEqual(c.Filter, want) {
+			t.Errorf("%s: filter %v, want %v", expr, c.Filter, want)
+		}
+	}
+
+	// filter and $filter are combined
+	call(t, app, "GET", "/api/data/app/items?filter="+url.QueryEscape(`{"a":1}`)+"&$filter="+url.QueryEscape("b eq 2"), "")
+	want := bson.D{{Key: "$and", Value: bson.A{
+		bson.D{{Key: "a", Value: int32(1)}},
+		bson.D{{Key: "b", Value: bson.D{{Key: "$eq", Value: int64(2)}}}},
+	}}}
+	if c := lastCall(t, store, "Find"); !reflect.DeepEqual(c.Filter, want) {
+		t.Errorf("combined filter %v", c.Filter)
+	}
+
+	for _, expr := range []string{"status eq", "status is 'a'", "(a eq 1", "a eq 'x", "$where eq 1", "a eq 1 b"} {
+		if status, _ := call(t, app, "GET", "/api/data/app/items?$filter="+url.QueryEscape(expr), ""); status != fiber.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", expr, status)
+		}
+	}
+}
+
+func TestRESTHeadAndOptions(t *testing.T) {
+	store := &mock.Store{
+		FindFunc:           func(mock.Call) ([]bson.M, error) { return []bson.M{{"_id": 1}}, nil },
+		CountDocumentsFunc: func(mock.Call) (int64, error) { return 42, nil },
+	}
+	app := newTestApp(t, store, &config.Config{RESTAPI: true})
+	send := func(method string, key bool) *http.Response {
+		req := httptest.NewRequest(method, "/api/data/app/users?limit=1", nil)
+		if key {
+			req.Header.Set("apiKey", testKey)
+		}
+		res, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	get := send("GET", true)
+	if get.Header.Get(HeaderTotalCount) != "" {
+		t.Errorf("GET total count %q", get.Header.Get(HeaderTotalCount))
+	}
+	head := send("HEAD", true)
+	if head.StatusCode != fiber.StatusOK || head.Header.Get(HeaderTotalCount) != "42" {
+		t.Errorf("HEAD status %d, total count %q", head.StatusCode, head.Header.Get(HeaderTotalCount))
+	}
+	// The body is the GET one, so that both have the same length and ETag
+	if head.Header.Get(fiber.HeaderContentLength) != get.Header.Get(fiber.HeaderContentLength) {
+		t.Errorf("HEAD length %s, GET length %s", head.Header.Get(fiber.HeaderContentLength), get.Header.Get(fiber.HeaderContentLength))
+	}
+
+	// OPTIONS needs no key to reach routing, which lists the methods
+	if res := send("OPTIONS", false); res.StatusCode == fiber.StatusUnauthorized || !strings.Contains(res.Header.Get(fiber.HeaderAllow), "GET") {
+		t.Errorf("OPTIONS status %d, Allow %q", res.StatusCode, res.Header.Get(fiber.HeaderAllow))
+	}
+}
+
+func TestSQL(t *testing.T) {
+	store := &mock.Store{
+		FindFunc:      func(mock.Call) ([]bson.M, error) { return []bson.M{{"name": "Ada"}}, nil },
+		AggregateFunc: func(mock.Call) ([]bson.M, error) { return []bson.M{{"city": "Paris", "n": int32(2)}}, nil },
+	}
+	app := newTestApp(t, store, nil)
+
+	status, body := call(t, app, "POST", "/api/sql", `{"query":"SELECT name, address.city FROM app.users WHERE age >= 18 AND (status IN ('a', 'b') OR name LIKE 'A_a%') AND email IS NOT NULL ORDER BY name DESC, age LIMIT 10 OFFSET 20"}`)
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	assertJSON(t, body, `{"documents":[{"name":"Ada"}]}`)
+	c := lastCall(t, store, "Find")
+	want := bson.D{{Key: "$and", Value: bson.A{
+		bson.D{{Key: "age", Value: bson.D{{Key: "$gte", Value: int64(18)}}}},
+		bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "status", Value: bson.D{{Key: "$in", Value: bson.A{"a", "b"}}}}},
+			bson.D{{Key: "name", Value: bson.D{{Key: "$regex", Value: "^A.a.*$"}}}},
+		}}},
+		bson.D{{Key: "email", Value: bson.D{{Key: "$ne", Value: nil}}}},
+	}}}
+	opts := c.Options.(*options.FindOptions)
+	if c.Database != "app" || c.Collection != "users" || !reflect.DeepEqual(c.Filter, want) {
+		t.Errorf("%s.%s filter %v", c.Database, c.Collection, c.Filter)
+	}
+	if !reflect.DeepEqual(opts.Projection, bson.D{{Key: "name", Value: int32(1)}, {Key: "address.city", Value: int32(1)}, {Key: "_id", Value: int32(0)}}) ||
+		!reflect.DeepEqual(opts.Sort, bson.D{{Key: "name", Value: int32(-1)}, {Key: "age", Value: int32(1)}}) ||
+		*opts.Limit != 10 || *opts.Skip != 20 {
+		t.Errorf("options %+v", opts)
+	}
+
+	status, body = call(t, app, "POST", "/api/sql", `{"query":"select address.city as city, count(*) n, avg(age) from app.users where not active = false group by address.city order by n desc limit 5;"}`)
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	assertJSON(t, body, `{"documents":[{"city":"Paris","n":2}]}`)
+	wantPipeline := bson.A{
+		bson.D{{Key: "$match", Value: bson.D{{Key: "$nor", Value: bson.A{bson.D{{Key: "active", Value: bson.D{{Key: "$eq", Value: false}}}}}}}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "k0", Value: "$address.city"}}},
+			{Key: "a1", Value: bson.D{{Key: "$sum", Value: int32(1)}}},
+			{Key: "a2", Value: bson.D{{Key: "$avg", Value: "$age"}}},
+		}}},
+		bson.D{{Key: "$project", Value: bson.D{{Key: "_id", Value: int32(0)}, {Key: "city", Value: "$_id.k0"}, {Key: "n", Value: "$a1"}, {Key: "avg_age", Value: "$a2"}}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "n", Value: int32(-1)}}}},
+		bson.D{{Key: "$limit", Value: int64(5)}},
+	}
+	if c := lastCall(t, store, "Aggregate"); !reflect.DeepEqual(c.Pipeline, wantPipeline) {
+		t.Errorf("pipeline %v\nwant %v", c.Pipeline, wantPipeline)
+	}
+
+	// Renamed columns are sorted by their source field before the rename
+	call(t, app, "POST", "/api/sql", `{"query":"SELECT \"full name\" AS name FROM app.users ORDER BY name LIMIT 1"}`)
+	wantPipeline = bson.A{
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "full name", Value: int32(1)}}}},
+		bson.D{{Key: "$limit", Value: int64(1)}},
+		bson.D{{Key: "$project", Value: bson.D{{Key: "_id", Value: int32(0)}, {Key: "name", Value: "$full name"}}}},
+	}
+	if c := lastCall(t, store, "Aggregate"); !reflect.DeepEqual(c.Pipeline, wantPipeline) {
+		t.Errorf("pipeline %v\nwant %v", c.Pipeline, wantPipeline)
+	}
+
+	for _, q := range []string{
+		"DELETE FROM app.users",
+		"SELECT * FROM users",
+		"SELECT name FROM app.users WHERE",
+		"SELECT name, count(*) FROM app.users",
+		"SELECT * FROM app.users GROUP BY name",
+		"SELECT name FROM app.users LIMIT -1",
+		"SELECT name FROM app.users WHERE \"$where\" = 1",
+		"SELECT name FROM app.users; DROP TABLE users",
+	} {
+		if status, body := call(t, app, "POST", "/api/sql", `{"query":"`+q+`"}`); status != fiber.StatusBadRequest {
+			t.Errorf("%s: status %d: %v", q, status, body)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	store := &mock.Store{FindFunc: func(mock.Call) ([]bson.M, error) {
+		return []bson.M{{"n": int32(1)}, {"n": int32(2)}}, nil
+	}}
+	app := newTestApp(t, store, nil)
+
+	status, body := call(t, app, "POST", "/api/find",
+		`{"database":"app","collection":"items","filter":{"n":{"$gt":0}},"sort":{"n":1},"limit":10,"skip":5}`)
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	assertJSON(t, body, `{"documents":[{"n":1},{"n":2}]}`)
+
+	opts := lastCall(t, store, "Find").Options.(*options.FindOptions)
+	if opts.Limit == nil || *opts.Limit != 10 || opts.Skip == nil || *opts.Skip != 5 || opts.Sort == nil {
+		t.Errorf("options not passed: %+v", opts)
+	}
+	if opts.BatchSize == nil || *opts.BatchSize != streamBatchSize {
+		t.Errorf("batch size %v, want the streaming default", opts.BatchSize)
+	}
+
+	call(t, app, "POST", "/api/find", `{"database":"app","collection":"items","batchSize":5000}`)
+	if opts := lastCall(t, store, "Find").Options.(*options.FindOptions); opts.BatchSize == nil || *opts.BatchSize != 5000 {
+		t.Errorf("batch size %v, want 5000", opts.BatchSize)
+	}
+	if status, _ := call(t, app, "POST", "/api/find", `{"database":"app","collection":"items","batchSize":-1}`); status != fiber.StatusBadRequest {
+		t.Errorf("negative batch size: status %d, want 400", status)
+	}
+}
+
+func TestFindTotalCount(t *testing.T) {
+	store := &mock.Store{
+		FindFunc: func(mock.Call) ([]bson.M, error) {
+			return []bson.M{{"n": int32(1)}}, nil
+		},
+		CountDocumentsFunc: func(mock.Call) (int64, error) { return 42, nil },
+	}
+	app := newTestApp(t, store, nil)
+
+	req := httptest.NewRequest("POST", "/api/find", strings.NewReader(
+		`{"database":"app","collection":"items","filter":{"n":1},"limit":1,"skip":3,"includeTotalCount":true}`))
+	req.Header.Set("apiKey", testKey)
+	res, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := res.Header.Get(HeaderTotalCount); got != "42" {
+		t.Errorf("%s %q, want 42", HeaderTotalCount, got)
+	}
+	var body map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&body)
+	assertJSON(t, body, `{"documents":[{"n":1}],"totalCount":42}`)
+	var counted bool
+	for _, c := range store.Calls() {
+		if c.Method == "CountDocuments" {
+			counted = true
+			if !reflect.DeepEqual(c.Filter, bson.D{{Key: "n", Value: int32(1)}}) {
+				t.Errorf("counted with filter %v", c.Filter)
+			}
+		}
+	}
+	if !counted {
+		t.Error("documents were not counted")
+	}
+
+	// Counting is opt-in
+	store = &mock.Store{}
+	app = newTestApp(t, store, nil)
+	_, body = call(t, app, "POST", "/api/find", `{"database":"app","collection":"items","limit":1}`)
+	if _, ok := body["totalCount"]; ok || len(store.Calls()) != 1 {
+		t.Errorf("counted without includeTotalCount: %v", store.Calls())
+	}
+
+	store = &mock.Store{CountDocumentsFunc: func(mock.Call) (int64, error) { return 0, errors.New("count failed") }}
+	app = newTestApp(t, store, nil)
+	status, body := call(t, app, "POST", "/api/find", `{"database":"app","collection":"items","includeTotalCount":true}`)
+	if status != fiber.StatusInternalServerError || body["error"] != "count failed" {
+		t.Errorf("status %d: %v", status, body)
+	}
+}
+
+func TestFindKeyset(t *testing.T) {
+	// The mock returns the page plus the document telling that another
+	// page follows
+	store := &mock.Store{FindFunc: func(mock.Call) ([]bson.M, error) {
+		return []bson.M{{"_id": int32(1), "age": int32(30)}, {"_id": int32(2), "age": int32(30)}, {"_id": int32(3), "age": int32(40)}}, nil
+	}}
+	app := newTestApp(t, store, nil)
+
+	status, body := call(t, app, "POST", "/api/find",
+		`{"database":"app","collection":"users","filter":{"active":true},"sort":{"age":1},"limit":2,"keyset":true}`)
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	if docs := body["documents"].([]interface{}); len(docs) != 2 || body["prevPage"] != nil {
+		t.Fatalf("first page %v", body)
+	}
+	c := lastCall(t, store, "Find")
+	opts := c.Options.(*options.FindOptions)
+	if *opts.Limit != 3 || !reflect.DeepEqual(opts.Sort, bson.D{{Key: "age", Value: int32(1)}, {Key: "_id", Value: int32(1)}}) {
+		t.Errorf("limit %d, sort %v", *opts.Limit, opts.Sort)
+	}
+
+	next := body["nextPage"].(string)
+	_, body = call(t, app, "POST", "/api/find",
+		`{"database":"app","collection":"users","filter":{"active":true},"sort":{"age":1},"limit":2,"pageAfter":"`+next+`"}`)
+	if body["prevPage"] == nil || body["nextPage"] == nil {
+		t.Errorf("second page %v", body)
+	}
+	want := bson.D{{Key: "$and", Value: bson.A{
+		bson.D{{Key: "active", Value: true}},
+		bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "age", Value: bson.D{{Key: "$gt", Value: int32(30)}}}},
+			bson.D{{Key: "age", Value: bson.D{{Key: "$eq", Value: int32(30)}}}, {Key: "_id", Value: bson.D{{Key: "$gt", Value: int32(2)}}}},
+		}}},
+	}}}
+	if c := lastCall(t, store, "Find"); !reflect.DeepEqual(c.Filter, want) {
+		t.Errorf("filter %v, want %v", c.Filter, want)
+	}
+
+	// Pages before the token are read in reverse
+	_, body = call(t, app, "POST", "/api/find",
+		`{"database":"app","collection":"users","sort":{"age":1},"limit":2,"pageBefore":"`+next+`"}`)
+	assertJSON(t, body["documents"], `[{"_id":2,"age":30},{"_id":1,"age":30}]`)
+	if opts := lastCall(t, store, "Find").Options.(*options.FindOptions); !reflect.DeepEqual(opts.Sort, bson.D{{Key: "age", Value: int32(-1)}, {Key: "_id", Value: int32(-1)}}) {
+		t.Errorf("sort %v", opts.Sort)
+	}
+
+	for _, body := range []string{
+		`{"database":"app","collection":"users","sort":{"age":-1},"limit":2,"pageAfter":"` + next + `"}`,
+		`{"database":"app","collection":"users","limit":2,"pageAfter":"not a token"}`,
+		`{"database":"app","collection":"users","limit":2,"skip":2,"keyset":true}`,
+		`{"database":"app","collection":"users","keyset":true}`,
+		`{"database":"app","collection":"users","limit":2,"projection":{"name":1},"sort":{"age":1},"keyset":true}`,
+	} {
+		if status, res := call(t, app, "POST", "/api/find", body); status != fiber.StatusBadRequest {
+			t.Errorf("%s: status %d: %v", body, status, res)
+		}
+	}
+}
+
+func TestFindManyDocuments(t *testing.T) {
+	// Enough documents for several chunks, encoded by different workers
+	n := 5*decodeChunk + 3
+	store := &mock.Store{FindFunc: func(mock.Call) ([]bson.M, error) {
+		docs := make([]bson.M, n)
+		for i := range docs {
+			docs[i] = bson.M{"_id": int32(i), "b": "x", "a": bson.M{"d": testOID}}
+		}
+		return docs, nil
+	}}
+	app := newTestApp(t, store, nil)
+
+	status, body := call(t, app, "POST", "/api/find", `{"database":"app","collection":"items"}`)
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	docs, _ := body["documents"].([]interface{})
+	if len(docs) != n {
+		t.Fatalf("got %d documents, want %d", len(docs), n)
+	}
+	for i, d := range docs {
+		if id := d.(map[string]interface{})["_id"]; id != float64(i) {
+			t.Fatalf("document %d has _id %v", i, id)
+		}
+	}
+	assertJSON(t, docs[0], `{"_id":0,"a":{"d":{"$oid":"65a1b2c3d4e5f60718293a4b"}},"b":"x"}`)
+}
+
+func TestUpdateOne(t *testing.T) {
+	store := &mock.Store{UpdateOneFunc: func(mock.Call) (*mongo.UpdateResult, error) {
+		return &mongo.UpdateResult{MatchedCount: 1, ModifiedCount: 1}, nil
+	}}
+	app := newTestApp(t, store, nil)
+
+	status, body := call(t, app, "POST", "/api/updateOne",
+		`{"database":"app","collection":"users","filter":{"name":"Ada"},"update":{"$set":{"age":36}},"upsert":true}`)
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	assertJSON(t, body, `{"matchedCount":1,"modifiedCount":1,"upsertedCount":0,"upsertedId":null}`)
+
+	c := lastCall(t, store, "UpdateOne")
+	if opts := c.Options.(*options.UpdateOptions); opts.Upsert == nil || !*opts.Upsert {
+		t.Error("upsert was not passed")
+	}
+	if !reflect.DeepEqual(c.Update, bson.D{{Key: "$set", Value: bson.D{{Key: "age", Value: int32(36)}}}}) {
+		t.Errorf("update %v", c.Update)
+	}
+}
+
+func TestUpdateMany(t *testing.T) {
+	store := &mock.Store{UpdateManyFunc: func(mock.Call) (*mongo.UpdateResult, error) {
+		return &mongo.UpdateResult{MatchedCount: 3, ModifiedCount: 2}, nil
+	}}
+	app := newTestApp(t, store, nil)
+
+	status, body := call(t, app, "POST", "/api/updateMany",
+		`{"database":"app","collection":"users","filter":{},"update":{"$inc":{"visits":1}}}`)
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	assertJSON(t, body, `{"matchedCount":3,"modifiedCount":2}`)
+	lastCall(t, store, "UpdateMany")
+}
+
+func TestMergeOne(t *testing.T) {
+	current := bson.M{"_id": int32(7), "name": "Ada", "address": bson.M{"city": "Lyon", "zip": "69001", "geo": "none"}}
+	matched := int64(1)
+	store := &mock.Store{
+		FindOneFunc: func(mock.Call) (bson.M, error) {
+			if current == nil {
+				return nil, mongo.ErrNoDocuments
+			}
+			return current, nil
+		},
+		UpdateOneFunc: func(mock.Call) (*mongo.UpdateResult, error) {
+			return &mongo.UpdateResult{MatchedCount: matched, ModifiedCount: matched}, nil
+		},
+	}
+	app := newTestApp(t, store, &config.Config{RESTAPI: true})
+
+	// Objects merge into the fields holding objects and replace any other
+	// value without their nulls; the update is pinned to the document read
+	status, body := call(t, app, "POST", "/api/mergeOne",
+		`{"database":"app","collection":"users","filter":{"name":"Ada"},"patch":{"phone":null,"address":{"city":"Paris","zip":null,"geo":{"lat":1,"lng":null}},"tags":["vip"]}}`)
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	assertJSON(t, body, `{"matchedCount":1,"modifiedCount":1,"upsertedCount":0,"upsertedId":null}`)
+	want := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "address.city", Value: "Paris"},
+			{Key: "address.geo", Value: bson.D{{Key: "lat", Value: int32(1)}}},
+			{Key: "tags", Value: bson.A{"vip"}},
+		}},
+		{Key: "$unset", Value: bson.D{{Key: "phone", Value: ""}, {Key: "address.zip", Value: ""}}},
+	}
+	isObject := bson.D{{Key: "$type", Value: "object"}}
+	wantFilter := bson.D{{Key: "$and", Value: bson.A{
+		bson.D{{Key: "name", Value: "Ada"}},
+		bson.D{
+			{Key: "_id", Value: int32(7)},
+			{Key: "address", Value: isObject},
+			{Key: "address.geo", Value: bson.D{{Key: "$not", Value: isObject}}},
+		},
+	}}}
+	if c := lastCall(t, store, "UpdateOne"); !reflect.DeepEqual(c.Update, want) || !reflect.DeepEqual(c.Filter, wantFilter) {
+		t.Errorf("update %v, filter %v", c.Update, c.Filter)
+	}
+
+	// A document changed since it was read fails the update
+	matched = 0
+	if status, body := call(t, app, "POST", "/api/mergeOne", `{"database":"app","collection":"users","filter":{},"patch":{"address":{"city":"Paris"}}}`); status != fiber.StatusConflict {
+		t.Errorf("changed document: status %d: %v", status, body)
+	}
+	matched = 1
+
+	// Without a document, objects are set whole and upserted
+	current = nil
+	status, body = call(t, app, "POST", "/api/mergeOne",
+		`{"database":"app","collection":"users","filter":{"name":"Ada"},"upsert":true,"patch":{"address":{"city":"Paris","zip":null}}}`)
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	want = bson.D{{Key: "$set", Value: bson.D{{Key: "address", Value: bson.D{{Key: "city", Value: "Paris"}}}}}}
+	if c := lastCall(t, store, "UpdateOne"); !reflect.DeepEqual(c.Update, want) || !reflect.DeepEqual(c.Filter, bson.D{{Key: "name", Value: "Ada"}}) {
+		t.Errorf("update %v, filter %v", c.Update, c.Filter)
+	}
+
+	// A patch changing nothing is not written
+	current = bson.M{"_id": int32(7), "geo": bson.M{"lat": 1}}
+	for _, patch := range []string{`{}`, `{"geo":{}}`} {
+		before := len(store.Calls())
+		status, body := call(t, app, "POST", "/api/mergeOne", `{"database":"app","collection":"users","filter":{},"patch":`+patch+`}`)
+		if status != fiber.StatusOK {
+			t.Fatalf("patch %s: status %d: %v", patch, status, body)
+		}
+		assertJSON(t, body, `{"matchedCount":1,"modifiedCount":0,"upsertedCount":0,"upsertedId":null}`)
+		for _, c := range store.Calls()[before:] {
+			if c.Method == "UpdateOne" {
+				t.Errorf("patch %s was written", patch)
+			}
+		}
+	}
+	current = nil
+	if status, _ := call(t, app, "POST", "/api/mergeOne", `{"database":"app","collection":"users","filter":{},"failOnNoMatch":true,"patch":{}}`); status != fiber.StatusNotFound {
+		t.Errorf("empty patch of no document: status %d", status)
+	}
+
+	for _, patch := range []string{`{"$set":{"a":1}}`, `{"a.b":1}`, `{"a":{"b.c":1}}`, `{"_id":2}`, `[1]`} {
+		status, body := call(t, app, "POST", "/api/mergeOne", `{"database":"app","collection":"users","filter":{},"patch":`+patch+`}`)
+		if status != fiber.StatusBadRequest {
+			t.Errorf("patch %s: status %d: %v", patch, status, body)
+		}
+	}
+	if status, _ := call(t, app, "POST", "/api/mergeOne", `{"database":"app","collection":"users","filter":{},"update":{"$set":{"a":1}}}`); status != fiber.StatusBadRequest {
+		t.Errorf("update without patch: status %d", status)
+	}
+
+	// The REST facade merges bodies of the merge patch type
+	req := httptest.NewRequest("PATCH", "/api/data/app/users/7", strings.NewReader(`{"phone":null,"name":"Ada"}`))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	req.Header.Set("apiKey", testKey)
+	res, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != fiber.StatusOK {
+		t.Fatalf("status %d", res.StatusCode)
+	}
+	want = bson.D{
+		{Key: "$set", Value: bson.D{{Key: "name", Value: "Ada"}}},
+		{Key: "$unset", Value: bson.D{{Key: "phone", Value: ""}}},
+	}
+	if c := lastCall(t, store, "UpdateOne"); !reflect.DeepEqual(c.Update, want) {
+		t.Errorf("update %v", c.Update)
+	}
+}
+
+func TestPatchOne(t *testing.T) {
+	matched := int64(1)
+	store := &mock.Store{
+		FindFunc: func(mock.Call) ([]bson.M, error) {
+			return []bson.M{{"_id": int32(7), "name": "Ada", "tags": bson.A{"a", "b"}, "address": bson.M{"city": "Paris"}}}, nil
+		},
+		UpdateOneFunc: func(mock.Call) (*mongo.UpdateResult, error) {
+			return &mongo.UpdateResult{MatchedCount: matched, ModifiedCount: matched}, nil
+		},
+	}
+	app := newTestApp(t, store, &config.Config{RESTAPI: true})
+
+	status, body := call(t, app, "POST", "/api/patchOne", `{"database":"app","collection":"users","filter":{"name":"Ada"},"operations":[
+		{"op":"test","path":"/name","value":"Ada"},
+		{"op":"replace","path":"/name","value":"Grace"},
+		{"op":"add","path":"/tags/-","value":"c"},
+		{"op":"copy","from":"/tags/0","path":"/first"},
+		{"op":"remove","path":"/address"}]}`)
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	assertJSON(t, body, `{"matchedCount":1,"modifiedCount":1,"upsertedCount":0,"upsertedId":null}`)
+	c := lastCall(t, store, "UpdateOne")
+	wantFilter := bson.D{
+		{Key: "_id", Value: int32(7)},
+		{Key: "name", Value: "Ada"},
+		{Key: "tags", Value: bson.A{"a", "b"}},
+		{Key: "first", Value: bson.D{{Key: "$exists", Value: false}}},
+		{Key: "address", Value: bson.D{{Key: "city", Value: "Paris"}}},
+	}
+	if !reflect.DeepEqual(c.Filter, wantFilter) {
+		t.Errorf("filter %v", c.Filter)
+	}
+	update := c.Update.(bson.D)
+	if len(update) != 2 || update[0].Key != "$set" || update[1].Key != "$unset" {
+		t.Fatalf("update %v", update)
+	}
+	if set := update[0].Value.(bson.D).Map(); !reflect.DeepEqual(set, bson.M{"name": "Grace", "tags": bson.A{"a", "b", "c"}, "first": "a"}) {
+		t.Errorf("$set %v", set)
+	}
+	if !reflect.DeepEqual(update[1].Value, bson.D{{Key: "address", Value: ""}}) {
+		t.Errorf("$unset %v", update[1].Value)
+	}
+
+	for _, tc := range []struct {
+		operations string
+		status     int
+	}{
+		{`[]`, fiber.StatusBadRequest},
+		{`[{"op":"add","path":"/a"}]`, fiber.StatusBadRequest},
+		{`[{"op":"rename","path":"/a"}]`, fiber.StatusBadRequest},
+		{`[{"op":"remove","path":"a"}]`, fiber.StatusBadRequest},
+		// Top-level members are set, unset and matched by name, so they
+		// cannot be paths or operators
+		{`[{"op":"add","path":"/a.b","value":1}]`, fiber.StatusBadRequest},
+		{`[{"op":"add","path":"/$set","value":1}]`, fiber.StatusBadRequest},
+		{`[{"op":"copy","from":"/a.b","path":"/c"}]`, fiber.StatusBadRequest},
+		{`[{"op":"add","path":"/","value":1}]`, fiber.StatusBadRequest},
+		{`[{"op":"move","from":"/tags","path":"/tags/0"}]`, fiber.StatusBadRequest},
+		{`[{"op":"test","path":"/name","value":"Grace"}]`, fiber.StatusConflict},
+		{`[{"op":"remove","path":"/missing"}]`, fiber.StatusUnprocessableEntity},
+		{`[{"op":"add","path":"/tags/5","value":1}]`, fiber.StatusUnprocessableEntity},
+		{`[{"op":"replace","path":"/_id","value":8}]`, fiber.StatusUnprocessableEntity},
+	} {
+		status, body := call(t, app, "POST", "/api/patchOne", `{"database":"app","collection":"users","filter":{},"operations":`+tc.operations+`}`)
+		if status != tc.status {
+			t.Errorf("%s: status %d: %v", tc.operations, status, body)
+		}
+	}
+
+	// Nested members may have any name, as their top-level field is set whole
+	if status, body := call(t, app, "POST", "/api/patchOne", `{"database":"app","collection":"users","filter":{},"operations":[{"op":"add","path":"/address/a.b","value":1}]}`); status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	want := bson.D{{Key: "$set", Value: bson.D{{Key: "address", Value: bson.D{{Key: "city", Value: "Paris"}, {Key: "a.b", Value: int32(1)}}}}}}
+	if c := lastCall(t, store, "UpdateOne"); !reflect.DeepEqual(c.Update, want) {
+		t.Errorf("update %v", c.Update)
+	}
+
+	// A document changed since it was read is a conflict
+	matched = 0
+	if status, body := call(t, app, "POST", "/api/patchOne", `{"database":"app","collection":"users","filter":{},"operations":[{"op":"add","path":"/a","value":1}]}`); status != fiber.StatusConflict {
+		t.Errorf("status %d: %v", status, body)
+	}
+	matched = 1
+
+	// The REST facade applies bodies of the JSON Patch type
+	req := httptest.NewRequest("PATCH", "/api/data/app/users/7", strings.NewReader(`[{"op":"move","from":"/address/city","path":"/city"}]`))
+	req.Header.Set("Content-Type", "application/json-patch+json")
+	req.Header.Set("apiKey", testKey)
+	res, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != fiber.StatusOK {
+		t.Fatalf("status %d", res.StatusCode)
+	}
+	want = bson.D{
+		{Key: "$set", Value: bson.D{{Key: "address", Value: bson.D{}}, {Key: "city", Value: "Paris"}}},
+	}
+	if c := lastCall(t, store, "UpdateOne"); !reflect.DeepEqual(c.Update, want) {
+		t.Errorf("update %v", c.Update)
+	}
+}
+
+func TestDeleteOne(t *testing.T) {
+	store := &mock.Store{DeleteOneFunc: func(mock.Call) (*mongo.DeleteResult, error) {
+		return &mongo.DeleteResult{DeletedCount: 1}, nil
+	}}
+	app := newTestApp(t, store, nil)
+
+	status, body := call(t, app, "POST", "/api/deleteOne", `{"database":"app","collection":"users","filter":{"name":"Ada"}}`)
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	assertJSON(t, body, `{"deletedCount":1}`)
+	lastCall(t, store, "DeleteOne")
+}
+
+func TestDeleteMany(t *testing.T) {
+	store := &mock.Store{DeleteManyFunc: func(mock.Call) (*mongo.DeleteResult, error) {
+		return &mongo.DeleteResult{DeletedCount: 4}, nil
+	}}
+	app := newTestApp(t, store, nil)
+
+	status, body := call(t, app, "POST", "/api/deleteMany", `{"database":"app","collection":"users","filter":{"active":false}}`)
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	assertJSON(t, body, `{"deletedCount":4}`)
+	lastCall(t, store, "DeleteMany")
+
+	// Deployments can keep the driver's result
+	store.DeleteOneFunc = store.DeleteManyFunc
+	app = newTestApp(t, store, &config.Config{LegacyDeleteResults: true})
+	for _, path := range []string{"/api/deleteOne", "/api/deleteMany"} {
+		_, body = call(t, app, "POST", path, `{"database":"app","collection":"users","filter":{"active":false}}`)
+		assertJSON(t, body, `{"result":{"n":4}}`)
+	}
+}
+
+func TestPlainObjectIDs(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("5f1b0c9e8d4a2b3c4d5e6f70")
+	store := &mock.Store{
+		FindOneFunc: func(mock.Call) (bson.M, error) { return bson.M{"_id": oid, "ref": oid}, nil },
+		FindFunc:    func(mock.Call) ([]bson.M, error) { return []bson.M{{"_id": oid}}, nil },
+		InsertOneFunc: func(mock.Call) (*mongo.InsertOneResult, error) {
+			return &mongo.InsertOneResult{InsertedID: oid}, nil
+		},
+	}
+	app := newTestApp(t, store, &config.Config{PlainObjectIDs: true})
+
+	_, body := call(t, app, "POST", "/api/findOne", `{"database":"db","collection":"c","filter":{"_id":"5f1b0c9e8d4a2b3c4d5e6f70"}}`)
+	if got := lastCall(t, store, "FindOne").Filter.(bson.D); got[0].Value != oid {
+		t.Errorf("filter %v, want an ObjectId _id", got)
+	}
+	doc := body["document"].(map[string]interface{})
+	if doc["_id"] != oid.Hex() {
+		t.Errorf("_id %v, want a plain string", doc["_id"])
+	}
+	if ref, ok := doc["ref"].(map[string]interface{}); !ok || ref["$oid"] != oid.Hex() {
+		t.Errorf("ref %v, want an $oid", doc["ref"])
+	}
+
+	_, body = call(t, app, "POST", "/api/find", `{"database":"db","collection":"c","filter":{"$or":[{"_id":{"$in":["5f1b0c9e8d4a2b3c4d5e6f70","other"]}}]}}`)
+	or := lastCall(t, store, "Find").Filter.(bson.D)[0].Value.(bson.A)
+	in := or[0].(bson.D)[0].Value.(bson.D)[0].Value.(bson.A)
+	if in[0] != oid || in[1] != "other" {
+		t.Errorf("$in %v, want the ObjectId and the string", in)
+	}
+	if docs := body["documents"].([]interface{}); docs[0].(map[string]interface{})["_id"] != oid.Hex() {
+		t.Errorf("documents %v, want a plain _id", docs)
+	}
+
+	_, body = call(t, app, "POST", "/api/insertOne", `{"database":"db","collection":"c","document":{"a":1}}`)
+	if body["insertedId"] != oid.Hex() {
+		t.Errorf("insertedId %v, want a plain string", body["insertedId"])
+	}
+
+	// A request can opt out
+	_, body = call(t, app, "POST", "/api/findOne", `{"database":"db","collection":"c","filter":{"_id":"5f1b0c9e8d4a2b3c4d5e6f70"},"plainObjectIds":false}`)
+	if got := lastCall(t, store, "FindOne").Filter.(bson.D); got[0].Value != oid.Hex() {
+		t.Errorf("filter %v, want the string _id", got)
+	}
+	if id, ok := body["document"].(map[string]interface{})["_id"].(map[string]interface{}); !ok || id["$oid"] != oid.Hex() {
+		t.Errorf("_id %v, want an $oid", body["document"])
+	}
+}
+
+func TestDates(t *testing.T) {
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	date := primitive.NewDateTimeFromTime(at)
+	store := &mock.Store{
+		FindOneFunc: func(mock.Call) (bson.M, error) {
+			return bson.M{"createdAt": date, "history": bson.A{bson.M{"at": date}}}, nil
+		},
+		FindFunc: func(mock.Call) ([]bson.M, error) { return []bson.M{{"createdAt": date}}, nil },
+	}
+	app := newTestApp(t, store, &config.Config{})
+
+	status, body := call(t, app, "POST", "/api/insertOne", `{"database":"db","collection":"c","dateFields":["createdAt","items.at"],
+		"document":{"createdAt":"2024-01-02T03:04:05Z","items":[{"at":"2024-01-02T04:04:05+01:00"}],"note":"2024-01-02T03:04:05Z"}}`)
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	inserted := lastCall(t, store, "InsertOne").Documents[0].(bson.D)
+	if v := field(inserted, "createdAt"); v != date {
+		t.Errorf("createdAt %v, want a date", v)
+	}
+	if v := field(field(inserted, "items").(bson.A)[0].(bson.D), "at"); v != date {
+		t.Errorf("items.at %v, want a date", v)
+	}
+	if v := field(inserted, "note"); v != "2024-01-02T03:04:05Z" {
+		t.Errorf("note %v, want the string", v)
+	}
+
+	call(t, app, "POST", "/api/updateOne", `{"database":"db","collection":"c","dateFields":["createdAt"],
+		"filter":{"createdAt":{"$lt":"2024-01-02T03:04:05Z"}},"update":{"$set":{"createdAt":"2024-01-02T03:04:05Z"}}}`)
+	update := lastCall(t, store, "UpdateOne")
+	if v := field(update.Filter.(bson.D), "createdAt").(bson.D)[0].Value; v != date {
+		t.Errorf("filter %v, want a date", v)
+	}
+	if v := field(field(update.Update.(bson.D), "$set").(bson.D), "createdAt"); v != date {
+		t.Errorf("update %v, want a date", v)
+	}
+
+	status, body = call(t, app, "POST", "/api/find", `{"database":"db","collection":"c","dateFields":["createdAt"],"filter":{"createdAt":"yesterday"}}`)
+	if status != fiber.StatusBadRequest {
+		t.Errorf("status %d, want 400: %v", status, body)
+	}
+
+	_, body = call(t, app, "POST", "/api/findOne", `{"database":"db","collection":"c","plainDates":true}`)
+	doc := body["document"].(map[string]interface{})
+	if doc["createdAt"] != "2024-01-02T03:04:05.000Z" {
+		t.Errorf("createdAt %v, want an RFC3339 string", doc["createdAt"])
+	}
+	if v := doc["history"].([]interface{})[0].(map[string]interface{})["at"]; v != "2024-01-02T03:04:05.000Z" {
+		t.Errorf("history.at %v, want an RFC3339 string", v)
+	}
+	_, body = call(t, app, "POST", "/api/find", `{"database":"db","collection":"c","plainDates":true}`)
+	if v := body["documents"].([]interface{})[0].(map[string]interface{})["createdAt"]; v != "2024-01-02T03:04:05.000Z" {
+		t.Errorf("createdAt %v, want an RFC3339 string", v)
+	}
+}
+
+func TestNumbersAsStrings(t *testing.T) {
+	price, _ := primitive.ParseDecimal128("1.10")
+	result := func() bson.M { return bson.M{"big": int64(9007199254740993), "small": int32(1), "price": price} }
+	store := &mock.Store{
+		FindOneFunc:   func(mock.Call) (bson.M, error) { return result(), nil },
+		AggregateFunc: func(mock.Call) ([]bson.M, error) { return []bson.M{result()}, nil },
+	}
+	app := newTestApp(t, store, &config.Config{APIKeys: []config.APIKey{{Name: "test", Key: testKey, NumbersAsStrings: true}}})
+
+	_, body := call(t, app, "POST", "/api/findOne", `{"database":"db","collection":"c"}`)
+	doc := body["document"].(map[string]interface{})
+	if doc["big"] != "9007199254740993" || doc["price"] != "1.10" || doc["small"] != float64(1) {
+		t.Errorf("document %v, want the int64 and decimal as strings", doc)
+	}
+	_, body = call(t, app, "POST", "/api/aggregate", `{"database":"db","collection":"c","pipeline":[]}`)
+	if doc := body["documents"].([]interface{})[0].(map[string]interface{}); doc["big"] != "9007199254740993" {
+		t.Errorf("document %v, want the int64 as a string", doc)
+	}
+
+	// A request can opt out of its key's default
+	_, body = call(t, app, "POST", "/api/findOne", `{"database":"db","collection":"c","numbersAsStrings":false}`)
+	doc = body["document"].(map[string]interface{})
+	if _, ok := doc["big"].(float64); !ok {
+		t.Errorf("big %v, want a number", doc["big"])
+	}
+	if price, ok := doc["price"].(map[string]interface{}); !ok || price["$numberDecimal"] != "1.10" {
+		t.Errorf("price %v, want a $numberDecimal", doc["price"])
+	}
+}
+
+func TestUUIDFields(t *testing.T) {
+	const id = "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+	bin := primitive.Binary{Subtype: bson.TypeBinaryUUID, Data: []byte{0x6b, 0xa7, 0xb8, 0x10, 0x9d, 0xad, 0x11, 0xd1, 0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8}}
+	store := &mock.Store{FindOneFunc: func(mock.Call) (bson.M, error) {
+		return bson.M{"_id": bin, "refs": bson.A{bson.M{"id": bin}}, "other": bin}, nil
+	}}
+	app := newTestApp(t, store, &config.Config{UUIDFields: map[string][]string{"app.users": {"_id", "refs.id"}}})
+
+	call(t, app, "POST", "/api/insertOne", `{"database":"app","collection":"users","document":{"_id":"`+id+`","refs":[{"id":"`+id+`"}]}}`)
+	inserted := lastCall(t, store, "InsertOne").Documents[0].(bson.D)
+	if !reflect.DeepEqual(field(inserted, "_id"), bin) {
+		t.Errorf("_id %v, want a UUID", field(inserted, "_id"))
+	}
+	if ref := field(inserted, "refs").(bson.A)[0].(bson.D); !reflect.DeepEqual(field(ref, "id"), bin) {
+		t.Errorf("refs.id %v, want a UUID", ref)
+	}
+
+	_, body := call(t, app, "POST", "/api/findOne", `{"database":"app","collection":"users","filter":{"_id":{"$in":["`+id+`"]}}}`)
+	if in := lastCall(t, store, "FindOne").Filter.(bson.D)[0].Value.(bson.D)[0].Value.(bson.A); !reflect.DeepEqual(in[0], bin) {
+		t.Errorf("$in %v, want a UUID", in)
+	}
+	doc := body["document"].(map[string]interface{})
+	if doc["_id"] != id || doc["refs"].([]interface{})[0].(map[string]interface{})["id"] != id {
+		t.Errorf("document %v, want UUID strings", doc)
+	}
+	if _, ok := doc["other"].(map[string]interface{}); !ok {
+		t.Errorf("other %v, want a $binary", doc["other"])
+	}
+
+	status, _ := call(t, app, "POST", "/api/deleteOne", `{"database":"app","collection":"users","filter":{"_id":"not-a-uuid"}}`)
+	if status != fiber.StatusBadRequest {
+		t.Errorf("status %d, want 400", status)
+	}
+
+	// Bulk writes convert each document, failing those with invalid UUIDs
+	var written []interface{}
+	store.InsertManyFunc = func(c mock.Call) (*mongo.InsertManyResult, error) {
+		written = append(written, c.Documents...)
+		return &mongo.InsertManyResult{InsertedIDs: make([]interface{}, len(c.Documents))}, nil
+	}
+	for _, req := range []struct{ path, body string }{
+		{"/api/insertMany?stream=true", `{"database":"app","collection":"users","documents":[{"_id":"` + id + `"},{"_id":"not-a-uuid"}]}`},
+		{"/api/import?database=app&collection=users", `{"_id":"` + id + `"}` + "\n" + `{"_id":"not-a-uuid"}`},
+	} {
+		written = nil
+		status, body := call(t, app, "POST", req.path, req.body)
+		if status != fiber.StatusOK || body["inserted"] != 1.0 || body["failed"] != 1.0 {
+			t.Errorf("%s: status %d: %v", req.path, status, body)
+		}
+		if len(written) != 1 || !reflect.DeepEqual(field(written[0].(bson.D), "_id"), bin) {
+			t.Errorf("%s: inserted %v, want a UUID", req.path, written)
+		}
+	}
+	call(t, app, "POST", "/api/import?database=app&collection=users&upsertKeys=_id", `{"_id":"`+id+`","a":1}`)
+	if filter := lastCall(t, store, "UpdateOne").Filter.(bson.D); !reflect.DeepEqual(field(filter, "_id"), bin) {
+		t.Errorf("upsert filter %v, want a UUID", filter)
+	}
+
+	written = nil
+	reads := 0
+	store.FindFunc = func(mock.Call) ([]bson.M, error) {
+		if reads++; reads > 1 {
+			return nil, nil
+		}
+		return []bson.M{{"_id": id}}, nil
+	}
+	store.CountDocumentsFunc = func(mock.Call) (int64, error) { return 1, nil }
+	waitForJob(t, app, "/api/cloneCollection", `{"source":{"database":"app","collection":"legacy"},"target":{"database":"app","collection":"users"}}`)
+	if len(written) != 1 || !reflect.DeepEqual(field(written[0].(bson.D), "_id"), bin) {
+		t.Errorf("cloned %v, want a UUID", written)
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	store := &mock.Store{
+		FindFunc:           func(mock.Call) ([]bson.M, error) { return []bson.M{{"a": int32(1)}, {"a": int32(2)}}, nil },
+		CountDocumentsFunc: func(mock.Call) (int64, error) { return 2, nil },
+	}
+	env := &config.Envelope{Rename: map[string]string{"documents": "data"}, Omit: []string{"totalCount"}, CountField: "count", Case: config.CaseSnake}
+	app := newTestApp(t, store, &config.Config{APIKeys: []config.APIKey{{Name: "test", Key: testKey, Envelope: env}}})
+
+	_, body := call(t, app, "POST", "/api/find", `{"database":"db","collection":"c","includeTotalCount":true}`)
+	if len(body) != 2 || len(body["data"].([]interface{})) != 2 || body["count"] != float64(2) {
+		t.Errorf("body %v, want data and count", body)
+	}
+	_, body = call(t, app, "POST", "/api/updateOne", `{"database":"db","collection":"c","filter":{},"update":{"$set":{"a":1}}}`)
+	if _, ok := body["matched_count"]; !ok || body["matchedCount"] != nil {
+		t.Errorf("body %v, want snake_case fields", body)
+	}
+
+	cfg := &config.Config{APIKeys: []config.APIKey{{Name: "test", Key: testKey, Envelope: &config.Envelope{Case: "kebab-case"}}}}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected an invalid envelope case to fail validation")
+	}
+}
+
+func TestJSONAPI(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("5f1b0c9e8d4a2b3c4d5e6f70")
+	store := &mock.Store{
+		FindFunc: func(mock.Call) ([]bson.M, error) {
+			return []bson.M{{"_id": oid, "name": "a"}, {"_id": int32(7), "name": "b"}}, nil
+		},
+		FindOneFunc: func(mock.Call) (bson.M, error) { return bson.M{"_id": "x", "name": "c"}, nil },
+	}
+	app := newTestApp(t, store, &config.Config{RESTAPI: true})
+	send := func(method, path, body string) map[string]interface{} {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", MIMEJSONAPI)
+		req.Header.Set("apiKey", testKey)
+		res, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ct := res.Header.Get("Content-Type"); ct != MIMEJSONAPI {
+			t.Errorf("Content-Type %q", ct)
+		}
+		var decoded map[string]interface{}
+		if err := json.NewDecoder(res.Body).Decode(&decoded); err != nil {
+			t.Fatal(err)
+		}
+		return decoded
+	}
+
+	body := send("GET", "/api/data/db/users?limit=2&skip=2", "")
+	data := body["data"].([]interface{})
+	first := data[0].(map[string]interface{})
+	if first["type"] != "users" || first["id"] != oid.Hex() || first["attributes"].(map[string]interface{})["name"] != "a" {
+		t.Errorf("resource %v", first)
+	}
+	if _, ok := first["attributes"].(map[string]interface{})["_id"]; ok {
+		t.Errorf("attributes %v, want no _id", first["attributes"])
+	}
+	if id := data[1].(map[string]interface{})["id"]; id != "7" {
+		t.Errorf("id %v, want \"7\"", id)
+	}
+	links := body["links"].(map[string]interface{})
+	if !strings.HasSuffix(links["next"].(string), "/api/data/db/users?limit=2&skip=4") || !strings.HasSuffix(links["prev"].(string), "skip=0") {
+		t.Errorf("links %v", links)
+	}
+
+	body = send("POST", "/api/findOne", `{"database":"db","collection":"users"}`)
+	if resource := body["data"].(map[string]interface{}); resource["id"] != "x" {
+		t.Errorf("data %v", resource)
+	}
+	if _, ok := body["links"]; ok {
+		t.Errorf("body %v, want no links for a POST", body)
+	}
+}
+
+func TestProtobuf(t *testing.T) {
+	dir := t.TempDir()
+	schema := `syntax = "proto3";
+package shop;
+import "google/protobuf/timestamp.proto";
+message Order {
+  message Item { string sku = 1; double price = 2; }
+  enum State { UNKNOWN = 0; OPEN = 1; }
+  string id = 1;
+  int64 total = 2;
+  repeated Item items = 3;
+  google.protobuf.Timestamp created_at = 4;
+  map<string, int32> counts = 5;
+  State state = 6;
+}`
+	if err := os.WriteFile(filepath.Join(dir, "order.proto"), []byte(schema), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	oid, _ := primitive.ObjectIDFromHex("5f1b0c9e8d4a2b3c4d5e6f70")
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	store := &mock.Store{FindFunc: func(mock.Call) ([]bson.M, error) {
+		return []bson.M{
+			{"_id": oid, "total": int64(1200), "items": bson.A{bson.M{"sku": "a", "price": 2.5}}, "createdAt": primitive.NewDateTimeFromTime(created),
+				"counts": bson.M{"x": int32(3)}, "state": "OPEN", "ignored": true},
+			{"_id": oid},
+		}, nil
+	}}
+	schemas := map[string]config.ProtoSchema{"shop.orders": {File: filepath.Join(dir, "order.proto"), Message: "shop.Order"}}
+	app := newTestApp(t, store, &config.Config{ProtoSchemas: schemas})
+	protos, err := protoschema.Load(schemas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := protos.Message("shop", "orders")
+
+	send := func(collection string) *http.Response {
+		req := httptest.NewRequest("POST", "/api/find", strings.NewReader(`{"database":"shop","collection":"`+collection+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", MIMEProtobuf)
+		req.Header.Set("apiKey", testKey)
+		res, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	res := send("orders")
+	if ct := res.Header.Get("Content-Type"); ct != "application/x-protobuf; messageType=shop.Order; delimited=true" {
+		t.Errorf("Content-Type %q", ct)
+	}
+	body, _ := io.ReadAll(res.Body)
+	var msgs []*dynamicpb.Message
+	for len(body) > 0 {
+		n, l := protowire.ConsumeVarint(body)
+		if l < 0 || int(n) > len(body)-l {
+			t.Fatalf("invalid delimited message %v", body)
+		}
+		msg := dynamicpb.NewMessage(md)
+		if err := proto.Unmarshal(body[l:l+int(n)], msg); err != nil {
+			t.Fatal(err)
+		}
+		msgs, body = append(msgs, msg), body[l+int(n):]
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("got %d messages, want 2", len(msgs))
+	}
+	// protojson varies its whitespace
+	got := strings.Join(strings.Fields(protojson.Format(msgs[0])), "")
+	for _, want := range []string{`"id":"5f1b0c9e8d4a2b3c4d5e6f70"`, `"total":"1200"`, `"sku":"a"`, `"price":2.5`, `"createdAt":"2024-01-02T03:04:05Z"`, `"counts":{"x":3}`, `"state":"OPEN"`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("message %s, want %s", got, want)
+		}
+	}
+
+	if res := send("customers"); res.StatusCode != fiber.StatusNotAcceptable {
+		t.Errorf("status %d, want 406 without a schema", res.StatusCode)
+	}
+}
+
+func TestFailOnNoMatch(t *testing.T) {
+	store := &mock.Store{}
+	app := newTestApp(t, store, &config.Config{RESTAPI: true})
+
+	for _, path := range []string{"/api/updateOne", "/api/updateMany", "/api/deleteOne", "/api/deleteMany"} {
+		body := `{"database":"app","collection":"users","filter":{"_id":1},"update":{"$set":{"a":1}}`
+		if status, _ := call(t, app, "POST", path, body+`}`); status != fiber.StatusOK {
+			t.Errorf("%s: status %d, want 200", path, status)
+		}
+		status, res := call(t, app, "POST", path, body+`,"failOnNoMatch":true}`)
+		if status != fiber.StatusNotFound || res["error"] != "No document matched the filter" {
+			t.Errorf("%s with failOnNoMatch: status %d: %v", path, status, res)
+		}
+	}
+
+	// Upserts and deletions are matches
+	store.UpdateOneFunc = func(mock.Call) (*mongo.UpdateResult, error) {
+		return &mongo.UpdateResult{UpsertedCount: 1, UpsertedID: int32(1)}, nil
+	}
+	store.DeleteOneFunc = func(mock.Call) (*mongo.DeleteResult, error) { return &mongo.DeleteResult{DeletedCount: 1}, nil }
+	for _, path := range []string{"/api/updateOne", "/api/deleteOne"} {
+		body := `{"database":"app","collection":"users","filter":{"_id":1},"update":{"$set":{"a":1}},"upsert":true,"failOnNoMatch":true}`
+		if status, res := call(t, app, "POST", path, body); status != fiber.StatusOK {
+			t.Errorf("%s: status %d: %v", path, status, res)
+		}
+	}
+
+	// The REST facade takes it as a query parameter
+	store.DeleteOneFunc = nil
+	if status, _ := call(t, app, "DELETE", "/api/data/app/users/1?failOnNoMatch=true", ""); status != fiber.StatusNotFound {
+		t.Errorf("DELETE: status %d, want 404", status)
+	}
+}
+
+func TestRestrictUpserts(t *testing.T) {
+	store := &mock.Store{}
+	update := `{"database":"app","collection":"users","filter":{"_id":1},"update":{"$set":{"a":1}}`
+	roles := []config.Role{
+		{Name: "writer", Operations: []string{"updateOne", "updateMany", "import", "clone"}},
+		{Name: "upserter", Operations: []string{"upsert"}},
+	}
+	newApp := func(restrict bool, keyRoles ...string) *fiber.App {
+		return newTestApp(t, store, &config.Config{
+			APIKeys:         []config.APIKey{{Name: "writer", Key: testKey, Roles: keyRoles}},
+			Roles:           roles,
+			RestrictUpserts: restrict,
+		})
+	}
+
+	// Upserts only need the update operation by default
+	if status, res := call(t, newApp(false, "writer"), "POST", "/api/updateOne", update+`,"upsert":true}`); status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, res)
+	}
+
+	writer, owner := newApp(true, "writer"), newApp(true, "writer", "upserter")
+	for _, path := range []string{"/api/updateOne", "/api/updateMany"} {
+		if status, res := call(t, writer, "POST", path, update+`}`); status != fiber.StatusOK {
+			t.Errorf("%s: status %d: %v", path, status, res)
+		}
+		status, res := call(t, writer, "POST", path, update+`,"upsert":true}`)
+		if status != fiber.StatusForbidden || !strings.Contains(res["error"].(string), "operation upsert is not permitted") {
+			t.Errorf("%s with upsert: status %d: %v", path, status, res)
+		}
+		if status, res := call(t, owner, "POST", path, update+`,"upsert":true}`); status != fiber.StatusOK {
+			t.Errorf("%s with upsert permission: status %d: %v", path, status, res)
+		}
+	}
+
+	// Imports by key and clones replacing documents upsert too
+	for _, tc := range []struct {
+		path, body string
+		allowed    int
+	}{
+		{"/api/import?database=app&collection=users&upsertKeys=_id", "{\"_id\":1}\n", fiber.StatusOK},
+		{"/api/cloneCollection", `{"source":{"database":"app","collection":"users"},"target":{"cluster":"backup","database":"app","collection":"users"},"upsert":true}`, fiber.StatusAccepted},
+	} {
+		status, res := call(t, writer, "POST", tc.path, tc.body)
+		if status != fiber.StatusForbidden || !strings.Contains(res["error"].(string), "operation upsert is not permitted") {
+			t.Errorf("%s: status %d: %v", tc.path, status, res)
+		}
+		if status, res := call(t, owner, "POST", tc.path, tc.body); status != tc.allowed {
+			t.Errorf("%s with upsert permission: status %d: %v", tc.path, status, res)
+		}
+	}
+}
+
+func TestSignedTokens(t *testing.T) {
+	const secret = "0123456789abcdef0123456789abcdef"
+	store := &mock.Store{}
+	app := newTestApp(t, store, &config.Config{
+		TokenSecret: secret,
+		APIKeys:     []config.APIKey{{Name: "reports", Key: testKey, Roles: []string{"read"}}},
+	})
+	withToken := func(method, path, body, token string) (int, map[string]interface{}) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded map[string]interface{}
+		if err := json.NewDecoder(res.Body).Decode(&decoded); err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, decoded
+	}
+
+	status, res := call(t, app, "POST", "/api/tokens", `{"namespace":"reports.public","operations":["find"],"ttlSeconds":600}`)
+	if status != fiber.StatusCreated {
+		t.Fatalf("status %d: %v", status, res)
+	}
+	token := res["token"].(string)
+
+	find := `{"database":"reports","collection":"public"}`
+	if status, res := withToken("POST", "/api/find", find, token); status != fiber.StatusOK {
+		t.Errorf("find: status %d: %v", status, res)
+	}
+	if c := lastCall(t, store, "Find"); c.Database != "reports" || c.Collection != "public" {
+		t.Errorf("find ran on %s.%s", c.Database, c.Collection)
+	}
+	// Signed URLs carry the token in the query string
+	req := httptest.NewRequest("POST", "/api/find?token="+url.QueryEscape(token), strings.NewReader(find))
+	req.Header.Set("Content-Type", "application/json")
+	if resp, err := app.Test(req, -1); err != nil || resp.StatusCode != fiber.StatusOK {
+		t.Errorf("signed URL: %v %v", resp.StatusCode, err)
+	}
+
+	// Only the token's operation and namespace are allowed
+	for _, tc := range []struct{ path, body string }{
+		{"/api/find", `{"database":"reports","collection":"private"}`},
+		{"/api/findOne", find},
+		{"/api/tokens", `{"namespace":"reports.public","operations":["find"]}`},
+		{"/api/sessions", ""},
+	} {
+		if status, res := withToken("POST", tc.path, tc.body, token); status != fiber.StatusForbidden {
+			t.Errorf("%s %s: status %d: %v", tc.path, tc.body, status, res)
+		}
+	}
+
+	// Keys cannot grant more than they are allowed
+	for body, want := range map[string]int{
+		`{"namespace":"reports.public","operations":["insertOne"]}`:              fiber.StatusForbidden,
+		`{"namespace":"reports.*","operations":["find"]}`:                        fiber.StatusBadRequest,
+		`{"namespace":"reports.public","operations":["drop"]}`:                   fiber.StatusBadRequest,
+		`{"namespace":"reports.public","operations":["find"],"ttlSeconds":7200}`: fiber.StatusBadRequest,
+	} {
+		if status, res := call(t, app, "POST", "/api/tokens", body); status != want {
+			t.Errorf("%s: status %d, want %d: %v", body, status, want, res)
+		}
+	}
+
+	signer := auth.NewTokens(secret, time.Hour)
+	expired, _ := signer.Sign(auth.TokenClaims{Key: "reports", Namespace: "reports.public", Operations: []string{"find"}, Expires: time.Now().Add(-time.Minute).Unix()})
+	unknownKey, _ := signer.Sign(auth.TokenClaims{Key: "deleted", Namespace: "reports.public", Operations: []string{"find"}, Expires: time.Now().Add(time.Minute).Unix()})
+	for token, want := range map[string]string{
+		expired:              "Forbidden: Token expired",
+		unknownKey:           "Forbidden: Invalid token",
+		token[:len(token)-2]: "Forbidden: Invalid token",
+		"":                   "Forbidden: Invalid API Key ",
+	} {
+		if status, res := withToken("POST", "/api/find", find, token); status != fiber.StatusForbidden || res["message"] != want {
+			t.Errorf("status %d: %v, want %q", status, res, want)
+		}
+	}
+}
+
+func TestOAuth(t *testing.T) {
+	signingKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/jwks":
+			e := big.NewInt(int64(signingKey.E)).Bytes()
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+				"kty": "RSA", "kid": "k1", "use": "sig",
+				"n": base64.RawURLEncoding.EncodeToString(signingKey.N.Bytes()),
+				"e": base64.RawURLEncoding.EncodeToString(e),
+			}}})
+		case "/introspect":
+			if id, secret, _ := r.BasicAuth(); id != "proxy" || secret != "s3cret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			r.ParseForm()
+			active := r.Form.Get("token") == "opaque-token"
+			json.NewEncoder(w).Encode(map[string]interface{}{"active": active, "client_id": "reporting", "scope": "mongo.read", "exp": time.Now().Add(time.Hour).Unix()})
+		}
+	}))
+	defer idp.Close()
+
+	store := &mock.Store{}
+	app := newTestApp(t, store, &config.Config{OAuth: config.OAuthConfig{
+		JWKSURL: idp.URL + "/jwks", Issuer: "https://idp.example.com", Audience: "data-api",
+		IntrospectionURL: idp.URL + "/introspect", ClientID: "proxy", ClientSecret: "s3cret",
+		ScopePrefix: "mongo.",
+	}})
+	sign := func(claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "k1"
+		signed, err := token.SignedString(signingKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	claims := func(scope string, exp time.Duration) jwt.MapClaims {
+		return jwt.MapClaims{"iss": "https://idp.example.com", "aud": "data-api", "client_id": "etl", "scope": scope, "exp": time.Now().Add(exp).Unix()}
+	}
+	withToken := func(path, body, token string) (int, map[string]interface{}) {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded map[string]interface{}
+		json.NewDecoder(res.Body).Decode(&decoded)
+		return res.StatusCode, decoded
+	}
+
+	// Each scope grants its role on its namespace only
+	token := sign(claims("mongo.read:analytics mongo.readWrite:scratch.events openid", time.Hour))
+	for _, tc := range []struct {
+		path, ns string
+		want     int
+	}{
+		{"/api/find", `"database":"analytics","collection":"daily"`, fiber.StatusOK},
+		{"/api/insertOne", `"database":"analytics","collection":"daily","document":{}`, fiber.StatusForbidden},
+		{"/api/insertOne", `"database":"scratch","collection":"events","document":{}`, fiber.StatusOK},
+		{"/api/find", `"database":"scratch","collection":"other"`, fiber.StatusForbidden},
+		{"/api/find", `"database":"billing","collection":"invoices"`, fiber.StatusForbidden},
+	} {
+		if status, res := withToken(tc.path, "{"+tc.ns+"}", token); status != tc.want {
+			t.Errorf("%s %s: status %d, want %d: %v", tc.path, tc.ns, status, tc.want, res)
+		}
+	}
+
+	// Opaque tokens are introspected
+	if status, res := withToken("/api/find", `{"database":"billing","collection":"invoices"}`, "opaque-token"); status != fiber.StatusOK {
+		t.Errorf("introspected: status %d: %v", status, res)
+	}
+
+	for token, want := range map[string]string{
+		sign(claims("mongo.read", -time.Minute)): "Forbidden: Token expired",
+		sign(jwt.MapClaims{"iss": "https://other.example.com", "aud": "data-api", "client_id": "etl", "exp": time.Now().Add(time.Hour).Unix()}): "Forbidden: Invalid token",
+		"revoked-token": "Forbidden: Invalid token",
+	} {
+		if status, res := withToken("/api/find", `{"database":"analytics","collection":"daily"}`, token); status != fiber.StatusForbidden || res["message"] != want {
+			t.Errorf("status %d: %v, want %q", status, res, want)
+		}
+	}
+}
+
+func TestPublicCollections(t *testing.T) {
+	store := &mock.Store{}
+	app := newTestApp(t, store, &config.Config{PublicCollections: []config.PublicCollection{
+		{Namespace: "open.datasets", Filter: map[string]interface{}{"published": true}, MaxLimit: 10},
+		{Namespace: "open.stations"},
+	}})
+	anonymous := func(method, path, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		res, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode
+	}
+
+	// Only the public documents are found, at most maxLimit at a time
+	if status := anonymous("POST", "/api/find", `{"database":"open","collection":"datasets","filter":{"year":2024},"limit":50}`); status != fiber.StatusOK {
+		t.Fatalf("find: status %d", status)
+	}
+	c := lastCall(t, store, "Find")
+	want := bson.D{{Key: "$and", Value: bson.A{bson.D{{Key: "year", Value: int32(2024)}}, bson.M{"published": true}}}}
+	if !reflect.DeepEqual(c.Filter, want) || *c.Options.(*options.FindOptions).Limit != 10 {
+		t.Errorf("find: filter %v, limit %d", c.Filter, *c.Options.(*options.FindOptions).Limit)
+	}
+	if status := anonymous("POST", "/api/find", `{"database":"open","collection":"stations"}`); status != fiber.StatusOK {
+		t.Fatalf("find: status %d", status)
+	}
+	if c := lastCall(t, store, "Find"); c.Filter != nil && len(c.Filter.(bson.D)) > 0 || *c.Options.(*options.FindOptions).Limit != 100 {
+		t.Errorf("find without filter: filter %v, limit %d", c.Filter, *c.Options.(*options.FindOptions).Limit)
+	}
+	if status := anonymous("POST", "/api/findOne", `{"database":"open","collection":"datasets","filter":{"_id":1}}`); status != fiber.StatusOK {
+		t.Errorf("findOne: status %d", status)
+	}
+	if c := lastCall(t, store, "FindOne"); !reflect.DeepEqual(c.Filter, bson.D{{Key: "$and", Value: bson.A{bson.D{{Key: "_id", Value: int32(1)}}, bson.M{"published": true}}}}) {
+		t.Errorf("findOne: filter %v", c.Filter)
+	}
+
+	// Everything else needs credentials
+	for _, tc := range []struct{ path, body string }{
+		{"/api/find", `{"database":"open","collection":"private"}`},
+		{"/api/insertOne", `{"database":"open","collection":"datasets","document":{}}`},
+		{"/api/aggregate", `{"database":"open","collection":"datasets","pipeline":[]}`},
+		{"/api/sessions", ``},
+	} {
+		if status := anonymous("POST", tc.path, tc.body); status != fiber.StatusForbidden {
+			t.Errorf("%s %s: status %d, want 403", tc.path, tc.body, status)
+		}
+	}
+	// Keys are unaffected
+	if status, res := call(t, app, "POST", "/api/find", `{"database":"open","collection":"datasets","limit":50}`); status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, res)
+	}
+	if c := lastCall(t, store, "Find"); c.Filter != nil && len(c.Filter.(bson.D)) > 0 || *c.Options.(*options.FindOptions).Limit != 50 {
+		t.Errorf("key: filter %v, limit %d", c.Filter, *c.Options.(*options.FindOptions).Limit)
+	}
+}
+
+func TestStrictBodies(t *testing.T) {
+	store := &mock.Store{}
+	typo := `{"database":"app","collection":"users","filterr":{"name":"a"},"limt":1}`
+	if status, _ := call(t, newTestApp(t, store, nil), "POST", "/api/deleteMany", typo); status != fiber.StatusOK {
+		t.Errorf("lenient: status %d, want 200", status)
+	}
+
+	store = &mock.Store{}
+	app := newTestApp(t, store, &config.Config{StrictBodies: true})
+	status, res := call(t, app, "POST", "/api/deleteMany", typo)
+	if status != fiber.StatusBadRequest || res["error"] != "unknown fields: filterr, limt" {
+		t.Errorf("status %d: %v", status, res)
+	}
+	if len(store.Calls()) != 0 {
+		t.Errorf("calls %v", store.Calls())
+	}
+	for path, body := range map[string]string{
+		"/api/find":            `{"database":"app","collection":"users","filter":{},"limit":1,"plainObjectIds":true,"format":"json"}`,
+		"/api/export":          `{"database":"app","collection":"users","chunkSize":10}`,
+		"/api/cloneCollection": `{"source":{"database":"app","collection":"users"},"target":{"cluster":"backup","database":"app","collection":"copy"},"upsertt":true}`,
+	} {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("apiKey", testKey)
+		res, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := fiber.StatusOK
+		if path == "/api/cloneCollection" {
+			want = fiber.StatusBadRequest
+		}
+		if res.StatusCode != want {
+			t.Errorf("%s: status %d, want %d", path, res.StatusCode, want)
+		}
+	}
+}
+
+func TestBodySchemas(t *testing.T) {
+	store := &mock.Store{}
+	app := newTestApp(t, store, nil)
+	for _, tc := range []struct {
+		path, body, want string
+	}{
+		{"/api/find", `{"database":"app","collection":"users","limit":"10"}`, "limit must be an integer, not a string"},
+		{"/api/find", `{"database":"app","collection":"users","limit":2.5}`, "limit must be an integer, not a number"},
+		// Only bulk writes stream their body
+		{"/api/find?stream=true", `{"database":"app","collection":"users","limit":"10"}`, "limit must be an integer, not a string"},
+		{"/api/aggregate", `{"database":"app","collection":"users","pipeline":{"$match":{}}}`, "pipeline must be an array, not an object"},
+		{"/api/updateOne", `{"database":"app","filter":[],"upsert":"yes"}`, "collection is required; filter must be an object, not an array; upsert must be a boolean, not a string"},
+		{"/api/insertMany", `{"database":"app","collection":"users","documents":[{},1]}`, "documents[1] must be an object, not a number"},
+		{"/api/insertOne", `{"database":"app","collection":"users"}`, "document is required"},
+		{"/api/cloneCollection", `{"source":{"database":1},"target":{}}`, "source.database must be a string, not a number"},
+		{"/api/deleteOne", `[]`, "request body must be a JSON object"},
+	} {
+		status, res := call(t, app, "POST", tc.path, tc.body)
+		if status != fiber.StatusBadRequest || res["error"] != tc.want {
+			t.Errorf("%s %s: status %d: %v", tc.path, tc.body, status, res)
+		}
+	}
+	if len(store.Calls()) != 0 {
+		t.Errorf("calls %v", store.Calls())
+	}
+
+	// Integers may be numbers without a fraction or EJSON numbers, and
+	// null leaves a field unset
+	body := `{"database":"app","collection":"users","limit":{"$numberLong":"10"},"skip":5.0,"sort":null}`
+	if status, res := call(t, app, "POST", "/api/find", body); status != fiber.StatusOK {
+		t.Errorf("status %d: %v", status, res)
+	}
+	opts := lastCall(t, store, "Find").Options.(*options.FindOptions)
+	if *opts.Limit != 10 || *opts.Skip != 5 {
+		t.Errorf("limit %d, skip %d", *opts.Limit, *opts.Skip)
+	}
+}
+
+func TestResponseFormats(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("5f1b0c9e8d4a2b3c4d5e6f70")
+	store := &mock.Store{FindFunc: func(mock.Call) ([]bson.M, error) {
+		return []bson.M{{"_id": oid, "name": "a,b", "n": int64(2)}, {"_id": oid, "tags": bson.A{"x"}}}, nil
+	}}
+	app := newTestApp(t, store, nil)
+
+	send := func(path, body, accept string) (*http.Response, []byte) {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("apiKey", testKey)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		res, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, _ := io.ReadAll(res.Body)
+		return res, raw
+	}
+	find := `{"database":"app","collection":"users"}`
+
+	res, raw := send("/api/find", find, "text/csv")
+	if ct := res.Header.Get("Content-Type"); ct != "text/csv" {
+		t.Errorf("Content-Type %q", ct)
+	}
+	if want := "_id,n,name,tags\n5f1b0c9e8d4a2b3c4d5e6f70,2,\"a,b\",\n5f1b0c9e8d4a2b3c4d5e6f70,,,\"[\"\"x\"\"]\"\n"; string(raw) != want {
+		t.Errorf("csv %q, want %q", raw, want)
+	}
+
+	// The format field and query parameter override Accept
+	_, raw = send("/api/find?format=ndjson", find, "text/csv")
+	if want := "{\"_id\":{\"$oid\":\"5f1b0c9e8d4a2b3c4d5e6f70\"},\"n\":2,\"name\":\"a,b\"}\n{\"_id\":{\"$oid\":\"5f1b0c9e8d4a2b3c4d5e6f70\"},\"tags\":[\"x\"]}\n"; string(raw) != want {
+		t.Errorf("ndjson %q", raw)
+	}
+	res, raw = send("/api/find", `{"database":"app","collection":"users","format":"bson"}`, "")
+	if ct := res.Header.Get("Content-Type"); ct != "application/bson" {
+		t.Errorf("Content-Type %q", ct)
+	}
+	var names []interface{}
+	for len(raw) >= 4 {
+		n := int(binary.LittleEndian.Uint32(raw))
+		var d bson.M
+		if err := bson.Unmarshal(raw[:n], &d); err != nil {
+			t.Fatal(err)
+		}
+		names, raw = append(names, d["name"]), raw[n:]
+	}
+	if !reflect.DeepEqual(names, []interface{}{"a,b", nil}) {
+		t.Errorf("bson documents %v", names)
+	}
+
+	_, raw = send("/api/find", find, "application/msgpack")
+	var decoded map[string]interface{}
+	if err := msgpack.Unmarshal(raw, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if got := decoded["documents"].([]interface{})[0].(map[string]interface{}); got["_id"] != oid.Hex() || got["n"] != int64(2) {
+		t.Errorf("msgpack %v", decoded)
+	}
+
+	_, raw = send("/api/find", find, "application/ejson")
+	if want := `{"documents":[{"_id":{"$oid":"5f1b0c9e8d4a2b3c4d5e6f70"},"n":{"$numberLong":"2"}`; !strings.HasPrefix(string(raw), want) {
+		t.Errorf("ejson %s", raw)
+	}
+
+	// Unknown formats are rejected before anything is written
+	calls := len(store.Calls())
+	res, _ = send("/api/insertOne", `{"database":"app","collection":"users","document":{},"format":"xml"}`, "")
+	if res.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("status %d, want 400", res.StatusCode)
+	}
+	if len(store.Calls()) != calls {
+		t.Error("insertOne ran with an unknown format")
+	}
+}
+
+func TestPrettyResponses(t *testing.T) {
+	store := &mock.Store{FindFunc: func(mock.Call) ([]bson.M, error) {
+		return []bson.M{{"_id": int32(1), "item": bson.D{{Key: "z", Value: "<b>"}, {Key: "a", Value: 2.5}}}}, nil
+	}}
+	app := newTestApp(t, store, nil)
+
+	send := func(path, body string) string {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("apiKey", testKey)
+		res, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, _ := io.ReadAll(res.Body)
+		return string(raw)
+	}
+
+	want := `{
+  "documents": [
+    {
+      "_id": 1,
+      "item": {
+        "a": 2.5,
+        "z": "<b>"
+      }
+    }
+  ]
+}
+`
+	if got := send("/api/find", `{"database":"app","collection":"users","pretty":true}`); got != want {
+		t.Errorf("pretty find %s, want %s", got, want)
+	}
+	if got := send("/api/find?pretty=true", `{"database":"app","collection":"users"}`); got != want {
+		t.Errorf("pretty query parameter %s", got)
+	}
+	// Formats other than JSON are written as they are
+	if got := send("/api/find?pretty=true&format=ndjson", `{"database":"app","collection":"users"}`); got != `{"_id":1,"item":{"z":"<b>","a":2.5}}`+"\n" {
+		t.Errorf("pretty ndjson %q", got)
+	}
+}
+
+func TestTabular(t *testing.T) {
+	created := primitive.NewDateTimeFromTime(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+	var chunk int
+	store := &mock.Store{FindFunc: func(mock.Call) ([]bson.M, error) {
+		chunk++
+		if chunk == 2 {
+			return []bson.M{{"_id": int32(3), "n": int32(7), "extra": true}}, nil
+		}
+		return []bson.M{
+			{"_id": int32(1), "n": int32(2), "price": 2.5, "at": created, "tags": bson.A{"a"}},
+			{"_id": int32(2), "n": int64(3), "price": int32(4), "tags": "b"},
+		}, nil
+	}}
+	app := newTestApp(t, store, nil)
+
+	req := httptest.NewRequest("POST", "/api/find", strings.NewReader(`{"database":"shop","collection":"orders"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", tabular.MIMEArrow)
+	req.Header.Set("apiKey", testKey)
+	res, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != tabular.MIMEArrow {
+		t.Errorf("Content-Type %q", ct)
+	}
+	r, err := ipc.NewReader(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Release()
+	var fields []string
+	for _, f := range r.Schema().Fields() {
+		fields = append(fields, f.Name+" "+f.Type.String())
+	}
+	if want := "_id int32,at timestamp[ms, tz=UTC],n int64,price float64,tags utf8"; strings.Join(fields, ",") != want {
+		t.Errorf("fields %v, want %s", fields, want)
+	}
+	if v, _ := r.Schema().Field(4).Metadata.GetValue("encoding"); v != "ejson" {
+		t.Errorf("tags metadata %v", r.Schema().Field(4).Metadata)
+	}
+	if !r.Next() {
+		t.Fatal("no record")
+	}
+	rec := r.Record()
+	if rec.NumRows() != 2 || rec.Column(4).ValueStr(0) != `["a"]` || rec.Column(4).ValueStr(1) != `"b"` || !rec.Column(1).IsNull(1) || rec.Column(3).ValueStr(1) != "4" {
+		t.Errorf("record %v", rec)
+	}
+
+	// Exports get the schema of their first chunk and a row group per chunk
+	chunk = 0
+	req = httptest.NewRequest("POST", "/api/export", strings.NewReader(`{"database":"shop","collection":"orders","format":"parquet","chunkSize":2}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("apiKey", testKey)
+	if res, err = app.Test(req, -1); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := io.ReadAll(res.Body)
+	if res.StatusCode != fiber.StatusOK {
+		t.Fatalf("status %d: %s", res.StatusCode, raw)
+	}
+	pf, err := file.NewParquetReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr, err := pqarrow.NewFileReader(pf, pqarrow.ArrowReadProperties{}, memory.DefaultAllocator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := fr.ReadTable(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Release()
+	if table.NumRows() != 3 || table.NumCols() != 5 || pf.NumRowGroups() != 2 {
+		t.Errorf("%d rows, %d columns, %d row groups", table.NumRows(), table.NumCols(), pf.NumRowGroups())
+	}
+}
+
+func TestShardKey(t *testing.T) {
+	store := &mock.Store{}
+	app := newTestApp(t, store, &config.Config{ShardKeys: map[string][]string{"app.orders": {"region", "customerId"}}})
+
+	for _, tc := range []struct {
+		path, body string
+		status     int
+	}{
+		{"/api/updateOne", `{"database":"app","collection":"orders","filter":{"region":"eu"},"update":{"$set":{"a":1}}}`, fiber.StatusBadRequest},
+		{"/api/updateOne", `{"database":"app","collection":"orders","filter":{"region":"eu","customerId":{"$eq":7}},"update":{"$set":{"a":1}}}`, fiber.StatusOK},
+		{"/api/updateOne", `{"database":"app","collection":"orders","filter":{"_id":1},"update":{"$set":{"a":1}}}`, fiber.StatusOK},
+		{"/api/updateOne", `{"database":"app","collection":"orders","filter":{"_id":1},"update":{"$set":{"a":1}},"upsert":true}`, fiber.StatusBadRequest},
+		{"/api/updateOne", `{"database":"app","collection":"orders","filter":{"_id":1},"update":{"$set":{"region":"us"}}}`, fiber.StatusBadRequest},
+		{"/api/updateMany", `{"database":"app","collection":"orders","filter":{"status":"open"},"update":{"$set":{"a":1}}}`, fiber.StatusOK},
+		{"/api/updateMany", `{"database":"app","collection":"orders","filter":{"region":"eu","customerId":7},"update":{"$set":{"region":"us"}}}`, fiber.StatusBadRequest},
+		{"/api/deleteOne", `{"database":"app","collection":"orders","filter":{"$and":[{"region":"eu"},{"customerId":7}]}}`, fiber.StatusOK},
+		{"/api/deleteOne", `{"database":"app","collection":"orders","filter":{"region":{"$in":["eu"]},"customerId":7}}`, fiber.StatusBadRequest},
+		{"/api/deleteMany", `{"database":"app","collection":"orders","filter":{}}`, fiber.StatusOK},
+		{"/api/deleteOne", `{"database":"app","collection":"other","filter":{"a":1}}`, fiber.StatusOK},
+		{"/api/deleteOne", `{"database":"app","collection":"other","filter":{"a":1},"shardKey":["b"]}`, fiber.StatusBadRequest},
+	} {
+		status, body := call(t, app, "POST", tc.path, tc.body)
+		if status != tc.status {
+			t.Errorf("%s %s: status %d, want %d: %v", tc.path, tc.body, status, tc.status, body)
+		}
+	}
+	status, body := call(t, app, "POST", "/api/deleteOne", `{"database":"app","collection":"orders","filter":{"region":"eu"}}`)
+	if msg, _ := body["error"].(string); status != fiber.StatusBadRequest || !strings.Contains(msg, "missing customerId") {
+		t.Errorf("status %d: %v", status, body)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	store := &mock.Store{AggregateFunc: func(mock.Call) ([]bson.M, error) {
+		return []bson.M{{"_id": "a", "total": int32(3)}}, nil
+	}}
+	app := newTestApp(t, store, nil)
+
+	status, body := call(t, app, "POST", "/api/aggregate",
+		`{"database":"app","collection":"orders","pipeline":[{"$match":{"status":"paid"}},{"$group":{"_id":"$customer","total":{"$sum":1}}}]}`)
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	assertJSON(t, body, `{"documents":[{"_id":"a","total":3}]}`)
+	if p, ok := lastCall(t, store, "Aggregate").Pipeline.(bson.A); !ok || len(p) != 2 {
+		t.Errorf("pipeline %v", p)
+	}
+
+	call(t, app, "POST", "/api/aggregate", `{"database":"app","collection":"orders","pipeline":[],"batchSize":500}`)
+	if opts := lastCall(t, store, "Aggregate").Options.(*options.AggregateOptions); opts.BatchSize == nil || *opts.BatchSize != 500 {
+		t.Errorf("batch size %v, want 500", opts.BatchSize)
+	}
+}
+
+func TestAggregateWrite(t *testing.T) {
+	store := &mock.Store{CountDocumentsFunc: func(mock.Call) (int64, error) { return 7, nil }}
+	app := newTestApp(t, store, nil)
+
+	status, body := call(t, app, "POST", "/api/aggregate",
+		`{"database":"app","collection":"orders","pipeline":[{"$group":{"_id":"$status"}},{"$out":"totals"}]}`)
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	assertJSON(t, body, `{"database":"app","collection":"totals","documents":7}`)
+	calls := store.Calls()
+	if len(calls) != 2 || calls[0].Method != "AggregateWrite" || calls[1].Method != "CountDocuments" || calls[1].Collection != "totals" {
+		t.Errorf("calls %v, want AggregateWrite and CountDocuments on the target", calls)
+	}
+
+	if status, _ := call(t, app, "POST", "/api/aggregate",
+		`{"database":"app","collection":"orders","pipeline":[{"$out":"totals"},{"$match":{}}]}`); status != fiber.StatusBadRequest {
+		t.Errorf("$out before the last stage: status %d, want 400", status)
+	}
+
+	// The read role may aggregate but not write the results
+	reader := newTestApp(t, store, &config.Config{APIKeys: []config.APIKey{{Name: "reader", Key: testKey, Roles: []string{"read"}}}})
+	if status, _ := call(t, reader, "POST", "/api/aggregate",
+		`{"database":"app","collection":"orders","pipeline":[{"$merge":{"into":{"db":"reports","coll":"totals"}}}]}`); status != fiber.StatusForbidden {
+		t.Errorf("read role: status %d, want 403", status)
+	}
+}
+
+func TestImport(t *testing.T) {
+	var batches [][]interface{}
+	store := &mock.Store{InsertManyFunc: func(c mock.Call) (*mongo.InsertManyResult, error) {
+		batches = append(batches, c.Documents)
+		if len(batches) == 1 {
+			// The second document is a duplicate
+			return nil, mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{
+				{WriteError: mongo.WriteError{Index: 1, Code: 11000, Message: "duplicate key"}},
+			}}
+		}
+		return &mongo.InsertManyResult{}, nil
+	}}
+	app := newTestApp(t, store, nil)
+
+	status, body := call(t, app, "POST", "/api/import?database=app&collection=users",
+		"{\"_id\":1}\n{\"_id\":1}\n{\"_id\":2}\n\n{bad\n{\"_id\":3}\n")
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	assertJSON(t, body, `{"processed":5,"inserted":3,"upserted":0,"modified":0,"failed":2,
+		"errors":[{"line":5,"error":"invalid JSON input"},{"line":2,"error":"duplicate key"}]}`)
+	// After the duplicate the remaining documents are inserted again
+	if len(batches) != 2 || len(batches[0]) != 4 || !reflect.DeepEqual(batches[1][0], bson.D{{Key: "_id", Value: int32(2)}}) {
+		t.Errorf("batches %v", batches)
+	}
+}
+
+func TestImportUpsertCSV(t *testing.T) {
+	store := &mock.Store{UpdateOneFunc: func(c mock.Call) (*mongo.UpdateResult, error) {
+		return &mongo.UpdateResult{UpsertedCount: 1}, nil
+	}}
+	app := newTestApp(t, store, nil)
+
+	status, body := call(t, app, "POST", "/api/import?database=app&collection=items&format=csv&upsertKeys=sku",
+		"sku,price,dims.w\nA1,10,2.5\n,3,1\n")
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	assertJSON(t, body, `{"processed":2,"inserted":0,"upserted":2,"modified":0,"failed":0}`)
+
+	c := lastCall(t, store, "UpdateOne")
+	if !reflect.DeepEqual(c.Filter, bson.D{{Key: "sku", Value: ""}}) {
+		t.Errorf("filter %v", c.Filter)
+	}
+	want := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "sku", Value: ""},
+		{Key: "price", Value: int32(3)},
+		{Key: "dims", Value: bson.D{{Key: "w", Value: int32(1)}}},
+	}}}
+	if !reflect.DeepEqual(c.Update, want) {
+		t.Errorf("update %v", c.Update)
+	}
+
+	status, body = call(t, app, "POST", "/api/import?database=app", "")
+	if status != fiber.StatusBadRequest {
+		t.Errorf("missing collection: status %d: %v", status, body)
+	}
+}
+
+func TestExport(t *testing.T) {
+	var filters []interface{}
+	store := &mock.Store{FindFunc: func(c mock.Call) ([]bson.M, error) {
+		filters = append(filters, c.Filter)
+		if len(filters) == 1 {
+			return []bson.M{{"_id": int32(4), "b": 1, "a": 2}, {"_id": int32(5)}}, nil
+		}
+		return []bson.M{{"_id": int32(6)}}, nil
+	}}
+	app := newTestApp(t, store, nil)
+
+	req := httptest.NewRequest("POST", "/api/export", strings.NewReader(
+		`{"database":"app","collection":"users","filter":{"a":{"$gt":1}},"chunkSize":2,"after":3}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("apiKey", testKey)
+	res, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := io.ReadAll(res.Body)
+	if res.StatusCode != fiber.StatusOK {
+		t.Fatalf("status %d: %s", res.StatusCode, raw)
+	}
+	if want := "{\"_id\":4,\"a\":2,\"b\":1}\n{\"_id\":5}\n{\"_id\":6}\n"; string(raw) != want {
+		t.Errorf("got %q, want %q", raw, want)
+	}
+
+	// Each chunk continues after the last _id of the previous one
+	filter := bson.D{{Key: "a", Value: bson.D{{Key: "$gt", Value: int32(1)}}}}
+	for i, after := range []int32{3, 5} {
+		want := bson.D{{Key: "$and", Value: bson.A{filter, bson.D{{Key: "_id", Value: bson.D{{Key: "$gt", Value: after}}}}}}}
+		if i >= len(filters) || !reflect.DeepEqual(filters[i], want) {
+			t.Errorf("chunk %d: filter %v, want %v", i, filters, want)
+		}
+	}
+	if len(filters) != 2 {
+		t.Errorf("%d chunks read, want 2", len(filters))
+	}
+	opts := lastCall(t, store, "Find").Options.(*options.FindOptions)
+	if opts.Limit == nil || *opts.Limit != 2 || !reflect.DeepEqual(opts.Sort, bson.D{{Key: "_id", Value: 1}}) {
+		t.Errorf("options %+v", opts)
+	}
+}
+
+func TestCloneCollection(t *testing.T) {
+	var inserted []interface{}
+	store := &mock.Store{
+		CountDocumentsFunc: func(mock.Call) (int64, error) { return 3, nil },
+		FindFunc: func(c mock.Call) ([]bson.M, error) {
+			if f, _ := c.Filter.(bson.D); len(f) > 0 {
+				return []bson.M{{"_id": int32(3)}}, nil
+			}
+			return []bson.M{{"_id": int32(1), "b": 1, "a": 2}, {"_id": int32(2)}}, nil
+		},
+		InsertManyFunc: func(c mock.Call) (*mongo.InsertManyResult, error) {
+			inserted = append(inserted, c.Documents...)
+			return &mongo.InsertManyResult{InsertedIDs: make([]interface{}, len(c.Documents))}, nil
+		},
+	}
+	app := newTestApp(t, store, nil)
+
+	body := waitForJob(t, app, "/api/cloneCollection",
+		`{"source":{"database":"app","collection":"users"},"target":{"cluster":"backup","database":"app","collection":"users"},"batchSize":2}`)
+	assertJSON(t, body["result"], `{"total":3,"processed":3,"inserted":3,"upserted":0,"modified":0,"failed":0}`)
+	want := []interface{}{
+		bson.D{{Key: "_id", Value: int32(1)}, {Key: "a", Value: 2}, {Key: "b", Value: 1}},
+		bson.D{{Key: "_id", Value: int32(2)}},
+		bson.D{{Key: "_id", Value: int32(3)}},
+	}
+	if !reflect.DeepEqual(inserted, want) {
+		t.Errorf("inserted %v, want %v", inserted, want)
+	}
+
+	for _, body := range []string{
+		`{"source":{"database":"app","collection":"users"},"target":{"database":"app","collection":"users"}}`,
+		`{"source":{"database":"app","collection":"users"},"target":{"cluster":"nope","database":"app","collection":"users"}}`,
+		`{"source":{"database":"app","collection":"users"},"target":{"cluster":"backup","database":"app","collection":"users"},"pipeline":[{"$group":{"_id":"$a"}}]}`,
+	} {
+		if status, _ := call(t, app, "POST", "/api/cloneCollection", body); status != fiber.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", body, status)
+		}
+	}
+}
+
+// waitForJob starts a job and polls it until it succeeds
+func waitForJob(t *testing.T, app *fiber.App, path, body string) map[string]interface{} {
+	t.Helper()
+	status, res := call(t, app, "POST", path, body)
+	if status != fiber.StatusAccepted {
+		t.Fatalf("status %d: %v", status, res)
+	}
+	// Jobs are polled on the jobs endpoint of the /api group, whichever
+	// route started them
+	location := res["location"].(string)
+	if id, _ := res["jobId"].(string); location != "/api/jobs/"+id {
+		t.Fatalf("%s: location %s of job %s", path, location, id)
+	}
+	for res["status"] != jobs.StatusSucceeded {
+		if res["status"] == jobs.StatusFailed {
+			t.Fatalf("job failed: %v", res)
+		}
+		time.Sleep(10 * time.Millisecond)
+		_, res = call(t, app, "GET", location, "")
+	}
+	return res
+}
+
+func TestAsyncJobs(t *testing.T) {
+	var inserted []interface{}
+	store := &mock.Store{
+		FindFunc: func(mock.Call) ([]bson.M, error) {
+			return []bson.M{{"_id": int32(1), "a": 2}, {"_id": int32(2)}}, nil
+		},
+		InsertManyFunc: func(c mock.Call) (*mongo.InsertManyResult, error) {
+			inserted = append(inserted, c.Documents...)
+			return &mongo.InsertManyResult{InsertedIDs: make([]interface{}, len(c.Documents))}, nil
+		},
+		AggregateFunc: func(mock.Call) ([]bson.M, error) { return nil, nil },
+	}
+	app := newTestApp(t, store, &config.Config{SavedQueries: []config.SavedQuery{{
+		Name: "archive", Operation: "aggregate", Database: "app", Collection: "users", Async: true,
+		Pipeline: []map[string]interface{}{{"$out": "archive"}},
+	}}})
+
+	job := waitForJob(t, app, "/api/export", `{"database":"app","collection":"users","async":true}`)
+	result := job["result"].(map[string]interface{})
+	if result["documents"] != 2.0 || result["location"] != "/api/jobs/"+job["id"].(string)+"/result" {
+		t.Fatalf("export result %v", result)
+	}
+	req := httptest.NewRequest("GET", result["location"].(string), nil)
+	req.Header.Set("apiKey", testKey)
+	res, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := io.ReadAll(res.Body)
+	if want := "{\"_id\":1,\"a\":2}\n{\"_id\":2}\n"; res.StatusCode != fiber.StatusOK || string(raw) != want {
+		t.Errorf("download: status %d, body %q, want %q", res.StatusCode, raw, want)
+	}
+
+	job = waitForJob(t, app, "/api/import?database=app&collection=users&async=true", `{"a":1}`+"\n"+`{"a":2}`)
+	assertJSON(t, job["result"], `{"processed":2,"inserted":2,"upserted":0,"modified":0,"failed":0}`)
+	if len(inserted) != 2 {
+		t.Errorf("%d documents imported, want 2", len(inserted))
+	}
+
+	job = waitForJob(t, app, "/api/aggregate",
+		`{"database":"app","collection":"users","async":true,"pipeline":[{"$match":{}},{"$merge":{"into":{"db":"reports","coll":"totals"}}}]}`)
+	assertJSON(t, job["result"], `{"database":"reports","collection":"totals","documents":0}`)
+	if status, _ := call(t, app, "POST", "/api/aggregate", `{"database":"app","collection":"users","async":true,"pipeline":[{"$match":{}}]}`); status != fiber.StatusBadRequest {
+		t.Errorf("async aggregation without $out: status %d, want 400", status)
+	}
+	job = waitForJob(t, app, "/api/run/archive", "")
+	assertJSON(t, job["result"], `{"database":"app","collection":"archive","documents":0}`)
+
+	if status, _ := call(t, app, "GET", "/api/jobs/65a1b2c3d4e5f60718293a4b", ""); status != fiber.StatusNotFound {
+		t.Errorf("unknown job: status %d, want 404", status)
+	}
+}
+
+func TestStats(t *testing.T) {
+	store := &mock.Store{StatsFunc: func(c mock.Call) (*db.Stats, error) {
+		if c.Collection == "missing" {
+			return nil, db.ErrNamespaceNotFound
+		}
+		return &db.Stats{Documents: 2, DataSize: 64, AvgDocumentSize: 32, Indexes: 1, IndexSizes: map[string]int64{"_id_": 4096}}, nil
+	}}
+	app := newTestApp(t, store, nil)
+
+	for i := 0; i < 2; i++ {
+		status, body := call(t, app, "GET", "/api/stats?database=app&collection=users", "")
+		if status != fiber.StatusOK {
+			t.Fatalf("status %d: %v", status, body)
+		}
+		delete(body, "time")
+		assertJSON(t, body, `{"database":"app","collection":"users","documents":2,"avgDocumentSize":32,"dataSize":64,
+			"storageSize":0,"indexes":1,"indexSize":0,"indexSizes":{"_id_":4096}}`)
+	}
+	// The second request is served from the cache
+	if calls := store.Calls(); len(calls) != 1 {
+		t.Errorf("%d store calls, want 1", len(calls))
+	}
+
+	if status, _ := call(t, app, "GET", "/api/stats?database=app&collection=missing", ""); status != fiber.StatusNotFound {
+		t.Errorf("missing collection: status %d, want 404", status)
+	}
+	if status, _ := call(t, app, "GET", "/api/stats", ""); status != fiber.StatusBadRequest {
+		t.Errorf("no database: status %d, want 400", status)
+	}
+
+	reader := newTestApp(t, store, &config.Config{APIKeys: []config.APIKey{{Name: "reader", Key: testKey, Roles: []string{"read"}}}})
+	if status, _ := call(t, reader, "GET", "/api/stats?database=app", ""); status != fiber.StatusForbidden {
+		t.Errorf("read role: status %d, want 403", status)
+	}
+
+	// The stats commands are limited like reads and attributed to the key
+	limited := &mock.Store{}
+	app = newTestApp(t, limited, &config.Config{MaxTimeMS: config.MaxTimeConfig{Read: 1000}})
+	if status, body := call(t, app, "GET", "/api/stats?database=app", ""); status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	if c, _ := limited.LastCall(); c.MaxTime != time.Second || c.Client != "test" {
+		t.Errorf("stats ran with maxTime %v for %q, want 1s for test", c.MaxTime, c.Client)
+	}
+}
+
+func TestStoreErrors(t *testing.T) {
+	fail := errors.New("connection refused")
+	store := &mock.Store{
+		FindFunc:      func(mock.Call) ([]bson.M, error) { return nil, fail },
+		InsertOneFunc: func(mock.Call) (*mongo.InsertOneResult, error) { return nil, fail },
+		AggregateFunc: func(mock.Call) ([]bson.M, error) { return nil, fail },
+	}
+	app := newTestApp(t, store, nil)
+
+	for _, path := range []string{"/api/find", "/api/insertOne", "/api/aggregate"} {
+		status, _ := call(t, app, "POST", path, `{"database":"app","collection":"c","document":{},"pipeline":[]}`)
+		if status != fiber.StatusInternalServerError {
+			t.Errorf("%s: status %d, want 500", path, status)
+		}
+	}
+}
+
+func TestOperationClient(t *testing.T) {
+	store := &mock.Store{}
+	app := newTestApp(t, store, nil)
+
+	for _, path := range []string{"/api/insertOne", "/api/find", "/api/updateMany", "/api/deleteOne", "/api/aggregate"} {
+		status, body := call(t, app, "POST", path, `{"database":"app","collection":"c","document":{},"filter":{},"update":{"$set":{"a":1}},"pipeline":[]}`)
+		if status != fiber.StatusOK {
+			t.Fatalf("%s: status %d: %v", path, status, body)
+		}
+	}
+	calls := store.Calls()
+	if len(calls) != 5 {
+		t.Fatalf("got %d calls", len(calls))
+	}
+	for _, c := range calls {
+		if c.Client != "test" {
+			t.Errorf("%s attributed to %q, want the key name", c.Method, c.Client)
+		}
+	}
+}
+
+func TestMaxTimeDefaults(t *testing.T) {
+	store := &mock.Store{}
+	app := newTestApp(t, store, &config.Config{MaxTimeMS: config.MaxTimeConfig{Read: 1000, Write: 2000}})
+
+	for _, body := range []string{
+		`{"database":"app","collection":"c","filter":{}}`,
+		`{"database":"app","collection":"c","filter":{},"maxTimeMS":50}`,
+	} {
+		if status, resp := call(t, app, "POST", "/api/find", body); status != fiber.StatusOK {
+			t.Fatalf("find: status %d: %v", status, resp)
+		}
+	}
+	for _, path := range []string{"/api/deleteOne", "/api/aggregate"} {
+		if status, resp := call(t, app, "POST", path, `{"database":"app","collection":"c","filter":{},"pipeline":[]}`); status != fiber.StatusOK {
+			t.Fatalf("%s: status %d: %v", path, status, resp)
+		}
+	}
+	// Each batch of a bulk write is limited like a write
+	for _, path := range []string{"/api/insertMany?stream=true", "/api/import?database=app&collection=c&stream=true", "/api/import?database=app&collection=c"} {
+		body := `{"database":"app","collection":"c","documents":[{"a":1}]}`
+		if strings.HasPrefix(path, "/api/import") {
+			body = `{"a":1}`
+		}
+		if status, resp := call(t, app, "POST", path, body); status != fiber.StatusOK {
+			t.Fatalf("%s: status %d: %v", path, status, resp)
+		}
+	}
+	want := []time.Duration{time.Second, 50 * time.Millisecond, 2 * time.Second, 0, 2 * time.Second, 2 * time.Second, 2 * time.Second}
+	calls := store.Calls()
+	if len(calls) != len(want) {
+		t.Fatalf("got %d calls", len(calls))
+	}
+	for i, c := range calls {
+		if c.MaxTime != want[i] {
+			t.Errorf("%s: maxTime %v, want %v", c.Method, c.MaxTime, want[i])
+		}
+	}
+}
+
+func TestSessions(t *testing.T) {
+	store := &mock.Store{}
+	app := newTestApp(t, store, nil)
+
+	status, body := call(t, app, "POST", "/api/sessions", "")
+	if status != fiber.StatusCreated || body["causalConsistency"] != true {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	id, _ := body["sessionId"].(string)
+	if status, body := call(t, app, "POST", "/api/sessions/"+id+"/startTransaction", ""); status != fiber.StatusOK || body["inTransaction"] != true {
+		t.Fatalf("startTransaction: status %d: %v", status, body)
+	}
+	if status, _ := call(t, app, "POST", "/api/sessions/"+id+"/startTransaction", ""); status != fiber.StatusConflict {
+		t.Errorf("second startTransaction: status %d, want 409", status)
+	}
+
+	inSession := func(path, body, session string) int {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("apiKey", testKey)
+		req.Header.Set(SessionHeader, session)
+		res, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode
+	}
+	if status := inSession("/api/insertOne", `{"database":"app","collection":"c","document":{"a":1}}`, id); status != fiber.StatusOK {
+		t.Fatalf("insertOne: status %d", status)
+	}
+	if status := inSession("/api/find", `{"database":"app","collection":"c","filter":{}}`, "unknown"); status != fiber.StatusNotFound {
+		t.Errorf("unknown session: status %d, want 404", status)
+	}
+	if status, body := call(t, app, "POST", "/api/sessions/"+id+"/commitTransaction", ""); status != fiber.StatusOK || body["inTransaction"] != false {
+		t.Fatalf("commitTransaction: status %d: %v", status, body)
+	}
+
+	req := httptest.NewRequest("DELETE", "/api/sessions/"+id, nil)
+	req.Header.Set("apiKey", testKey)
+	res, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("end: status %d", res.StatusCode)
+	}
+	if status := inSession("/api/find", `{"database":"app","collection":"c","filter":{}}`, id); status != fiber.StatusNotFound {
+		t.Errorf("ended session: status %d, want 404", status)
+	}
+
+	var got []string
+	for _, c := range store.Calls() {
+		if c.Session != 1 {
+			t.Errorf("%s ran in session %d", c.Method, c.Session)
+		}
+		got = append(got, c.Method)
+	}
+	want := "StartSession StartTransaction InsertOne CommitTransaction EndSession"
+	if strings.Join(got, " ") != want {
+		t.Errorf("calls %v, want %s", got, want)
+	}
+}
+
+func TestSnapshotRead(t *testing.T) {
+	store := &mock.Store{FindFunc: func(call mock.Call) ([]bson.M, error) {
+		return []bson.M{{"from": call.Collection}}, nil
+	}}
+	app := newTestApp(t, store, &config.Config{
+		APIKeys: []config.APIKey{{Name: "reader", Key: testKey, Roles: []string{"read"}, Namespaces: []string{"shop.*"}}},
+	})
+
+	body := `{"finds":[{"database":"shop","collection":"orders","filter":{"_id":1}},{"database":"shop","collection":"orderItems","filter":{"orderId":1},"limit":5}]}`
+	status, res := call(t, app, "POST", "/api/snapshotRead", body)
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, res)
+	}
+	results, _ := res["results"].([]interface{})
+	if len(results) != 2 {
+		t.Fatalf("results %v", res["results"])
+	}
+	for i, coll := range []string{"orders", "orderItems"} {
+		docs := results[i].(map[string]interface{})["documents"].([]interface{})
+		if len(docs) != 1 || docs[0].(map[string]interface{})["from"] != coll {
+			t.Errorf("results[%d] %v", i, docs)
+		}
+	}
+	var got []string
+	for _, c := range store.Calls() {
+		if c.Session != 1 {
+			t.Errorf("%s ran in session %d", c.Method, c.Session)
+		}
+		got = append(got, c.Method)
+	}
+	if want := "StartSnapshot Find Find EndSession"; strings.Join(got, " ") != want {
+		t.Errorf("calls %v, want %s", got, want)
+	}
+
+	// Every find is authorized before any runs
+	store = &mock.Store{}
+	app = newTestApp(t, store, &config.Config{
+		APIKeys: []config.APIKey{{Name: "reader", Key: testKey, Roles: []string{"read"}, Namespaces: []string{"shop.*"}}},
+	})
+	body = `{"finds":[{"database":"shop","collection":"orders"},{"database":"billing","collection":"invoices"}]}`
+	if status, res := call(t, app, "POST", "/api/snapshotRead", body); status != fiber.StatusForbidden || !strings.HasPrefix(res["error"].(string), "finds[1]: ") {
+		t.Errorf("status %d: %v", status, res)
+	}
+	body = `{"finds":[{"database":"shop","collection":"orders","keyset":true}]}`
+	if status, res := call(t, app, "POST", "/api/snapshotRead", body); status != fiber.StatusBadRequest {
+		t.Errorf("keyset: status %d: %v", status, res)
+	}
+	if status, res := call(t, app, "POST", "/api/snapshotRead", `{"finds":[]}`); status != fiber.StatusBadRequest {
+		t.Errorf("no finds: status %d: %v", status, res)
+	}
+	if calls := store.Calls(); len(calls) != 0 {
+		t.Errorf("store was called: %v", calls)
+	}
+}
+
+func TestFanOutFind(t *testing.T) {
+	ctx := context.Background()
+	us, eu := memstore.New(), memstore.New()
+	order := func(id, total int32) bson.D {
+		return bson.D{{Key: "_id", Value: id}, {Key: "total", Value: total}}
+	}
+	if _, err := us.InsertMany(ctx, "shop", "orders", []interface{}{order(1, 30), order(2, 10), order(3, 20)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := eu.InsertMany(ctx, "shop", "orders", []interface{}{order(2, 10), order(3, 25), order(4, 5)}); err != nil {
+		t.Fatal(err)
+	}
+	broken := &mock.Store{FindFunc: func(mock.Call) ([]bson.M, error) { return nil, errors.New("connection refused") }}
+
+	cfg := &config.Config{APIKeys: []config.APIKey{{Name: "test", Key: testKey}}, SystemDatabase: "dataapi_system"}
+	keys, err := auth.NewStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := fiber.New()
+	app.Use(auth.Middleware(auth.MiddlewareConfig{Store: keys}))
+	data := &Data{
+		Store:       us,
+		Clusters:    map[string]db.DataStore{config.DefaultCluster: us, "eu": eu, "ap": broken},
+		FanOutReads: config.FanOutReadConfig{Clusters: []string{config.DefaultCluster, "eu", "ap"}, TimeoutMs: 1000},
+	}
+	app.Post("/api/fanOutFind", ValidateBody("fanOutFind"), data.FanOutFind)
+
+	ids := func(res map[string]interface{}) []interface{} {
+		var ids []interface{}
+		for _, d := range res["documents"].([]interface{}) {
+			ids = append(ids, d.(map[string]interface{})["_id"])
+		}
+		return ids
+	}
+	status, res := call(t, app, "POST", "/api/fanOutFind", `{"database":"shop","collection":"orders","clusters":["default","eu"],"sort":{"total":-1},"limit":3}`)
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, res)
+	}
+	if got := ids(res); !reflect.DeepEqual(got, []interface{}{float64(1), float64(3), float64(2)}) {
+		t.Errorf("merged ids %v", got)
+	}
+	// The copy of the first cluster listed wins
+	if total := res["documents"].([]interface{})[1].(map[string]interface{})["total"]; total != float64(20) {
+		t.Errorf("order 3 total %v, want the default cluster's", total)
+	}
+	if res["duplicates"] != float64(2) || res["conflicts"] != float64(1) || res["partial"] != nil {
+		t.Errorf("duplicates %v, conflicts %v, partial %v", res["duplicates"], res["conflicts"], res["partial"])
+	}
+	reads := res["clusters"].([]interface{})
+	if len(reads) != 2 {
+		t.Fatalf("clusters %v", reads)
+	}
+	for i, name := range []string{"default", "eu"} {
+		read := reads[i].(map[string]interface{})
+		if read["cluster"] != name || read["documents"] != float64(3) || read["latencyMs"] == nil {
+			t.Errorf("read %d: %v", i, read)
+		}
+	}
+
+	// Skipped documents are skipped from the merged results
+	_, res = call(t, app, "POST", "/api/fanOutFind", `{"database":"shop","collection":"orders","clusters":["eu","default"],"sort":{"total":-1},"skip":1,"limit":2}`)
+	if got := ids(res); !reflect.DeepEqual(got, []interface{}{float64(3), float64(2)}) {
+		t.Errorf("skipped ids %v", got)
+	}
+	if total := res["documents"].([]interface{})[0].(map[string]interface{})["total"]; total != float64(25) {
+		t.Errorf("order 3 total %v, want the eu cluster's", total)
+	}
+
+	// A failing cluster is reported and the others are still returned
+	status, res = call(t, app, "POST", "/api/fanOutFind", `{"database":"shop","collection":"orders"}`)
+	if status != fiber.StatusOK || res["partial"] != true || len(ids(res)) != 4 {
+		t.Fatalf("partial: %d %v", status, res)
+	}
+	if read := res["clusters"].([]interface{})[2].(map[string]interface{}); read["error"] != "connection refused" {
+		t.Errorf("failed read %v", read)
+	}
+
+	for _, body := range []string{
+		`{"database":"shop","collection":"orders","clusters":["default","us"]}`,
+		`{"database":"shop","collection":"orders","clusters":["eu","eu"]}`,
+		`{"database":"shop","collection":"orders","projection":{"_id":0}}`,
+	} {
+		if status, res := call(t, app, "POST", "/api/fanOutFind", body); status != fiber.StatusBadRequest {
+			t.Errorf("%s: status %d: %v", body, status, res)
+		}
+	}
+}
+
+func TestTail(t *testing.T) {
+	store := &mock.Store{
+		StatsFunc: func(call mock.Call) (*db.Stats, error) {
+			switch call.Collection {
+			case "missing":
+				return nil, db.ErrNamespaceNotFound
+			case "users":
+				return &db.Stats{}, nil
+			}
+			return &db.Stats{Capped: true}, nil
+		},
+		FindFunc: func(call mock.Call) ([]bson.M, error) {
+			if call.Collection == "empty" {
+				return nil, nil
+			}
+			return []bson.M{{"_id": int32(1), "msg": "started"}, {"_id": int32(2), "msg": "ready"}}, nil
+		},
+	}
+	app := newTestApp(t, store, &config.Config{TailIdleTimeoutSeconds: 5})
+
+	tail := func(body, accept string) (int, string) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/api/tail", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("apiKey", testKey)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		res, err := app.Test(req, 10000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(raw)
+	}
+
+	status, body := tail(`{"database":"app","collection":"logs","filter":{"level":"info"}}`, "")
+	if status != fiber.StatusOK || body != "{\"_id\":1,\"msg\":\"started\"}\n{\"_id\":2,\"msg\":\"ready\"}\n" {
+		t.Fatalf("ndjson tail: %d %q", status, body)
+	}
+	find := lastCall(t, store, "Find")
+	opts := find.Options.(*options.FindOptions)
+	if opts.CursorType == nil || *opts.CursorType != options.TailableAwait || opts.MaxAwaitTime == nil {
+		t.Errorf("tail find options %+v, want a tailable cursor awaiting data", opts)
+	}
+	if !reflect.DeepEqual(find.Filter, bson.D{{Key: "level", Value: "info"}}) {
+		t.Errorf("tail filter %v", find.Filter)
+	}
+
+	status, body = tail(`{"database":"app","collection":"logs"}`, "text/event-stream")
+	if status != fiber.StatusOK || body != "data: {\"_id\":1,\"msg\":\"started\"}\n\ndata: {\"_id\":2,\"msg\":\"ready\"}\n\n" {
+		t.Fatalf("sse tail: %d %q", status, body)
+	}
+
+	// A tail of an empty collection waits for documents until it is idle
+	started := time.Now()
+	if status, body = tail(`{"database":"app","collection":"empty","idleTimeoutMS":50}`, ""); status != fiber.StatusOK || body != "" {
+		t.Errorf("empty tail: %d %q", status, body)
+	}
+	if elapsed := time.Since(started); elapsed < 50*time.Millisecond {
+		t.Errorf("empty tail ended after %v, before its idle timeout", elapsed)
+	}
+
+	for _, tc := range []struct {
+		body   string
+		status int
+	}{
+		{`{"database":"app","collection":"users"}`, fiber.StatusBadRequest},
+		{`{"database":"app","collection":"missing"}`, fiber.StatusNotFound},
+		{`{"database":"app","collection":"logs","idleTimeoutMS":60000}`, fiber.StatusBadRequest},
+		{`{"database":"app","collection":"logs","format":"csv"}`, fiber.StatusBadRequest},
+	} {
+		if status, body := tail(tc.body, ""); status != tc.status {
+			t.Errorf("%s: status %d, want %d: %s", tc.body, status, tc.status, body)
+		}
+	}
+}
+
+func TestInvalidInput(t *testing.T) {
+	store := &mock.Store{}
+	app := newTestApp(t, store, nil)
+
+	for path, body := range map[string]string{
+		"/api/find":      `not json`,
+		"/api/findOne":   `{"database":"app","collection":"c","filter":{"_id":{"$oid":"nope"}}}`,
+		"/api/insertOne": `{"database":"app","collection":"c","document":{"d":{"$date":"yesterday"}}}`,
+	} {
+		if status, body := call(t, app, "POST", path, body); status != fiber.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400 (%v)", path, status, body)
+		}
+	}
+	if calls := store.Calls(); len(calls) != 0 {
+		t.Errorf("store was called: %v", calls)
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	store := &mock.Store{}
+	app := newTestApp(t, store, &config.Config{
+		APIKeys: []config.APIKey{{Name: "reader", Key: testKey, Roles: []string{"read"}, Namespaces: []string{"app.*"}}},
+	})
+
+	cases := map[string]string{
+		"/api/insertOne": `{"database":"app","collection":"users","document":{}}`,
+		"/api/find":      `{"database":"other","collection":"users","filter":{}}`,
+	}
+	for path, body := range cases {
+		if status, body := call(t, app, "POST", path, body); status != fiber.StatusForbidden {
+			t.Errorf("%s: status %d, want 403 (%v)", path, status, body)
+		}
+	}
+	if calls := store.Calls(); len(calls) != 0 {
+		t.Errorf("store was called: %v", calls)
+	}
+
+	req := httptest.NewRequest("POST", "/api/find", strings.NewReader(`{}`))
+	req.Header.Set("apiKey", "wrong")
+	if res, _ := app.Test(req, -1); res.StatusCode != fiber.StatusForbidden {
+		t.Errorf("invalid key: status %d, want 403", res.StatusCode)
+	}
+}
+
+func TestTenancy(t *testing.T) {
+	store := &mock.Store{}
+	key := []config.APIKey{{Name: "acme", Key: testKey, Tenant: "acme"}}
+
+	app := newTestApp(t, store, &config.Config{APIKeys: key, Tenancy: config.TenancyConfig{Mode: config.TenancyPrefix}})
+	call(t, app, "POST", "/api/find", `{"database":"app","collection":"users","filter":{}}`)
+	if c := lastCall(t, store, "Find"); c.Database != "acme_app" {
+		t.Errorf("prefix mode: database %s, want acme_app", c.Database)
+	}
+
+	app = newTestApp(t, store, &config.Config{APIKeys: key, Tenancy: config.TenancyConfig{Mode: config.TenancyField, Field: "tenantId"}})
+	call(t, app, "POST", "/api/deleteMany", `{"database":"app","collection":"users","filter":{"old":true}}`)
+	want := bson.D{{Key: "$and", Value: bson.A{bson.D{{Key: "old", Value: true}}, bson.D{{Key: "tenantId", Value: "acme"}}}}}
+	if c := lastCall(t, store, "DeleteMany"); !reflect.DeepEqual(c.Filter, want) {
+		t.Errorf("field mode: filter %v, want %v", c.Filter, want)
+	}
+
+	// Aggregations may only write the tenant's documents
+	for body, want := range map[string]int{
+		`[{"$out":"copy"}]`:   fiber.StatusForbidden,
+		`[{"$merge":"copy"}]`: fiber.StatusForbidden,
+		`[{"$merge":{"into":"copy","on":["_id","tenantId"],"whenMatched":[{"$set":{"tenantId":"other"}}]}}]`: fiber.StatusForbidden,
+		`[{"$set":{"tenantId":"other"}},{"$merge":{"into":"copy","on":["_id","tenantId"]}}]`:                 fiber.StatusOK,
+	} {
+		status, res := call(t, app, "POST", "/api/aggregate", `{"database":"app","collection":"users","pipeline":`+body+`}`)
+		if status != want {
+			t.Errorf("%s: status %d, want %d: %v", body, status, want, res)
+		}
+	}
+	var stages bson.A
+	for _, c := range store.Calls() {
+		if c.Method == "AggregateWrite" {
+			stages = c.Pipeline.(bson.A)
+		}
+	}
+	if len(stages) < 2 {
+		t.Fatalf("pipeline %v", stages)
+	}
+	if set := stages[len(stages)-2]; !reflect.DeepEqual(set, bson.D{{Key: "$set", Value: bson.D{{Key: "tenantId", Value: "acme"}}}}) {
+		t.Errorf("merged documents not stamped: %v", stages)
+	}
+}
+
+func TestValidateQuery(t *testing.T) {
+	store := &mock.Store{}
+	app := newTestApp(t, store, nil)
+
+	status, body := call(t, app, "POST", "/api/validateQuery", `{"filter":{"name":{"$regex":"ada"}}}`)
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	if body["valid"] != true {
+		t.Errorf("expected valid filter: %v", body)
+	}
+	if status, _ := call(t, app, "POST", "/api/validateQuery", `{}`); status != fiber.StatusBadRequest {
+		t.Errorf("empty request: status %d, want 400", status)
+	}
+	if calls := store.Calls(); len(calls) != 0 {
+		t.Errorf("store was called: %v", calls)
+	}
+}
+
+func TestSavedQueries(t *testing.T) {
+	store := &mock.Store{}
+	app := newTestApp(t, store, &config.Config{
+		APIKeys: []config.APIKey{{Name: "runner", Key: testKey, Roles: []string{"runner"}}},
+		Roles:   []config.Role{{Name: "runner", Operations: []string{"run:byStatus"}}},
+		SavedQueries: []config.SavedQuery{{
+			Name: "byStatus", Operation: "find", Database: "shop", Collection: "orders",
+			Parameters: []config.Parameter{{Name: "status", Type: "string", Required: true}},
+			Filter:     map[string]interface{}{"status": map[string]interface{}{"$param": "status"}},
+		}},
+	})
+
+	status, body := call(t, app, "GET", "/api/run", "")
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	assertJSON(t, body, `{"queries":[{"name":"byStatus","operation":"find","parameters":[{"name":"status","type":"string","required":true}]}]}`)
+
+	status, body = call(t, app, "POST", "/api/run/byStatus", `{"status":"paid"}`)
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	c := lastCall(t, store, "Find")
+	if c.Database != "shop" || !reflect.DeepEqual(c.Filter, bson.D{{Key: "status", Value: "paid"}}) {
+		t.Errorf("ran %s.%s with %v", c.Database, c.Collection, c.Filter)
+	}
+
+	if status, _ := call(t, app, "POST", "/api/run/byStatus", `{}`); status != fiber.StatusBadRequest {
+		t.Errorf("missing parameter: status %d, want 400", status)
+	}
+	if status, _ := call(t, app, "POST", "/api/run/unknown", `{}`); status != fiber.StatusNotFound {
+		t.Errorf("unknown query: status %d, want 404", status)
+	}
+	// The role only allows running the saved query
+	if status, _ := call(t, app, "POST", "/api/find", `{"database":"shop","collection":"orders"}`); status != fiber.StatusForbidden {
+		t.Errorf("direct find: status %d, want 403", status)
+	}
+}
+
+func TestSavedQueryOperations(t *testing.T) {
+	// Saved queries may run exactly the operations with a handler
+	for _, op := range query.Operations {
+		if operations[op] == nil {
+			t.Errorf("no handler for saved query operation %s", op)
+		}
+	}
+	if len(operations) != len(query.Operations) {
+		t.Errorf("%d handlers for %d saved query operations", len(operations), len(query.Operations))
+	}
+
+	store := &mock.Store{}
+	queries, err := query.NewRegistry(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range auth.Operations {
+		if operations[op] != nil {
+			continue
+		}
+		q := config.SavedQuery{Name: "q_" + op, Operation: op, Database: "shop", Collection: "orders"}
+		if err := queries.Put(context.Background(), q); err == nil {
+			t.Errorf("saved a query running %s", op)
+		}
+		if _, err := query.NewRegistry([]config.SavedQuery{q}); err == nil {
+			t.Errorf("configured a query running %s", op)
+		}
+	}
+
+	// A query whose operation has no handler, e.g. stored by an earlier
+	// version, is rejected rather than run
+	app := newTestApp(t, store, &config.Config{
+		APIKeys:      []config.APIKey{{Name: "test", Key: testKey}},
+		SavedQueries: []config.SavedQuery{{Name: "all", Operation: "find", Database: "shop", Collection: "orders"}},
+	})
+	find := operations["find"]
+	delete(operations, "find")
+	defer func() { operations["find"] = find }()
+	if status, body := call(t, app, "POST", "/api/run/all", ""); status != fiber.StatusBadRequest {
+		t.Errorf("status %d: %v", status, body)
+	}
+}
+
+func TestPipelineTemplates(t *testing.T) {
+	store := &mock.Store{}
+	salesByRegion := config.SavedQuery{
+		Name: "salesByRegion", Operation: "aggregate", Database: "shop", Collection: "orders",
+		Parameters: []config.Parameter{{Name: "start", Type: "date", Required: true}, {Name: "end", Type: "date", Required: true}},
+		Pipeline: []map[string]interface{}{
+			{"$match": map[string]interface{}{"createdAt": map[string]interface{}{"$gte": map[string]interface{}{"$param": "start"}, "$lt": map[string]interface{}{"$param": "end"}}}},
+			{"$group": map[string]interface{}{"_id": "$region", "total": map[string]interface{}{"$sum": "$amount"}}},
+		},
+	}
+	app := newTestApp(t, store, &config.Config{
+		APIKeys:      []config.APIKey{{Name: "runner", Key: testKey, Roles: []string{"runner"}}},
+		Roles:        []config.Role{{Name: "runner", Operations: []string{"run:salesByRegion"}}},
+		SavedQueries: []config.SavedQuery{salesByRegion},
+	})
+
+	if status, body := call(t, app, "POST", "/api/run/salesByRegion", `{"start":"2024-01-01T00:00:00Z","end":"2024-02-01T00:00:00Z"}`); status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	pipeline := lastCall(t, store, "Aggregate").Pipeline.(bson.A)
+	match := pipeline[0].(bson.D)[0].Value.(bson.D)[0].Value.(bson.D)
+	if start, ok := match[0].Value.(primitive.DateTime); !ok || start.Time().UTC() != time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC) {
+		t.Errorf("bound $match %v", match)
+	}
+	// Parameters are values only, so they cannot inject stages or operators
+	for _, body := range []string{
+		`{"start":{"$gt":""},"end":"2024-02-01T00:00:00Z"}`,
+		`{"start":"2024-01-01T00:00:00Z","end":"2024-02-01T00:00:00Z","stage":{"$out":"x"}}`,
+	} {
+		if status, res := call(t, app, "POST", "/api/run/salesByRegion", body); status != fiber.StatusBadRequest {
+			t.Errorf("%s: status %d: %v", body, status, res)
+		}
+	}
+	if status, _ := call(t, app, "POST", "/api/aggregate", `{"database":"shop","collection":"orders","pipeline":[]}`); status != fiber.StatusForbidden {
+		t.Errorf("direct aggregate: status %d, want 403", status)
+	}
+
+	salesByRegion.Pipeline = append(salesByRegion.Pipeline, map[string]interface{}{"$param": "start"})
+	if _, err := query.NewRegistry([]config.SavedQuery{salesByRegion}); err == nil {
+		t.Error("registered a pipeline with a parameter as a stage")
+	}
+}
+
+func TestAdminListing(t *testing.T) {
+	store := &mock.Store{
+		ListDatabasesFunc:   func() ([]string, error) { return []string{"app", "shop"}, nil },
+		ListCollectionsFunc: func(database string) ([]string, error) { return []string{database + "_coll"}, nil },
+	}
+	app := newTestApp(t, store, nil)
+
+	status, body := call(t, app, "GET", "/api/admin/databases", "")
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	assertJSON(t, body, `{"databases":["app","shop"]}`)
+
+	_, body = call(t, app, "GET", "/api/admin/databases/shop/collections", "")
+	assertJSON(t, body, `{"collections":["shop_coll"]}`)
+}
+
+func TestHashedKeys(t *testing.T) {
+	const secret = "hashed_secret_key"
+	hash, err := auth.HashKey(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := newTestApp(t, &mock.Store{}, &config.Config{APIKeys: []config.APIKey{
+		{Name: "test", Key: testKey},
+		{Name: "hashed", KeyHash: hash},
+	}})
+	find := func(key string) (int, map[string]interface{}) {
+		req := httptest.NewRequest("POST", "/api/find", strings.NewReader(`{"database":"app","collection":"users"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("apiKey", key)
+		res, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded map[string]interface{}
+		if err := json.NewDecoder(res.Body).Decode(&decoded); err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, decoded
+	}
+	for key, want := range map[string]int{
+		secret:                   fiber.StatusOK,
+		secret + "x":             fiber.StatusForbidden,
+		"hashed_s":               fiber.StatusForbidden,
+		"hashed_secret_kez":      fiber.StatusForbidden,
+		strings.ToUpper(testKey): fiber.StatusForbidden,
+		testKey[:len(testKey)-1]: fiber.StatusForbidden,
+	} {
+		// The second request is answered from the verified keys
+		for i := 0; i < 2; i++ {
+			if status, res := find(key); status != want {
+				t.Errorf("key %q: status %d, want %d: %v", key, status, want, res)
+			}
+		}
+	}
+
+	// Created keys are returned once and only stored hashed
+	status, res := call(t, app, "POST", "/api/admin/keys", `{"name":"created"}`)
+	if status != fiber.StatusCreated {
+		t.Fatalf("create: status %d: %v", status, res)
+	}
+	created := res["key"].(map[string]interface{})
+	if _, ok := created["keyHash"]; ok {
+		t.Errorf("create returned the hash: %v", created)
+	}
+	value := created["key"].(string)
+	if status, res := find(value); status != fiber.StatusOK {
+		t.Errorf("created key: status %d: %v", status, res)
+	}
+	_, res = call(t, app, "GET", "/api/admin/keys", "")
+	for _, k := range res["keys"].([]interface{}) {
+		k := k.(map[string]interface{})
+		if k["keyHash"] != nil || k["name"] == "created" && k["key"] != value[:8]+"****" {
+			t.Errorf("listed %v", k)
+		}
+	}
+	if status, res := call(t, app, "POST", "/api/admin/keys", `{"name":"copy","key":"`+value+`"}`); status != fiber.StatusConflict {
+		t.Errorf("duplicate value: status %d: %v", status, res)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	app := newTestApp(t, &mock.Store{}, &config.Config{RESTAPI: true})
+	find := `{"database":"app","collection":"users"}`
+	insert := `{"database":"app","collection":"users","document":{"a":1}}`
+	maintenance := func(body string) map[string]interface{} {
+		t.Helper()
+		status, res := call(t, app, "PUT", "/api/admin/maintenance", body)
+		if status != fiber.StatusOK {
+			t.Fatalf("status %d: %v", status, res)
+		}
+		return res["maintenance"].(map[string]interface{})
+	}
+	retryAfter := func(path, body string) (int, string) {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("apiKey", testKey)
+		res, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, res.Header.Get(fiber.HeaderRetryAfter)
+	}
+
+	state := maintenance(`{"enabled":true}`)
+	if state["since"] == nil {
+		t.Errorf("state %v", state)
+	}
+	if status, after := retryAfter("/api/insertOne", insert); status != fiber.StatusServiceUnavailable || after != "60" {
+		t.Errorf("insert: status %d, Retry-After %q", status, after)
+	}
+	if status, _ := retryAfter("/api/data/app/users", `{"a":1}`); status != fiber.StatusServiceUnavailable {
+		t.Errorf("REST create: status %d", status)
+	}
+	if status, res := call(t, app, "POST", "/api/find", find); status != fiber.StatusOK {
+		t.Errorf("find: status %d: %v", status, res)
+	}
+
+	maintenance(`{"enabled":true,"reads":true,"retryAfterSeconds":30,"message":"Upgrading, back soon"}`)
+	if status, after := retryAfter("/api/find", find); status != fiber.StatusServiceUnavailable || after != "30" {
+		t.Errorf("find with reads frozen: status %d, Retry-After %q", status, after)
+	}
+	_, res := call(t, app, "POST", "/api/find", find)
+	assertJSON(t, res, `{"error":"Upgrading, back soon"}`)
+	if _, res := call(t, app, "GET", "/api/admin/maintenance", ""); res["maintenance"].(map[string]interface{})["since"] != state["since"] {
+		t.Errorf("since changed: %v", res)
+	}
+
+	if state := maintenance(`{"enabled":false,"reads":true}`); len(state) != 2 || state["enabled"] != false {
+		t.Errorf("disabled state %v", state)
+	}
+	if status, res := call(t, app, "POST", "/api/insertOne", insert); status != fiber.StatusOK {
+		t.Errorf("insert after maintenance: status %d: %v", status, res)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "touch.star")
+	if err := os.WriteFile(script, []byte(`
+def handle(req):
+    if req.body.get("write"):
+        return mongo.insert_one("shop", "orders", {"touched": True})
+    return {"orders": mongo.count("shop", "orders", {})}
+`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	store := &mock.Store{}
+	app := newTestApp(t, store, &config.Config{
+		ReadOnly: true,
+		RESTAPI:  true,
+		SavedQueries: []config.SavedQuery{{
+			Name: "archive", Operation: "updateMany", Database: "shop", Collection: "orders",
+			Update: map[string]interface{}{"$set": map[string]interface{}{"archived": true}},
+		}},
+		Endpoints: []config.Endpoint{{Name: "touch", Method: "POST", Path: "/touch", Script: script}},
+	})
+
+	// Write endpoints aren't routed: 404, or 405 where the path also serves
+	// reads
+	for _, path := range []string{"insertOne", "insertMany", "updateOne", "mergeOne", "patchOne", "updateMany",
+		"deleteOne", "deleteMany", "import", "revert", "restore", "cloneCollection"} {
+		if status := send(t, app, "POST", "/api/"+path, `{}`); status != fiber.StatusNotFound {
+			t.Errorf("%s: status %d, want 404", path, status)
+		}
+	}
+	for _, route := range [][2]string{{"POST", "/api/data/shop/orders"}, {"PATCH", "/api/data/shop/orders/1"}, {"DELETE", "/api/data/shop/orders/1"}} {
+		if status := send(t, app, route[0], route[1], `{}`); status != fiber.StatusMethodNotAllowed {
+			t.Errorf("%s %s: status %d, want 405", route[0], route[1], status)
+		}
+	}
+
+	for _, route := range [][2]string{{"POST", "/api/find"}, {"GET", "/api/data/shop/orders"}, {"GET", "/api/run"}} {
+		if status, res := call(t, app, route[0], route[1], `{"database":"shop","collection":"orders"}`); status != fiber.StatusOK {
+			t.Errorf("%s %s: status %d: %v", route[0], route[1], status, res)
+		}
+	}
+
+	// Sessions, saved queries and custom endpoints stay routed; sessions
+	// only ever run reads, and the writes of the others are forbidden
+	status, res := call(t, app, "POST", "/api/sessions", "")
+	if status != fiber.StatusCreated {
+		t.Fatalf("sessions: status %d: %v", status, res)
+	}
+	if status, res := call(t, app, "POST", "/api/sessions/"+res["sessionId"].(string)+"/startTransaction", ""); status != fiber.StatusOK {
+		t.Errorf("startTransaction: status %d: %v", status, res)
+	}
+	if status, res := call(t, app, "POST", "/api/custom/touch", `{}`); status != fiber.StatusOK {
+		t.Errorf("custom read: status %d: %v", status, res)
+	}
+	for path, body := range map[string]string{
+		"/api/run/archive":  `{}`,
+		"/api/aggregate":    `{"database":"shop","collection":"orders","pipeline":[{"$out":"totals"}]}`,
+		"/api/custom/touch": `{"write":true}`,
+	} {
+		status, res := call(t, app, "POST", path, body)
+		if status != fiber.StatusForbidden || !strings.Contains(res["error"].(string), "read-only instance") {
+			t.Errorf("%s: status %d: %v", path, status, res)
+		}
+	}
+	for _, c := range store.Calls() {
+		switch c.Method {
+		case "Find", "CountDocuments", "StartSession", "StartTransaction":
+		default:
+			t.Errorf("called %s", c.Method)
+		}
+	}
+}
+
+// send sends a request with the test API key and returns its status
+func send(t *testing.T, app *fiber.App, method, path, body string) int {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("apiKey", testKey)
+	res, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode
+}
+
+func TestRetention(t *testing.T) {
+	week := int64(7 * 24 * 60 * 60)
+	store := &mock.Store{ListIndexesFunc: func(c mock.Call) ([]db.Index, error) {
+		switch c.Collection {
+		case "sessions":
+			return []db.Index{{Name: "lastSeen_1", Keys: bson.D{{Key: "lastSeen", Value: int32(1)}}, ExpireAfterSeconds: &week}}, nil
+		case "logs":
+			return []db.Index{{Name: "at_1", Keys: bson.D{{Key: "at", Value: int32(1)}}}}, nil
+		}
+		return []db.Index{}, nil
+	}}
+	app := newTestApp(t, store, &config.Config{Retention: []config.RetentionPolicy{
+		{Database: "app", Collection: "events", Field: "createdAt", ExpireAfter: "30d"},
+		{Database: "app", Collection: "sessions", Field: "lastSeen", ExpireAfter: "24h"},
+		{Database: "app", Collection: "logs", Field: "at", ExpireAfter: "1h"},
+	}})
+
+	status, body := call(t, app, "GET", "/api/admin/retention", "")
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	states := func(body map[string]interface{}) []interface{} {
+		var s []interface{}
+		for _, p := range body["policies"].([]interface{}) {
+			s = append(s, p.(map[string]interface{})["state"])
+		}
+		return s
+	}
+	assertJSON(t, states(body), `["missing","drift","conflict"]`)
+	for _, c := range store.Calls() {
+		if c.Method != "ListIndexes" {
+			t.Errorf("check called %s", c.Method)
+		}
+	}
+
+	_, body = call(t, app, "POST", "/api/admin/retention/apply", "")
+	assertJSON(t, states(body), `["created","updated","conflict"]`)
+	var created, updated bool
+	for _, c := range store.Calls() {
+		switch c.Method {
+		case "CreateIndex":
+			created = c.Collection == "events" && *c.Index.ExpireAfterSeconds == 30*24*60*60 &&
+				reflect.DeepEqual(c.Index.Keys, bson.D{{Key: "createdAt", Value: int32(1)}})
+		case "SetIndexExpiry":
+			updated = c.Collection == "sessions" && c.Index.Name == "lastSeen_1" && *c.Index.ExpireAfterSeconds == 24*60*60
+		}
+	}
+	if !created || !updated {
+		t.Errorf("calls %+v", store.Calls())
+	}
+}
+
+func TestWarmQueries(t *testing.T) {
+	store := &mock.Store{FindFunc: func(c mock.Call) ([]bson.M, error) {
+		if c.Collection == "broken" {
+			return nil, errors.New("not authorized")
+		}
+		return []bson.M{{"_id": 1}}, nil
+	}}
+	app := newTestApp(t, store, &config.Config{WarmQueries: []config.WarmQuery{
+		{Database: "shop", Collection: "orders", Filter: map[string]interface{}{"status": "open"}, Sort: "status,-createdAt"},
+		{Database: "shop", Collection: "orders", Pipeline: []map[string]interface{}{{"$group": map[string]interface{}{"_id": "$region"}}}},
+		{Database: "shop", Collection: "broken"},
+	}})
+
+	status, body := call(t, app, "POST", "/api/admin/warm", "")
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	results := body["queries"].([]interface{})
+	if len(results) != 3 {
+		t.Fatalf("results %v", results)
+	}
+	for i, want := range []string{"find", "aggregate", "find"} {
+		if op := results[i].(map[string]interface{})["operation"]; op != want {
+			t.Errorf("query %d ran %v", i, op)
+		}
+	}
+	if r := results[2].(map[string]interface{}); r["error"] != "not authorized" {
+		t.Errorf("failed query %v", r)
+	}
+
+	calls := store.Calls()
+	opts := calls[0].Options.(*options.FindOptions)
+	if *opts.Limit != 1 || !reflect.DeepEqual(opts.Sort, bson.D{{Key: "status", Value: 1}, {Key: "createdAt", Value: -1}}) {
+		t.Errorf("find options %+v", opts)
+	}
+	if !reflect.DeepEqual(calls[0].Filter, bson.D{{Key: "status", Value: "open"}}) {
+		t.Errorf("filter %v", calls[0].Filter)
+	}
+	want := bson.A{bson.D{{Key: "$group", Value: bson.D{{Key: "_id", Value: "$region"}}}}, bson.D{{Key: "$limit", Value: 1}}}
+	if !reflect.DeepEqual(calls[1].Pipeline, want) {
+		t.Errorf("pipeline %v", calls[1].Pipeline)
+	}
+}
+
+func TestViews(t *testing.T) {
+	store := &mock.Store{
+		ListViewsFunc: func(mock.Call) ([]db.View, error) {
+			return []db.View{{Name: "openOrders", ViewOn: "orders", Pipeline: bson.A{bson.D{{Key: "$match", Value: bson.D{{Key: "status", Value: "open"}}}}}}}, nil
+		},
+		CreateViewFunc: func(call mock.Call) error {
+			if call.Collection == "orders" {
+				return db.ErrNamespaceExists
+			}
+			return nil
+		},
+		DropViewFunc: func(call mock.Call) error {
+			if call.Collection != "openOrders" {
+				return db.ErrNamespaceNotFound
+			}
+			return nil
+		},
+	}
+	app := newTestApp(t, store, nil)
+
+	status, body := call(t, app, "GET", "/api/admin/databases/shop/views", "")
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	views := body["views"].([]interface{})
+	if len(views) != 1 || views[0].(map[string]interface{})["viewOn"] != "orders" {
+		t.Errorf("views %v", views)
+	}
+
+	status, body = call(t, app, "POST", "/api/admin/databases/shop/views", `{"name":"recent","viewOn":"orders","pipeline":[{"$match":{"createdAt":{"$gte":{"$date":"2024-01-01T00:00:00Z"}}}}]}`)
+	if status != fiber.StatusCreated || body["name"] != "recent" {
+		t.Errorf("create: status %d: %v", status, body)
+	}
+	view := lastCall(t, store, "CreateView").View
+	date := view.Pipeline[0].(bson.D)[0].Value.(bson.D)[0].Value.(bson.D)[0].Value
+	if _, ok := date.(primitive.DateTime); !ok || view.ViewOn != "orders" {
+		t.Errorf("view %+v", view)
+	}
+	for body, want := range map[string]int{
+		`{"name":"orders","viewOn":"orders"}`: fiber.StatusConflict,
+		`{"name":"copy"}`:                     fiber.StatusBadRequest,
+		`{"name":"copy","viewOn":"orders","pipeline":[{"$out":"backup"}]}`: fiber.StatusBadRequest,
+	} {
+		if status, res := call(t, app, "POST", "/api/admin/databases/shop/views", body); status != want {
+			t.Errorf("%s: status %d, want %d (%v)", body, status, want, res)
+		}
+	}
+
+	for name, want := range map[string]int{"openOrders": fiber.StatusNoContent, "orders": fiber.StatusNotFound} {
+		req := httptest.NewRequest("DELETE", "/api/admin/databases/shop/views/"+name, nil)
+		res, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != want {
+			t.Errorf("drop %s: status %d, want %d", name, res.StatusCode, want)
+		}
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"0001_users_email.json": `{
+			"up": [{"op": "createIndex", "database": "app", "collection": "users", "index": {"keys": {"email": 1}, "unique": true}}],
+			"down": [{"op": "dropIndex", "database": "app", "collection": "users", "name": "email_1"}]}`,
+		"0002_backfill_status.json": `{
+			"up": [{"op": "updateMany", "database": "app", "collection": "users", "filter": {"status": {"$exists": false}}, "update": {"$set": {"status": "active"}}}]}`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The ledger is kept in the mock's recorded inserts and deletes
+	ledger := map[int64]bson.M{}
+	store := &mock.Store{
+		FindFunc: func(c mock.Call) ([]bson.M, error) {
+			docs := []bson.M{}
+			for _, e := range ledger {
+				docs = append(docs, e)
+			}
+			return docs, nil
+		},
+		InsertOneFunc: func(c mock.Call) (*mongo.InsertOneResult, error) {
+			raw, _ := bson.Marshal(c.Documents[0])
+			var doc bson.M
+			bson.Unmarshal(raw, &doc)
+			ledger[doc["_id"].(int64)] = doc
+			return &mongo.InsertOneResult{InsertedID: doc["_id"]}, nil
+		},
+		DeleteOneFunc: func(c mock.Call) (*mongo.DeleteResult, error) {
+			delete(ledger, c.Filter.(bson.D)[0].Value.(int64))
+			return &mongo.DeleteResult{DeletedCount: 1}, nil
+		},
+	}
+	app := newTestApp(t, store, &config.Config{MigrationsDir: dir})
+
+	_, body := call(t, app, "POST", "/api/admin/migrations/up", `{"dryRun":true}`)
+	assertJSON(t, body, `{"results":[
+		{"version":1,"name":"users_email","direction":"up","steps":["createIndex app.users {\"email\":1} unique"],"dryRun":true},
+		{"version":2,"name":"backfill_status","direction":"up","steps":["updateMany app.users {\"filter\":{\"status\":{\"$exists\":false}},\"update\":{\"$set\":{\"status\":\"active\"}}}"],"dryRun":true}]}`)
+	if len(ledger) != 0 {
+		t.Fatal("dry run recorded migrations")
+	}
+
+	status, body := call(t, app, "POST", "/api/admin/migrations/up", `{"target":1}`)
+	if status != fiber.StatusOK || len(body["results"].([]interface{})) != 1 {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	c := lastCall(t, store, "CreateIndex")
+	if !c.Index.Unique || !reflect.DeepEqual(c.Index.Keys, bson.D{{Key: "email", Value: int32(1)}}) {
+		t.Errorf("index %+v", c.Index)
+	}
+
+	call(t, app, "POST", "/api/admin/migrations/up", "")
+	if c := lastCall(t, store, "UpdateMany"); c.Collection != "users" {
+		t.Errorf("update ran on %s", c.Collection)
+	}
+	_, body = call(t, app, "GET", "/api/admin/migrations", "")
+	for _, m := range body["migrations"].([]interface{}) {
+		if !m.(map[string]interface{})["applied"].(bool) {
+			t.Errorf("migration %v not applied", m)
+		}
+	}
+
+	// The latest migration has no down steps
+	status, body = call(t, app, "POST", "/api/admin/migrations/down", "")
+	if status != fiber.StatusInternalServerError {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	delete(ledger, 2)
+	status, body = call(t, app, "POST", "/api/admin/migrations/down", "")
+	if status != fiber.StatusOK || len(ledger) != 0 {
+		t.Fatalf("status %d: %v, ledger %v", status, body, ledger)
+	}
+	if c := lastCall(t, store, "DeleteOne"); c.Database != "dataapi_system" {
+		t.Errorf("ledger in %s", c.Database)
+	}
+	var dropped bool
+	for _, c := range store.Calls() {
+		dropped = dropped || c.Method == "DropIndex" && c.Index.Name == "email_1"
+	}
+	if !dropped {
+		t.Error("index was not dropped")
+	}
+}
+
+func TestAdminReplication(t *testing.T) {
+	ctx := context.Background()
+	primary, target := memstore.New(), memstore.New()
+	mirrored := mirror.New(primary, target, config.DualWriteConfig{Cluster: "next"})
+	traffic := trafficmirror.New(config.TrafficMirrorConfig{URL: "http://staging", Percent: 10})
+	admin := &Admin{Mirror: mirrored, Shadow: shadow.New(primary, target, config.ShadowReadConfig{Cluster: "next", Percent: 5}, "dataapi_system"), Traffic: traffic}
+	app, disabled := fiber.New(), fiber.New()
+	for a, h := range map[*fiber.App]*Admin{app: admin, disabled: {}} {
+		a.Get("/api/admin/dualwrite", h.GetDualWrite)
+		a.Post("/api/admin/dualwrite/retry", h.RetryDualWrite)
+		a.Post("/api/admin/dualwrite/reconcile", h.ReconcileDualWrite)
+		a.Get("/api/admin/shadowreads", h.GetShadowReads)
+		a.Get("/api/admin/trafficmirror", h.GetTrafficMirror)
+	}
+	if _, err := primary.InsertOne(ctx, "app", "users", bson.D{{Key: "_id", Value: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		method, path, body string
+		want               string
+	}{
+		{"GET", "/api/admin/dualwrite", "", `{"dualWrite":{"cluster":"next","queued":0,"lagSeconds":0,"mirrored":0,"failed":0,"failures":[],"reconciliations":[]}}`},
+		{"POST", "/api/admin/dualwrite/retry", "", `{"queued":0}`},
+		{"GET", "/api/admin/shadowreads", "", `{"shadowReads":{"cluster":"next","percent":5,"compared":0,"matched":0,"mismatched":0,"skipped":0,"errors":0,"mismatches":[]}}`},
+		{"GET", "/api/admin/trafficmirror", "", `{"trafficMirror":{"url":"http://staging","percent":10,"writes":false,"sent":0,"failed":0,"skipped":0,"statuses":{}}}`},
+	} {
+		status, res := call(t, app, tc.method, tc.path, tc.body)
+		if status != fiber.StatusOK {
+			t.Fatalf("%s: status %d: %v", tc.path, status, res)
+		}
+		assertJSON(t, res, tc.want)
+		if status, _ := call(t, disabled, tc.method, tc.path, tc.body); status != fiber.StatusBadRequest {
+			t.Errorf("%s disabled: status %d, want 400", tc.path, status)
+		}
+	}
+
+	if status, res := call(t, app, "POST", "/api/admin/dualwrite/reconcile", `{"database":"app"}`); status != fiber.StatusBadRequest {
+		t.Errorf("without collection: status %d: %v", status, res)
+	}
+	status, res := call(t, app, "POST", "/api/admin/dualwrite/reconcile", `{"database":"app","collection":"users"}`)
+	if r, _ := res["reconciliation"].(map[string]interface{}); status != fiber.StatusAccepted || r["state"] != "running" {
+		t.Fatalf("status %d: %v", status, res)
+	}
+}
+
+func TestInsertNaturalKey(t *testing.T) {
+	existing := bson.M{"_id": int32(7), "email": "ann@example.com", "name": "Ann", "plan": "free"}
+	store := &mock.Store{
+		UpdateOneFunc: func(c mock.Call) (*mongo.UpdateResult, error) {
+			opts := c.Options.(*options.UpdateOptions)
+			if opts != nil && opts.Upsert != nil && *opts.Upsert && c.Filter.(bson.D)[0].Value == "bob@example.com" {
+				return &mongo.UpdateResult{UpsertedCount: 1, UpsertedID: int32(8)}, nil
+			}
+			return &mongo.UpdateResult{MatchedCount: 1}, nil
+		},
+		FindOneFunc: func(mock.Call) (bson.M, error) { return existing, nil },
+	}
+	app := newTestApp(t, store, &config.Config{NaturalKeys: map[string][]string{"app.users": {"email"}}})
+	insert := func(email, onConflict string) string {
+		return `{"database":"app","collection":"users","document":{"email":"` + email + `","name":"Ann B"},"onConflict":"` + onConflict + `"}`
+	}
+
+	status, res := call(t, app, "POST", "/api/insertOne", insert("bob@example.com", ""))
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, res)
+	}
+	assertJSON(t, res, `{"insertedId":8}`)
+	fields := bson.D{{Key: "email", Value: "bob@example.com"}, {Key: "name", Value: "Ann B"}}
+	if c := lastCall(t, store, "UpdateOne"); !reflect.DeepEqual(c.Update, bson.D{{Key: "$setOnInsert", Value: fields}}) {
+		t.Errorf("update %v", c.Update)
+	}
+
+	status, res = call(t, app, "POST", "/api/insertOne", insert("ann@example.com", "error"))
+	if status != fiber.StatusConflict || res["existingId"] != float64(7) {
+		t.Errorf("error: status %d: %v", status, res)
+	}
+	status, res = call(t, app, "POST", "/api/insertOne", insert("ann@example.com", "ignore"))
+	if status != fiber.StatusOK {
+		t.Fatalf("ignore: status %d: %v", status, res)
+	}
+	assertJSON(t, res, `{"existingId":7,"document":{"_id":7,"email":"ann@example.com","name":"Ann","plan":"free"}}`)
+
+	// The existing document is updated by _id
+	for _, onConflict := range []string{"replace", "merge"} {
+		if status, res := call(t, app, "POST", "/api/insertOne", insert("ann@example.com", onConflict)); status != fiber.StatusOK {
+			t.Fatalf("%s: status %d: %v", onConflict, status, res)
+		}
+	}
+	var updates []interface{}
+	for _, c := range store.Calls() {
+		if c.Method == "UpdateOne" && reflect.DeepEqual(c.Filter, bson.D{{Key: "_id", Value: int32(7)}}) {
+			updates = append(updates, c.Update)
+		}
+	}
+	fields[0].Value = "ann@example.com"
+	want := []interface{}{
+		bson.D{{Key: "$set", Value: fields}, {Key: "$unset", Value: bson.D{{Key: "plan", Value: ""}}}},
+		bson.D{{Key: "$set", Value: fields}},
+	}
+	if !reflect.DeepEqual(updates, want) {
+		t.Errorf("updates %v, want %v", updates, want)
+	}
+
+	for _, body := range []string{
+		insert("ann@example.com", "overwrite"),
+		`{"database":"app","collection":"users","document":{"name":"Ann"},"onConflict":"ignore"}`,
+		`{"database":"app","collection":"orders","document":{"a":1},"onConflict":"ignore"}`,
+	} {
+		if status, res := call(t, app, "POST", "/api/insertOne", body); status != fiber.StatusBadRequest {
+			t.Errorf("%s: status %d: %v", body, status, res)
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	ctx := context.Background()
+	mem := memstore.New()
+	if _, err := mem.InsertOne(ctx, "app", "users", bson.D{{Key: "_id", Value: int32(1)}, {Key: "name", Value: "ann"}, {Key: "age", Value: int32(30)}}); err != nil {
+		t.Fatal(err)
+	}
+	store := &mock.Store{
+		FindOneFunc: func(c mock.Call) (bson.M, error) {
+			opts, _ := c.Options.(*options.FindOneOptions)
+			return mem.FindOne(ctx, c.Database, c.Collection, c.Filter, opts)
+		},
+		FindFunc: func(c mock.Call) ([]bson.M, error) {
+			opts, _ := c.Options.(*options.FindOptions)
+			return mem.Find(ctx, c.Database, c.Collection, c.Filter, opts)
+		},
+		InsertManyFunc: func(c mock.Call) (*mongo.InsertManyResult, error) {
+			return mem.InsertMany(ctx, c.Database, c.Collection, c.Documents)
+		},
+		UpdateOneFunc: func(c mock.Call) (*mongo.UpdateResult, error) {
+			opts, _ := c.Options.(*options.UpdateOptions)
+			return mem.UpdateOne(ctx, c.Database, c.Collection, c.Filter, c.Update, opts)
+		},
+		UpdateManyFunc: func(c mock.Call) (*mongo.UpdateResult, error) {
+			opts, _ := c.Options.(*options.UpdateOptions)
+			return mem.UpdateMany(ctx, c.Database, c.Collection, c.Filter, c.Update, opts)
+		},
+	}
+	app := newTestApp(t, store, &config.Config{VersionedCollections: []string{"app.users"}})
+
+	req := httptest.NewRequest("POST", "/api/updateOne", strings.NewReader(`{"database":"app","collection":"users","filter":{"name":"ann"},"update":{"$set":{"age":31}}}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("apiKey", testKey)
+	req.Header.Set("X-Request-ID", "req-1")
+	if res, err := app.Test(req, -1); err != nil || res.StatusCode != fiber.StatusOK {
+		t.Fatalf("updateOne: %v %v", res, err)
+	}
+	if status, body := call(t, app, "POST", "/api/updateMany", `{"database":"app","collection":"users","filter":{},"update":{"$set":{"active":true}}}`); status != fiber.StatusOK {
+		t.Fatalf("updateMany: status %d: %v", status, body)
+	}
+	// Updates that change nothing keep no version
+	if status, body := call(t, app, "POST", "/api/updateOne", `{"database":"app","collection":"users","filter":{},"update":{"$set":{"active":true}}}`); status != fiber.StatusOK {
+		t.Fatalf("updateOne: status %d: %v", status, body)
+	}
+
+	status, body := call(t, app, "POST", "/api/history", `{"database":"app","collection":"users","documentId":1}`)
+	if status != fiber.StatusOK {
+		t.Fatalf("history: status %d: %v", status, body)
+	}
+	versions := body["versions"].([]interface{})
+	if len(versions) != 2 {
+		t.Fatalf("versions %v", versions)
+	}
+	latest, first := versions[0].(map[string]interface{}), versions[1].(map[string]interface{})
+	if latest["operation"] != "updateMany" || latest["document"].(map[string]interface{})["age"] != float64(31) {
+		t.Errorf("latest version %v", latest)
+	}
+	if first["operation"] != "updateOne" || first["client"] != "test" || first["requestId"] != "req-1" || first["document"].(map[string]interface{})["age"] != float64(30) {
+		t.Errorf("first version %v", first)
+	}
+
+	versionID := first["_id"]
+	if oid, ok := versionID.(map[string]interface{}); ok {
+		versionID = oid["$oid"]
+	}
+	status, body = call(t, app, "POST", "/api/revert", fmt.Sprintf(`{"database":"app","collection":"users","versionId":%q}`, versionID))
+	if status != fiber.StatusOK || body["modifiedCount"] != float64(1) {
+		t.Fatalf("revert: status %d: %v", status, body)
+	}
+	doc, err := mem.FindOne(ctx, "app", "users", bson.D{{Key: "_id", Value: int32(1)}}, nil)
+	if err != nil || !reflect.DeepEqual(doc, bson.M{"_id": int32(1), "name": "ann", "age": int32(30)}) {
+		t.Errorf("reverted document %v: %v", doc, err)
+	}
+	// The reverted version is kept too
+	if _, body := call(t, app, "POST", "/api/history", `{"database":"app","collection":"users","documentId":1,"limit":1}`); len(body["versions"].([]interface{})) != 1 {
+		t.Errorf("limited history %v", body)
+	} else if v := body["versions"].([]interface{})[0].(map[string]interface{}); v["document"].(map[string]interface{})["active"] != true {
+		t.Errorf("version before the revert %v", v)
+	}
+
+	if status, body := call(t, app, "POST", "/api/revert", `{"database":"app","collection":"users","versionId":"65a1b2c3d4e5f60718293a4b"}`); status != fiber.StatusNotFound {
+		t.Errorf("missing version: status %d: %v", status, body)
+	}
+	if status, body := call(t, app, "POST", "/api/history", `{"database":"app","collection":"orders","documentId":1}`); status != fiber.StatusBadRequest {
+		t.Errorf("unversioned collection: status %d: %v", status, body)
+	}
+	if status, body := call(t, app, "POST", "/api/history", `{"database":"app","collection":"users"}`); status != fiber.StatusBadRequest {
+		t.Errorf("without documentId: status %d: %v", status, body)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	ctx := context.Background()
+	mem := memstore.New()
+	for i, name := range []string{"ann", "bob", "cid"} {
+		if _, err := mem.InsertOne(ctx, "app", "users", bson.D{{Key: "_id", Value: int32(i + 1)}, {Key: "name", Value: name}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store := &mock.Store{
+		FindOneFunc: func(c mock.Call) (bson.M, error) {
+			opts, _ := c.Options.(*options.FindOneOptions)
+			return mem.FindOne(ctx, c.Database, c.Collection, c.Filter, opts)
+		},
+		FindFunc: func(c mock.Call) ([]bson.M, error) {
+			opts, _ := c.Options.(*options.FindOptions)
+			return mem.Find(ctx, c.Database, c.Collection, c.Filter, opts)
+		},
+		InsertOneFunc: func(c mock.Call) (*mongo.InsertOneResult, error) {
+			return mem.InsertOne(ctx, c.Database, c.Collection, c.Documents[0])
+		},
+		InsertManyFunc: func(c mock.Call) (*mongo.InsertManyResult, error) {
+			return mem.InsertMany(ctx, c.Database, c.Collection, c.Documents)
+		},
+		DeleteOneFunc: func(c mock.Call) (*mongo.DeleteResult, error) {
+			return mem.DeleteOne(ctx, c.Database, c.Collection, c.Filter)
+		},
+		DeleteManyFunc: func(c mock.Call) (*mongo.DeleteResult, error) {
+			return mem.DeleteMany(ctx, c.Database, c.Collection, c.Filter)
+		},
+	}
+	app := newTestApp(t, store, &config.Config{Trash: config.TrashConfig{Collections: []string{"app.*"}, RetentionDays: 7}})
+
+	if status, body := call(t, app, "POST", "/api/deleteOne", `{"database":"app","collection":"users","filter":{"name":"ann"}}`); status != fiber.StatusOK || body["deletedCount"] != float64(1) {
+		t.Fatalf("deleteOne: status %d: %v", status, body)
+	}
+	if status, body := call(t, app, "POST", "/api/deleteMany", `{"database":"app","collection":"users","filter":{}}`); status != fiber.StatusOK || body["deletedCount"] != float64(2) {
+		t.Fatalf("deleteMany: status %d: %v", status, body)
+	}
+	entries, err := mem.Find(ctx, "app", "_trash", bson.D{}, nil)
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("trash entries %v: %v", entries, err)
+	}
+	for _, e := range entries {
+		if e["database"] != "app" || e["collection"] != "users" || e["client"] != "test" || e["deletedAt"] == nil {
+			t.Errorf("trash entry %v", e)
+		}
+	}
+	var indexes []*db.Index
+	for _, c := range store.Calls() {
+		if c.Method == "CreateIndex" {
+			indexes = append(indexes, c.Index)
+		}
+	}
+	if len(indexes) != 1 || !reflect.DeepEqual(indexes[0].Keys, bson.D{{Key: "deletedAt", Value: 1}}) || *indexes[0].ExpireAfterSeconds != 7*24*3600 {
+		t.Errorf("TTL indexes %+v", indexes)
+	}
+
+	status, body := call(t, app, "POST", "/api/restore", `{"database":"app","collection":"users","documentId":1}`)
+	if status != fiber.StatusOK || body["insertedId"] != float64(1) {
+		t.Fatalf("restore: status %d: %v", status, body)
+	}
+	doc, err := mem.FindOne(ctx, "app", "users", bson.D{{Key: "_id", Value: int32(1)}}, nil)
+	if err != nil || doc["name"] != "ann" {
+		t.Errorf("restored document %v: %v", doc, err)
+	}
+	if entries, _ := mem.Find(ctx, "app", "_trash", bson.D{}, nil); len(entries) != 2 {
+		t.Errorf("trash entries after restore %v", entries)
+	}
+	if status, body := call(t, app, "POST", "/api/restore", `{"database":"app","collection":"users","documentId":1}`); status != fiber.StatusNotFound {
+		t.Errorf("restored twice: status %d: %v", status, body)
+	}
+	if status, body := call(t, app, "POST", "/api/restore", `{"database":"other","collection":"users","documentId":2}`); status != fiber.StatusBadRequest {
+		t.Errorf("collection without trash: status %d: %v", status, body)
+	}
+	if status, body := call(t, app, "POST", "/api/restore", `{"database":"app","collection":"users"}`); status != fiber.StatusBadRequest {
+		t.Errorf("without documentId: status %d: %v", status, body)
+	}
+}
+
+func TestComputedFields(t *testing.T) {
+	store := &mock.Store{
+		AggregateFunc: func(c mock.Call) ([]bson.M, error) {
+			return []bson.M{{"_id": int32(1), "price": 2.5, "qty": int32(4), "total": 10.0}}, nil
+		},
+	}
+	app := newTestApp(t, store, &config.Config{ComputedFields: map[string]map[string]interface{}{
+		"shop.orders": {
+			"total":  map[string]interface{}{"$multiply": []interface{}{"$price", "$qty"}},
+			"cutoff": map[string]interface{}{"$date": "2024-01-01T00:00:00Z"},
+		},
+	}})
+	addFields := bson.D{{Key: "$addFields", Value: bson.D{
+		{Key: "cutoff", Value: primitive.NewDateTimeFromTime(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))},
+		{Key: "total", Value: bson.D{{Key: "$multiply", Value: bson.A{"$price", "$qty"}}}},
+	}}}
+
+	status, body := call(t, app, "POST", "/api/find", `{"database":"shop","collection":"orders","filter":{"qty":{"$gt":1}},"sort":{"qty":-1},"limit":5,"projection":{"qty":0}}`)
+	if status != fiber.StatusOK || body["documents"].([]interface{})[0].(map[string]interface{})["total"] != float64(10) {
+		t.Fatalf("find: status %d: %v", status, body)
+	}
+	want := bson.A{
+		bson.D{{Key: "$match", Value: bson.D{{Key: "qty", Value: bson.D{{Key: "$gt", Value: int32(1)}}}}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "qty", Value: int32(-1)}}}},
+		bson.D{{Key: "$limit", Value: int64(5)}},
+		addFields,
+		bson.D{{Key: "$project", Value: bson.D{{Key: "qty", Value: int32(0)}}}},
+	}
+	if c := lastCall(t, store, "Aggregate"); !reflect.DeepEqual(c.Pipeline, want) {
+		t.Errorf("find pipeline %v, want %v", c.Pipeline, want)
+	}
+
+	if status, body := call(t, app, "POST", "/api/findOne", `{"database":"shop","collection":"orders","filter":{"_id":1}}`); status != fiber.StatusOK || body["document"].(map[string]interface{})["total"] != float64(10) {
+		t.Fatalf("findOne: status %d: %v", status, body)
+	}
+	if p := lastCall(t, store, "Aggregate").Pipeline.(bson.A); len(p) != 3 || !reflect.DeepEqual(p[1], bson.D{{Key: "$limit", Value: int64(1)}}) {
+		t.Errorf("findOne pipeline %v", p)
+	}
+
+	if status, body := call(t, app, "POST", "/api/aggregate", `{"database":"shop","collection":"orders","pipeline":[{"$match":{"total":{"$gt":5}}}]}`); status != fiber.StatusOK {
+		t.Fatalf("aggregate: status %d: %v", status, body)
+	}
+	if p := lastCall(t, store, "Aggregate").Pipeline.(bson.A); len(p) != 2 || !reflect.DeepEqual(p[0], addFields) {
+		t.Errorf("aggregate pipeline %v", p)
+	}
+
+	// Other collections are read as stored
+	if status, body := call(t, app, "POST", "/api/find", `{"database":"shop","collection":"users"}`); status != fiber.StatusOK {
+		t.Fatalf("find: status %d: %v", status, body)
+	}
+	lastCall(t, store, "Find")
+}
+
+func TestReadDefaults(t *testing.T) {
+	store := &mock.Store{}
+	app := newTestApp(t, store, &config.Config{ReadDefaults: map[string]config.ReadDefaults{
+		"app.events": {DefaultLimit: 50, MaxLimit: 500, Projection: map[string]interface{}{"payload": 0}},
+		"app.logs":   {MaxLimit: 1000},
+	}})
+
+	for _, tc := range []struct {
+		body  string
+		limit int64
+	}{
+		{`{"database":"app","collection":"events"}`, 50},
+		{`{"database":"app","collection":"events","limit":200}`, 200},
+		{`{"database":"app","collection":"events","limit":100000}`, 500},
+		{`{"database":"app","collection":"logs"}`, 1000},
+	} {
+		if status, body := call(t, app, "POST", "/api/find", tc.body); status != fiber.StatusOK {
+			t.Fatalf("%s: status %d: %v", tc.body, status, body)
+		}
+		opts := lastCall(t, store, "Find").Options.(*options.FindOptions)
+		if opts.Limit == nil || *opts.Limit != tc.limit {
+			t.Errorf("%s: limit %v, want %d", tc.body, opts.Limit, tc.limit)
+		}
+	}
+
+	// The default projection applies to reads without their own
+	call(t, app, "POST", "/api/find", `{"database":"app","collection":"events"}`)
+	if p := lastCall(t, store, "Find").Options.(*options.FindOptions).Projection; !reflect.DeepEqual(p, bson.D{{Key: "payload", Value: int32(0)}}) {
+		t.Errorf("default projection %v", p)
+	}
+	call(t, app, "POST", "/api/findOne", `{"database":"app","collection":"events","projection":{"type":1}}`)
+	if p := lastCall(t, store, "FindOne").Options.(*options.FindOneOptions).Projection; !reflect.DeepEqual(p, bson.D{{Key: "type", Value: int32(1)}}) {
+		t.Errorf("request projection %v", p)
+	}
+
+	// Other collections are unbounded
+	call(t, app, "POST", "/api/find", `{"database":"app","collection":"users"}`)
+	if opts := lastCall(t, store, "Find").Options.(*options.FindOptions); opts.Limit != nil || opts.Projection != nil {
+		t.Errorf("users options %+v", opts)
+	}
+}
+
+func TestAggregateLimits(t *testing.T) {
+	docs := []bson.M{{"_id": 1, "pad": strings.Repeat("x", 600<<10)}, {"_id": 2, "pad": strings.Repeat("x", 600<<10)}, {"_id": 3}}
+	store := &mock.Store{AggregateFunc: func(mock.Call) ([]bson.M, error) { return docs, nil }}
+	app := newTestApp(t, store, &config.Config{AggregateLimits: config.AggregateLimits{MaxDocuments: 2}})
+	pipeline := `{"database":"app","collection":"events","pipeline":[{"$match":{"type":"click"}}]}`
+
+	status, body := call(t, app, "POST", "/api/aggregate", pipeline)
+	if status != fiber.StatusOK || body["truncated"] != true || len(body["documents"].([]interface{})) != 2 {
+		t.Fatalf("status %d: truncated %v, warning %v", status, body["truncated"], body["warning"])
+	}
+	stages := lastCall(t, store, "Aggregate").Pipeline.(bson.A)
+	if last := stages[len(stages)-1]; !reflect.DeepEqual(last, bson.D{{Key: "$limit", Value: int64(3)}}) {
+		t.Errorf("last stage %v", last)
+	}
+
+	// The size cap keeps the documents within it
+	app = newTestApp(t, store, &config.Config{AggregateLimits: config.AggregateLimits{MaxResponseMB: 1}})
+	_, body = call(t, app, "POST", "/api/aggregate", pipeline)
+	if body["truncated"] != true || len(body["documents"].([]interface{})) != 1 {
+		t.Errorf("size cap: truncated %v, %d documents", body["truncated"], len(body["documents"].([]interface{})))
+	}
+	if stages := lastCall(t, store, "Aggregate").Pipeline.(bson.A); len(stages) != 1 {
+		t.Errorf("stages without a document cap %v", stages)
+	}
+
+	// Results within the caps carry no warning, and writes are not capped
+	app = newTestApp(t, store, &config.Config{AggregateLimits: config.AggregateLimits{MaxDocuments: 5}})
+	if _, body = call(t, app, "POST", "/api/aggregate", pipeline); body["truncated"] != nil || body["warning"] != nil {
+		t.Errorf("untruncated response %v", body["warning"])
+	}
+	call(t, app, "POST", "/api/aggregate", `{"database":"app","collection":"events","pipeline":[{"$out":"copy"}]}`)
+	written := false
+	for _, c := range store.Calls() {
+		if c.Method == "AggregateWrite" {
+			written = true
+			if stages := c.Pipeline.(bson.A); len(stages) != 1 {
+				t.Errorf("write stages %v", stages)
+			}
+		}
+	}
+	if !written {
+		t.Error("no AggregateWrite call")
+	}
+}
+
+func TestCrossDatabaseJoins(t *testing.T) {
+	store := &mock.Store{}
+	app := newTestApp(t, store, &config.Config{
+		APIKeys:            []config.APIKey{{Name: "reader", Key: testKey, Roles: []string{"read"}, Namespaces: []string{"shop.*", "catalog.*"}}},
+		CrossDatabaseJoins: []config.JoinRule{{Source: "shop.orders", Target: "catalog.*"}, {Source: "shop.orders", Target: "billing.*"}},
+	})
+
+	lookup := `{"$lookup":{"from":{"db":"catalog","coll":"products"},"localField":"sku","foreignField":"sku","as":"product"}}`
+	for _, tc := range []struct {
+		coll, pipeline string
+		want           int
+	}{
+		{"orders", `[` + lookup + `]`, fiber.StatusOK},
+		{"orders", `[{"$lookup":{"from":"customers","localField":"customerId","foreignField":"_id","as":"customer"}}]`, fiber.StatusOK},
+		{"orders", `[{"$unionWith":{"db":"catalog","coll":"archived"}}]`, fiber.StatusOK},
+		// No rule for the source collection
+		{"carts", `[` + lookup + `]`, fiber.StatusForbidden},
+		// A rule, but the key may not read the joined collection
+		{"orders", `[{"$unionWith":{"db":"billing","coll":"invoices"}}]`, fiber.StatusForbidden},
+		// Joins nested in $facet and in the pipeline of a $lookup
+		{"carts", `[{"$facet":{"products":[` + lookup + `]}}]`, fiber.StatusForbidden},
+		{"orders", `[{"$lookup":{"from":"customers","as":"c","pipeline":[{"$unionWith":{"db":"other","coll":"x"}}]}}]`, fiber.StatusForbidden},
+	} {
+		body := `{"database":"shop","collection":"` + tc.coll + `","pipeline":` + tc.pipeline + `}`
+		if status, res := call(t, app, "POST", "/api/aggregate", body); status != tc.want {
+			t.Errorf("%s %s: status %d, want %d (%v)", tc.coll, tc.pipeline, status, tc.want, res)
+		}
+	}
+	var aggregated int
+	for _, c := range store.Calls() {
+		if c.Method == "Aggregate" {
+			aggregated++
+		}
+	}
+	if aggregated != 3 {
+		t.Errorf("%d aggregations ran, want 3", aggregated)
+	}
+}
+
+func TestSameDatabaseJoins(t *testing.T) {
+	store := &mock.Store{}
+	app := newTestApp(t, store, &config.Config{
+		APIKeys: []config.APIKey{{Name: "reader", Key: testKey, Roles: []string{"read"}, Namespaces: []string{"app.public"}}},
+	})
+
+	if status, _ := call(t, app, "POST", "/api/find", `{"database":"app","collection":"secrets"}`); status != fiber.StatusForbidden {
+		t.Fatalf("find: status %d, want 403", status)
+	}
+	// Joins within the database need no rule, but the key must be allowed
+	// to read the joined collection
+	for pipeline, want := range map[string]int{
+		`[{"$lookup":{"from":"public","localField":"a","foreignField":"a","as":"same"}}]`:    fiber.StatusOK,
+		`[{"$lookup":{"from":"secrets","localField":"a","foreignField":"a","as":"leaked"}}]`: fiber.StatusForbidden,
+		`[{"$unionWith":"secrets"}]`: fiber.StatusForbidden,
+		`[{"$graphLookup":{"from":"secrets","startWith":"$a","connectFromField":"a","connectToField":"b","as":"g"}}]`: fiber.StatusForbidden,
+		`[{"$facet":{"all":[{"$unionWith":{"coll":"secrets"}}]}}]`:                                                    fiber.StatusForbidden,
+	} {
+		status, res := call(t, app, "POST", "/api/aggregate", `{"database":"app","collection":"public","pipeline":`+pipeline+`}`)
+		if status != want {
+			t.Errorf("%s: status %d, want %d (%v)", pipeline, status, want, res)
+		}
+		if want == fiber.StatusForbidden && !strings.Contains(fmt.Sprint(res["error"]), "namespace app.secrets is not permitted") {
+			t.Errorf("%s: %v", pipeline, res)
+		}
+	}
+	for _, c := range store.Calls() {
+		if c.Method == "Aggregate" && c.Pipeline != nil && strings.Contains(fmt.Sprint(c.Pipeline), "secrets") {
+			t.Errorf("aggregation joining secrets ran: %v", c.Pipeline)
+		}
+	}
+}
+
+func TestSlowOps(t *testing.T) {
+	store := &mock.Store{
+		FindFunc: func(c mock.Call) ([]bson.M, error) {
+			return []bson.M{
+				{"op": "query", "ns": "app.users", "millis": int32(250), "planSummary": "COLLSCAN", "command": bson.M{"find": "users", "comment": "client=reports requestId=req-2"}},
+				{"op": "getmore", "ns": "app.users", "millis": int32(120), "command": bson.M{"getMore": int64(1)}, "originatingCommand": bson.M{"comment": "nightly client=reports requestId=req-1"}},
+				{"op": "update", "ns": "app.orders", "millis": int32(300), "command": bson.M{"q": bson.M{}, "comment": "client=web requestId=req-3"}},
+			}, nil
+		},
+	}
+	app := newTestApp(t, store, nil)
+
+	status, body := call(t, app, "GET", "/api/admin/slowOps?database=app&client=reports&minMs=50", "")
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	c := lastCall(t, store, "Find")
+	if c.Database != "app" || c.Collection != "system.profile" {
+		t.Errorf("read %s.%s", c.Database, c.Collection)
+	}
+	filter := c.Filter.(bson.D)
+	if !reflect.DeepEqual(filter[0], bson.E{Key: "millis", Value: bson.D{{Key: "$gte", Value: int64(50)}}}) || len(filter[1].Value.(bson.A)) != 2 {
+		t.Errorf("filter %v", filter)
+	}
+	ops := body["operations"].([]interface{})
+	if op := ops[1].(map[string]interface{}); op["client"] != "reports" || op["requestId"] != "req-1" || op["millis"] != float64(120) {
+		t.Errorf("getMore %v", op)
+	}
+	assertJSON(t, body["clients"], `{"reports":{"count":2,"totalMillis":370,"maxMillis":250},"web":{"count":1,"totalMillis":300,"maxMillis":300}}`)
+
+	if status, _ := call(t, app, "GET", "/api/admin/slowOps", ""); status != fiber.StatusBadRequest {
+		t.Errorf("without database: status %d, want 400", status)
+	}
+}
+
+func TestCurrentOps(t *testing.T) {
+	store := &mock.Store{
+		CurrentOpsFunc: func(c mock.Call) ([]bson.M, error) {
+			if reflect.DeepEqual(c.Filter.(bson.D)[0], bson.E{Key: "opid", Value: int64(404)}) {
+				return []bson.M{}, nil
+			}
+			return []bson.M{
+				{"opid": int32(7), "op": "getmore", "ns": "app.users", "secs_running": int64(3), "cursor": bson.M{"originatingCommand": bson.M{"comment": "client=reports requestId=req-1"}}},
+				{"opid": int32(9), "op": "command", "ns": "app.orders", "secs_running": int64(42), "command": bson.M{"aggregate": "orders", "comment": "client=web requestId=req-2"}},
+			}, nil
+		},
+	}
+	app := newTestApp(t, store, nil)
+
+	status, body := call(t, app, "GET", "/api/admin/currentOps?client=web", "")
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	if and := lastCall(t, store, "CurrentOps").Filter.(bson.D)[0].Value.(bson.A); len(and) != 2 {
+		t.Errorf("filter %v", and)
+	}
+	assertJSON(t, body["operations"], `[
+		{"opid":9,"op":"command","ns":"app.orders","secsRunning":42,"client":"web","requestId":"req-2"},
+		{"opid":7,"op":"getmore","ns":"app.users","secsRunning":3,"client":"reports","requestId":"req-1"}
+	]`)
+
+	if status, body := call(t, app, "POST", "/api/admin/killOp", `{"opid":9}`); status != fiber.StatusOK || body["killed"] != float64(9) {
+		t.Fatalf("killOp: status %d: %v", status, body)
+	}
+	if c := lastCall(t, store, "KillOp"); !reflect.DeepEqual(c.Filter, bson.D{{Key: "op", Value: int64(9)}}) {
+		t.Errorf("killed %v", c.Filter)
+	}
+	// Operations that did not come through the proxy are not killed
+	if status, _ := call(t, app, "POST", "/api/admin/killOp", `{"opid":404}`); status != fiber.StatusNotFound {
+		t.Errorf("unknown operation: status %d, want 404", status)
+	}
+	lastCall(t, store, "CurrentOps")
+	if status, _ := call(t, app, "POST", "/api/admin/killOp", `{"opid":1.5}`); status != fiber.StatusBadRequest {
+		t.Errorf("fractional opid: status %d, want 400", status)
+	}
+}
+
+func TestCursors(t *testing.T) {
+	cursors := db.NewCursorRegistry()
+	app := fiber.New()
+	admin := &Admin{Cursors: cursors}
+	app.Get("/api/admin/cursors", admin.ListCursors)
+	app.Delete("/api/admin/cursors/:id", admin.CloseCursor)
+
+	ctx := db.WithRequestID(db.WithClient(context.Background(), "reports"), "req-1")
+	first, doneFirst := cursors.Track(ctx, "find", "app", "users")
+	second, doneSecond := cursors.Track(context.Background(), "aggregate", "app", "orders")
+	defer doneSecond()
+
+	status, body := call(t, app, "GET", "/api/admin/cursors", "")
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	list := body["cursors"].([]interface{})
+	if len(list) != 2 {
+		t.Fatalf("cursors %v", list)
+	}
+	if c := list[0].(map[string]interface{}); c["client"] != "reports" || c["requestId"] != "req-1" || c["operation"] != "find" || c["ns"] != "app.users" {
+		t.Errorf("first cursor %v", c)
+	}
+
+	if status, body := call(t, app, "DELETE", "/api/admin/cursors/1", ""); status != fiber.StatusOK {
+		t.Fatalf("close: status %d: %v", status, body)
+	}
+	if first.Err() == nil || second.Err() != nil {
+		t.Errorf("contexts after closing the first cursor: %v, %v", first.Err(), second.Err())
+	}
+	doneFirst()
+	if cursors.Open() != 1 || cursors.Closed() != 1 {
+		t.Errorf("%d open and %d closed cursors", cursors.Open(), cursors.Closed())
+	}
+	if status, _ := call(t, app, "DELETE", "/api/admin/cursors/1", ""); status != fiber.StatusNotFound {
+		t.Errorf("closed twice: status %d, want 404", status)
+	}
+
+	// Cursors open for too long are closed
+	if n := cursors.CloseExpired(time.Hour); n != 0 {
+		t.Errorf("closed %d cursors younger than an hour", n)
+	}
+	if n := cursors.CloseExpired(0); n != 1 || second.Err() == nil {
+		t.Errorf("closed %d expired cursors", n)
+	}
+}
+
+// serverInfoFunc adapts a function to db.ServerInspector
+type serverInfoFunc func(context.Context) (*db.ServerInfo, error)
+
+func (f serverInfoFunc) ServerInfo(ctx context.Context) (*db.ServerInfo, error) { return f(ctx) }
+
+func TestHealthDetails(t *testing.T) {
+	var infoErr error
+	app := fiber.New()
+	health := &Health{
+		Server: serverInfoFunc(func(context.Context) (*db.ServerInfo, error) {
+			return &db.ServerInfo{Version: "7.0.12", Topology: "replicaSet", SetName: "rs0", PingMS: 1.5}, infoErr
+		}),
+		Started: time.Now().Add(-time.Minute),
+	}
+	app.Get("/api/health/details", health.Details)
+
+	status, body := call(t, app, "GET", "/api/health/details", "")
+	if status != fiber.StatusOK || body["status"] != "ok" {
+		t.Fatalf("status %d: %v", status, body)
+	}
+	if m := body["mongodb"].(map[string]interface{}); m["version"] != "7.0.12" || m["topology"] != "replicaSet" || m["setName"] != "rs0" || m["pingMs"] != 1.5 {
+		t.Errorf("mongodb %v", m)
+	}
+	if p := body["proxy"].(map[string]interface{}); p["uptimeSeconds"].(float64) < 60 || p["goVersion"] == "" {
+		t.Errorf("proxy %v", p)
+	}
+
+	infoErr = errors.New("server selection timeout")
+	status, body = call(t, app, "GET", "/api/health/details", "")
+	if status != fiber.StatusServiceUnavailable || body["status"] != "unavailable" {
+		t.Errorf("unreachable: status %d: %v", status, body)
+	}
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"context"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"mongo-data-api-go-alternative/db"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Health serves /api/health/details, which describes the proxy and the
+// deployment it is connected to for operators triaging an incident
+type Health struct {
+	// Server is nil when the store is not MongoDB, as in mock mode
+	Server db.ServerInspector
+	// Started is when the proxy started
+	Started time.Time
+}
+
+// Details reports the build and uptime of the proxy and the version,
+// topology and ping round trip of MongoDB. It answers 503 when MongoDB
+// cannot be reached.
+func (h *Health) Details(c *fiber.Ctx) error {
+	resp := fiber.Map{"status": "ok", "proxy": proxyInfo(h.Started)}
+	if h.Server == nil {
+		return c.JSON(resp)
+	}
+	ctx, cancel := context.WithTimeout(c.Context(), 5*time.Second)
+	defer cancel()
+	info, err := h.Server.ServerInfo(ctx)
+	if err != nil {
+		resp["status"], resp["mongodb"] = "unavailable", fiber.Map{"error": err.Error()}
+		return c.Status(fiber.StatusServiceUnavailable).JSON(resp)
+	}
+	resp["mongodb"] = info
+	return c.JSON(resp)
+}
+
+// proxyInfo describes the running binary from its embedded build
+// information: the module version, or the commit it was built from
+func proxyInfo(started time.Time) fiber.Map {
+	info := fiber.Map{
+		"goVersion":     runtime.Version(),
+		"startedAt":     started,
+		"uptimeSeconds": int64(time.Since(started).Seconds()),
+	}
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	info["version"] = build.Main.Version
+	for _, s := range build.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			info["revision"] = s.Value
+		case "vcs.time":
+			info["revisionTime"] = s.Value
+		case "vcs.modified":
+			info["modified"] = s.Value == "true"
+		}
+	}
+	return info
+}
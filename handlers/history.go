@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"mongo-data-api-go-alternative/auth"
+	"mongo-data-api-go-alternative/config"
+	"mongo-data-api-go-alternative/history"
+	"mongo-data-api-go-alternative/hooks"
+	"mongo-data-api-go-alternative/tenant"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultHistoryLimit = 20
+	maxHistoryLimit     = 1000
+)
+
+// requestID returns the X-Request-ID of a request: the one it is answered
+// with, or else the one the client sent
+func requestID(c *fiber.Ctx) string {
+	if id := c.GetRespHeader(fiber.HeaderXRequestID); id != "" {
+		return id
+	}
+	return c.Get(fiber.HeaderXRequestID)
+}
+
+// versioned checks that the collection of a request keeps its history
+func (h *Data) versioned(database string, doc *Document) error {
+	if h.History == nil || !h.History.Versioned(database, doc.Collection) {
+		return fmt.Errorf("%s.%s is not versioned", doc.Database, doc.Collection)
+	}
+	return nil
+}
+
+// savedDocumentFilter restricts a filter of a history or trash collection,
+// whose entries hold a document, to the entries of the tenant's documents
+func savedDocumentFilter(c *fiber.Ctx, filter bson.D) bson.D {
+	if scope := tenant.FromCtx(c); scope != nil && scope.Mode == config.TenancyField {
+		filter = append(filter, bson.E{Key: "document." + scope.Field, Value: scope.ID})
+	}
+	return filter
+}
+
+// Versions lists the prior versions of a document, newest first
+func (h *Data) Versions(c *fiber.Ctx) error {
+	var doc Document
+	if err := parseBody(c, &doc, h.StrictBodies); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if _, err := responseFormat(c, &doc); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if doc.DocumentID == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "documentId is required"})
+	}
+	if doc.Limit < 0 || doc.Skip < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "limit and skip cannot be negative"})
+	}
+	limit := doc.Limit
+	if limit == 0 {
+		limit = defaultHistoryLimit
+	}
+	limit = min(limit, maxHistoryLimit)
+
+	database, err := h.database(c, "find", &doc)
+	if err != nil {
+		return denied(c, err)
+	}
+	if err := h.versioned(database, &doc); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	plain := h.plainObjectIDs(&doc)
+	id := doc.DocumentID
+	if plain {
+		id = objectIDValue(id)
+	}
+	defer observe(c, "history", doc.Database, doc.Collection)()
+
+	opts := options.Find().SetSort(bson.D{{Key: "at", Value: -1}, {Key: "_id", Value: -1}}).SetSkip(doc.Skip).SetLimit(limit)
+	versions, err := h.Store.Find(limitedContext(c, &doc, h.MaxTime.Read), database, history.Collection(doc.Collection), savedDocumentFilter(c, bson.D{{Key: "documentId", Value: id}}), opts)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	if plain {
+		for _, v := range versions {
+			plainDocumentID(v)
+			v["documentId"] = plainID(v["documentId"])
+			plainDocumentID(v["document"])
+		}
+	}
+	return respond(c, &doc, map[string]interface{}{"versions": versions})
+}
+
+// Revert restores a document to one of its prior versions, recreating it
+// if it was deleted since. The version it replaces is saved in turn, so a
+// revert can itself be reverted. Hooks see the write as an updateOne.
+func (h *Data) Revert(c *fiber.Ctx) error {
+	var doc Document
+	if err := parseBody(c, &doc, h.StrictBodies); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if _, err := responseFormat(c, &doc); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if doc.VersionID == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "versionId is required"})
+	}
+
+	if err := auth.Authorize(c, "find", doc.Database, doc.Collection); err != nil {
+		return denied(c, err)
+	}
+	database, err := h.database(c, "updateOne", &doc)
+	if err != nil {
+		return denied(c, err)
+	}
+	if err := h.versioned(database, &doc); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer observe(c, "revert", doc.Database, doc.Collection)()
+
+	// The version is read raw to restore its fields in their order
+	ctx := limitedContext(c, &doc, h.MaxTime.Write)
+	var version struct {
+		DocumentID interface{} `bson:"documentId"`
+		Document   bson.D      `bson:"document"`
+	}
+	found := false
+	filter := savedDocumentFilter(c, bson.D{{Key: "_id", Value: objectIDValue(doc.VersionID)}})
+	err = h.Store.FindEach(ctx, database, history.Collection(doc.Collection), filter, options.Find().SetLimit(1), func(raw bson.Raw) error {
+		found = true
+		return bson.Unmarshal(raw, &version)
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !found {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Version not found"})
+	}
+
+	// The shard key of the version routes the write, which may recreate
+	// the document
+	byID := bson.D{{Key: "_id", Value: version.DocumentID}}
+	for _, field := range h.shardKey(&doc) {
+		if v, ok := lookupField(version.Document, strings.Split(field, ".")); ok && field != "_id" {
+			byID = append(byID, bson.E{Key: field, Value: v})
+		}
+	}
+	scope := tenant.FromCtx(c)
+	current, err := h.Store.FindOne(ctx, database, doc.Collection, scope.Filter(byID), nil)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		current = bson.M{}
+	} else if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	req := hookRequest("updateOne", &doc)
+	req.Filter, req.Update = byID, replacement(current, version.Document)
+	if err := hooks.BeforeRequest(c, req); err != nil {
+		return hookError(c, err)
+	}
+	wrappedResult := map[string]interface{}{"documentId": version.DocumentID, "upsertedId": nil, "upsertedCount": 0, "modifiedCount": 0, "matchedCount": 1}
+	if update, _ := req.Update.(bson.D); len(update) > 0 {
+		if err := scope.Update(update); err != nil {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+		}
+		filter := scope.Filter(req.Filter)
+		if err := checkShardKey("updateOne", h.shardKey(&doc), filter, update, true, true); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		result, err := h.Store.UpdateOne(ctx, database, doc.Collection, filter, update, options.Update().SetUpsert(true))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		wrappedResult["upsertedId"] = result.UpsertedID
+		wrappedResult["upsertedCount"] = result.UpsertedCount
+		wrappedResult["modifiedCount"] = result.ModifiedCount
+		wrappedResult["matchedCount"] = result.MatchedCount
+	}
+	if err := hooks.AfterResult(c, req, wrappedResult); err != nil {
+		return hookError(c, err)
+	}
+	if h.plainObjectIDs(&doc) {
+		plainResultIDs(wrappedResult)
+		wrappedResult["documentId"] = plainID(wrappedResult["documentId"])
+	}
+	return respond(c, &doc, wrappedResult)
+}
@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+
+	"mongo-data-api-go-alternative/hooks"
+	"mongo-data-api-go-alternative/importer"
+	"mongo-data-api-go-alternative/tenant"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// maxImportBatch bounds the batchSize parameter of /api/import
+const maxImportBatch = 10000
+
+// importParams are the query parameters of /api/import
+type importParams struct {
+	Database     string `query:"database"`
+	Collection   string `query:"collection"`
+	Format       string `query:"format"`
+	BatchSize    int    `query:"batchSize"`
+	UpsertKeys   string `query:"upsertKeys"`
+	IgnoreBlanks bool   `query:"ignoreBlanks"`
+	Progress     bool   `query:"progress"`
+	Async        bool   `query:"async"`
+	Stream       bool   `query:"stream"`
+}
+
+// importStatus is a progress line of a streamed import
+type importStatus struct {
+	importer.Progress
+	Done bool `json:"done"`
+}
+
+// Import bulk loads the NDJSON or CSV request body into a collection. With
+// progress=true the response is NDJSON with one line per written batch; with
+// async=true the batches are written by a job; with stream=true the batches
+// are written while the body is read.
+func (h *Data) Import(c *fiber.Ctx) error {
+	var params importParams
+	if err := c.QueryParser(&params); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	// Query values point into the request buffer, which is reused once the
+	// handler returns
+	params.Database = utils.CopyString(params.Database)
+	params.Collection = utils.CopyString(params.Collection)
+	params.UpsertKeys = utils.CopyString(params.UpsertKeys)
+	if params.Database == "" || params.Collection == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "database and collection are required"})
+	}
+	if params.Progress && params.Async {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "progress and async cannot be combined"})
+	}
+	if params.Stream && (params.Progress || params.Async) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "stream cannot be combined with progress or async"})
+	}
+	if params.BatchSize < 0 || params.BatchSize > maxImportBatch {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "batchSize must be between 1 and 10000"})
+	}
+	if params.Format == "" {
+		params.Format = importer.FormatNDJSON
+		if strings.HasPrefix(c.Get(fiber.HeaderContentType), "text/csv") {
+			params.Format = importer.FormatCSV
+		}
+	}
+
+	doc := &Document{Database: params.Database, Collection: params.Collection, Upsert: params.UpsertKeys != ""}
+	database, err := h.database(c, "import", doc)
+	if err != nil {
+		return denied(c, err)
+	}
+	if err := h.authorizeUpsert(c, doc); err != nil {
+		return denied(c, err)
+	}
+	defer observe(c, "import", doc.Database, doc.Collection)()
+
+	writer := &importer.Writer{
+		Store:      h.Store,
+		Database:   database,
+		Collection: params.Collection,
+		UpsertKeys: splitKeys(params.UpsertKeys),
+		Scope:      tenant.FromCtx(c),
+		Convert:    h.uuidConverter(doc),
+	}
+	options := importer.DecodeOptions{IgnoreBlanks: params.IgnoreBlanks}
+	if params.Stream {
+		dec, err := importer.NewDecoder(bodyReader(c), params.Format, options)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		return h.writeStream(c, "import", doc, dec, params.BatchSize, writer)
+	}
+
+	// The body is copied because the batches outlive the request handler
+	// when progress is streamed
+	body := append([]byte(nil), c.Body()...)
+	dec, err := importer.NewDecoder(bytes.NewReader(body), params.Format, options)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	batches, progress, err := importer.Read(dec, params.BatchSize)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	for i := range batches {
+		req := hookRequest("import", doc)
+		req.Documents = batches[i].Documents
+		if err := hooks.BeforeBatch(c, req); err != nil {
+			return hookError(c, err)
+		}
+		batches[i].Documents = req.Documents
+	}
+
+	if params.Async {
+		return startJob(c, h.Jobs, "import", func(ctx context.Context, _ string, report func(interface{})) (interface{}, error) {
+			for _, batch := range batches {
+				if err := writer.Write(ctx, batch, &progress); err != nil {
+					return nil, err
+				}
+				report(progress)
+			}
+			return progress, nil
+		})
+	}
+	ctx := limitedContext(c, doc, h.MaxTime.Write)
+	if !params.Progress {
+		for _, batch := range batches {
+			if err := writer.Write(ctx, batch, &progress); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+			}
+		}
+		return c.JSON(progress)
+	}
+
+	c.Set(fiber.HeaderContentType, "application/x-ndjson")
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		enc := json.NewEncoder(w)
+		for _, batch := range batches {
+			if err := writer.Write(ctx, batch, &progress); err != nil {
+				break
+			}
+			line := importStatus{Progress: progress}
+			line.Errors = nil
+			if enc.Encode(line) != nil || w.Flush() != nil {
+				// The client went away
+				return
+			}
+		}
+		enc.Encode(importStatus{Progress: progress, Done: true})
+		w.Flush()
+	})
+	return nil
+}
+
+// splitKeys splits a comma-separated list of field names
+func splitKeys(s string) []string {
+	var keys []string
+	for _, key := range strings.Split(s, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
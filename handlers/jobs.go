@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+
+	"mongo-data-api-go-alternative/auth"
+	"mongo-data-api-go-alternative/db"
+	"mongo-data-api-go-alternative/formats"
+	"mongo-data-api-go-alternative/jobs"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Jobs serves /api/jobs, which reports on background jobs. A job is only
+// visible to the API key that started it.
+type Jobs struct {
+	Manager *jobs.Manager
+}
+
+// job looks up the job named in the path and responds with an error if the
+// requesting key may not see it
+func (h *Jobs) job(c *fiber.Ctx) (jobs.Job, bool, error) {
+	job, err := h.Manager.Get(context.Background(), c.Params("id"))
+	if err != nil && !errors.Is(err, jobs.ErrNotFound) {
+		return job, false, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil || job.Owner != auth.PrincipalFromCtx(c).Key.Name {
+		return job, false, c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": jobs.ErrNotFound.Error()})
+	}
+	return job, true, nil
+}
+
+// Get reports the status, progress and result of a job
+func (h *Jobs) Get(c *fiber.Ctx) error {
+	job, ok, err := h.job(c)
+	if !ok {
+		return err
+	}
+	return c.JSON(job)
+}
+
+// Result downloads the file written by a finished export job
+func (h *Jobs) Result(c *fiber.Ctx) error {
+	job, ok, err := h.job(c)
+	if !ok {
+		return err
+	}
+	if job.Status != jobs.StatusSucceeded {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "job has not succeeded", "status": job.Status})
+	}
+	path, err := h.Manager.File(job.ID)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := c.Download(path, filepath.Base(path)); err != nil {
+		return err
+	}
+	if f, err := formats.Lookup(strings.TrimPrefix(filepath.Ext(path), ".")); err == nil {
+		c.Set(fiber.HeaderContentType, f.MediaType)
+	}
+	return nil
+}
+
+// apiLocal is the key of the path of the /api group in the fiber locals
+const apiLocal = "api"
+
+// apiPath records the path of the group it is used on, the /api group below
+// any prefix the app is mounted at
+func apiPath(c *fiber.Ctx) error {
+	c.Locals(apiLocal, c.Route().Path)
+	return c.Next()
+}
+
+// jobsPath returns the path of a job on the jobs endpoint of the /api group
+func jobsPath(c *fiber.Ctx, id string) string {
+	api, _ := c.Locals(apiLocal).(string)
+	return api + "/jobs/" + id
+}
+
+// startJob runs fn as a job owned by the requesting key and responds with
+// its id
+func startJob(c *fiber.Ctx, manager *jobs.Manager, kind string, fn jobs.Func) error {
+	if manager == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Background jobs are not enabled"})
+	}
+	owner := auth.PrincipalFromCtx(c).Key.Name
+	job := manager.Start(kind, owner, func(ctx context.Context, id string, report func(interface{})) (interface{}, error) {
+		return fn(db.WithClient(ctx, owner), id, report)
+	})
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"jobId": job.ID, "location": jobsPath(c, job.ID)})
+}
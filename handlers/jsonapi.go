@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MIMEJSONAPI is the media type of JSON:API documents. Clients asking for
+// it in Accept get the results of find and findOne as JSON:API documents.
+const MIMEJSONAPI = "application/vnd.api+json"
+
+// wantsJSONAPI reports whether the client accepts JSON:API documents
+func wantsJSONAPI(c *fiber.Ctx) bool {
+	return strings.Contains(c.Get(fiber.HeaderAccept), MIMEJSONAPI)
+}
+
+// respondJSONAPI writes the result of a find or findOne as a JSON:API
+// document. Documents become resources of the collection's type with their
+// _id as id and their other fields as attributes. totalCount and keyset
+// tokens go to meta; GET requests, such as those of the REST facade, also
+// get self and pagination links.
+func respondJSONAPI(c *fiber.Ctx, doc *Document, result map[string]interface{}) error {
+	body := map[string]interface{}{}
+	n := 0
+	if d, ok := result["document"]; ok {
+		body["data"] = resourceObject(doc.Collection, d)
+	} else {
+		var data []interface{}
+		switch docs := result["documents"].(type) {
+		case []bson.M:
+			for _, d := range docs {
+				data = append(data, resourceObject(doc.Collection, d))
+			}
+		case []interface{}:
+			for _, d := range docs {
+				data = append(data, resourceObject(doc.Collection, d))
+			}
+		}
+		if data == nil {
+			data = []interface{}{}
+		}
+		body["data"], n = data, len(data)
+	}
+
+	meta := map[string]interface{}{}
+	for _, key := range []string{"totalCount", "nextPage", "prevPage"} {
+		if v, ok := result[key]; ok {
+			meta[key] = v
+		}
+	}
+	if len(meta) > 0 {
+		body["meta"] = meta
+	}
+	if c.Method() == fiber.MethodGet {
+		body["links"] = pageLinks(c, doc, result, n)
+	}
+	return writeResponse(c, body, MIMEJSONAPI)
+}
+
+// resourceObject renders a document as a JSON:API resource object
+func resourceObject(typ string, d interface{}) interface{} {
+	var id, attributes interface{}
+	switch d := d.(type) {
+	case bson.M:
+		id, attributes = d["_id"], withoutID(d)
+	case map[string]interface{}:
+		id, attributes = d["_id"], withoutID(d)
+	case bson.D:
+		fields := make(bson.D, 0, len(d))
+		for _, e := range d {
+			if e.Key == "_id" {
+				id = e.Value
+				continue
+			}
+			fields = append(fields, e)
+		}
+		attributes = fields
+	default:
+		return nil
+	}
+	resource := bson.D{{Key: "type", Value: typ}}
+	if id != nil {
+		resource = append(resource, bson.E{Key: "id", Value: resourceID(id)})
+	}
+	return append(resource, bson.E{Key: "attributes", Value: attributes})
+}
+
+func withoutID(m map[string]interface{}) bson.M {
+	fields := make(bson.M, len(m))
+	for k, v := range m {
+		if k != "_id" {
+			fields[k] = v
+		}
+	}
+	return fields
+}
+
+// resourceID renders an _id as the string id JSON:API requires
+func resourceID(id interface{}) string {
+	switch id := id.(type) {
+	case primitive.ObjectID:
+		return id.Hex()
+	case string:
+		return id
+	}
+	return fmt.Sprint(id)
+}
+
+// pageLinks returns the self link of a GET request and, for finds, the
+// links to the next and previous pages by skip and limit or keyset tokens
+func pageLinks(c *fiber.Ctx, doc *Document, result map[string]interface{}, n int) map[string]interface{} {
+	links := map[string]interface{}{"self": c.BaseURL() + c.OriginalURL()}
+	if _, ok := result["documents"]; !ok {
+		return links
+	}
+	link := func(set map[string]string) string {
+		q, _ := url.ParseQuery(string(c.Request().URI().QueryString()))
+		for _, key := range []string{"pageAfter", "pageBefore"} {
+			q.Del(key)
+		}
+		for k, v := range set {
+			q.Set(k, v)
+		}
+		return c.BaseURL() + c.Path() + "?" + q.Encode()
+	}
+
+	next, hasNext := result["nextPage"].(string)
+	prev, hasPrev := result["prevPage"].(string)
+	switch {
+	case hasNext || hasPrev:
+		if hasNext {
+			links["next"] = link(map[string]string{"pageAfter": next})
+		}
+		if hasPrev {
+			links["prev"] = link(map[string]string{"pageBefore": prev})
+		}
+	case doc.Limit > 0:
+		if int64(n) == doc.Limit {
+			links["next"] = link(map[string]string{"skip": strconv.FormatInt(doc.Skip+doc.Limit, 10)})
+		}
+		if doc.Skip > 0 {
+			links["prev"] = link(map[string]string{"skip": strconv.FormatInt(max(doc.Skip-doc.Limit, 0), 10)})
+		}
+	}
+	return links
+}
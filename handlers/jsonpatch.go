@@ -0,0 +1,518 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"mongo-data-api-go-alternative/auth"
+	"mongo-data-api-go-alternative/hooks"
+	"mongo-data-api-go-alternative/tenant"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// jsonPatchType is the media type of RFC 6902 JSON Patch bodies
+const jsonPatchType = "application/json-patch+json"
+
+// PatchOperation is an operation of an RFC 6902 JSON Patch. Path and From
+// are JSON Pointers; Value is unset, as opposed to null, when it is absent.
+type PatchOperation struct {
+	Op    string        `bson:"op"`
+	Path  string        `bson:"path"`
+	From  string        `bson:"from"`
+	Value bson.RawValue `bson:"value"`
+}
+
+// errPatchTest is returned when a test operation fails
+var errPatchTest = errors.New("test failed")
+
+// jsonPatchOp is a validated PatchOperation with parsed pointers
+type jsonPatchOp struct {
+	op    string
+	path  []string
+	from  []string
+	value interface{}
+}
+
+// PatchOne handles applying a JSON Patch to a single document
+func (h *Data) PatchOne(c *fiber.Ctx) error {
+	var doc Document
+	if err := parseBody(c, &doc, h.StrictBodies); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return h.patchOne(c, &doc)
+}
+
+// patchOne reads the document matching the filter, applies the operations
+// to it and writes the top-level fields they changed. The write only
+// matches while the fields the operations read or changed still have the
+// values read, so a document changed meanwhile fails with 409 for the
+// client to retry. It is authorized as a findOne and an updateOne, and
+// hooks see the write as an updateOne.
+func (h *Data) patchOne(c *fiber.Ctx, doc *Document) error {
+	if _, err := responseFormat(c, doc); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if doc.Update != nil || doc.Upsert {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "patchOne takes operations, and cannot upsert"})
+	}
+	ops, err := parseJSONPatch(doc.Operations)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := h.convertFields(doc); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if err := auth.Authorize(c, "findOne", doc.Database, doc.Collection); err != nil {
+		return denied(c, err)
+	}
+	database, err := h.database(c, "updateOne", doc)
+	if err != nil {
+		return denied(c, err)
+	}
+	defer observe(c, "patchOne", doc.Database, doc.Collection)()
+
+	scope := tenant.FromCtx(c)
+	ctx := limitedContext(c, doc, h.MaxTime.Write)
+	var original, patched bson.D
+	found := false
+	err = h.Store.FindEach(ctx, database, doc.Collection, scope.Filter(h.filter(doc)), options.Find().SetLimit(1), func(raw bson.Raw) error {
+		found = true
+		if err := bson.Unmarshal(raw, &original); err != nil {
+			return err
+		}
+		return bson.Unmarshal(raw, &patched)
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !found {
+		if doc.FailOnNoMatch {
+			return noMatch(c)
+		}
+		return respond(c, doc, map[string]interface{}{"upsertedId": nil, "upsertedCount": 0, "modifiedCount": 0, "matchedCount": 0})
+	}
+
+	for _, op := range ops {
+		if patched, err = op.apply(patched); err != nil {
+			status := fiber.StatusUnprocessableEntity
+			if errors.Is(err, errPatchTest) {
+				status = fiber.StatusConflict
+			}
+			return c.Status(status).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+	update, err := patchUpdate(original, patched)
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	req := hookRequest("updateOne", doc)
+	req.Filter, req.Update = versionFilter(original, ops, h.shardKey(doc)), update
+	if len(update) > 0 {
+		if err := hooks.BeforeRequest(c, req); err != nil {
+			return hookError(c, err)
+		}
+	}
+	wrappedResult := map[string]interface{}{"upsertedId": nil, "upsertedCount": 0, "modifiedCount": 0, "matchedCount": 1}
+	if len(update) > 0 {
+		if err := scope.Update(req.Update); err != nil {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+		}
+		filter := scope.Filter(req.Filter)
+		if err := checkShardKey("updateOne", h.shardKey(doc), filter, req.Update, true, false); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		result, err := h.Store.UpdateOne(ctx, database, doc.Collection, filter, req.Update, nil)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		if result.MatchedCount == 0 {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "The document changed while the patch was applied; retry"})
+		}
+		wrappedResult["modifiedCount"] = result.ModifiedCount
+		if err := hooks.AfterResult(c, req, wrappedResult); err != nil {
+			return hookError(c, err)
+		}
+	}
+	return respond(c, doc, wrappedResult)
+}
+
+// parseJSONPatch validates the operations of a JSON Patch. Operations on
+// the whole document are not supported, nor are top-level members whose
+// names are not plain field names, as the update sets them by name.
+func parseJSONPatch(operations []PatchOperation) ([]jsonPatchOp, error) {
+	if len(operations) == 0 {
+		return nil, errors.New("operations must hold at least one operation")
+	}
+	ops := make([]jsonPatchOp, len(operations))
+	for i, o := range operations {
+		op := jsonPatchOp{op: o.Op}
+		var err error
+		if op.path, err = parseFieldPointer(o.Path); err != nil {
+			return nil, fmt.Errorf("operation %d: path %w", i, err)
+		}
+		switch o.Op {
+		case "add", "replace", "test":
+			if o.Value.Type == bsontype.Type(0) {
+				return nil, fmt.Errorf("operation %d: %s needs a value", i, o.Op)
+			}
+			if err := o.Value.Unmarshal(&op.value); err != nil {
+				return nil, fmt.Errorf("operation %d: %w", i, err)
+			}
+		case "move", "copy":
+			if op.from, err = parseFieldPointer(o.From); err != nil {
+				return nil, fmt.Errorf("operation %d: from %w", i, err)
+			}
+			if o.Op == "move" && len(op.path) > len(op.from) && isPrefix(op.from, op.path) {
+				return nil, fmt.Errorf("operation %d: cannot move %s into itself", i, o.From)
+			}
+		case "remove":
+		default:
+			return nil, fmt.Errorf("operation %d: op must be add, remove, replace, move, copy or test", i)
+		}
+		ops[i] = op
+	}
+	return ops, nil
+}
+
+// parsePointer splits a JSON Pointer into its unescaped reference tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, errors.New("must point into the document")
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("%q must start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// parseFieldPointer parses a JSON Pointer whose first token names a field
+// that can be set, unset and filtered on by name
+func parseFieldPointer(pointer string) ([]string, error) {
+	tokens, err := parsePointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	switch field := tokens[0]; {
+	case field == "":
+		return nil, fmt.Errorf("%q must name a field", pointer)
+	case strings.HasPrefix(field, "$"):
+		return nil, fmt.Errorf("%q cannot name a field starting with $", pointer)
+	case strings.Contains(field, "."):
+		return nil, fmt.Errorf("%q cannot name a field containing a dot", pointer)
+	}
+	return tokens, nil
+}
+
+func isPrefix(prefix, path []string) bool {
+	for i := range prefix {
+		if path[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// apply returns the document with the operation applied
+func (op jsonPatchOp) apply(d bson.D) (bson.D, error) {
+	var v interface{} = d
+	var err error
+	switch op.op {
+	case "add":
+		v, err = patchAt(v, op.path, func(parent interface{}, key string) (interface{}, error) {
+			return addMember(parent, key, op.value)
+		})
+	case "remove":
+		v, err = patchAt(v, op.path, removeMember)
+	case "replace":
+		v, err = patchAt(v, op.path, func(parent interface{}, key string) (interface{}, error) {
+			if _, err := member(parent, key); err != nil {
+				return nil, err
+			}
+			return setMember(parent, key, op.value)
+		})
+	case "move", "copy":
+		var value interface{}
+		if value, err = lookupPointer(v, op.from); err != nil {
+			return nil, fmt.Errorf("from %s", err)
+		}
+		if op.op == "move" {
+			if v, err = patchAt(v, op.from, removeMember); err != nil {
+				return nil, err
+			}
+		} else {
+			value = copyValue(value)
+		}
+		v, err = patchAt(v, op.path, func(parent interface{}, key string) (interface{}, error) {
+			return addMember(parent, key, value)
+		})
+	case "test":
+		var value interface{}
+		if value, err = lookupPointer(v, op.path); err == nil && !patchEqual(value, op.value) {
+			err = fmt.Errorf("%w: /%s does not hold the value", errPatchTest, strings.Join(op.path, "/"))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v.(bson.D), nil
+}
+
+// patchAt replaces the container holding the last token of path by what fn
+// returns for it
+func patchAt(v interface{}, path []string, fn func(parent interface{}, key string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return fn(v, path[0])
+	}
+	child, err := member(v, path[0])
+	if err != nil {
+		return nil, err
+	}
+	if child, err = patchAt(child, path[1:], fn); err != nil {
+		return nil, err
+	}
+	return setMember(v, path[0], child)
+}
+
+func lookupPointer(v interface{}, path []string) (interface{}, error) {
+	for _, key := range path {
+		var err error
+		if v, err = member(v, key); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// member returns the member key of a document or array
+func member(v interface{}, key string) (interface{}, error) {
+	switch v := v.(type) {
+	case bson.D:
+		for _, e := range v {
+			if e.Key == key {
+				return e.Value, nil
+			}
+		}
+		return nil, fmt.Errorf("%s does not exist", key)
+	case bson.A:
+		i, err := arrayIndex(key, len(v)-1)
+		if err != nil {
+			return nil, err
+		}
+		return v[i], nil
+	}
+	return nil, fmt.Errorf("%s is not in a document or an array", key)
+}
+
+// setMember sets an existing array element, or a document member
+func setMember(v interface{}, key string, value interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case bson.D:
+		for i, e := range v {
+			if e.Key == key {
+				v[i].Value = value
+				return v, nil
+			}
+		}
+		return append(v, bson.E{Key: key, Value: value}), nil
+	case bson.A:
+		i, err := arrayIndex(key, len(v)-1)
+		if err != nil {
+			return nil, err
+		}
+		v[i] = value
+		return v, nil
+	}
+	return nil, fmt.Errorf("%s is not in a document or an array", key)
+}
+
+// addMember sets a document member, or inserts an array element before
+// the index, with - appending it
+func addMember(v interface{}, key string, value interface{}) (interface{}, error) {
+	a, ok := v.(bson.A)
+	if !ok {
+		return setMember(v, key, value)
+	}
+	i := len(a)
+	if key != "-" {
+		var err error
+		if i, err = arrayIndex(key, len(a)); err != nil {
+			return nil, err
+		}
+	}
+	a = append(a, nil)
+	copy(a[i+1:], a[i:])
+	a[i] = value
+	return a, nil
+}
+
+func removeMember(v interface{}, key string) (interface{}, error) {
+	switch v := v.(type) {
+	case bson.D:
+		for i, e := range v {
+			if e.Key == key {
+				return append(v[:i:i], v[i+1:]...), nil
+			}
+		}
+		return nil, fmt.Errorf("%s does not exist", key)
+	case bson.A:
+		i, err := arrayIndex(key, len(v)-1)
+		if err != nil {
+			return nil, err
+		}
+		return append(v[:i:i], v[i+1:]...), nil
+	}
+	return nil, fmt.Errorf("%s is not in a document or an array", key)
+}
+
+// arrayIndex parses an array index of at most max
+func arrayIndex(key string, max int) (int, error) {
+	i, err := strconv.Atoi(key)
+	if err != nil || i < 0 || (len(key) > 1 && key[0] == '0') {
+		return 0, fmt.Errorf("%s is not an array index", key)
+	}
+	if i > max {
+		return 0, fmt.Errorf("index %d is out of bounds", i)
+	}
+	return i, nil
+}
+
+// copyValue copies the documents and arrays in v, so that a copied value
+// can be changed independently
+func copyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.D:
+		d := make(bson.D, len(v))
+		for i, e := range v {
+			d[i] = bson.E{Key: e.Key, Value: copyValue(e.Value)}
+		}
+		return d
+	case bson.A:
+		a := make(bson.A, len(v))
+		for i, e := range v {
+			a[i] = copyValue(e)
+		}
+		return a
+	}
+	return v
+}
+
+// patchEqual compares values as JSON does: numbers by value and documents
+// regardless of the order of their members
+func patchEqual(a, b interface{}) bool {
+	if x, ok := patchNumber(a); ok {
+		y, ok := patchNumber(b)
+		return ok && x == y
+	}
+	switch a := a.(type) {
+	case bson.D:
+		b, ok := b.(bson.D)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for _, e := range a {
+			v, err := member(b, e.Key)
+			if err != nil || !patchEqual(e.Value, v) {
+				return false
+			}
+		}
+		return true
+	case bson.A:
+		b, ok := b.(bson.A)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !patchEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func patchNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// patchUpdate is the update setting the top-level fields of patched that
+// differ from original and unsetting those it removed
+func patchUpdate(original, patched bson.D) (bson.D, error) {
+	set, unset := bson.D{}, bson.D{}
+	for _, e := range patched {
+		v, err := member(original, e.Key)
+		switch {
+		case err == nil && reflect.DeepEqual(v, e.Value):
+		case e.Key == "_id":
+			return nil, errors.New("patch cannot change _id")
+		default:
+			set = append(set, e)
+		}
+	}
+	for _, e := range original {
+		if _, err := member(patched, e.Key); err != nil {
+			if e.Key == "_id" {
+				return nil, errors.New("patch cannot change _id")
+			}
+			unset = append(unset, bson.E{Key: e.Key, Value: ""})
+		}
+	}
+	update := bson.D{}
+	if len(set) > 0 {
+		update = append(update, bson.E{Key: "$set", Value: set})
+	}
+	if len(unset) > 0 {
+		update = append(update, bson.E{Key: "$unset", Value: unset})
+	}
+	return update, nil
+}
+
+// versionFilter matches original by _id and shard key while the top-level
+// fields the operations read or change keep the values read
+func versionFilter(original bson.D, ops []jsonPatchOp, shardKey []string) bson.D {
+	id, _ := member(original, "_id")
+	filter := bson.D{{Key: "_id", Value: id}}
+	seen := map[string]bool{"_id": true}
+	for _, field := range shardKey {
+		if v, ok := lookupField(original, strings.Split(field, ".")); ok && !seen[field] {
+			seen[field] = true
+			filter = append(filter, bson.E{Key: field, Value: v})
+		}
+	}
+	for _, op := range ops {
+		for _, path := range [][]string{op.path, op.from} {
+			if len(path) == 0 || seen[path[0]] {
+				continue
+			}
+			seen[path[0]] = true
+			if v, err := member(original, path[0]); err == nil {
+				filter = append(filter, bson.E{Key: path[0], Value: v})
+			} else {
+				filter = append(filter, bson.E{Key: path[0], Value: bson.D{{Key: "$exists", Value: false}}})
+			}
+		}
+	}
+	return filter
+}
@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// keyset pages through a find by the sort key values of the last document
+// seen instead of skipping documents, so deep pages cost as much as the
+// first one
+type keyset struct {
+	// sort is the requested sort with _id appended as a tie breaker, so
+	// every document has a distinct position
+	sort  bson.D
+	limit int64
+	// before pages backwards from values; otherwise forwards
+	before bool
+	// values are the sort key values of the page boundary, nil on the first
+	// page
+	values bson.A
+}
+
+// pageToken is the content of the opaque nextPage and prevPage tokens
+type pageToken struct {
+	Sort   bson.D `bson:"s"`
+	Values bson.A `bson:"v"`
+}
+
+var errPageToken = errors.New("invalid page token")
+
+// newKeyset validates the pagination of a find with keyset, pageAfter or
+// pageBefore set
+func newKeyset(doc *Document) (*keyset, error) {
+	if doc.PageAfter != "" && doc.PageBefore != "" {
+		return nil, errors.New("pageAfter and pageBefore cannot be used together")
+	}
+	if doc.Skip > 0 {
+		return nil, errors.New("skip cannot be used with keyset pagination")
+	}
+	if doc.Limit <= 0 {
+		return nil, errors.New("keyset pagination needs a limit")
+	}
+
+	k := &keyset{limit: doc.Limit, before: doc.PageBefore != ""}
+	hasID := false
+	for _, e := range doc.Sort {
+		dir, ok := direction(e.Value)
+		if !ok {
+			return nil, errors.New("keyset pagination needs sort directions of 1 or -1")
+		}
+		if !projects(doc.Projection, e.Key) {
+			return nil, errors.New("projection must include the sort fields")
+		}
+		k.sort = append(k.sort, bson.E{Key: e.Key, Value: dir})
+		hasID = hasID || e.Key == "_id"
+	}
+	if !hasID {
+		if !projects(doc.Projection, "_id") {
+			return nil, errors.New("projection must include _id")
+		}
+		k.sort = append(k.sort, bson.E{Key: "_id", Value: int32(1)})
+	}
+
+	token := doc.PageAfter
+	if k.before {
+		token = doc.PageBefore
+	}
+	if token == "" {
+		return k, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errPageToken
+	}
+	var t pageToken
+	if err := bson.Unmarshal(raw, &t); err != nil || len(t.Values) != len(k.sort) {
+		return nil, errPageToken
+	}
+	if !reflect.DeepEqual(t.Sort, k.sort) {
+		return nil, errors.New("page token was issued for a different sort")
+	}
+	k.values = t.Values
+	return k, nil
+}
+
+// direction normalizes a sort direction to int32
+func direction(v interface{}) (int32, bool) {
+	var d float64
+	switch n := v.(type) {
+	case int32:
+		d = float64(n)
+	case int64:
+		d = float64(n)
+	case float64:
+		d = n
+	default:
+		return 0, false
+	}
+	if d != 1 && d != -1 {
+		return 0, false
+	}
+	return int32(d), true
+}
+
+// projects reports whether projection keeps field in the documents
+func projects(projection bson.D, field string) bool {
+	inclusion := false
+	for _, e := range projection {
+		if e.Key != "_id" && truthy(e.Value) {
+			inclusion = true
+		}
+	}
+	for _, e := range projection {
+		if e.Key == field || strings.HasPrefix(field, e.Key+".") {
+			return truthy(e.Value)
+		}
+	}
+	return field == "_id" || !inclusion
+}
+
+// querySort is the sort of the query; pages before the token are read in
+// reverse and put back in order by page
+func (k *keyset) querySort() bson.D {
+	if !k.before {
+		return k.sort
+	}
+	reversed := make(bson.D, len(k.sort))
+	for i, e := range k.sort {
+		reversed[i] = bson.E{Key: e.Key, Value: -e.Value.(int32)}
+	}
+	return reversed
+}
+
+// filter restricts filter to the documents after (or before) the token's
+// position in the sort order
+func (k *keyset) filter(filter interface{}) interface{} {
+	if k.values == nil {
+		return filter
+	}
+	clauses := make(bson.A, len(k.sort))
+	for i, e := range k.sort {
+		clause := make(bson.D, 0, i+1)
+		for j := 0; j < i; j++ {
+			clause = append(clause, bson.E{Key: k.sort[j].Key, Value: bson.D{{Key: "$eq", Value: k.values[j]}}})
+		}
+		op := "$gt"
+		if (e.Value.(int32) < 0) != k.before {
+			op = "$lt"
+		}
+		clauses[i] = append(clause, bson.E{Key: e.Key, Value: bson.D{{Key: op, Value: k.values[i]}}})
+	}
+	cond := bson.D{{Key: "$or", Value: clauses}}
+	if d, ok := filter.(bson.D); filter == nil || ok && len(d) == 0 {
+		return cond
+	}
+	return bson.D{{Key: "$and", Value: bson.A{filter, cond}}}
+}
+
+// page trims the limit+1 documents read to the page and returns the tokens
+// of the pages after and before it, which are empty when there is none
+func (k *keyset) page(docs []bson.M) (page []bson.M, next, prev string, err error) {
+	more := int64(len(docs)) > k.limit
+	if more {
+		docs = docs[:k.limit]
+	}
+	if len(docs) == 0 {
+		return docs, "", "", nil
+	}
+	if k.before {
+		for i, j := 0, len(docs)-1; i < j; i, j = i+1, j-1 {
+			docs[i], docs[j] = docs[j], docs[i]
+		}
+	}
+
+	hasNext := more || k.before
+	hasPrev := k.values != nil && !k.before || k.before && more
+	if hasNext {
+		if next, err = k.token(docs[len(docs)-1]); err != nil {
+			return nil, "", "", err
+		}
+	}
+	if hasPrev {
+		if prev, err = k.token(docs[0]); err != nil {
+			return nil, "", "", err
+		}
+	}
+	return docs, next, prev, nil
+}
+
+// token encodes the position of doc in the sort order
+func (k *keyset) token(doc bson.M) (string, error) {
+	values := make(bson.A, len(k.sort))
+	for i, e := range k.sort {
+		values[i] = lookup(doc, e.Key)
+	}
+	raw, err := bson.Marshal(pageToken{Sort: k.sort, Values: values})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// lookup returns the value of a dotted path in doc, or nil when it is
+// missing
+func lookup(doc interface{}, path string) interface{} {
+	for _, key := range strings.Split(path, ".") {
+		switch d := doc.(type) {
+		case bson.M:
+			doc = d[key]
+		case map[string]interface{}:
+			doc = d[key]
+		case bson.D:
+			doc = nil
+			for _, e := range d {
+				if e.Key == key {
+					doc = e.Value
+					break
+				}
+			}
+		default:
+			return nil
+		}
+	}
+	return doc
+}
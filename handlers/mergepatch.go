@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"mongo-data-api-go-alternative/tenant"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// mergePatchType is the media type of RFC 7386 JSON Merge Patch bodies
+const mergePatchType = "application/merge-patch+json"
+
+// MergeOne handles applying a JSON Merge Patch to a single document. It is
+// an updateOne whose update is translated from the patch, so it is
+// authorized and hooked as one.
+func (h *Data) MergeOne(c *fiber.Ctx) error {
+	var doc Document
+	if err := parseBody(c, &doc, h.StrictBodies); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if doc.Update != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "mergeOne takes a patch, not an update"})
+	}
+	return h.mergeOne(c, &doc)
+}
+
+// mergeOne translates the patch of doc into an update and runs it as an
+// updateOne. Objects in the patch are merged into the fields holding
+// objects and replace any other value, so a patch holding objects reads the
+// document first; the update is then pinned to its _id and the types of
+// those fields, and fails with 409 if they changed meanwhile. A patch that
+// changes nothing, such as {}, is not written.
+func (h *Data) mergeOne(c *fiber.Ctx, doc *Document) error {
+	if _, err := responseFormat(c, doc); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	update, types, err := mergePatchUpdate(doc.Patch, nil)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if len(types) == 0 && len(update) > 0 {
+		doc.Update = update
+		return h.updateOne(c, doc)
+	}
+
+	if err := h.convertFields(doc); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	database, err := h.database(c, "updateOne", doc)
+	if err != nil {
+		return denied(c, err)
+	}
+	ctx := limitedContext(c, doc, h.MaxTime.Write)
+	current, err := h.Store.FindOne(ctx, database, doc.Collection, tenant.FromCtx(c).Filter(h.filter(doc)), nil)
+	found := err == nil
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	if found {
+		if update, types, err = mergePatchUpdate(doc.Patch, current); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		filter := doc.Filter
+		if filter == nil {
+			filter = bson.D{}
+		}
+		doc.Filter = bson.D{{Key: "$and", Value: bson.A{filter, append(bson.D{{Key: "_id", Value: current["_id"]}}, types...)}}}
+		doc.Upsert, doc.pinned = false, true
+	}
+	if len(update) == 0 {
+		if !found && doc.FailOnNoMatch {
+			return noMatch(c)
+		}
+		matched := 0
+		if found {
+			matched = 1
+		}
+		return respond(c, doc, map[string]interface{}{"upsertedId": nil, "upsertedCount": 0, "modifiedCount": 0, "matchedCount": matched})
+	}
+	doc.Update = update
+	return h.updateOne(c, doc)
+}
+
+// mergePatchUpdate translates a merge patch into update operators for the
+// target document, or for none when target is nil: null members are
+// $unset, objects are merged member by member into fields holding objects
+// and any other value is $set, replacing arrays, scalars and missing fields
+// as a whole without the null members of objects. types holds the filter
+// conditions on the types of the fields objects were merged into or
+// replaced, so that the update only applies while they keep them.
+func mergePatchUpdate(patch bson.D, target map[string]interface{}) (update, types bson.D, err error) {
+	if patch == nil {
+		return nil, nil, errors.New("patch must be an object")
+	}
+	set, unset := bson.D{}, bson.D{}
+	if err := mergePatch("", patch, target, &set, &unset, &types); err != nil {
+		return nil, nil, err
+	}
+	update = bson.D{}
+	if len(set) > 0 {
+		update = append(update, bson.E{Key: "$set", Value: set})
+	}
+	if len(unset) > 0 {
+		update = append(update, bson.E{Key: "$unset", Value: unset})
+	}
+	return update, types, nil
+}
+
+func mergePatch(prefix string, patch bson.D, target map[string]interface{}, set, unset, types *bson.D) error {
+	for _, e := range patch {
+		if err := checkPatchMember(prefix, e.Key); err != nil {
+			return err
+		}
+		path := prefix + e.Key
+		switch v := e.Value.(type) {
+		case nil:
+			*unset = append(*unset, bson.E{Key: path, Value: ""})
+		case bson.D:
+			isObject := bson.D{{Key: "$type", Value: "object"}}
+			if object, ok := mergeTarget(target[e.Key]); ok {
+				*types = append(*types, bson.E{Key: path, Value: isObject})
+				if err := mergePatch(path+".", v, object, set, unset, types); err != nil {
+					return err
+				}
+				continue
+			}
+			*types = append(*types, bson.E{Key: path, Value: bson.D{{Key: "$not", Value: isObject}}})
+			value, err := withoutNulls(path+".", v)
+			if err != nil {
+				return err
+			}
+			*set = append(*set, bson.E{Key: path, Value: value})
+		default:
+			*set = append(*set, bson.E{Key: path, Value: v})
+		}
+	}
+	return nil
+}
+
+// checkPatchMember rejects member names that would not be set as a field
+// of their own
+func checkPatchMember(prefix, key string) error {
+	switch {
+	case key == "":
+		return errors.New("patch members must have a name")
+	case strings.HasPrefix(key, "$"):
+		return fmt.Errorf("patch member %s%s cannot be an update operator", prefix, key)
+	case strings.Contains(key, "."):
+		return fmt.Errorf("patch member %s%s cannot contain a dot", prefix, key)
+	case prefix == "" && key == "_id":
+		return errors.New("patch cannot change _id")
+	}
+	return nil
+}
+
+// mergeTarget returns the members of v if it is an object
+func mergeTarget(v interface{}) (map[string]interface{}, bool) {
+	switch v := v.(type) {
+	case bson.M:
+		return v, true
+	case map[string]interface{}:
+		return v, true
+	case bson.D:
+		m := make(map[string]interface{}, len(v))
+		for _, e := range v {
+			m[e.Key] = e.Value
+		}
+		return m, true
+	}
+	return nil, false
+}
+
+// withoutNulls returns the object patch replacing a field, without its null
+// members, as merging it into an empty object would
+func withoutNulls(prefix string, patch bson.D) (bson.D, error) {
+	value := bson.D{}
+	for _, e := range patch {
+		if err := checkPatchMember(prefix, e.Key); err != nil {
+			return nil, err
+		}
+		switch v := e.Value.(type) {
+		case nil:
+		case bson.D:
+			nested, err := withoutNulls(prefix+e.Key+".", v)
+			if err != nil {
+				return nil, err
+			}
+			value = append(value, bson.E{Key: e.Key, Value: nested})
+		default:
+			value = append(value, e)
+		}
+	}
+	return value, nil
+}
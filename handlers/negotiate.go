@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"mongo-data-api-go-alternative/formats"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// responseFormat returns the format of a response: the one named by the
+// request's format field or query parameter, else the registered format
+// best matching Accept, else relaxed EJSON
+func responseFormat(c *fiber.Ctx, doc *Document) (formats.Format, error) {
+	name := c.Query("format")
+	if doc != nil && doc.Format != "" {
+		name = doc.Format
+	}
+	if name != "" {
+		return formats.Lookup(name)
+	}
+	return formats.ByMediaType(c.Accepts(formats.MediaTypes()...)), nil
+}
+
+// plainJSON reports whether the request gets the default JSON responses,
+// which finds can stream
+func plainJSON(c *fiber.Ctx, doc *Document) bool {
+	if envelope(c) != nil || wantsJSONAPI(c) || wantsProtobuf(c) || pretty(c, doc) {
+		return false
+	}
+	format, err := responseFormat(c, doc)
+	return err == nil && format.Name == formats.JSON
+}
+
+// pretty reports whether the request asks for indented JSON with sorted
+// keys
+func pretty(c *fiber.Ctx, doc *Document) bool {
+	return (doc != nil && doc.Pretty) || c.QueryBool("pretty")
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// plainObjectIDs reports whether the request converts _id strings to
+// ObjectIds and back: as it asks, or else as configured
+func (h *Data) plainObjectIDs(doc *Document) bool {
+	if doc.PlainObjectIDs != nil {
+		return *doc.PlainObjectIDs
+	}
+	return h.PlainObjectIDs
+}
+
+// filter returns the request's filter, with the _id strings that are valid
+// ObjectIds converted when the request asks for plain ObjectIds
+func (h *Data) filter(doc *Document) bson.D {
+	if !h.plainObjectIDs(doc) {
+		return doc.Filter
+	}
+	return objectIDFilter(doc.Filter)
+}
+
+// idOperators are the query operators whose operand is an _id, or an array
+// of them
+var idOperators = map[string]bool{
+	"$eq": true, "$ne": true, "$gt": true, "$gte": true, "$lt": true, "$lte": true,
+	"$in": true, "$nin": true,
+}
+
+// objectIDFilter returns a copy of filter in which the 24-hex-character
+// strings compared with _id, at the top level or in $and, $or and $nor
+// clauses, are ObjectIds
+func objectIDFilter(filter bson.D) bson.D {
+	if filter == nil {
+		return nil
+	}
+	converted := make(bson.D, len(filter))
+	for i, e := range filter {
+		switch e.Key {
+		case "_id":
+			e.Value = objectIDValue(e.Value)
+		case "$and", "$or", "$nor":
+			if clauses, ok := e.Value.(bson.A); ok {
+				convertedClauses := make(bson.A, len(clauses))
+				for j, clause := range clauses {
+					if d, ok := clause.(bson.D); ok {
+						clause = objectIDFilter(d)
+					}
+					convertedClauses[j] = clause
+				}
+				e.Value = convertedClauses
+			}
+		}
+		converted[i] = e
+	}
+	return converted
+}
+
+// objectIDValue converts the _id condition v: a string, an array of them
+// or a document of comparison operators
+func objectIDValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		if oid, err := primitive.ObjectIDFromHex(v); err == nil {
+			return oid
+		}
+	case bson.A:
+		converted := make(bson.A, len(v))
+		for i, item := range v {
+			converted[i] = objectIDValue(item)
+		}
+		return converted
+	case bson.D:
+		if len(v) == 0 || !idOperators[v[0].Key] {
+			// An embedded document _id
+			return v
+		}
+		converted := make(bson.D, len(v))
+		for i, e := range v {
+			if idOperators[e.Key] {
+				e.Value = objectIDValue(e.Value)
+			}
+			converted[i] = e
+		}
+		return converted
+	}
+	return v
+}
+
+// plainResultIDs replaces the ObjectIds of a write result's inserted and
+// upserted ids with their hex strings
+func plainResultIDs(result map[string]interface{}) {
+	for key, v := range result {
+		switch key {
+		case "insertedId", "upsertedId", "existingId":
+			result[key] = plainID(v)
+		case "insertedIds":
+			if ids, ok := v.([]interface{}); ok {
+				for i := range ids {
+					ids[i] = plainID(ids[i])
+				}
+			}
+		}
+	}
+}
+
+// plainDocumentID replaces an ObjectId _id of doc with its hex string
+func plainDocumentID(doc interface{}) {
+	switch d := doc.(type) {
+	case bson.M:
+		if id, ok := d["_id"]; ok {
+			d["_id"] = plainID(id)
+		}
+	case map[string]interface{}:
+		if id, ok := d["_id"]; ok {
+			d["_id"] = plainID(id)
+		}
+	case bson.D:
+		for i := range d {
+			if d[i].Key == "_id" {
+				d[i].Value = plainID(d[i].Value)
+			}
+		}
+	}
+}
+
+func plainID(id interface{}) interface{} {
+	if oid, ok := id.(primitive.ObjectID); ok {
+		return oid.Hex()
+	}
+	return id
+}
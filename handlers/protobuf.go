@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"log"
+	"strings"
+
+	"mongo-data-api-go-alternative/protoschema"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// MIMEProtobuf is the media type of protobuf responses. Clients asking for
+// it in Accept get the results of find and findOne on collections with a
+// schema as length-delimited messages.
+const MIMEProtobuf = "application/x-protobuf"
+
+// wantsProtobuf reports whether the client accepts protobuf responses
+func wantsProtobuf(c *fiber.Ctx) bool {
+	return strings.Contains(c.Get(fiber.HeaderAccept), MIMEProtobuf)
+}
+
+// respondProtobuf writes the documents of a find or findOne result as
+// messages of the collection's schema, each prefixed with its length as a
+// varint. The message type is named in the Content-Type.
+func (h *Data) respondProtobuf(c *fiber.Ctx, doc *Document, result map[string]interface{}) error {
+	md := h.Protos.Message(doc.Database, doc.Collection)
+	if md == nil {
+		return c.Status(fiber.StatusNotAcceptable).JSON(fiber.Map{"error": "No protobuf schema for " + doc.Database + "." + doc.Collection})
+	}
+
+	var docs []interface{}
+	if d, ok := result["document"]; ok && d != nil {
+		docs = append(docs, d)
+	}
+	switch ds := result["documents"].(type) {
+	case []bson.M:
+		for _, d := range ds {
+			docs = append(docs, d)
+		}
+	case []interface{}:
+		docs = append(docs, ds...)
+	}
+
+	var body []byte
+	for _, d := range docs {
+		var err error
+		if body, err = protoschema.AppendDelimited(body, md, d); err != nil {
+			log.Printf("Failed to encode result as %s: %v", md.FullName(), err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to encode result", "details": err.Error()})
+		}
+	}
+	c.Set(fiber.HeaderContentType, MIMEProtobuf+"; messageType="+string(md.FullName())+"; delimited=true")
+	return c.Send(body)
+}
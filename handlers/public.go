@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"mongo-data-api-go-alternative/auth"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// defaultPublicLimit caps anonymous finds on public collections without a
+// maxLimit
+const defaultPublicLimit = 100
+
+// publicFilter caps the limit of an anonymous request on a public
+// collection and returns the filter of the collection's public documents,
+// to be combined with the request's. It returns nil for other requests.
+func publicFilter(c *fiber.Ctx, doc *Document) interface{} {
+	pc, ok := auth.PrincipalFromCtx(c).Public(doc.Database, doc.Collection)
+	if !ok {
+		return nil
+	}
+	limit := pc.MaxLimit
+	if limit == 0 {
+		limit = defaultPublicLimit
+	}
+	if doc.Limit <= 0 || doc.Limit > limit {
+		doc.Limit = limit
+	}
+	if len(pc.Filter) == 0 {
+		return nil
+	}
+	return bson.M(pc.Filter)
+}
+
+// andFilter combines filter with the additional conditions of extra
+func andFilter(filter, extra interface{}) interface{} {
+	if extra == nil {
+		return filter
+	}
+	if d, ok := filter.(bson.D); filter == nil || ok && len(d) == 0 {
+		return extra
+	}
+	return bson.D{{Key: "$and", Value: bson.A{filter, extra}}}
+}
@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"strconv"
+	"strings"
+
+	"mongo-data-api-go-alternative/auth"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// documentRenderer returns the rewriting of the documents a request reads,
+// or nil when they are returned as stored
+func (h *Data) documentRenderer(c *fiber.Ctx, doc *Document) func(bson.M) {
+	plainIDs, plainDates, numbers := h.plainObjectIDs(doc), doc.PlainDates, numbersAsStrings(c, doc)
+	uuids := h.uuidFields(doc)
+	if !plainIDs && !plainDates && !numbers && len(uuids) == 0 {
+		return nil
+	}
+	return func(d bson.M) {
+		if plainIDs {
+			plainDocumentID(d)
+		}
+		for _, field := range uuids {
+			rewriteField(d, strings.Split(field, "."), plainUUID)
+		}
+		if plainDates {
+			rewriteValues(d, plainDate)
+		}
+		if numbers {
+			rewriteValues(d, numberString)
+		}
+	}
+}
+
+// numbersAsStrings reports whether the request returns 64-bit integers and
+// decimals as strings: as it asks, or else as its API key does
+func numbersAsStrings(c *fiber.Ctx, doc *Document) bool {
+	if doc.NumbersAsStrings != nil {
+		return *doc.NumbersAsStrings
+	}
+	p := auth.PrincipalFromCtx(c)
+	return p != nil && p.Key.NumbersAsStrings
+}
+
+// numberString renders the numbers JavaScript cannot represent exactly as
+// strings. Relaxed EJSON writes 64-bit integers as plain numbers, which
+// JSON.parse rounds past 2^53.
+func numberString(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int64:
+		return strconv.FormatInt(n, 10)
+	case primitive.Decimal128:
+		return n.String()
+	}
+	return v
+}
+
+// renderDocuments applies render to the documents of a result
+func renderDocuments(result map[string]interface{}, render func(bson.M)) {
+	renderDocument(result["document"], render)
+	switch docs := result["documents"].(type) {
+	case []bson.M:
+		for _, d := range docs {
+			render(d)
+		}
+	case []interface{}:
+		for _, d := range docs {
+			renderDocument(d, render)
+		}
+	}
+}
+
+func renderDocument(doc interface{}, render func(bson.M)) {
+	switch d := doc.(type) {
+	case bson.M:
+		render(d)
+	case map[string]interface{}:
+		render(d)
+	}
+}
+
+// rewriteValues replaces the values in v, at any depth, with what fn
+// returns for them
+func rewriteValues(v interface{}, fn func(interface{}) interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.M:
+		for k, item := range v {
+			v[k] = rewriteValues(item, fn)
+		}
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = rewriteValues(item, fn)
+		}
+	case bson.D:
+		for i := range v {
+			v[i].Value = rewriteValues(v[i].Value, fn)
+		}
+	case bson.A:
+		for i := range v {
+			v[i] = rewriteValues(v[i], fn)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = rewriteValues(v[i], fn)
+		}
+	default:
+		return fn(v)
+	}
+	return v
+}
+
+// rewriteField replaces the values at path in v, or the elements of an
+// array there, with what fn returns for them. A path crossing an array
+// applies to each of its elements.
+func rewriteField(v interface{}, path []string, fn func(interface{}) interface{}) interface{} {
+	if len(path) == 0 {
+		if a, ok := v.(bson.A); ok {
+			for i := range a {
+				a[i] = fn(a[i])
+			}
+			return a
+		}
+		return fn(v)
+	}
+	switch v := v.(type) {
+	case bson.M:
+		if item, ok := v[path[0]]; ok {
+			v[path[0]] = rewriteField(item, path[1:], fn)
+		}
+	case map[string]interface{}:
+		if item, ok := v[path[0]]; ok {
+			v[path[0]] = rewriteField(item, path[1:], fn)
+		}
+	case bson.D:
+		for i := range v {
+			if v[i].Key == path[0] {
+				v[i].Value = rewriteField(v[i].Value, path[1:], fn)
+			}
+		}
+	case bson.A:
+		for i := range v {
+			v[i] = rewriteField(v[i], path, fn)
+		}
+	}
+	return v
+}
@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"mongo-data-api-go-alternative/query"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// FindByID serves GET /api/collections/:db/:coll/:id and its REST facade
+// equivalent, a findOne by _id.
+// The fields query parameter lists the fields to return, or to leave out
+// when prefixed with "-".
+func (h *Data) FindByID(c *fiber.Ctx) error {
+	doc, err := idDocument(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	doc.Projection = fieldsProjection(c.Query("fields"))
+
+	return h.findOneOr(c, doc, func(c *fiber.Ctx) error {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Document not found"})
+	})
+}
+
+// idFilter matches an _id given as a path segment. The segment does not say
+// which type the _id has, so it matches an ObjectId, a number or a string
+// with that text.
+func idFilter(id string) bson.D {
+	candidates := bson.A{id}
+	if oid, err := primitive.ObjectIDFromHex(id); err == nil {
+		candidates = append(candidates, oid)
+	}
+	if n, err := strconv.ParseInt(id, 10, 64); err == nil {
+		candidates = append(candidates, n)
+	}
+	if len(candidates) == 1 {
+		return bson.D{{Key: "_id", Value: id}}
+	}
+	return bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: candidates}}}}
+}
+
+// fieldsProjection turns a comma-separated list such as "name,email" or
+// "-password" into a projection
+func fieldsProjection(fields string) bson.D {
+	var projection bson.D
+	for _, f := range strings.Split(fields, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		if name, ok := strings.CutPrefix(f, "-"); ok {
+			projection = append(projection, bson.E{Key: name, Value: int32(0)})
+		} else {
+			projection = append(projection, bson.E{Key: f, Value: int32(1)})
+		}
+	}
+	return projection
+}
+
+// The REST facade maps resource requests on /api/data/:db/:coll[/:id] to
+// the data operations, for clients that cannot build request bodies:
+//
+//	GET    /api/data/:db/:coll      find, with filter, $filter, sort, limit, skip and fields parameters
+//	POST   /api/data/:db/:coll      insertOne, or insertMany for an array
+//	GET    /api/data/:db/:coll/:id  findOne by _id
+//	PATCH  /api/data/:db/:coll/:id  updateOne by _id, $set of the body unless it holds operators or is a merge patch or JSON Patch
+//	DELETE /api/data/:db/:coll/:id  deleteOne by _id
+
+// List serves GET /api/data/:db/:coll
+func (h *Data) List(c *fiber.Ctx) error {
+	doc, err := listDocument(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	return h.find(c, doc)
+}
+
+// listDocument reads the find of a REST list request from its query string
+func listDocument(c *fiber.Ctx) (*Document, error) {
+	doc := &Document{Database: c.Params("db"), Collection: c.Params("coll")}
+	if filter := c.Query("filter"); filter != "" {
+		if err := bson.UnmarshalExtJSON([]byte(filter), false, &doc.Filter); err != nil {
+			return nil, fmt.Errorf("invalid filter: %w", err)
+		}
+	}
+	if expr := c.Query("$filter"); expr != "" {
+		filter, err := query.ParseExpression(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid $filter: %w", err)
+		}
+		if len(doc.Filter) > 0 {
+			filter = bson.D{{Key: "$and", Value: bson.A{doc.Filter, filter}}}
+		}
+		doc.Filter = filter
+	}
+	if sort := c.Query("sort"); strings.HasPrefix(sort, "{") {
+		if err := bson.UnmarshalExtJSON([]byte(sort), false, &doc.Sort); err != nil {
+			return nil, fmt.Errorf("invalid sort: %w", err)
+		}
+	} else {
+		// "name,-age" sorts by name ascending, then age descending
+		for _, f := range fieldsProjection(sort) {
+			dir := int32(1)
+			if f.Value == int32(0) {
+				dir = -1
+			}
+			doc.Sort = append(doc.Sort, bson.E{Key: f.Key, Value: dir})
+		}
+	}
+	for name, v := range map[string]*int64{"limit": &doc.Limit, "skip": &doc.Skip} {
+		if q := c.Query(name); q != "" {
+			n, err := strconv.ParseInt(q, 10, 64)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid %s %q", name, q)
+			}
+			*v = n
+		}
+	}
+	doc.Projection = fieldsProjection(c.Query("fields"))
+	doc.IncludeTotalCount = c.QueryBool("includeTotalCount")
+	doc.Keyset = c.QueryBool("keyset")
+	doc.PageAfter, doc.PageBefore = c.Query("pageAfter"), c.Query("pageBefore")
+	return doc, nil
+}
+
+// Create serves POST /api/data/:db/:coll with a document or an array of
+// documents as the body
+func (h *Data) Create(c *fiber.Ctx) error {
+	doc := Document{Database: c.Params("db"), Collection: c.Params("coll")}
+	body := bytes.TrimSpace(c.Body())
+	var err error
+	if len(body) > 0 && body[0] == '[' {
+		// Extended JSON has no top-level arrays
+		var wrapped struct {
+			Documents []bson.D `bson:"documents"`
+		}
+		err = bson.UnmarshalExtJSON(append(append([]byte(`{"documents":`), body...), '}'), false, &wrapped)
+		doc.Documents = wrapped.Documents
+	} else {
+		err = bson.UnmarshalExtJSON(body, false, &doc.Document)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	c.Status(fiber.StatusCreated)
+	if doc.Documents != nil {
+		return h.insertMany(c, &doc)
+	}
+	return h.insertOne(c, &doc)
+}
+
+// Patch serves PATCH /api/data/:db/:coll/:id. A body of fields is set on
+// the document; a body of update operators is applied as it is. Bodies of
+// type application/merge-patch+json are merged as by mergeOne, and those of
+// type application/json-patch+json applied as by patchOne.
+func (h *Data) Patch(c *fiber.Ctx) error {
+	doc, err := idDocument(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if strings.HasPrefix(c.Get(fiber.HeaderContentType), jsonPatchType) {
+		// The patch is an array, which only decodes as a member
+		body := append(append([]byte(`{"operations":`), c.Body()...), '}')
+		if err := bson.UnmarshalExtJSON(body, false, doc); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		return h.patchOne(c, doc)
+	}
+	var fields bson.D
+	if err := bson.UnmarshalExtJSON(c.Body(), false, &fields); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if strings.HasPrefix(c.Get(fiber.HeaderContentType), mergePatchType) {
+		if fields == nil {
+			fields = bson.D{}
+		}
+		doc.Patch = fields
+		return h.mergeOne(c, doc)
+	}
+	if len(fields) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "The body must set at least one field"})
+	}
+	operators := 0
+	for _, e := range fields {
+		if strings.HasPrefix(e.Key, "$") {
+			operators++
+		}
+	}
+	switch operators {
+	case 0:
+		doc.Update = bson.D{{Key: "$set", Value: fields}}
+	case len(fields):
+		doc.Update = fields
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "The body must hold either fields or update operators"})
+	}
+	return h.updateOne(c, doc)
+}
+
+// Remove serves DELETE /api/data/:db/:coll/:id
+func (h *Data) Remove(c *fiber.Ctx) error {
+	doc, err := idDocument(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	return h.deleteOne(c, doc)
+}
+
+// idDocument addresses the document named by the path of a REST request.
+// failOnNoMatch=true makes a PATCH or DELETE of a missing document a 404.
+func idDocument(c *fiber.Ctx) (*Document, error) {
+	id, err := url.PathUnescape(c.Params("id"))
+	if err != nil {
+		return nil, errors.New("invalid id")
+	}
+	doc := &Document{Database: c.Params("db"), Collection: c.Params("coll"), Filter: idFilter(id)}
+	doc.FailOnNoMatch = c.QueryBool("failOnNoMatch")
+	return doc, nil
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"mongo-data-api-go-alternative/script"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/etag"
+)
+
+// Routes are the endpoints of the /api group that clients call with their
+// credentials. The server and the handler tests register them the same way,
+// so a read-only instance routes the same endpoints in both.
+type Routes struct {
+	Data     *Data
+	Sessions *Sessions
+	Clone    *Clone
+	Stats    *Stats
+	Jobs     *Jobs
+	// Tokens is nil unless signed tokens are enabled
+	Tokens    *Tokens
+	Saved     *SavedQueries
+	Endpoints []*script.Endpoint
+	// ReadOnly leaves the write endpoints unrouted, so they answer 404, or
+	// 405 where the path also serves reads. Sessions, saved queries and
+	// custom endpoints stay routed; the auth middleware rejects their writes.
+	ReadOnly bool
+	// RESTAPI routes the REST resources under /data
+	RESTAPI bool
+}
+
+// Register adds the routes to api, the /api group
+func (r *Routes) Register(api fiber.Router) {
+	// Responses link to other endpoints of the group, such as jobs
+	api.Use(apiPath)
+
+	// Client sessions; data requests run in the session named by their
+	// X-Session-Id header
+	api.Post("/sessions", r.Sessions.Start)
+	api.Post("/sessions/:id/startTransaction", r.Sessions.StartTransaction)
+	api.Post("/sessions/:id/commitTransaction", r.Sessions.CommitTransaction)
+	api.Post("/sessions/:id/abortTransaction", r.Sessions.AbortTransaction)
+	api.Delete("/sessions/:id", r.Sessions.End)
+	api.Use(r.Sessions.Bind)
+
+	// MongoDB operations. The bodies of the data endpoints are checked
+	// against their schemas before the handlers decode them.
+	data := r.Data
+	api.Post("/findOne", ValidateBody("findOne"), data.FindOne)
+	// GET reads answer HEAD and If-None-Match with the ETag of their body
+	readETag := etag.New()
+	api.Get("/collections/:db/:coll/:id", readETag, data.FindByID)
+	if r.RESTAPI {
+		api.Get("/data/:db/:coll", readETag, data.List)
+		api.Get("/data/:db/:coll/:id", readETag, data.FindByID)
+	}
+	api.Post("/find", ValidateBody("find"), data.Find)
+	api.Post("/snapshotRead", ValidateBody("snapshotRead"), data.SnapshotRead)
+	if len(data.FanOutReads.Clusters) > 0 {
+		api.Post("/fanOutFind", ValidateBody("fanOutFind"), data.FanOutFind)
+	}
+	api.Post("/aggregate", ValidateBody("aggregate"), data.Aggregate)
+	api.Post("/validateQuery", data.ValidateQuery)
+	api.Post("/sql", data.SQL)
+	api.Post("/export", ValidateBody("export"), data.Export)
+	api.Post("/tail", ValidateBody("tail"), data.Tail)
+	api.Post("/history", ValidateBody("history"), data.Versions)
+
+	// Read-only instances don't route the write endpoints at all
+	if !r.ReadOnly {
+		api.Post("/insertOne", ValidateBody("insertOne"), data.InsertOne)
+		api.Post("/insertMany", ValidateBody("insertMany"), data.InsertMany)
+		if r.RESTAPI {
+			api.Post("/data/:db/:coll", data.Create)
+			api.Patch("/data/:db/:coll/:id", data.Patch)
+			api.Delete("/data/:db/:coll/:id", data.Remove)
+		}
+		api.Post("/updateOne", ValidateBody("updateOne"), data.UpdateOne)
+		api.Post("/mergeOne", ValidateBody("mergeOne"), data.MergeOne)
+		api.Post("/patchOne", ValidateBody("patchOne"), data.PatchOne)
+		api.Post("/revert", ValidateBody("revert"), data.Revert)
+		api.Post("/updateMany", ValidateBody("updateMany"), data.UpdateMany)
+		api.Post("/deleteOne", ValidateBody("deleteOne"), data.DeleteOne)
+		api.Post("/deleteMany", ValidateBody("deleteMany"), data.DeleteMany)
+		api.Post("/restore", ValidateBody("restore"), data.Restore)
+		api.Post("/import", data.Import)
+
+		// Background copies between namespaces and clusters
+		api.Post("/cloneCollection", ValidateBody("cloneCollection"), r.Clone.Start)
+	}
+
+	// Storage statistics for dashboards
+	api.Get("/stats", r.Stats.Get)
+
+	// Background jobs
+	api.Get("/jobs/:id", r.Jobs.Get)
+	api.Get("/jobs/:id/result", r.Jobs.Result)
+
+	// Short-lived signed tokens for direct client access
+	if r.Tokens != nil {
+		api.Post("/tokens", r.Tokens.Issue)
+	}
+
+	// Saved queries
+	api.Get("/run", r.Saved.List)
+	api.Post("/run/:name", r.Saved.Run)
+
+	// Custom scripted endpoints
+	for _, ep := range r.Endpoints {
+		api.Add(ep.Method, "/custom"+ep.Path, ep.Handler)
+	}
+}
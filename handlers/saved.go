@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"mongo-data-api-go-alternative/auth"
+	"mongo-data-api-go-alternative/config"
+	"mongo-data-api-go-alternative/query"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// operations maps the operations saved queries may run, query.Operations,
+// to the handler implementing them
+var operations = map[string]func(*Data, *fiber.Ctx, *Document) error{
+	"insertOne":  (*Data).insertOne,
+	"insertMany": (*Data).insertMany,
+	"findOne":    (*Data).findOne,
+	"find":       (*Data).find,
+	"updateOne":  (*Data).updateOne,
+	"updateMany": (*Data).updateMany,
+	"deleteOne":  (*Data).deleteOne,
+	"deleteMany": (*Data).deleteMany,
+	"aggregate":  (*Data).aggregate,
+}
+
+// SavedQueries serves the /api/run endpoints
+type SavedQueries struct {
+	Registry *query.Registry
+	Data     *Data
+}
+
+// savedQueryView is what clients see of a saved query: its signature but not
+// its templates
+type savedQueryView struct {
+	Name        string             `json:"name"`
+	Description string             `json:"description,omitempty"`
+	Operation   string             `json:"operation"`
+	Parameters  []config.Parameter `json:"parameters"`
+}
+
+// List lists the saved queries the API key may run
+func (s *SavedQueries) List(c *fiber.Ctx) error {
+	p := auth.PrincipalFromCtx(c)
+	views := make([]savedQueryView, 0)
+	for _, q := range s.Registry.List() {
+		if !p.Can("run") && !p.Can("run:"+q.Name) {
+			continue
+		}
+		params := q.Parameters
+		if params == nil {
+			params = []config.Parameter{}
+		}
+		views = append(views, savedQueryView{Name: q.Name, Description: q.Description, Operation: q.Operation, Parameters: params})
+	}
+	return c.JSON(fiber.Map{"queries": views})
+}
+
+// Run executes a saved query with the parameter values in the request body
+func (s *SavedQueries) Run(c *fiber.Ctx) error {
+	q, _, err := s.Registry.Get(c.Params("name"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	params := make(map[string]interface{})
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&params); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+
+	bound, err := query.Bind(q, params)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// The bound query is decoded like a request body, so typed parameters
+	// become BSON values
+	data, err := json.Marshal(bound)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	var doc Document
+	if err := bson.UnmarshalExtJSON(data, false, &doc); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	run := operations[q.Operation]
+	if run == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("saved queries cannot run %q", q.Operation)})
+	}
+	auth.RunningSavedQuery(c, q.Name)
+	return run(s.Data, c, &doc)
+}
@@ -0,0 +1,272 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// JSON types of the fields of request bodies
+const (
+	typeAny     = "any"
+	typeString  = "string"
+	typeInteger = "integer"
+	typeNumber  = "number"
+	typeBoolean = "boolean"
+	typeObject  = "object"
+	typeArray   = "array"
+)
+
+// typeNames name the JSON types in error messages
+var typeNames = map[string]string{
+	typeString:  "a string",
+	typeInteger: "an integer",
+	typeNumber:  "a number",
+	typeBoolean: "a boolean",
+	typeObject:  "an object",
+	typeArray:   "an array",
+	"null":      "null",
+}
+
+// fieldSchema is the JSON type of a field of a request body. Items is the
+// schema of the elements of an array, and Fields those of the fields of an
+// object decoded into a struct.
+type fieldSchema struct {
+	Type   string
+	Items  *fieldSchema
+	Fields map[string]fieldSchema
+}
+
+// bodySchema is the schema of the JSON object body of an endpoint
+type bodySchema struct {
+	fieldSchema
+	// Required are the fields that must be set and not null
+	Required []string
+}
+
+var (
+	documentType  = reflect.TypeOf(bson.D{})
+	rawValueType  = reflect.TypeOf(bson.RawValue{})
+	interfaceType = reflect.TypeOf((*interface{})(nil)).Elem()
+)
+
+// bodySchemas are the schemas of the bodies of the endpoints decoding EJSON
+// bodies, generated from the structs they are decoded into
+var bodySchemas = map[string]bodySchema{
+	"insertOne":       newBodySchema(Document{}, "database", "collection", "document"),
+	"insertMany":      newBodySchema(Document{}, "database", "collection", "documents"),
+	"findOne":         newBodySchema(Document{}, "database", "collection"),
+	"find":            newBodySchema(Document{}, "database", "collection"),
+	"fanOutFind":      newBodySchema(fanOutRequest{}, "database", "collection"),
+	"snapshotRead":    newBodySchema(snapshotRequest{}, "finds"),
+	"updateOne":       newBodySchema(Document{}, "database", "collection"),
+	"mergeOne":        newBodySchema(Document{}, "database", "collection"),
+	"patchOne":        newBodySchema(Document{}, "database", "collection"),
+	"updateMany":      newBodySchema(Document{}, "database", "collection"),
+	"deleteOne":       newBodySchema(Document{}, "database", "collection"),
+	"deleteMany":      newBodySchema(Document{}, "database", "collection"),
+	"aggregate":       newBodySchema(Document{}, "database", "collection"),
+	"export":          newBodySchema(exportRequest{}, "database", "collection"),
+	"tail":            newBodySchema(tailRequest{}, "database", "collection"),
+	"history":         newBodySchema(Document{}, "database", "collection", "documentId"),
+	"revert":          newBodySchema(Document{}, "database", "collection", "versionId"),
+	"restore":         newBodySchema(Document{}, "database", "collection", "documentId"),
+	"cloneCollection": newBodySchema(cloneRequest{}, "source", "target"),
+}
+
+// newBodySchema generates the schema of bodies decoded into the struct v
+func newBodySchema(v interface{}, required ...string) bodySchema {
+	s := bodySchema{fieldSchema: schemaOf(reflect.TypeOf(v)), Required: required}
+	for _, name := range required {
+		if _, ok := s.Fields[name]; !ok {
+			panic(fmt.Sprintf("handlers: %T has no field %s", v, name))
+		}
+	}
+	return s
+}
+
+// schemaOf returns the JSON type the bson codec decodes into type t
+func schemaOf(t reflect.Type) fieldSchema {
+	switch t {
+	case documentType:
+		return fieldSchema{Type: typeObject}
+	case rawValueType, interfaceType:
+		return fieldSchema{Type: typeAny}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaOf(t.Elem())
+	case reflect.String:
+		return fieldSchema{Type: typeString}
+	case reflect.Bool:
+		return fieldSchema{Type: typeBoolean}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return fieldSchema{Type: typeInteger}
+	case reflect.Float32, reflect.Float64:
+		return fieldSchema{Type: typeNumber}
+	case reflect.Map:
+		return fieldSchema{Type: typeObject}
+	case reflect.Slice, reflect.Array:
+		items := schemaOf(t.Elem())
+		return fieldSchema{Type: typeArray, Items: &items}
+	case reflect.Struct:
+		s := fieldSchema{Type: typeObject, Fields: map[string]fieldSchema{}}
+		for i := 0; i < t.NumField(); i++ {
+			name, inline := bsonField(t.Field(i))
+			switch {
+			case inline:
+				for name, field := range schemaOf(t.Field(i).Type).Fields {
+					s.Fields[name] = field
+				}
+			case name != "":
+				s.Fields[name] = schemaOf(t.Field(i).Type)
+			}
+		}
+		return s
+	}
+	return fieldSchema{Type: typeAny}
+}
+
+// ValidateBody checks the body of the endpoint op against its schema
+// before the handler decodes it, so that a missing field or a field of the
+// wrong type, such as a limit sent as a string, is answered with the same
+// 400 by every endpoint. Bodies streamed with stream=true to one of the
+// StreamedPaths are decoded as they arrive and are left to the handler.
+func ValidateBody(op string) fiber.Handler {
+	schema, ok := bodySchemas[op]
+	if !ok {
+		panic("handlers: no body schema for " + op)
+	}
+	return func(c *fiber.Ctx) error {
+		if Streamed(c) {
+			return c.Next()
+		}
+		if err := schema.validate(c.Body()); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Next()
+	}
+}
+
+// validate checks the JSON object body against the schema. All the fields
+// that don't match are reported, in order of their names.
+func (s bodySchema) validate(body []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var top map[string]interface{}
+	if err := dec.Decode(&top); err != nil || top == nil {
+		return errors.New("request body must be a JSON object")
+	}
+	var problems []string
+	for _, name := range s.Required {
+		if top[name] == nil {
+			problems = append(problems, name+" is required")
+		}
+	}
+	problems = append(problems, s.fieldSchema.check("", top)...)
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// check returns the problems of value at path. Null is accepted for every
+// type, as the codec leaves the field unset. Fields the schema doesn't know
+// are left to strict bodies to reject.
+func (s fieldSchema) check(path string, value interface{}) []string {
+	if value == nil || s.Type == typeAny {
+		return nil
+	}
+	if got := jsonType(value); !s.accepts(got, value) {
+		return []string{fmt.Sprintf("%s must be %s, not %s", path, typeNames[s.Type], typeNames[got])}
+	}
+	var problems []string
+	switch v := value.(type) {
+	case []interface{}:
+		for i, item := range v {
+			problems = append(problems, s.Items.check(fmt.Sprintf("%s[%d]", path, i), item)...)
+		}
+	case map[string]interface{}:
+		if s.Fields == nil || isEJSONNumber(v) {
+			break
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if field, ok := s.Fields[name]; ok {
+				problems = append(problems, field.check(join(path, name), v[name])...)
+			}
+		}
+	}
+	return problems
+}
+
+// accepts reports whether a value of JSON type got is valid for the schema.
+// Numbers may be given as EJSON numbers, and integers as numbers without a
+// fraction, as the codec decodes them.
+func (s fieldSchema) accepts(got string, value interface{}) bool {
+	switch s.Type {
+	case typeInteger:
+		if n, ok := value.(json.Number); ok {
+			f, err := n.Float64()
+			return err == nil && f == float64(int64(f))
+		}
+		m, ok := value.(map[string]interface{})
+		return ok && isEJSONNumber(m) && (m["$numberInt"] != nil || m["$numberLong"] != nil)
+	case typeNumber:
+		m, ok := value.(map[string]interface{})
+		return got == typeNumber || ok && isEJSONNumber(m)
+	}
+	return got == s.Type
+}
+
+// isEJSONNumber reports whether m is an EJSON number such as
+// {"$numberLong": "5"}
+func isEJSONNumber(m map[string]interface{}) bool {
+	if len(m) != 1 {
+		return false
+	}
+	for key := range m {
+		switch key {
+		case "$numberInt", "$numberLong", "$numberDouble", "$numberDecimal":
+			_, ok := m[key].(string)
+			return ok
+		}
+	}
+	return false
+}
+
+// jsonType returns the JSON type of a value decoded with UseNumber
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return typeString
+	case json.Number:
+		return typeNumber
+	case bool:
+		return typeBoolean
+	case []interface{}:
+		return typeArray
+	case map[string]interface{}:
+		return typeObject
+	}
+	return "null"
+}
+
+// join appends name to the dotted path of a field
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"mongo-data-api-go-alternative/auth"
+	"mongo-data-api-go-alternative/db"
+	"mongo-data-api-go-alternative/sessions"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// SessionHeader names the session a data request runs in
+const SessionHeader = "X-Session-Id"
+
+// sessionLocal is the key of the request's session in the fiber locals
+const sessionLocal = "session"
+
+// errTokenSession rejects sessions of signed tokens, which would share
+// those of the issuing key, and of anonymous requests
+var errTokenSession = errors.New("sessions require an API key or OAuth2 client")
+
+// transactionTimeout bounds committing and aborting a transaction
+const transactionTimeout = 30 * time.Second
+
+// Sessions serves /api/sessions, which opens and ends server sessions and
+// their transactions. A session is only usable by the API key that opened
+// it.
+type Sessions struct {
+	Manager *sessions.Manager
+}
+
+// sessionError responds with the status matching a session error
+func sessionError(c *fiber.Ctx, err error) error {
+	status := fiber.StatusInternalServerError
+	switch {
+	case errors.Is(err, sessions.ErrNotFound):
+		status = fiber.StatusNotFound
+	case errors.Is(err, sessions.ErrTransaction):
+		status = fiber.StatusConflict
+	case errors.Is(err, db.ErrSessionsUnsupported):
+		status = fiber.StatusNotImplemented
+	}
+	return c.Status(status).JSON(fiber.Map{"error": err.Error()})
+}
+
+// Bind runs the data request in the session named by the X-Session-Id
+// header, if any. Requests of the same session run one at a time.
+func (h *Sessions) Bind(c *fiber.Ctx) error {
+	id := c.Get(SessionHeader)
+	if id == "" {
+		return c.Next()
+	}
+	if p := auth.PrincipalFromCtx(c); p.Token() != nil || p.Anonymous() {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": errTokenSession.Error()})
+	}
+	s, err := h.Manager.Acquire(id, auth.PrincipalFromCtx(c).Key.Name)
+	if err != nil {
+		return sessionError(c, err)
+	}
+	defer h.Manager.Release(s)
+	c.Locals(sessionLocal, s)
+	return c.Next()
+}
+
+// Start opens a session. Sessions are causally consistent unless the body
+// sets causalConsistency to false.
+func (h *Sessions) Start(c *fiber.Ctx) error {
+	if p := auth.PrincipalFromCtx(c); p.Token() != nil || p.Anonymous() {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": errTokenSession.Error()})
+	}
+	var req struct {
+		CausalConsistency *bool `json:"causalConsistency"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+	}
+	causal := req.CausalConsistency == nil || *req.CausalConsistency
+	s, err := h.Manager.Start(auth.PrincipalFromCtx(c).Key.Name, causal)
+	if err != nil {
+		return sessionError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(s)
+}
+
+// withSession runs fn with the session named in the path and responds with
+// its state
+func (h *Sessions) withSession(c *fiber.Ctx, fn func(ctx context.Context, s *sessions.Session) error) error {
+	s, err := h.Manager.Acquire(c.Params("id"), auth.PrincipalFromCtx(c).Key.Name)
+	if err != nil {
+		return sessionError(c, err)
+	}
+	defer h.Manager.Release(s)
+	ctx, cancel := context.WithTimeout(opContext(c), transactionTimeout)
+	defer cancel()
+	if err := fn(ctx, s); err != nil {
+		return sessionError(c, err)
+	}
+	return c.JSON(s)
+}
+
+// StartTransaction starts a transaction in a session
+func (h *Sessions) StartTransaction(c *fiber.Ctx) error {
+	return h.withSession(c, func(_ context.Context, s *sessions.Session) error {
+		return h.Manager.StartTransaction(s)
+	})
+}
+
+// CommitTransaction commits the transaction of a session
+func (h *Sessions) CommitTransaction(c *fiber.Ctx) error {
+	return h.withSession(c, func(ctx context.Context, s *sessions.Session) error {
+		return h.Manager.CommitTransaction(ctx, s)
+	})
+}
+
+// AbortTransaction aborts the transaction of a session
+func (h *Sessions) AbortTransaction(c *fiber.Ctx) error {
+	return h.withSession(c, func(ctx context.Context, s *sessions.Session) error {
+		return h.Manager.AbortTransaction(ctx, s)
+	})
+}
+
+// End ends a session, aborting its transaction if one is in progress
+func (h *Sessions) End(c *fiber.Ctx) error {
+	s, err := h.Manager.Acquire(c.Params("id"), auth.PrincipalFromCtx(c).Key.Name)
+	if err != nil {
+		return sessionError(c, err)
+	}
+	defer h.Manager.Release(s)
+	h.Manager.End(s)
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// shardKey returns the shard key fields of the request's collection: those
+// the request names, or else those configured for the namespace
+func (h *Data) shardKey(doc *Document) []string {
+	if len(doc.ShardKey) > 0 {
+		return doc.ShardKey
+	}
+	return h.ShardKeys[doc.Database+"."+doc.Collection]
+}
+
+// checkShardKey reports why a write cannot be routed on a collection
+// sharded on key, before MongoDB rejects it with a less helpful error.
+// Single-document writes must target one shard with the full shard key or
+// _id; upserts and updates changing a shard key field need the full shard
+// key, and multi-document updates cannot change it at all. Fields count
+// when the filter, or one of its $and clauses, matches them by equality.
+func checkShardKey(op string, key []string, filter, update interface{}, single, upsert bool) error {
+	if len(key) == 0 {
+		return nil
+	}
+	fields := strings.Join(key, ", ")
+	changesKey := updatesShardKey(update, key)
+	if changesKey && !single {
+		return fmt.Errorf("%s cannot change a shard key field of a collection sharded on (%s); use updateOne", op, fields)
+	}
+
+	equal := make(map[string]bool)
+	equalityFields(filter, equal)
+	var missing []string
+	for _, field := range key {
+		if !equal[field] {
+			missing = append(missing, field)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	switch {
+	case upsert:
+		return fmt.Errorf("%s with upsert on a collection sharded on (%s) needs equality on every shard key field in the filter; missing %s",
+			op, fields, strings.Join(missing, ", "))
+	case changesKey:
+		return fmt.Errorf("%s changing a shard key field of a collection sharded on (%s) needs equality on every shard key field in the filter; missing %s",
+			op, fields, strings.Join(missing, ", "))
+	case single && !equal["_id"]:
+		return fmt.Errorf("%s on a collection sharded on (%s) needs equality on _id or on every shard key field in the filter; missing %s",
+			op, fields, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// equalityFields adds the fields filter matches by equality to equal
+func equalityFields(filter interface{}, equal map[string]bool) {
+	for _, e := range elements(filter) {
+		if e.Key == "$and" {
+			if clauses, ok := e.Value.(bson.A); ok {
+				for _, clause := range clauses {
+					equalityFields(clause, equal)
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(e.Key, "$") {
+			continue
+		}
+		ops := elements(e.Value)
+		if len(ops) == 0 || !strings.HasPrefix(ops[0].Key, "$") {
+			// A plain value, or a whole embedded document
+			equal[e.Key] = true
+			continue
+		}
+		for _, op := range ops {
+			if op.Key == "$eq" {
+				equal[e.Key] = true
+			}
+		}
+	}
+}
+
+// updatesShardKey reports whether update sets or removes a field of key
+// or one of their parents. Replacement documents and pipelines are
+// treated as changing the key, since they may.
+func updatesShardKey(update interface{}, key []string) bool {
+	if _, ok := update.(bson.A); ok {
+		return true
+	}
+	ops := elements(update)
+	for _, op := range ops {
+		if !strings.HasPrefix(op.Key, "$") {
+			return len(ops) > 0
+		}
+		for _, e := range elements(op.Value) {
+			for _, field := range key {
+				if e.Key == field || strings.HasPrefix(field, e.Key+".") || strings.HasPrefix(e.Key, field+".") {
+					return true
+				}
+			}
+			if op.Key == "$rename" {
+				if to, ok := e.Value.(string); ok {
+					for _, field := range key {
+						if to == field || strings.HasPrefix(field, to+".") {
+							return true
+						}
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// elements returns the fields of a document decoded as bson.D or a map, or
+// nothing for other values
+func elements(v interface{}) bson.D {
+	switch d := v.(type) {
+	case bson.D:
+		return d
+	case bson.M:
+		return mapElements(d)
+	case map[string]interface{}:
+		return mapElements(d)
+	}
+	return nil
+}
+
+func mapElements(m map[string]interface{}) bson.D {
+	d := make(bson.D, 0, len(m))
+	for k, v := range m {
+		d = append(d, bson.E{Key: k, Value: v})
+	}
+	return d
+}
@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"mongo-data-api-go-alternative/db"
+	"mongo-data-api-go-alternative/hooks"
+	"mongo-data-api-go-alternative/tenant"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxSnapshotFinds bounds the finds of a snapshotRead
+const maxSnapshotFinds = 20
+
+// snapshotRequest is the body of /api/snapshotRead
+type snapshotRequest struct {
+	Finds []Document `bson:"finds"`
+	// Format and Pretty apply to the whole response
+	Format string `bson:"format"`
+	Pretty bool   `bson:"pretty"`
+}
+
+// preparedFind is a find of a snapshotRead or fan-out find, authorized and
+// ready to run
+type preparedFind struct {
+	doc      *Document
+	req      *hooks.Request
+	database string
+	filter   interface{}
+	options  *options.FindOptions
+	computed bson.D
+}
+
+// SnapshotRead runs several finds in one session with snapshot read
+// concern, so that they all see the data as of the same point in time,
+// e.g. orders and their items as they were together. Every find is
+// authorized before any runs, and the results are returned in the order of
+// the finds. Keyset pages and total counts are not supported.
+func (h *Data) SnapshotRead(c *fiber.Ctx) error {
+	var body snapshotRequest
+	if err := parseBody(c, &body, h.StrictBodies); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	respondDoc := &Document{Format: body.Format, Pretty: body.Pretty}
+	format, err := responseFormat(c, respondDoc)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if format.Rows {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "snapshotRead responds with JSON or EJSON only"})
+	}
+	if len(body.Finds) == 0 || len(body.Finds) > maxSnapshotFinds {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("finds must hold between 1 and %d finds", maxSnapshotFinds)})
+	}
+
+	finds := make([]*preparedFind, len(body.Finds))
+	for i := range body.Finds {
+		f, err := h.prepareFind(c, &body.Finds[i])
+		if err != nil {
+			return snapshotError(c, i, err)
+		}
+		finds[i] = f
+	}
+
+	starter, ok := h.Store.(db.SnapshotStarter)
+	if !ok {
+		return c.Status(fiber.StatusNotImplemented).JSON(fiber.Map{"error": db.ErrSessionsUnsupported.Error()})
+	}
+	session, err := starter.StartSnapshot()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer session.End(context.Background())
+
+	results := make([]interface{}, len(finds))
+	for i, f := range finds {
+		result, err := h.runSnapshotFind(c, session, f)
+		if err != nil {
+			return snapshotError(c, i, err)
+		}
+		results[i] = result
+	}
+	return respond(c, respondDoc, map[string]interface{}{"results": results})
+}
+
+// snapshotError answers with the error of the i-th find, with the status
+// of a *fiber.Error or as denied for authorization errors
+func snapshotError(c *fiber.Ctx, i int, err error) error {
+	var fe *fiber.Error
+	if errors.As(err, &fe) {
+		return c.Status(fe.Code).JSON(fiber.Map{"error": fmt.Sprintf("finds[%d]: %s", i, fe.Message)})
+	}
+	return denied(c, fmt.Errorf("finds[%d]: %w", i, err))
+}
+
+// prepareFind checks and authorizes a find as find does, for the finds
+// that run outside of it. Errors other than authorization errors are
+// *fiber.Errors.
+func (h *Data) prepareFind(c *fiber.Ctx, doc *Document) (*preparedFind, error) {
+	if doc.Database == "" || doc.Collection == "" {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "database and collection are required")
+	}
+	if doc.Keyset || doc.PageAfter != "" || doc.PageBefore != "" || doc.IncludeTotalCount {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "keyset pages and includeTotalCount are not supported")
+	}
+	if err := h.convertFields(doc); err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if err := h.readDefaults(doc, true); err != nil {
+		return nil, fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+
+	req := hookRequest("find", doc)
+	req.Filter = h.filter(doc)
+	if err := hooks.BeforeRequest(c, req); err != nil {
+		return nil, fiber.NewError(hooks.Status(err), err.Error())
+	}
+	public := publicFilter(c, doc)
+	filter := andFilter(tenant.FromCtx(c).Filter(req.Filter), public)
+	database, err := h.database(c, "find", doc)
+	if err != nil {
+		return nil, err
+	}
+
+	findOptions := options.Find()
+	if doc.Projection != nil {
+		findOptions.SetProjection(doc.Projection)
+	}
+	if doc.Sort != nil {
+		findOptions.SetSort(doc.Sort)
+	}
+	if doc.Limit > 0 {
+		findOptions.SetLimit(doc.Limit)
+	}
+	if doc.Skip > 0 {
+		findOptions.SetSkip(doc.Skip)
+	}
+	computed, err := h.computedFields(doc)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	return &preparedFind{doc: doc, req: req, database: database, filter: filter, options: findOptions, computed: computed}, nil
+}
+
+// runSnapshotFind runs a find in the snapshot session and returns its
+// result as find would. Errors are *fiber.Errors.
+func (h *Data) runSnapshotFind(c *fiber.Ctx, session db.Session, f *preparedFind) (map[string]interface{}, error) {
+	defer observe(c, "find", f.doc.Database, f.doc.Collection)()
+	results, err := f.run(session.Bind(limitedContext(c, f.doc, h.MaxTime.Read)), h.Store)
+	if err != nil {
+		log.Printf("Error executing snapshot find: %v", err)
+		return nil, fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	result := map[string]interface{}{"documents": results}
+	if err := hooks.AfterResult(c, f.req, result); err != nil {
+		return nil, fiber.NewError(hooks.Status(err), err.Error())
+	}
+	if render := h.documentRenderer(c, f.doc); render != nil {
+		renderDocuments(result, render)
+	}
+	return result, nil
+}
+
+// run reads the documents of the find from store
+func (f *preparedFind) run(ctx context.Context, store db.DataStore) ([]bson.M, error) {
+	if len(f.computed) > 0 {
+		pipeline, aggregateOptions := findPipeline(f.filter, f.options, f.computed)
+		return store.Aggregate(ctx, f.database, f.doc.Collection, pipeline, aggregateOptions)
+	}
+	return store.Find(ctx, f.database, f.doc.Collection, f.filter, f.options)
+}
@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"mongo-data-api-go-alternative/query"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// sqlRequest is the body of /api/sql
+type sqlRequest struct {
+	Query string `json:"query"`
+}
+
+// SQL runs a read-only SELECT statement, compiled to a find or an
+// aggregation. Rows are returned as documents keyed by column name.
+func (h *Data) SQL(c *fiber.Ctx) error {
+	var req sqlRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if req.Query == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "query is required"})
+	}
+	q, err := query.ParseSQL(req.Query)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	doc := &Document{Database: q.Database, Collection: q.Collection}
+	if q.Pipeline != nil {
+		doc.Pipeline = q.Pipeline
+		return h.aggregate(c, doc)
+	}
+	doc.Filter, doc.Projection, doc.Sort, doc.Limit, doc.Skip = q.Filter, q.Projection, q.Sort, q.Limit, q.Skip
+	return h.find(c, doc)
+}
@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"mongo-data-api-go-alternative/auth"
+	"mongo-data-api-go-alternative/config"
+	"mongo-data-api-go-alternative/db"
+	"mongo-data-api-go-alternative/tenant"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Stats serves /api/stats, the storage statistics of a database or
+// collection. Results are cached for TTL so dashboards polling the endpoint
+// don't run the stats commands on every request.
+type Stats struct {
+	Store db.DataStore
+	// TTL is how long results are cached; zero or negative disables caching
+	TTL time.Duration
+	// MaxTime limits the stats commands with its read limit
+	MaxTime config.MaxTimeConfig
+
+	mu    sync.Mutex
+	cache map[string]cachedStats
+}
+
+type cachedStats struct {
+	stats *db.Stats
+	time  time.Time
+}
+
+// statsResponse is the body returned by /api/stats
+type statsResponse struct {
+	Database   string `json:"database"`
+	Collection string `json:"collection,omitempty"`
+	*db.Stats
+	// Time is when the statistics were read from the database
+	Time time.Time `json:"time"`
+}
+
+// Get returns the statistics of the database and optional collection named
+// in the query string
+func (h *Stats) Get(c *fiber.Ctx) error {
+	database, collection := c.Query("database"), c.Query("collection")
+	if database == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "database is required"})
+	}
+	scope := tenant.FromCtx(c)
+	if scope != nil && scope.Mode == config.TenancyField {
+		// Collections are shared by all tenants in field mode
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": tenant.ErrForbidden.Error()})
+	}
+	if err := auth.Authorize(c, "stats", database, collection); err != nil {
+		return denied(c, err)
+	}
+
+	defer observe(c, "stats", database, collection)()
+	entry, err := h.stats(limitedContext(c, &Document{}, h.MaxTime.Read), scope.Database(database), collection)
+	if errors.Is(err, db.ErrNamespaceNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Collection not found"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(statsResponse{Database: database, Collection: collection, Stats: entry.stats, Time: entry.time})
+}
+
+// stats returns cached statistics or reads them from the store
+func (h *Stats) stats(ctx context.Context, database, collection string) (cachedStats, error) {
+	key := database + "." + collection
+	h.mu.Lock()
+	entry, ok := h.cache[key]
+	h.mu.Unlock()
+	if ok && time.Since(entry.time) < h.TTL {
+		return entry, nil
+	}
+
+	stats, err := h.Store.Stats(ctx, database, collection)
+	if err != nil {
+		return cachedStats{}, err
+	}
+	entry = cachedStats{stats: stats, time: time.Now().UTC()}
+	if h.TTL > 0 {
+		h.mu.Lock()
+		if h.cache == nil {
+			h.cache = make(map[string]cachedStats)
+		}
+		h.cache[key] = entry
+		h.mu.Unlock()
+	}
+	return entry, nil
+}
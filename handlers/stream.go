@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"mongo-data-api-go-alternative/hooks"
+	"mongo-data-api-go-alternative/importer"
+	"mongo-data-api-go-alternative/tenant"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// StreamedPaths are the endpoints that decode their body while reading it
+// when called with stream=true
+var StreamedPaths = []string{"/api/insertMany", "/api/import"}
+
+// Streamed reports whether a request asks for its body to be streamed
+func Streamed(c *fiber.Ctx) bool {
+	if !c.QueryBool("stream") {
+		return false
+	}
+	for _, path := range StreamedPaths {
+		if strings.HasSuffix(c.Path(), path) {
+			return true
+		}
+	}
+	return false
+}
+
+// bodyReader returns the request body as a reader. Streamed bodies are read
+// from the connection as they arrive, without a read deadline, so that
+// uploads larger than the body limit aren't cut off by the read timeout.
+func bodyReader(c *fiber.Ctx) io.Reader {
+	if !c.Request().IsBodyStream() {
+		return bytes.NewReader(c.Body())
+	}
+	if conn := c.Context().Conn(); conn != nil {
+		conn.SetReadDeadline(time.Time{})
+	}
+	return c.Context().RequestBodyStream()
+}
+
+// arrayDecoder decodes the elements of a JSON array as EJSON documents. Its
+// line numbers are the 1-based positions of the documents in the array.
+type arrayDecoder struct {
+	dec   *json.Decoder
+	index int
+}
+
+func (a *arrayDecoder) Next() (bson.D, error) {
+	if !a.dec.More() {
+		// Consume the closing bracket
+		if _, err := a.dec.Token(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	var raw json.RawMessage
+	if err := a.dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+	a.index++
+	var doc bson.D
+	if err := bson.UnmarshalExtJSON(raw, false, &doc); err != nil {
+		return nil, &importer.RecordError{Line: a.index, Err: err}
+	}
+	return doc, nil
+}
+
+func (a *arrayDecoder) Line() int {
+	return a.index
+}
+
+// openInsertStream reads an insertMany body up to its documents array and
+// returns a decoder for the documents. The database and collection fields
+// must precede the documents.
+func openInsertStream(r io.Reader) (*Document, *arrayDecoder, error) {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, nil, errors.New("request body must be a JSON object")
+	}
+	doc := &Document{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		switch key := tok.(string); key {
+		case "database":
+			err = dec.Decode(&doc.Database)
+		case "collection":
+			err = dec.Decode(&doc.Collection)
+		case "documents":
+			if doc.Database == "" || doc.Collection == "" {
+				return nil, nil, errors.New("database and collection must precede documents in a streamed request")
+			}
+			if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+				return nil, nil, errors.New("documents must be an array")
+			}
+			return doc, &arrayDecoder{dec: dec}, nil
+		default:
+			var skipped json.RawMessage
+			err = dec.Decode(&skipped)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid request body: %w", err)
+		}
+	}
+	return nil, nil, errors.New("documents are required")
+}
+
+// insertManyStream inserts the documents of a streamed request body batch
+// by batch while it is decoded, so memory use does not grow with the size
+// of the body. It responds with the import counters.
+func (h *Data) insertManyStream(c *fiber.Ctx) error {
+	doc, dec, err := openInsertStream(bodyReader(c))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	database, err := h.database(c, "insertMany", doc)
+	if err != nil {
+		return denied(c, err)
+	}
+	defer observe(c, "insertMany", doc.Database, doc.Collection)()
+	writer := &importer.Writer{
+		Store:      h.Store,
+		Database:   database,
+		Collection: doc.Collection,
+		Scope:      tenant.FromCtx(c),
+		Convert:    h.uuidConverter(doc),
+	}
+	return h.writeStream(c, "insertMany", doc, dec, importer.DefaultBatchSize, writer)
+}
+
+// writeStream decodes and writes batches until dec is exhausted. Documents
+// written before a fatal decoding error stay written; the response then
+// reports the error with the progress so far.
+func (h *Data) writeStream(c *fiber.Ctx, op string, doc *Document, dec importer.Decoder, size int, writer *importer.Writer) error {
+	var progress importer.Progress
+	for {
+		batch, err := importer.NextBatch(dec, size, &progress)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error(), "progress": progress})
+		}
+		if len(batch.Documents) == 0 {
+			return c.JSON(progress)
+		}
+		req := hookRequest(op, doc)
+		req.Documents = batch.Documents
+		if err := hooks.BeforeBatch(c, req); err != nil {
+			return hookError(c, err)
+		}
+		batch.Documents = req.Documents
+		if err := writer.Write(limitedContext(c, doc, h.MaxTime.Write), batch, &progress); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error(), "progress": progress})
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// bodyFieldSets caches the fields accepted by each request body type
+var bodyFieldSets sync.Map
+
+// unknownFields returns the top-level fields of the JSON object body that
+// the struct v points to has no bson field for, sorted
+func unknownFields(body []byte, v interface{}) ([]string, error) {
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(body, &top); err != nil {
+		return nil, err
+	}
+	known := bodyFields(reflect.TypeOf(v).Elem())
+	var unknown []string
+	for name := range top {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown, nil
+}
+
+// bodyFields returns the names the bson codec decodes into the fields of
+// struct type t, including those of inlined structs
+func bodyFields(t reflect.Type) map[string]bool {
+	if fields, ok := bodyFieldSets.Load(t); ok {
+		return fields.(map[string]bool)
+	}
+	fields := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		name, inline := bsonField(t.Field(i))
+		switch {
+		case inline:
+			for name := range bodyFields(t.Field(i).Type) {
+				fields[name] = true
+			}
+		case name != "":
+			fields[name] = true
+		}
+	}
+	bodyFieldSets.Store(t, fields)
+	return fields
+}
+
+// bsonField returns the name the bson codec decodes struct field f from,
+// or whether it inlines the fields of a struct. The name is empty for
+// fields the codec skips.
+func bsonField(f reflect.StructField) (name string, inline bool) {
+	name, opts, _ := strings.Cut(f.Tag.Get("bson"), ",")
+	switch {
+	case name == "-" || !f.IsExported():
+		return "", false
+	case strings.Contains(","+opts+",", ",inline,") && f.Type.Kind() == reflect.Struct:
+		return "", true
+	case name == "":
+		return strings.ToLower(f.Name), false
+	}
+	return name, false
+}
@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"mongo-data-api-go-alternative/db"
+	"mongo-data-api-go-alternative/formats"
+	"mongo-data-api-go-alternative/hooks"
+	"mongo-data-api-go-alternative/tenant"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// tailSSE is the format of tails sent as server-sent events
+const tailSSE = "sse"
+
+const (
+	// tailAwait is how long each getMore of a tail waits for new documents
+	tailAwait = 5 * time.Second
+	// tailRetry is how long a tail of an empty collection waits before it
+	// opens its cursor again; MongoDB closes tailable cursors that find
+	// nothing right away
+	tailRetry = time.Second
+	// tailKeepAlive is how often an SSE tail sends a comment while no
+	// document arrives, so that proxies keep the connection open and a
+	// client that went away is noticed
+	tailKeepAlive = 15 * time.Second
+)
+
+// tailRequest is the body accepted by /api/tail
+type tailRequest struct {
+	Database   string `bson:"database"`
+	Collection string `bson:"collection"`
+	Filter     bson.D `bson:"filter"`
+	Projection bson.D `bson:"projection"`
+	// Format is "ndjson" or "sse"; without one, Accept: text/event-stream
+	// selects "sse"
+	Format string `bson:"format"`
+	// IdleTimeoutMS ends the tail when no document arrives for that long,
+	// instead of the configured idle timeout, which it cannot exceed
+	IdleTimeoutMS int64 `bson:"idleTimeoutMS"`
+}
+
+// Tail streams the documents of a capped collection matching an optional
+// filter as they are inserted, through a tailable cursor awaiting new
+// data. The documents already in the collection are sent first, in
+// insertion order. Documents are relaxed EJSON lines ("ndjson", the
+// default) or server-sent events ("sse"). The tail ends when no document
+// arrives for the idle timeout or when the client goes away. Result hooks
+// and computed fields are not applied.
+func (h *Data) Tail(c *fiber.Ctx) error {
+	var doc tailRequest
+	if err := parseBody(c, &doc, h.StrictBodies); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	sse := doc.Format == tailSSE
+	switch doc.Format {
+	case "":
+		sse = strings.Contains(c.Get(fiber.HeaderAccept), "text/event-stream")
+	case formats.NDJSON, tailSSE:
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("format must be %q or %q", formats.NDJSON, tailSSE)})
+	}
+	idle := h.TailIdleTimeout
+	if doc.IdleTimeoutMS != 0 {
+		requested := time.Duration(doc.IdleTimeoutMS) * time.Millisecond
+		if requested < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "idleTimeoutMS must not be negative"})
+		}
+		if idle > 0 && requested > idle {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("idleTimeoutMS must not exceed %d", idle.Milliseconds())})
+		}
+		idle = requested
+	}
+
+	req := &hooks.Request{Operation: "tail", Database: doc.Database, Collection: doc.Collection, Filter: doc.Filter}
+	if err := hooks.BeforeRequest(c, req); err != nil {
+		return hookError(c, err)
+	}
+	target := &Document{Database: doc.Database, Collection: doc.Collection}
+	database, err := h.database(c, "tail", target)
+	if err != nil {
+		return denied(c, err)
+	}
+	defer observe(c, "tail", doc.Database, doc.Collection)()
+
+	stats, err := h.Store.Stats(opContext(c), database, doc.Collection)
+	if errors.Is(err, db.ErrNamespaceNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Collection not found"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !stats.Capped {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("%s.%s is not a capped collection", doc.Database, doc.Collection)})
+	}
+
+	opts := options.Find().SetCursorType(options.TailableAwait).SetMaxAwaitTime(tailAwait)
+	if doc.Projection != nil {
+		opts.SetProjection(doc.Projection)
+	}
+	filter := tenant.FromCtx(c).Filter(req.Filter)
+	out := &tailWriter{sse: sse, render: h.documentRenderer(c, target)}
+	// The request context is released when the handler returns, so the
+	// stream writer gets everything it needs from it now
+	ctx, cancel := context.WithCancel(opContext(c))
+	conn := c.Context().Conn()
+
+	if sse {
+		c.Set(fiber.HeaderContentType, "text/event-stream")
+		c.Set(fiber.HeaderCacheControl, "no-cache")
+	} else {
+		f, _ := formats.Lookup(formats.NDJSON)
+		c.Set(fiber.HeaderContentType, f.MediaType)
+	}
+	// Stop proxies from buffering the stream
+	c.Set("X-Accel-Buffering", "no")
+	c.Context().SetBodyStreamWriter(func(bw *bufio.Writer) {
+		defer cancel()
+		// A tail outlives the server's write timeout
+		if conn != nil {
+			conn.SetWriteDeadline(time.Time{})
+		}
+		out.bw = bw
+		write := out.write
+		if idle > 0 {
+			timer := time.AfterFunc(idle, cancel)
+			defer timer.Stop()
+			write = func(raw bson.Raw) error {
+				timer.Reset(idle)
+				return out.write(raw)
+			}
+		}
+		var wg sync.WaitGroup
+		if sse {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				out.keepAlive(ctx, cancel)
+			}()
+		}
+		err := h.tail(ctx, database, doc.Collection, filter, opts, write)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Tail of %s.%s stopped: %v", database, doc.Collection, err)
+			out.fail(err)
+		}
+		cancel()
+		wg.Wait()
+	})
+	return nil
+}
+
+// tail calls fn with the documents of a tailable cursor until ctx is done
+// or the cursor is closed. The cursor of an empty collection is opened
+// again until it finds a document.
+func (h *Data) tail(ctx context.Context, database, collection string, filter interface{}, opts *options.FindOptions, fn func(bson.Raw) error) error {
+	for {
+		found := false
+		err := h.Store.FindEach(ctx, database, collection, filter, opts, func(raw bson.Raw) error {
+			found = true
+			return fn(raw)
+		})
+		if err != nil || found {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(tailRetry):
+		}
+	}
+}
+
+// tailWriter writes the documents of a tail as EJSON lines or server-sent
+// events, flushing each. Its writes are serialized, as SSE keep-alives are
+// sent from another goroutine.
+type tailWriter struct {
+	mu     sync.Mutex
+	bw     *bufio.Writer
+	sse    bool
+	render func(bson.M)
+}
+
+func (t *tailWriter) write(raw bson.Raw) error {
+	var doc bson.M
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return err
+	}
+	if t.render != nil {
+		t.render(doc)
+	}
+	var buf bytes.Buffer
+	if t.sse {
+		buf.WriteString("data: ")
+	}
+	// WriteEJSON ends the document with a newline; an event ends with a
+	// blank line
+	if err := formats.WriteEJSON(&buf, ordered(doc), false); err != nil {
+		return err
+	}
+	if t.sse {
+		buf.WriteByte('\n')
+	}
+	return t.send(buf.Bytes())
+}
+
+// keepAlive sends a comment every tailKeepAlive until ctx is done, and
+// cancels the tail when the client is gone
+func (t *tailWriter) keepAlive(ctx context.Context, cancel func()) {
+	ticker := time.NewTicker(tailKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := t.send([]byte(": keepalive\n\n")); err != nil {
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// fail reports the error ending an SSE tail as an "error" event. NDJSON
+// tails just end, since their lines are documents.
+func (t *tailWriter) fail(err error) {
+	if !t.sse {
+		return
+	}
+	data, _ := json.Marshal(fiber.Map{"error": err.Error()})
+	t.send([]byte("event: error\ndata: " + string(data) + "\n\n"))
+}
+
+func (t *tailWriter) send(p []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := t.bw.Write(p); err != nil {
+		return err
+	}
+	return t.bw.Flush()
+}
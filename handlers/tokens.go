@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"mongo-data-api-go-alternative/auth"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// defaultTokenTTL is the lifetime of tokens requested without ttlSeconds
+const defaultTokenTTL = 10 * time.Minute
+
+// Tokens serves /api/tokens, which issues short-lived signed tokens that
+// can be handed to browsers and mobile clients for limited direct access.
+// A token grants a subset of the operations of the issuing API key on one
+// namespace, and stops working when the key is deleted or loses them.
+type Tokens struct {
+	Signer *auth.Tokens
+}
+
+// tokenRequest is the body of POST /api/tokens
+type tokenRequest struct {
+	Namespace  string   `json:"namespace"`
+	Operations []string `json:"operations"`
+	TTLSeconds int      `json:"ttlSeconds"`
+}
+
+// Issue signs a token for the namespace and operations of the request,
+// which the requesting key must be allowed itself
+func (h *Tokens) Issue(c *fiber.Ctx) error {
+	p := auth.PrincipalFromCtx(c)
+	if p.Token() != nil || p.Client() != nil || p.Anonymous() {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "only API keys can issue tokens"})
+	}
+	var req tokenRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	database, collection, ok := strings.Cut(req.Namespace, ".")
+	if !ok || database == "" || collection == "" || strings.ContainsAny(req.Namespace, `*?[\`) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("invalid namespace %q: expected \"database.collection\"", req.Namespace)})
+	}
+	if len(req.Operations) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "operations are required"})
+	}
+	ttl := defaultTokenTTL
+	if req.TTLSeconds != 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+	if ttl <= 0 || ttl > h.Signer.MaxTTL {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("ttlSeconds must be between 1 and %d", int(h.Signer.MaxTTL.Seconds()))})
+	}
+	for _, op := range req.Operations {
+		if !isOperation(op) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("unknown operation %q", op)})
+		}
+		// Tokens can be issued for operations frozen by maintenance mode
+		if err := auth.Authorize(c, op, database, collection); err != nil && !errors.Is(err, auth.ErrMaintenance) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	token, err := h.Signer.Sign(auth.TokenClaims{
+		Key:        p.Key.Name,
+		Namespace:  req.Namespace,
+		Operations: req.Operations,
+		Expires:    expires.Unix(),
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"token": token, "expiresAt": expires.UTC()})
+}
+
+func isOperation(op string) bool {
+	for _, o := range auth.Operations {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
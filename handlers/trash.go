@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+
+	"mongo-data-api-go-alternative/auth"
+	"mongo-data-api-go-alternative/hooks"
+	"mongo-data-api-go-alternative/tenant"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Restore takes the latest deleted version of a document out of the trash
+// and inserts it back into its collection. Hooks see the write as an
+// insertOne.
+func (h *Data) Restore(c *fiber.Ctx) error {
+	var doc Document
+	if err := parseBody(c, &doc, h.StrictBodies); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if _, err := responseFormat(c, &doc); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if doc.DocumentID == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "documentId is required"})
+	}
+
+	if err := auth.Authorize(c, "find", doc.Database, doc.Collection); err != nil {
+		return denied(c, err)
+	}
+	database, err := h.database(c, "insertOne", &doc)
+	if err != nil {
+		return denied(c, err)
+	}
+	if h.Trash == nil || !h.Trash.Enabled(database, doc.Collection) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("%s.%s has no trash", doc.Database, doc.Collection)})
+	}
+	plain := h.plainObjectIDs(&doc)
+	id := doc.DocumentID
+	if plain {
+		id = objectIDValue(id)
+	}
+	defer observe(c, "restore", doc.Database, doc.Collection)()
+
+	// The entry is read raw to restore the fields of the document in their
+	// order
+	ctx := limitedContext(c, &doc, h.MaxTime.Write)
+	var entry struct {
+		ID       interface{} `bson:"_id"`
+		Document bson.D      `bson:"document"`
+	}
+	found := false
+	filter := savedDocumentFilter(c, bson.D{{Key: "collection", Value: doc.Collection}, {Key: "documentId", Value: id}})
+	opts := options.Find().SetSort(bson.D{{Key: "deletedAt", Value: -1}, {Key: "_id", Value: -1}}).SetLimit(1)
+	err = h.Store.FindEach(ctx, database, h.Trash.Collection(), filter, opts, func(raw bson.Raw) error {
+		found = true
+		return bson.Unmarshal(raw, &entry)
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !found {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "No deleted document found"})
+	}
+
+	req := hookRequest("insertOne", &doc)
+	req.Documents = []interface{}{entry.Document}
+	if err := hooks.BeforeRequest(c, req); err != nil {
+		return hookError(c, err)
+	}
+	if len(req.Documents) != 1 {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Request hook must keep exactly one document"})
+	}
+	result, err := h.Store.InsertOne(ctx, database, doc.Collection, tenant.FromCtx(c).Document(req.Documents[0]))
+	if mongo.IsDuplicateKeyError(err) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "A document with the same _id already exists"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	// The document is back, so a failure to remove its entry only leaves a
+	// stale one behind until it is purged
+	if _, err := h.Store.DeleteOne(ctx, database, h.Trash.Collection(), bson.D{{Key: "_id", Value: entry.ID}}); err != nil {
+		log.Printf("Failed to remove the trash entry of a restored document of %s.%s: %v", database, doc.Collection, err)
+	}
+
+	wrappedResult := map[string]interface{}{"insertedId": result.InsertedID}
+	if err := hooks.AfterResult(c, req, wrappedResult); err != nil {
+		return hookError(c, err)
+	}
+	if plain {
+		plainResultIDs(wrappedResult)
+	}
+	return respond(c, &doc, wrappedResult)
+}
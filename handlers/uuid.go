@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// uuidFields returns the fields configured as UUIDs in the request's
+// collection
+func (h *Data) uuidFields(doc *Document) []string {
+	return h.UUIDFields[doc.Database+"."+doc.Collection]
+}
+
+// uuidConverter returns the importer.Writer conversion of the fields
+// configured as UUIDs in the request's collection, or nil when there are
+// none
+func (h *Data) uuidConverter(doc *Document) func(bson.D) error {
+	return convertUUIDs(h.uuidFields(doc))
+}
+
+// convertUUIDs returns a conversion of the UUID strings of fields in a
+// document, or nil without fields
+func convertUUIDs(fields []string) func(bson.D) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	return func(d bson.D) error {
+		for _, field := range fields {
+			if err := convertDocumentField(d, field, uuidValue); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// uuidValue converts a canonical UUID string sent for a UUID field to
+// Binary subtype 4, so that clients don't have to send base64 $binary
+// payloads
+func uuidValue(field string, v interface{}) (interface{}, error) {
+	s, ok := v.(string)
+	if !ok {
+		return v, nil
+	}
+	id, err := uuid.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid UUID %q", field, s)
+	}
+	return primitive.Binary{Subtype: bson.TypeBinaryUUID, Data: id[:]}, nil
+}
+
+// plainUUID renders a Binary subtype 4 as a canonical UUID string
+func plainUUID(v interface{}) interface{} {
+	if b, ok := v.(primitive.Binary); ok && b.Subtype == bson.TypeBinaryUUID && len(b.Data) == 16 {
+		return uuid.UUID(b.Data).String()
+	}
+	return v
+}
@@ -0,0 +1,252 @@
+// Package history keeps the prior versions of the documents of versioned
+// collections: updates made through the store copy the documents they
+// change to a history collection alongside, from which the versions can be
+// listed and restored
+package history
+
+import (
+	"context"
+	"errors"
+	"log"
+	"reflect"
+	"time"
+
+	"mongo-data-api-go-alternative/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// Suffix is appended to the name of a collection to name its history
+	Suffix = "_history"
+	// batchSize is the number of documents updateMany reads and updates at
+	// once
+	batchSize = 1000
+)
+
+// Collection returns the name of the history collection of collection
+func Collection(collection string) string {
+	return collection + Suffix
+}
+
+// Store is a data store that saves the prior version of every document
+// an update changes in versioned collections. Versions are saved once the
+// update succeeded; a version that fails to be saved is logged, as the
+// update cannot be undone.
+type Store struct {
+	db.DataStore
+	versioned map[string]bool
+	prefixed  bool
+}
+
+var _ db.DataStore = (*Store)(nil)
+
+// New versions the collections named "database.collection" in namespaces.
+// With prefixed, databases are tenant prefixed, so a namespace names the
+// database of every tenant.
+func New(store db.DataStore, namespaces []string, prefixed bool) *Store {
+	versioned := make(map[string]bool, len(namespaces))
+	for _, ns := range namespaces {
+		versioned[ns] = true
+	}
+	return &Store{DataStore: store, versioned: versioned, prefixed: prefixed}
+}
+
+// StartSession starts a session of the underlying store, so that versions
+// are saved in the transaction of the update
+func (s *Store) StartSession(causal bool) (db.Session, error) {
+	starter, ok := s.DataStore.(db.SessionStarter)
+	if !ok {
+		return nil, db.ErrSessionsUnsupported
+	}
+	return starter.StartSession(causal)
+}
+
+// StartSnapshot starts a snapshot session of the underlying store
+func (s *Store) StartSnapshot() (db.Session, error) {
+	starter, ok := s.DataStore.(db.SnapshotStarter)
+	if !ok {
+		return nil, db.ErrSessionsUnsupported
+	}
+	return starter.StartSnapshot()
+}
+
+// Versioned reports whether collection of the physical database is
+// versioned
+func (s *Store) Versioned(database, collection string) bool {
+	if s.versioned[database+"."+collection] {
+		return true
+	}
+	if !s.prefixed {
+		return false
+	}
+	// Tenant IDs may contain underscores themselves
+	for i, r := range database {
+		if r == '_' && s.versioned[database[i+1:]+"."+collection] {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateOne saves the version of the document the update changes. The
+// document is read first and the update pinned to its _id, unless it no
+// longer matches, in which case the update runs as requested.
+func (s *Store) UpdateOne(ctx context.Context, database, collection string, filter, update interface{}, opts *options.UpdateOptions) (*mongo.UpdateResult, error) {
+	if !s.Versioned(database, collection) {
+		return s.DataStore.UpdateOne(ctx, database, collection, filter, update, opts)
+	}
+	prior, err := s.DataStore.FindOne(ctx, database, collection, orEmpty(filter), nil)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return s.DataStore.UpdateOne(ctx, database, collection, filter, update, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pinned := bson.D{{Key: "$and", Value: bson.A{orEmpty(filter), bson.D{{Key: "_id", Value: prior["_id"]}}}}}
+	var pinnedOpts *options.UpdateOptions
+	if opts != nil {
+		o := *opts
+		o.Upsert = nil
+		pinnedOpts = &o
+	}
+	res, err := s.DataStore.UpdateOne(ctx, database, collection, pinned, update, pinnedOpts)
+	if err != nil {
+		return nil, err
+	}
+	if res.MatchedCount == 0 {
+		return s.DataStore.UpdateOne(ctx, database, collection, filter, update, opts)
+	}
+	if res.ModifiedCount > 0 {
+		s.save(ctx, database, collection, "updateOne", []bson.M{prior})
+	}
+	return res, nil
+}
+
+// UpdateMany saves the versions of the documents the update changes. The
+// matching documents are read in _id order, batchSize at a time, and each
+// batch is updated pinned to the _ids read, then read again to save the
+// versions of those that changed. Documents that only match once the update
+// ran are not updated; when none match at all, the update runs as requested,
+// so that it may upsert.
+func (s *Store) UpdateMany(ctx context.Context, database, collection string, filter, update interface{}, opts *options.UpdateOptions) (*mongo.UpdateResult, error) {
+	if !s.Versioned(database, collection) {
+		return s.DataStore.UpdateMany(ctx, database, collection, filter, update, opts)
+	}
+	var pinnedOpts *options.UpdateOptions
+	if opts != nil {
+		o := *opts
+		o.Upsert = nil
+		pinnedOpts = &o
+	}
+	res := &mongo.UpdateResult{}
+	var after interface{}
+	for resumed := false; ; resumed = true {
+		page := orEmpty(filter)
+		if resumed {
+			page = bson.D{{Key: "$and", Value: bson.A{page, bson.D{{Key: "_id", Value: bson.D{{Key: "$gt", Value: after}}}}}}}
+		}
+		priors, err := s.DataStore.Find(ctx, database, collection, page, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(batchSize))
+		if err != nil {
+			return nil, err
+		}
+		if len(priors) == 0 {
+			if !resumed {
+				return s.DataStore.UpdateMany(ctx, database, collection, filter, update, opts)
+			}
+			return res, nil
+		}
+		after = priors[len(priors)-1]["_id"]
+
+		ids := make(bson.A, len(priors))
+		for i, doc := range priors {
+			ids[i] = doc["_id"]
+		}
+		pinned := bson.D{{Key: "$and", Value: bson.A{orEmpty(filter), bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}}}}}
+		updated, err := s.DataStore.UpdateMany(ctx, database, collection, pinned, update, pinnedOpts)
+		if err != nil {
+			return nil, err
+		}
+		res.MatchedCount += updated.MatchedCount
+		res.ModifiedCount += updated.ModifiedCount
+		if updated.ModifiedCount > 0 {
+			s.save(ctx, database, collection, "updateMany", s.changed(ctx, database, collection, priors, ids))
+		}
+		if len(priors) < batchSize {
+			return res, nil
+		}
+	}
+}
+
+// changed returns the documents of priors, whose _ids are ids, that differ
+// from their current version
+func (s *Store) changed(ctx context.Context, database, collection string, priors []bson.M, ids bson.A) []bson.M {
+	after, err := s.DataStore.Find(ctx, database, collection, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}}, options.Find())
+	if err != nil {
+		log.Printf("Failed to read the updated documents of %s.%s to save their versions: %v", database, collection, err)
+		return nil
+	}
+	current := make(map[string]bson.M, len(after))
+	for _, doc := range after {
+		current[idKey(doc["_id"])] = doc
+	}
+	var changed []bson.M
+	for _, doc := range priors {
+		if now, ok := current[idKey(doc["_id"])]; !ok || !reflect.DeepEqual(doc, now) {
+			changed = append(changed, doc)
+		}
+	}
+	return changed
+}
+
+// save inserts the versions of documents into the history collection.
+// A version holds the document, its documentId, the operation that
+// replaced it, the API key it was made with as client, the X-Request-ID of
+// its request as requestId, and when it was replaced as at.
+func (s *Store) save(ctx context.Context, database, collection, operation string, documents []bson.M) {
+	if len(documents) == 0 {
+		return
+	}
+	client, _ := db.ClientFromContext(ctx)
+	requestID, _ := db.RequestIDFromContext(ctx)
+	at := time.Now().UTC()
+	versions := make([]interface{}, len(documents))
+	for i, doc := range documents {
+		version := bson.D{
+			{Key: "_id", Value: primitive.NewObjectID()},
+			{Key: "documentId", Value: doc["_id"]},
+			{Key: "document", Value: doc},
+			{Key: "operation", Value: operation},
+		}
+		if client != "" {
+			version = append(version, bson.E{Key: "client", Value: client})
+		}
+		if requestID != "" {
+			version = append(version, bson.E{Key: "requestId", Value: requestID})
+		}
+		versions[i] = append(version, bson.E{Key: "at", Value: at})
+	}
+	if _, err := s.DataStore.InsertMany(ctx, database, Collection(collection), versions); err != nil {
+		log.Printf("Failed to save %d versions of %s.%s: %v", len(versions), database, collection, err)
+	}
+}
+
+func orEmpty(filter interface{}) interface{} {
+	if filter == nil {
+		return bson.D{}
+	}
+	return filter
+}
+
+// idKey identifies an _id by its BSON encoding
+func idKey(id interface{}) string {
+	t, data, err := bson.MarshalValue(id)
+	if err != nil {
+		return ""
+	}
+	return string(rune(t)) + string(data)
+}
@@ -0,0 +1,79 @@
+package history
+
+import (
+	"context"
+	"testing"
+
+	"mongo-data-api-go-alternative/db"
+	memstore "mongo-data-api-go-alternative/db/memory"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// countingStore counts the updateMany calls reaching the store
+type countingStore struct {
+	db.DataStore
+	updates int
+}
+
+func (s *countingStore) UpdateMany(ctx context.Context, database, collection string, filter, update interface{}, opts *options.UpdateOptions) (*mongo.UpdateResult, error) {
+	s.updates++
+	return s.DataStore.UpdateMany(ctx, database, collection, filter, update, opts)
+}
+
+func TestUpdateMany(t *testing.T) {
+	ctx := context.Background()
+	mem := memstore.New()
+	docs := make([]interface{}, 2*batchSize+10)
+	for i := range docs {
+		docs[i] = bson.D{{Key: "_id", Value: int32(i)}, {Key: "open", Value: i%2 == 0}}
+	}
+	if _, err := mem.InsertMany(ctx, "app", "orders", docs); err != nil {
+		t.Fatal(err)
+	}
+	counting := &countingStore{DataStore: mem}
+	s := New(counting, []string{"app.orders"}, false)
+
+	// The update keeps the documents matching, so each must be visited once
+	// as the batches move on in _id order
+	open := bson.D{{Key: "open", Value: true}}
+	res, err := s.UpdateMany(ctx, "app", "orders", open, bson.D{{Key: "$inc", Value: bson.D{{Key: "n", Value: 1}}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(batchSize + 5); res.MatchedCount != want || res.ModifiedCount != want {
+		t.Errorf("matched %d, modified %d, want %d", res.MatchedCount, res.ModifiedCount, want)
+	}
+	if counting.updates != 2 {
+		t.Errorf("%d batches, want 2", counting.updates)
+	}
+	if n, _ := mem.CountDocuments(ctx, "app", "orders", bson.D{{Key: "n", Value: int32(1)}}); n != int64(batchSize+5) {
+		t.Errorf("%d documents updated once", n)
+	}
+	versions, err := mem.Find(ctx, "app", Collection("orders"), bson.D{}, options.Find())
+	if err != nil || len(versions) != batchSize+5 {
+		t.Fatalf("%d versions: %v", len(versions), err)
+	}
+	for _, v := range versions {
+		if doc, ok := v["document"].(bson.D); !ok || doc.Map()["n"] != nil || v["operation"] != "updateMany" {
+			t.Fatalf("version %v", v)
+		}
+	}
+
+	// Documents left unchanged don't get versions
+	if _, err := s.UpdateMany(ctx, "app", "orders", open, bson.D{{Key: "$set", Value: bson.D{{Key: "open", Value: true}}}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := mem.CountDocuments(ctx, "app", Collection("orders"), bson.D{}); n != int64(batchSize+5) {
+		t.Errorf("%d versions after a no-op update", n)
+	}
+
+	// With no match, the update runs as requested so that it upserts
+	counting.updates = 0
+	res, err = s.UpdateMany(ctx, "app", "orders", bson.D{{Key: "_id", Value: "new"}}, bson.D{{Key: "$set", Value: bson.D{{Key: "open", Value: true}}}}, options.Update().SetUpsert(true))
+	if err != nil || res.UpsertedID != "new" || counting.updates != 1 {
+		t.Errorf("upsert: %+v, %d updates, %v", res, counting.updates, err)
+	}
+}
@@ -0,0 +1,148 @@
+package hooks
+
+import (
+	"errors"
+	"path"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Request is an operation about to be sent to MongoDB. Filter, Update,
+// Documents and Pipeline hold deserialized values (bson.D documents and
+// bson.A arrays) and may be replaced by hooks. Database is the name given by
+// the client, before any tenant prefix is applied.
+type Request struct {
+	Operation  string
+	Database   string
+	Collection string
+	Filter     interface{}
+	Update     interface{}
+	Documents  []interface{}
+	Pipeline   interface{}
+}
+
+// Hook transforms requests and results of the data endpoints.
+// Request runs after the body has been parsed and before tenant scoping, so
+// anything a hook adds is still restricted to the caller's tenant. Result
+// receives the response before it is serialized, e.g. "document" (bson.M),
+// "documents" ([]bson.M) or the counters of write operations. Returning an
+// error aborts the request; a *fiber.Error controls the status code.
+type Hook interface {
+	Request(c *fiber.Ctx, req *Request) error
+	Result(c *fiber.Ctx, req *Request, result map[string]interface{}) error
+}
+
+// Funcs adapts plain functions to the Hook interface. Either may be nil.
+type Funcs struct {
+	OnRequest func(c *fiber.Ctx, req *Request) error
+	OnResult  func(c *fiber.Ctx, req *Request, result map[string]interface{}) error
+}
+
+// Request implements Hook
+func (f Funcs) Request(c *fiber.Ctx, req *Request) error {
+	if f.OnRequest == nil {
+		return nil
+	}
+	return f.OnRequest(c, req)
+}
+
+// Result implements Hook
+func (f Funcs) Result(c *fiber.Ctx, req *Request, result map[string]interface{}) error {
+	if f.OnResult == nil {
+		return nil
+	}
+	return f.OnResult(c, req, result)
+}
+
+type registration struct {
+	pattern string
+	hook    Hook
+}
+
+var (
+	mu    sync.RWMutex
+	hooks []registration
+)
+
+// Register adds a hook for the namespaces matching pattern, a path.Match
+// pattern on "database.collection" such as "shop.*" or "*". Hooks run in
+// registration order and should be registered before the server starts.
+func Register(pattern string, h Hook) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return err
+	}
+	if h == nil {
+		return errors.New("hooks: nil hook")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	hooks = append(hooks, registration{pattern: pattern, hook: h})
+	return nil
+}
+
+func matching(req *Request) []Hook {
+	mu.RLock()
+	defer mu.RUnlock()
+	var matched []Hook
+	namespace := req.Database + "." + req.Collection
+	for _, r := range hooks {
+		if ok, _ := path.Match(r.pattern, namespace); ok {
+			matched = append(matched, r.hook)
+		}
+	}
+	return matched
+}
+
+// Registered reports whether any hook is registered for the request's
+// namespace
+func Registered(req *Request) bool {
+	return len(matching(req)) > 0
+}
+
+// BeforeRequest runs the request hooks registered for the request's namespace
+func BeforeRequest(c *fiber.Ctx, req *Request) error {
+	for _, h := range matching(req) {
+		if err := h.Request(c, req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErrDocumentCount is returned by BeforeBatch when a hook added or removed
+// documents
+var ErrDocumentCount = fiber.NewError(fiber.StatusInternalServerError, "Request hook must not add or remove documents")
+
+// BeforeBatch runs the request hooks for a batch of an import or streamed
+// insert, whose progress counts documents by position. Hooks may replace the
+// documents but not change their number.
+func BeforeBatch(c *fiber.Ctx, req *Request) error {
+	n := len(req.Documents)
+	if err := BeforeRequest(c, req); err != nil {
+		return err
+	}
+	if len(req.Documents) != n {
+		return ErrDocumentCount
+	}
+	return nil
+}
+
+// AfterResult runs the result hooks registered for the request's namespace
+func AfterResult(c *fiber.Ctx, req *Request, result map[string]interface{}) error {
+	for _, h := range matching(req) {
+		if err := h.Result(c, req, result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Status returns the HTTP status for an error returned by a hook
+func Status(err error) int {
+	var fe *fiber.Error
+	if errors.As(err, &fe) {
+		return fe.Code
+	}
+	return fiber.StatusBadRequest
+}
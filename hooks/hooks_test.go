@@ -0,0 +1,179 @@
+package hooks
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// register registers h for the duration of the test
+func register(t *testing.T, pattern string, h Hook) {
+	t.Helper()
+	mu.Lock()
+	saved := hooks
+	mu.Unlock()
+	t.Cleanup(func() {
+		mu.Lock()
+		hooks = saved
+		mu.Unlock()
+	})
+	if err := Register(pattern, h); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	var order []string
+	register(t, "shop.*", Funcs{
+		OnRequest: func(_ *fiber.Ctx, req *Request) error {
+			order = append(order, "shop")
+			req.Filter = bson.D{{Key: "tenant", Value: "a"}}
+			return nil
+		},
+		OnResult: func(_ *fiber.Ctx, _ *Request, result map[string]interface{}) error {
+			result["document"].(bson.M)["masked"] = true
+			return nil
+		},
+	})
+	register(t, "*", Funcs{OnRequest: func(_ *fiber.Ctx, req *Request) error {
+		order = append(order, "all")
+		req.Filter = append(req.Filter.(bson.D), bson.E{Key: "deleted", Value: false})
+		return nil
+	}})
+	register(t, "other.*", Funcs{OnRequest: func(*fiber.Ctx, *Request) error {
+		t.Error("hook of another database ran")
+		return nil
+	}})
+
+	req := &Request{Operation: "findOne", Database: "shop", Collection: "orders", Filter: bson.D{}}
+	if !Registered(req) {
+		t.Fatal("no hook registered for shop.orders")
+	}
+	if err := BeforeRequest(nil, req); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"shop", "all"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("hooks ran in order %v, want %v", order, want)
+	}
+	if want := (bson.D{{Key: "tenant", Value: "a"}, {Key: "deleted", Value: false}}); !reflect.DeepEqual(req.Filter, want) {
+		t.Errorf("filter %v, want %v", req.Filter, want)
+	}
+	result := map[string]interface{}{"document": bson.M{"_id": 1}}
+	if err := AfterResult(nil, req, result); err != nil {
+		t.Fatal(err)
+	}
+	if result["document"].(bson.M)["masked"] != true {
+		t.Errorf("result %v not modified", result)
+	}
+	if !Registered(&Request{Database: "logs", Collection: "events"}) {
+		t.Error(`"*" doesn't match logs.events`)
+	}
+}
+
+func TestHookErrors(t *testing.T) {
+	register(t, "shop.orders", Funcs{OnRequest: func(*fiber.Ctx, *Request) error {
+		return fiber.NewError(fiber.StatusForbidden, "closed")
+	}})
+	register(t, "shop.orders", Funcs{OnRequest: func(*fiber.Ctx, *Request) error {
+		t.Error("hook ran after an error")
+		return nil
+	}})
+	err := BeforeRequest(nil, &Request{Database: "shop", Collection: "orders"})
+	if Status(err) != fiber.StatusForbidden {
+		t.Errorf("status %d for %v, want 403", Status(err), err)
+	}
+	if Status(errors.New("invalid")) != fiber.StatusBadRequest {
+		t.Error("plain errors aren't answered with 400")
+	}
+	if err := Register("[", Funcs{}); err == nil {
+		t.Error("invalid pattern registered")
+	}
+	if err := Register("*", nil); err == nil {
+		t.Error("nil hook registered")
+	}
+}
+
+func TestBeforeBatch(t *testing.T) {
+	register(t, "shop.*", Funcs{OnRequest: func(_ *fiber.Ctx, req *Request) error {
+		switch req.Collection {
+		case "replaced":
+			for i := range req.Documents {
+				req.Documents[i] = bson.D{{Key: "n", Value: i}}
+			}
+		case "dropped":
+			req.Documents = req.Documents[1:]
+		case "added":
+			req.Documents = append(req.Documents, bson.D{})
+		}
+		return nil
+	}})
+
+	for _, tc := range []struct {
+		collection string
+		err        error
+	}{
+		{"replaced", nil},
+		{"dropped", ErrDocumentCount},
+		{"added", ErrDocumentCount},
+	} {
+		req := &Request{Operation: "import", Database: "shop", Collection: tc.collection, Documents: []interface{}{bson.D{}, bson.D{}}}
+		if err := BeforeBatch(nil, req); err != tc.err {
+			t.Errorf("%s: error %v, want %v", tc.collection, err, tc.err)
+		}
+	}
+	if Status(ErrDocumentCount) != fiber.StatusInternalServerError {
+		t.Errorf("status %d, want 500", Status(ErrDocumentCount))
+	}
+}
+
+func TestRenameFields(t *testing.T) {
+	h := RenameFields(map[string]string{"email": "mail", "name": "fullName"})
+
+	req := &Request{
+		Filter: bson.D{
+			{Key: "email", Value: "a@example.com"},
+			{Key: "$or", Value: bson.A{bson.D{{Key: "name", Value: "A"}}, bson.D{{Key: "age", Value: 3}}}},
+		},
+		Documents: []interface{}{bson.D{{Key: "name", Value: "A"}, {Key: "age", Value: 3}}},
+		Update:    bson.D{{Key: "$set", Value: bson.D{{Key: "email", Value: "b@example.com"}}}},
+		Pipeline:  bson.A{bson.D{{Key: "$match", Value: bson.D{{Key: "email", Value: "a@example.com"}}}}},
+	}
+	pipeline := req.Pipeline
+	if err := h.Request(nil, req); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"filter", req.Filter, bson.D{
+			{Key: "mail", Value: "a@example.com"},
+			{Key: "$or", Value: bson.A{bson.D{{Key: "fullName", Value: "A"}}, bson.D{{Key: "age", Value: 3}}}},
+		}},
+		{"documents", req.Documents, []interface{}{bson.D{{Key: "fullName", Value: "A"}, {Key: "age", Value: 3}}}},
+		{"update", req.Update, bson.D{{Key: "$set", Value: bson.D{{Key: "mail", Value: "b@example.com"}}}}},
+		{"pipeline", req.Pipeline, pipeline},
+	} {
+		if !reflect.DeepEqual(tc.got, tc.want) {
+			t.Errorf("%s: %v, want %v", tc.name, tc.got, tc.want)
+		}
+	}
+
+	result := map[string]interface{}{
+		"document":  bson.M{"mail": "a@example.com", "age": 3},
+		"documents": []bson.M{{"fullName": "A"}, {"name": "kept"}},
+	}
+	if err := h.Result(nil, req, result); err != nil {
+		t.Fatal(err)
+	}
+	if want := (bson.M{"email": "a@example.com", "age": 3}); !reflect.DeepEqual(result["document"], want) {
+		t.Errorf("document %v, want %v", result["document"], want)
+	}
+	if want := []bson.M{{"name": "A"}, {"name": "kept"}}; !reflect.DeepEqual(result["documents"], want) {
+		t.Errorf("documents %v, want %v", result["documents"], want)
+	}
+}
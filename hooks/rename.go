@@ -0,0 +1,103 @@
+package hooks
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RenameFields returns a hook that exposes stored field names under different
+// names, e.g. to hide legacy field names from clients. fields maps the name
+// used by clients to the name stored in MongoDB. Top-level fields are renamed
+// in filters (including $and/$or/$nor clauses), inserted documents, update
+// operators and returned documents. Pipelines are passed through unchanged.
+func RenameFields(fields map[string]string) Hook {
+	reverse := make(map[string]string, len(fields))
+	for public, stored := range fields {
+		reverse[stored] = public
+	}
+	return &renamer{toStored: fields, toPublic: reverse}
+}
+
+type renamer struct {
+	toStored map[string]string
+	toPublic map[string]string
+}
+
+func (r *renamer) Request(_ *fiber.Ctx, req *Request) error {
+	if d, ok := req.Filter.(bson.D); ok {
+		req.Filter = r.filter(d)
+	}
+	for i, doc := range req.Documents {
+		if d, ok := doc.(bson.D); ok {
+			req.Documents[i] = renameD(d, r.toStored)
+		}
+	}
+	if d, ok := req.Update.(bson.D); ok {
+		update := make(bson.D, len(d))
+		for i, e := range d {
+			if fields, ok := e.Value.(bson.D); ok {
+				e.Value = renameD(fields, r.toStored)
+			}
+			update[i] = e
+		}
+		req.Update = update
+	}
+	return nil
+}
+
+func (r *renamer) filter(d bson.D) bson.D {
+	out := renameD(d, r.toStored)
+	for i, e := range out {
+		switch e.Key {
+		case "$and", "$or", "$nor":
+			if clauses, ok := e.Value.(bson.A); ok {
+				renamed := make(bson.A, len(clauses))
+				for j, clause := range clauses {
+					if sub, ok := clause.(bson.D); ok {
+						clause = r.filter(sub)
+					}
+					renamed[j] = clause
+				}
+				out[i].Value = renamed
+			}
+		}
+	}
+	return out
+}
+
+func (r *renamer) Result(_ *fiber.Ctx, _ *Request, result map[string]interface{}) error {
+	if doc, ok := result["document"].(bson.M); ok {
+		renameM(doc, r.toPublic)
+	}
+	if docs, ok := result["documents"].([]bson.M); ok {
+		for _, doc := range docs {
+			renameM(doc, r.toPublic)
+		}
+	}
+	return nil
+}
+
+func renameD(d bson.D, names map[string]string) bson.D {
+	out := make(bson.D, len(d))
+	for i, e := range d {
+		if name, ok := names[e.Key]; ok {
+			e.Key = name
+		}
+		out[i] = e
+	}
+	return out
+}
+
+func renameM(m bson.M, names map[string]string) {
+	moved := make(map[string]interface{})
+	for from, to := range names {
+		if v, ok := m[from]; ok {
+			delete(m, from)
+			moved[to] = v
+		}
+	}
+	for k, v := range moved {
+		m[k] = v
+	}
+}
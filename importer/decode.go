@@ -0,0 +1,167 @@
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Formats accepted by NewDecoder
+const (
+	FormatNDJSON = "ndjson"
+	FormatCSV    = "csv"
+)
+
+// maxLine bounds the size of a single NDJSON document
+const maxLine = 16 * 1024 * 1024
+
+// Decoder reads documents one at a time. Next returns io.EOF after the last
+// document and a *RecordError for a record that cannot be decoded, after
+// which decoding can continue; any other error is fatal.
+type Decoder interface {
+	Next() (bson.D, error)
+	// Line is the line number of the record last returned by Next
+	Line() int
+}
+
+// RecordError is an invalid record
+type RecordError struct {
+	Line int
+	Err  error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *RecordError) Unwrap() error { return e.Err }
+
+// DecodeOptions configure how records are turned into documents
+type DecodeOptions struct {
+	// IgnoreBlanks omits empty CSV fields instead of storing empty strings
+	IgnoreBlanks bool
+}
+
+// NewDecoder returns a decoder for format. NDJSON lines are Extended JSON
+// documents; CSV files start with a header row whose dotted names create
+// embedded documents, and numeric fields are stored as numbers.
+func NewDecoder(r io.Reader, format string, opts DecodeOptions) (Decoder, error) {
+	switch format {
+	case FormatNDJSON:
+		s := bufio.NewScanner(r)
+		s.Buffer(make([]byte, 64*1024), maxLine)
+		return &ndjsonDecoder{scanner: s}, nil
+	case FormatCSV:
+		cr := csv.NewReader(r)
+		cr.ReuseRecord = true
+		header, err := cr.Read()
+		if err == io.EOF {
+			return nil, fmt.Errorf("CSV input has no header row")
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &csvDecoder{reader: cr, header: append([]string(nil), header...), opts: opts}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q (expected %q or %q)", format, FormatNDJSON, FormatCSV)
+}
+
+type ndjsonDecoder struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func (d *ndjsonDecoder) Next() (bson.D, error) {
+	for d.scanner.Scan() {
+		d.line++
+		line := bytes.TrimSpace(d.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var doc bson.D
+		if err := bson.UnmarshalExtJSON(line, false, &doc); err != nil {
+			return nil, &RecordError{Line: d.line, Err: err}
+		}
+		return doc, nil
+	}
+	if err := d.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+func (d *ndjsonDecoder) Line() int { return d.line }
+
+type csvDecoder struct {
+	reader *csv.Reader
+	header []string
+	opts   DecodeOptions
+	line   int
+}
+
+func (d *csvDecoder) Next() (bson.D, error) {
+	record, err := d.reader.Read()
+	if pe, ok := err.(*csv.ParseError); ok {
+		d.line = pe.Line
+		return nil, &RecordError{Line: pe.Line, Err: pe.Err}
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.line, _ = d.reader.FieldPos(0)
+	doc := bson.D{}
+	for i, field := range record {
+		if i >= len(d.header) {
+			return nil, &RecordError{Line: d.line, Err: fmt.Errorf("record has %d fields, header has %d", len(record), len(d.header))}
+		}
+		if field == "" && d.opts.IgnoreBlanks {
+			continue
+		}
+		doc = set(doc, d.header[i], csvValue(field))
+	}
+	return doc, nil
+}
+
+func (d *csvDecoder) Line() int { return d.line }
+
+// csvValue converts numeric fields to int32, int64 or double like mongoimport
+func csvValue(field string) interface{} {
+	if n, err := strconv.ParseInt(field, 10, 64); err == nil {
+		if n >= math.MinInt32 && n <= math.MaxInt32 {
+			return int32(n)
+		}
+		return n
+	}
+	if f, err := strconv.ParseFloat(field, 64); err == nil && !strings.ContainsAny(field, "xXnN") {
+		return f
+	}
+	return field
+}
+
+// set sets a dotted path in doc, creating embedded documents as needed
+func set(doc bson.D, path string, value interface{}) bson.D {
+	key, rest, nested := strings.Cut(path, ".")
+	for i, e := range doc {
+		if e.Key != key {
+			continue
+		}
+		if !nested {
+			doc[i].Value = value
+			return doc
+		}
+		sub, _ := e.Value.(bson.D)
+		doc[i].Value = set(sub, rest, value)
+		return doc
+	}
+	if nested {
+		value = set(bson.D{}, rest, value)
+	}
+	return append(doc, bson.E{Key: key, Value: value})
+}
@@ -0,0 +1,274 @@
+// Package importer bulk loads NDJSON and CSV data into a collection in
+// batches, either inserting documents or upserting them by key fields.
+package importer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"mongo-data-api-go-alternative/db"
+	"mongo-data-api-go-alternative/tenant"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DefaultBatchSize is the number of documents written per batch unless
+// configured otherwise
+const DefaultBatchSize = 1000
+
+// maxErrors bounds the number of errors reported in a Progress
+const maxErrors = 100
+
+// Batch is a group of decoded documents that are written together
+type Batch struct {
+	Documents []interface{}
+	// Lines holds the source line of each document
+	Lines []int
+}
+
+// LineError is a record that could not be decoded or written
+type LineError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// Progress counts the records handled so far. Only the first 100 errors are
+// kept.
+type Progress struct {
+	Processed int64       `json:"processed"`
+	Inserted  int64       `json:"inserted"`
+	Upserted  int64       `json:"upserted"`
+	Modified  int64       `json:"modified"`
+	Failed    int64       `json:"failed"`
+	Errors    []LineError `json:"errors,omitempty"`
+}
+
+func (p *Progress) fail(line int, err error) {
+	p.Processed++
+	p.Failed++
+	if len(p.Errors) < maxErrors {
+		p.Errors = append(p.Errors, LineError{Line: line, Error: err.Error()})
+	}
+}
+
+// Read decodes every record of dec into batches of up to size documents.
+// Records that fail to decode are counted in the returned progress.
+func Read(dec Decoder, size int) ([]Batch, Progress, error) {
+	var batches []Batch
+	var progress Progress
+	for {
+		batch, err := NextBatch(dec, size, &progress)
+		if err != nil {
+			return nil, progress, err
+		}
+		if len(batch.Documents) == 0 {
+			return batches, progress, nil
+		}
+		batches = append(batches, batch)
+	}
+}
+
+// NextBatch decodes the next batch of up to size documents from dec, so
+// large inputs can be written while they are read. Records that fail to
+// decode are counted in progress. The batch is empty at the end of the
+// input.
+func NextBatch(dec Decoder, size int, progress *Progress) (Batch, error) {
+	if size <= 0 {
+		size = DefaultBatchSize
+	}
+	var batch Batch
+	for len(batch.Documents) < size {
+		doc, err := dec.Next()
+		if err == io.EOF {
+			break
+		}
+		var recErr *RecordError
+		if errors.As(err, &recErr) {
+			progress.fail(recErr.Line, recErr.Err)
+			continue
+		}
+		if err != nil {
+			return batch, err
+		}
+		batch.Documents = append(batch.Documents, doc)
+		batch.Lines = append(batch.Lines, dec.Line())
+	}
+	return batch, nil
+}
+
+// Writer writes batches to a collection. With UpsertKeys set each document
+// replaces the fields of the document with the same key values, or is
+// inserted when there is none; otherwise documents are inserted.
+type Writer struct {
+	Store      db.DataStore
+	Database   string
+	Collection string
+	UpsertKeys []string
+	// Scope restricts writes to a tenant (nil when tenancy is disabled)
+	Scope *tenant.Scope
+	// Convert, if set, converts the fields of each document to the types
+	// they are stored as before it is written
+	Convert func(bson.D) error
+}
+
+// Write writes a batch and adds the outcome to progress. Failing documents
+// are recorded and skipped; the error is only returned when the context is
+// done.
+func (w *Writer) Write(ctx context.Context, batch Batch, progress *Progress) error {
+	batch = w.convert(batch, progress)
+	if len(w.UpsertKeys) > 0 {
+		return w.upsert(ctx, batch, progress)
+	}
+
+	docs := make([]interface{}, len(batch.Documents))
+	for i, doc := range batch.Documents {
+		docs[i] = w.Scope.Document(doc)
+	}
+	// Inserts are ordered: on failure everything before the failing document
+	// was written, so continue after it
+	for start := 0; start < len(docs); {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		result, err := w.Store.InsertMany(ctx, w.Database, w.Collection, docs[start:])
+		if err == nil {
+			progress.Processed += int64(len(docs) - start)
+			progress.Inserted += int64(len(docs) - start)
+			return nil
+		}
+		failed := len(docs) - start
+		var bwe mongo.BulkWriteException
+		switch {
+		case errors.As(err, &bwe) && len(bwe.WriteErrors) > 0:
+			failed = bwe.WriteErrors[0].Index
+			err = errors.New(bwe.WriteErrors[0].Message)
+		case result != nil && len(result.InsertedIDs) < failed:
+			failed = len(result.InsertedIDs)
+		default:
+			// Unknown outcome, e.g. a network error: report the whole rest
+			for i := start; i < len(docs); i++ {
+				progress.fail(batch.Lines[i], err)
+			}
+			return nil
+		}
+		progress.Processed += int64(failed)
+		progress.Inserted += int64(failed)
+		progress.fail(batch.Lines[start+failed], err)
+		start += failed + 1
+	}
+	return nil
+}
+
+// convert returns the documents of batch that Convert accepts, recording
+// the others as failed
+func (w *Writer) convert(batch Batch, progress *Progress) Batch {
+	if w.Convert == nil {
+		return batch
+	}
+	var converted Batch
+	for i, document := range batch.Documents {
+		if doc, ok := document.(bson.D); ok {
+			if err := w.Convert(doc); err != nil {
+				progress.fail(batch.Lines[i], err)
+				continue
+			}
+		}
+		converted.Documents = append(converted.Documents, document)
+		converted.Lines = append(converted.Lines, batch.Lines[i])
+	}
+	return converted
+}
+
+func (w *Writer) upsert(ctx context.Context, batch Batch, progress *Progress) error {
+	opts := options.Update().SetUpsert(true)
+	for i, document := range batch.Documents {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		doc, _ := document.(bson.D)
+		filter, update, err := w.upsertArgs(doc)
+		if err != nil {
+			progress.fail(batch.Lines[i], err)
+			continue
+		}
+		result, err := w.Store.UpdateOne(ctx, w.Database, w.Collection, w.Scope.Filter(filter), update, opts)
+		if err != nil {
+			progress.fail(batch.Lines[i], err)
+			continue
+		}
+		progress.Processed++
+		if result.UpsertedCount > 0 {
+			progress.Upserted++
+		} else {
+			progress.Modified += result.ModifiedCount
+		}
+	}
+	return nil
+}
+
+// upsertArgs builds the filter matching the key fields of doc and an update
+// setting all of its other fields. A given _id is only used on insert.
+func (w *Writer) upsertArgs(doc bson.D) (bson.D, bson.D, error) {
+	filter := bson.D{}
+	for _, key := range w.UpsertKeys {
+		value, ok := lookup(doc, key)
+		if !ok {
+			return nil, nil, fmt.Errorf("missing upsert key %q", key)
+		}
+		filter = append(filter, bson.E{Key: key, Value: value})
+	}
+
+	set := bson.D{}
+	var id interface{}
+	for _, e := range doc {
+		if e.Key == "_id" {
+			id = e.Value
+			continue
+		}
+		set = append(set, e)
+	}
+	if len(set) == 0 {
+		// Nothing but the key: only create the document if it is missing
+		return filter, bson.D{{Key: "$setOnInsert", Value: w.Scope.Document(doc)}}, nil
+	}
+	if scoped, ok := w.Scope.Document(set).(bson.D); ok {
+		set = scoped
+	}
+	update := bson.D{{Key: "$set", Value: set}}
+	if id != nil && !w.isKey("_id") {
+		update = append(update, bson.E{Key: "$setOnInsert", Value: bson.D{{Key: "_id", Value: id}}})
+	}
+	return filter, update, nil
+}
+
+func (w *Writer) isKey(field string) bool {
+	for _, key := range w.UpsertKeys {
+		if key == field {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the value at a dotted path in doc
+func lookup(doc bson.D, path string) (interface{}, bool) {
+	key, rest, nested := strings.Cut(path, ".")
+	for _, e := range doc {
+		if e.Key != key {
+			continue
+		}
+		if !nested {
+			return e.Value, true
+		}
+		if sub, ok := e.Value.(bson.D); ok {
+			return lookup(sub, rest)
+		}
+		return nil, false
+	}
+	return nil, false
+}
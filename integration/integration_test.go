@@ -0,0 +1,382 @@
+//go:build integration
+
+// Package integration runs the full HTTP stack against a real MongoDB. By
+// default a MongoDB container is started with testcontainers (Docker is
+// required); set TEST_MONGO_URI to use an existing server instead.
+//
+//	go test -tags integration ./integration/
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"mongo-data-api-go-alternative/config"
+	"mongo-data-api-go-alternative/db"
+	"mongo-data-api-go-alternative/server"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/modules/mongodb"
+)
+
+const (
+	apiKey   = "integration_key"
+	adminKey = "integration_admin"
+)
+
+var (
+	app *fiber.App
+	// database is unique per run so runs against a shared server do not
+	// interfere
+	database = fmt.Sprintf("it_%d", time.Now().UnixNano())
+	systemDB = database + "_system"
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(run(m))
+}
+
+func run(m *testing.M) int {
+	ctx := context.Background()
+	uri := os.Getenv("TEST_MONGO_URI")
+	if uri == "" {
+		container, err := mongodb.Run(ctx, "mongo:7")
+		if err != nil {
+			log.Printf("starting MongoDB container: %v", err)
+			return 1
+		}
+		defer testcontainers.TerminateContainer(container)
+		if uri, err = container.ConnectionString(ctx); err != nil {
+			log.Printf("MongoDB connection string: %v", err)
+			return 1
+		}
+	}
+
+	cfg := &config.Config{
+		MongoURI:       uri,
+		APIKeys:        []config.APIKey{{Name: "integration", Key: apiKey}},
+		AdminKey:       adminKey,
+		SystemDatabase: systemDB,
+		SavedQueries: []config.SavedQuery{{
+			Name: "itemsByColor", Operation: "find", Database: database, Collection: "items",
+			Parameters: []config.Parameter{{Name: "color", Type: "string", Required: true}},
+			Filter:     map[string]interface{}{"color": map[string]interface{}{"$param": "color"}},
+			Sort:       map[string]interface{}{"n": 1},
+		}},
+		Endpoints: []config.Endpoint{{Name: "count", Method: "GET", Path: "/count/:db", Script: "testdata/count.star"}},
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Printf("config: %v", err)
+		return 1
+	}
+	var err error
+	if app, err = server.New(cfg); err != nil {
+		log.Printf("server: %v", err)
+		return 1
+	}
+	defer func() {
+		db.Client().Database(database).Drop(ctx)
+		db.Client().Database(systemDB).Drop(ctx)
+		db.Close()
+	}()
+	return m.Run()
+}
+
+type response struct {
+	status int
+	raw    []byte
+	body   map[string]interface{}
+}
+
+// request sends a request with the given headers (defaulting to the API key)
+func request(t *testing.T, method, path, body string, headers ...string) response {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if len(headers) == 0 {
+		headers = []string{"apiKey", apiKey}
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	res, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := response{status: res.StatusCode}
+	r.raw, _ = io.ReadAll(res.Body)
+	json.Unmarshal(r.raw, &r.body)
+	return r
+}
+
+// post runs a data operation on collection with the fields in body (a JSON
+// object without braces)
+func post(t *testing.T, op, collection, fields string) response {
+	t.Helper()
+	body := fmt.Sprintf(`{"database":%q,"collection":%q`, database, collection)
+	if fields != "" {
+		body += "," + fields
+	}
+	return request(t, "POST", "/api/"+op, body+"}")
+}
+
+func expectStatus(t *testing.T, r response, status int) {
+	t.Helper()
+	if r.status != status {
+		t.Fatalf("status %d, want %d: %s", r.status, status, r.raw)
+	}
+}
+
+func expectJSON(t *testing.T, got interface{}, want string) {
+	t.Helper()
+	var w interface{}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := json.Marshal(got)
+	var g interface{}
+	json.Unmarshal(raw, &g)
+	if !reflect.DeepEqual(g, w) {
+		t.Errorf("got %s, want %s", raw, want)
+	}
+}
+
+func TestHealthAndMetrics(t *testing.T) {
+	r := request(t, "GET", "/api/health", "", "apiKey", "")
+	expectStatus(t, r, fiber.StatusOK)
+	expectJSON(t, r.body, `{"status":"ok"}`)
+
+	r = request(t, "GET", "/metrics", "", "apiKey", "")
+	expectStatus(t, r, fiber.StatusOK)
+	if !strings.Contains(string(r.raw), "mongodataapi_http_requests_total") {
+		t.Error("metrics do not contain the request counter")
+	}
+}
+
+func TestCRUD(t *testing.T) {
+	coll := "crud"
+
+	r := post(t, "insertOne", coll, `"document":{"_id":1,"name":"Ada","visits":0}`)
+	expectStatus(t, r, fiber.StatusOK)
+	expectJSON(t, r.body, `{"insertedId":1}`)
+
+	r = post(t, "insertMany", coll, `"documents":[{"_id":2,"name":"Grace","visits":0},{"_id":3,"name":"Linus","visits":5}]`)
+	expectStatus(t, r, fiber.StatusOK)
+	expectJSON(t, r.body, `{"insertedIds":[2,3]}`)
+
+	r = post(t, "findOne", coll, `"filter":{"name":"Grace"},"projection":{"_id":0,"name":1}`)
+	expectStatus(t, r, fiber.StatusOK)
+	expectJSON(t, r.body, `{"document":{"name":"Grace"}}`)
+
+	r = post(t, "findOne", coll, `"filter":{"name":"Nobody"}`)
+	expectStatus(t, r, fiber.StatusOK)
+	expectJSON(t, r.body, `{"document":null}`)
+
+	r = post(t, "find", coll, `"filter":{"visits":{"$gte":0}},"sort":{"_id":-1},"skip":1,"limit":1,"projection":{"name":1}`)
+	expectStatus(t, r, fiber.StatusOK)
+	expectJSON(t, r.body, `{"documents":[{"_id":2,"name":"Grace"}]}`)
+
+	r = post(t, "updateOne", coll, `"filter":{"_id":1},"update":{"$inc":{"visits":1}}`)
+	expectStatus(t, r, fiber.StatusOK)
+	expectJSON(t, r.body, `{"matchedCount":1,"modifiedCount":1,"upsertedCount":0,"upsertedId":null}`)
+
+	r = post(t, "updateOne", coll, `"filter":{"_id":4},"update":{"$set":{"name":"Barbara"}},"upsert":true`)
+	expectStatus(t, r, fiber.StatusOK)
+	expectJSON(t, r.body, `{"matchedCount":0,"modifiedCount":0,"upsertedCount":1,"upsertedId":4}`)
+
+	r = post(t, "updateMany", coll, `"filter":{"visits":{"$lt":5}},"update":{"$set":{"active":true}}`)
+	expectStatus(t, r, fiber.StatusOK)
+	expectJSON(t, r.body, `{"matchedCount":2,"modifiedCount":2}`)
+
+	r = post(t, "aggregate", coll, `"pipeline":[{"$group":{"_id":null,"visits":{"$sum":"$visits"}}}]`)
+	expectStatus(t, r, fiber.StatusOK)
+	expectJSON(t, r.body, `{"documents":[{"_id":null,"visits":6}]}`)
+
+	r = post(t, "deleteOne", coll, `"filter":{"_id":4}`)
+	expectStatus(t, r, fiber.StatusOK)
+	expectJSON(t, r.body, `{"deletedCount":1}`)
+
+	r = post(t, "deleteMany", coll, `"filter":{}`)
+	expectStatus(t, r, fiber.StatusOK)
+	expectJSON(t, r.body, `{"deletedCount":3}`)
+}
+
+func TestEJSONRoundTrip(t *testing.T) {
+	coll := "ejson"
+	doc := `{
+		"_id": {"$oid": "65a1b2c3d4e5f60718293a4b"},
+		"created": {"$date": "2024-01-02T03:04:05.678Z"},
+		"price": {"$numberDecimal": "19.99"},
+		"blob": {"$binary": {"base64": "AQID", "subType": "00"}},
+		"uuid": {"$binary": {"base64": "9bsKtrRPRqSOsRAbOm8SXA==", "subType": "04"}},
+		"count": {"$numberLong": "42"},
+		"ratio": {"$numberDouble": "0.5"},
+		"nested": [{"at": {"$date": "1969-07-20T20:17:40Z"}}]
+	}`
+	r := post(t, "insertOne", coll, `"document":`+doc)
+	expectStatus(t, r, fiber.StatusOK)
+	expectJSON(t, r.body, `{"insertedId":{"$oid":"65a1b2c3d4e5f60718293a4b"}}`)
+
+	r = post(t, "findOne", coll, `"filter":{"_id":{"$oid":"65a1b2c3d4e5f60718293a4b"}}`)
+	expectStatus(t, r, fiber.StatusOK)
+	expectJSON(t, r.body, `{"document":{
+		"_id": {"$oid": "65a1b2c3d4e5f60718293a4b"},
+		"created": {"$date": "2024-01-02T03:04:05.678Z"},
+		"price": {"$numberDecimal": "19.99"},
+		"blob": {"$binary": {"base64": "AQID", "subType": "00"}},
+		"uuid": {"$binary": {"base64": "9bsKtrRPRqSOsRAbOm8SXA==", "subType": "04"}},
+		"count": 42,
+		"ratio": 0.5,
+		"nested": [{"at": {"$date": {"$numberLong": "-14182940000"}}}]
+	}}`)
+
+	// Typed values must match typed filters
+	for filter, want := range map[string]int{
+		`{"created":{"$gte":{"$date":"2024-01-01T00:00:00Z"}}}`:                     1,
+		`{"created":{"$lt":{"$date":"2024-01-01T00:00:00Z"}}}`:                      0,
+		`{"price":{"$gt":{"$numberDecimal":"10"}}}`:                                 1,
+		`{"blob":{"$binary":{"base64":"AQID","subType":"00"}}}`:                     1,
+		`{"_id":"65a1b2c3d4e5f60718293a4b"}`:                                        0,
+		`{"uuid":{"$binary":{"base64":"9bsKtrRPRqSOsRAbOm8SXA==","subType":"04"}}}`: 1,
+	} {
+		r := post(t, "find", coll, `"filter":`+filter)
+		expectStatus(t, r, fiber.StatusOK)
+		if docs, _ := r.body["documents"].([]interface{}); len(docs) != want {
+			t.Errorf("filter %s matched %d documents, want %d", filter, len(docs), want)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	coll := "errors"
+	post(t, "insertOne", coll, `"document":{"_id":1}`)
+
+	cases := []struct {
+		name   string
+		r      func() response
+		status int
+	}{
+		{"missing API key", func() response { return request(t, "POST", "/api/find", `{}`, "apiKey", "") }, fiber.StatusForbidden},
+		{"invalid API key", func() response { return request(t, "POST", "/api/find", `{}`, "apiKey", "wrong") }, fiber.StatusForbidden},
+		{"malformed body", func() response { return request(t, "POST", "/api/find", `{"database":`) }, fiber.StatusBadRequest},
+		{"invalid ObjectId", func() response { return post(t, "find", coll, `"filter":{"_id":{"$oid":"xyz"}}`) }, fiber.StatusBadRequest},
+		{"invalid date", func() response { return post(t, "insertOne", coll, `"document":{"d":{"$date":"tomorrow"}}`) }, fiber.StatusBadRequest},
+		{"duplicate key", func() response { return post(t, "insertOne", coll, `"document":{"_id":1}`) }, fiber.StatusInternalServerError},
+		{"update without operators", func() response { return post(t, "updateOne", coll, `"filter":{},"update":{"a":1}`) }, fiber.StatusInternalServerError},
+		{"unknown query operator", func() response { return post(t, "find", coll, `"filter":{"a":{"$bogus":1}}`) }, fiber.StatusInternalServerError},
+		{"unknown stage", func() response { return post(t, "aggregate", coll, `"pipeline":[{"$bogus":{}}]`) }, fiber.StatusInternalServerError},
+		{"system database", func() response {
+			return request(t, "POST", "/api/find", fmt.Sprintf(`{"database":%q,"collection":"apiKeys","filter":{}}`, systemDB))
+		}, fiber.StatusForbidden},
+		{"admin without key", func() response { return request(t, "GET", "/api/admin/keys", "", "adminKey", "") }, fiber.StatusForbidden},
+		{"unknown route", func() response { return request(t, "GET", "/api/nothing", "") }, fiber.StatusNotFound},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			expectStatus(t, tc.r(), tc.status)
+		})
+	}
+}
+
+func TestValidateQuery(t *testing.T) {
+	r := request(t, "POST", "/api/validateQuery", `{"filter":{"name":{"$regex":"ada"}},"pipeline":[{"$sort":{"a":1}}]}`)
+	expectStatus(t, r, fiber.StatusOK)
+	if r.body["valid"] != true {
+		t.Errorf("expected a valid query: %s", r.raw)
+	}
+	r = request(t, "POST", "/api/validateQuery", `{"update":{"name":"x"}}`)
+	expectStatus(t, r, fiber.StatusOK)
+	if r.body["valid"] != false {
+		t.Errorf("expected an invalid update: %s", r.raw)
+	}
+}
+
+func TestSavedQueries(t *testing.T) {
+	post(t, "insertMany", "items", `"documents":[{"n":1,"color":"red"},{"n":2,"color":"blue"},{"n":3,"color":"red"}]`)
+
+	r := request(t, "GET", "/api/run", "")
+	expectStatus(t, r, fiber.StatusOK)
+	if queries, _ := r.body["queries"].([]interface{}); len(queries) != 1 {
+		t.Errorf("listed %s", r.raw)
+	}
+
+	r = request(t, "POST", "/api/run/itemsByColor", `{"color":"red"}`)
+	expectStatus(t, r, fiber.StatusOK)
+	docs, _ := r.body["documents"].([]interface{})
+	if len(docs) != 2 {
+		t.Fatalf("got %s", r.raw)
+	}
+
+	expectStatus(t, request(t, "POST", "/api/run/itemsByColor", `{}`), fiber.StatusBadRequest)
+	expectStatus(t, request(t, "POST", "/api/run/itemsByColor", `{"color":{"$ne":null}}`), fiber.StatusBadRequest)
+	expectStatus(t, request(t, "POST", "/api/run/missing", `{}`), fiber.StatusNotFound)
+}
+
+func TestCustomEndpoint(t *testing.T) {
+	post(t, "insertMany", "scripted", `"documents":[{"a":1},{"a":2}]`)
+
+	r := request(t, "GET", "/api/custom/count/"+database+"?collection=scripted", "")
+	expectStatus(t, r, fiber.StatusOK)
+	expectJSON(t, r.body, `{"count":2}`)
+
+	// Scripts are subject to the same restrictions as the data endpoints
+	r = request(t, "GET", "/api/custom/count/"+systemDB+"?collection=apiKeys", "")
+	expectStatus(t, r, fiber.StatusForbidden)
+}
+
+func TestAdminAPI(t *testing.T) {
+	admin := []string{"adminKey", adminKey}
+
+	r := request(t, "POST", "/api/admin/keys", `{"name":"reader","roles":["read"]}`, admin...)
+	expectStatus(t, r, fiber.StatusCreated)
+	created, _ := r.body["key"].(map[string]interface{})
+	secret, _ := created["key"].(string)
+	if secret == "" {
+		t.Fatalf("no key returned: %s", r.raw)
+	}
+
+	// The new key can read but not write
+	read := fmt.Sprintf(`{"database":%q,"collection":"admin","filter":{}}`, database)
+	expectStatus(t, request(t, "POST", "/api/find", read, "apiKey", secret), fiber.StatusOK)
+	write := fmt.Sprintf(`{"database":%q,"collection":"admin","document":{}}`, database)
+	expectStatus(t, request(t, "POST", "/api/insertOne", write, "apiKey", secret), fiber.StatusForbidden)
+
+	r = request(t, "GET", "/api/admin/keys/reader", "", admin...)
+	expectStatus(t, r, fiber.StatusOK)
+	if strings.Contains(string(r.raw), secret) {
+		t.Error("key secret is not masked")
+	}
+
+	r = request(t, "PATCH", "/api/admin/keys/reader", `{"roles":["readWrite"]}`, admin...)
+	expectStatus(t, r, fiber.StatusOK)
+	expectStatus(t, request(t, "POST", "/api/insertOne", write, "apiKey", secret), fiber.StatusOK)
+
+	expectStatus(t, request(t, "PUT", "/api/admin/roles/writer", `{"operations":["insertOne"]}`, admin...), fiber.StatusOK)
+	expectStatus(t, request(t, "GET", "/api/admin/roles", "", admin...), fiber.StatusOK)
+	expectStatus(t, request(t, "DELETE", "/api/admin/roles/writer", "", admin...), fiber.StatusOK)
+
+	expectStatus(t, request(t, "DELETE", "/api/admin/keys/reader", "", admin...), fiber.StatusOK)
+	expectStatus(t, request(t, "POST", "/api/find", read, "apiKey", secret), fiber.StatusForbidden)
+	expectStatus(t, request(t, "DELETE", "/api/admin/keys/integration", "", admin...), fiber.StatusConflict)
+
+	r = request(t, "GET", "/api/admin/databases", "", admin...)
+	expectStatus(t, r, fiber.StatusOK)
+	if !strings.Contains(string(r.raw), database) {
+		t.Errorf("database %s not listed: %s", database, r.raw)
+	}
+	r = request(t, "GET", "/api/admin/databases/"+database+"/collections", "", admin...)
+	expectStatus(t, r, fiber.StatusOK)
+	if !strings.Contains(string(r.raw), `"admin"`) {
+		t.Errorf("collection not listed: %s", r.raw)
+	}
+}
@@ -0,0 +1,319 @@
+// Package jobs runs long operations in the background and tracks their
+// progress so clients can poll for the outcome.
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Job states
+const (
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+const (
+	// heartbeat is how often running jobs are saved even without progress
+	heartbeat = 30 * time.Second
+	// staleAfter is how long a persisted job may go without an update
+	// before it is reported as interrupted
+	staleAfter = 2 * time.Minute
+)
+
+// ErrNotFound is returned for unknown job ids
+var ErrNotFound = errors.New("job not found")
+
+// Job is a snapshot of a background operation
+type Job struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	// Owner is the name of the API key that started the job
+	Owner    string      `json:"-"`
+	Status   string      `json:"status"`
+	Progress interface{} `json:"progress,omitempty"`
+	Result   interface{} `json:"result,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Created  time.Time   `json:"created"`
+	Updated  time.Time   `json:"updated"`
+}
+
+// record is a job as stored in the jobs collection. Progress and result are
+// stored as their JSON rendering so they read back the same.
+type record struct {
+	ID       string    `bson:"_id"`
+	Kind     string    `bson:"kind"`
+	Owner    string    `bson:"owner"`
+	Status   string    `bson:"status"`
+	Progress bson.Raw  `bson:"progress,omitempty"`
+	Result   bson.Raw  `bson:"result,omitempty"`
+	Error    string    `bson:"error,omitempty"`
+	Created  time.Time `bson:"created"`
+	Updated  time.Time `bson:"updated"`
+}
+
+// Func performs a job. It reports progress through report and returns the
+// job's result, which must render as a JSON object.
+type Func func(ctx context.Context, id string, report func(progress interface{})) (interface{}, error)
+
+// Manager runs jobs and keeps their state in memory and, once attached, in a
+// collection shared by all instances
+type Manager struct {
+	mu   sync.RWMutex
+	jobs map[string]*Job
+	dir  string
+	coll *mongo.Collection
+}
+
+// NewManager returns an empty manager that keeps result files in dir
+func NewManager(dir string) *Manager {
+	return &Manager{jobs: make(map[string]*Job), dir: dir}
+}
+
+// Attach persists jobs in coll, so their state survives restarts. Jobs
+// that were running when their server stopped are reported as failed.
+func (m *Manager) Attach(coll *mongo.Collection) {
+	m.coll = coll
+}
+
+// Start runs fn in the background and returns the new job
+func (m *Manager) Start(kind, owner string, fn Func) Job {
+	now := time.Now().UTC()
+	job := &Job{
+		ID:      primitive.NewObjectID().Hex(),
+		Kind:    kind,
+		Owner:   owner,
+		Status:  StatusRunning,
+		Created: now,
+		Updated: now,
+	}
+	m.mu.Lock()
+	m.jobs[job.ID] = job
+	snapshot := *job
+	m.mu.Unlock()
+	m.save(snapshot)
+
+	go func() {
+		done := make(chan struct{})
+		go func() {
+			ticker := time.NewTicker(heartbeat)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					m.update(job.ID, func(*Job) {})
+				case <-done:
+					return
+				}
+			}
+		}()
+
+		result, err := fn(context.Background(), job.ID, func(progress interface{}) {
+			m.update(job.ID, func(j *Job) { j.Progress = progress })
+		})
+		close(done)
+		m.update(job.ID, func(j *Job) {
+			if err != nil {
+				j.Status, j.Error = StatusFailed, err.Error()
+			} else {
+				j.Status, j.Result = StatusSucceeded, result
+			}
+		})
+	}()
+	return snapshot
+}
+
+func (m *Manager) update(id string, fn func(*Job)) {
+	m.mu.Lock()
+	j, ok := m.jobs[id]
+	if !ok {
+		m.mu.Unlock()
+		return
+	}
+	fn(j)
+	j.Updated = time.Now().UTC()
+	snapshot := *j
+	m.mu.Unlock()
+	m.save(snapshot)
+}
+
+// save writes a job to the jobs collection, if attached
+func (m *Manager) save(j Job) {
+	if m.coll == nil {
+		return
+	}
+	r := record{ID: j.ID, Kind: j.Kind, Owner: j.Owner, Status: j.Status, Error: j.Error, Created: j.Created, Updated: j.Updated}
+	var err error
+	if r.Progress, err = toRaw(j.Progress); err == nil {
+		r.Result, err = toRaw(j.Result)
+	}
+	if err != nil {
+		log.Printf("Failed to save job %s: %v", j.ID, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = m.coll.ReplaceOne(ctx, bson.D{{Key: "_id", Value: j.ID}}, r, options.Replace().SetUpsert(true))
+	if err != nil {
+		log.Printf("Failed to save job %s: %v", j.ID, err)
+	}
+}
+
+// Get returns a snapshot of a job started by this or, once attached, any
+// instance
+func (m *Manager) Get(ctx context.Context, id string) (Job, error) {
+	m.mu.RLock()
+	j, ok := m.jobs[id]
+	var snapshot Job
+	if ok {
+		snapshot = *j
+	}
+	m.mu.RUnlock()
+	if ok {
+		return snapshot, nil
+	}
+	if m.coll == nil {
+		return Job{}, ErrNotFound
+	}
+
+	var r record
+	err := m.coll.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&r)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Job{}, ErrNotFound
+	}
+	if err != nil {
+		return Job{}, err
+	}
+	job := Job{ID: r.ID, Kind: r.Kind, Owner: r.Owner, Status: r.Status, Error: r.Error, Created: r.Created, Updated: r.Updated}
+	if job.Progress, err = fromRaw(r.Progress); err != nil {
+		return Job{}, err
+	}
+	if job.Result, err = fromRaw(r.Result); err != nil {
+		return Job{}, err
+	}
+	if job.Status == StatusRunning && time.Since(job.Updated) > staleAfter {
+		job.Status, job.Error = StatusFailed, "interrupted: the server running the job stopped"
+	}
+	return job, nil
+}
+
+// StartExpiry periodically expires the jobs that finished longer than
+// retention ago
+func (m *Manager) StartExpiry(retention time.Duration) {
+	interval := min(retention/4, time.Hour)
+	go func() {
+		for range time.Tick(interval) {
+			m.Expire(retention)
+		}
+	}()
+}
+
+// Expire forgets the jobs that finished longer than retention ago and
+// removes their result files, including those left by earlier runs of the
+// server. Persisted jobs of every instance are deleted once they have gone
+// that long without an update, which running jobs never do.
+func (m *Manager) Expire(retention time.Duration) {
+	cutoff := time.Now().UTC().Add(-retention)
+	running := make(map[string]bool)
+	m.mu.Lock()
+	for id, j := range m.jobs {
+		switch {
+		case j.Status == StatusRunning:
+			running[id] = true
+		case j.Updated.Before(cutoff):
+			delete(m.jobs, id)
+		}
+	}
+	m.mu.Unlock()
+
+	entries, err := os.ReadDir(m.dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Failed to expire job files: %v", err)
+	}
+	for _, e := range entries {
+		id, _, _ := strings.Cut(e.Name(), ".")
+		info, err := e.Info()
+		if err != nil || e.IsDir() || running[id] || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(m.dir, e.Name())); err != nil {
+			log.Printf("Failed to remove the result file of job %s: %v", id, err)
+		}
+	}
+
+	if m.coll == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := m.coll.DeleteMany(ctx, bson.D{{Key: "updated", Value: bson.D{{Key: "$lt", Value: cutoff}}}}); err != nil {
+		log.Printf("Failed to expire jobs: %v", err)
+	}
+}
+
+// CreateFile creates the result file of a job. ext is the file name
+// extension, e.g. "ndjson".
+func (m *Manager) CreateFile(id, ext string) (*os.File, error) {
+	if err := os.MkdirAll(m.dir, 0o755); err != nil {
+		return nil, err
+	}
+	return os.Create(filepath.Join(m.dir, id+"."+ext))
+}
+
+// File returns the path of the result file of a job
+func (m *Manager) File(id string) (string, error) {
+	if _, err := primitive.ObjectIDFromHex(id); err != nil {
+		return "", ErrNotFound
+	}
+	matches, err := filepath.Glob(filepath.Join(m.dir, id+".*"))
+	if err != nil {
+		return "", err
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("result file of job %s not found on this server", id)
+	}
+	return matches[0], nil
+}
+
+// toRaw converts a progress or result value to BSON through its JSON
+// rendering
+func toRaw(v interface{}) (bson.Raw, error) {
+	if v == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var raw bson.Raw
+	if err := bson.UnmarshalExtJSON(data, false, &raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// fromRaw converts a stored progress or result value back to JSON
+func fromRaw(raw bson.Raw) (interface{}, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	data, err := bson.MarshalExtJSON(raw, false, false)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(data), nil
+}
@@ -0,0 +1,97 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// wait returns a job once it is no longer running
+func wait(t *testing.T, m *Manager, id string) Job {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		j, err := m.Get(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if j.Status != StatusRunning {
+			return j
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("job %s still running", id)
+	return Job{}
+}
+
+func TestExpire(t *testing.T) {
+	m := NewManager(t.TempDir())
+	export := func(ctx context.Context, id string, _ func(interface{})) (interface{}, error) {
+		f, err := m.CreateFile(id, "ndjson")
+		if err != nil {
+			return nil, err
+		}
+		return map[string]int{"documents": 0}, f.Close()
+	}
+	old, recent := m.Start("export", "test", export), m.Start("export", "test", export)
+	wait(t, m, old.ID)
+	wait(t, m, recent.ID)
+	release := make(chan struct{})
+	running := m.Start("export", "test", func(ctx context.Context, id string, report func(interface{})) (interface{}, error) {
+		if _, err := export(ctx, id, report); err != nil {
+			return nil, err
+		}
+		<-release
+		return nil, nil
+	})
+	defer close(release)
+
+	// The old job and the running one's file were last touched two hours ago
+	twoHoursAgo := time.Now().Add(-2 * time.Hour)
+	for i := 0; i < 200; i++ {
+		if _, err := m.File(running.ID); err == nil {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	for _, id := range []string{old.ID, running.ID} {
+		path, err := m.File(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, twoHoursAgo, twoHoursAgo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.mu.Lock()
+	m.jobs[old.ID].Updated = twoHoursAgo
+	m.mu.Unlock()
+	// A file left by an earlier run of the server
+	leftover, err := m.CreateFile("65a1b2c3d4e5f60718293a4b", "csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leftover.Close()
+	if err := os.Chtimes(leftover.Name(), twoHoursAgo, twoHoursAgo); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Expire(time.Hour)
+	if _, err := m.Get(context.Background(), old.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expired job: %v, want ErrNotFound", err)
+	}
+	for _, id := range []string{old.ID, "65a1b2c3d4e5f60718293a4b"} {
+		if _, err := m.File(id); err == nil {
+			t.Errorf("result file of %s kept", id)
+		}
+	}
+	for _, id := range []string{recent.ID, running.ID} {
+		if _, err := m.Get(context.Background(), id); err != nil {
+			t.Errorf("job %s: %v", id, err)
+		}
+		if _, err := m.File(id); err != nil {
+			t.Errorf("result file of %s: %v", id, err)
+		}
+	}
+}
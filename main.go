@@ -1,77 +1,169 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"strings"
 	"time"
 
+	"mongo-data-api-go-alternative/config"
 	"mongo-data-api-go-alternative/db"
-	"mongo-data-api-go-alternative/handlers"
+	"mongo-data-api-go-alternative/server"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/ansrivas/fiberprometheus/v2"
+	"golang.org/x/net/netutil"
 )
 
-func main() {
-	// Connect to MongoDB
-	if err := db.Connect(); err != nil {
-		log.Fatal("Error connecting to MongoDB:", err)
-	}
-	defer db.Close()
+// command is a CLI subcommand; run receives the arguments after its name
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
 
-	// Create Fiber app
-	app := fiber.New(fiber.Config{
-		ReadTimeout:  time.Second * 10,
-		WriteTimeout: time.Second * 10,
-	})
+var commands = []command{
+	{"serve", "start the API server (default)", serve},
+	{"check-config", "validate the configuration, saved queries and endpoint scripts", checkConfig},
+	{"ping", "check that MongoDB is reachable", ping},
+	{"keys", "create, revoke, list or hash API keys (keys create|revoke|list|hash)", keys},
+	{"routes", "list the routes served by the API", routes},
+	{"import", "load a NDJSON or CSV file through /api/import of a running server", importData},
+	{"seed", "load seed documents into empty collections", seedData},
+}
 
-	// Add monitor middleware for metrics
-	prometheus := fiberprometheus.NewWith("mongo-data-api","mongodataapi","http")
-	prometheus.RegisterAt(app, "/metrics")
-	prometheus.SetSkipPaths([]string{"/api/health", "/metrics"})
-	app.Use(prometheus.Middleware)
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the flags of a command.\n", os.Args[0])
+}
 
-	// API Key Authentication Middleware
-	app.Use(func(c *fiber.Ctx) error {
-		// Skip API key check for health and metrics endpoints
-		if c.Path() == "/api/health" || c.Path() == "/metrics" {
-			return c.Next()
+func main() {
+	// Without a command (or with only flags) the server is started, as
+	// before subcommands existed
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		usage()
+		return
+	}
+
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		err := cmd.run(args)
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(2)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
 		}
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+	usage()
+	os.Exit(2)
+}
 
-		apiKey := c.Get("apiKey")
+// serve starts the API server
+func serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	mock := fs.Bool("mock", false, "serve an in-memory data store instead of MongoDB")
+	mockData := fs.String("mock-data", "", "JSON file with seed documents for --mock, keyed by database.collection")
+	record := fs.String("record", "", "record requests and responses of the data endpoints as fixtures in this directory")
+	replay := fs.String("replay", "", "serve the data endpoints from fixtures recorded in this directory")
+	check := fs.Bool("check", false, "check the configuration, clusters, namespaces and indexes, print a report and exit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
 
-		if apiKey != os.Getenv("API_KEY") {
-			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-				"message": "Forbidden: Invalid API Key ",
-			})
-		}
+	// Load configuration
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("loading configuration: %w", err)
+	}
+	if *mock {
+		cfg.Mock = true
+	}
+	if *mockData != "" {
+		cfg.MockData = *mockData
+	}
+	if *record != "" {
+		cfg.RecordDir = *record
+	}
+	if *replay != "" {
+		cfg.ReplayDir = *replay
+	}
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("loading configuration: %w", err)
+	}
+	if *check {
+		return selfCheck(cfg)
+	}
+	defer db.Close()
 
-		return c.Next()
-	})
+	// With an admin port the operational endpoints get their own listener
+	var app, internal *fiber.App
+	if cfg.AdminPort != "" {
+		app, internal, err = server.NewSplit(cfg)
+	} else {
+		app, err = server.New(cfg)
+	}
+	if err != nil {
+		return fmt.Errorf("starting server: %w", err)
+	}
+	if internal != nil {
+		go func() {
+			log.Fatal(internal.Listen(":" + cfg.AdminPort))
+		}()
+	}
 
-	// API Routes
-	api := app.Group("/api")
-	{
-		api.Get("/health", func(c *fiber.Ctx) error {
-			return c.JSON(fiber.Map{"status": "ok"})
-		})
+	tlsConfig, err := server.TLSConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("starting server: %w", err)
+	}
 
-		// MongoDB operations
-		api.Post("/insertOne", handlers.InsertOne)
-		api.Post("/insertMany", handlers.InsertMany)
-		api.Post("/findOne", handlers.FindOne)
-		api.Post("/find", handlers.Find)
-		api.Post("/updateOne", handlers.UpdateOne)
-		api.Post("/updateMany", handlers.UpdateMany)
-		api.Post("/deleteOne", handlers.DeleteOne)
-		api.Post("/deleteMany", handlers.DeleteMany)
-		api.Post("/aggregate", handlers.Aggregate)
+	if cfg.Engine == config.EngineNetHTTP {
+		srv := &http.Server{
+			Handler:      server.Handler(app, cfg),
+			ReadTimeout:  time.Duration(cfg.ReadTimeoutSeconds) * time.Second,
+			WriteTimeout: time.Duration(cfg.WriteTimeoutSeconds) * time.Second,
+			IdleTimeout:  time.Duration(cfg.IdleTimeoutSeconds) * time.Second,
+		}
+		ln, err := net.Listen("tcp", ":"+cfg.Port)
+		if err != nil {
+			return fmt.Errorf("starting server: %w", err)
+		}
+		if cfg.MaxConnections > 0 {
+			ln = netutil.LimitListener(ln, cfg.MaxConnections)
+		}
+		if tlsConfig != nil {
+			// ServeTLS negotiates HTTP/2 with clients that support it
+			srv.TLSConfig = tlsConfig
+			log.Fatal(srv.ServeTLS(ln, "", ""))
+		}
+		log.Fatal(srv.Serve(ln))
 	}
 
 	// Start server
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "3000"
+	if tlsConfig != nil {
+		ln, err := tls.Listen("tcp", ":"+cfg.Port, tlsConfig)
+		if err != nil {
+			return fmt.Errorf("starting server: %w", err)
+		}
+		log.Fatal(app.Listener(ln))
 	}
-	log.Fatal(app.Listen(":" + port))
+	log.Fatal(app.Listen(":" + cfg.Port))
+	return nil
 }
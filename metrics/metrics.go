@@ -0,0 +1,306 @@
+// Package metrics exports Prometheus metrics of the HTTP requests served,
+// the MongoDB commands they run and the topology of the MongoDB clusters.
+package metrics
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"mongo-data-api-go-alternative/priority"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+const (
+	namespace = "mongodataapi"
+	service   = "mongo-data-api"
+)
+
+// DefaultHTTPBuckets are the request duration buckets in seconds, from 1ns
+// to a minute
+var DefaultHTTPBuckets = []float64{
+	0.000000001, 0.000000002, 0.000000005,
+	0.00000001, 0.00000002, 0.00000005,
+	0.0000001, 0.0000002, 0.0000005,
+	0.000001, 0.000002, 0.000005,
+	0.00001, 0.00002, 0.00005,
+	0.0001, 0.0002, 0.0005,
+	0.001, 0.002, 0.005,
+	0.01, 0.02, 0.05,
+	0.1, 0.2, 0.5,
+	1, 2, 5,
+	10, 15, 20, 30, 60,
+}
+
+// DefaultMongoBuckets are the MongoDB command duration buckets in seconds,
+// from 0.5ms to two minutes
+var DefaultMongoBuckets = []float64{
+	0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5,
+	1, 2.5, 5, 10, 30, 60, 120,
+}
+
+// Options configure the histograms
+type Options struct {
+	// HTTPBuckets and MongoBuckets are the upper bounds of the duration
+	// buckets in seconds (default DefaultHTTPBuckets and
+	// DefaultMongoBuckets)
+	HTTPBuckets  []float64
+	MongoBuckets []float64
+	// NativeHistograms additionally records the durations as native
+	// histograms, whose exponential buckets resolve any latency. They are
+	// only exposed to scrapers negotiating the protobuf format.
+	NativeHistograms bool
+}
+
+// operationDuration is the histogram of the Metrics created last, which
+// RecordMongoOperation observes
+var operationDuration atomic.Pointer[prometheus.HistogramVec]
+
+// RecordMongoOperation records a data operation served by the API. status
+// is the HTTP status it was answered with. Nothing is recorded before New
+// has been called.
+func RecordMongoOperation(operation, database, collection string, status int, d time.Duration) {
+	if h := operationDuration.Load(); h != nil {
+		h.WithLabelValues(operation, database, collection, strconv.Itoa(status)).Observe(d.Seconds())
+	}
+}
+
+// Metrics holds the collectors, registered with a registry of their own
+type Metrics struct {
+	registry         *prometheus.Registry
+	requestsTotal    *prometheus.CounterVec
+	requestDuration  *prometheus.HistogramVec
+	requestsInFlight *prometheus.GaugeVec
+	commandDuration  *prometheus.HistogramVec
+	operations       *prometheus.HistogramVec
+	topology         *topology
+	skipPaths        map[string]bool
+}
+
+// New creates the collectors
+func New(opts Options) *Metrics {
+	if len(opts.HTTPBuckets) == 0 {
+		opts.HTTPBuckets = DefaultHTTPBuckets
+	}
+	if len(opts.MongoBuckets) == 0 {
+		opts.MongoBuckets = DefaultMongoBuckets
+	}
+	labels := prometheus.Labels{"service": service}
+	histogram := func(subsystem, name, help string, buckets []float64) prometheus.HistogramOpts {
+		h := prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			Name:        name,
+			Help:        help,
+			ConstLabels: labels,
+			Buckets:     buckets,
+		}
+		if opts.NativeHistograms {
+			h.NativeHistogramBucketFactor = 1.1
+			h.NativeHistogramMaxBucketNumber = 160
+			h.NativeHistogramMinResetDuration = time.Hour
+		}
+		return h
+	}
+
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requestsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "http",
+			Name:        "requests_total",
+			Help:        "Count all http requests by status code, method and path.",
+			ConstLabels: labels,
+		}, []string{"status_code", "method", "path"}),
+		requestDuration: prometheus.NewHistogramVec(
+			histogram("http", "request_duration_seconds", "Duration of all HTTP requests by status code, method and path.", opts.HTTPBuckets),
+			[]string{"status_code", "method", "path"}),
+		requestsInFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   "http",
+			Name:        "requests_in_progress_total",
+			Help:        "All the requests in progress",
+			ConstLabels: labels,
+		}, []string{"method"}),
+		commandDuration: prometheus.NewHistogramVec(
+			histogram("mongo", "command_duration_seconds", "Duration of MongoDB commands by command, database and status.", opts.MongoBuckets),
+			[]string{"command", "database", "status"}),
+		operations: prometheus.NewHistogramVec(
+			histogram("mongo", "operation_duration_seconds", "Duration of data operations by operation, namespace and response status.", opts.MongoBuckets),
+			[]string{"operation", "database", "collection", "status"}),
+		topology:  newTopology(),
+		skipPaths: make(map[string]bool),
+	}
+	m.registry.MustRegister(m.requestsTotal, m.requestDuration, m.requestsInFlight, m.commandDuration, m.operations)
+	m.registry.MustRegister(m.topology.collectors()...)
+	operationDuration.Store(m.operations)
+	return m
+}
+
+// WatchCursors exports the number of open cursors and the number of cursors
+// closed for staying open too long, as reported by open and closed
+func (m *Metrics) WatchCursors(open func() int, closed func() int64) {
+	labels := prometheus.Labels{"service": service}
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   "mongo",
+			Name:        "cursors_open",
+			Help:        "Number of cursors open on MongoDB.",
+			ConstLabels: labels,
+		}, func() float64 { return float64(open()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "mongo",
+			Name:        "cursors_closed_total",
+			Help:        "Count of the cursors closed by the proxy, for staying open too long or through the admin API.",
+			ConstLabels: labels,
+		}, func() float64 { return float64(closed()) }),
+	)
+}
+
+// WatchFailovers exports the number of reads failed over to the standby
+// cluster for each of reasons, as reported by count
+func (m *Metrics) WatchFailovers(reasons []string, count func(reason string) int64) {
+	for _, reason := range reasons {
+		m.registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "mongo",
+			Name:        "read_failovers_total",
+			Help:        "Count of the reads retried on the standby cluster, by the reason the default cluster did not serve them.",
+			ConstLabels: prometheus.Labels{"service": service, "reason": reason},
+		}, func() float64 { return float64(count(reason)) }))
+	}
+}
+
+// WatchRateLimitFallback exports whether the rate limits are enforced by
+// each replica on its own because the shared buckets are unavailable, as
+// reported by fallback
+func (m *Metrics) WatchRateLimitFallback(fallback func() bool) {
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   "http",
+		Name:        "rate_limit_fallback",
+		Help:        "1 while rate limits are enforced per replica because Redis is unavailable.",
+		ConstLabels: prometheus.Labels{"service": service},
+	}, func() float64 {
+		if fallback() {
+			return 1
+		}
+		return 0
+	}))
+}
+
+// WatchRequestQueue exports the requests served, waiting, admitted and
+// turned away by the request queue for each of classes, as reported by
+// stats
+func (m *Metrics) WatchRequestQueue(classes []string, stats func(class string) priority.Stats) {
+	for _, class := range classes {
+		labels := prometheus.Labels{"service": service, "class": class}
+		gauge := func(name, help string, value func(priority.Stats) int) prometheus.Collector {
+			return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Subsystem:   "http",
+				Name:        name,
+				Help:        help,
+				ConstLabels: labels,
+			}, func() float64 { return float64(value(stats(class))) })
+		}
+		counter := func(name, help string, value func(priority.Stats) float64) prometheus.Collector {
+			return prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Namespace:   namespace,
+				Subsystem:   "http",
+				Name:        name,
+				Help:        help,
+				ConstLabels: labels,
+			}, func() float64 { return value(stats(class)) })
+		}
+		m.registry.MustRegister(
+			gauge("queue_requests_in_flight", "Requests being served, by priority class.",
+				func(s priority.Stats) int { return s.InFlight }),
+			gauge("queue_requests_waiting", "Requests waiting for a slot, by priority class.",
+				func(s priority.Stats) int { return s.Queued }),
+			counter("queue_admitted_total", "Count of the requests admitted, by priority class.",
+				func(s priority.Stats) float64 { return float64(s.Admitted) }),
+			counter("queue_promoted_total", "Count of the requests admitted ahead of higher classes after waiting the starvation limit.",
+				func(s priority.Stats) float64 { return float64(s.Promoted) }),
+			counter("queue_rejected_total", "Count of the requests turned away by a full queue, by priority class.",
+				func(s priority.Stats) float64 { return float64(s.Rejected) }),
+			counter("queue_timeouts_total", "Count of the requests that waited too long for a slot, by priority class.",
+				func(s priority.Stats) float64 { return float64(s.TimedOut) }),
+			counter("queue_wait_seconds_total", "Time the admitted requests waited for a slot, by priority class.",
+				func(s priority.Stats) float64 { return s.WaitSeconds }),
+		)
+	}
+}
+
+// RegisterAt serves the metrics at url
+func (m *Metrics) RegisterAt(app fiber.Router, url string) {
+	app.Get(url, adaptor.HTTPHandler(promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{
+		EnableOpenMetrics: true,
+	})))
+}
+
+// SetSkipPaths excludes the requests to routes from the metrics
+func (m *Metrics) SetSkipPaths(paths []string) {
+	for _, path := range paths {
+		m.skipPaths[path] = true
+	}
+}
+
+// Middleware counts and times the requests by route
+func (m *Metrics) Middleware(c *fiber.Ctx) error {
+	method := utils.CopyString(c.Method())
+	m.requestsInFlight.WithLabelValues(method).Inc()
+	defer m.requestsInFlight.WithLabelValues(method).Dec()
+
+	start := time.Now()
+	err := c.Next()
+
+	path := utils.CopyString(c.Route().Path)
+	if path == "/" {
+		path = utils.CopyString(c.Path())
+	}
+	if trimmed := strings.TrimRight(path, "/"); trimmed != "" {
+		path = trimmed
+	}
+	if m.skipPaths[path] {
+		return err
+	}
+
+	status := fiber.StatusInternalServerError
+	if err != nil {
+		if e, ok := err.(*fiber.Error); ok {
+			status = e.Code
+		}
+	} else {
+		status = c.Response().StatusCode()
+	}
+	code := strconv.Itoa(status)
+	m.requestsTotal.WithLabelValues(code, method, path).Inc()
+	m.requestDuration.WithLabelValues(code, method, path).Observe(time.Since(start).Seconds())
+	return err
+}
+
+// CommandMonitor times the commands of a MongoDB client
+func (m *Metrics) CommandMonitor() *event.CommandMonitor {
+	observe := func(e event.CommandFinishedEvent, status string) {
+		m.commandDuration.WithLabelValues(e.CommandName, e.DatabaseName, status).Observe(e.Duration.Seconds())
+	}
+	return &event.CommandMonitor{
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			observe(e.CommandFinishedEvent, "success")
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			observe(e.CommandFinishedEvent, "failure")
+		},
+	}
+}
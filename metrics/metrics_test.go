@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"context"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// buckets returns the upper bounds of the buckets of the histogram name, and
+// whether it also records a native histogram
+func buckets(t *testing.T, m *Metrics, name string) ([]float64, bool) {
+	t.Helper()
+	families, err := m.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		h := f.GetMetric()[0].GetHistogram()
+		var bounds []float64
+		for _, b := range h.GetBucket() {
+			bounds = append(bounds, b.GetUpperBound())
+		}
+		return bounds, h.Schema != nil
+	}
+	t.Fatalf("no %s histogram", name)
+	return nil, false
+}
+
+// observe sends a request through the middleware and reports a MongoDB
+// command, so that each histogram has a series
+func observe(t *testing.T, m *Metrics) {
+	t.Helper()
+	app := fiber.New()
+	app.Use(m.Middleware)
+	app.Get("/api/find", func(c *fiber.Ctx) error { return c.SendString("ok") })
+	if _, err := app.Test(httptest.NewRequest("GET", "/api/find", nil), -1); err != nil {
+		t.Fatal(err)
+	}
+	m.CommandMonitor().Succeeded(context.Background(), &event.CommandSucceededEvent{CommandFinishedEvent: event.CommandFinishedEvent{
+		CommandName: "find", DatabaseName: "app", Duration: 5 * time.Millisecond,
+	}})
+	RecordMongoOperation("find", "app", "users", 200, 5*time.Millisecond)
+}
+
+func TestBuckets(t *testing.T) {
+	m := New(Options{})
+	observe(t, m)
+	for name, want := range map[string][]float64{
+		"mongodataapi_http_request_duration_seconds":    DefaultHTTPBuckets,
+		"mongodataapi_mongo_command_duration_seconds":   DefaultMongoBuckets,
+		"mongodataapi_mongo_operation_duration_seconds": DefaultMongoBuckets,
+	} {
+		if got, native := buckets(t, m, name); !reflect.DeepEqual(got, want) || native {
+			t.Errorf("%s: buckets %v, native %v; want the defaults", name, got, native)
+		}
+	}
+
+	m = New(Options{HTTPBuckets: []float64{0.1, 1}, MongoBuckets: []float64{0.01, 0.1}, NativeHistograms: true})
+	observe(t, m)
+	for name, want := range map[string][]float64{
+		"mongodataapi_http_request_duration_seconds":    {0.1, 1},
+		"mongodataapi_mongo_command_duration_seconds":   {0.01, 0.1},
+		"mongodataapi_mongo_operation_duration_seconds": {0.01, 0.1},
+	} {
+		if got, native := buckets(t, m, name); !reflect.DeepEqual(got, want) || !native {
+			t.Errorf("%s: buckets %v, native %v; want %v and native", name, got, native, want)
+		}
+	}
+}
+
+func TestSkipPaths(t *testing.T) {
+	m := New(Options{})
+	m.SetSkipPaths([]string{"/api/health"})
+	app := fiber.New()
+	app.Use(m.Middleware)
+	app.Get("/api/health", func(c *fiber.Ctx) error { return c.SendString("ok") })
+	app.Get("/api/items/:id", func(c *fiber.Ctx) error { return fiber.ErrNotFound })
+	for _, path := range []string{"/api/health", "/api/items/1", "/api/items/2/"} {
+		if _, err := app.Test(httptest.NewRequest("GET", path, nil), -1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	families, err := m.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var series []string
+	for _, f := range families {
+		if f.GetName() != "mongodataapi_http_requests_total" {
+			continue
+		}
+		for _, metric := range f.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range metric.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			series = append(series, labels["method"]+" "+labels["path"]+" "+labels["status_code"])
+			if metric.GetCounter().GetValue() != 2 {
+				t.Errorf("%v counted %v times, want 2", labels, metric.GetCounter().GetValue())
+			}
+		}
+	}
+	// Requests are labelled with their route, and skipped routes aren't
+	// counted
+	if want := []string{"GET /api/items/:id 404"}; !reflect.DeepEqual(series, want) {
+		t.Errorf("series %v, want %v", series, want)
+	}
+}
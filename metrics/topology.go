@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo/description"
+)
+
+// serverKinds are the server types counted per cluster, so that a type
+// without servers reads 0 instead of disappearing
+var serverKinds = []description.ServerKind{
+	description.Standalone, description.RSPrimary, description.RSSecondary, description.RSArbiter,
+	description.RSMember, description.RSGhost, description.Mongos, description.LoadBalancer, description.Unknown,
+}
+
+// topology holds the gauges fed by the driver's server discovery and
+// monitoring events
+type topology struct {
+	servers         *prometheus.GaugeVec
+	rtt             *prometheus.GaugeVec
+	lastHeartbeat   *prometheus.GaugeVec
+	heartbeatErrors *prometheus.CounterVec
+}
+
+func newTopology() *topology {
+	return &topology{
+		servers: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   "mongo",
+			Name:        "servers",
+			Help:        "Number of servers of a MongoDB cluster by type.",
+			ConstLabels: prometheus.Labels{"service": service},
+		}, []string{"cluster", "type"}),
+		rtt: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   "mongo",
+			Name:        "server_rtt_seconds",
+			Help:        "Round trip time of the last polled heartbeat of a MongoDB server.",
+			ConstLabels: prometheus.Labels{"service": service},
+		}, []string{"cluster", "address"}),
+		lastHeartbeat: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   "mongo",
+			Name:        "server_last_heartbeat_timestamp_seconds",
+			Help:        "Unix time of the last successful heartbeat of a MongoDB server.",
+			ConstLabels: prometheus.Labels{"service": service},
+		}, []string{"cluster", "address"}),
+		heartbeatErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "mongo",
+			Name:        "server_heartbeat_failures_total",
+			Help:        "Failed heartbeats of a MongoDB server.",
+			ConstLabels: prometheus.Labels{"service": service},
+		}, []string{"cluster", "address"}),
+	}
+}
+
+func (t *topology) collectors() []prometheus.Collector {
+	return []prometheus.Collector{t.servers, t.rtt, t.lastHeartbeat, t.heartbeatErrors}
+}
+
+// ServerMonitor reports the topology of the cluster a MongoDB client is
+// connected to, labeled with cluster
+func (m *Metrics) ServerMonitor(cluster string) *event.ServerMonitor {
+	t := m.topology
+	return &event.ServerMonitor{
+		TopologyDescriptionChanged: func(e *event.TopologyDescriptionChangedEvent) {
+			counts := make(map[description.ServerKind]int)
+			current := make(map[string]bool)
+			for _, s := range e.NewDescription.Servers {
+				counts[s.Kind]++
+				current[s.Addr.String()] = true
+			}
+			for _, kind := range serverKinds {
+				t.servers.WithLabelValues(cluster, kind.String()).Set(float64(counts[kind]))
+			}
+			// Forget the servers that left the cluster
+			for _, s := range e.PreviousDescription.Servers {
+				if addr := s.Addr.String(); !current[addr] {
+					t.rtt.DeleteLabelValues(cluster, addr)
+					t.lastHeartbeat.DeleteLabelValues(cluster, addr)
+					t.heartbeatErrors.DeleteLabelValues(cluster, addr)
+				}
+			}
+		},
+		ServerHeartbeatSucceeded: func(e *event.ServerHeartbeatSucceededEvent) {
+			addr := heartbeatAddress(e.ConnectionID)
+			t.lastHeartbeat.WithLabelValues(cluster, addr).Set(float64(time.Now().UnixMilli()) / 1000)
+			// Awaited heartbeats wait for a topology change on the server, so
+			// their duration is not a round trip
+			if !e.Awaited {
+				t.rtt.WithLabelValues(cluster, addr).Set(e.Duration.Seconds())
+			}
+		},
+		ServerHeartbeatFailed: func(e *event.ServerHeartbeatFailedEvent) {
+			t.heartbeatErrors.WithLabelValues(cluster, heartbeatAddress(e.ConnectionID)).Inc()
+		},
+	}
+}
+
+// heartbeatAddress strips the connection number from the connection id of
+// a heartbeat, e.g. "db1:27017[-3]"
+func heartbeatAddress(connectionID string) string {
+	if i := strings.LastIndexByte(connectionID, '['); i > 0 {
+		return connectionID[:i]
+	}
+	return connectionID
+}
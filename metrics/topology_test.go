@@ -0,0 +1,121 @@
+package metrics
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo/address"
+	"go.mongodb.org/mongo-driver/mongo/description"
+)
+
+// series returns the values of the metric name by their labels other than
+// service, e.g. "cluster=main address=db1:27017"
+func series(t *testing.T, m *Metrics, name string) map[string]float64 {
+	t.Helper()
+	families, err := m.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, metric := range f.GetMetric() {
+			var labels []string
+			for _, l := range metric.GetLabel() {
+				if l.GetName() != "service" {
+					labels = append(labels, l.GetName()+"="+l.GetValue())
+				}
+			}
+			value := metric.GetGauge().GetValue()
+			if c := metric.GetCounter(); c != nil {
+				value = c.GetValue()
+			}
+			values[strings.Join(labels, " ")] = value
+		}
+	}
+	return values
+}
+
+func servers(kinds ...description.ServerKind) description.Topology {
+	var topology description.Topology
+	for i, kind := range kinds {
+		topology.Servers = append(topology.Servers, description.Server{Addr: address.Address("db" + string(rune('1'+i)) + ":27017"), Kind: kind})
+	}
+	return topology
+}
+
+func TestServerMonitor(t *testing.T) {
+	m := New(Options{})
+	monitor := m.ServerMonitor("main")
+	const (
+		rtt       = "mongodataapi_mongo_server_rtt_seconds"
+		heartbeat = "mongodataapi_mongo_server_last_heartbeat_timestamp_seconds"
+		failures  = "mongodataapi_mongo_server_heartbeat_failures_total"
+	)
+	db1, db2 := "address=db1:27017 cluster=main", "address=db2:27017 cluster=main"
+
+	// Servers opening are counted by type, with 0 for the other types
+	monitor.TopologyDescriptionChanged(&event.TopologyDescriptionChangedEvent{NewDescription: servers(description.RSPrimary, description.RSSecondary)})
+	counts := series(t, m, "mongodataapi_mongo_servers")
+	if len(counts) != len(serverKinds) || counts["cluster=main type=RSPrimary"] != 1 || counts["cluster=main type=RSSecondary"] != 1 || counts["cluster=main type=Mongos"] != 0 {
+		t.Errorf("servers %v", counts)
+	}
+
+	// Polled heartbeats set the round trip time; awaited ones only the time
+	// of the last heartbeat, as they wait for a change on the server
+	before := float64(time.Now().Unix())
+	monitor.ServerHeartbeatSucceeded(&event.ServerHeartbeatSucceededEvent{ConnectionID: "db1:27017[-1]", Duration: 20 * time.Millisecond})
+	monitor.ServerHeartbeatSucceeded(&event.ServerHeartbeatSucceededEvent{ConnectionID: "db1:27017[-2]", Duration: 10 * time.Second, Awaited: true})
+	monitor.ServerHeartbeatSucceeded(&event.ServerHeartbeatSucceededEvent{ConnectionID: "db2:27017[-3]", Duration: 30 * time.Millisecond})
+	if got := series(t, m, rtt); !reflect.DeepEqual(got, map[string]float64{db1: 0.02, db2: 0.03}) {
+		t.Errorf("rtt %v", got)
+	}
+	if got := series(t, m, heartbeat); len(got) != 2 || got[db1] < before || got[db2] < before {
+		t.Errorf("last heartbeat %v, want after %v", got, before)
+	}
+
+	// Failed heartbeats are counted, awaited or not
+	failure := errors.New("connection refused")
+	monitor.ServerHeartbeatFailed(&event.ServerHeartbeatFailedEvent{ConnectionID: "db2:27017[-4]", Failure: failure})
+	monitor.ServerHeartbeatFailed(&event.ServerHeartbeatFailedEvent{ConnectionID: "db2:27017[-5]", Failure: failure, Awaited: true})
+	if got := series(t, m, failures); !reflect.DeepEqual(got, map[string]float64{db2: 2}) {
+		t.Errorf("failures %v", got)
+	}
+
+	// A server closing leaves the topology and its series are removed
+	monitor.TopologyDescriptionChanged(&event.TopologyDescriptionChangedEvent{
+		PreviousDescription: servers(description.RSPrimary, description.RSSecondary),
+		NewDescription:      servers(description.RSPrimary),
+	})
+	if counts := series(t, m, "mongodataapi_mongo_servers"); counts["cluster=main type=RSPrimary"] != 1 || counts["cluster=main type=RSSecondary"] != 0 {
+		t.Errorf("servers %v", counts)
+	}
+	for name, want := range map[string][]string{rtt: {db1}, heartbeat: {db1}, failures: nil} {
+		var got []string
+		for labels := range series(t, m, name) {
+			got = append(got, labels)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: series %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestHeartbeatAddress(t *testing.T) {
+	for id, want := range map[string]string{
+		"db1:27017[-3]":         "db1:27017",
+		"db1:27017":             "db1:27017",
+		"[::1]:27017[-12]":      "[::1]:27017",
+		"/tmp/mongodb.sock[-1]": "/tmp/mongodb.sock",
+	} {
+		if got := heartbeatAddress(id); got != want {
+			t.Errorf("heartbeatAddress(%q) = %q, want %q", id, got, want)
+		}
+	}
+}
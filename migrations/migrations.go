@@ -0,0 +1,368 @@
+// Package migrations applies versioned schema changes, such as index
+// changes and update pipelines, and records them in a ledger collection so
+// every deployment knows which changes it has seen.
+//
+// A migration is a JSON file named <version>_<name>.json in the migrations
+// directory, holding the steps to apply ("up") and to revert ("down"):
+//
+//	{
+//	  "up": [{"op": "createIndex", "database": "app", "collection": "users",
+//	          "index": {"keys": {"email": 1}, "unique": true}}],
+//	  "down": [{"op": "dropIndex", "database": "app", "collection": "users", "name": "email_1"}]
+//	}
+//
+// Filters, updates and pipelines are Extended JSON.
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"mongo-data-api-go-alternative/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LedgerCollection records the applied migrations in the system database
+const LedgerCollection = "migrations"
+
+// Step operations
+const (
+	OpCreateIndex = "createIndex"
+	OpDropIndex   = "dropIndex"
+	OpUpdateMany  = "updateMany"
+	// OpAggregate runs a pipeline ending in $out or $merge
+	OpAggregate = "aggregate"
+)
+
+// Step is a single change of a migration
+type Step struct {
+	Op         string `bson:"op" json:"op"`
+	Database   string `bson:"database" json:"database"`
+	Collection string `bson:"collection" json:"collection"`
+	// Index is created by createIndex
+	Index *db.Index `bson:"index,omitempty" json:"index,omitempty"`
+	// Name is the index dropped by dropIndex
+	Name string `bson:"name,omitempty" json:"name,omitempty"`
+	// Filter and Update are used by updateMany; Update may be a pipeline
+	Filter bson.D      `bson:"filter,omitempty" json:"filter,omitempty"`
+	Update interface{} `bson:"update,omitempty" json:"update,omitempty"`
+	// Pipeline is run by aggregate
+	Pipeline bson.A `bson:"pipeline,omitempty" json:"pipeline,omitempty"`
+}
+
+// Migration is a versioned set of steps read from a file
+type Migration struct {
+	Version int64
+	Name    string
+	Up      []Step
+	Down    []Step
+}
+
+// Load reads the migrations in dir, ordered by version
+func Load(dir string) ([]Migration, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading migrations: %w", err)
+	}
+	var migrations []Migration
+	seen := make(map[int64]string)
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		base := strings.TrimSuffix(e.Name(), ".json")
+		prefix, name, _ := strings.Cut(base, "_")
+		version, err := strconv.ParseInt(prefix, 10, 64)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: file names must start with a positive version number", e.Name())
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", other, e.Name())
+		}
+		seen[version] = e.Name()
+
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var steps struct {
+			Up   []Step `bson:"up"`
+			Down []Step `bson:"down"`
+		}
+		if err := bson.UnmarshalExtJSON(data, false, &steps); err != nil {
+			return nil, fmt.Errorf("migration %s: %w", e.Name(), err)
+		}
+		m := Migration{Version: version, Name: name, Up: steps.Up, Down: steps.Down}
+		if err := m.validate(); err != nil {
+			return nil, fmt.Errorf("migration %s: %w", e.Name(), err)
+		}
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+func (m Migration) validate() error {
+	if len(m.Up) == 0 {
+		return errors.New("no up steps")
+	}
+	for _, steps := range [][]Step{m.Up, m.Down} {
+		for i, s := range steps {
+			if err := s.validate(); err != nil {
+				return fmt.Errorf("step %d: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s Step) validate() error {
+	if s.Database == "" || s.Collection == "" {
+		return errors.New("database and collection are required")
+	}
+	switch s.Op {
+	case OpCreateIndex:
+		if s.Index == nil || len(s.Index.Keys) == 0 {
+			return errors.New("createIndex needs index keys")
+		}
+	case OpDropIndex:
+		if s.Name == "" {
+			return errors.New("dropIndex needs the index name")
+		}
+	case OpUpdateMany:
+		if s.Update == nil {
+			return errors.New("updateMany needs an update")
+		}
+	case OpAggregate:
+		if len(s.Pipeline) == 0 {
+			return errors.New("aggregate needs a pipeline")
+		}
+	default:
+		return fmt.Errorf("unknown op %q", s.Op)
+	}
+	return nil
+}
+
+// String describes the step for dry runs and logs
+func (s Step) String() string {
+	ns := s.Database + "." + s.Collection
+	switch s.Op {
+	case OpCreateIndex:
+		keys, _ := bson.MarshalExtJSON(s.Index.Keys, false, false)
+		desc := fmt.Sprintf("createIndex %s %s", ns, keys)
+		if s.Index.Name != "" {
+			desc += " name=" + s.Index.Name
+		}
+		if s.Index.Unique {
+			desc += " unique"
+		}
+		if s.Index.ExpireAfterSeconds != nil {
+			desc += fmt.Sprintf(" expireAfterSeconds=%d", *s.Index.ExpireAfterSeconds)
+		}
+		return desc
+	case OpDropIndex:
+		return fmt.Sprintf("dropIndex %s %s", ns, s.Name)
+	case OpUpdateMany:
+		filter, _ := bson.MarshalExtJSON(bson.D{{Key: "filter", Value: s.Filter}, {Key: "update", Value: s.Update}}, false, false)
+		return fmt.Sprintf("updateMany %s %s", ns, filter)
+	default:
+		pipeline, _ := bson.MarshalExtJSON(bson.D{{Key: "pipeline", Value: s.Pipeline}}, false, false)
+		return fmt.Sprintf("aggregate %s %s", ns, pipeline)
+	}
+}
+
+func (s Step) run(ctx context.Context, store db.DataStore) error {
+	switch s.Op {
+	case OpCreateIndex:
+		_, err := store.CreateIndex(ctx, s.Database, s.Collection, *s.Index)
+		return err
+	case OpDropIndex:
+		return store.DropIndex(ctx, s.Database, s.Collection, s.Name)
+	case OpUpdateMany:
+		filter := s.Filter
+		if filter == nil {
+			filter = bson.D{}
+		}
+		_, err := store.UpdateMany(ctx, s.Database, s.Collection, filter, s.Update, nil)
+		return err
+	default:
+		return store.AggregateWrite(ctx, s.Database, s.Collection, s.Pipeline)
+	}
+}
+
+// State is a migration and whether it has been applied
+type State struct {
+	Version   int64      `json:"version"`
+	Name      string     `json:"name"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"appliedAt,omitempty"`
+	// Missing is set for applied migrations whose file is gone
+	Missing bool `json:"missing,omitempty"`
+}
+
+// Result describes a migration that was applied or reverted, or would be
+// in a dry run
+type Result struct {
+	Version   int64    `json:"version"`
+	Name      string   `json:"name"`
+	Direction string   `json:"direction"`
+	Steps     []string `json:"steps"`
+	DryRun    bool     `json:"dryRun,omitempty"`
+}
+
+// ledgerEntry is a document of the ledger collection
+type ledgerEntry struct {
+	Version   int64     `bson:"_id"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"appliedAt"`
+}
+
+// Runner applies migrations and keeps the ledger in Database
+type Runner struct {
+	Store      db.DataStore
+	Database   string
+	Migrations []Migration
+}
+
+func (r *Runner) ledger(ctx context.Context) (map[int64]ledgerEntry, error) {
+	docs, err := r.Store.Find(ctx, r.Database, LedgerCollection, bson.D{}, options.Find())
+	if err != nil {
+		return nil, fmt.Errorf("reading the migrations ledger: %w", err)
+	}
+	entries := make(map[int64]ledgerEntry, len(docs))
+	for _, doc := range docs {
+		raw, err := bson.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		var e ledgerEntry
+		if err := bson.Unmarshal(raw, &e); err != nil {
+			return nil, fmt.Errorf("reading the migrations ledger: %w", err)
+		}
+		entries[e.Version] = e
+	}
+	return entries, nil
+}
+
+// Status lists the known and applied migrations by version
+func (r *Runner) Status(ctx context.Context) ([]State, error) {
+	applied, err := r.ledger(ctx)
+	if err != nil {
+		return nil, err
+	}
+	states := make([]State, 0, len(r.Migrations))
+	for _, m := range r.Migrations {
+		st := State{Version: m.Version, Name: m.Name}
+		if e, ok := applied[m.Version]; ok {
+			st.Applied, st.AppliedAt = true, &e.AppliedAt
+			delete(applied, m.Version)
+		}
+		states = append(states, st)
+	}
+	for _, e := range applied {
+		appliedAt := e.AppliedAt
+		states = append(states, State{Version: e.Version, Name: e.Name, Applied: true, AppliedAt: &appliedAt, Missing: true})
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Version < states[j].Version })
+	return states, nil
+}
+
+// Up applies the pending migrations up to and including target, or all of
+// them when target is 0. The steps of a migration are run in order; when
+// one fails, the migration is not recorded and later ones are not run.
+func (r *Runner) Up(ctx context.Context, target int64, dryRun bool) ([]Result, error) {
+	applied, err := r.ledger(ctx)
+	if err != nil {
+		return nil, err
+	}
+	results := []Result{}
+	for _, m := range r.Migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		if target > 0 && m.Version > target {
+			break
+		}
+		res := Result{Version: m.Version, Name: m.Name, Direction: "up", Steps: describe(m.Up), DryRun: dryRun}
+		if !dryRun {
+			// Recording the migration first keeps other instances from
+			// applying it at the same time
+			entry := bson.D{
+				{Key: "_id", Value: m.Version},
+				{Key: "name", Value: m.Name},
+				{Key: "appliedAt", Value: time.Now().UTC()},
+			}
+			if _, err := r.Store.InsertOne(ctx, r.Database, LedgerCollection, entry); err != nil {
+				return results, fmt.Errorf("recording migration %d: %w", m.Version, err)
+			}
+			if err := r.run(ctx, m.Version, m.Up); err != nil {
+				r.Store.DeleteOne(ctx, r.Database, LedgerCollection, bson.D{{Key: "_id", Value: m.Version}})
+				return results, err
+			}
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// Down reverts the applied migrations newer than target, newest first. A
+// negative target reverts only the latest applied migration.
+func (r *Runner) Down(ctx context.Context, target int64, dryRun bool) ([]Result, error) {
+	applied, err := r.ledger(ctx)
+	if err != nil {
+		return nil, err
+	}
+	results := []Result{}
+	for i := len(r.Migrations) - 1; i >= 0; i-- {
+		m := r.Migrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		if target >= 0 && m.Version <= target {
+			break
+		}
+		if len(m.Down) == 0 {
+			return results, fmt.Errorf("migration %d has no down steps", m.Version)
+		}
+		res := Result{Version: m.Version, Name: m.Name, Direction: "down", Steps: describe(m.Down), DryRun: dryRun}
+		if !dryRun {
+			if err := r.run(ctx, m.Version, m.Down); err != nil {
+				return results, err
+			}
+			if _, err := r.Store.DeleteOne(ctx, r.Database, LedgerCollection, bson.D{{Key: "_id", Value: m.Version}}); err != nil {
+				return results, fmt.Errorf("recording migration %d: %w", m.Version, err)
+			}
+		}
+		results = append(results, res)
+		if target < 0 {
+			break
+		}
+	}
+	return results, nil
+}
+
+func (r *Runner) run(ctx context.Context, version int64, steps []Step) error {
+	for i, s := range steps {
+		if err := s.run(ctx, r.Store); err != nil {
+			return fmt.Errorf("migration %d step %d (%s): %w", version, i, s.Op, err)
+		}
+	}
+	return nil
+}
+
+func describe(steps []Step) []string {
+	desc := make([]string, len(steps))
+	for i, s := range steps {
+		desc[i] = s.String()
+	}
+	return desc
+}
@@ -0,0 +1,416 @@
+// Package mirror applies the writes of a data store to a second cluster as
+// well, so that collections can be migrated between clusters while the API
+// keeps serving them
+package mirror
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"mongo-data-api-go-alternative/config"
+	"mongo-data-api-go-alternative/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultQueueSize  = 10000
+	defaultMaxRetries = 3
+	// maxFailures bounds the failed writes kept for retrying
+	maxFailures = 1000
+	// writeTimeout bounds each attempt to mirror a write
+	writeTimeout = 30 * time.Second
+)
+
+// ErrQueueFull is recorded for writes made while the mirror queue is full
+var ErrQueueFull = errors.New("mirror queue full")
+
+// Store is a data store whose writes are applied to the primary store and,
+// once they succeeded there, mirrored to the target store in the same order
+// by a background worker. Reads are served by the primary only. Writes that
+// still fail after retries are kept as failures until they are retried.
+type Store struct {
+	db.DataStore
+	target     db.DataStore
+	cluster    string
+	maxRetries int
+	queue      chan *write
+
+	mu              sync.Mutex
+	current         *write
+	mirrored        int64
+	failed          int64
+	failures        []Failure
+	nextFailure     int64
+	reconciliations map[string]*Reconciliation
+}
+
+var _ db.DataStore = (*Store)(nil)
+
+// write is a write waiting to be mirrored
+type write struct {
+	operation  string
+	database   string
+	collection string
+	client     string
+	queued     time.Time
+	apply      func(ctx context.Context, target db.DataStore) error
+}
+
+// Failure is a write that could not be mirrored
+type Failure struct {
+	ID         int64     `json:"id"`
+	Operation  string    `json:"operation"`
+	Database   string    `json:"database"`
+	Collection string    `json:"collection"`
+	Error      string    `json:"error"`
+	At         time.Time `json:"at"`
+	write      *write
+}
+
+// Status reports the progress of the mirror
+type Status struct {
+	Cluster string `json:"cluster"`
+	// Queued is the number of writes waiting to be mirrored and
+	// LagSeconds the age of the oldest of them
+	Queued          int              `json:"queued"`
+	LagSeconds      float64          `json:"lagSeconds"`
+	Mirrored        int64            `json:"mirrored"`
+	Failed          int64            `json:"failed"`
+	Failures        []Failure        `json:"failures"`
+	Reconciliations []Reconciliation `json:"reconciliations"`
+}
+
+// New mirrors the writes of primary to target, the store of cluster
+func New(primary, target db.DataStore, cfg config.DualWriteConfig) *Store {
+	size, retries := cfg.QueueSize, cfg.MaxRetries
+	if size <= 0 {
+		size = defaultQueueSize
+	}
+	if retries == 0 {
+		retries = defaultMaxRetries
+	}
+	s := &Store{
+		DataStore:       primary,
+		target:          target,
+		cluster:         cfg.Cluster,
+		maxRetries:      retries,
+		queue:           make(chan *write, size),
+		failures:        []Failure{},
+		reconciliations: make(map[string]*Reconciliation),
+	}
+	go s.run()
+	return s
+}
+
+// Status returns the current state of the mirror
+func (s *Store) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := Status{
+		Cluster:         s.cluster,
+		Queued:          len(s.queue),
+		Mirrored:        s.mirrored,
+		Failed:          s.failed,
+		Failures:        append([]Failure{}, s.failures...),
+		Reconciliations: []Reconciliation{},
+	}
+	if s.current != nil {
+		st.Queued++
+		st.LagSeconds = time.Since(s.current.queued).Seconds()
+	}
+	for _, r := range s.reconciliations {
+		st.Reconciliations = append(st.Reconciliations, *r)
+	}
+	sort.Slice(st.Reconciliations, func(i, j int) bool {
+		return st.Reconciliations[i].StartedAt.After(st.Reconciliations[j].StartedAt)
+	})
+	return st
+}
+
+// Retry queues the failed writes again and returns how many were queued
+func (s *Store) Retry() int {
+	s.mu.Lock()
+	failures := s.failures
+	s.failures = []Failure{}
+	s.mu.Unlock()
+
+	for i, f := range failures {
+		f.write.queued = time.Now()
+		select {
+		case s.queue <- f.write:
+		default:
+			// Keep what doesn't fit for the next retry
+			s.mu.Lock()
+			s.failures = append(failures[i:], s.failures...)
+			s.mu.Unlock()
+			return i
+		}
+	}
+	return len(failures)
+}
+
+// enqueue queues a write succeeded on the primary
+func (s *Store) enqueue(ctx context.Context, operation, database, collection string, apply func(context.Context, db.DataStore) error) {
+	w := &write{operation: operation, database: database, collection: collection, queued: time.Now(), apply: apply}
+	w.client, _ = db.ClientFromContext(ctx)
+	select {
+	case s.queue <- w:
+	default:
+		s.fail(w, ErrQueueFull)
+	}
+}
+
+func (s *Store) run() {
+	for w := range s.queue {
+		s.mu.Lock()
+		s.current = w
+		s.mu.Unlock()
+
+		err := s.apply(w)
+
+		s.mu.Lock()
+		s.current = nil
+		if err == nil {
+			s.mirrored++
+		}
+		s.mu.Unlock()
+		if err != nil {
+			s.fail(w, err)
+		}
+	}
+}
+
+// apply mirrors a write, retrying network errors and timeouts
+func (s *Store) apply(w *write) error {
+	var err error
+	for attempt := 0; attempt <= s.maxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+		if w.client != "" {
+			ctx = db.WithClient(ctx, w.client)
+		}
+		err = w.apply(ctx, s.target)
+		cancel()
+		if err == nil || !mongo.IsNetworkError(err) && !mongo.IsTimeout(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *Store) fail(w *write, err error) {
+	log.Printf("Failed to mirror %s on %s.%s to cluster %s: %v", w.operation, w.database, w.collection, s.cluster, err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed++
+	s.nextFailure++
+	s.failures = append(s.failures, Failure{
+		ID:         s.nextFailure,
+		Operation:  w.operation,
+		Database:   w.database,
+		Collection: w.collection,
+		Error:      err.Error(),
+		At:         time.Now().UTC(),
+		write:      w,
+	})
+	if len(s.failures) > maxFailures {
+		s.failures = s.failures[len(s.failures)-maxFailures:]
+	}
+}
+
+// InsertOne inserts on the primary and mirrors the document with the _id
+// it was given there
+func (s *Store) InsertOne(ctx context.Context, database, collection string, document interface{}) (*mongo.InsertOneResult, error) {
+	res, err := s.DataStore.InsertOne(ctx, database, collection, document)
+	if err != nil {
+		return res, err
+	}
+	doc, err := withID(document, res.InsertedID)
+	s.enqueue(ctx, "insertOne", database, collection, func(ctx context.Context, target db.DataStore) error {
+		if err != nil {
+			return err
+		}
+		_, err := target.InsertOne(ctx, database, collection, doc)
+		return err
+	})
+	return res, nil
+}
+
+// InsertMany inserts on the primary and mirrors the documents it inserted
+// with their _ids. Inserts are ordered, so they are the documents before
+// the first failed one.
+func (s *Store) InsertMany(ctx context.Context, database, collection string, documents []interface{}) (*mongo.InsertManyResult, error) {
+	res, err := s.DataStore.InsertMany(ctx, database, collection, documents)
+	inserted := len(documents)
+	if err != nil {
+		var bwe mongo.BulkWriteException
+		if !errors.As(err, &bwe) || len(bwe.WriteErrors) == 0 {
+			return res, err
+		}
+		inserted = bwe.WriteErrors[0].Index
+		for _, we := range bwe.WriteErrors {
+			inserted = min(inserted, we.Index)
+		}
+	}
+	if res == nil || inserted == 0 || len(res.InsertedIDs) < inserted {
+		return res, err
+	}
+	docs := make([]interface{}, inserted)
+	var docErr error
+	for i := range docs {
+		if docs[i], docErr = withID(documents[i], res.InsertedIDs[i]); docErr != nil {
+			break
+		}
+	}
+	s.enqueue(ctx, "insertMany", database, collection, func(ctx context.Context, target db.DataStore) error {
+		if docErr != nil {
+			return docErr
+		}
+		_, err := target.InsertMany(ctx, database, collection, docs)
+		return err
+	})
+	return res, err
+}
+
+// UpdateOne updates on the primary and mirrors the update when it matched
+// or upserted a document
+func (s *Store) UpdateOne(ctx context.Context, database, collection string, filter, update interface{}, opts *options.UpdateOptions) (*mongo.UpdateResult, error) {
+	res, err := s.DataStore.UpdateOne(ctx, database, collection, filter, update, opts)
+	if err == nil {
+		s.mirrorUpdate(ctx, "updateOne", database, collection, filter, update, opts, res, db.DataStore.UpdateOne)
+	}
+	return res, err
+}
+
+// UpdateMany updates on the primary and mirrors the update when it matched
+// or upserted documents
+func (s *Store) UpdateMany(ctx context.Context, database, collection string, filter, update interface{}, opts *options.UpdateOptions) (*mongo.UpdateResult, error) {
+	res, err := s.DataStore.UpdateMany(ctx, database, collection, filter, update, opts)
+	if err == nil {
+		s.mirrorUpdate(ctx, "updateMany", database, collection, filter, update, opts, res, db.DataStore.UpdateMany)
+	}
+	return res, err
+}
+
+type updateFunc func(db.DataStore, context.Context, string, string, interface{}, interface{}, *options.UpdateOptions) (*mongo.UpdateResult, error)
+
+// mirrorUpdate queues an update. The target only upserts when the primary
+// did, and then creates the document with the primary's _id.
+func (s *Store) mirrorUpdate(ctx context.Context, operation, database, collection string, filter, update interface{}, opts *options.UpdateOptions, res *mongo.UpdateResult, fn updateFunc) {
+	if res == nil || res.MatchedCount == 0 && res.UpsertedID == nil {
+		return
+	}
+	mirrorOpts := options.Update()
+	if opts != nil {
+		*mirrorOpts = *opts
+	}
+	mirrorOpts.SetUpsert(res.UpsertedID != nil)
+	if res.UpsertedID != nil {
+		// Equality conditions of $and are copied into upserted documents
+		filter = bson.D{{Key: "$and", Value: bson.A{filter, bson.D{{Key: "_id", Value: res.UpsertedID}}}}}
+	}
+	s.enqueue(ctx, operation, database, collection, func(ctx context.Context, target db.DataStore) error {
+		_, err := fn(target, ctx, database, collection, filter, update, mirrorOpts)
+		return err
+	})
+}
+
+// DeleteOne deletes on the primary and mirrors the delete when it removed
+// a document
+func (s *Store) DeleteOne(ctx context.Context, database, collection string, filter interface{}) (*mongo.DeleteResult, error) {
+	res, err := s.DataStore.DeleteOne(ctx, database, collection, filter)
+	if err == nil && res != nil && res.DeletedCount > 0 {
+		s.enqueue(ctx, "deleteOne", database, collection, func(ctx context.Context, target db.DataStore) error {
+			_, err := target.DeleteOne(ctx, database, collection, filter)
+			return err
+		})
+	}
+	return res, err
+}
+
+// DeleteMany deletes on the primary and mirrors the delete when it removed
+// documents
+func (s *Store) DeleteMany(ctx context.Context, database, collection string, filter interface{}) (*mongo.DeleteResult, error) {
+	res, err := s.DataStore.DeleteMany(ctx, database, collection, filter)
+	if err == nil && res != nil && res.DeletedCount > 0 {
+		s.enqueue(ctx, "deleteMany", database, collection, func(ctx context.Context, target db.DataStore) error {
+			_, err := target.DeleteMany(ctx, database, collection, filter)
+			return err
+		})
+	}
+	return res, err
+}
+
+// AggregateWrite runs a $out or $merge pipeline on the primary and then on
+// the target, where it reads the mirrored source collection
+func (s *Store) AggregateWrite(ctx context.Context, database, collection string, pipeline interface{}) error {
+	if err := s.DataStore.AggregateWrite(ctx, database, collection, pipeline); err != nil {
+		return err
+	}
+	s.enqueue(ctx, "aggregateWrite", database, collection, func(ctx context.Context, target db.DataStore) error {
+		return target.AggregateWrite(ctx, database, collection, pipeline)
+	})
+	return nil
+}
+
+// CreateIndex creates an index on the primary and the target
+func (s *Store) CreateIndex(ctx context.Context, database, collection string, index db.Index) (string, error) {
+	name, err := s.DataStore.CreateIndex(ctx, database, collection, index)
+	if err == nil {
+		s.enqueue(ctx, "createIndex", database, collection, func(ctx context.Context, target db.DataStore) error {
+			_, err := target.CreateIndex(ctx, database, collection, index)
+			return err
+		})
+	}
+	return name, err
+}
+
+// DropIndex drops an index on the primary and the target
+func (s *Store) DropIndex(ctx context.Context, database, collection, name string) error {
+	if err := s.DataStore.DropIndex(ctx, database, collection, name); err != nil {
+		return err
+	}
+	s.enqueue(ctx, "dropIndex", database, collection, func(ctx context.Context, target db.DataStore) error {
+		return target.DropIndex(ctx, database, collection, name)
+	})
+	return nil
+}
+
+// SetIndexExpiry changes a TTL index on the primary and the target
+func (s *Store) SetIndexExpiry(ctx context.Context, database, collection, name string, seconds int64) error {
+	if err := s.DataStore.SetIndexExpiry(ctx, database, collection, name, seconds); err != nil {
+		return err
+	}
+	s.enqueue(ctx, "setIndexExpiry", database, collection, func(ctx context.Context, target db.DataStore) error {
+		return target.SetIndexExpiry(ctx, database, collection, name, seconds)
+	})
+	return nil
+}
+
+// withID returns a copy of document with the _id the primary inserted it
+// with, which the driver does not add to the caller's document
+func withID(document, id interface{}) (bson.D, error) {
+	raw, err := bson.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.D
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	for _, e := range doc {
+		if e.Key == "_id" {
+			return doc, nil
+		}
+	}
+	return append(bson.D{{Key: "_id", Value: id}}, doc...), nil
+}
@@ -0,0 +1,76 @@
+package mirror
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"mongo-data-api-go-alternative/config"
+	memstore "mongo-data-api-go-alternative/db/memory"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// waitFor polls the mirror's status until done returns true
+func waitFor(t *testing.T, s *Store, done func(Status) bool) Status {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		st := s.Status()
+		if done(st) {
+			return st
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("status %+v", st)
+		}
+	}
+}
+
+func TestDualWrite(t *testing.T) {
+	ctx := context.Background()
+	primary, target := memstore.New(), memstore.New()
+	store := New(primary, target, config.DualWriteConfig{Cluster: "next"})
+
+	if _, err := store.InsertOne(ctx, "app", "users", bson.D{{Key: "name", Value: "ann"}}); err != nil {
+		t.Fatal(err)
+	}
+	upsert := options.Update().SetUpsert(true)
+	if _, err := store.UpdateOne(ctx, "app", "users", bson.D{{Key: "name", Value: "bob"}}, bson.D{{Key: "$set", Value: bson.D{{Key: "age", Value: 3}}}}, upsert); err != nil {
+		t.Fatal(err)
+	}
+	// Neither matches, so nothing is mirrored
+	if _, err := store.UpdateOne(ctx, "app", "users", bson.D{{Key: "name", Value: "cy"}}, bson.D{{Key: "$set", Value: bson.D{{Key: "age", Value: 4}}}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.DeleteOne(ctx, "app", "users", bson.D{{Key: "name", Value: "cy"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	status := waitFor(t, store, func(st Status) bool { return st.Queued == 0 && st.Mirrored == 2 })
+	if status.Failed != 0 || status.Cluster != "next" {
+		t.Fatalf("status %+v", status)
+	}
+	sorted := options.Find().SetSort(bson.D{{Key: "name", Value: 1}})
+	want, _ := primary.Find(ctx, "app", "users", bson.D{}, sorted)
+	got, _ := target.Find(ctx, "app", "users", bson.D{}, sorted)
+	if len(want) != 2 || !reflect.DeepEqual(got, want) {
+		t.Errorf("target %v, want %v", got, want)
+	}
+
+	// A document written to the target only is found by reconciling
+	if _, err := target.InsertOne(ctx, "app", "users", bson.D{{Key: "name", Value: "stray"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Reconcile("app", "users"); err != nil {
+		t.Fatal(err)
+	}
+	status = waitFor(t, store, func(st Status) bool { return st.Reconciliations[0].State != "running" })
+	if r := status.Reconciliations[0]; r.State != "done" || r.Compared != 2 || r.Extra != 1 || r.Missing != 0 || r.Different != 0 {
+		t.Errorf("reconciliation %+v", r)
+	}
+
+	if queued := store.Retry(); queued != 0 {
+		t.Errorf("retried %d writes, want 0", queued)
+	}
+}
@@ -0,0 +1,171 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// reconcileBatch is the number of documents compared at once
+	reconcileBatch = 500
+	// maxSamples bounds the _ids of differing documents reported
+	maxSamples = 20
+)
+
+// ErrReconciling is returned when a collection is already being reconciled
+var ErrReconciling = errors.New("already being reconciled")
+
+// Reconciliation compares a collection on the primary and the target
+type Reconciliation struct {
+	Database   string     `json:"database"`
+	Collection string     `json:"collection"`
+	State      string     `json:"state"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	Compared   int64      `json:"compared"`
+	// Missing counts documents only on the primary, Extra documents only on
+	// the target and Different documents whose contents differ
+	Missing   int64         `json:"missing"`
+	Extra     int64         `json:"extra"`
+	Different int64         `json:"different"`
+	Samples   []interface{} `json:"samples"`
+}
+
+// Reconcile starts comparing a collection on the primary and the target in
+// the background. It fails when the collection is already being compared.
+func (s *Store) Reconcile(database, collection string) (Reconciliation, error) {
+	key := database + "." + collection
+	s.mu.Lock()
+	if r, ok := s.reconciliations[key]; ok && r.State == "running" {
+		s.mu.Unlock()
+		return *r, fmt.Errorf("%s is %w", key, ErrReconciling)
+	}
+	r := &Reconciliation{
+		Database:   database,
+		Collection: collection,
+		State:      "running",
+		StartedAt:  time.Now().UTC(),
+		Samples:    []interface{}{},
+	}
+	s.reconciliations[key] = r
+	started := *r
+	s.mu.Unlock()
+
+	go func() {
+		err := s.reconcile(context.Background(), r)
+		now := time.Now().UTC()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		r.FinishedAt = &now
+		r.State = "done"
+		if err != nil {
+			r.State = "failed"
+			r.Error = err.Error()
+			log.Printf("Failed to reconcile %s with cluster %s: %v", key, s.cluster, err)
+		}
+	}()
+	return started, nil
+}
+
+// reconcile walks the primary collection in _id order, comparing each batch
+// with the target documents in the same _id range
+func (s *Store) reconcile(ctx context.Context, r *Reconciliation) error {
+	var last interface{}
+	for {
+		filter := bson.D{}
+		if last != nil {
+			filter = bson.D{{Key: "_id", Value: bson.D{{Key: "$gt", Value: last}}}}
+		}
+		opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(reconcileBatch)
+		primary, err := s.DataStore.Find(ctx, r.Database, r.Collection, filter, opts)
+		if err != nil {
+			return err
+		}
+		if len(primary) == 0 {
+			break
+		}
+
+		upper := primary[len(primary)-1]["_id"]
+		rng := bson.D{{Key: "$lte", Value: upper}}
+		if last != nil {
+			rng = append(rng, bson.E{Key: "$gt", Value: last})
+		}
+		target, err := s.target.Find(ctx, r.Database, r.Collection, bson.D{{Key: "_id", Value: rng}}, options.Find())
+		if err != nil {
+			return err
+		}
+		s.compare(r, primary, target)
+		last = upper
+		if len(primary) < reconcileBatch {
+			break
+		}
+	}
+
+	// Target documents past the last primary one are extra
+	filter := bson.D{}
+	if last != nil {
+		filter = bson.D{{Key: "_id", Value: bson.D{{Key: "$gt", Value: last}}}}
+	}
+	extra, err := s.target.CountDocuments(ctx, r.Database, r.Collection, filter)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	r.Extra += extra
+	s.mu.Unlock()
+	return nil
+}
+
+// compare counts the differences between a batch of primary documents and
+// the target documents in the same _id range
+func (s *Store) compare(r *Reconciliation, primary, target []bson.M) {
+	byID := make(map[string]bson.M, len(target))
+	for _, doc := range target {
+		byID[idKey(doc["_id"])] = doc
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, doc := range primary {
+		key := idKey(doc["_id"])
+		other, ok := byID[key]
+		delete(byID, key)
+		r.Compared++
+		switch {
+		case !ok:
+			r.Missing++
+		case !reflect.DeepEqual(doc, other):
+			r.Different++
+		default:
+			continue
+		}
+		r.sample(doc["_id"])
+	}
+	for _, doc := range byID {
+		r.Extra++
+		r.sample(doc["_id"])
+	}
+}
+
+func (r *Reconciliation) sample(id interface{}) {
+	if len(r.Samples) < maxSamples {
+		r.Samples = append(r.Samples, id)
+	}
+}
+
+// idKey identifies an _id across stores by its BSON encoding
+func idKey(id interface{}) string {
+	t, data, err := bson.MarshalValue(id)
+	if err != nil {
+		return fmt.Sprint(id)
+	}
+	return string(rune(t)) + string(data)
+}
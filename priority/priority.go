@@ -0,0 +1,238 @@
+// Package priority bounds the requests served at once and queues the others
+// by priority class, serving interactive requests ahead of batch ones
+// without starving the latter
+package priority
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"mongo-data-api-go-alternative/config"
+)
+
+// Classes lists the priority classes, highest first
+var Classes = []string{config.PriorityInteractive, config.PriorityBatch}
+
+var (
+	// ErrQueueFull is returned for a request arriving while the queue is
+	// full
+	ErrQueueFull = errors.New("request queue is full")
+	// ErrQueueTimeout is returned for a request that waited longer than
+	// the queue timeout
+	ErrQueueTimeout = errors.New("request waited too long in the queue")
+)
+
+// Stats are the counters of a priority class
+type Stats struct {
+	// InFlight and Queued are the requests being served and waiting
+	InFlight int
+	Queued   int
+	// Admitted counts the requests served, Promoted those of them served
+	// ahead of higher classes after waiting the starvation limit
+	Admitted int64
+	Promoted int64
+	// Rejected counts the requests turned away by a full queue and
+	// TimedOut those that waited too long
+	Rejected int64
+	TimedOut int64
+	// WaitSeconds is the time spent waiting by the requests admitted
+	WaitSeconds float64
+}
+
+// Queue is a concurrency limiter with a FIFO queue per priority class
+type Queue struct {
+	max        int
+	maxQueued  int
+	timeout    time.Duration
+	starvation time.Duration
+	now        func() time.Time
+
+	mu       sync.Mutex
+	inFlight int
+	waiting  map[string][]*waiter
+	stats    map[string]*Stats
+}
+
+// waiter is a queued request; ready is closed once it holds a slot
+type waiter struct {
+	class    string
+	enqueued time.Time
+	ready    chan struct{}
+	admitted bool
+}
+
+// New creates the queue configured by cfg, or returns nil when
+// cfg.MaxConcurrent is 0
+func New(cfg config.RequestQueueConfig) *Queue {
+	if cfg.MaxConcurrent <= 0 {
+		return nil
+	}
+	q := &Queue{
+		max:        cfg.MaxConcurrent,
+		maxQueued:  cfg.MaxQueued,
+		timeout:    time.Duration(cfg.TimeoutMs) * time.Millisecond,
+		starvation: time.Duration(cfg.StarvationMs) * time.Millisecond,
+		now:        time.Now,
+		waiting:    make(map[string][]*waiter),
+		stats:      make(map[string]*Stats),
+	}
+	for _, class := range Classes {
+		q.stats[class] = &Stats{}
+	}
+	return q
+}
+
+// Class returns the priority class of a key's priority setting
+func Class(priority string) string {
+	if priority == config.PriorityBatch {
+		return config.PriorityBatch
+	}
+	return config.PriorityInteractive
+}
+
+// Acquire waits for a slot for a request of class and returns the function
+// releasing it. Requests are admitted right away while slots are free and
+// no other request waits.
+func (q *Queue) Acquire(ctx context.Context, class string) (func(), error) {
+	class = Class(class)
+	q.mu.Lock()
+	stats := q.stats[class]
+	if q.inFlight < q.max && q.queued() == 0 {
+		q.inFlight++
+		stats.InFlight++
+		stats.Admitted++
+		q.mu.Unlock()
+		return q.releaser(class), nil
+	}
+	if q.maxQueued > 0 && q.queued() >= q.maxQueued {
+		stats.Rejected++
+		q.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+	w := &waiter{class: class, enqueued: q.now(), ready: make(chan struct{})}
+	q.waiting[class] = append(q.waiting[class], w)
+	stats.Queued++
+	q.mu.Unlock()
+
+	var expired <-chan time.Time
+	if q.timeout > 0 {
+		timer := time.NewTimer(q.timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	var err error
+	select {
+	case <-w.ready:
+		return q.releaser(class), nil
+	case <-expired:
+		err = ErrQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if !q.leave(w, err) {
+		// Admitted while giving up
+		return q.releaser(class), nil
+	}
+	return nil, err
+}
+
+// leave removes a waiter giving up with err, unless it was admitted in the
+// meantime, and reports whether it was removed
+func (q *Queue) leave(w *waiter, err error) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if w.admitted {
+		return false
+	}
+	queue := q.waiting[w.class]
+	for i, other := range queue {
+		if other == w {
+			q.waiting[w.class] = append(queue[:i:i], queue[i+1:]...)
+			break
+		}
+	}
+	stats := q.stats[w.class]
+	stats.Queued--
+	if errors.Is(err, ErrQueueTimeout) {
+		stats.TimedOut++
+	}
+	return true
+}
+
+// releaser returns the function releasing a slot of class, which only
+// releases it once
+func (q *Queue) releaser(class string) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			q.release(class)
+			q.mu.Unlock()
+		})
+	}
+}
+
+// release frees a slot of class and admits the waiters that fit
+func (q *Queue) release(class string) {
+	q.inFlight--
+	q.stats[class].InFlight--
+	for q.inFlight < q.max {
+		w, promoted := q.next()
+		if w == nil {
+			return
+		}
+		q.waiting[w.class] = q.waiting[w.class][1:]
+		stats := q.stats[w.class]
+		stats.Queued--
+		stats.InFlight++
+		stats.Admitted++
+		if promoted {
+			stats.Promoted++
+		}
+		stats.WaitSeconds += q.now().Sub(w.enqueued).Seconds()
+		q.inFlight++
+		w.admitted = true
+		close(w.ready)
+	}
+}
+
+// next returns the waiter to admit: the oldest of a lower class that waited
+// the starvation limit, or else the oldest of the highest class waiting.
+// promoted reports whether it was picked for its wait.
+func (q *Queue) next() (w *waiter, promoted bool) {
+	now := q.now()
+	for i, class := range Classes {
+		queue := q.waiting[class]
+		if len(queue) == 0 {
+			continue
+		}
+		if w == nil {
+			w = queue[0]
+			continue
+		}
+		if i > 0 && q.starvation > 0 && now.Sub(queue[0].enqueued) >= q.starvation {
+			return queue[0], true
+		}
+	}
+	return w, false
+}
+
+func (q *Queue) queued() int {
+	n := 0
+	for _, queue := range q.waiting {
+		n += len(queue)
+	}
+	return n
+}
+
+// Stats returns the counters of class
+func (q *Queue) Stats(class string) Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if s, ok := q.stats[class]; ok {
+		return *s
+	}
+	return Stats{}
+}
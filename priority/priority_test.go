@@ -0,0 +1,97 @@
+package priority
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"mongo-data-api-go-alternative/config"
+)
+
+func TestRequestQueue(t *testing.T) {
+	// run admits a first interactive request, holds it while a batch
+	// request and, wait later, another interactive one queue up, and returns
+	// the order the requests were admitted in
+	run := func(starvation, wait time.Duration) []string {
+		queue := New(config.RequestQueueConfig{MaxConcurrent: 1, TimeoutMs: 5000, StarvationMs: int(starvation.Milliseconds())})
+		served := make(chan string, 3)
+		var wg sync.WaitGroup
+		send := func(name, class string) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				release, err := queue.Acquire(context.Background(), class)
+				if err != nil {
+					t.Errorf("%s: %v", name, err)
+					return
+				}
+				served <- name
+				release()
+			}()
+		}
+		waitQueued := func(class string) {
+			for deadline := time.Now().Add(5 * time.Second); queue.Stats(class).Queued == 0; time.Sleep(time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatalf("no %s request queued", class)
+				}
+			}
+		}
+		release, err := queue.Acquire(context.Background(), config.PriorityInteractive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		send("batch", config.PriorityBatch)
+		waitQueued(config.PriorityBatch)
+		time.Sleep(wait)
+		send("interactive", config.PriorityInteractive)
+		waitQueued(config.PriorityInteractive)
+		release()
+		wg.Wait()
+		return []string{<-served, <-served}
+	}
+
+	// Interactive requests are served ahead of batch ones...
+	if order := run(time.Minute, 0); !reflect.DeepEqual(order, []string{"interactive", "batch"}) {
+		t.Errorf("order %v", order)
+	}
+	// ...unless those waited the starvation limit
+	if order := run(50*time.Millisecond, 100*time.Millisecond); !reflect.DeepEqual(order, []string{"batch", "interactive"}) {
+		t.Errorf("starved order %v", order)
+	}
+}
+
+func TestQueueLimits(t *testing.T) {
+	queue := New(config.RequestQueueConfig{MaxConcurrent: 1, MaxQueued: 1, TimeoutMs: 20})
+	release, err := queue.Acquire(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The queued request times out while the full queue rejects the next
+	done := make(chan error)
+	go func() {
+		_, err := queue.Acquire(context.Background(), config.PriorityBatch)
+		done <- err
+	}()
+	for deadline := time.Now().Add(5 * time.Second); queue.Stats(config.PriorityBatch).Queued == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no batch request queued")
+		}
+	}
+	if _, err := queue.Acquire(context.Background(), config.PriorityInteractive); err != ErrQueueFull {
+		t.Errorf("third request: %v, want ErrQueueFull", err)
+	}
+	if err := <-done; err != ErrQueueTimeout {
+		t.Errorf("queued request: %v, want ErrQueueTimeout", err)
+	}
+	release()
+
+	batch, interactive := queue.Stats(config.PriorityBatch), queue.Stats(config.PriorityInteractive)
+	if batch.TimedOut != 1 || batch.Queued != 0 || interactive.Rejected != 1 || interactive.Admitted != 1 || interactive.InFlight != 0 {
+		t.Errorf("stats: batch %+v, interactive %+v", batch, interactive)
+	}
+	if New(config.RequestQueueConfig{}) != nil {
+		t.Error("queue created without MaxConcurrent")
+	}
+}
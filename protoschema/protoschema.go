@@ -0,0 +1,326 @@
+// Package protoschema encodes documents as protobuf messages described by
+// .proto files, for clients that want typed, compact payloads.
+package protoschema
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"mongo-data-api-go-alternative/config"
+
+	"github.com/bufbuild/protocompile"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Registry holds the message descriptors of the collections with a schema
+type Registry struct {
+	messages map[string]protoreflect.MessageDescriptor
+}
+
+// Load compiles the .proto files of schemas, keyed by
+// "database.collection"
+func Load(schemas map[string]config.ProtoSchema) (*Registry, error) {
+	r := &Registry{messages: make(map[string]protoreflect.MessageDescriptor, len(schemas))}
+	for ns, s := range schemas {
+		md, err := compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("protobuf schema of %s: %w", ns, err)
+		}
+		r.messages[ns] = md
+	}
+	return r, nil
+}
+
+func compile(s config.ProtoSchema) (protoreflect.MessageDescriptor, error) {
+	dir, file := filepath.Split(s.File)
+	if dir == "" {
+		dir = "."
+	}
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.WithStandardImports(&protocompile.SourceResolver{ImportPaths: append([]string{dir}, s.ImportPaths...)}),
+	}
+	files, err := compiler.Compile(context.Background(), file)
+	if err != nil {
+		return nil, err
+	}
+	md, ok := files[0].FindDescriptorByName(protoreflect.FullName(s.Message)).(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("message %s not found in %s", s.Message, s.File)
+	}
+	return md, nil
+}
+
+// Message returns the message the documents of a collection are encoded
+// as, or nil when it has no schema
+func (r *Registry) Message(database, collection string) protoreflect.MessageDescriptor {
+	if r == nil {
+		return nil
+	}
+	return r.messages[database+"."+collection]
+}
+
+// AppendDelimited appends doc encoded as md to b, prefixed with its length
+// as a varint, so that a sequence of documents can be read back one by one
+func AppendDelimited(b []byte, md protoreflect.MessageDescriptor, doc interface{}) ([]byte, error) {
+	msg := dynamicpb.NewMessage(md)
+	if err := setFields(msg, doc); err != nil {
+		return b, err
+	}
+	encoded, err := proto.Marshal(msg)
+	if err != nil {
+		return b, err
+	}
+	b = protowire.AppendVarint(b, uint64(len(encoded)))
+	return append(b, encoded...), nil
+}
+
+// setFields sets the fields of msg from the document fields of the same
+// name or JSON name. A field named id holds the document's _id unless the
+// document has an id of its own. Document fields the message lacks are
+// left out.
+func setFields(msg protoreflect.Message, doc interface{}) error {
+	values, err := documentFields(doc)
+	if err != nil {
+		return err
+	}
+	fields := msg.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		v, ok := values[string(fd.Name())]
+		if !ok {
+			v, ok = values[fd.JSONName()]
+		}
+		if !ok && fd.Name() == "id" {
+			v, ok = values["_id"]
+		}
+		if !ok || v == nil {
+			continue
+		}
+		if err := setField(msg, fd, v); err != nil {
+			return fmt.Errorf("%s: %w", fd.Name(), err)
+		}
+	}
+	return nil
+}
+
+func setField(msg protoreflect.Message, fd protoreflect.FieldDescriptor, v interface{}) error {
+	switch {
+	case fd.IsMap():
+		entries, err := documentFields(v)
+		if err != nil {
+			return err
+		}
+		m := msg.Mutable(fd).Map()
+		for k, item := range entries {
+			key, err := mapKey(fd.MapKey(), k)
+			if err != nil {
+				return err
+			}
+			val, err := fieldValue(fd.MapValue(), item, m.NewValue)
+			if err != nil {
+				return fmt.Errorf("%s: %w", k, err)
+			}
+			m.Set(key, val)
+		}
+	case fd.IsList():
+		items, ok := v.(bson.A)
+		if !ok {
+			return fmt.Errorf("expected an array, got %T", v)
+		}
+		list := msg.Mutable(fd).List()
+		for i, item := range items {
+			val, err := fieldValue(fd, item, list.NewElement)
+			if err != nil {
+				return fmt.Errorf("%d: %w", i, err)
+			}
+			list.Append(val)
+		}
+	default:
+		val, err := fieldValue(fd, v, func() protoreflect.Value { return msg.NewField(fd) })
+		if err != nil {
+			return err
+		}
+		msg.Set(fd, val)
+	}
+	return nil
+}
+
+// fieldValue converts a single value of fd; newMessage returns an empty
+// message value for message fields
+func fieldValue(fd protoreflect.FieldDescriptor, v interface{}, newMessage func() protoreflect.Value) (protoreflect.Value, error) {
+	if fd.Message() == nil {
+		return scalarValue(fd, v)
+	}
+	val := newMessage()
+	msg := val.Message()
+	if msg.Descriptor().FullName() == "google.protobuf.Timestamp" {
+		d, ok := v.(primitive.DateTime)
+		if !ok {
+			return val, fmt.Errorf("expected a date, got %T", v)
+		}
+		t := d.Time()
+		fields := msg.Descriptor().Fields()
+		msg.Set(fields.ByName("seconds"), protoreflect.ValueOfInt64(t.Unix()))
+		msg.Set(fields.ByName("nanos"), protoreflect.ValueOfInt32(int32(t.Nanosecond())))
+		return val, nil
+	}
+	return val, setFields(msg, v)
+}
+
+func scalarValue(fd protoreflect.FieldDescriptor, v interface{}) (protoreflect.Value, error) {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		if b, ok := v.(bool); ok {
+			return protoreflect.ValueOfBool(b), nil
+		}
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		if n, ok := integer(v); ok && n >= math.MinInt32 && n <= math.MaxInt32 {
+			return protoreflect.ValueOfInt32(int32(n)), nil
+		}
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		if n, ok := integer(v); ok {
+			return protoreflect.ValueOfInt64(n), nil
+		}
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		if n, ok := integer(v); ok && n >= 0 && n <= math.MaxUint32 {
+			return protoreflect.ValueOfUint32(uint32(n)), nil
+		}
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		if n, ok := integer(v); ok && n >= 0 {
+			return protoreflect.ValueOfUint64(uint64(n)), nil
+		}
+	case protoreflect.FloatKind:
+		if f, ok := float(v); ok {
+			return protoreflect.ValueOfFloat32(float32(f)), nil
+		}
+	case protoreflect.DoubleKind:
+		if f, ok := float(v); ok {
+			return protoreflect.ValueOfFloat64(f), nil
+		}
+	case protoreflect.StringKind:
+		if s, ok := text(v); ok {
+			return protoreflect.ValueOfString(s), nil
+		}
+	case protoreflect.BytesKind:
+		switch b := v.(type) {
+		case primitive.Binary:
+			return protoreflect.ValueOfBytes(b.Data), nil
+		case primitive.ObjectID:
+			return protoreflect.ValueOfBytes(b[:]), nil
+		case string:
+			return protoreflect.ValueOfBytes([]byte(b)), nil
+		}
+	case protoreflect.EnumKind:
+		if s, ok := v.(string); ok {
+			if ev := fd.Enum().Values().ByName(protoreflect.Name(s)); ev != nil {
+				return protoreflect.ValueOfEnum(ev.Number()), nil
+			}
+			return protoreflect.Value{}, fmt.Errorf("unknown %s value %q", fd.Enum().FullName(), s)
+		}
+		if n, ok := integer(v); ok && n >= math.MinInt32 && n <= math.MaxInt32 {
+			return protoreflect.ValueOfEnum(protoreflect.EnumNumber(n)), nil
+		}
+	}
+	return protoreflect.Value{}, fmt.Errorf("cannot encode %T as %s", v, fd.Kind())
+}
+
+// mapKey converts the field name of a document encoding a map to a key of
+// the map's key kind
+func mapKey(fd protoreflect.FieldDescriptor, k string) (protoreflect.MapKey, error) {
+	var v interface{} = k
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+	case protoreflect.BoolKind:
+		b, err := strconv.ParseBool(k)
+		if err != nil {
+			return protoreflect.MapKey{}, fmt.Errorf("invalid %s key %q", fd.Kind(), k)
+		}
+		v = b
+	default:
+		n, err := strconv.ParseInt(k, 10, 64)
+		if err != nil {
+			return protoreflect.MapKey{}, fmt.Errorf("invalid %s key %q", fd.Kind(), k)
+		}
+		v = n
+	}
+	val, err := scalarValue(fd, v)
+	if err != nil {
+		return protoreflect.MapKey{}, err
+	}
+	return val.MapKey(), nil
+}
+
+// integer returns v as an int64 if it is a whole number
+func integer(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case int:
+		return int64(n), true
+	case float64:
+		if n == math.Trunc(n) && n >= math.MinInt64 && n <= math.MaxInt64 {
+			return int64(n), true
+		}
+	}
+	return 0, false
+}
+
+func float(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// text renders the values that have a natural string form
+func text(v interface{}) (string, bool) {
+	switch s := v.(type) {
+	case string:
+		return s, true
+	case primitive.ObjectID:
+		return s.Hex(), true
+	case primitive.DateTime:
+		return s.Time().UTC().Format(time.RFC3339Nano), true
+	case primitive.Decimal128:
+		return s.String(), true
+	case int32, int64, int, float64:
+		return fmt.Sprint(s), true
+	}
+	return "", false
+}
+
+// documentFields returns the fields of a document decoded as a map or
+// bson.D
+func documentFields(doc interface{}) (map[string]interface{}, error) {
+	switch d := doc.(type) {
+	case bson.M:
+		return d, nil
+	case map[string]interface{}:
+		return d, nil
+	case bson.D:
+		m := make(map[string]interface{}, len(d))
+		for _, e := range d {
+			m[e.Key] = e.Value
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("expected a document, got %T", doc)
+}
@@ -0,0 +1,307 @@
+package query
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ParseExpression translates an OData-style filter expression such as
+//
+//	status eq 'active' and (age gt 30 or vip eq true)
+//
+// into a MongoDB filter. It supports the comparisons eq, ne, gt, ge, lt, le
+// and in, the functions contains, startswith and endswith, and, or, not and
+// parentheses. Values are 'quoted strings', with quotes in them doubled,
+// numbers, true, false, null and dates such as 2024-01-02 or
+// 2024-01-02T03:04:05Z. Nested fields are written with "/" or ".".
+func ParseExpression(expr string) (bson.D, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	filter, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.unexpected(t)
+	}
+	return filter, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokString
+	tokLiteral
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func tokenize(expr string) ([]token, error) {
+	var tokens []token
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')' || r == ',':
+			tokens = append(tokens, token{tokPunct, string(r), i})
+			i++
+		case r == '\'':
+			var sb strings.Builder
+			start := i
+			for i++; ; i++ {
+				if i == len(runes) {
+					return nil, fmt.Errorf("unterminated string at position %d", start)
+				}
+				if runes[i] == '\'' {
+					if i+1 < len(runes) && runes[i+1] == '\'' {
+						sb.WriteRune('\'')
+						i++
+						continue
+					}
+					i++
+					break
+				}
+				sb.WriteRune(runes[i])
+			}
+			tokens = append(tokens, token{tokString, sb.String(), start})
+		case unicode.IsDigit(r) || r == '-' || r == '+':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || strings.ContainsRune("-+:.", runes[i])) {
+				i++
+			}
+			tokens = append(tokens, token{tokLiteral, string(runes[start:i]), start})
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || strings.ContainsRune("_./", runes[i])) {
+				i++
+			}
+			tokens = append(tokens, token{tokWord, string(runes[start:i]), start})
+		default:
+			return nil, fmt.Errorf("unexpected %q at position %d", r, i)
+		}
+	}
+	return append(tokens, token{tokEOF, "", len(runes)}), nil
+}
+
+type exprParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *exprParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// keyword reports whether the next token is the keyword kw, consuming it
+func (p *exprParser) keyword(kw string) bool {
+	if t := p.peek(); t.kind == tokWord && strings.EqualFold(t.text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) punct(s string) error {
+	if t := p.next(); t.kind != tokPunct || t.text != s {
+		return fmt.Errorf("expected %q at position %d", s, t.pos)
+	}
+	return nil
+}
+
+func (p *exprParser) unexpected(t token) error {
+	if t.kind == tokEOF {
+		return fmt.Errorf("unexpected end of expression")
+	}
+	return fmt.Errorf("unexpected %q at position %d", t.text, t.pos)
+}
+
+func (p *exprParser) or() (bson.D, error) {
+	return p.chain("or", "$or", p.and)
+}
+
+func (p *exprParser) and() (bson.D, error) {
+	return p.chain("and", "$and", p.unary)
+}
+
+// chain parses operands joined by kw into a single op clause
+func (p *exprParser) chain(kw, op string, operand func() (bson.D, error)) (bson.D, error) {
+	first, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	clauses := bson.A{first}
+	for p.keyword(kw) {
+		next, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, next)
+	}
+	if len(clauses) == 1 {
+		return first, nil
+	}
+	return bson.D{{Key: op, Value: clauses}}, nil
+}
+
+func (p *exprParser) unary() (bson.D, error) {
+	if p.keyword("not") {
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return bson.D{{Key: "$nor", Value: bson.A{operand}}}, nil
+	}
+	if t := p.peek(); t.kind == tokPunct && t.text == "(" {
+		p.next()
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.punct(")")
+	}
+	return p.predicate()
+}
+
+// comparisons maps the comparison operators to query operators
+var comparisons = map[string]string{"eq": "$eq", "ne": "$ne", "gt": "$gt", "ge": "$gte", "lt": "$lt", "le": "$lte"}
+
+// stringFunctions build the regular expression of a string function
+var stringFunctions = map[string]func(string) string{
+	"contains":   func(s string) string { return regexp.QuoteMeta(s) },
+	"startswith": func(s string) string { return "^" + regexp.QuoteMeta(s) },
+	"endswith":   func(s string) string { return regexp.QuoteMeta(s) + "$" },
+}
+
+func (p *exprParser) predicate() (bson.D, error) {
+	t := p.next()
+	if t.kind != tokWord {
+		return nil, p.unexpected(t)
+	}
+	if fn, ok := stringFunctions[strings.ToLower(t.text)]; ok && p.peek().kind == tokPunct && p.peek().text == "(" {
+		p.next()
+		field, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.punct(","); err != nil {
+			return nil, err
+		}
+		s := p.next()
+		if s.kind != tokString {
+			return nil, fmt.Errorf("%s needs a string at position %d", t.text, s.pos)
+		}
+		if err := p.punct(")"); err != nil {
+			return nil, err
+		}
+		return bson.D{{Key: field, Value: bson.D{{Key: "$regex", Value: fn(s.text)}}}}, nil
+	}
+
+	p.pos--
+	field, err := p.field()
+	if err != nil {
+		return nil, err
+	}
+	op := p.next()
+	if op.kind != tokWord {
+		return nil, p.unexpected(op)
+	}
+	switch strings.ToLower(op.text) {
+	case "in":
+		if err := p.punct("("); err != nil {
+			return nil, err
+		}
+		values := bson.A{}
+		for {
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+			if t := p.peek(); t.kind == tokPunct && t.text == "," {
+				p.next()
+				continue
+			}
+			break
+		}
+		if err := p.punct(")"); err != nil {
+			return nil, err
+		}
+		return bson.D{{Key: field, Value: bson.D{{Key: "$in", Value: values}}}}, nil
+	}
+	mongoOp, ok := comparisons[strings.ToLower(op.text)]
+	if !ok {
+		return nil, fmt.Errorf("unknown operator %q at position %d", op.text, op.pos)
+	}
+	v, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	return bson.D{{Key: field, Value: bson.D{{Key: mongoOp, Value: v}}}}, nil
+}
+
+// field reads a field name, turning OData's "/" separators into dots
+func (p *exprParser) field() (string, error) {
+	t := p.next()
+	if t.kind != tokWord {
+		return "", p.unexpected(t)
+	}
+	return strings.ReplaceAll(t.text, "/", "."), nil
+}
+
+func (p *exprParser) value() (interface{}, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		return t.text, nil
+	case tokWord:
+		switch strings.ToLower(t.text) {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+	case tokLiteral:
+		if n, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			return n, nil
+		}
+		if f, err := strconv.ParseFloat(t.text, 64); err == nil {
+			return f, nil
+		}
+		if d, err := time.Parse(time.RFC3339Nano, t.text); err == nil {
+			return d.UTC(), nil
+		}
+		if d, err := time.Parse(time.DateOnly, t.text); err == nil {
+			return d, nil
+		}
+		return nil, fmt.Errorf("invalid value %q at position %d", t.text, t.pos)
+	}
+	return nil, p.unexpected(t)
+}
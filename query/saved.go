@@ -0,0 +1,417 @@
+package query
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"mongo-data-api-go-alternative/config"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Registry errors
+var (
+	ErrNotFound = errors.New("not found")
+	ErrReadOnly = errors.New("defined in configuration and cannot be modified")
+)
+
+// Registry holds saved queries. Queries from the configuration are
+// read-only; queries created through the admin API are persisted in the
+// system database.
+type Registry struct {
+	mu      sync.RWMutex
+	queries map[string]savedEntry
+	coll    *mongo.Collection
+}
+
+type savedEntry struct {
+	config.SavedQuery
+	static bool
+}
+
+// storedQuery is the persisted form of a saved query. The definition is kept
+// as JSON because templates contain $-prefixed keys.
+type storedQuery struct {
+	Name       string `bson:"_id"`
+	Definition string `bson:"definition"`
+}
+
+// NewRegistry builds a registry from the configured saved queries
+func NewRegistry(queries []config.SavedQuery) (*Registry, error) {
+	r := &Registry{queries: make(map[string]savedEntry)}
+	if err := r.SetStatic(queries); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// SetStatic replaces the queries from the configuration, e.g. when it is
+// reloaded. They take precedence over persisted queries of the same name;
+// persisted queries they shadowed come back with the next Reload.
+func (r *Registry) SetStatic(queries []config.SavedQuery) error {
+	for _, q := range queries {
+		if err := ValidateSaved(q); err != nil {
+			return err
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, e := range r.queries {
+		if e.static {
+			delete(r.queries, name)
+		}
+	}
+	for _, q := range queries {
+		r.queries[q.Name] = savedEntry{SavedQuery: q, static: true}
+	}
+	return nil
+}
+
+// Attach enables persistence in coll and loads the queries stored there
+func (r *Registry) Attach(ctx context.Context, coll *mongo.Collection) error {
+	r.coll = coll
+	return r.Reload(ctx)
+}
+
+// StartRefresh periodically reloads persisted queries
+func (r *Registry) StartRefresh(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			if err := r.Reload(ctx); err != nil {
+				log.Printf("Failed to reload saved queries: %v", err)
+			}
+			cancel()
+		}
+	}()
+}
+
+// Reload replaces the persisted queries with the current database contents
+func (r *Registry) Reload(ctx context.Context) error {
+	if r.coll == nil {
+		return nil
+	}
+	var stored []storedQuery
+	cursor, err := r.coll.Find(ctx, bson.D{})
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(ctx, &stored); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, e := range r.queries {
+		if !e.static {
+			delete(r.queries, name)
+		}
+	}
+	for _, sq := range stored {
+		var q config.SavedQuery
+		if err := json.Unmarshal([]byte(sq.Definition), &q); err != nil {
+			log.Printf("Skipping invalid saved query %s: %v", sq.Name, err)
+			continue
+		}
+		if err := ValidateSaved(q); err != nil {
+			log.Printf("Skipping invalid saved query %s: %v", sq.Name, err)
+			continue
+		}
+		if e, ok := r.queries[q.Name]; ok && e.static {
+			continue
+		}
+		r.queries[q.Name] = savedEntry{SavedQuery: q}
+	}
+	return nil
+}
+
+// List returns all saved queries sorted by name
+func (r *Registry) List() []config.SavedQuery {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	list := make([]config.SavedQuery, 0, len(r.queries))
+	for _, e := range r.queries {
+		list = append(list, e.SavedQuery)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Get returns a saved query by name and whether it comes from the configuration
+func (r *Registry) Get(name string) (config.SavedQuery, bool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e, ok := r.queries[name]
+	if !ok {
+		return config.SavedQuery{}, false, fmt.Errorf("saved query %q %w", name, ErrNotFound)
+	}
+	return e.SavedQuery, e.static, nil
+}
+
+// Put creates or replaces a persisted saved query
+func (r *Registry) Put(ctx context.Context, q config.SavedQuery) error {
+	if err := ValidateSaved(q); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.queries[q.Name]; ok && e.static {
+		return fmt.Errorf("saved query %q is %w", q.Name, ErrReadOnly)
+	}
+	if r.coll != nil {
+		definition, err := json.Marshal(q)
+		if err != nil {
+			return err
+		}
+		opts := options.Replace().SetUpsert(true)
+		stored := storedQuery{Name: q.Name, Definition: string(definition)}
+		if _, err := r.coll.ReplaceOne(ctx, bson.D{{Key: "_id", Value: q.Name}}, stored, opts); err != nil {
+			return err
+		}
+	}
+	r.queries[q.Name] = savedEntry{SavedQuery: q}
+	return nil
+}
+
+// Delete removes a persisted saved query
+func (r *Registry) Delete(ctx context.Context, name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.queries[name]
+	if !ok {
+		return fmt.Errorf("saved query %q %w", name, ErrNotFound)
+	}
+	if e.static {
+		return fmt.Errorf("saved query %q is %w", name, ErrReadOnly)
+	}
+	if r.coll != nil {
+		if _, err := r.coll.DeleteOne(ctx, bson.D{{Key: "_id", Value: name}}); err != nil {
+			return err
+		}
+	}
+	delete(r.queries, name)
+	return nil
+}
+
+// Operations lists the operations a saved query may run, those of the data
+// endpoints taking a single request document
+var Operations = []string{
+	"insertOne", "insertMany",
+	"findOne", "find",
+	"updateOne", "updateMany",
+	"deleteOne", "deleteMany",
+	"aggregate",
+}
+
+var parameterTypes = map[string]bool{
+	"string": true, "int": true, "number": true, "bool": true, "date": true, "objectId": true,
+}
+
+// ValidateSaved checks a saved query definition and that every $param
+// reference is declared
+func ValidateSaved(q config.SavedQuery) error {
+	if q.Name == "" || strings.ContainsAny(q.Name, "/ ") {
+		return fmt.Errorf("invalid saved query name %q", q.Name)
+	}
+	if !slices.Contains(Operations, q.Operation) {
+		return fmt.Errorf("saved query %q: unknown operation %q", q.Name, q.Operation)
+	}
+	if q.Database == "" || q.Collection == "" {
+		return fmt.Errorf("saved query %q: database and collection are required", q.Name)
+	}
+	if q.Async && q.Operation != "aggregate" {
+		return fmt.Errorf("saved query %q: only aggregate queries can be async", q.Name)
+	}
+
+	declared := make(map[string]bool)
+	for _, p := range q.Parameters {
+		if p.Name == "" || !parameterTypes[p.Type] {
+			return fmt.Errorf("saved query %q: parameter %q has invalid type %q", q.Name, p.Name, p.Type)
+		}
+		declared[p.Name] = true
+	}
+
+	// Parameters are values, so the stages of a pipeline are fixed
+	for i, stage := range q.Pipeline {
+		if _, ok := paramRef(stage); ok {
+			return fmt.Errorf("saved query %q: pipeline stage %d cannot be a parameter", q.Name, i)
+		}
+	}
+
+	var undeclared []string
+	walkParams(templates(q), func(name string) {
+		if !declared[name] {
+			undeclared = append(undeclared, name)
+		}
+	})
+	if len(undeclared) > 0 {
+		return fmt.Errorf("saved query %q: undeclared parameters %s", q.Name, strings.Join(undeclared, ", "))
+	}
+	return nil
+}
+
+func templates(q config.SavedQuery) []interface{} {
+	return []interface{}{q.Document, q.Filter, q.Update, q.Projection, q.Sort, q.Pipeline}
+}
+
+func walkParams(v interface{}, fn func(string)) {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		if name, ok := paramRef(val); ok {
+			fn(name)
+			return
+		}
+		for _, item := range val {
+			walkParams(item, fn)
+		}
+	case []map[string]interface{}:
+		for _, item := range val {
+			walkParams(item, fn)
+		}
+	case []interface{}:
+		for _, item := range val {
+			walkParams(item, fn)
+		}
+	}
+}
+
+func paramRef(m map[string]interface{}) (string, bool) {
+	if len(m) != 1 {
+		return "", false
+	}
+	name, ok := m["$param"].(string)
+	return name, ok
+}
+
+// Bind substitutes parameter values into a saved query's templates. Values
+// are type-checked and converted to EJSON so they can never introduce
+// operators or stages.
+func Bind(q config.SavedQuery, params map[string]interface{}) (config.SavedQuery, error) {
+	values := make(map[string]interface{}, len(q.Parameters))
+	for _, p := range q.Parameters {
+		raw, ok := params[p.Name]
+		if !ok || raw == nil {
+			if p.Required {
+				return q, fmt.Errorf("parameter %q is required", p.Name)
+			}
+			raw = p.Default
+		}
+		v, err := convertParam(p, raw)
+		if err != nil {
+			return q, err
+		}
+		values[p.Name] = v
+	}
+	for name := range params {
+		if _, ok := values[name]; !ok {
+			return q, fmt.Errorf("unknown parameter %q", name)
+		}
+	}
+
+	bound := q
+	bound.Document, _ = substitute(q.Document, values).(map[string]interface{})
+	bound.Filter, _ = substitute(q.Filter, values).(map[string]interface{})
+	bound.Update, _ = substitute(q.Update, values).(map[string]interface{})
+	bound.Projection, _ = substitute(q.Projection, values).(map[string]interface{})
+	bound.Sort, _ = substitute(q.Sort, values).(map[string]interface{})
+	if q.Pipeline != nil {
+		bound.Pipeline = make([]map[string]interface{}, len(q.Pipeline))
+		for i, stage := range q.Pipeline {
+			bound.Pipeline[i], _ = substitute(stage, values).(map[string]interface{})
+		}
+	}
+	return bound, nil
+}
+
+func substitute(v interface{}, values map[string]interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		if val == nil {
+			return val
+		}
+		if name, ok := paramRef(val); ok {
+			return values[name]
+		}
+		out := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			out[k] = substitute(item, values)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			out[i] = substitute(item, values)
+		}
+		return out
+	}
+	return v
+}
+
+// convertParam checks a parameter value against its declared type and
+// returns its EJSON representation
+func convertParam(p config.Parameter, raw interface{}) (interface{}, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	invalid := fmt.Errorf("parameter %q must be of type %s", p.Name, p.Type)
+	switch p.Type {
+	case "string":
+		s, ok := raw.(string)
+		if !ok {
+			return nil, invalid
+		}
+		// Strings starting with $ would be field paths inside aggregation
+		// expressions
+		if strings.HasPrefix(s, "$") {
+			return nil, fmt.Errorf("parameter %q must not start with $", p.Name)
+		}
+		return s, nil
+	case "int":
+		f, ok := raw.(float64)
+		if !ok || f != math.Trunc(f) {
+			return nil, invalid
+		}
+		return map[string]interface{}{"$numberLong": fmt.Sprintf("%d", int64(f))}, nil
+	case "number":
+		f, ok := raw.(float64)
+		if !ok {
+			return nil, invalid
+		}
+		return f, nil
+	case "bool":
+		b, ok := raw.(bool)
+		if !ok {
+			return nil, invalid
+		}
+		return b, nil
+	case "date":
+		s, ok := raw.(string)
+		if !ok {
+			return nil, invalid
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, invalid
+		}
+		return map[string]interface{}{"$date": t.UTC().Format(time.RFC3339Nano)}, nil
+	case "objectId":
+		s, ok := raw.(string)
+		if b, err := hex.DecodeString(s); !ok || err != nil || len(b) != 12 {
+			return nil, invalid
+		}
+		return map[string]interface{}{"$oid": s}, nil
+	}
+	return nil, invalid
+}
@@ -0,0 +1,669 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// SQL is a SELECT statement compiled to a find, or to an aggregation when
+// it groups, aggregates or renames columns
+type SQL struct {
+	Database   string
+	Collection string
+	// Pipeline is set when the statement needs an aggregation; the find
+	// fields are empty then
+	Pipeline   bson.A
+	Filter     bson.D
+	Projection bson.D
+	Sort       bson.D
+	Limit      int64
+	Skip       int64
+}
+
+// sqlAggregates maps SQL aggregate functions to $group accumulators
+var sqlAggregates = map[string]string{"count": "$sum", "sum": "$sum", "avg": "$avg", "min": "$min", "max": "$max"}
+
+// sqlComparisons maps SQL comparison operators to query operators
+var sqlComparisons = map[string]string{"=": "$eq", "!=": "$ne", "<>": "$ne", "<": "$lt", "<=": "$lte", ">": "$gt", ">=": "$gte"}
+
+// column is an item of the select list
+type column struct {
+	field string
+	// fn is the lower-case aggregate function, if any; field is "*" for
+	// COUNT(*)
+	fn    string
+	alias string
+}
+
+func (c column) name() string {
+	switch {
+	case c.alias != "":
+		return c.alias
+	case c.fn == "count" && c.field == "*":
+		return "count"
+	case c.fn != "":
+		return c.fn + "_" + strings.ReplaceAll(c.field, ".", "_")
+	}
+	return c.field
+}
+
+// ParseSQL compiles a read-only SELECT statement of the form
+//
+//	SELECT columns FROM database.collection [WHERE condition]
+//	[GROUP BY fields] [ORDER BY field [ASC|DESC], ...] [LIMIT n [OFFSET m]]
+//
+// Columns are *, fields and COUNT, SUM, AVG, MIN and MAX aggregates, each
+// with an optional AS alias. Conditions use =, !=, <>, <, <=, >, >=,
+// [NOT] IN, [NOT] LIKE, [NOT] BETWEEN, IS [NOT] NULL, AND, OR, NOT and
+// parentheses.
+func ParseSQL(statement string) (*SQL, error) {
+	tokens, err := sqlTokenize(statement)
+	if err != nil {
+		return nil, err
+	}
+	p := &sqlParser{tokens: tokens}
+
+	if !p.keyword("select") {
+		return nil, errors.New("only SELECT statements are supported")
+	}
+	var columns []column
+	if !p.symbol("*") {
+		for {
+			col, err := p.column()
+			if err != nil {
+				return nil, err
+			}
+			columns = append(columns, col)
+			if !p.symbol(",") {
+				break
+			}
+		}
+	}
+
+	if !p.keyword("from") {
+		return nil, p.expected("FROM")
+	}
+	ns, err := p.identifier()
+	if err != nil {
+		return nil, err
+	}
+	q := &SQL{}
+	var ok bool
+	if q.Database, q.Collection, ok = strings.Cut(ns, "."); !ok || q.Database == "" || q.Collection == "" {
+		return nil, fmt.Errorf("FROM needs a database.collection, got %q", ns)
+	}
+
+	if p.keyword("where") {
+		if q.Filter, err = p.or(); err != nil {
+			return nil, err
+		}
+	}
+	var groupBy []string
+	if p.keyword("group") {
+		if !p.keyword("by") {
+			return nil, p.expected("BY")
+		}
+		for {
+			field, err := p.identifier()
+			if err != nil {
+				return nil, err
+			}
+			groupBy = append(groupBy, field)
+			if !p.symbol(",") {
+				break
+			}
+		}
+	}
+	if p.keyword("order") {
+		if !p.keyword("by") {
+			return nil, p.expected("BY")
+		}
+		for {
+			field, err := p.identifier()
+			if err != nil {
+				return nil, err
+			}
+			dir := int32(1)
+			if p.keyword("desc") {
+				dir = -1
+			} else {
+				p.keyword("asc")
+			}
+			q.Sort = append(q.Sort, bson.E{Key: field, Value: dir})
+			if !p.symbol(",") {
+				break
+			}
+		}
+	}
+	if p.keyword("limit") {
+		if q.Limit, err = p.count(); err != nil {
+			return nil, err
+		}
+		if p.keyword("offset") {
+			if q.Skip, err = p.count(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	p.symbol(";")
+	if t := p.peek(); t.kind != sqlEOF {
+		return nil, p.unexpected(t)
+	}
+
+	if err := q.compile(columns, groupBy); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// compile turns the select list into a projection, or into an aggregation
+// when the statement needs one
+func (q *SQL) compile(columns []column, groupBy []string) error {
+	grouped := len(groupBy) > 0
+	renamed := false
+	for _, c := range columns {
+		grouped = grouped || c.fn != ""
+		renamed = renamed || c.alias != ""
+	}
+
+	if !grouped && !renamed {
+		if len(columns) > 0 {
+			q.Projection = bson.D{}
+			id := false
+			for _, c := range columns {
+				q.Projection = append(q.Projection, bson.E{Key: c.field, Value: int32(1)})
+				id = id || c.field == "_id"
+			}
+			if !id {
+				q.Projection = append(q.Projection, bson.E{Key: "_id", Value: int32(0)})
+			}
+		}
+		return nil
+	}
+
+	pipeline := bson.A{}
+	if len(q.Filter) > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: q.Filter}})
+	}
+	project := bson.D{}
+	if grouped {
+		if len(columns) == 0 {
+			return errors.New("SELECT * cannot be used with GROUP BY or aggregates")
+		}
+		var key interface{}
+		if len(groupBy) > 0 {
+			keys := bson.D{}
+			for i, field := range groupBy {
+				keys = append(keys, bson.E{Key: "k" + strconv.Itoa(i), Value: "$" + field})
+			}
+			key = keys
+		}
+		group := bson.D{{Key: "_id", Value: key}}
+		for i, c := range columns {
+			if c.fn == "" {
+				index := -1
+				for j, field := range groupBy {
+					if field == c.field {
+						index = j
+					}
+				}
+				if index < 0 {
+					return fmt.Errorf("column %s must be in GROUP BY or used in an aggregate", c.field)
+				}
+				project = append(project, bson.E{Key: c.name(), Value: "$_id.k" + strconv.Itoa(index)})
+				continue
+			}
+			var value interface{} = "$" + c.field
+			switch {
+			case c.fn == "count" && c.field == "*":
+				value = int32(1)
+			case c.fn == "count":
+				// COUNT(field) counts the rows where field is not null
+				value = bson.D{{Key: "$cond", Value: bson.A{bson.D{{Key: "$gt", Value: bson.A{"$" + c.field, nil}}}, int32(1), int32(0)}}}
+			}
+			acc := "a" + strconv.Itoa(i)
+			group = append(group, bson.E{Key: acc, Value: bson.D{{Key: sqlAggregates[c.fn], Value: value}}})
+			project = append(project, bson.E{Key: c.name(), Value: "$" + acc})
+		}
+		pipeline = append(pipeline, bson.D{{Key: "$group", Value: group}})
+	} else {
+		// The rows are sorted and paged before the columns are renamed,
+		// so ORDER BY may use either name
+		sources := make(map[string]string)
+		for _, c := range columns {
+			sources[c.name()] = c.field
+		}
+		sort := bson.D{}
+		for _, e := range q.Sort {
+			if field, ok := sources[e.Key]; ok {
+				e.Key = field
+			}
+			sort = append(sort, e)
+		}
+		q.Sort = sort
+		for _, c := range columns {
+			project = append(project, bson.E{Key: c.name(), Value: "$" + c.field})
+		}
+	}
+	if _, ok := lookupKey(project, "_id"); !ok {
+		project = append(bson.D{{Key: "_id", Value: int32(0)}}, project...)
+	}
+
+	if !grouped {
+		pipeline = append(pipeline, q.paging()...)
+		pipeline = append(pipeline, bson.D{{Key: "$project", Value: project}})
+	} else {
+		pipeline = append(pipeline, bson.D{{Key: "$project", Value: project}})
+		pipeline = append(pipeline, q.paging()...)
+	}
+	q.Pipeline = pipeline
+	q.Filter, q.Sort, q.Limit, q.Skip = nil, nil, 0, 0
+	return nil
+}
+
+// paging returns the $sort, $skip and $limit stages of the statement
+func (q *SQL) paging() bson.A {
+	var stages bson.A
+	if len(q.Sort) > 0 {
+		stages = append(stages, bson.D{{Key: "$sort", Value: q.Sort}})
+	}
+	if q.Skip > 0 {
+		stages = append(stages, bson.D{{Key: "$skip", Value: q.Skip}})
+	}
+	if q.Limit > 0 {
+		stages = append(stages, bson.D{{Key: "$limit", Value: q.Limit}})
+	}
+	return stages
+}
+
+func lookupKey(d bson.D, key string) (interface{}, bool) {
+	for _, e := range d {
+		if e.Key == key {
+			return e.Value, true
+		}
+	}
+	return nil, false
+}
+
+type sqlKind int
+
+const (
+	sqlEOF sqlKind = iota
+	sqlIdent
+	sqlString
+	sqlNumber
+	sqlSymbol
+)
+
+type sqlToken struct {
+	kind sqlKind
+	text string
+	// quoted identifiers are never keywords
+	quoted bool
+	pos    int
+}
+
+func sqlTokenize(statement string) ([]sqlToken, error) {
+	var tokens []sqlToken
+	runes := []rune(statement)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '\'' || r == '"' || r == '`':
+			var sb strings.Builder
+			for i++; ; i++ {
+				if i == len(runes) {
+					return nil, fmt.Errorf("unterminated quote at position %d", start)
+				}
+				if runes[i] == r {
+					if i+1 < len(runes) && runes[i+1] == r {
+						sb.WriteRune(r)
+						i++
+						continue
+					}
+					i++
+					break
+				}
+				sb.WriteRune(runes[i])
+			}
+			if r == '\'' {
+				tokens = append(tokens, sqlToken{kind: sqlString, text: sb.String(), pos: start})
+			} else {
+				tokens = append(tokens, sqlToken{kind: sqlIdent, text: sb.String(), quoted: true, pos: start})
+			}
+		case unicode.IsDigit(r) || r == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1]):
+			i++
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || strings.ContainsRune(".eE", runes[i])) {
+				i++
+			}
+			tokens = append(tokens, sqlToken{kind: sqlNumber, text: string(runes[start:i]), pos: start})
+		case unicode.IsLetter(r) || r == '_':
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, sqlToken{kind: sqlIdent, text: string(runes[start:i]), pos: start})
+		case strings.ContainsRune("<>!", r) && i+1 < len(runes) && (runes[i+1] == '=' || r == '<' && runes[i+1] == '>'):
+			tokens = append(tokens, sqlToken{kind: sqlSymbol, text: string(runes[i : i+2]), pos: start})
+			i += 2
+		case strings.ContainsRune("=<>(),*;", r):
+			tokens = append(tokens, sqlToken{kind: sqlSymbol, text: string(r), pos: start})
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected %q at position %d", r, i)
+		}
+	}
+	return append(tokens, sqlToken{kind: sqlEOF, pos: len(runes)}), nil
+}
+
+type sqlParser struct {
+	tokens []sqlToken
+	pos    int
+}
+
+func (p *sqlParser) peek() sqlToken {
+	return p.tokens[p.pos]
+}
+
+func (p *sqlParser) next() sqlToken {
+	t := p.tokens[p.pos]
+	if t.kind != sqlEOF {
+		p.pos++
+	}
+	return t
+}
+
+func isKeyword(t sqlToken, kw string) bool {
+	return t.kind == sqlIdent && !t.quoted && strings.EqualFold(t.text, kw)
+}
+
+// keyword reports whether the next token is the keyword kw, consuming it
+func (p *sqlParser) keyword(kw string) bool {
+	if isKeyword(p.peek(), kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// symbol reports whether the next token is the symbol s, consuming it
+func (p *sqlParser) symbol(s string) bool {
+	if t := p.peek(); t.kind == sqlSymbol && t.text == s {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *sqlParser) expected(what string) error {
+	t := p.peek()
+	if t.kind == sqlEOF {
+		return fmt.Errorf("expected %s at the end of the statement", what)
+	}
+	return fmt.Errorf("expected %s at position %d, got %q", what, t.pos, t.text)
+}
+
+func (p *sqlParser) unexpected(t sqlToken) error {
+	if t.kind == sqlEOF {
+		return errors.New("unexpected end of statement")
+	}
+	return fmt.Errorf("unexpected %q at position %d", t.text, t.pos)
+}
+
+// sqlReserved are keywords that cannot be used as unquoted names
+var sqlReserved = map[string]bool{
+	"select": true, "from": true, "where": true, "group": true, "order": true, "by": true, "limit": true,
+	"offset": true, "and": true, "or": true, "not": true, "in": true, "like": true, "between": true,
+	"is": true, "null": true, "as": true, "asc": true, "desc": true, "true": true, "false": true,
+}
+
+// identifier reads a field or namespace name
+func (p *sqlParser) identifier() (string, error) {
+	t := p.peek()
+	if t.kind != sqlIdent || !t.quoted && sqlReserved[strings.ToLower(t.text)] {
+		return "", p.expected("a name")
+	}
+	if strings.HasPrefix(t.text, "$") {
+		return "", fmt.Errorf("invalid name %q at position %d", t.text, t.pos)
+	}
+	p.pos++
+	return t.text, nil
+}
+
+func (p *sqlParser) column() (column, error) {
+	var c column
+	if t := p.peek(); t.kind == sqlIdent && !t.quoted && sqlAggregates[strings.ToLower(t.text)] != "" &&
+		p.tokens[p.pos+1].kind == sqlSymbol && p.tokens[p.pos+1].text == "(" {
+		c.fn = strings.ToLower(t.text)
+		p.pos += 2
+		if p.symbol("*") {
+			if c.fn != "count" {
+				return c, fmt.Errorf("%s(*) is not supported", strings.ToUpper(c.fn))
+			}
+			c.field = "*"
+		} else {
+			field, err := p.identifier()
+			if err != nil {
+				return c, err
+			}
+			c.field = field
+		}
+		if !p.symbol(")") {
+			return c, p.expected(")")
+		}
+	} else {
+		field, err := p.identifier()
+		if err != nil {
+			return c, err
+		}
+		c.field = field
+	}
+
+	if p.keyword("as") {
+		alias, err := p.identifier()
+		if err != nil {
+			return c, err
+		}
+		c.alias = alias
+	} else if t := p.peek(); t.kind == sqlIdent && (t.quoted || !sqlReserved[strings.ToLower(t.text)]) {
+		c.alias, _ = p.identifier()
+	}
+	if strings.Contains(c.alias, ".") {
+		return c, fmt.Errorf("alias %q cannot contain dots", c.alias)
+	}
+	return c, nil
+}
+
+// count reads a LIMIT or OFFSET
+func (p *sqlParser) count() (int64, error) {
+	t := p.next()
+	n, err := strconv.ParseInt(t.text, 10, 64)
+	if t.kind != sqlNumber || err != nil || n < 0 {
+		return 0, fmt.Errorf("expected a non-negative integer at position %d", t.pos)
+	}
+	return n, nil
+}
+
+func (p *sqlParser) or() (bson.D, error) {
+	return p.chain("or", "$or", p.and)
+}
+
+func (p *sqlParser) and() (bson.D, error) {
+	return p.chain("and", "$and", p.not)
+}
+
+// chain parses operands joined by kw into a single op clause
+func (p *sqlParser) chain(kw, op string, operand func() (bson.D, error)) (bson.D, error) {
+	first, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	clauses := bson.A{first}
+	for p.keyword(kw) {
+		next, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, next)
+	}
+	if len(clauses) == 1 {
+		return first, nil
+	}
+	return bson.D{{Key: op, Value: clauses}}, nil
+}
+
+func (p *sqlParser) not() (bson.D, error) {
+	if p.keyword("not") {
+		operand, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return negate(operand), nil
+	}
+	if p.symbol("(") {
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.symbol(")") {
+			return nil, p.expected(")")
+		}
+		return inner, nil
+	}
+	return p.predicate()
+}
+
+func negate(filter bson.D) bson.D {
+	return bson.D{{Key: "$nor", Value: bson.A{filter}}}
+}
+
+func (p *sqlParser) predicate() (bson.D, error) {
+	field, err := p.identifier()
+	if err != nil {
+		return nil, err
+	}
+	cond := func(op string, v interface{}) bson.D {
+		return bson.D{{Key: field, Value: bson.D{{Key: op, Value: v}}}}
+	}
+
+	if t := p.peek(); t.kind == sqlSymbol && sqlComparisons[t.text] != "" {
+		p.next()
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		return cond(sqlComparisons[t.text], v), nil
+	}
+	if p.keyword("is") {
+		op := "$eq"
+		if p.keyword("not") {
+			op = "$ne"
+		}
+		if !p.keyword("null") {
+			return nil, p.expected("NULL")
+		}
+		return cond(op, nil), nil
+	}
+
+	negated := p.keyword("not")
+	var filter bson.D
+	switch {
+	case p.keyword("in"):
+		if !p.symbol("(") {
+			return nil, p.expected("(")
+		}
+		values := bson.A{}
+		for {
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+			if !p.symbol(",") {
+				break
+			}
+		}
+		if !p.symbol(")") {
+			return nil, p.expected(")")
+		}
+		if negated {
+			return cond("$nin", values), nil
+		}
+		return cond("$in", values), nil
+	case p.keyword("like"):
+		t := p.next()
+		if t.kind != sqlString {
+			return nil, fmt.Errorf("LIKE needs a string pattern at position %d", t.pos)
+		}
+		filter = cond("$regex", likePattern(t.text))
+	case p.keyword("between"):
+		low, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		if !p.keyword("and") {
+			return nil, p.expected("AND")
+		}
+		high, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		filter = bson.D{{Key: field, Value: bson.D{{Key: "$gte", Value: low}, {Key: "$lte", Value: high}}}}
+	default:
+		return nil, p.expected("a comparison")
+	}
+	if negated {
+		return negate(filter), nil
+	}
+	return filter, nil
+}
+
+// likePattern translates a LIKE pattern, with % for any text and _ for a
+// single character, into an anchored regular expression
+func likePattern(pattern string) string {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			sb.WriteString(".*")
+		case '_':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return sb.String()
+}
+
+func (p *sqlParser) value() (interface{}, error) {
+	t := p.next()
+	switch {
+	case t.kind == sqlString:
+		return t.text, nil
+	case t.kind == sqlNumber:
+		if n, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			return n, nil
+		}
+		if f, err := strconv.ParseFloat(t.text, 64); err == nil {
+			return f, nil
+		}
+		return nil, fmt.Errorf("invalid number %q at position %d", t.text, t.pos)
+	case isKeyword(t, "true"):
+		return true, nil
+	case isKeyword(t, "false"):
+		return false, nil
+	case isKeyword(t, "null"):
+		return nil, nil
+	}
+	return nil, p.unexpected(t)
+}
@@ -0,0 +1,314 @@
+package query
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Report describes a filter, update or pipeline without executing it
+type Report struct {
+	Valid bool `json:"valid"`
+	// Normalized is the canonical EJSON form of the parsed input
+	Normalized interface{} `json:"normalized,omitempty"`
+	Operators  []string    `json:"operators"`
+	Warnings   []string    `json:"warnings"`
+	Errors     []string    `json:"errors"`
+}
+
+var queryOperators = set(
+	"$eq", "$ne", "$gt", "$gte", "$lt", "$lte", "$in", "$nin",
+	"$and", "$or", "$nor", "$not",
+	"$exists", "$type",
+	"$expr", "$jsonSchema", "$mod", "$regex", "$options", "$text", "$where",
+	"$search", "$language", "$caseSensitive", "$diacriticSensitive",
+	"$geoIntersects", "$geoWithin", "$near", "$nearSphere", "$geometry",
+	"$maxDistance", "$minDistance", "$box", "$center", "$centerSphere", "$polygon",
+	"$all", "$elemMatch", "$size",
+	"$bitsAllClear", "$bitsAllSet", "$bitsAnyClear", "$bitsAnySet",
+	"$comment", "$rand", "$sampleRate",
+)
+
+var updateOperators = set(
+	"$currentDate", "$inc", "$min", "$max", "$mul", "$rename", "$set", "$setOnInsert", "$unset",
+	"$addToSet", "$pop", "$pull", "$push", "$pullAll", "$bit",
+)
+
+var stages = set(
+	"$addFields", "$bucket", "$bucketAuto", "$changeStream", "$collStats", "$count", "$densify",
+	"$documents", "$facet", "$fill", "$geoNear", "$graphLookup", "$group", "$indexStats", "$limit",
+	"$listSessions", "$lookup", "$match", "$merge", "$out", "$planCacheStats", "$project",
+	"$redact", "$replaceRoot", "$replaceWith", "$sample", "$search", "$searchMeta", "$set",
+	"$setWindowFields", "$skip", "$sort", "$sortByCount", "$unionWith", "$unset", "$unwind",
+	"$vectorSearch",
+)
+
+func set(values ...string) map[string]bool {
+	m := make(map[string]bool, len(values))
+	for _, v := range values {
+		m[v] = true
+	}
+	return m
+}
+
+type analyzer struct {
+	operators map[string]bool
+	warnings  []string
+	errors    []string
+}
+
+func (a *analyzer) warn(format string, args ...interface{}) {
+	a.warnings = append(a.warnings, fmt.Sprintf(format, args...))
+}
+
+func (a *analyzer) fail(format string, args ...interface{}) {
+	a.errors = append(a.errors, fmt.Sprintf(format, args...))
+}
+
+func (a *analyzer) report() Report {
+	ops := make([]string, 0, len(a.operators))
+	for op := range a.operators {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	r := Report{Valid: len(a.errors) == 0, Operators: ops, Warnings: a.warnings, Errors: a.errors}
+	if r.Warnings == nil {
+		r.Warnings = []string{}
+	}
+	if r.Errors == nil {
+		r.Errors = []string{}
+	}
+	return r
+}
+
+// Filter analyzes a deserialized query filter
+func Filter(filter interface{}) Report {
+	a := &analyzer{operators: make(map[string]bool)}
+	d, ok := filter.(bson.D)
+	if filter != nil && !ok {
+		a.fail("filter must be a document")
+		return a.report()
+	}
+	if len(d) == 0 {
+		a.warn("empty filter matches every document in the collection")
+	}
+	a.filter(d, "")
+	return a.report()
+}
+
+// filter walks a query document; path is the field the document applies to
+// (empty at the top level)
+func (a *analyzer) filter(d bson.D, path string) {
+	for _, e := range d {
+		if !strings.HasPrefix(e.Key, "$") {
+			if path != "" {
+				// {field: {a: 1, $gt: 2}} mixes an exact match with operators
+				if hasOperator(d) {
+					a.fail("%s mixes operators and field names", path)
+				}
+				return
+			}
+			if sub, ok := e.Value.(bson.D); ok && hasOperator(sub) {
+				a.filter(sub, e.Key)
+			}
+			continue
+		}
+
+		a.operators[e.Key] = true
+		if !queryOperators[e.Key] {
+			a.fail("unknown query operator %s", e.Key)
+			continue
+		}
+
+		switch e.Key {
+		case "$and", "$or", "$nor":
+			clauses, ok := e.Value.(bson.A)
+			if !ok || len(clauses) == 0 {
+				a.fail("%s requires a non-empty array", e.Key)
+				continue
+			}
+			for _, clause := range clauses {
+				sub, ok := clause.(bson.D)
+				if !ok {
+					a.fail("%s clauses must be documents", e.Key)
+					continue
+				}
+				a.filter(sub, "")
+			}
+		case "$not", "$elemMatch":
+			if sub, ok := e.Value.(bson.D); ok {
+				a.filter(sub, path)
+			}
+		case "$where":
+			a.warn("$where runs JavaScript for every document and cannot use indexes")
+		case "$expr":
+			a.collectExpression(e.Value)
+			a.warn("$expr can only use indexes for simple equality and range comparisons")
+		case "$regex":
+			if pattern, ok := regexPattern(e.Value); ok && !strings.HasPrefix(pattern, "^") {
+				a.warn("unanchored $regex on %s cannot use an index efficiently", path)
+			}
+		case "$ne":
+			a.warn("$ne on %s is not selective and usually scans most of the index", path)
+		case "$nin":
+			a.warn("$nin on %s is not selective and usually scans most of the index", path)
+			fallthrough
+		case "$in", "$all":
+			if _, ok := e.Value.(bson.A); !ok {
+				a.fail("%s requires an array", e.Key)
+			}
+		}
+		if path == "" && !isTopLevelOperator(e.Key) {
+			a.fail("%s must be applied to a field", e.Key)
+		}
+	}
+	if path != "" {
+		return
+	}
+	for _, e := range d {
+		if pattern, ok := e.Value.(primitive.Regex); ok && !strings.HasPrefix(pattern.Pattern, "^") {
+			a.warn("unanchored regular expression on %s cannot use an index efficiently", e.Key)
+		}
+	}
+}
+
+func isTopLevelOperator(op string) bool {
+	switch op {
+	case "$and", "$or", "$nor", "$expr", "$jsonSchema", "$text", "$where", "$comment", "$sampleRate":
+		return true
+	}
+	return false
+}
+
+func hasOperator(d bson.D) bool {
+	for _, e := range d {
+		if strings.HasPrefix(e.Key, "$") {
+			return true
+		}
+	}
+	return false
+}
+
+func regexPattern(v interface{}) (string, bool) {
+	switch p := v.(type) {
+	case string:
+		return p, true
+	case primitive.Regex:
+		return p.Pattern, true
+	}
+	return "", false
+}
+
+// collectExpression records aggregation expression operators
+func (a *analyzer) collectExpression(v interface{}) {
+	switch val := v.(type) {
+	case bson.D:
+		for _, e := range val {
+			if strings.HasPrefix(e.Key, "$") {
+				a.operators[e.Key] = true
+			}
+			a.collectExpression(e.Value)
+		}
+	case bson.A:
+		for _, item := range val {
+			a.collectExpression(item)
+		}
+	}
+}
+
+// Update analyzes a deserialized update document
+func Update(update interface{}) Report {
+	a := &analyzer{operators: make(map[string]bool)}
+	d, ok := update.(bson.D)
+	if !ok || len(d) == 0 {
+		a.fail("update must be a non-empty document")
+		return a.report()
+	}
+	if !hasOperator(d) {
+		a.fail("update must only contain update operators such as $set")
+		return a.report()
+	}
+	for _, e := range d {
+		if !strings.HasPrefix(e.Key, "$") {
+			a.fail("update mixes operators and field names (%s)", e.Key)
+			continue
+		}
+		a.operators[e.Key] = true
+		if !updateOperators[e.Key] {
+			a.fail("unknown update operator %s", e.Key)
+			continue
+		}
+		if _, ok := e.Value.(bson.D); !ok {
+			a.fail("%s requires a document", e.Key)
+		}
+	}
+	return a.report()
+}
+
+// Pipeline analyzes a deserialized aggregation pipeline
+func Pipeline(pipeline interface{}) Report {
+	a := &analyzer{operators: make(map[string]bool)}
+	stagesList, ok := pipeline.(bson.A)
+	if !ok {
+		a.fail("pipeline must be an array of stages")
+		return a.report()
+	}
+	a.pipeline(stagesList)
+	return a.report()
+}
+
+func (a *analyzer) pipeline(list bson.A) {
+	for i, item := range list {
+		stage, ok := item.(bson.D)
+		if !ok || len(stage) != 1 {
+			a.fail("stage %d must be a document with exactly one field", i)
+			continue
+		}
+		name := stage[0].Key
+		a.operators[name] = true
+		if !stages[name] {
+			a.fail("stage %d: unknown stage %s", i, name)
+			continue
+		}
+
+		switch name {
+		case "$match":
+			if i > 0 {
+				a.warn("stage %d: $match after other stages cannot use indexes; move it first if possible", i)
+			}
+			if sub, ok := stage[0].Value.(bson.D); ok {
+				a.filter(sub, "")
+			}
+			continue
+		case "$out", "$merge":
+			if i != len(list)-1 {
+				a.fail("stage %d: %s must be the last stage", i, name)
+			}
+			a.warn("%s writes the pipeline results to a collection", name)
+		case "$lookup", "$graphLookup", "$unionWith":
+			a.warn("stage %d: %s reads from another collection", i, name)
+		case "$sort":
+			if i == len(list)-1 || !isStage(list[i+1], "$limit") {
+				a.warn("stage %d: $sort without a following $limit sorts the entire result set", i)
+			}
+		case "$facet":
+			if d, ok := stage[0].Value.(bson.D); ok {
+				for _, f := range d {
+					if sub, ok := f.Value.(bson.A); ok {
+						a.pipeline(sub)
+					}
+				}
+			}
+			continue
+		}
+		a.collectExpression(stage[0].Value)
+	}
+}
+
+func isStage(item interface{}, name string) bool {
+	d, ok := item.(bson.D)
+	return ok && len(d) == 1 && d[0].Key == name
+}
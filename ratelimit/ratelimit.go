@@ -0,0 +1,152 @@
+package ratelimit
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// sharedRetry is how long a limiter uses its own buckets after the shared
+// ones failed before it tries them again
+const sharedRetry = 5 * time.Second
+
+// refill is the time an empty bucket takes to fill up again. Buckets left
+// alone that long are full, so they are dropped and created again when
+// needed.
+const refill = time.Minute
+
+// Limiter is an in-memory token bucket limiter keyed by client name,
+// optionally drawing from buckets shared by every replica instead
+type Limiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	now     func() time.Time
+	// swept is when full buckets were last dropped
+	swept time.Time
+
+	// shared holds the buckets of every replica, if set. While it fails
+	// the in-memory buckets are used until retryAt.
+	shared   *Redis
+	fallback bool
+	retryAt  time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New creates an empty limiter
+func New() *Limiter {
+	return &Limiter{buckets: make(map[string]*bucket), now: time.Now}
+}
+
+// NewShared creates a limiter drawing from the buckets of shared, and from
+// its own while shared fails, so that each replica then enforces the limits
+// on its own
+func NewShared(shared *Redis) *Limiter {
+	l := New()
+	l.shared = shared
+	return l
+}
+
+// Allow consumes a token from the bucket for key, which holds up to perMinute
+// tokens and refills continuously. When the bucket is empty it returns false
+// and how long the caller should wait before retrying.
+func (l *Limiter) Allow(key string, perMinute int) (bool, time.Duration) {
+	if perMinute <= 0 {
+		return true, 0
+	}
+	if l.shared != nil && l.useShared() {
+		ok, wait, err := l.shared.Allow(key, perMinute)
+		l.sharedDone(err)
+		if err == nil {
+			return ok, wait
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.swept) >= refill {
+		l.sweep(now)
+	}
+	capacity := float64(perMinute)
+	rate := capacity / 60 // tokens per second
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > capacity {
+		b.tokens = capacity
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep drops the buckets untouched for refill, such as those of the
+// anonymous clients of public collections, one per IP
+func (l *Limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(l.buckets, key)
+		}
+	}
+	l.swept = now
+}
+
+// Reset forgets the bucket for key, e.g. after its limit was changed
+func (l *Limiter) Reset(key string) {
+	l.mu.Lock()
+	delete(l.buckets, key)
+	l.mu.Unlock()
+	if l.shared != nil {
+		if err := l.shared.Reset(key); err != nil {
+			log.Printf("Resetting the shared rate limit of %s: %v", key, err)
+		}
+	}
+}
+
+// useShared reports whether the shared buckets are used, i.e. they have
+// not failed within sharedRetry
+func (l *Limiter) useShared() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return !l.fallback || !l.now().Before(l.retryAt)
+}
+
+// sharedDone records the outcome of a call to the shared buckets, falling
+// back on the in-memory ones when it failed
+func (l *Limiter) sharedDone(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case err != nil && !l.fallback:
+		log.Printf("Shared rate limits unavailable, limiting on this replica: %v", err)
+	case err == nil && l.fallback:
+		log.Printf("Shared rate limits available again")
+	}
+	l.fallback = err != nil
+	if l.fallback {
+		l.retryAt = l.now().Add(sharedRetry)
+	}
+}
+
+// Fallback reports whether the limiter uses its in-memory buckets because
+// the shared ones failed
+func (l *Limiter) Fallback() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.fallback
+}
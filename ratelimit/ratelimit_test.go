@@ -0,0 +1,58 @@
+package ratelimit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"mongo-data-api-go-alternative/config"
+)
+
+func TestSweep(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l := New()
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 100; i++ {
+		l.Allow(fmt.Sprintf("anonymous:10.0.0.%d", i), 60)
+	}
+	// The bucket of a client within its limit isn't dropped early
+	now = now.Add(30 * time.Second)
+	l.Allow("key", 1)
+	if len(l.buckets) != 101 {
+		t.Fatalf("%d buckets, want 101", len(l.buckets))
+	}
+
+	now = now.Add(40 * time.Second)
+	if ok, _ := l.Allow("key", 1); ok {
+		t.Error("key allowed before its bucket refilled")
+	}
+	if len(l.buckets) != 1 {
+		t.Errorf("%d buckets after a minute, want the active one", len(l.buckets))
+	}
+
+	// A dropped bucket comes back full
+	now = now.Add(2 * time.Minute)
+	if ok, _ := l.Allow("anonymous:10.0.0.1", 60); !ok {
+		t.Error("dropped bucket not full")
+	}
+}
+
+func TestSharedFallback(t *testing.T) {
+	// Nothing listens on the port, so the limiter limits on its own
+	shared, err := NewRedis(config.RateLimitRedisConfig{URL: "redis://127.0.0.1:1", KeyPrefix: "test:", TimeoutMs: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shared.Close()
+	l := NewShared(shared)
+
+	for i, want := range []bool{true, true, false} {
+		if ok, _ := l.Allow("test", 2); ok != want {
+			t.Fatalf("request %d: allowed %v, want %v", i, ok, want)
+		}
+	}
+	if !l.Fallback() {
+		t.Error("limiter not falling back")
+	}
+}
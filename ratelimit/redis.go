@@ -0,0 +1,84 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"mongo-data-api-go-alternative/config"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// allowScript takes a token from the bucket of KEYS[1], which holds up to
+// ARGV[1] tokens refilled over a minute, and returns whether it could and
+// how many milliseconds to wait otherwise. Time is the server's, so that
+// replicas with skewed clocks share buckets. Buckets expire once full.
+var allowScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local rate = capacity / 60000
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(bucket[1]) or capacity
+local last = tonumber(bucket[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - last) * rate)
+local allowed, wait = 0, 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+else
+  wait = math.ceil((1 - tokens) / rate)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', now)
+redis.call('PEXPIRE', KEYS[1], 60000)
+return {allowed, wait}
+`)
+
+// Redis is a token bucket limiter keeping its buckets in Redis, shared by
+// every replica connected to the same server
+type Redis struct {
+	client  *redis.Client
+	prefix  string
+	timeout time.Duration
+}
+
+// NewRedis connects to the server of cfg.URL. Connections are made on
+// first use.
+func NewRedis(cfg config.RateLimitRedisConfig) (*Redis, error) {
+	opts, err := redis.ParseURL(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate limit Redis URL: %w", err)
+	}
+	timeout := time.Duration(cfg.TimeoutMs) * time.Millisecond
+	opts.DialTimeout, opts.ReadTimeout, opts.WriteTimeout = timeout, timeout, timeout
+	// A limiter falling back on its own buckets doesn't retry
+	opts.MaxRetries = -1
+	return &Redis{client: redis.NewClient(opts), prefix: cfg.KeyPrefix, timeout: timeout}, nil
+}
+
+// Allow takes a token from the shared bucket for key, like Limiter.Allow
+func (r *Redis) Allow(key string, perMinute int) (bool, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	res, err := allowScript.Run(ctx, r.client, []string{r.prefix + key}, perMinute).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	if len(res) != 2 {
+		return false, 0, fmt.Errorf("unexpected rate limit script result %v", res)
+	}
+	return res[0] == 1, time.Duration(res[1]) * time.Millisecond, nil
+}
+
+// Reset deletes the shared bucket for key
+func (r *Redis) Reset(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	return r.client.Del(ctx, r.prefix+key).Err()
+}
+
+// Close closes the connections to the server
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
@@ -0,0 +1,126 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"mongo-data-api-go-alternative/config"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newRedis returns a limiter on an in-process Redis server whose clock is
+// set to now
+func newRedis(t *testing.T, now time.Time) (*Redis, *miniredis.Miniredis) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	server.SetTime(now)
+	shared, err := NewRedis(config.RateLimitRedisConfig{URL: "redis://" + server.Addr(), KeyPrefix: "test:", TimeoutMs: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { shared.Close() })
+	return shared, server
+}
+
+func TestRedisBucket(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	shared, server := newRedis(t, now)
+
+	for i, want := range []bool{true, true, false} {
+		ok, wait, err := shared.Allow("key", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Fatalf("request %d: allowed %v, want %v", i, ok, want)
+		}
+		// Two tokens a minute, so the next one takes 30 seconds
+		if !ok && wait != 30*time.Second {
+			t.Errorf("wait %v, want 30s", wait)
+		}
+	}
+	if ttl := server.TTL("test:key"); ttl != time.Minute {
+		t.Errorf("bucket expires in %v, want a minute", ttl)
+	}
+	// Other keys have their own bucket
+	if ok, _, _ := shared.Allow("other", 2); !ok {
+		t.Error("other key limited")
+	}
+
+	// Tokens refill with the server's time
+	server.SetTime(now.Add(15 * time.Second))
+	if ok, wait, _ := shared.Allow("key", 2); ok || wait != 15*time.Second {
+		t.Errorf("after 15s: allowed %v, wait %v", ok, wait)
+	}
+	server.SetTime(now.Add(30 * time.Second))
+	if ok, _, _ := shared.Allow("key", 2); !ok {
+		t.Error("token not refilled after 30s")
+	}
+
+	// Reset deletes the bucket, which comes back full
+	if err := shared.Reset("key"); err != nil {
+		t.Fatal(err)
+	}
+	if server.Exists("test:key") {
+		t.Error("bucket kept after Reset")
+	}
+	for i := 0; i < 2; i++ {
+		if ok, _, _ := shared.Allow("key", 2); !ok {
+			t.Errorf("request %d after Reset limited", i)
+		}
+	}
+
+	// Full buckets expire
+	server.FastForward(time.Minute)
+	if server.Exists("test:other") {
+		t.Error("bucket kept after a minute")
+	}
+}
+
+func TestSharedRecovery(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	shared, server := newRedis(t, now)
+	l := NewShared(shared)
+	l.now = func() time.Time { return now }
+
+	if ok, _ := l.Allow("key", 1); !ok || l.Fallback() {
+		t.Fatalf("shared bucket: allowed %v, fallback %v", ok, l.Fallback())
+	}
+	if ok, _ := l.Allow("key", 1); ok {
+		t.Fatal("shared bucket not limited")
+	}
+
+	// While Redis is down the replica limits on its own, with its own
+	// bucket
+	server.Close()
+	if ok, _ := l.Allow("key", 1); !ok || !l.Fallback() {
+		t.Fatalf("down: allowed %v, fallback %v", ok, l.Fallback())
+	}
+	if ok, _ := l.Allow("key", 1); ok {
+		t.Error("in-memory bucket not limited")
+	}
+
+	// Redis isn't tried again before sharedRetry
+	if err := server.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(sharedRetry - time.Second)
+	l.Allow("key", 1)
+	if !l.Fallback() {
+		t.Error("shared buckets used again before sharedRetry")
+	}
+	now = now.Add(time.Second)
+	if ok, _ := l.Allow("key", 1); ok || l.Fallback() {
+		t.Errorf("recovered: allowed %v, fallback %v", ok, l.Fallback())
+	}
+
+	// Reset clears both buckets
+	l.Reset("key")
+	if ok, _ := l.Allow("key", 1); !ok {
+		t.Error("limited after Reset")
+	}
+	if _, ok := l.buckets["key"]; ok {
+		t.Error("in-memory bucket kept after Reset")
+	}
+}
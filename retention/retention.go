@@ -0,0 +1,127 @@
+// Package retention keeps the TTL indexes of collections in line with the
+// configured retention policies, so expired documents are deleted by
+// MongoDB instead of cleanup scripts.
+package retention
+
+import (
+	"context"
+	"fmt"
+
+	"mongo-data-api-go-alternative/config"
+	"mongo-data-api-go-alternative/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Policy states
+const (
+	// StateOK means the TTL index matches the policy
+	StateOK = "ok"
+	// StateMissing and StateDrift are reported by Check for indexes that
+	// Apply would create or update
+	StateMissing = "missing"
+	StateDrift   = "drift"
+	// StateCreated and StateUpdated are reported by Apply for the indexes
+	// it changed
+	StateCreated = "created"
+	StateUpdated = "updated"
+	// StateConflict means an index on the field without an expiry exists;
+	// it has to be dropped or changed by hand
+	StateConflict = "conflict"
+	StateError    = "error"
+)
+
+// Status reports how a collection's indexes compare to a policy
+type Status struct {
+	config.RetentionPolicy
+	ExpireAfterSeconds int64 `json:"expireAfterSeconds"`
+	// Index is the name of the policy's TTL index, if there is one
+	Index string `json:"index,omitempty"`
+	// CurrentExpireAfterSeconds is the expiry of a drifted index
+	CurrentExpireAfterSeconds *int64 `json:"currentExpireAfterSeconds,omitempty"`
+	State                     string `json:"state"`
+	Error                     string `json:"error,omitempty"`
+}
+
+// Manager checks and applies retention policies
+type Manager struct {
+	Store    db.DataStore
+	Policies []config.RetentionPolicy
+}
+
+// Check compares the indexes with the policies without changing them
+func (m *Manager) Check(ctx context.Context) []Status {
+	return m.run(ctx, false)
+}
+
+// Apply creates missing TTL indexes and updates the expiry of drifted ones
+func (m *Manager) Apply(ctx context.Context) []Status {
+	return m.run(ctx, true)
+}
+
+func (m *Manager) run(ctx context.Context, apply bool) []Status {
+	statuses := make([]Status, len(m.Policies))
+	for i, p := range m.Policies {
+		statuses[i] = m.policy(ctx, p, apply)
+	}
+	return statuses
+}
+
+func (m *Manager) policy(ctx context.Context, p config.RetentionPolicy, apply bool) Status {
+	st := Status{RetentionPolicy: p}
+	fail := func(err error) Status {
+		st.State, st.Error = StateError, err.Error()
+		return st
+	}
+	seconds, err := p.Expiry()
+	if err != nil {
+		return fail(err)
+	}
+	st.ExpireAfterSeconds = seconds
+
+	indexes, err := m.Store.ListIndexes(ctx, p.Database, p.Collection)
+	if err != nil {
+		return fail(err)
+	}
+	for _, index := range indexes {
+		if !onField(index.Keys, p.Field) {
+			continue
+		}
+		st.Index = index.Name
+		switch {
+		case index.ExpireAfterSeconds == nil:
+			st.State = StateConflict
+			st.Error = fmt.Sprintf("index %q on %s has no expiry", index.Name, p.Field)
+		case *index.ExpireAfterSeconds == seconds:
+			st.State = StateOK
+		case !apply:
+			st.State, st.CurrentExpireAfterSeconds = StateDrift, index.ExpireAfterSeconds
+		default:
+			st.CurrentExpireAfterSeconds = index.ExpireAfterSeconds
+			if err := m.Store.SetIndexExpiry(ctx, p.Database, p.Collection, index.Name, seconds); err != nil {
+				return fail(err)
+			}
+			st.State = StateUpdated
+		}
+		return st
+	}
+
+	if !apply {
+		st.State = StateMissing
+		return st
+	}
+	name, err := m.Store.CreateIndex(ctx, p.Database, p.Collection, db.Index{
+		Keys:               bson.D{{Key: p.Field, Value: int32(1)}},
+		ExpireAfterSeconds: &seconds,
+	})
+	if err != nil {
+		return fail(err)
+	}
+	st.Index, st.State = name, StateCreated
+	return st
+}
+
+// onField reports whether keys index field alone
+func onField(keys bson.D, field string) bool {
+	return len(keys) == 1 && keys[0].Key == field
+}
@@ -0,0 +1,128 @@
+package script
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.starlark.net/starlark"
+)
+
+// toGo converts a Starlark value to plain Go values suitable for JSON
+func toGo(v starlark.Value) (interface{}, error) {
+	switch val := v.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case starlark.Bool:
+		return bool(val), nil
+	case starlark.Int:
+		if i, ok := val.Int64(); ok {
+			return i, nil
+		}
+		return nil, fmt.Errorf("integer %s out of range", val)
+	case starlark.Float:
+		return float64(val), nil
+	case starlark.String:
+		return string(val), nil
+	case *starlark.Dict:
+		m := make(map[string]interface{}, val.Len())
+		for _, item := range val.Items() {
+			k, ok := item[0].(starlark.String)
+			if !ok {
+				return nil, fmt.Errorf("dict keys must be strings, got %s", item[0].Type())
+			}
+			gv, err := toGo(item[1])
+			if err != nil {
+				return nil, err
+			}
+			m[string(k)] = gv
+		}
+		return m, nil
+	case starlark.Indexable: // list, tuple
+		list := make([]interface{}, val.Len())
+		for i := range list {
+			gv, err := toGo(val.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			list[i] = gv
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("cannot convert %s to JSON", v.Type())
+}
+
+// toStarlark converts decoded JSON values to Starlark values
+func toStarlark(v interface{}) (starlark.Value, error) {
+	switch val := v.(type) {
+	case nil:
+		return starlark.None, nil
+	case bool:
+		return starlark.Bool(val), nil
+	case float64:
+		if val == math.Trunc(val) && math.Abs(val) < 1<<53 {
+			return starlark.MakeInt64(int64(val)), nil
+		}
+		return starlark.Float(val), nil
+	case string:
+		return starlark.String(val), nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		d := starlark.NewDict(len(val))
+		for _, k := range keys {
+			sv, err := toStarlark(val[k])
+			if err != nil {
+				return nil, err
+			}
+			d.SetKey(starlark.String(k), sv)
+		}
+		return d, nil
+	case []interface{}:
+		items := make([]starlark.Value, len(val))
+		for i, item := range val {
+			sv, err := toStarlark(item)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = sv
+		}
+		return starlark.NewList(items), nil
+	}
+	return nil, fmt.Errorf("cannot convert %T to a Starlark value", v)
+}
+
+// toBSON converts a Starlark value holding EJSON to BSON
+func toBSON(v starlark.Value) (interface{}, error) {
+	goValue, err := toGo(v)
+	if err != nil {
+		return nil, err
+	}
+	jsonData, err := json.Marshal(goValue)
+	if err != nil {
+		return nil, err
+	}
+	var bsonData interface{}
+	if err := bson.UnmarshalExtJSON(jsonData, false, &bsonData); err != nil {
+		return nil, err
+	}
+	return bsonData, nil
+}
+
+// fromBSON converts BSON values to Starlark values via relaxed EJSON
+func fromBSON(v interface{}) (starlark.Value, error) {
+	ejsonBytes, err := bson.MarshalExtJSON(bson.M{"v": v}, false, false)
+	if err != nil {
+		return nil, err
+	}
+	var wrapped map[string]interface{}
+	if err := json.Unmarshal(ejsonBytes, &wrapped); err != nil {
+		return nil, err
+	}
+	return toStarlark(wrapped["v"])
+}
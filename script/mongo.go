@@ -0,0 +1,373 @@
+package script
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"mongo-data-api-go-alternative/auth"
+	"mongo-data-api-go-alternative/db"
+	"mongo-data-api-go-alternative/tenant"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// mongoModule exposes MongoDB operations to scripts. Every operation is
+// authorized for the calling API key and scoped to its tenant, exactly like
+// the corresponding data endpoint.
+var mongoModule = &starlarkstruct.Module{
+	Name: "mongo",
+	Members: starlark.StringDict{
+		"find":        starlark.NewBuiltin("mongo.find", mongoFind),
+		"find_one":    starlark.NewBuiltin("mongo.find_one", mongoFindOne),
+		"count":       starlark.NewBuiltin("mongo.count", mongoCount),
+		"aggregate":   starlark.NewBuiltin("mongo.aggregate", mongoAggregate),
+		"insert_one":  starlark.NewBuiltin("mongo.insert_one", mongoInsertOne),
+		"insert_many": starlark.NewBuiltin("mongo.insert_many", mongoInsertMany),
+		"update_one":  starlark.NewBuiltin("mongo.update_one", mongoUpdate("updateOne")),
+		"update_many": starlark.NewBuiltin("mongo.update_many", mongoUpdate("updateMany")),
+		"delete_one":  starlark.NewBuiltin("mongo.delete_one", mongoDelete("deleteOne")),
+		"delete_many": starlark.NewBuiltin("mongo.delete_many", mongoDelete("deleteMany")),
+	},
+}
+
+// namespace is a tenant-scoped collection a script operates on
+type namespace struct {
+	store      db.DataStore
+	database   string
+	collection string
+}
+
+// scopedNamespace authorizes op and returns the tenant-scoped namespace
+func scopedNamespace(thread *starlark.Thread, op, database, coll string) (*namespace, *tenant.Scope, error) {
+	c, ok := thread.Local(ctxLocal).(*fiber.Ctx)
+	store, _ := thread.Local(storeLocal).(db.DataStore)
+	if !ok || store == nil {
+		return nil, nil, errors.New("mongo operations are only available while handling a request")
+	}
+	if err := auth.Authorize(c, op, database, coll); err != nil {
+		return nil, nil, denied(c, err)
+	}
+	scope := tenant.FromCtx(c)
+	return &namespace{store: store, database: scope.Database(database), collection: coll}, scope, nil
+}
+
+// denied converts an authorization error to the error failing the request:
+// 503 during maintenance, 403 otherwise
+func denied(c *fiber.Ctx, err error) error {
+	var m *auth.MaintenanceError
+	if errors.As(err, &m) {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(m.RetryAfter))
+		return &scriptError{status: fiber.StatusServiceUnavailable, message: err.Error()}
+	}
+	return &scriptError{status: fiber.StatusForbidden, message: err.Error()}
+}
+
+// optionalBSON converts an optional Starlark argument to BSON
+func optionalBSON(v starlark.Value) (interface{}, error) {
+	if v == nil || v == starlark.None {
+		return nil, nil
+	}
+	return toBSON(v)
+}
+
+func filterArg(scope *tenant.Scope, v starlark.Value) (interface{}, error) {
+	filter, err := optionalBSON(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter: %w", err)
+	}
+	if filter == nil {
+		filter = bson.D{}
+	}
+	return scope.Filter(filter), nil
+}
+
+func mongoFind(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var database, coll string
+	var filterV, projectionV, sortV starlark.Value
+	var limit, skip int64
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "database", &database, "collection", &coll,
+		"filter?", &filterV, "projection?", &projectionV, "sort?", &sortV, "limit?", &limit, "skip?", &skip); err != nil {
+		return nil, err
+	}
+	ns, scope, err := scopedNamespace(thread, "find", database, coll)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := filterArg(scope, filterV)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := options.Find()
+	if projection, err := optionalBSON(projectionV); err != nil {
+		return nil, err
+	} else if projection != nil {
+		opts.SetProjection(projection)
+	}
+	if sort, err := optionalBSON(sortV); err != nil {
+		return nil, err
+	} else if sort != nil {
+		opts.SetSort(sort)
+	}
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+	if skip > 0 {
+		opts.SetSkip(skip)
+	}
+
+	ctx, cancel := opContext(thread)
+	defer cancel()
+	results, err := ns.store.Find(ctx, ns.database, ns.collection, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	return fromBSON(results)
+}
+
+func mongoFindOne(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var database, coll string
+	var filterV, projectionV starlark.Value
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "database", &database, "collection", &coll,
+		"filter?", &filterV, "projection?", &projectionV); err != nil {
+		return nil, err
+	}
+	ns, scope, err := scopedNamespace(thread, "findOne", database, coll)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := filterArg(scope, filterV)
+	if err != nil {
+		return nil, err
+	}
+	opts := options.FindOne()
+	if projection, err := optionalBSON(projectionV); err != nil {
+		return nil, err
+	} else if projection != nil {
+		opts.SetProjection(projection)
+	}
+
+	ctx, cancel := opContext(thread)
+	defer cancel()
+	result, err := ns.store.FindOne(ctx, ns.database, ns.collection, filter, opts)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return starlark.None, nil
+		}
+		return nil, err
+	}
+	return fromBSON(result)
+}
+
+func mongoCount(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var database, coll string
+	var filterV starlark.Value
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "database", &database, "collection", &coll, "filter?", &filterV); err != nil {
+		return nil, err
+	}
+	ns, scope, err := scopedNamespace(thread, "find", database, coll)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := filterArg(scope, filterV)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := opContext(thread)
+	defer cancel()
+	n, err := ns.store.CountDocuments(ctx, ns.database, ns.collection, filter)
+	if err != nil {
+		return nil, err
+	}
+	return starlark.MakeInt64(n), nil
+}
+
+func mongoAggregate(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var database, coll string
+	var pipelineV *starlark.List
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "database", &database, "collection", &coll, "pipeline", &pipelineV); err != nil {
+		return nil, err
+	}
+	ns, scope, err := scopedNamespace(thread, "aggregate", database, coll)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := toBSON(pipelineV)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pipeline: %w", err)
+	}
+	pipeline, err := scope.Pipeline(raw)
+	if err != nil {
+		return nil, &scriptError{status: fiber.StatusForbidden, message: err.Error()}
+	}
+
+	// Joins and writes are checked like those of the aggregate endpoint
+	c := thread.Local(ctxLocal).(*fiber.Ctx)
+	policy, _ := thread.Local(policyLocal).(Policy)
+	if err := auth.AuthorizeJoins(c, policy.CrossDatabaseJoins, database, coll, raw); err != nil {
+		return nil, denied(c, err)
+	}
+	output, err := auth.OutputNamespace(raw, database)
+	if err != nil {
+		return nil, &scriptError{status: fiber.StatusBadRequest, message: err.Error()}
+	}
+
+	ctx, cancel := opContext(thread)
+	defer cancel()
+	if output != nil {
+		if err := auth.Authorize(c, "aggregateWrite", output.Database, output.Collection); err != nil {
+			return nil, denied(c, err)
+		}
+		if err := ns.store.AggregateWrite(ctx, ns.database, ns.collection, pipeline); err != nil {
+			return nil, err
+		}
+		return starlark.NewList(nil), nil
+	}
+	results, err := ns.store.Aggregate(ctx, ns.database, ns.collection, pipeline, nil)
+	if err != nil {
+		return nil, err
+	}
+	return fromBSON(results)
+}
+
+func mongoInsertOne(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var database, coll string
+	var docV *starlark.Dict
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "database", &database, "collection", &coll, "document", &docV); err != nil {
+		return nil, err
+	}
+	ns, scope, err := scopedNamespace(thread, "insertOne", database, coll)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := toBSON(docV)
+	if err != nil {
+		return nil, fmt.Errorf("invalid document: %w", err)
+	}
+
+	ctx, cancel := opContext(thread)
+	defer cancel()
+	result, err := ns.store.InsertOne(ctx, ns.database, ns.collection, scope.Document(doc))
+	if err != nil {
+		return nil, err
+	}
+	return fromBSON(result.InsertedID)
+}
+
+func mongoInsertMany(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var database, coll string
+	var docsV *starlark.List
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "database", &database, "collection", &coll, "documents", &docsV); err != nil {
+		return nil, err
+	}
+	ns, scope, err := scopedNamespace(thread, "insertMany", database, coll)
+	if err != nil {
+		return nil, err
+	}
+	docs := make([]interface{}, 0, docsV.Len())
+	for i := 0; i < docsV.Len(); i++ {
+		doc, err := toBSON(docsV.Index(i))
+		if err != nil {
+			return nil, fmt.Errorf("invalid document %d: %w", i, err)
+		}
+		docs = append(docs, scope.Document(doc))
+	}
+
+	ctx, cancel := opContext(thread)
+	defer cancel()
+	result, err := ns.store.InsertMany(ctx, ns.database, ns.collection, docs)
+	if err != nil {
+		return nil, err
+	}
+	return fromBSON(result.InsertedIDs)
+}
+
+func mongoUpdate(op string) func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+	return func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var database, coll string
+		var filterV starlark.Value
+		var updateV *starlark.Dict
+		var upsert bool
+		if err := starlark.UnpackArgs(b.Name(), args, kwargs, "database", &database, "collection", &coll,
+			"filter", &filterV, "update", &updateV, "upsert?", &upsert); err != nil {
+			return nil, err
+		}
+		ns, scope, err := scopedNamespace(thread, op, database, coll)
+		if err != nil {
+			return nil, err
+		}
+		if policy, _ := thread.Local(policyLocal).(Policy); upsert && policy.RestrictUpserts {
+			c := thread.Local(ctxLocal).(*fiber.Ctx)
+			if err := auth.Authorize(c, "upsert", database, coll); err != nil {
+				return nil, denied(c, err)
+			}
+		}
+		filter, err := filterArg(scope, filterV)
+		if err != nil {
+			return nil, err
+		}
+		update, err := toBSON(updateV)
+		if err != nil {
+			return nil, fmt.Errorf("invalid update: %w", err)
+		}
+		if err := scope.Update(update); err != nil {
+			return nil, &scriptError{status: fiber.StatusForbidden, message: err.Error()}
+		}
+
+		ctx, cancel := opContext(thread)
+		defer cancel()
+		opts := options.Update().SetUpsert(upsert)
+		var result *mongo.UpdateResult
+		if op == "updateOne" {
+			result, err = ns.store.UpdateOne(ctx, ns.database, ns.collection, filter, update, opts)
+		} else {
+			result, err = ns.store.UpdateMany(ctx, ns.database, ns.collection, filter, update, opts)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return fromBSON(bson.M{
+			"matchedCount":  result.MatchedCount,
+			"modifiedCount": result.ModifiedCount,
+			"upsertedCount": result.UpsertedCount,
+			"upsertedId":    result.UpsertedID,
+		})
+	}
+}
+
+func mongoDelete(op string) func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+	return func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var database, coll string
+		var filterV starlark.Value
+		if err := starlark.UnpackArgs(b.Name(), args, kwargs, "database", &database, "collection", &coll, "filter", &filterV); err != nil {
+			return nil, err
+		}
+		ns, scope, err := scopedNamespace(thread, op, database, coll)
+		if err != nil {
+			return nil, err
+		}
+		filter, err := filterArg(scope, filterV)
+		if err != nil {
+			return nil, err
+		}
+
+		ctx, cancel := opContext(thread)
+		defer cancel()
+		var result *mongo.DeleteResult
+		if op == "deleteOne" {
+			result, err = ns.store.DeleteOne(ctx, ns.database, ns.collection, filter)
+		} else {
+			result, err = ns.store.DeleteMany(ctx, ns.database, ns.collection, filter)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return starlark.MakeInt64(result.DeletedCount), nil
+	}
+}
@@ -0,0 +1,240 @@
+package script
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"mongo-data-api-go-alternative/config"
+	"mongo-data-api-go-alternative/db"
+
+	"github.com/gofiber/fiber/v2"
+	"go.starlark.net/lib/json"
+	startime "go.starlark.net/lib/time"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+const (
+	ctxLocal      = "fiberCtx"
+	deadlineLocal = "deadline"
+	storeLocal    = "store"
+	policyLocal   = "policy"
+
+	// maxSteps bounds the work a single request may do regardless of timeout
+	maxSteps = 50_000_000
+)
+
+// Endpoint is a compiled custom endpoint
+type Endpoint struct {
+	Name    string
+	Method  string
+	Path    string
+	handle  starlark.Callable
+	timeout time.Duration
+	store   db.DataStore
+	policy  Policy
+}
+
+// Policy is the server configuration restricting the mongo operations of
+// scripts beyond the grants of the calling key, as it does for the data
+// endpoints
+type Policy struct {
+	// CrossDatabaseJoins are the joins to other databases aggregations
+	// may make
+	CrossDatabaseJoins []config.JoinRule
+	// RestrictUpserts requires the upsert operation for updates that upsert
+	RestrictUpserts bool
+}
+
+// scriptError is raised by fail() to return an HTTP error from a script
+type scriptError struct {
+	status  int
+	message string
+}
+
+func (e *scriptError) Error() string { return e.message }
+
+// response is returned by response() to control the status code
+type response struct {
+	status int
+	body   starlark.Value
+}
+
+func (r *response) String() string        { return fmt.Sprintf("response(%d)", r.status) }
+func (r *response) Type() string          { return "response" }
+func (r *response) Freeze()               { r.body.Freeze() }
+func (r *response) Truth() starlark.Bool  { return starlark.True }
+func (r *response) Hash() (uint32, error) { return 0, errors.New("unhashable type: response") }
+
+var predeclared = starlark.StringDict{
+	"mongo":    mongoModule,
+	"json":     json.Module,
+	"time":     startime.Module,
+	"fail":     starlark.NewBuiltin("fail", builtinFail),
+	"response": starlark.NewBuiltin("response", builtinResponse),
+}
+
+// Load compiles the scripts of the configured endpoints. Their mongo calls
+// are executed against store under policy.
+func Load(endpoints []config.Endpoint, store db.DataStore, policy Policy) ([]*Endpoint, error) {
+	compiled := make([]*Endpoint, 0, len(endpoints))
+	for _, cfg := range endpoints {
+		ep, err := compile(cfg, store, policy)
+		if err != nil {
+			return nil, fmt.Errorf("endpoint %q: %w", cfg.Name, err)
+		}
+		compiled = append(compiled, ep)
+	}
+	return compiled, nil
+}
+
+func compile(cfg config.Endpoint, store db.DataStore, policy Policy) (*Endpoint, error) {
+	method := strings.ToUpper(cfg.Method)
+	if method == "" {
+		method = fiber.MethodPost
+	}
+	if !strings.HasPrefix(cfg.Path, "/") {
+		return nil, fmt.Errorf("path %q must start with /", cfg.Path)
+	}
+	timeout := time.Duration(cfg.TimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	thread := &starlark.Thread{Name: cfg.Name, Print: printer(cfg.Name)}
+	globals, err := starlark.ExecFile(thread, cfg.Script, nil, predeclared)
+	if err != nil {
+		return nil, err
+	}
+	handle, ok := globals["handle"].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("%s does not define handle(req)", cfg.Script)
+	}
+	globals.Freeze()
+
+	return &Endpoint{Name: cfg.Name, Method: method, Path: cfg.Path, handle: handle, timeout: timeout, store: store, policy: policy}, nil
+}
+
+func printer(name string) func(*starlark.Thread, string) {
+	return func(_ *starlark.Thread, msg string) {
+		log.Printf("[script %s] %s", name, msg)
+	}
+}
+
+// Handler runs the endpoint's handle(req) function for each request
+func (ep *Endpoint) Handler(c *fiber.Ctx) error {
+	req, err := ep.request(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	deadline := time.Now().Add(ep.timeout)
+	thread := &starlark.Thread{Name: ep.Name, Print: printer(ep.Name)}
+	thread.SetLocal(ctxLocal, c)
+	thread.SetLocal(deadlineLocal, deadline)
+	thread.SetLocal(storeLocal, ep.store)
+	thread.SetLocal(policyLocal, ep.policy)
+	thread.SetMaxExecutionSteps(maxSteps)
+	timer := time.AfterFunc(ep.timeout, func() { thread.Cancel("timeout") })
+	defer timer.Stop()
+
+	result, err := starlark.Call(thread, ep.handle, starlark.Tuple{req}, nil)
+	if err != nil {
+		var se *scriptError
+		if errors.As(err, &se) {
+			return c.Status(se.status).JSON(fiber.Map{"error": se.message})
+		}
+		log.Printf("Custom endpoint %s failed: %v", ep.Name, err)
+		if evalErr, ok := err.(*starlark.EvalError); ok {
+			log.Print(evalErr.Backtrace())
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Custom endpoint failed", "details": err.Error()})
+	}
+
+	status := fiber.StatusOK
+	if r, ok := result.(*response); ok {
+		status, result = r.status, r.body
+	}
+	body, err := toGo(result)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Invalid script result", "details": err.Error()})
+	}
+	return c.Status(status).JSON(body)
+}
+
+// request builds the req struct passed to handle()
+func (ep *Endpoint) request(c *fiber.Ctx) (starlark.Value, error) {
+	params := starlark.NewDict(len(c.Route().Params))
+	for _, name := range c.Route().Params {
+		params.SetKey(starlark.String(name), starlark.String(c.Params(name)))
+	}
+
+	query := starlark.NewDict(0)
+	for k, v := range c.Queries() {
+		query.SetKey(starlark.String(k), starlark.String(v))
+	}
+
+	headers := starlark.NewDict(0)
+	c.Request().Header.VisitAll(func(k, v []byte) {
+		name := http.CanonicalHeaderKey(string(k))
+		if name != "Apikey" && name != "Adminkey" {
+			headers.SetKey(starlark.String(name), starlark.String(v))
+		}
+	})
+
+	var body starlark.Value = starlark.None
+	if len(c.Body()) > 0 {
+		var parsed interface{}
+		if err := c.BodyParser(&parsed); err != nil {
+			return nil, err
+		}
+		var err error
+		if body, err = toStarlark(parsed); err != nil {
+			return nil, err
+		}
+	}
+
+	return starlarkstruct.FromStringDict(starlark.String("request"), starlark.StringDict{
+		"method":  starlark.String(c.Method()),
+		"path":    starlark.String(c.Path()),
+		"params":  params,
+		"query":   query,
+		"headers": headers,
+		"body":    body,
+	}), nil
+}
+
+// opContext returns a context bounded by the script's deadline
+func opContext(thread *starlark.Thread) (context.Context, context.CancelFunc) {
+	deadline, _ := thread.Local(deadlineLocal).(time.Time)
+	return context.WithDeadline(context.Background(), deadline)
+}
+
+func builtinFail(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var status int
+	var message string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "status", &status, "message", &message); err != nil {
+		return nil, err
+	}
+	if status < 400 || status > 599 {
+		return nil, fmt.Errorf("fail: status %d is not an error status", status)
+	}
+	return nil, &scriptError{status: status, message: message}
+}
+
+func builtinResponse(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var status int
+	var body starlark.Value = starlark.None
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "status", &status, "body?", &body); err != nil {
+		return nil, err
+	}
+	if status < 100 || status > 599 {
+		return nil, fmt.Errorf("response: invalid status %d", status)
+	}
+	return &response{status: status, body: body}, nil
+}
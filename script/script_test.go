@@ -0,0 +1,138 @@
+package script
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"mongo-data-api-go-alternative/auth"
+	"mongo-data-api-go-alternative/config"
+	"mongo-data-api-go-alternative/db/mock"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const testKey = "test_key"
+
+// newTestApp serves the endpoints of the scripts behind the API key
+// middleware, like server.New does
+func newTestApp(t *testing.T, store *mock.Store, cfg *config.Config, scripts map[string]string) *fiber.App {
+	t.Helper()
+	if cfg.SystemDatabase == "" {
+		cfg.SystemDatabase = "dataapi_system"
+	}
+	dir := t.TempDir()
+	for name, src := range scripts {
+		file := filepath.Join(dir, name+".star")
+		if err := os.WriteFile(file, []byte(src), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		cfg.Endpoints = append(cfg.Endpoints, config.Endpoint{Name: name, Method: "POST", Path: "/" + name, Script: file})
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := auth.NewStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoints, err := Load(cfg.Endpoints, store, Policy{CrossDatabaseJoins: cfg.CrossDatabaseJoins, RestrictUpserts: cfg.RestrictUpserts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := fiber.New()
+	app.Use(auth.Middleware(auth.MiddlewareConfig{Store: keys, Tenancy: cfg.Tenancy, Maintenance: &auth.Maintenance{}, ReadOnly: cfg.ReadOnly}))
+	for _, ep := range endpoints {
+		app.Add(ep.Method, "/custom"+ep.Path, ep.Handler)
+	}
+	return app
+}
+
+func callEndpoint(t *testing.T, app *fiber.App, path, body string) int {
+	t.Helper()
+	req := httptest.NewRequest("POST", path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("apiKey", testKey)
+	res, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode
+}
+
+func TestAggregateChecks(t *testing.T) {
+	scripts := map[string]string{"report": `
+def handle(req):
+    return {"results": mongo.aggregate(req.body["database"], req.body["collection"], req.body["pipeline"])}
+`}
+	writer := config.APIKey{Name: "writer", Key: testKey, Roles: []string{"readWrite"}}
+	reader := config.APIKey{Name: "reader", Key: testKey, Roles: []string{"read"}}
+	joins := []config.JoinRule{{Source: "shop.orders", Target: "catalog.*"}}
+	lookup := `{"$lookup":{"from":{"db":"catalog","coll":"products"},"localField":"sku","foreignField":"sku","as":"product"}}`
+
+	for _, tc := range []struct {
+		name     string
+		key      config.APIKey
+		readOnly bool
+		coll     string
+		pipeline string
+		want     int
+		write    bool
+	}{
+		{"read", reader, false, "orders", `[{"$match":{}}]`, fiber.StatusOK, false},
+		{"write", writer, false, "orders", `[{"$out":"totals"}]`, fiber.StatusOK, true},
+		{"write without aggregateWrite", reader, false, "orders", `[{"$merge":{"into":"totals"}}]`, fiber.StatusForbidden, false},
+		{"write on a read-only instance", writer, true, "orders", `[{"$out":"totals"}]`, fiber.StatusForbidden, false},
+		{"write before the last stage", writer, false, "orders", `[{"$out":"totals"},{"$match":{}}]`, fiber.StatusBadRequest, false},
+		{"allowed join", reader, false, "orders", `[` + lookup + `]`, fiber.StatusOK, false},
+		{"join without a rule", reader, false, "carts", `[` + lookup + `]`, fiber.StatusForbidden, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &mock.Store{}
+			app := newTestApp(t, store, &config.Config{APIKeys: []config.APIKey{tc.key}, CrossDatabaseJoins: joins, ReadOnly: tc.readOnly}, scripts)
+			body := `{"database":"shop","collection":"` + tc.coll + `","pipeline":` + tc.pipeline + `}`
+			if status := callEndpoint(t, app, "/custom/report", body); status != tc.want {
+				t.Fatalf("status %d, want %d", status, tc.want)
+			}
+			var wrote bool
+			for _, c := range store.Calls() {
+				wrote = wrote || c.Method == "AggregateWrite"
+			}
+			if wrote != tc.write {
+				t.Errorf("AggregateWrite called: %v, want %v", wrote, tc.write)
+			}
+		})
+	}
+}
+
+func TestRestrictUpserts(t *testing.T) {
+	scripts := map[string]string{"upsert": `
+def handle(req):
+    return mongo.update_one("app", "users", {"_id": 1}, {"$set": {"a": 1}}, upsert=req.body["upsert"])
+`}
+	roles := []config.Role{
+		{Name: "writer", Operations: []string{"updateOne"}},
+		{Name: "upserter", Operations: []string{"upsert"}},
+	}
+	for _, tc := range []struct {
+		roles  []string
+		upsert string
+		want   int
+	}{
+		{[]string{"writer"}, "false", fiber.StatusOK},
+		{[]string{"writer"}, "true", fiber.StatusForbidden},
+		{[]string{"writer", "upserter"}, "true", fiber.StatusOK},
+	} {
+		store := &mock.Store{}
+		app := newTestApp(t, store, &config.Config{
+			APIKeys:         []config.APIKey{{Name: "writer", Key: testKey, Roles: tc.roles}},
+			Roles:           roles,
+			RestrictUpserts: true,
+		}, scripts)
+		if status := callEndpoint(t, app, "/custom/upsert", `{"upsert":`+tc.upsert+`}`); status != tc.want {
+			t.Errorf("roles %v, upsert %s: status %d, want %d", tc.roles, tc.upsert, status, tc.want)
+		}
+	}
+}
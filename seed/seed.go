@@ -0,0 +1,107 @@
+// Package seed loads fixture documents into empty collections, so
+// short-lived environments start with data to work with.
+package seed
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"mongo-data-api-go-alternative/config"
+	"mongo-data-api-go-alternative/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// batchSize is the number of documents inserted per InsertMany
+const batchSize = 1000
+
+// Result reports what was loaded into a collection
+type Result struct {
+	config.SeedSource
+	Inserted int `json:"inserted"`
+	// Skipped is set when the collection already had documents
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+// Apply loads every source whose collection is empty. Collections with
+// documents are left alone, so restarts and repeated runs don't duplicate
+// data. It stops at the first error.
+func Apply(ctx context.Context, store db.DataStore, sources []config.SeedSource) ([]Result, error) {
+	results := make([]Result, 0, len(sources))
+	for _, src := range sources {
+		res, err := load(ctx, store, src)
+		if err != nil {
+			return results, fmt.Errorf("seeding %s.%s from %s: %w", src.Database, src.Collection, src.File, err)
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+func load(ctx context.Context, store db.DataStore, src config.SeedSource) (Result, error) {
+	res := Result{SeedSource: src}
+	n, err := store.CountDocuments(ctx, src.Database, src.Collection, bson.D{})
+	if err != nil {
+		return res, err
+	}
+	if n > 0 {
+		res.Skipped = true
+		return res, nil
+	}
+	docs, err := ReadFile(src.File)
+	if err != nil {
+		return res, err
+	}
+	for start := 0; start < len(docs); start += batchSize {
+		end := min(start+batchSize, len(docs))
+		inserted, err := store.InsertMany(ctx, src.Database, src.Collection, docs[start:end])
+		if inserted != nil {
+			res.Inserted += len(inserted.InsertedIDs)
+		}
+		if err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// ReadFile reads the documents of a seed file: a JSON array of documents
+// or one document per line, in Extended JSON
+func ReadFile(path string) ([]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raws []json.RawMessage
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &raws); err != nil {
+			return nil, err
+		}
+	} else {
+		sc := bufio.NewScanner(bytes.NewReader(data))
+		sc.Buffer(nil, 16<<20)
+		for sc.Scan() {
+			if line := bytes.TrimSpace(sc.Bytes()); len(line) > 0 {
+				raws = append(raws, append(json.RawMessage(nil), line...))
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	docs := make([]interface{}, len(raws))
+	for i, raw := range raws {
+		var doc bson.D
+		if err := bson.UnmarshalExtJSON(raw, false, &doc); err != nil {
+			return nil, fmt.Errorf("document %d: %w", i+1, err)
+		}
+		docs[i] = doc
+	}
+	return docs, nil
+}
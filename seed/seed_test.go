@@ -0,0 +1,115 @@
+package seed
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"mongo-data-api-go-alternative/config"
+	memstore "mongo-data-api-go-alternative/db/memory"
+	"mongo-data-api-go-alternative/db/mock"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestApply(t *testing.T) {
+	ctx := context.Background()
+	store := memstore.New()
+	if _, err := store.InsertOne(ctx, "app", "orders", bson.D{{Key: "_id", Value: "existing"}}); err != nil {
+		t.Fatal(err)
+	}
+	sources := []config.SeedSource{
+		{Database: "app", Collection: "users", File: writeFile(t, "users.json", `[{"_id": 1, "name": "ann"}, {"_id": 2, "name": "bob"}]`)},
+		{Database: "app", Collection: "events", File: writeFile(t, "events.ndjson", "{\"_id\": 1, \"at\": {\"$date\": \"2024-01-02T00:00:00Z\"}}\n\n{\"_id\": 2}\n")},
+		{Database: "app", Collection: "orders", File: writeFile(t, "orders.json", `[{"_id": 1}]`)},
+	}
+
+	results, err := Apply(ctx, store, sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range results {
+		got = append(got, fmt.Sprintf("%s %d %v", r.Collection, r.Inserted, r.Skipped))
+	}
+	if want := []string{"users 2 false", "events 2 false", "orders 0 true"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("results %v, want %v", got, want)
+	}
+	// The non-empty collection was left alone
+	if docs, _ := store.Find(ctx, "app", "orders", bson.D{}, nil); len(docs) != 1 {
+		t.Errorf("orders %v", docs)
+	}
+
+	// Seeded collections aren't empty anymore, so running again adds nothing
+	results, err = Apply(ctx, store, sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if !r.Skipped || r.Inserted != 0 {
+			t.Errorf("second run: %+v", r)
+		}
+	}
+	if n, _ := store.CountDocuments(ctx, "app", "users", bson.D{}); n != 2 {
+		t.Errorf("%d users after the second run, want 2", n)
+	}
+}
+
+func TestApplyBatches(t *testing.T) {
+	lines := make([]string, 2500)
+	for i := range lines {
+		lines[i] = fmt.Sprintf(`{"n": %d}`, i)
+	}
+	store := &mock.Store{}
+	results, err := Apply(context.Background(), store, []config.SeedSource{
+		{Database: "app", Collection: "items", File: writeFile(t, "items.ndjson", strings.Join(lines, "\n"))},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var batches []int
+	for _, c := range store.Calls() {
+		if c.Method == "InsertMany" {
+			batches = append(batches, len(c.Documents))
+		}
+	}
+	if !reflect.DeepEqual(batches, []int{1000, 1000, 500}) || results[0].Inserted != 2500 {
+		t.Errorf("batches %v, inserted %d", batches, results[0].Inserted)
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	store := memstore.New()
+	results, err := Apply(context.Background(), store, []config.SeedSource{
+		{Database: "app", Collection: "users", File: writeFile(t, "users.json", `[{"_id": 1}]`)},
+		{Database: "app", Collection: "events", File: writeFile(t, "events.ndjson", "{\"_id\": 1}\n{\"_id\": {\"$oid\": \"nope\"}}\n")},
+		{Database: "app", Collection: "orders", File: writeFile(t, "orders.json", `[{"_id": 1}]`)},
+	})
+	// Loading stops at the failing source
+	if err == nil || !strings.Contains(err.Error(), "seeding app.events from ") || !strings.Contains(err.Error(), "document 2") {
+		t.Errorf("error %v", err)
+	}
+	if len(results) != 1 || results[0].Collection != "users" {
+		t.Errorf("results %+v", results)
+	}
+	if n, _ := store.CountDocuments(context.Background(), "app", "orders", bson.D{}); n != 0 {
+		t.Errorf("%d orders seeded after the error", n)
+	}
+
+	if _, err := ReadFile(filepath.Join(t.TempDir(), "missing.json")); !os.IsNotExist(err) {
+		t.Errorf("missing file: %v", err)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"mongo-data-api-go-alternative/config"
+	"mongo-data-api-go-alternative/db"
+	"mongo-data-api-go-alternative/retention"
+)
+
+// Results of the checks of serve --check
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "fail"
+)
+
+// checkReport collects the results of a self-check and prints them as a
+// table
+type checkReport struct {
+	w      *tabwriter.Writer
+	counts map[string]int
+}
+
+func newCheckReport(out io.Writer) *checkReport {
+	r := &checkReport{w: tabwriter.NewWriter(out, 0, 0, 2, ' ', 0), counts: map[string]int{}}
+	fmt.Fprintln(r.w, "RESULT\tCHECK\tDETAIL")
+	return r
+}
+
+func (r *checkReport) add(result, check, detail string, args ...interface{}) {
+	r.counts[result]++
+	fmt.Fprintf(r.w, "%s\t%s\t%s\n", result, check, fmt.Sprintf(detail, args...))
+}
+
+// selfCheck validates cfg, connects to every cluster and checks that the
+// namespaces API keys and public collections are limited to exist and that
+// the indexes the configuration relies on are in place. It prints a report
+// and fails if any check failed; warnings point at what the server fixes
+// itself at startup or what only degrades a feature.
+func selfCheck(cfg *config.Config) error {
+	r := newCheckReport(os.Stdout)
+	if err := compileConfig(cfg); err != nil {
+		r.add(checkFail, "config", "%v", err)
+	} else {
+		r.add(checkOK, "config", "%d API keys, %d roles, %d saved queries, %d custom endpoints",
+			len(cfg.APIKeys), len(cfg.Roles), len(cfg.SavedQueries), len(cfg.Endpoints))
+	}
+
+	if err := checkClusters(cfg, r); err == nil {
+		defer db.Close()
+		store := db.NewMongo(db.Client())
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		checkNamespaces(ctx, cfg, store, r)
+		checkIndexes(ctx, cfg, store, r)
+	}
+
+	r.w.Flush()
+	if n := r.counts[checkFail]; n > 0 {
+		return fmt.Errorf("self-check failed: %d of %d checks failed", n, n+r.counts[checkOK]+r.counts[checkWarn])
+	}
+	fmt.Printf("Self-check passed with %d warnings\n", r.counts[checkWarn])
+	return nil
+}
+
+// checkClusters connects to the default cluster, which the other checks
+// use, and to each additional cluster. It returns an error if the default
+// cluster is unreachable.
+func checkClusters(cfg *config.Config, r *checkReport) error {
+	start := time.Now()
+	err := connectMongo(cfg)
+	if err != nil {
+		r.add(checkFail, "cluster "+config.DefaultCluster, "%v", err)
+	} else {
+		r.add(checkOK, "cluster "+config.DefaultCluster, "reachable in %s", time.Since(start).Round(time.Millisecond))
+	}
+
+	names := make([]string, 0, len(cfg.Clusters))
+	for name := range cfg.Clusters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		start := time.Now()
+		if err := dialCluster(cfg.AppName, cfg.Clusters[name]); err != nil {
+			r.add(checkFail, "cluster "+name, "%v", err)
+		} else {
+			r.add(checkOK, "cluster "+name, "reachable in %s", time.Since(start).Round(time.Millisecond))
+		}
+	}
+	return err
+}
+
+// dialCluster connects to an additional cluster and disconnects
+func dialCluster(appName string, cluster config.Cluster) error {
+	opts, err := db.ClusterOptions(cluster.ClusterOptions)
+	if err != nil {
+		return err
+	}
+	client, err := db.Dial(cluster.URI, appName, opts)
+	if err != nil {
+		return err
+	}
+	return client.Disconnect(context.Background())
+}
+
+// checkNamespaces checks that the namespaces of API keys and public
+// collections exist. A missing collection fails; a pattern matching no
+// collection only warns, as its collections may be created later.
+func checkNamespaces(ctx context.Context, cfg *config.Config, store db.DataStore, r *checkReport) {
+	existing, err := listNamespaces(ctx, store)
+	if err != nil {
+		r.add(checkFail, "namespaces", "listing collections: %v", err)
+		return
+	}
+	check := func(owner, ns string) {
+		if !strings.ContainsAny(ns, `*?[\`) {
+			if existing[ns] {
+				r.add(checkOK, owner, "%s exists", ns)
+			} else {
+				r.add(checkFail, owner, "%s does not exist", ns)
+			}
+			return
+		}
+		for name := range existing {
+			if ok, _ := path.Match(ns, name); ok {
+				r.add(checkOK, owner, "%s matches %s", ns, name)
+				return
+			}
+		}
+		r.add(checkWarn, owner, "%s matches no collection", ns)
+	}
+
+	for _, k := range cfg.APIKeys {
+		for _, ns := range k.Namespaces {
+			// Keys of tenants of prefixed databases name their databases
+			// without the prefix
+			if cfg.Tenancy.Mode == config.TenancyPrefix && k.Tenant != "" {
+				ns = k.Tenant + "_" + ns
+			}
+			check("key "+k.Name, ns)
+		}
+	}
+	for _, p := range cfg.PublicCollections {
+		check("public collection", p.Namespace)
+	}
+}
+
+// listNamespaces returns the "database.collection" names of the
+// deployment
+func listNamespaces(ctx context.Context, store db.DataStore) (map[string]bool, error) {
+	databases, err := store.ListDatabases(ctx)
+	if err != nil {
+		return nil, err
+	}
+	namespaces := map[string]bool{}
+	for _, database := range databases {
+		collections, err := store.ListCollections(ctx, database)
+		if err != nil {
+			return nil, err
+		}
+		for _, coll := range collections {
+			namespaces[database+"."+coll] = true
+		}
+	}
+	return namespaces, nil
+}
+
+// checkIndexes compares the indexes with the retention policies and checks
+// that the natural keys of collections are covered by a unique index
+func checkIndexes(ctx context.Context, cfg *config.Config, store db.DataStore, r *checkReport) {
+	manager := &retention.Manager{Store: store, Policies: cfg.Retention}
+	for _, st := range manager.Check(ctx) {
+		name := fmt.Sprintf("retention %s.%s", st.Database, st.Collection)
+		switch st.State {
+		case retention.StateOK:
+			r.add(checkOK, name, "TTL index %s on %s", st.Index, st.Field)
+		case retention.StateMissing, retention.StateDrift:
+			r.add(checkWarn, name, "TTL index on %s is %s and will be applied at startup", st.Field, st.State)
+		default:
+			r.add(checkFail, name, "%s", st.Error)
+		}
+	}
+
+	namespaces := make([]string, 0, len(cfg.NaturalKeys))
+	for ns := range cfg.NaturalKeys {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	for _, ns := range namespaces {
+		fields := cfg.NaturalKeys[ns]
+		name := "natural key " + ns
+		database, coll, _ := strings.Cut(ns, ".")
+		indexes, err := store.ListIndexes(ctx, database, coll)
+		if err != nil {
+			r.add(checkFail, name, "listing indexes: %v", err)
+			continue
+		}
+		if index := uniqueIndexOn(indexes, fields); index != "" {
+			r.add(checkOK, name, "unique index %s", index)
+		} else {
+			r.add(checkWarn, name, "no unique index on %s, so concurrent inserts may duplicate documents", strings.Join(fields, ", "))
+		}
+	}
+}
+
+// uniqueIndexOn returns the name of a unique index on exactly fields, in
+// any order
+func uniqueIndexOn(indexes []db.Index, fields []string) string {
+	for _, index := range indexes {
+		if !index.Unique || len(index.Keys) != len(fields) {
+			continue
+		}
+		covered := 0
+		for _, k := range index.Keys {
+			for _, f := range fields {
+				if k.Key == f {
+					covered++
+					break
+				}
+			}
+		}
+		if covered == len(fields) {
+			return index.Name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+
+	"mongo-data-api-go-alternative/config"
+	"mongo-data-api-go-alternative/db"
+	memstore "mongo-data-api-go-alternative/db/memory"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestSelfCheck(t *testing.T) {
+	ctx := context.Background()
+	store := memstore.New()
+	for _, ns := range [][2]string{{"app", "users"}, {"app", "orders"}, {"acme_app", "users"}} {
+		if _, err := store.InsertOne(ctx, ns[0], ns[1], bson.D{{Key: "a", Value: 1}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.CreateIndex(ctx, "app", "orders", db.Index{Keys: bson.D{{Key: "sku", Value: 1}, {Key: "region", Value: 1}}, Unique: true}); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		Tenancy: config.TenancyConfig{Mode: config.TenancyPrefix},
+		APIKeys: []config.APIKey{
+			{Name: "reader", Namespaces: []string{"app.users", "app.missing", "app.ord*", "logs.*"}},
+			{Name: "acme", Tenant: "acme", Namespaces: []string{"app.users"}},
+		},
+		PublicCollections: []config.PublicCollection{{Namespace: "app.orders"}},
+		Retention:         []config.RetentionPolicy{{Database: "app", Collection: "users", Field: "createdAt", ExpireAfter: "30d"}},
+		NaturalKeys:       map[string][]string{"app.orders": {"region", "sku"}, "app.users": {"email"}},
+	}
+
+	var out bytes.Buffer
+	r := newCheckReport(&out)
+	checkNamespaces(ctx, cfg, store, r)
+	checkIndexes(ctx, cfg, store, r)
+	r.w.Flush()
+
+	want := []string{
+		"RESULT CHECK DETAIL",
+		"ok key reader app.users exists",
+		"fail key reader app.missing does not exist",
+		"ok key reader app.ord* matches app.orders",
+		"warn key reader logs.* matches no collection",
+		"ok key acme acme_app.users exists",
+		"ok public collection app.orders exists",
+		"warn retention app.users TTL index on createdAt is missing and will be applied at startup",
+		"ok natural key app.orders unique index sku_1_region_1",
+		"warn natural key app.users no unique index on email, so concurrent inserts may duplicate documents",
+	}
+	spaces := regexp.MustCompile(` {2,}`)
+	got := strings.Split(strings.TrimSpace(out.String()), "\n")
+	for i := range got {
+		got[i] = spaces.ReplaceAllString(strings.TrimSpace(got[i]), " ")
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("report:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if r.counts[checkOK] != 5 || r.counts[checkWarn] != 3 || r.counts[checkFail] != 1 {
+		t.Errorf("counts %v", r.counts)
+	}
+}
+
+func TestUniqueIndexOn(t *testing.T) {
+	indexes := []db.Index{
+		{Name: "_id_", Keys: bson.D{{Key: "_id", Value: 1}}},
+		{Name: "email_1", Keys: bson.D{{Key: "email", Value: 1}}},
+		{Name: "tenant_1_email_1", Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "email", Value: 1}}, Unique: true},
+	}
+	for _, tc := range []struct {
+		fields []string
+		want   string
+	}{
+		{[]string{"email", "tenant"}, "tenant_1_email_1"},
+		{[]string{"tenant", "email"}, "tenant_1_email_1"},
+		// Not unique, or on other fields
+		{[]string{"email"}, ""},
+		{[]string{"tenant", "email", "name"}, ""},
+		{[]string{"tenant", "tenant"}, ""},
+	} {
+		if got := uniqueIndexOn(indexes, tc.fields); got != tc.want {
+			t.Errorf("%v: %q, want %q", tc.fields, got, tc.want)
+		}
+	}
+}
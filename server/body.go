@@ -0,0 +1,38 @@
+package server
+
+import (
+	"io"
+
+	"mongo-data-api-go-alternative/handlers"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// bodyLimit enforces the body limit in bytes. The server streams request
+// bodies so that bulk writes can read them incrementally, which bypasses
+// Fiber's own limit; every other request is held to it here.
+func bodyLimit(limit int) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if limit <= 0 || !c.Request().IsBodyStream() || handlers.Streamed(c) {
+			return c.Next()
+		}
+		if c.Request().Header.ContentLength() > limit {
+			// The unread body can't be skipped, so the connection is dropped
+			c.Context().SetConnectionClose()
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": "Request body too large"})
+		}
+		// Bodies of unknown (chunked) length are read up to the limit
+		if c.Request().Header.ContentLength() < 0 {
+			body, err := io.ReadAll(io.LimitReader(c.Context().RequestBodyStream(), int64(limit)+1))
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+			}
+			if len(body) > limit {
+				c.Context().SetConnectionClose()
+				return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": "Request body too large"})
+			}
+			c.Request().SetBody(body)
+		}
+		return c.Next()
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+
+	"mongo-data-api-go-alternative/config"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// securityHeaders sets the standard security headers on every response.
+// The admin UI only loads its own scripts and styles, so the same policy
+// covers it and the API. HSTS is only sent when the server terminates TLS.
+func securityHeaders(tls bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+		c.Set(fiber.HeaderXFrameOptions, "DENY")
+		c.Set(fiber.HeaderReferrerPolicy, "no-referrer")
+		c.Set(fiber.HeaderContentSecurityPolicy, "default-src 'self'; frame-ancestors 'none'")
+		c.Set("Cross-Origin-Opener-Policy", "same-origin")
+		if tls {
+			c.Set(fiber.HeaderStrictTransportSecurity, "max-age=63072000; includeSubDomains")
+		}
+		return c.Next()
+	}
+}
+
+// importTypes are the media types /api/import accepts besides JSON
+var importTypes = []string{"text/csv", "application/x-ndjson", "application/ndjson"}
+
+// harden rejects requests before they reach authentication or a handler:
+// overlong URLs, too many headers, bodies declared larger than any request
+// may be, and, with requireJson, POST bodies that are not JSON
+func harden(cfg *config.Config) fiber.Handler {
+	maxBody := cfg.MaxStreamBodyMB << 20
+	return func(c *fiber.Ctx) error {
+		if cfg.MaxURLLength > 0 && len(c.Request().RequestURI()) > cfg.MaxURLLength {
+			return c.Status(fiber.StatusRequestURITooLong).JSON(fiber.Map{"error": fmt.Sprintf("URL longer than %d characters", cfg.MaxURLLength)})
+		}
+		if cfg.MaxHeaders > 0 && c.Request().Header.Len() > cfg.MaxHeaders {
+			return c.Status(fiber.StatusRequestHeaderFieldsTooLarge).JSON(fiber.Map{"error": fmt.Sprintf("more than %d request headers", cfg.MaxHeaders)})
+		}
+		if maxBody > 0 && c.Request().Header.ContentLength() > maxBody {
+			// The unread body can't be skipped, so the connection is dropped
+			c.Context().SetConnectionClose()
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": "Request body too large"})
+		}
+		if cfg.RequireJSON && c.Method() == fiber.MethodPost && c.Request().Header.ContentLength() != 0 && !jsonBody(c) {
+			return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{"error": "Content-Type must be application/json"})
+		}
+		return c.Next()
+	}
+}
+
+// jsonBody reports whether a request body is declared as JSON, or as CSV or
+// NDJSON for an import
+func jsonBody(c *fiber.Ctx) bool {
+	mediaType, _, err := mime.ParseMediaType(c.Get(fiber.HeaderContentType))
+	if err != nil {
+		return false
+	}
+	if mediaType == fiber.MIMEApplicationJSON || strings.HasSuffix(mediaType, "+json") {
+		return true
+	}
+	if strings.HasSuffix(c.Path(), "/api/import") {
+		for _, t := range importTypes {
+			if mediaType == t {
+				return true
+			}
+		}
+	}
+	return false
+}
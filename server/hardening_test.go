@@ -0,0 +1,82 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"mongo-data-api-go-alternative/config"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestHarden(t *testing.T) {
+	app := fiber.New()
+	app.Use(harden(&config.Config{MaxURLLength: 64, MaxHeaders: 10, MaxStreamBodyMB: 1, RequireJSON: true}))
+	app.All("/api/*", func(c *fiber.Ctx) error { return c.JSON(fiber.Map{"ok": true}) })
+
+	request := func(method, path, contentType string, body string, headers int) *http.Request {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		for i := 0; i < headers; i++ {
+			req.Header.Set(fmt.Sprintf("X-Extra-%d", i), "1")
+		}
+		return req
+	}
+	for _, tc := range []struct {
+		name string
+		req  *http.Request
+		want int
+	}{
+		{"read", request("GET", "/api/find", "", "", 0), fiber.StatusOK},
+		{"long URL", request("GET", "/api/find?filter="+strings.Repeat("a", 64), "", "", 0), fiber.StatusRequestURITooLong},
+		{"headers under the limit", request("GET", "/api/find", "", "", 5), fiber.StatusOK},
+		{"too many headers", request("GET", "/api/find", "", "", 10), fiber.StatusRequestHeaderFieldsTooLarge},
+		{"large body", request("POST", "/api/insertMany", "application/json", strings.Repeat(" ", 1<<20+1), 0), fiber.StatusRequestEntityTooLarge},
+		{"JSON", request("POST", "/api/find", "application/json; charset=utf-8", "{}", 0), fiber.StatusOK},
+		{"JSON suffix", request("POST", "/api/find", "application/vnd.api+json", "{}", 0), fiber.StatusOK},
+		{"no body", request("POST", "/api/find", "", "", 0), fiber.StatusOK},
+		{"form", request("POST", "/api/find", "application/x-www-form-urlencoded", "a=1", 0), fiber.StatusUnsupportedMediaType},
+		{"CSV", request("POST", "/api/find", "text/csv", "a\n1", 0), fiber.StatusUnsupportedMediaType},
+		{"CSV import", request("POST", "/api/import", "text/csv", "a\n1", 0), fiber.StatusOK},
+		{"NDJSON import", request("POST", "/api/import", "application/x-ndjson", "{}", 0), fiber.StatusOK},
+		{"form PUT", request("PUT", "/api/find", "application/x-www-form-urlencoded", "a=1", 0), fiber.StatusOK},
+	} {
+		res, err := app.Test(tc.req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.name, res.StatusCode, tc.want)
+		}
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	for _, tls := range []bool{false, true} {
+		app := fiber.New()
+		app.Use(securityHeaders(tls))
+		app.Get("/", func(c *fiber.Ctx) error { return c.SendString("ok") })
+		res, err := app.Test(httptest.NewRequest("GET", "/", nil), -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for header, want := range map[string]string{
+			"X-Content-Type-Options":  "nosniff",
+			"X-Frame-Options":         "DENY",
+			"Referrer-Policy":         "no-referrer",
+			"Content-Security-Policy": "default-src 'self'; frame-ancestors 'none'",
+		} {
+			if got := res.Header.Get(header); got != want {
+				t.Errorf("tls %v: %s %q, want %q", tls, header, got, want)
+			}
+		}
+		if hsts := res.Header.Get("Strict-Transport-Security"); (hsts != "") != tls {
+			t.Errorf("tls %v: Strict-Transport-Security %q", tls, hsts)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"mongo-data-api-go-alternative/config"
+	"mongo-data-api-go-alternative/handlers"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+)
+
+// NewHandler builds the Data API as an http.Handler so it can be served by
+// net/http and composed with standard middleware (authenticating proxies,
+// chi or echo routers, ...). Requests are translated to the same Fiber
+// handlers used by New, but bodies are buffered on the way in and out, so
+// the endpoints that stream them are rejected; see Handler.
+func NewHandler(cfg *config.Config) (http.Handler, error) {
+	app, err := New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return Handler(app, cfg), nil
+}
+
+// streamingPaths are the endpoints whose responses are written while they
+// run, for as long as a tail lasts
+var streamingPaths = []string{"/api/export", "/api/tail"}
+
+// Handler adapts an app built by New or NewSplit to an http.Handler. The
+// adaptor reads the whole request body before calling the app and writes
+// the response once the handler returns, so exports, tails, imports with
+// progress and streamed bulk writes are answered with 501 instead of
+// holding everything in memory or never responding.
+func Handler(app *fiber.App, cfg *config.Config) http.Handler {
+	handler := adaptor.FiberApp(app)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if streaming(r) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotImplemented)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "streamed requests and responses are not supported by the net/http engine; use HTTP_ENGINE=fiber"})
+			return
+		}
+		// The adaptor routes by RequestURI; derive it from URL so that
+		// http.StripPrefix and routers that rewrite the path work
+		r = r.Clone(r.Context())
+		r.RequestURI = r.URL.RequestURI()
+		// Enforce the body limit like the Fiber server does
+		if limit := int64(cfg.BodyLimitMB) << 20; limit > 0 {
+			if r.ContentLength > limit {
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		handler(w, r)
+	})
+}
+
+// streaming reports whether a request streams its body or its response
+func streaming(r *http.Request) bool {
+	for _, path := range streamingPaths {
+		if strings.HasSuffix(r.URL.Path, path) {
+			return true
+		}
+	}
+	query := r.URL.Query()
+	if progress, _ := strconv.ParseBool(query.Get("progress")); progress && strings.HasSuffix(r.URL.Path, "/api/import") {
+		return true
+	}
+	stream, _ := strconv.ParseBool(query.Get("stream"))
+	for _, path := range handlers.StreamedPaths {
+		if stream && strings.HasSuffix(r.URL.Path, path) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"mongo-data-api-go-alternative/config"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestHandlerRejectsStreaming(t *testing.T) {
+	app := fiber.New()
+	app.Post("/api/*", func(c *fiber.Ctx) error { return c.JSON(fiber.Map{"ok": true}) })
+	handler := Handler(app, &config.Config{})
+
+	for _, tc := range []struct {
+		path string
+		want int
+	}{
+		{"/api/find", http.StatusOK},
+		{"/api/insertMany", http.StatusOK},
+		{"/api/import?progress=false", http.StatusOK},
+		{"/api/insertMany?stream=true", http.StatusNotImplemented},
+		{"/api/import?stream=1", http.StatusNotImplemented},
+		{"/api/import?progress=true", http.StatusNotImplemented},
+		{"/api/export", http.StatusNotImplemented},
+		{"/data/api/tail", http.StatusNotImplemented},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", tc.path, strings.NewReader("{}")))
+		if rec.Code != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.path, rec.Code, tc.want)
+		}
+		if tc.want == http.StatusNotImplemented && !strings.Contains(rec.Body.String(), "HTTP_ENGINE=fiber") {
+			t.Errorf("%s: body %s", tc.path, rec.Body)
+		}
+	}
+}
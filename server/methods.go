@@ -0,0 +1,23 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// allowedMethods answers OPTIONS requests with 204 and the methods routed
+// for their path in the Allow header. No route handles OPTIONS, so Fiber
+// fails the request with 405 after listing the methods that would have
+// matched; authentication lets OPTIONS through for it to get there.
+func allowedMethods(c *fiber.Ctx) error {
+	if c.Method() != fiber.MethodOptions {
+		return c.Next()
+	}
+	err := c.Next()
+	if errors.Is(err, fiber.ErrMethodNotAllowed) {
+		c.Append(fiber.HeaderAllow, fiber.MethodOptions)
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+	return err
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"mongo-data-api-go-alternative/auth"
+	"mongo-data-api-go-alternative/config"
+	"mongo-data-api-go-alternative/query"
+)
+
+// configPollInterval is how often watched configuration files are checked
+// for changes
+const configPollInterval = 10 * time.Second
+
+// configWatcher reloads the API keys, roles and saved queries when the
+// configuration files change. Other settings only take effect on restart.
+// The files are compared by content, since Kubernetes updates mounted
+// ConfigMaps and Secrets by swapping a symlink.
+type configWatcher struct {
+	files   []string
+	keys    *auth.Store
+	queries *query.Registry
+
+	mu sync.Mutex
+	// seen are the digests of the files when last checked, applied those
+	// of the configuration in effect
+	seen    map[string]string
+	applied map[string]string
+	loaded  time.Time
+	err     error
+}
+
+// configStatus reports the configuration a server runs with
+type configStatus struct {
+	// Files maps each watched file to the SHA-256 digest of the content
+	// last applied
+	Files  map[string]string `json:"files"`
+	Loaded time.Time         `json:"loaded"`
+	// Error is why the current content of the files was not applied
+	Error string `json:"error,omitempty"`
+}
+
+func newConfigWatcher(cfg *config.Config, keys *auth.Store, queries *query.Registry) *configWatcher {
+	w := &configWatcher{files: cfg.Files(), keys: keys, queries: queries, loaded: time.Now().UTC()}
+	w.seen, _ = w.read()
+	w.applied = w.seen
+	return w
+}
+
+// read returns the digests of the files
+func (w *configWatcher) read() (map[string]string, error) {
+	digests := make(map[string]string, len(w.files))
+	for _, file := range w.files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(b)
+		digests[file] = hex.EncodeToString(sum[:])
+	}
+	return digests, nil
+}
+
+// watch checks the files every interval
+func (w *configWatcher) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		w.check()
+	}
+}
+
+// check reloads the configuration if the files changed since it was last
+// applied. A configuration that fails to load is reported and retried on
+// the next change, while the server keeps the previous one.
+func (w *configWatcher) check() {
+	digests, err := w.read()
+	if err != nil {
+		// e.g. while the files are being replaced
+		log.Printf("Checking configuration files: %v", err)
+		return
+	}
+	w.mu.Lock()
+	unchanged := equalDigests(digests, w.seen)
+	w.mu.Unlock()
+	if unchanged {
+		return
+	}
+
+	err = w.apply()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.seen, w.err = digests, err
+	if err != nil {
+		log.Printf("Configuration not reloaded: %v", err)
+		return
+	}
+	w.applied, w.loaded = digests, time.Now().UTC()
+	log.Printf("Reloaded API keys, roles and saved queries")
+}
+
+func (w *configWatcher) apply() error {
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	// Roles are checked first so that a failure changes nothing
+	for _, r := range cfg.Roles {
+		if err := auth.ValidateRole(r); err != nil {
+			return err
+		}
+	}
+	if err := w.queries.SetStatic(cfg.SavedQueries); err != nil {
+		return err
+	}
+	if err := w.keys.SetStatic(cfg.APIKeys, cfg.Roles); err != nil {
+		return err
+	}
+	// Bring back persisted entries no longer shadowed by configured ones
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := w.keys.Reload(ctx); err != nil {
+		log.Printf("Failed to reload API keys: %v", err)
+	}
+	if err := w.queries.Reload(ctx); err != nil {
+		log.Printf("Failed to reload saved queries: %v", err)
+	}
+	return nil
+}
+
+func (w *configWatcher) status() configStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	st := configStatus{Files: w.applied, Loaded: w.loaded}
+	if w.err != nil {
+		st.Error = w.err.Error()
+	}
+	return st
+}
+
+func equalDigests(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for file, digest := range a {
+		if b[file] != digest {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"mongo-data-api-go-alternative/auth"
+	"mongo-data-api-go-alternative/config"
+	"mongo-data-api-go-alternative/query"
+)
+
+func TestConfigReload(t *testing.T) {
+	dir := t.TempDir()
+	configFile, keysFile := filepath.Join(dir, "config.json"), filepath.Join(dir, "keys.json")
+	write := func(file, content string) {
+		t.Helper()
+		if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(configFile, `{"apiKeysFile": "`+keysFile+`", "savedQueries": [{"name": "recent", "operation": "find", "database": "app", "collection": "orders"}]}`)
+	write(keysFile, `[{"name": "ann", "key": "key-ann"}]`)
+	t.Setenv("CONFIG_FILE", configFile)
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := auth.NewStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries, err := query.NewRegistry(cfg.SavedQueries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newConfigWatcher(cfg, keys, queries)
+	initial := w.status()
+	if len(initial.Files) != 2 || initial.Files[configFile] == "" || initial.Files[keysFile] == "" {
+		t.Fatalf("watching %v", initial.Files)
+	}
+
+	w.check()
+	if st := w.status(); !st.Loaded.Equal(initial.Loaded) {
+		t.Error("unchanged files reloaded")
+	}
+
+	// A rotated key and a new saved query are applied
+	write(keysFile, `[{"name": "bob", "key": "key-bob"}]`)
+	write(configFile, `{"apiKeysFile": "`+keysFile+`", "savedQueries": [{"name": "all", "operation": "find", "database": "app", "collection": "orders"}]}`)
+	w.check()
+	if _, ok := keys.Lookup("key-bob"); !ok {
+		t.Error("new key not loaded")
+	}
+	if _, ok := keys.Lookup("key-ann"); ok {
+		t.Error("removed key still valid")
+	}
+	if _, ok, _ := queries.Get("all"); !ok {
+		t.Error("new saved query not loaded")
+	}
+	applied := w.status()
+	if applied.Error != "" || applied.Files[keysFile] == initial.Files[keysFile] || applied.Loaded.Before(initial.Loaded) {
+		t.Errorf("status %+v", applied)
+	}
+
+	// An invalid configuration is reported and keeps the current one
+	write(keysFile, `[{"name": "cy", "key": "key-cy"}, {"name": "cy", "key": "key-cy2"}]`)
+	w.check()
+	invalid := w.status()
+	if invalid.Error == "" || invalid.Files[keysFile] != applied.Files[keysFile] {
+		t.Errorf("invalid configuration: status %+v", invalid)
+	}
+	if _, ok := keys.Lookup("key-bob"); !ok {
+		t.Error("key dropped by an invalid configuration")
+	}
+
+	// Missing files, e.g. while being replaced, are checked again later
+	if err := os.Remove(keysFile); err != nil {
+		t.Fatal(err)
+	}
+	w.check()
+	if st := w.status(); st.Error != invalid.Error {
+		t.Errorf("missing file: status %+v", st)
+	}
+	write(keysFile, `[{"name": "cy", "key": "key-cy"}]`)
+	w.check()
+	if st := w.status(); st.Error != "" {
+		t.Errorf("fixed configuration: status %+v", st)
+	}
+	if _, ok := keys.Lookup("key-cy"); !ok {
+		t.Error("fixed configuration not applied")
+	}
+}
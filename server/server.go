@@ -0,0 +1,622 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"mongo-data-api-go-alternative/accesslog"
+	"mongo-data-api-go-alternative/alert"
+	"mongo-data-api-go-alternative/auth"
+	"mongo-data-api-go-alternative/config"
+	"mongo-data-api-go-alternative/db"
+	"mongo-data-api-go-alternative/db/memory"
+	"mongo-data-api-go-alternative/failover"
+	"mongo-data-api-go-alternative/fixtures"
+	"mongo-data-api-go-alternative/handlers"
+	"mongo-data-api-go-alternative/history"
+	"mongo-data-api-go-alternative/jobs"
+	"mongo-data-api-go-alternative/metrics"
+	"mongo-data-api-go-alternative/migrations"
+	"mongo-data-api-go-alternative/mirror"
+	"mongo-data-api-go-alternative/priority"
+	"mongo-data-api-go-alternative/protoschema"
+	"mongo-data-api-go-alternative/query"
+	"mongo-data-api-go-alternative/ratelimit"
+	"mongo-data-api-go-alternative/retention"
+	"mongo-data-api-go-alternative/script"
+	"mongo-data-api-go-alternative/seed"
+	"mongo-data-api-go-alternative/sessions"
+	"mongo-data-api-go-alternative/shadow"
+	"mongo-data-api-go-alternative/trafficmirror"
+	"mongo-data-api-go-alternative/trash"
+	"mongo-data-api-go-alternative/ui"
+	"mongo-data-api-go-alternative/warmup"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/pprof"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// New builds the Data API application. It connects to cfg.MongoURI unless a
+// client was already set with db.SetClient, or serves an in-memory store
+// when cfg.Mock or cfg.ReplayDir is set. The returned app can be started with Listen or
+// mounted into another Fiber app, e.g. parent.Mount("/data", app).
+//
+// Metrics are registered with the default Prometheus registry, so New must
+// only be called once per process.
+func New(cfg *config.Config) (*fiber.App, error) {
+	s, err := newService(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return s.app(true, false), nil
+}
+
+// NewSplit builds the Data API like New, as two apps sharing their state:
+// public serves the data endpoints only, and internal additionally serves
+// metrics, the readiness probe, profiling, the admin API and the admin UI.
+// internal is meant for a listener on cfg.AdminPort that is not exposed to
+// clients. Like New, it must only be called once per process.
+func NewSplit(cfg *config.Config) (public, internal *fiber.App, err error) {
+	s, err := newService(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.app(false, false), s.app(true, true), nil
+}
+
+// service is the state shared by the apps serving the Data API
+type service struct {
+	cfg     *config.Config
+	keys    *auth.Store
+	queries *query.Registry
+	// maintenance freezes operations when enabled through the admin API
+	maintenance *auth.Maintenance
+	protos      *protoschema.Registry
+	jobManager  *jobs.Manager
+	sessions    *sessions.Manager
+	store       db.DataStore
+	clusters    map[string]db.DataStore
+	endpoints   []*script.Endpoint
+	limiter     *ratelimit.Limiter
+	retention   *retention.Manager
+	warmer      *warmup.Warmer
+	migrations  *migrations.Runner
+	metrics     *metrics.Metrics
+	// fixtures records or replays the data endpoints, if enabled
+	fixtures fiber.Handler
+	// accessLog logs every request, if enabled
+	accessLog fiber.Handler
+	// alerter posts webhook alerts on high error rates or latency, if
+	// enabled
+	alerter *alert.Alerter
+	// queue bounds the requests served at once, if enabled
+	queue *priority.Queue
+	// mirror mirrors the writes of store to another cluster, if dual
+	// writes are enabled
+	mirror *mirror.Store
+	// shadow compares reads of store with another cluster, if shadow reads
+	// are enabled
+	shadow *shadow.Store
+	// traffic replays a sample of the requests to another
+	// deployment, if enabled
+	traffic *trafficmirror.Mirror
+	// history saves the versions of documents of versioned collections, if
+	// any
+	history *history.Store
+	// trash holds the documents deleted from trashed collections, if any
+	trash *trash.Store
+	// operations lists and kills the operations in progress on the default
+	// cluster, nil in mock mode
+	operations db.OperationManager
+	// views creates and drops the views of the default cluster, nil in mock
+	// mode
+	views db.ViewManager
+	// inspector describes the deployment of the default cluster, nil in
+	// mock mode
+	inspector db.ServerInspector
+	// started is when the service was created
+	started time.Time
+	// ready reports whether the data store is reachable
+	ready func(ctx context.Context) error
+	// watcher reloads keys, roles and saved queries when the configuration
+	// files change, if enabled
+	watcher *configWatcher
+}
+
+// newService loads the configured keys, queries and scripts and connects the
+// data stores
+func newService(cfg *config.Config) (*service, error) {
+	keys, err := auth.NewStore(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("loading API keys: %w", err)
+	}
+	queries, err := query.NewRegistry(cfg.SavedQueries)
+	if err != nil {
+		return nil, fmt.Errorf("loading saved queries: %w", err)
+	}
+	protos, err := protoschema.Load(cfg.ProtoSchemas)
+	if err != nil {
+		return nil, err
+	}
+
+	jobManager := jobs.NewManager(cfg.JobsDir)
+	if cfg.JobRetentionHours > 0 {
+		jobManager.StartExpiry(time.Duration(cfg.JobRetentionHours) * time.Hour)
+	}
+	maintenance := &auth.Maintenance{}
+
+	m := metrics.New(metrics.Options{
+		HTTPBuckets:      cfg.Metrics.HTTPBuckets,
+		MongoBuckets:     cfg.Metrics.MongoBuckets,
+		NativeHistograms: cfg.Metrics.NativeHistograms,
+	})
+	m.WatchCursors(db.Cursors.Open, db.Cursors.Closed)
+	requestQueue := priority.New(cfg.RequestQueue)
+	if requestQueue != nil {
+		m.WatchRequestQueue(priority.Classes, requestQueue.Stats)
+		log.Printf("Request queue: serving %d requests at once", cfg.RequestQueue.MaxConcurrent)
+	}
+	limiter := ratelimit.New()
+	if cfg.RateLimitRedis.URL != "" {
+		shared, err := ratelimit.NewRedis(cfg.RateLimitRedis)
+		if err != nil {
+			return nil, err
+		}
+		limiter = ratelimit.NewShared(shared)
+		m.WatchRateLimitFallback(limiter.Fallback)
+		log.Printf("Rate limits: sharing buckets through Redis")
+	}
+	if cfg.CursorMaxAgeSeconds > 0 {
+		db.Cursors.StartExpiry(time.Duration(cfg.CursorMaxAgeSeconds) * time.Second)
+	}
+	monitor := func(cluster string) *options.ClientOptions {
+		return options.Client().SetMonitor(m.CommandMonitor()).SetServerMonitor(m.ServerMonitor(cluster))
+	}
+
+	var store db.DataStore
+	ready := func(context.Context) error { return nil }
+	clusters := make(map[string]db.DataStore, len(cfg.Clusters)+1)
+	if cfg.Mock || cfg.ReplayDir != "" {
+		// Keys, roles and saved queries managed through the admin API are
+		// kept in memory as well
+		mem := memory.New()
+		if cfg.MockData != "" {
+			f, err := os.Open(cfg.MockData)
+			if err != nil {
+				return nil, fmt.Errorf("loading mock data: %w", err)
+			}
+			err = mem.Load(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("loading mock data from %s: %w", cfg.MockData, err)
+			}
+		}
+		if cfg.ReplayDir == "" {
+			log.Println("Mock mode: serving an in-memory data store, nothing is persisted")
+		}
+		store = mem
+		for name := range cfg.Clusters {
+			clusters[name] = memory.New()
+		}
+	} else {
+		mongoOptions, err := db.ClusterOptions(cfg.MongoOptions)
+		if err != nil {
+			return nil, err
+		}
+		if store, err = connect(cfg, keys, queries, maintenance, jobManager, mongoOptions, monitor(config.DefaultCluster)); err != nil {
+			return nil, err
+		}
+		ready = func(ctx context.Context) error { return db.Client().Ping(ctx, nil) }
+		for name, cluster := range cfg.Clusters {
+			clusterOptions, err := db.ClusterOptions(cluster.ClusterOptions)
+			if err != nil {
+				return nil, fmt.Errorf("cluster %s: %w", name, err)
+			}
+			client, err := db.Dial(cluster.URI, cfg.AppName, clusterOptions, monitor(name))
+			if err != nil {
+				return nil, fmt.Errorf("connecting to cluster %s: %w", name, err)
+			}
+			clusters[name] = db.NewMongo(client)
+		}
+	}
+
+	// Operations in progress are listed and killed on the default cluster
+	// itself
+	operations, _ := store.(db.OperationManager)
+	views, _ := store.(db.ViewManager)
+	inspector, _ := store.(db.ServerInspector)
+
+	// Retry the reads the default cluster fails or is too slow for on a
+	// standby
+	if cfg.ReadFailover.Cluster != "" {
+		failoverStore := failover.New(store, clusters[cfg.ReadFailover.Cluster], cfg.ReadFailover)
+		m.WatchFailovers(failover.Reasons, failoverStore.Failovers)
+		store = failoverStore
+		log.Printf("Read failover: retrying failed reads on cluster %s", cfg.ReadFailover.Cluster)
+	}
+
+	// Mirror the writes to the cluster collections are migrated to
+	var mirrorStore *mirror.Store
+	if cfg.DualWrite.Cluster != "" {
+		mirrorStore = mirror.New(store, clusters[cfg.DualWrite.Cluster], cfg.DualWrite)
+		store = mirrorStore
+		log.Printf("Dual writes: mirroring writes to cluster %s", cfg.DualWrite.Cluster)
+	}
+
+	// Compare a sample of the reads with another cluster
+	var shadowStore *shadow.Store
+	if cfg.ShadowReads.Cluster != "" {
+		shadowStore = shadow.New(store, clusters[cfg.ShadowReads.Cluster], cfg.ShadowReads, cfg.SystemDatabase)
+		store = shadowStore
+		log.Printf("Shadow reads: comparing %g%% of reads with cluster %s", cfg.ShadowReads.Percent, cfg.ShadowReads.Cluster)
+	}
+
+	// Keep the prior versions of the documents of versioned collections
+	var historyStore *history.Store
+	if len(cfg.VersionedCollections) > 0 {
+		historyStore = history.New(store, cfg.VersionedCollections, cfg.Tenancy.Mode == config.TenancyPrefix)
+		store = historyStore
+	}
+	// Move the documents deleted from trashed collections to the trash
+	var trashStore *trash.Store
+	if len(cfg.Trash.Collections) > 0 {
+		trashStore = trash.New(store, cfg.Trash, cfg.Tenancy.Mode == config.TenancyPrefix)
+		store = trashStore
+	}
+	clusters[config.DefaultCluster] = store
+
+	// Load and optionally apply schema migrations
+	var migrationRunner *migrations.Runner
+	if cfg.MigrationsDir != "" {
+		list, err := migrations.Load(cfg.MigrationsDir)
+		if err != nil {
+			return nil, err
+		}
+		migrationRunner = &migrations.Runner{Store: store, Database: cfg.SystemDatabase, Migrations: list}
+		if cfg.MigrateOnStart {
+			results, err := migrationRunner.Up(context.Background(), 0, false)
+			for _, res := range results {
+				log.Printf("Applied migration %d %s", res.Version, res.Name)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("applying migrations: %w", err)
+			}
+		}
+	}
+
+	// Load fixture documents into empty collections
+	if len(cfg.Seed) > 0 {
+		results, err := seed.Apply(context.Background(), store, cfg.Seed)
+		for _, res := range results {
+			if !res.Skipped {
+				log.Printf("Seeded %s.%s with %d documents from %s", res.Database, res.Collection, res.Inserted, res.File)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sessionManager := sessions.NewManager(store, time.Duration(cfg.SessionIdleTimeoutSeconds)*time.Second)
+	sessionManager.StartReaper()
+
+	// Ensure the TTL indexes of the retention policies
+	retentionManager := &retention.Manager{Store: store, Policies: cfg.Retention}
+	if len(cfg.Retention) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		for _, st := range retentionManager.Apply(ctx) {
+			if st.State == retention.StateOK {
+				continue
+			}
+			msg := st.State
+			if st.Error != "" {
+				msg += ": " + st.Error
+			}
+			log.Printf("Retention policy for %s.%s (%s): %s", st.Database, st.Collection, st.Field, msg)
+		}
+		cancel()
+	}
+
+	// Warm the plan cache and connection pool with the warm queries
+	warmer := &warmup.Warmer{Store: store, Queries: cfg.WarmQueries}
+	if len(cfg.WarmQueries) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		failed := 0
+		for _, res := range warmer.Run(ctx) {
+			if res.Error != "" {
+				failed++
+				log.Printf("Warm query %s on %s.%s failed: %s", res.Operation, res.Database, res.Collection, res.Error)
+			}
+		}
+		cancel()
+		log.Printf("Ran %d warm queries, %d failed", len(cfg.WarmQueries), failed)
+	}
+
+	// Compile custom endpoint scripts
+	endpoints, err := script.Load(cfg.Endpoints, store, script.Policy{CrossDatabaseJoins: cfg.CrossDatabaseJoins, RestrictUpserts: cfg.RestrictUpserts})
+	if err != nil {
+		return nil, fmt.Errorf("loading custom endpoints: %w", err)
+	}
+
+	// Fixture recording and replay of everything but the admin API,
+	// imports, exports, tails, jobs and sessions, whose bodies are not JSON
+	// or not reproducible
+	var recordReplay fiber.Handler
+	fixtureConfig := fixtures.Config{SkipPaths: []string{"/admin*", "/import", "/export", "/tail", "/jobs*", "/sessions*"}}
+	switch {
+	case cfg.RecordDir != "":
+		fixtureConfig.Dir = cfg.RecordDir
+		if recordReplay, err = fixtures.Recorder(fixtureConfig); err != nil {
+			return nil, fmt.Errorf("recording fixtures: %w", err)
+		}
+		log.Printf("Recording fixtures to %s", cfg.RecordDir)
+	case cfg.ReplayDir != "":
+		fixtureConfig.Dir = cfg.ReplayDir
+		if recordReplay, err = fixtures.Replayer(fixtureConfig); err != nil {
+			return nil, fmt.Errorf("loading fixtures: %w", err)
+		}
+		log.Printf("Replaying fixtures from %s", cfg.ReplayDir)
+	}
+
+	var accessLog fiber.Handler
+	if cfg.AccessLog.Format != "" {
+		w, err := accesslog.Open(cfg.AccessLog.Output, cfg.AccessLog.MaxSizeMB, cfg.AccessLog.MaxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("opening access log: %w", err)
+		}
+		accessLog = accesslog.Middleware(w, cfg.AccessLog.Format)
+	}
+
+	var watcher *configWatcher
+	if cfg.WatchConfig && len(cfg.Files()) > 0 {
+		watcher = newConfigWatcher(cfg, keys, queries)
+		go watcher.watch(configPollInterval)
+	}
+
+	var alerter *alert.Alerter
+	if cfg.Alerts.WebhookURL != "" {
+		alerter = alert.New(cfg.Alerts)
+		alerter.Start()
+	}
+
+	var trafficMirror *trafficmirror.Mirror
+	if cfg.TrafficMirror.URL != "" {
+		trafficMirror = trafficmirror.New(cfg.TrafficMirror)
+		log.Printf("Traffic mirror: replaying %g%% of requests to %s", cfg.TrafficMirror.Percent, cfg.TrafficMirror.URL)
+	}
+
+	return &service{
+		cfg:         cfg,
+		keys:        keys,
+		queries:     queries,
+		maintenance: maintenance,
+		mirror:      mirrorStore,
+		shadow:      shadowStore,
+		protos:      protos,
+		jobManager:  jobManager,
+		sessions:    sessionManager,
+		store:       store,
+		clusters:    clusters,
+		endpoints:   endpoints,
+		limiter:     limiter,
+		queue:       requestQueue,
+		retention:   retentionManager,
+		warmer:      warmer,
+		migrations:  migrationRunner,
+		metrics:     m,
+		fixtures:    recordReplay,
+		accessLog:   accessLog,
+		alerter:     alerter,
+		traffic:     trafficMirror,
+		history:     historyStore,
+		trash:       trashStore,
+		operations:  operations,
+		views:       views,
+		inspector:   inspector,
+		started:     time.Now(),
+		ready:       ready,
+		watcher:     watcher,
+	}, nil
+}
+
+// app builds a Fiber app serving the data endpoints. operational adds
+// metrics, the readiness probe, the admin API and the admin UI; profiling
+// adds the pprof endpoints, which must never be reachable by clients.
+func (s *service) app(operational, profiling bool) *fiber.App {
+	cfg := s.cfg
+
+	// Create Fiber app
+	app := fiber.New(fiber.Config{
+		ReadTimeout:  time.Duration(cfg.ReadTimeoutSeconds) * time.Second,
+		WriteTimeout: time.Duration(cfg.WriteTimeoutSeconds) * time.Second,
+		IdleTimeout:  time.Duration(cfg.IdleTimeoutSeconds) * time.Second,
+		Concurrency:  cfg.MaxConnections,
+		Prefork:      cfg.Prefork,
+		BodyLimit:    cfg.BodyLimitMB << 20,
+		// Leave room for the request line and headers that harden bounds
+		ReadBufferSize: cfg.MaxURLLength + 8192,
+		// Bulk writes with stream=true decode their body as it arrives
+		StreamRequestBody: true,
+	})
+
+	// Requests keep the X-Request-ID they came with, or get one
+	app.Use(requestid.New())
+	if s.accessLog != nil {
+		app.Use(s.accessLog)
+	}
+
+	// Add monitor middleware for metrics
+	if operational {
+		s.metrics.RegisterAt(app, "/metrics")
+	}
+	s.metrics.SetSkipPaths([]string{"/api/health", "/metrics", "/readyz"})
+	app.Use(s.metrics.Middleware)
+	if s.alerter != nil {
+		s.alerter.SetSkipPaths([]string{"/api/health", "/metrics", "/readyz"})
+		app.Use(s.alerter.Middleware)
+	}
+	app.Use(securityHeaders(cfg.TLSCertFile != "" || len(cfg.ACMEDomains) > 0))
+	app.Use(harden(cfg))
+	app.Use(bodyLimit(cfg.BodyLimitMB << 20))
+	if profiling {
+		app.Use(pprof.New())
+	}
+	app.Use(allowedMethods)
+
+	// API Key Authentication Middleware
+	// Skip API key check for health, readiness and metrics endpoints; the
+	// admin API has its own authentication and the admin UI is static
+	var tokens *auth.Tokens
+	if cfg.TokenSecret != "" {
+		tokens = auth.NewTokens(cfg.TokenSecret, time.Duration(cfg.TokenMaxTTLSeconds)*time.Second)
+	}
+	var oauth *auth.OAuth
+	if cfg.OAuth.Enabled() {
+		oauth = auth.NewOAuth(cfg.OAuth)
+	}
+	app.Use(auth.Middleware(auth.MiddlewareConfig{
+		Store:           s.keys,
+		Tenancy:         cfg.Tenancy,
+		Limiter:         s.limiter,
+		Queue:           s.queue,
+		Tokens:          tokens,
+		OAuth:           oauth,
+		ScopePrefix:     cfg.OAuth.ScopePrefix,
+		Public:          cfg.PublicCollections,
+		PublicRateLimit: cfg.PublicRateLimit,
+		Maintenance:     s.maintenance,
+		ReadOnly:        cfg.ReadOnly,
+		SkipPaths:       []string{"/api/health", "/metrics", "/readyz", "/api/admin*", "/admin*"},
+	}))
+	// Only requests the API key middleware accepted are replayed
+	if s.traffic != nil {
+		app.Use(s.traffic.Middleware)
+	}
+
+	if operational {
+		// Readiness probe for load balancers and orchestrators
+		app.Get("/readyz", func(c *fiber.Ctx) error {
+			ctx, cancel := context.WithTimeout(c.Context(), 5*time.Second)
+			defer cancel()
+			resp := fiber.Map{"status": "ready"}
+			if s.watcher != nil {
+				resp["config"] = s.watcher.status()
+			}
+			if err := s.ready(ctx); err != nil {
+				resp["status"], resp["error"] = "unavailable", err.Error()
+				return c.Status(fiber.StatusServiceUnavailable).JSON(resp)
+			}
+			return c.JSON(resp)
+		})
+
+		// Admin web UI
+		app.Use("/admin", ui.Handler())
+	}
+
+	// API Routes
+	api := app.Group("/api")
+	{
+		api.Get("/health", func(c *fiber.Ctx) error {
+			return c.JSON(fiber.Map{"status": "ok"})
+		})
+		// Details need an API key, as they expose the deployment
+		health := &handlers.Health{Server: s.inspector, Started: s.started}
+		api.Get("/health/details", health.Details)
+
+		if s.fixtures != nil {
+			api.Use(s.fixtures)
+		}
+
+		// Sessions, data, stats, jobs, tokens, saved queries and custom
+		// endpoints, all behind the API key middleware
+		data := &handlers.Data{Store: s.store, Jobs: s.jobManager, MaxTime: cfg.MaxTimeMS, ShardKeys: cfg.ShardKeys, PlainObjectIDs: cfg.PlainObjectIDs, UUIDFields: cfg.UUIDFields, ComputedFields: cfg.ComputedFields, ReadDefaults: cfg.ReadDefaults, AggregateLimits: cfg.AggregateLimits, CrossDatabaseJoins: cfg.CrossDatabaseJoins, Clusters: s.clusters, FanOutReads: cfg.FanOutReads, TailIdleTimeout: time.Duration(cfg.TailIdleTimeoutSeconds) * time.Second, Protos: s.protos, StrictBodies: cfg.StrictBodies, LegacyDeleteResults: cfg.LegacyDeleteResults, RestrictUpserts: cfg.RestrictUpserts, NaturalKeys: cfg.NaturalKeys, History: s.history, Trash: s.trash}
+		routes := &handlers.Routes{
+			Data:      data,
+			Sessions:  &handlers.Sessions{Manager: s.sessions},
+			Clone:     &handlers.Clone{Clusters: s.clusters, Jobs: s.jobManager, StrictBodies: cfg.StrictBodies, RestrictUpserts: cfg.RestrictUpserts, UUIDFields: cfg.UUIDFields},
+			Stats:     &handlers.Stats{Store: s.store, TTL: time.Duration(cfg.StatsCacheSeconds) * time.Second, MaxTime: cfg.MaxTimeMS},
+			Jobs:      &handlers.Jobs{Manager: s.jobManager},
+			Saved:     &handlers.SavedQueries{Registry: s.queries, Data: data},
+			Endpoints: s.endpoints,
+			ReadOnly:  cfg.ReadOnly,
+			RESTAPI:   cfg.RESTAPI,
+		}
+		if tokens != nil {
+			routes.Tokens = &handlers.Tokens{Signer: tokens}
+		}
+		routes.Register(api)
+
+		if !operational {
+			return app
+		}
+
+		// Key, role and rate limit management
+		admin := &handlers.Admin{
+			Keys:        s.keys,
+			Limiter:     s.limiter,
+			Queries:     s.queries,
+			Store:       s.store,
+			Retention:   s.retention,
+			Warmer:      s.warmer,
+			Migrations:  s.migrations,
+			Maintenance: s.maintenance,
+			Mirror:      s.mirror,
+			Shadow:      s.shadow,
+			Traffic:     s.traffic,
+			Operations:  s.operations,
+			Cursors:     db.Cursors,
+			Views:       s.views,
+		}
+		admin.Register(api.Group("/admin", auth.AdminMiddleware(cfg.AdminKey)))
+	}
+
+	return app
+}
+
+// connect connects to MongoDB, loads the keys, roles and saved queries
+// persisted in the system database and persists jobs there
+func connect(cfg *config.Config, keys *auth.Store, queries *query.Registry, maintenance *auth.Maintenance, jobManager *jobs.Manager, opts ...*options.ClientOptions) (db.DataStore, error) {
+	if !db.Connected() {
+		if err := db.Connect(cfg.MongoURI, cfg.AppName, opts...); err != nil {
+			return nil, fmt.Errorf("connecting to MongoDB: %w", err)
+		}
+	}
+
+	// Load API keys and roles, including those managed through the admin API
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	err := keys.Attach(ctx,
+		db.GetCollection(cfg.SystemDatabase, "apiKeys"),
+		db.GetCollection(cfg.SystemDatabase, "roles"))
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("loading API keys from MongoDB: %w", err)
+	}
+	keys.StartRefresh(30 * time.Second)
+
+	// Load saved queries
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	err = queries.Attach(ctx, db.GetCollection(cfg.SystemDatabase, "savedQueries"))
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("loading saved queries from MongoDB: %w", err)
+	}
+	queries.StartRefresh(30 * time.Second)
+
+	// Load the maintenance mode, which every instance follows
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	err = maintenance.Attach(ctx, db.GetCollection(cfg.SystemDatabase, "settings"))
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("loading maintenance mode from MongoDB: %w", err)
+	}
+	maintenance.StartRefresh(10 * time.Second)
+
+	jobManager.Attach(db.GetCollection(cfg.SystemDatabase, "jobs"))
+
+	return db.NewMongo(db.Client()), nil
+}
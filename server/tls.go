@@ -0,0 +1,132 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"mongo-data-api-go-alternative/config"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certPollInterval is how often certificate files are checked for changes
+const certPollInterval = 10 * time.Second
+
+// TLSConfig returns the TLS configuration of the public listener, or nil
+// when HTTPS is not configured. Certificates are read from cfg.TLSCertFile
+// and cfg.TLSKeyFile, and reloaded when the files change, or obtained and
+// renewed through ACME for cfg.ACMEDomains. HTTP/2 is offered only with the
+// net/http engine.
+func TLSConfig(cfg *config.Config) (*tls.Config, error) {
+	protos := []string{"http/1.1"}
+	if cfg.Engine == config.EngineNetHTTP {
+		protos = []string{"h2", "http/1.1"}
+	}
+
+	if len(cfg.ACMEDomains) > 0 {
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.ACMEDomains...),
+			Cache:      autocert.DirCache(cfg.ACMECacheDir),
+			Email:      cfg.ACMEEmail,
+		}
+		if cfg.ACMEDirectoryURL != "" {
+			m.Client = &acme.Client{DirectoryURL: cfg.ACMEDirectoryURL}
+		}
+		// Certificates are validated with the tls-alpn-01 challenge on the
+		// listener itself
+		return &tls.Config{
+			GetCertificate: m.GetCertificate,
+			NextProtos:     append(protos, acme.ALPNProto),
+			MinVersion:     tls.VersionTLS12,
+		}, nil
+	}
+
+	if cfg.TLSCertFile == "" {
+		return nil, nil
+	}
+	r := &certReloader{certFile: cfg.TLSCertFile, keyFile: cfg.TLSKeyFile}
+	if _, err := r.load(); err != nil {
+		return nil, err
+	}
+	go r.watch(certPollInterval)
+	return &tls.Config{
+		GetCertificate: r.GetCertificate,
+		NextProtos:     protos,
+		MinVersion:     tls.VersionTLS12,
+	}, nil
+}
+
+// certReloader serves a certificate from files and reloads it when the
+// files are modified, so renewed certificates are picked up without a
+// restart
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// GetCertificate returns the current certificate
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// load reads the certificate and key if either file changed since the
+// last load, and reports whether it did
+func (r *certReloader) load() (bool, error) {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return false, err
+	}
+	r.mu.RLock()
+	unchanged := r.cert != nil && modTime.Equal(r.modTime)
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	r.mu.Lock()
+	r.cert, r.modTime = &cert, modTime
+	r.mu.Unlock()
+	return true, nil
+}
+
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("loading TLS certificate: %w", err)
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// watch reloads the certificate every interval. Errors, e.g. while the
+// files are only partially rewritten, keep the previous certificate in use.
+func (r *certReloader) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		reloaded, err := r.load()
+		if err != nil {
+			log.Printf("Keeping the current TLS certificate: %v", err)
+		} else if reloaded {
+			log.Printf("Reloaded TLS certificate from %s", r.certFile)
+		}
+	}
+}
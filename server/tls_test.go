@@ -0,0 +1,122 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"mongo-data-api-go-alternative/config"
+)
+
+// writeCert writes a self-signed certificate for name and its key, dated
+// modTime
+func writeCert(t *testing.T, certFile, keyFile, name string, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file, block := range map[string]*pem.Block{certFile: {Type: "CERTIFICATE", Bytes: der}, keyFile: {Type: "EC PRIVATE KEY", Bytes: keyDER}} {
+		if err := os.WriteFile(file, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func commonName(t *testing.T, r *certReloader) string {
+	t.Helper()
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	writeCert(t, certFile, keyFile, "old.example.com", modTime)
+
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if reloaded, err := r.load(); err != nil || !reloaded {
+		t.Fatalf("first load: %v, %v", reloaded, err)
+	}
+	if reloaded, err := r.load(); err != nil || reloaded {
+		t.Errorf("unchanged files reloaded: %v, %v", reloaded, err)
+	}
+
+	// Renewed files are picked up
+	modTime = modTime.Add(time.Minute)
+	writeCert(t, certFile, keyFile, "new.example.com", modTime)
+	if reloaded, err := r.load(); err != nil || !reloaded {
+		t.Fatalf("renewed files: %v, %v", reloaded, err)
+	}
+	if name := commonName(t, r); name != "new.example.com" {
+		t.Errorf("serving %s after the renewal", name)
+	}
+
+	// A partially written pair keeps the current certificate, until the
+	// files are complete again
+	if err := os.WriteFile(keyFile, []byte("-----BEGIN EC PRIVATE"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.load(); err == nil {
+		t.Error("invalid key loaded")
+	}
+	if name := commonName(t, r); name != "new.example.com" {
+		t.Errorf("serving %s after a failed reload", name)
+	}
+	writeCert(t, certFile, keyFile, "newer.example.com", modTime.Add(time.Minute))
+	if reloaded, err := r.load(); err != nil || !reloaded || commonName(t, r) != "newer.example.com" {
+		t.Errorf("completed files: %v, %v", reloaded, err)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	if cfg, err := TLSConfig(&config.Config{}); cfg != nil || err != nil {
+		t.Errorf("without certificate: %v, %v", cfg, err)
+	}
+	dir := t.TempDir()
+	if _, err := TLSConfig(&config.Config{TLSCertFile: filepath.Join(dir, "cert.pem"), TLSKeyFile: filepath.Join(dir, "key.pem")}); err == nil {
+		t.Error("missing files accepted")
+	}
+	cfg, err := TLSConfig(&config.Config{ACMEDomains: []string{"api.example.com"}, ACMECacheDir: dir, Engine: config.EngineNetHTTP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"h2", "http/1.1", "acme-tls/1"}; !reflect.DeepEqual(cfg.NextProtos, want) {
+		t.Errorf("ACME protocols %v, want %v", cfg.NextProtos, want)
+	}
+}
@@ -0,0 +1,205 @@
+// Package sessions keeps the server sessions opened by clients, so that a
+// sequence of requests can run in the same causally consistent session or
+// transaction. Sessions live in the memory of the instance that opened
+// them and are ended once they have been idle for too long.
+package sessions
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"mongo-data-api-go-alternative/db"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// endTimeout bounds ending a session and aborting its transaction
+const endTimeout = 10 * time.Second
+
+var (
+	// ErrNotFound is returned for unknown, ended or expired session ids
+	ErrNotFound = errors.New("session not found")
+	// ErrTransaction is returned when a transaction is started while one
+	// is in progress, or committed or aborted while none is
+	ErrTransaction = errors.New("invalid transaction state")
+)
+
+// Session is a server session opened by a client
+type Session struct {
+	ID string `json:"sessionId"`
+	// Owner is the name of the API key that opened the session
+	Owner             string    `json:"-"`
+	CausalConsistency bool      `json:"causalConsistency"`
+	InTransaction     bool      `json:"inTransaction"`
+	Created           time.Time `json:"created"`
+
+	// use serializes the requests of the session, which the driver does
+	// not allow to run concurrently
+	use      sync.Mutex
+	session  db.Session
+	lastUsed time.Time
+	ended    bool
+}
+
+// Bind returns a context whose operations run in the session
+func (s *Session) Bind(ctx context.Context) context.Context {
+	return s.session.Bind(ctx)
+}
+
+// Manager opens sessions on a store and ends those idle for longer than
+// its idle timeout
+type Manager struct {
+	store db.DataStore
+	idle  time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+// NewManager returns a manager of sessions on store
+func NewManager(store db.DataStore, idle time.Duration) *Manager {
+	return &Manager{store: store, idle: idle, sessions: make(map[string]*Session)}
+}
+
+// Start opens a session owned by owner
+func (m *Manager) Start(owner string, causal bool) (*Session, error) {
+	starter, ok := m.store.(db.SessionStarter)
+	if !ok {
+		return nil, db.ErrSessionsUnsupported
+	}
+	session, err := starter.StartSession(causal)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	s := &Session{
+		ID:                primitive.NewObjectID().Hex(),
+		Owner:             owner,
+		CausalConsistency: causal,
+		Created:           now,
+		session:           session,
+		lastUsed:          now,
+	}
+	m.mu.Lock()
+	m.sessions[s.ID] = s
+	m.mu.Unlock()
+	return s, nil
+}
+
+// Acquire returns the session with the given id, if owner owns it, for the
+// exclusive use of a request, waiting for the requests already using it.
+// The session must be released when the request is done.
+func (m *Manager) Acquire(id, owner string) (*Session, error) {
+	m.mu.Lock()
+	s, ok := m.sessions[id]
+	m.mu.Unlock()
+	if !ok || s.Owner != owner {
+		return nil, ErrNotFound
+	}
+	s.use.Lock()
+	if s.ended {
+		s.use.Unlock()
+		return nil, ErrNotFound
+	}
+	return s, nil
+}
+
+// Release ends the use of a session acquired with Acquire
+func (m *Manager) Release(s *Session) {
+	m.mu.Lock()
+	s.lastUsed = time.Now()
+	m.mu.Unlock()
+	s.use.Unlock()
+}
+
+// StartTransaction starts a transaction in an acquired session
+func (m *Manager) StartTransaction(s *Session) error {
+	if s.InTransaction {
+		return ErrTransaction
+	}
+	if err := s.session.StartTransaction(); err != nil {
+		return err
+	}
+	s.InTransaction = true
+	return nil
+}
+
+// CommitTransaction commits the transaction of an acquired session
+func (m *Manager) CommitTransaction(ctx context.Context, s *Session) error {
+	if !s.InTransaction {
+		return ErrTransaction
+	}
+	err := s.session.CommitTransaction(ctx)
+	s.InTransaction = false
+	return err
+}
+
+// AbortTransaction aborts the transaction of an acquired session
+func (m *Manager) AbortTransaction(ctx context.Context, s *Session) error {
+	if !s.InTransaction {
+		return ErrTransaction
+	}
+	err := s.session.AbortTransaction(ctx)
+	s.InTransaction = false
+	return err
+}
+
+// End ends an acquired session, aborting its transaction if one is in
+// progress. The session must still be released.
+func (m *Manager) End(s *Session) {
+	m.mu.Lock()
+	delete(m.sessions, s.ID)
+	m.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), endTimeout)
+	defer cancel()
+	if s.InTransaction {
+		if err := s.session.AbortTransaction(ctx); err != nil {
+			log.Printf("Aborting the transaction of session %s: %v", s.ID, err)
+		}
+		s.InTransaction = false
+	}
+	s.session.End(ctx)
+	s.ended = true
+}
+
+// StartReaper ends idle sessions in the background. Without an idle
+// timeout sessions last until they are ended.
+func (m *Manager) StartReaper() {
+	if m.idle <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(m.idle / 4) {
+			m.reap(time.Now())
+		}
+	}()
+}
+
+// reap ends the sessions not used since before now minus the idle timeout.
+// Sessions in use are left alone.
+func (m *Manager) reap(now time.Time) {
+	var idle []*Session
+	m.mu.Lock()
+	for _, s := range m.sessions {
+		if now.Sub(s.lastUsed) > m.idle {
+			idle = append(idle, s)
+		}
+	}
+	m.mu.Unlock()
+	for _, s := range idle {
+		if !s.use.TryLock() {
+			continue
+		}
+		m.mu.Lock()
+		expired := now.Sub(s.lastUsed) > m.idle
+		m.mu.Unlock()
+		if expired && !s.ended {
+			log.Printf("Ending session %s of %s after %s idle", s.ID, s.Owner, m.idle)
+			m.End(s)
+		}
+		s.use.Unlock()
+	}
+}
@@ -0,0 +1,270 @@
+// Package shadow repeats a sample of the reads of a data store on a second
+// cluster and compares the results, to validate a cluster migration or an
+// index change before cutting over
+package shadow
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"mongo-data-api-go-alternative/config"
+	"mongo-data-api-go-alternative/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultTimeout       = 10 * time.Second
+	defaultMaxConcurrent = 16
+	// maxMismatches bounds the mismatches kept for the status
+	maxMismatches = 100
+)
+
+// Store is a data store that serves reads from the primary store and repeats
+// a sample of them on the target store in the background. Results that
+// differ in their number of documents or their contents are logged as
+// mismatches; the primary's results are always the ones returned.
+type Store struct {
+	db.DataStore
+	target  db.DataStore
+	cluster string
+	system  string
+	percent float64
+	timeout time.Duration
+	slots   chan struct{}
+
+	mu         sync.Mutex
+	compared   int64
+	matched    int64
+	skipped    int64
+	errors     int64
+	mismatches []Mismatch
+}
+
+var _ db.DataStore = (*Store)(nil)
+
+// Mismatch is a read whose results differed between the clusters
+type Mismatch struct {
+	Operation  string    `json:"operation"`
+	Database   string    `json:"database"`
+	Collection string    `json:"collection"`
+	Client     string    `json:"client,omitempty"`
+	At         time.Time `json:"at"`
+	// Count and TargetCount are the number of documents each cluster
+	// returned, Hash and TargetHash digests of the documents
+	Count       int    `json:"count"`
+	TargetCount int    `json:"targetCount"`
+	Hash        string `json:"hash"`
+	TargetHash  string `json:"targetHash"`
+}
+
+// Status reports the shadow reads made so far
+type Status struct {
+	Cluster string  `json:"cluster"`
+	Percent float64 `json:"percent"`
+	// Compared counts the reads repeated on the target, Skipped those not
+	// repeated because too many were in flight and Errors those that failed
+	// on the target
+	Compared   int64      `json:"compared"`
+	Matched    int64      `json:"matched"`
+	Mismatched int64      `json:"mismatched"`
+	Skipped    int64      `json:"skipped"`
+	Errors     int64      `json:"errors"`
+	Mismatches []Mismatch `json:"mismatches"`
+}
+
+// New repeats cfg.Percent of the reads of primary on target, the store of
+// cfg.Cluster. Reads of keys, roles and other state in systemDatabase, and
+// of system collections such as system.profile, are not repeated.
+func New(primary, target db.DataStore, cfg config.ShadowReadConfig, systemDatabase string) *Store {
+	timeout, concurrent := time.Duration(cfg.TimeoutMs)*time.Millisecond, cfg.MaxConcurrent
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	if concurrent <= 0 {
+		concurrent = defaultMaxConcurrent
+	}
+	return &Store{
+		DataStore:  primary,
+		target:     target,
+		cluster:    cfg.Cluster,
+		system:     systemDatabase,
+		percent:    cfg.Percent,
+		timeout:    timeout,
+		slots:      make(chan struct{}, concurrent),
+		mismatches: []Mismatch{},
+	}
+}
+
+// Status returns the counts of shadow reads and the latest mismatches
+func (s *Store) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Status{
+		Cluster:    s.cluster,
+		Percent:    s.percent,
+		Compared:   s.compared,
+		Matched:    s.matched,
+		Mismatched: s.compared - s.matched,
+		Skipped:    s.skipped,
+		Errors:     s.errors,
+		Mismatches: append([]Mismatch{}, s.mismatches...),
+	}
+}
+
+// FindOne reads from the primary and compares a sample with the target
+func (s *Store) FindOne(ctx context.Context, database, collection string, filter interface{}, opts *options.FindOneOptions) (bson.M, error) {
+	doc, err := s.DataStore.FindOne(ctx, database, collection, filter, opts)
+	if err == nil || errors.Is(err, mongo.ErrNoDocuments) {
+		s.shadow(ctx, "findOne", database, collection, docs(doc), true, func(ctx context.Context) ([]bson.M, error) {
+			doc, err := s.target.FindOne(ctx, database, collection, filter, opts)
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				err = nil
+			}
+			return docs(doc), err
+		})
+	}
+	return doc, err
+}
+
+// Find reads from the primary and compares a sample with the target. The
+// order of the documents only counts when the find is sorted.
+func (s *Store) Find(ctx context.Context, database, collection string, filter interface{}, opts *options.FindOptions) ([]bson.M, error) {
+	results, err := s.DataStore.Find(ctx, database, collection, filter, opts)
+	if err == nil {
+		s.shadow(ctx, "find", database, collection, results, opts != nil && opts.Sort != nil, func(ctx context.Context) ([]bson.M, error) {
+			return s.target.Find(ctx, database, collection, filter, opts)
+		})
+	}
+	return results, err
+}
+
+// CountDocuments counts on the primary and compares a sample with the
+// target
+func (s *Store) CountDocuments(ctx context.Context, database, collection string, filter interface{}) (int64, error) {
+	n, err := s.DataStore.CountDocuments(ctx, database, collection, filter)
+	if err == nil {
+		s.shadow(ctx, "countDocuments", database, collection, []bson.M{{"n": n}}, true, func(ctx context.Context) ([]bson.M, error) {
+			n, err := s.target.CountDocuments(ctx, database, collection, filter)
+			return []bson.M{{"n": n}}, err
+		})
+	}
+	return n, err
+}
+
+// Aggregate runs a pipeline on the primary and compares a sample with the
+// target. The order of the documents is not compared.
+func (s *Store) Aggregate(ctx context.Context, database, collection string, pipeline interface{}, opts *options.AggregateOptions) ([]bson.M, error) {
+	results, err := s.DataStore.Aggregate(ctx, database, collection, pipeline, opts)
+	if err == nil {
+		s.shadow(ctx, "aggregate", database, collection, results, false, func(ctx context.Context) ([]bson.M, error) {
+			return s.target.Aggregate(ctx, database, collection, pipeline, opts)
+		})
+	}
+	return results, err
+}
+
+// shadow repeats a sampled read on the target in the background and
+// compares its results with those of the primary
+func (s *Store) shadow(ctx context.Context, operation, database, collection string, results []bson.M, ordered bool, read func(context.Context) ([]bson.M, error)) {
+	if database == s.system || strings.HasPrefix(collection, "system.") || rand.Float64()*100 >= s.percent {
+		return
+	}
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		s.mu.Lock()
+		s.skipped++
+		s.mu.Unlock()
+		return
+	}
+	client, _ := db.ClientFromContext(ctx)
+	maxTime, _ := db.MaxTimeFromContext(ctx)
+	// The primary's results are hashed before they are returned, since
+	// handlers may change them
+	count, hash := len(results), digest(results, ordered)
+
+	go func() {
+		defer func() { <-s.slots }()
+		ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+		defer cancel()
+		if client != "" {
+			ctx = db.WithClient(ctx, client)
+		}
+		ctx = db.WithMaxTime(ctx, maxTime)
+
+		target, err := read(ctx)
+		if err != nil {
+			log.Printf("Shadow %s on %s.%s failed on cluster %s: %v", operation, database, collection, s.cluster, err)
+			s.mu.Lock()
+			s.errors++
+			s.mu.Unlock()
+			return
+		}
+		targetHash := digest(target, ordered)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.compared++
+		if len(target) == count && targetHash == hash {
+			s.matched++
+			return
+		}
+		log.Printf("Shadow %s on %s.%s mismatched on cluster %s: %d documents (%s), %d on the primary (%s)", operation, database, collection, s.cluster, len(target), targetHash, count, hash)
+		s.mismatches = append(s.mismatches, Mismatch{
+			Operation:   operation,
+			Database:    database,
+			Collection:  collection,
+			Client:      client,
+			At:          time.Now().UTC(),
+			Count:       count,
+			TargetCount: len(target),
+			Hash:        hash,
+			TargetHash:  targetHash,
+		})
+		if len(s.mismatches) > maxMismatches {
+			s.mismatches = s.mismatches[len(s.mismatches)-maxMismatches:]
+		}
+	}()
+}
+
+func docs(doc bson.M) []bson.M {
+	if doc == nil {
+		return nil
+	}
+	return []bson.M{doc}
+}
+
+// digest hashes documents independently of the order of their fields and,
+// unless ordered, of the documents themselves
+func digest(results []bson.M, ordered bool) string {
+	hashes := make([]string, len(results))
+	for i, doc := range results {
+		// JSON encodes maps with sorted keys
+		b, err := json.Marshal(doc)
+		if err != nil {
+			b = []byte(err.Error())
+		}
+		sum := sha256.Sum256(b)
+		hashes[i] = string(sum[:])
+	}
+	if !ordered {
+		sort.Strings(hashes)
+	}
+	h := sha256.New()
+	for _, sum := range hashes {
+		h.Write([]byte(sum))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
@@ -0,0 +1,60 @@
+package shadow
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"mongo-data-api-go-alternative/config"
+	"mongo-data-api-go-alternative/db"
+	memstore "mongo-data-api-go-alternative/db/memory"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestShadowReads(t *testing.T) {
+	ctx := context.Background()
+	primary, target := memstore.New(), memstore.New()
+	for _, s := range []db.DataStore{primary, target} {
+		docs := []interface{}{bson.D{{Key: "_id", Value: 1}, {Key: "a", Value: 1}}, bson.D{{Key: "_id", Value: 2}, {Key: "a", Value: 2}}}
+		if _, err := s.InsertMany(ctx, "app", "users", docs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := target.InsertOne(ctx, "app", "orders", bson.D{{Key: "_id", Value: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	store := New(primary, target, config.ShadowReadConfig{Cluster: "next", Percent: 100}, "dataapi_system")
+
+	// Reads returning the same documents match, a missing one does not
+	if _, err := store.Find(ctx, "app", "users", bson.D{}, options.Find().SetSort(bson.D{{Key: "_id", Value: -1}})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Aggregate(ctx, "app", "users", bson.A{bson.D{{Key: "$sort", Value: bson.D{{Key: "_id", Value: -1}}}}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.FindOne(ctx, "app", "orders", bson.D{}, nil); !errors.Is(err, mongo.ErrNoDocuments) {
+		t.Fatalf("findOne: %v", err)
+	}
+	// Reads of the system database are not repeated
+	if _, err := store.Find(ctx, "dataapi_system", "keys", bson.D{}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var status Status
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		status = store.Status()
+		if status.Compared == 3 || time.Now().After(deadline) {
+			break
+		}
+	}
+	if status.Cluster != "next" || status.Compared != 3 || status.Matched != 2 || status.Mismatched != 1 || status.Errors != 0 {
+		t.Fatalf("status %+v", status)
+	}
+	if m := status.Mismatches[0]; m.Operation != "findOne" || m.Collection != "orders" || m.Count != 0 || m.TargetCount != 1 {
+		t.Errorf("mismatch %+v", m)
+	}
+}
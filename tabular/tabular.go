@@ -0,0 +1,327 @@
+// Package tabular converts documents to Apache Arrow records and writes them
+// as Arrow IPC streams or Parquet files, for loading extracts into analytics
+// tools such as Spark and Pandas.
+package tabular
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/apache/arrow-go/v18/parquet"
+	"github.com/apache/arrow-go/v18/parquet/compress"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Formats
+const (
+	// FormatArrow is the Arrow IPC streaming format
+	FormatArrow = "arrow"
+	// FormatParquet is Parquet with Snappy compression
+	FormatParquet = "parquet"
+)
+
+// Media types of the formats
+const (
+	MIMEArrow   = "application/vnd.apache.arrow.stream"
+	MIMEParquet = "application/vnd.apache.parquet"
+)
+
+// Infer returns the schema of docs: a nullable column per top-level field,
+// _id first and the others sorted by name. A field whose values are all
+// booleans, integers, numbers, dates or binaries gets a column of that type;
+// strings, ObjectIds and decimals become strings. Documents, arrays and
+// fields of mixed types become strings holding relaxed Extended JSON, with
+// the field metadata "encoding": "ejson".
+func Infer(docs []bson.M) *arrow.Schema {
+	kinds := map[string]kind{}
+	for _, d := range docs {
+		for k, v := range d {
+			kinds[k] = kinds[k].merge(kindOf(v))
+		}
+	}
+	names := make([]string, 0, len(kinds))
+	for k := range kinds {
+		if k != "_id" {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	if _, ok := kinds["_id"]; ok {
+		names = append([]string{"_id"}, names...)
+	}
+	fields := make([]arrow.Field, len(names))
+	for i, name := range names {
+		fields[i] = arrow.Field{Name: name, Type: kinds[name].dataType(), Nullable: true}
+		if kinds[name] == kindJSON {
+			fields[i].Metadata = arrow.NewMetadata([]string{encodingKey}, []string{encodingEJSON})
+		}
+	}
+	return arrow.NewSchema(fields, nil)
+}
+
+// Field metadata marking the columns of Extended JSON
+const (
+	encodingKey   = "encoding"
+	encodingEJSON = "ejson"
+)
+
+// Record converts docs to a record of schema. Fields missing from the
+// schema are left out, and values that do not fit their column are null.
+// The caller releases the record.
+func Record(schema *arrow.Schema, docs []bson.M) (arrow.Record, error) {
+	b := array.NewRecordBuilder(memory.DefaultAllocator, schema)
+	defer b.Release()
+	for _, d := range docs {
+		for i, f := range schema.Fields() {
+			ejson := f.Metadata.FindKey(encodingKey) >= 0
+			if err := appendValue(b.Field(i), d[f.Name], ejson); err != nil {
+				return nil, fmt.Errorf("%s: %w", f.Name, err)
+			}
+		}
+	}
+	return b.NewRecord(), nil
+}
+
+// Writer writes documents in one of the formats. Its schema is inferred from
+// the first documents written.
+type Writer struct {
+	out    io.Writer
+	format string
+	schema *arrow.Schema
+	write  func(arrow.Record) error
+	close  func() error
+}
+
+// NewWriter returns a writer of format to out
+func NewWriter(out io.Writer, format string) (*Writer, error) {
+	if format != FormatArrow && format != FormatParquet {
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+	return &Writer{out: out, format: format}, nil
+}
+
+// start infers the schema from docs and opens the output
+func (w *Writer) start(docs []bson.M) error {
+	w.schema = Infer(docs)
+	if w.format == FormatArrow {
+		iw := ipc.NewWriter(w.out, ipc.WithSchema(w.schema))
+		w.write, w.close = iw.Write, iw.Close
+		return nil
+	}
+	props := parquet.NewWriterProperties(parquet.WithCompression(compress.Codecs.Snappy))
+	fw, err := pqarrow.NewFileWriter(w.schema, w.out, props, pqarrow.NewArrowWriterProperties(pqarrow.WithStoreSchema()))
+	if err != nil {
+		return err
+	}
+	w.write, w.close = fw.Write, fw.Close
+	return nil
+}
+
+// Write writes docs as a record batch, or a row group in Parquet
+func (w *Writer) Write(docs []bson.M) error {
+	if w.schema == nil {
+		if err := w.start(docs); err != nil {
+			return err
+		}
+	}
+	if len(docs) == 0 {
+		return nil
+	}
+	rec, err := Record(w.schema, docs)
+	if err != nil {
+		return err
+	}
+	defer rec.Release()
+	return w.write(rec)
+}
+
+// Close finishes the output, which has no columns if nothing was written
+func (w *Writer) Close() error {
+	if w.schema == nil {
+		if err := w.start(nil); err != nil {
+			return err
+		}
+	}
+	return w.close()
+}
+
+// kind is the column type inferred for a field
+type kind int
+
+const (
+	kindNone kind = iota
+	kindBool
+	kindInt32
+	kindInt64
+	kindDouble
+	kindString
+	kindDate
+	kindBinary
+	kindJSON
+)
+
+// kindOf returns the kind of a single value; nulls have no kind
+func kindOf(v interface{}) kind {
+	switch v.(type) {
+	case nil, primitive.Null, primitive.Undefined:
+		return kindNone
+	case bool:
+		return kindBool
+	case int32:
+		return kindInt32
+	case int64, int:
+		return kindInt64
+	case float64:
+		return kindDouble
+	case string, primitive.ObjectID, primitive.Decimal128:
+		return kindString
+	case primitive.DateTime:
+		return kindDate
+	case primitive.Binary:
+		return kindBinary
+	}
+	return kindJSON
+}
+
+// merge returns the kind of a column holding values of both kinds. Integers
+// widen to 64 bits and then to doubles; other mixes fall back to JSON.
+func (k kind) merge(other kind) kind {
+	switch {
+	case k == other || other == kindNone:
+		return k
+	case k == kindNone:
+		return other
+	case k.numeric() && other.numeric():
+		return max(k, other)
+	}
+	return kindJSON
+}
+
+func (k kind) numeric() bool {
+	return k == kindInt32 || k == kindInt64 || k == kindDouble
+}
+
+func (k kind) dataType() arrow.DataType {
+	switch k {
+	case kindBool:
+		return arrow.FixedWidthTypes.Boolean
+	case kindInt32:
+		return arrow.PrimitiveTypes.Int32
+	case kindInt64:
+		return arrow.PrimitiveTypes.Int64
+	case kindDouble:
+		return arrow.PrimitiveTypes.Float64
+	case kindDate:
+		return &arrow.TimestampType{Unit: arrow.Millisecond, TimeZone: "UTC"}
+	case kindBinary:
+		return arrow.BinaryTypes.Binary
+	}
+	// Fields that only ever held null are strings too
+	return arrow.BinaryTypes.String
+}
+
+// appendValue appends v to the column built by b, or a null if v does not
+// fit the column. Any value fits a string column of Extended JSON.
+func appendValue(b array.Builder, v interface{}, ejson bool) error {
+	switch b := b.(type) {
+	case *array.BooleanBuilder:
+		if x, ok := v.(bool); ok {
+			b.Append(x)
+			return nil
+		}
+	case *array.Int32Builder:
+		if x, ok := v.(int32); ok {
+			b.Append(x)
+			return nil
+		}
+	case *array.Int64Builder:
+		switch x := v.(type) {
+		case int32:
+			b.Append(int64(x))
+			return nil
+		case int64:
+			b.Append(x)
+			return nil
+		case int:
+			b.Append(int64(x))
+			return nil
+		}
+	case *array.Float64Builder:
+		switch x := v.(type) {
+		case int32:
+			b.Append(float64(x))
+			return nil
+		case int64:
+			b.Append(float64(x))
+			return nil
+		case int:
+			b.Append(float64(x))
+			return nil
+		case float64:
+			b.Append(x)
+			return nil
+		}
+	case *array.TimestampBuilder:
+		if x, ok := v.(primitive.DateTime); ok {
+			b.Append(arrow.Timestamp(x))
+			return nil
+		}
+	case *array.BinaryBuilder:
+		if x, ok := v.(primitive.Binary); ok {
+			b.Append(x.Data)
+			return nil
+		}
+	case *array.StringBuilder:
+		if kindOf(v) == kindNone {
+			break
+		}
+		if !ejson {
+			s, ok := text(v)
+			if !ok {
+				break
+			}
+			b.Append(s)
+			return nil
+		}
+		s, err := relaxedJSON(v)
+		if err != nil {
+			return err
+		}
+		b.Append(s)
+		return nil
+	}
+	b.AppendNull()
+	return nil
+}
+
+// text renders the values of plain string columns
+func text(v interface{}) (string, bool) {
+	switch x := v.(type) {
+	case string:
+		return x, true
+	case primitive.ObjectID:
+		return x.Hex(), true
+	case primitive.Decimal128:
+		return x.String(), true
+	}
+	return "", false
+}
+
+// relaxedJSON renders any value as relaxed Extended JSON. Only documents can
+// be marshaled at the top level, so v is wrapped in one and unwrapped.
+func relaxedJSON(v interface{}) (string, error) {
+	b, err := bson.MarshalExtJSON(bson.D{{Key: "v", Value: v}}, false, false)
+	if err != nil {
+		return "", err
+	}
+	b = bytes.TrimPrefix(b, []byte(`{"v":`))
+	return string(bytes.TrimSuffix(b, []byte("}"))), nil
+}
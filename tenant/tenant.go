@@ -0,0 +1,299 @@
+package tenant
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"mongo-data-api-go-alternative/config"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const localsKey = "tenantScope"
+
+// ErrForbidden is returned when a request would escape the tenant's namespace
+var ErrForbidden = errors.New("operation not permitted in tenancy mode")
+
+// Scope rewrites requests so they only touch data owned by one tenant.
+// A nil *Scope leaves everything untouched.
+type Scope struct {
+	ID    string
+	Mode  string
+	Field string
+}
+
+// NewScope builds the scope for a tenant, or nil when tenancy is disabled
+func NewScope(cfg config.TenancyConfig, id string) *Scope {
+	if cfg.Mode == config.TenancyNone {
+		return nil
+	}
+	return &Scope{ID: id, Mode: cfg.Mode, Field: cfg.Field}
+}
+
+// Set stores the scope on the request context
+func Set(c *fiber.Ctx, s *Scope) {
+	c.Locals(localsKey, s)
+}
+
+// FromCtx returns the scope stored on the request context
+func FromCtx(c *fiber.Ctx) *Scope {
+	s, _ := c.Locals(localsKey).(*Scope)
+	return s
+}
+
+// Database returns the physical database name for a requested database
+func (s *Scope) Database(name string) string {
+	if s == nil || s.Mode != config.TenancyPrefix {
+		return name
+	}
+	return s.ID + "_" + name
+}
+
+// Filter restricts a deserialized filter to the tenant's documents
+func (s *Scope) Filter(filter interface{}) interface{} {
+	if s == nil || s.Mode != config.TenancyField {
+		return filter
+	}
+	match := bson.D{{Key: s.Field, Value: s.ID}}
+	if d, ok := filter.(bson.D); filter == nil || ok && len(d) == 0 {
+		return match
+	}
+	return bson.D{{Key: "$and", Value: bson.A{filter, match}}}
+}
+
+// Document stamps the tenant id onto a deserialized document. Documents
+// other than a bson.D, such as maps, are returned as a bson.D.
+func (s *Scope) Document(doc interface{}) interface{} {
+	if s == nil || s.Mode != config.TenancyField {
+		return doc
+	}
+	d, ok := toD(doc)
+	if !ok {
+		// Not a document, so the insert fails to encode it
+		return doc
+	}
+	stamped := make(bson.D, 0, len(d)+1)
+	for _, e := range d {
+		if e.Key != s.Field {
+			stamped = append(stamped, e)
+		}
+	}
+	return append(stamped, bson.E{Key: s.Field, Value: s.ID})
+}
+
+// Update rejects update documents that modify the tenant field, and
+// updates that are not documents, such as pipelines, whose changes to it
+// cannot be checked
+func (s *Scope) Update(update interface{}) error {
+	if s == nil || s.Mode != config.TenancyField || update == nil {
+		return nil
+	}
+	d, ok := toD(update)
+	if !ok {
+		return fmt.Errorf("%w: update must be a document of update operators", ErrForbidden)
+	}
+	for _, op := range d {
+		fields, ok := toD(op.Value)
+		if !ok {
+			continue
+		}
+		for _, f := range fields {
+			if s.touches(f.Key) {
+				return fmt.Errorf("%w: update must not modify %q", ErrForbidden, s.Field)
+			}
+			// $rename targets are values, not keys
+			if target, ok := f.Value.(string); ok && op.Key == "$rename" && s.touches(target) {
+				return fmt.Errorf("%w: update must not modify %q", ErrForbidden, s.Field)
+			}
+		}
+	}
+	return nil
+}
+
+// Pipeline validates an aggregation pipeline and, in field mode, prepends a
+// $match stage restricting it to the tenant's documents
+func (s *Scope) Pipeline(pipeline interface{}) (interface{}, error) {
+	if s == nil {
+		return pipeline, nil
+	}
+	stages, ok := pipeline.(bson.A)
+	if !ok {
+		return pipeline, nil
+	}
+	if err := s.checkStages(stages); err != nil {
+		return nil, err
+	}
+	if s.Mode != config.TenancyField {
+		return stages, nil
+	}
+	scoped := make(bson.A, 0, len(stages)+2)
+	scoped = append(scoped, bson.D{{Key: "$match", Value: bson.D{{Key: s.Field, Value: s.ID}}}})
+	scoped = append(scoped, stages...)
+	// Earlier stages may have changed the tenant field of the documents
+	// merged
+	if last := len(scoped) - 1; stageName(scoped[last]) == "$merge" {
+		merge := scoped[last]
+		scoped[last] = bson.D{{Key: "$set", Value: bson.D{{Key: s.Field, Value: s.ID}}}}
+		scoped = append(scoped, merge)
+	}
+	return scoped, nil
+}
+
+// toD returns v as a bson.D: maps with their keys sorted, and other values
+// through their BSON encoding, which fails for values that aren't documents
+func toD(v interface{}) (bson.D, bool) {
+	switch v := v.(type) {
+	case bson.D:
+		return v, true
+	case bson.M:
+		return mapToD(v), true
+	case map[string]interface{}:
+		return mapToD(v), true
+	case nil:
+		return nil, false
+	}
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return nil, false
+	}
+	var d bson.D
+	if err := bson.Unmarshal(data, &d); err != nil {
+		return nil, false
+	}
+	return d, true
+}
+
+func mapToD(m map[string]interface{}) bson.D {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	d := make(bson.D, len(keys))
+	for i, k := range keys {
+		d[i] = bson.E{Key: k, Value: m[k]}
+	}
+	return d
+}
+
+func stageName(stage interface{}) string {
+	if d, ok := stage.(bson.D); ok && len(d) > 0 {
+		return d[0].Key
+	}
+	return ""
+}
+
+func (s *Scope) touches(key string) bool {
+	return key == s.Field || strings.HasPrefix(key, s.Field+".")
+}
+
+// checkStages rejects stages that could read or write outside the tenant's data
+func (s *Scope) checkStages(stages bson.A) error {
+	for _, st := range stages {
+		stage, ok := st.(bson.D)
+		if !ok || len(stage) == 0 {
+			continue
+		}
+		name, spec := stage[0].Key, stage[0].Value
+		switch name {
+		case "$lookup", "$graphLookup", "$unionWith":
+			// Joined collections cannot be scoped by the tenant field
+			if s.Mode == config.TenancyField {
+				return fmt.Errorf("%w: %s is not supported", ErrForbidden, name)
+			}
+		case "$out":
+			// $out replaces the collection of every tenant
+			if s.Mode == config.TenancyField {
+				return fmt.Errorf("%w: $out is not supported", ErrForbidden)
+			}
+		case "$merge":
+			if s.Mode == config.TenancyField {
+				if err := s.checkMerge(spec); err != nil {
+					return err
+				}
+			}
+		case "$facet":
+			if d, ok := spec.(bson.D); ok {
+				for _, e := range d {
+					if sub, ok := e.Value.(bson.A); ok {
+						if err := s.checkStages(sub); err != nil {
+							return err
+						}
+					}
+				}
+			}
+			continue
+		default:
+			continue
+		}
+		if hasDatabase(spec) {
+			return fmt.Errorf("%w: %s may not reference another database", ErrForbidden, name)
+		}
+		if d, ok := spec.(bson.D); ok {
+			for _, e := range d {
+				if sub, ok := e.Value.(bson.A); ok && e.Key == "pipeline" {
+					if err := s.checkStages(sub); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkMerge rejects $merge stages that could write to documents of other
+// tenants: those not matching on the tenant field, and those updating
+// matched documents with a pipeline, which could change it
+func (s *Scope) checkMerge(spec interface{}) error {
+	d, _ := spec.(bson.D)
+	var on []string
+	for _, e := range d {
+		switch e.Key {
+		case "on":
+			switch v := e.Value.(type) {
+			case string:
+				on = append(on, v)
+			case bson.A:
+				for _, f := range v {
+					if f, ok := f.(string); ok {
+						on = append(on, f)
+					}
+				}
+			}
+		case "whenMatched":
+			if _, ok := e.Value.(bson.A); ok {
+				return fmt.Errorf("%w: $merge may not update documents with a pipeline", ErrForbidden)
+			}
+		}
+	}
+	for _, f := range on {
+		if f == s.Field {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: $merge must match on %q", ErrForbidden, s.Field)
+}
+
+// hasDatabase reports whether a stage spec names an explicit database,
+// e.g. {$out: {db: ..., coll: ...}} or {$lookup: {from: {db: ..., coll: ...}}}
+func hasDatabase(spec interface{}) bool {
+	d, ok := spec.(bson.D)
+	if !ok {
+		return false
+	}
+	for _, e := range d {
+		switch e.Key {
+		case "db":
+			return true
+		case "from", "into":
+			if hasDatabase(e.Value) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package tenant
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"mongo-data-api-go-alternative/config"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestDisabled(t *testing.T) {
+	s := NewScope(config.TenancyConfig{Mode: config.TenancyNone}, "acme")
+	doc := bson.M{"a": 1}
+	if s != nil || s.Database("app") != "app" || s.Filter(nil) != nil || !reflect.DeepEqual(s.Document(doc), doc) || s.Update(bson.A{}) != nil {
+		t.Errorf("a nil scope changed the request")
+	}
+}
+
+func TestPrefixMode(t *testing.T) {
+	s := NewScope(config.TenancyConfig{Mode: config.TenancyPrefix}, "acme")
+	if got := s.Database("app"); got != "acme_app" {
+		t.Errorf("database %s", got)
+	}
+	// Documents are left as they are, as the database is the tenant's
+	filter, doc := bson.D{{Key: "a", Value: 1}}, bson.M{"a": 1}
+	if !reflect.DeepEqual(s.Filter(filter), filter) || !reflect.DeepEqual(s.Document(doc), doc) {
+		t.Errorf("filter %v, document %v", s.Filter(filter), s.Document(doc))
+	}
+	if err := s.Update(bson.D{{Key: "$set", Value: bson.D{{Key: "tenantId", Value: "other"}}}}); err != nil {
+		t.Error(err)
+	}
+	if _, err := s.Pipeline(bson.A{bson.D{{Key: "$lookup", Value: bson.D{{Key: "from", Value: bson.D{{Key: "db", Value: "other"}, {Key: "coll", Value: "users"}}}}}}}); !errors.Is(err, ErrForbidden) {
+		t.Errorf("lookup in another database: %v", err)
+	}
+}
+
+func TestFieldMode(t *testing.T) {
+	s := NewScope(config.TenancyConfig{Mode: config.TenancyField, Field: "tenantId"}, "acme")
+	if got := s.Database("app"); got != "app" {
+		t.Errorf("database %s", got)
+	}
+	match := bson.D{{Key: "tenantId", Value: "acme"}}
+	if got := s.Filter(nil); !reflect.DeepEqual(got, match) {
+		t.Errorf("filter %v", got)
+	}
+	filter := bson.D{{Key: "a", Value: 1}}
+	if got := s.Filter(filter); !reflect.DeepEqual(got, bson.D{{Key: "$and", Value: bson.A{filter, match}}}) {
+		t.Errorf("filter %v", got)
+	}
+
+	// Documents of any type are stamped, replacing the tenant they name
+	stamped := bson.D{{Key: "a", Value: int32(1)}, {Key: "tenantId", Value: "acme"}}
+	for _, doc := range []interface{}{
+		bson.D{{Key: "tenantId", Value: "other"}, {Key: "a", Value: int32(1)}},
+		bson.M{"a": int32(1), "tenantId": "other"},
+		map[string]interface{}{"a": int32(1)},
+		struct {
+			A int32 `bson:"a"`
+		}{1},
+	} {
+		if got := s.Document(doc); !reflect.DeepEqual(got, stamped) {
+			t.Errorf("%#v: stamped %v", doc, got)
+		}
+	}
+
+	for _, tc := range []struct {
+		update interface{}
+		err    bool
+	}{
+		{bson.D{{Key: "$set", Value: bson.D{{Key: "a", Value: 1}}}}, false},
+		{bson.M{"$inc": bson.M{"n": 1}}, false},
+		{nil, false},
+		{bson.D{{Key: "$set", Value: bson.D{{Key: "tenantId", Value: "other"}}}}, true},
+		{bson.D{{Key: "$unset", Value: bson.D{{Key: "tenantId.x", Value: ""}}}}, true},
+		{bson.D{{Key: "$rename", Value: bson.D{{Key: "a", Value: "tenantId"}}}}, true},
+		{bson.M{"$set": bson.M{"tenantId": "other"}}, true},
+		{map[string]interface{}{"$set": map[string]interface{}{"tenantId": "other"}}, true},
+		// Pipelines could set the field in ways that aren't checked
+		{bson.A{bson.D{{Key: "$set", Value: bson.D{{Key: "tenantId", Value: "other"}}}}}, true},
+	} {
+		if err := s.Update(tc.update); (err != nil) != tc.err || err != nil && !errors.Is(err, ErrForbidden) {
+			t.Errorf("%v: error %v", tc.update, err)
+		}
+	}
+
+	pipeline, err := s.Pipeline(bson.A{bson.D{{Key: "$merge", Value: bson.D{{Key: "into", Value: "totals"}, {Key: "on", Value: bson.A{"_id", "tenantId"}}}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bson.A{
+		bson.D{{Key: "$match", Value: match}},
+		bson.D{{Key: "$set", Value: match}},
+		bson.D{{Key: "$merge", Value: bson.D{{Key: "into", Value: "totals"}, {Key: "on", Value: bson.A{"_id", "tenantId"}}}}},
+	}
+	if !reflect.DeepEqual(pipeline, want) {
+		t.Errorf("pipeline %v", pipeline)
+	}
+	for _, stage := range []bson.D{
+		{{Key: "$lookup", Value: bson.D{{Key: "from", Value: "users"}}}},
+		{{Key: "$out", Value: "copy"}},
+		{{Key: "$merge", Value: bson.D{{Key: "into", Value: "totals"}}}},
+		{{Key: "$facet", Value: bson.D{{Key: "a", Value: bson.A{bson.D{{Key: "$unionWith", Value: "users"}}}}}}},
+	} {
+		if _, err := s.Pipeline(bson.A{stage}); !errors.Is(err, ErrForbidden) {
+			t.Errorf("%v: error %v", stage, err)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+// Package trafficmirror replays a sample of the requests the API receives to
+// another deployment, such as a staging instance, so that new versions can be
+// load tested with the shape of production traffic
+package trafficmirror
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mongo-data-api-go-alternative/config"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultTimeout       = 10 * time.Second
+	defaultMaxConcurrent = 32
+	// Header marks replayed requests
+	Header = "X-Mirrored-Request"
+)
+
+// readPaths are the POST endpoints that only read
+var readPaths = map[string]bool{
+	"/api/findOne": true, "/api/find": true, "/api/aggregate": true, "/api/export": true,
+	"/api/sql": true, "/api/validateQuery": true, "/api/history": true,
+}
+
+// skippedPaths are not replayed: they depend on state of this deployment,
+// such as sessions and jobs, don't serve data, or stream for as long as the
+// client stays connected
+var skippedPaths = []string{"/api/admin", "/api/health", "/api/sessions", "/api/jobs", "/api/tail"}
+
+// hopHeaders are not forwarded
+var hopHeaders = map[string]bool{
+	"Connection": true, "Keep-Alive": true, "Proxy-Connection": true, "Te": true, "Trailer": true,
+	"Transfer-Encoding": true, "Upgrade": true, "Content-Length": true, "Host": true,
+}
+
+// credentialHeaders carry the client's credentials, which are not forwarded
+var credentialHeaders = map[string]bool{"Apikey": true, "Authorization": true, "Cookie": true}
+
+// Mirror replays requests to the URL of its configuration
+type Mirror struct {
+	cfg    config.TrafficMirrorConfig
+	target string
+	client *http.Client
+	slots  chan struct{}
+
+	mu      sync.Mutex
+	sent    int64
+	failed  int64
+	skipped int64
+	// statuses counts the responses of the target by status code
+	statuses map[int]int64
+}
+
+// Status reports the requests replayed so far
+type Status struct {
+	URL     string  `json:"url"`
+	Percent float64 `json:"percent"`
+	Writes  bool    `json:"writes"`
+	// Sent counts the requests the target answered, by status code in
+	// Statuses, Failed those it didn't answer and Skipped those not replayed
+	// because too many were in flight
+	Sent     int64            `json:"sent"`
+	Failed   int64            `json:"failed"`
+	Skipped  int64            `json:"skipped"`
+	Statuses map[string]int64 `json:"statuses"`
+}
+
+// New creates a mirror for cfg, which must have a URL
+func New(cfg config.TrafficMirrorConfig) *Mirror {
+	timeout, concurrent := time.Duration(cfg.TimeoutMs)*time.Millisecond, cfg.MaxConcurrent
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	if concurrent <= 0 {
+		concurrent = defaultMaxConcurrent
+	}
+	return &Mirror{
+		cfg:      cfg,
+		target:   strings.TrimSuffix(cfg.URL, "/"),
+		client:   &http.Client{Timeout: timeout},
+		slots:    make(chan struct{}, concurrent),
+		statuses: make(map[int]int64),
+	}
+}
+
+// Status returns the counts of replayed requests
+func (m *Mirror) Status() Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := Status{
+		URL:      m.cfg.URL,
+		Percent:  m.cfg.Percent,
+		Writes:   m.cfg.Writes,
+		Sent:     m.sent,
+		Failed:   m.failed,
+		Skipped:  m.skipped,
+		Statuses: make(map[string]int64, len(m.statuses)),
+	}
+	for code, n := range m.statuses {
+		st.Statuses[strconv.Itoa(code)] = n
+	}
+	return st
+}
+
+// Middleware replays a sample of the requests in the background; the
+// request itself is served as usual. It is mounted after the API key
+// middleware, so only authenticated requests are replayed, and they are sent
+// with the key of the configuration instead of the client's credentials.
+func (m *Mirror) Middleware(c *fiber.Ctx) error {
+	if !m.eligible(c) || rand.Float64()*100 >= m.cfg.Percent {
+		return c.Next()
+	}
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		m.mu.Lock()
+		m.skipped++
+		m.mu.Unlock()
+		return c.Next()
+	}
+
+	// The request is copied, as Fiber reuses it once it is answered
+	req, err := http.NewRequest(c.Method(), m.target+withoutToken(c.OriginalURL()), bytes.NewReader(bytes.Clone(c.Body())))
+	if err != nil {
+		<-m.slots
+		return c.Next()
+	}
+	c.Request().Header.VisitAll(func(key, value []byte) {
+		if k := http.CanonicalHeaderKey(string(key)); !hopHeaders[k] && !credentialHeaders[k] {
+			req.Header.Add(k, string(value))
+		}
+	})
+	if m.cfg.APIKey != "" {
+		req.Header.Set("apiKey", m.cfg.APIKey)
+	}
+	req.Header.Set(Header, "true")
+	req.Header.Set(fiber.HeaderXForwardedFor, c.IP())
+
+	go m.send(req)
+	return c.Next()
+}
+
+// eligible reports whether a request may be replayed: a read, or any data
+// request when writes are replayed too
+func (m *Mirror) eligible(c *fiber.Ctx) bool {
+	path := c.Path()
+	if !strings.HasPrefix(path, "/api/") || c.Get(Header) != "" || c.Get("X-Session-Id") != "" {
+		return false
+	}
+	for _, p := range skippedPaths {
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return false
+		}
+	}
+	// Streamed bodies are read by the handler as they arrive
+	if c.Request().IsBodyStream() && c.QueryBool("stream") {
+		return false
+	}
+	switch c.Method() {
+	case fiber.MethodGet, fiber.MethodHead:
+		return true
+	case fiber.MethodPost:
+		return readPaths[path] || m.cfg.Writes
+	default:
+		return m.cfg.Writes
+	}
+}
+
+// withoutToken removes the signed token query parameter from uri
+func withoutToken(uri string) string {
+	path, query, ok := strings.Cut(uri, "?")
+	if !ok {
+		return uri
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil || !values.Has("token") {
+		return uri
+	}
+	values.Del("token")
+	if len(values) == 0 {
+		return path
+	}
+	return path + "?" + values.Encode()
+}
+
+func (m *Mirror) send(req *http.Request) {
+	defer func() { <-m.slots }()
+	res, err := m.client.Do(req)
+	if err == nil {
+		_, err = io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.failed++
+		// Only the first failures are logged, as a down target would fail
+		// every replayed request
+		if m.failed <= 10 {
+			log.Printf("Failed to mirror %s %s: %v", req.Method, req.URL.Path, err)
+		}
+		return
+	}
+	m.sent++
+	m.statuses[res.StatusCode]++
+}
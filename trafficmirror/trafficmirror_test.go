@@ -0,0 +1,127 @@
+package trafficmirror
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"mongo-data-api-go-alternative/config"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestMirror(t *testing.T) {
+	replayed := make(chan *http.Request, 10)
+	bodies := make(chan string, 10)
+	staging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		replayed <- r
+		bodies <- string(body)
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer staging.Close()
+
+	traffic := New(config.TrafficMirrorConfig{URL: staging.URL, Percent: 100, APIKey: "staging_key"})
+	app := fiber.New()
+	app.Use(traffic.Middleware)
+	ok := func(c *fiber.Ctx) error { return c.JSON(fiber.Map{"ok": true}) }
+	app.Post("/api/find", ok)
+	app.Post("/api/insertOne", ok)
+	app.Get("/api/admin/trafficmirror", ok)
+	send := func(method, path, body string) {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("apiKey", "test_key")
+		req.Header.Set("Authorization", "Bearer token")
+		req.Header.Set("X-Request-ID", "1")
+		if res, err := app.Test(req, -1); err != nil || res.StatusCode != fiber.StatusOK {
+			t.Fatalf("%s: %v %v", path, res, err)
+		}
+	}
+
+	find := `{"database":"app","collection":"users","filter":{"a":1}}`
+	send("POST", "/api/find?format=ndjson&token=signed", find)
+	// Writes are not replayed by default, nor are admin requests
+	send("POST", "/api/insertOne", `{"database":"app","collection":"users","document":{}}`)
+	send("GET", "/api/admin/trafficmirror", "")
+
+	select {
+	case r := <-replayed:
+		// The client's credentials are replaced by the key of the target
+		if r.URL.String() != "/api/find?format=ndjson" || r.Header.Get("apiKey") != "staging_key" ||
+			r.Header.Get("Authorization") != "" || r.Header.Get("X-Request-ID") != "1" || r.Header.Get(Header) != "true" {
+			t.Errorf("replayed %s with headers %v", r.URL, r.Header)
+		}
+		if body := <-bodies; body != find {
+			t.Errorf("replayed body %s", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("find was not replayed")
+	}
+
+	var status Status
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		status = traffic.Status()
+		if status.Sent == 1 || time.Now().After(deadline) {
+			break
+		}
+	}
+	if !reflect.DeepEqual(status.Statuses, map[string]int64{"418": 1}) || status.Failed != 0 || len(replayed) != 0 {
+		t.Errorf("status %+v, %d more replayed", status, len(replayed))
+	}
+}
+
+func TestEligible(t *testing.T) {
+	for _, tc := range []struct {
+		method, path string
+		header       string
+		writes, want bool
+	}{
+		{"GET", "/api/collections/app/users/1", "", false, true},
+		{"POST", "/api/aggregate", "", false, true},
+		{"POST", "/api/updateOne", "", false, false},
+		{"POST", "/api/updateOne", "", true, true},
+		{"DELETE", "/api/data/app/users/1", "", false, false},
+		{"POST", "/api/find", Header, false, false},
+		{"POST", "/api/find", "X-Session-Id", false, false},
+		{"POST", "/api/sessions/1/commit", "", true, false},
+		{"GET", "/api/jobs/1", "", false, false},
+		{"POST", "/api/tail", "", true, false},
+		{"GET", "/metrics", "", false, false},
+	} {
+		m := New(config.TrafficMirrorConfig{URL: "http://staging", Percent: 100, Writes: tc.writes})
+		app := fiber.New()
+		var got bool
+		app.Use(func(c *fiber.Ctx) error {
+			got = m.eligible(c)
+			return c.SendStatus(fiber.StatusNoContent)
+		})
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.header != "" {
+			req.Header.Set(tc.header, "1")
+		}
+		if _, err := app.Test(req, -1); err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("%s %s (header %q, writes %v): eligible %v, want %v", tc.method, tc.path, tc.header, tc.writes, got, tc.want)
+		}
+	}
+}
+
+func TestWithoutToken(t *testing.T) {
+	for uri, want := range map[string]string{
+		"/api/find":                       "/api/find",
+		"/api/find?format=ndjson":         "/api/find?format=ndjson",
+		"/api/find?token=t":               "/api/find",
+		"/api/find?token=t&format=ndjson": "/api/find?format=ndjson",
+	} {
+		if got := withoutToken(uri); got != want {
+			t.Errorf("withoutToken(%q) = %q, want %q", uri, got, want)
+		}
+	}
+}
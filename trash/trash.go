@@ -0,0 +1,297 @@
+// Package trash moves the documents deleted from some collections to a
+// trash collection of their database instead of destroying them, so that
+// they can be restored until they are purged
+package trash
+
+import (
+	"context"
+	"errors"
+	"log"
+	"path"
+	"sync"
+	"time"
+
+	"mongo-data-api-go-alternative/config"
+	"mongo-data-api-go-alternative/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultCollection    = "_trash"
+	defaultRetentionDays = 30
+	// batchSize is the number of documents deleteMany moves at once
+	batchSize = 1000
+	// attempts bounds the retries of a deleteOne whose document changed
+	// between being read and deleted
+	attempts = 3
+	// indexTimeout bounds creating the TTL index of a trash collection
+	indexTimeout = 30 * time.Second
+)
+
+// Store is a data store whose deletes from trashed collections first copy
+// the documents to the trash collection of the database. A trash entry
+// holds the document, its documentId, the database and collection it was
+// deleted from, the API key that deleted it as client, the X-Request-ID of
+// the request as requestId and when it was deleted as deletedAt, which a
+// TTL index purges entries by.
+type Store struct {
+	db.DataStore
+	patterns   []string
+	collection string
+	retention  int64
+	prefixed   bool
+	// indexed holds the databases whose trash has its TTL index
+	indexed sync.Map
+}
+
+var _ db.DataStore = (*Store)(nil)
+
+// New moves the documents deleted from the collections matching cfg to the
+// trash. With prefixed, databases are tenant prefixed, so a pattern matches
+// the database of every tenant.
+func New(store db.DataStore, cfg config.TrashConfig, prefixed bool) *Store {
+	collection, days := cfg.Collection, cfg.RetentionDays
+	if collection == "" {
+		collection = defaultCollection
+	}
+	if days <= 0 {
+		days = defaultRetentionDays
+	}
+	return &Store{
+		DataStore:  store,
+		patterns:   cfg.Collections,
+		collection: collection,
+		retention:  int64(days) * 24 * 3600,
+		prefixed:   prefixed,
+	}
+}
+
+// StartSession starts a session of the underlying store, so that documents
+// are moved in the transaction of the delete
+func (s *Store) StartSession(causal bool) (db.Session, error) {
+	starter, ok := s.DataStore.(db.SessionStarter)
+	if !ok {
+		return nil, db.ErrSessionsUnsupported
+	}
+	return starter.StartSession(causal)
+}
+
+// StartSnapshot starts a snapshot session of the underlying store
+func (s *Store) StartSnapshot() (db.Session, error) {
+	starter, ok := s.DataStore.(db.SnapshotStarter)
+	if !ok {
+		return nil, db.ErrSessionsUnsupported
+	}
+	return starter.StartSnapshot()
+}
+
+// Collection returns the name of the trash collection of each database
+func (s *Store) Collection() string {
+	return s.collection
+}
+
+// Enabled reports whether the deletes from collection of the physical
+// database are moved to the trash. Deletes from the trash itself are not.
+func (s *Store) Enabled(database, collection string) bool {
+	if collection == s.collection {
+		return false
+	}
+	if s.matches(database + "." + collection) {
+		return true
+	}
+	if !s.prefixed {
+		return false
+	}
+	// Tenant IDs may contain underscores themselves
+	for i, r := range database {
+		if r == '_' && s.matches(database[i+1:]+"."+collection) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Store) matches(ns string) bool {
+	for _, pattern := range s.patterns {
+		if ok, _ := path.Match(pattern, ns); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// DeleteOne moves the document it deletes to the trash. The document is
+// read and moved first, then deleted by its _id.
+func (s *Store) DeleteOne(ctx context.Context, database, collection string, filter interface{}) (*mongo.DeleteResult, error) {
+	if !s.Enabled(database, collection) {
+		return s.DataStore.DeleteOne(ctx, database, collection, filter)
+	}
+	res := &mongo.DeleteResult{}
+	for attempt := 0; attempt < attempts && res.DeletedCount == 0; attempt++ {
+		doc, err := s.DataStore.FindOne(ctx, database, collection, orEmpty(filter), nil)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return res, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries, err := s.move(ctx, database, collection, []bson.M{doc})
+		if err != nil {
+			return nil, err
+		}
+		res, err = s.DataStore.DeleteOne(ctx, database, collection, pinned(filter, bson.D{{Key: "_id", Value: doc["_id"]}}))
+		if err != nil || res.DeletedCount == 0 {
+			// Changed or deleted meanwhile
+			s.discard(ctx, database, entries)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// DeleteMany moves the documents it deletes to the trash, in batches that
+// are read and moved, then deleted by their _ids
+func (s *Store) DeleteMany(ctx context.Context, database, collection string, filter interface{}) (*mongo.DeleteResult, error) {
+	if !s.Enabled(database, collection) {
+		return s.DataStore.DeleteMany(ctx, database, collection, filter)
+	}
+	res := &mongo.DeleteResult{}
+	for {
+		docs, err := s.DataStore.Find(ctx, database, collection, orEmpty(filter), options.Find().SetLimit(batchSize))
+		if err != nil {
+			return nil, err
+		}
+		if len(docs) == 0 {
+			return res, nil
+		}
+		entries, err := s.move(ctx, database, collection, docs)
+		if err != nil {
+			return nil, err
+		}
+		ids := make(bson.A, len(docs))
+		for i, doc := range docs {
+			ids[i] = doc["_id"]
+		}
+		deleted, err := s.DataStore.DeleteMany(ctx, database, collection, pinned(filter, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}}))
+		if err != nil {
+			s.discard(ctx, database, entries)
+			return nil, err
+		}
+		res.DeletedCount += deleted.DeletedCount
+		if deleted.DeletedCount < int64(len(docs)) {
+			s.discardKept(ctx, database, collection, docs, entries)
+		}
+		if deleted.DeletedCount == 0 || len(docs) < batchSize {
+			return res, nil
+		}
+	}
+}
+
+// move inserts trash entries for documents and returns their _ids
+func (s *Store) move(ctx context.Context, database, collection string, documents []bson.M) (bson.A, error) {
+	s.ensureIndex(database)
+	client, _ := db.ClientFromContext(ctx)
+	requestID, _ := db.RequestIDFromContext(ctx)
+	now := time.Now().UTC()
+	entries := make([]interface{}, len(documents))
+	ids := make(bson.A, len(documents))
+	for i, doc := range documents {
+		id := primitive.NewObjectID()
+		entry := bson.D{
+			{Key: "_id", Value: id},
+			{Key: "database", Value: database},
+			{Key: "collection", Value: collection},
+			{Key: "documentId", Value: doc["_id"]},
+			{Key: "document", Value: doc},
+		}
+		if client != "" {
+			entry = append(entry, bson.E{Key: "client", Value: client})
+		}
+		if requestID != "" {
+			entry = append(entry, bson.E{Key: "requestId", Value: requestID})
+		}
+		entries[i], ids[i] = append(entry, bson.E{Key: "deletedAt", Value: now}), id
+	}
+	if _, err := s.DataStore.InsertMany(ctx, database, s.collection, entries); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// discard removes trash entries of documents that were not deleted
+func (s *Store) discard(ctx context.Context, database string, entries bson.A) {
+	if _, err := s.DataStore.DeleteMany(ctx, database, s.collection, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: entries}}}}); err != nil {
+		log.Printf("Failed to discard %d trash entries of %s: %v", len(entries), database, err)
+	}
+}
+
+// discardKept discards the entries of the documents of a batch that still
+// exist, as they changed meanwhile and no longer matched the delete
+func (s *Store) discardKept(ctx context.Context, database, collection string, docs []bson.M, entries bson.A) {
+	ids := make(bson.A, len(docs))
+	for i, doc := range docs {
+		ids[i] = doc["_id"]
+	}
+	kept, err := s.DataStore.Find(ctx, database, collection, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}}, options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		log.Printf("Failed to find the documents of %s.%s that were not deleted: %v", database, collection, err)
+		return
+	}
+	var discarded bson.A
+	for _, doc := range kept {
+		for i, d := range docs {
+			if idKey(d["_id"]) == idKey(doc["_id"]) {
+				discarded = append(discarded, entries[i])
+			}
+		}
+	}
+	if len(discarded) > 0 {
+		s.discard(ctx, database, discarded)
+	}
+}
+
+// ensureIndex creates the TTL index purging the trash of database, once
+// per process, or updates its expiry when the retention changed. It runs
+// outside the session of the delete, as indexes cannot be created in most
+// transactions.
+func (s *Store) ensureIndex(database string) {
+	if _, done := s.indexed.LoadOrStore(database, true); done {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), indexTimeout)
+	defer cancel()
+	index := db.Index{Keys: bson.D{{Key: "deletedAt", Value: 1}}, ExpireAfterSeconds: &s.retention}
+	if _, err := s.DataStore.CreateIndex(ctx, database, s.collection, index); err != nil {
+		if err := s.DataStore.SetIndexExpiry(ctx, database, s.collection, "deletedAt_1", s.retention); err != nil {
+			s.indexed.Delete(database)
+			log.Printf("Failed to create the TTL index of %s.%s: %v", database, s.collection, err)
+		}
+	}
+}
+
+// pinned restricts filter to the documents matching pin
+func pinned(filter interface{}, pin bson.D) bson.D {
+	return bson.D{{Key: "$and", Value: bson.A{orEmpty(filter), pin}}}
+}
+
+func orEmpty(filter interface{}) interface{} {
+	if filter == nil {
+		return bson.D{}
+	}
+	return filter
+}
+
+// idKey identifies an _id by its BSON encoding
+func idKey(id interface{}) string {
+	t, data, err := bson.MarshalValue(id)
+	if err != nil {
+		return ""
+	}
+	return string(rune(t)) + string(data)
+}
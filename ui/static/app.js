@@ -0,0 +1,233 @@
+'use strict';
+
+const $ = (id) => document.getElementById(id);
+
+// Credentials are kept in sessionStorage so they are gone when the tab closes
+const creds = {
+  get admin() { return sessionStorage.getItem('adminKey') || ''; },
+  get api() { return sessionStorage.getItem('apiKey') || ''; },
+};
+
+// The API may be mounted under a sub-path; the UI is always served at <base>/admin
+const base = location.pathname.replace(/\/admin(\/.*)?$/, '');
+
+async function request(method, path, body, headers) {
+  const res = await fetch(path, {
+    method,
+    headers: Object.assign({ 'Content-Type': 'application/json' }, headers),
+    body: body === undefined ? undefined : JSON.stringify(body),
+  });
+  const text = await res.text();
+  let data;
+  try { data = JSON.parse(text); } catch (e) { data = text; }
+  if (!res.ok) {
+    const msg = (data && (data.error || data.message)) || res.statusText;
+    throw new Error(res.status + ': ' + msg);
+  }
+  return data;
+}
+
+const admin = (method, path, body) => request(method, base + '/api/admin' + path, body, { adminKey: creds.admin });
+const data = (op, body) => request('POST', base + '/api/' + op, body, { apiKey: creds.api });
+
+function show(el, value) {
+  el.textContent = typeof value === 'string' ? value : JSON.stringify(value, null, 2);
+}
+
+function listItems(el, items, onClick) {
+  el.innerHTML = '';
+  items.forEach((item) => {
+    const li = document.createElement('li');
+    li.textContent = item;
+    li.addEventListener('click', () => {
+      el.querySelectorAll('li').forEach((n) => n.classList.remove('selected'));
+      li.classList.add('selected');
+      onClick(item);
+    });
+    el.appendChild(li);
+  });
+}
+
+// Tabs
+
+document.querySelectorAll('nav button').forEach((btn) => {
+  btn.addEventListener('click', () => {
+    document.querySelectorAll('nav button, .tab').forEach((n) => n.classList.remove('active'));
+    btn.classList.add('active');
+    $(btn.dataset.tab).classList.add('active');
+    loaders[btn.dataset.tab]();
+  });
+});
+
+$('adminKey').value = creds.admin;
+$('apiKey').value = creds.api;
+$('credentials').addEventListener('submit', (e) => {
+  e.preventDefault();
+  sessionStorage.setItem('adminKey', $('adminKey').value);
+  sessionStorage.setItem('apiKey', $('apiKey').value);
+  loaders[document.querySelector('nav button.active').dataset.tab]();
+});
+
+// Collections
+
+async function loadDatabases() {
+  try {
+    const res = await admin('GET', '/databases');
+    listItems($('databaseList'), res.databases, loadCollections);
+  } catch (err) {
+    show($('collectionPreview'), err.message);
+  }
+}
+
+async function loadCollections(database) {
+  try {
+    const res = await admin('GET', '/databases/' + encodeURIComponent(database) + '/collections');
+    listItems($('collectionList'), res.collections, (coll) => previewCollection(database, coll));
+  } catch (err) {
+    show($('collectionPreview'), err.message);
+  }
+}
+
+async function previewCollection(database, collection) {
+  $('queryDatabase').value = database;
+  $('queryCollection').value = collection;
+  if (!creds.api) {
+    show($('collectionPreview'), 'Enter an API key to preview documents.');
+    return;
+  }
+  try {
+    show($('collectionPreview'), await data('find', { database, collection, filter: {}, limit: 20 }));
+  } catch (err) {
+    show($('collectionPreview'), err.message);
+  }
+}
+
+// Query
+
+$('queryForm').addEventListener('submit', async (e) => {
+  e.preventDefault();
+  let body;
+  try {
+    body = JSON.parse($('queryBody').value || '{}');
+  } catch (err) {
+    show($('queryOutput'), 'Invalid JSON: ' + err.message);
+    return;
+  }
+  body.database = $('queryDatabase').value;
+  body.collection = $('queryCollection').value;
+  const started = performance.now();
+  try {
+    const res = await data($('queryOperation').value, body);
+    show($('queryOutput'), res);
+    $('queryOutput').textContent += '\n\n(' + Math.round(performance.now() - started) + ' ms)';
+  } catch (err) {
+    show($('queryOutput'), err.message);
+  }
+});
+
+// Metrics
+
+function parseLabels(s) {
+  const labels = {};
+  s.replace(/(\w+)="([^"]*)"/g, (_, k, v) => { labels[k] = v; });
+  return labels;
+}
+
+async function loadMetrics() {
+  const text = await (await fetch(base + '/metrics')).text();
+  const rows = {};
+  text.split('\n').forEach((line) => {
+    const m = line.match(/^mongodataapi_http_(requests_total|request_duration_seconds_sum)\{(.*)\} (\S+)$/);
+    if (!m) return;
+    const l = parseLabels(m[2]);
+    const key = [l.method, l.path, l.status_code].join(' ');
+    rows[key] = rows[key] || { method: l.method, path: l.path, status: l.status_code, count: 0, sum: 0 };
+    if (m[1] === 'requests_total') rows[key].count = Number(m[3]);
+    else rows[key].sum = Number(m[3]);
+  });
+
+  const tbody = $('metricsTable');
+  tbody.innerHTML = '';
+  Object.values(rows).sort((a, b) => b.count - a.count).forEach((r) => {
+    const tr = document.createElement('tr');
+    const avg = r.count ? (r.sum / r.count * 1000).toFixed(1) : '-';
+    [r.method, r.path, r.status, r.count, avg].forEach((v) => {
+      const td = document.createElement('td');
+      td.textContent = v;
+      tr.appendChild(td);
+    });
+    tbody.appendChild(tr);
+  });
+}
+
+$('refreshMetrics').addEventListener('click', loadMetrics);
+
+// API keys
+
+const csv = (s) => s.split(',').map((v) => v.trim()).filter(Boolean);
+
+async function loadKeys() {
+  const tbody = $('keysTable');
+  tbody.innerHTML = '';
+  let res;
+  try {
+    res = await admin('GET', '/keys');
+  } catch (err) {
+    show($('keyCreated'), err.message);
+    $('keyCreated').classList.remove('hidden');
+    return;
+  }
+  res.keys.forEach((k) => {
+    const tr = document.createElement('tr');
+    [k.name, k.key, k.tenant || '', (k.roles || []).join(', '), (k.namespaces || []).join(', '), k.rateLimit || '']
+      .forEach((v) => {
+        const td = document.createElement('td');
+        td.textContent = v;
+        tr.appendChild(td);
+      });
+    const td = document.createElement('td');
+    if (!k.static) {
+      const btn = document.createElement('button');
+      btn.textContent = 'Revoke';
+      btn.addEventListener('click', async () => {
+        if (!confirm('Revoke key ' + k.name + '?')) return;
+        await admin('DELETE', '/keys/' + encodeURIComponent(k.name));
+        loadKeys();
+      });
+      td.appendChild(btn);
+    } else {
+      td.textContent = 'config';
+    }
+    tr.appendChild(td);
+    tbody.appendChild(tr);
+  });
+}
+
+$('keyForm').addEventListener('submit', async (e) => {
+  e.preventDefault();
+  const body = {
+    name: $('keyName').value,
+    tenant: $('keyTenant').value,
+    roles: csv($('keyRoles').value),
+    namespaces: csv($('keyNamespaces').value),
+    rateLimit: Number($('keyRateLimit').value) || 0,
+  };
+  try {
+    const res = await admin('POST', '/keys', body);
+    show($('keyCreated'), 'Created key ' + res.key.name + '. Copy the secret now, it will not be shown again:\n' + res.key.key);
+    e.target.reset();
+  } catch (err) {
+    show($('keyCreated'), err.message);
+  }
+  $('keyCreated').classList.remove('hidden');
+  loadKeys();
+});
+
+const loaders = {
+  collections: loadDatabases,
+  query: () => {},
+  metrics: loadMetrics,
+  keys: loadKeys,
+};
+
+loadDatabases();
@@ -0,0 +1,22 @@
+package ui
+
+import (
+	"embed"
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/filesystem"
+)
+
+//go:embed static
+var static embed.FS
+
+// Handler serves the embedded admin UI. The UI itself is public; every call
+// it makes is authenticated with the admin or API key entered by the user.
+func Handler() fiber.Handler {
+	return filesystem.New(filesystem.Config{
+		Root:       http.FS(static),
+		PathPrefix: "static",
+		Index:      "index.html",
+	})
+}
@@ -0,0 +1,115 @@
+// Package warmup runs representative queries with limit 1, so that MongoDB
+// has their plans cached and the proxy open connections before traffic
+// arrives, after a deploy or a failover.
+package warmup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"mongo-data-api-go-alternative/config"
+	"mongo-data-api-go-alternative/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Result reports how a warm query ran
+type Result struct {
+	Database   string  `json:"database"`
+	Collection string  `json:"collection"`
+	Operation  string  `json:"operation"`
+	DurationMS float64 `json:"durationMs"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// Warmer runs the configured warm queries
+type Warmer struct {
+	Store   db.DataStore
+	Queries []config.WarmQuery
+}
+
+// Run runs every query in order, continuing past failures
+func (w *Warmer) Run(ctx context.Context) []Result {
+	results := make([]Result, len(w.Queries))
+	for i, q := range w.Queries {
+		results[i] = w.run(ctx, q)
+	}
+	return results
+}
+
+func (w *Warmer) run(ctx context.Context, q config.WarmQuery) Result {
+	res := Result{Database: q.Database, Collection: q.Collection, Operation: "find"}
+	start := time.Now()
+	var err error
+	if len(q.Pipeline) > 0 {
+		res.Operation = "aggregate"
+		var pipeline bson.A
+		if pipeline, err = pipelineOf(q); err == nil {
+			_, err = w.Store.Aggregate(ctx, q.Database, q.Collection, pipeline, options.Aggregate())
+		}
+	} else {
+		var filter bson.D
+		if filter, err = extJSON(q.Filter); err == nil {
+			opts := options.Find().SetLimit(1)
+			if sort := sortOf(q.Sort); len(sort) > 0 {
+				opts.SetSort(sort)
+			}
+			_, err = w.Store.Find(ctx, q.Database, q.Collection, filter, opts)
+		}
+	}
+	res.DurationMS = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// pipelineOf returns the pipeline of q followed by a $limit of 1
+func pipelineOf(q config.WarmQuery) (bson.A, error) {
+	pipeline := make(bson.A, 0, len(q.Pipeline)+1)
+	for i, stage := range q.Pipeline {
+		d, err := extJSON(stage)
+		if err != nil {
+			return nil, fmt.Errorf("stage %d: %w", i, err)
+		}
+		pipeline = append(pipeline, d)
+	}
+	return append(pipeline, bson.D{{Key: "$limit", Value: 1}}), nil
+}
+
+// extJSON converts a configured value to a document
+func extJSON(v map[string]interface{}) (bson.D, error) {
+	if v == nil {
+		return bson.D{}, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var d bson.D
+	if err := bson.UnmarshalExtJSON(data, false, &d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// sortOf parses "name,-age" into a sort by name ascending, then age
+// descending
+func sortOf(s string) bson.D {
+	var sort bson.D
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		switch {
+		case f == "" || f == "-":
+		case strings.HasPrefix(f, "-"):
+			sort = append(sort, bson.E{Key: f[1:], Value: -1})
+		default:
+			sort = append(sort, bson.E{Key: f, Value: 1})
+		}
+	}
+	return sort
+}